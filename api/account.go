@@ -0,0 +1,98 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/models"
+)
+
+// accountRequest sends an authenticated request about the account of a registration and decodes
+// the account from the response.
+//
+// Parameters:
+//   - method: string - The HTTP method.
+//   - accountData: models.AccountData - The registration, only ID and Token are used.
+//   - body: any - The JSON request body, nil for none.
+//
+// Returns:
+//   - models.Account: The account returned by the API.
+//   - *models.APIError: The errors reported by the API, if it answered with one.
+//   - error: An error if the request fails.
+func accountRequest(method string, accountData models.AccountData, body any) (models.Account, *models.APIError, error) {
+	var jsonData []byte
+	if body != nil {
+		var err error
+		if jsonData, err = json.Marshal(body); err != nil {
+			return models.Account{}, nil, fmt.Errorf("failed to marshal json: %v", err)
+		}
+	}
+
+	resp, err := sendAPIRequest(func() (*http.Request, error) {
+		var reqBody io.Reader
+		if jsonData != nil {
+			reqBody = bytes.NewReader(jsonData)
+		}
+		req, err := http.NewRequest(method, internal.ApiUrl+"/"+internal.ApiVersion+"/reg/"+accountData.ID+"/account", reqBody)
+		if err == nil {
+			req.Header.Set("Authorization", "Bearer "+accountData.Token)
+		}
+		return req, err
+	})
+	if err != nil {
+		return models.Account{}, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return models.Account{}, nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr models.APIError
+		if err := json.Unmarshal(respBody, &apiErr); err != nil {
+			return models.Account{}, nil, fmt.Errorf("failed to request account: %s", resp.Status)
+		}
+		return models.Account{}, &apiErr, fmt.Errorf("failed to request account: %s", resp.Status)
+	}
+
+	var account models.Account
+	if err := json.Unmarshal(respBody, &account); err != nil {
+		return models.Account{}, nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return account, nil, nil
+}
+
+// GetAccount fetches the account of a registration: its type, WARP+ status, data quota and license.
+//
+// Parameters:
+//   - accountData: models.AccountData - The registration, only ID and Token are used.
+//
+// Returns:
+//   - models.Account: The account.
+//   - *models.APIError: The errors reported by the API, if it answered with one.
+//   - error: An error if the request fails.
+func GetAccount(accountData models.AccountData) (models.Account, *models.APIError, error) {
+	return accountRequest("GET", accountData, nil)
+}
+
+// SetLicense attaches the registration to the account of a license key, e.g. a WARP+ key
+// from the official app. The previous account of the registration is left behind.
+//
+// Parameters:
+//   - accountData: models.AccountData - The registration, only ID and Token are used.
+//   - license: string - The license key.
+//
+// Returns:
+//   - models.Account: The account the registration is now attached to.
+//   - *models.APIError: The errors reported by the API, if it answered with one.
+//   - error: An error if the request fails or the key is refused.
+func SetLicense(accountData models.AccountData, license string) (models.Account, *models.APIError, error) {
+	return accountRequest("PUT", accountData, models.LicenseUpdate{License: license})
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// RejectedReconnectDelay is the shortest wait after the server rejected the registration or
+	// rate limited the client. Retrying those right away only gets the device rate limited further.
+	// Every further rejection in a row doubles it, up to MaxReconnectDelay.
+	RejectedReconnectDelay = 30 * time.Second
+	// MaxReconnectDelay is the longest wait between reconnect attempts.
+	MaxReconnectDelay = 5 * time.Minute
+)
+
+// reconnectBackoff returns how long MaintainTunnel waits before the next attempt, depending on
+// why the last one failed. Reconnects the client asked for happen right away, as do ones after
+// network changes, which also cut short any wait. Failed handshakes and lost connections wait
+// reconnectDelay. Rejected registrations and rate limits wait at least RejectedReconnectDelay,
+// or as long as the server asks for with Retry-After.
+//
+// Parameters:
+//   - reason: string - The Reconnect* reason of the failure.
+//   - rsp: *http.Response - The response to CONNECT, nil if there was none.
+//   - reconnectDelay: time.Duration - The wait after transient failures.
+//   - rejections: int - The rejections in a row, including this one.
+//
+// Returns:
+//   - time.Duration: The wait before the next attempt.
+func reconnectBackoff(reason string, rsp *http.Response, reconnectDelay time.Duration, rejections int) time.Duration {
+	switch reason {
+	case ReconnectNetworkChanged, ReconnectRequested, ReconnectShutdown:
+		return 0
+	case ReconnectRejected:
+		if rsp != nil && rsp.StatusCode == http.StatusTooManyRequests {
+			if after := retryAfter(rsp); after > 0 {
+				return min(after, MaxReconnectDelay)
+			}
+		} else if rsp != nil && !registrationRejected(rsp, nil) {
+			// e.g. a 502 of an overloaded node
+			return reconnectDelay
+		}
+		delay := max(reconnectDelay, RejectedReconnectDelay)
+		return min(delay<<min(max(rejections-1, 0), 8), MaxReconnectDelay)
+	}
+	return reconnectDelay
+}
+
+// retryAfter returns the wait a Retry-After header asks for, 0 if there is none.
+func retryAfter(rsp *http.Response) time.Duration {
+	value := rsp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	status := func(code int, retryAfter string) *http.Response {
+		rsp := &http.Response{StatusCode: code, Header: http.Header{}}
+		if retryAfter != "" {
+			rsp.Header.Set("Retry-After", retryAfter)
+		}
+		return rsp
+	}
+	const delay = time.Second
+
+	tests := []struct {
+		name       string
+		reason     string
+		rsp        *http.Response
+		rejections int
+		want       time.Duration
+	}{
+		{"network changed", ReconnectNetworkChanged, nil, 0, 0},
+		{"requested", ReconnectRequested, nil, 0, 0},
+		{"shutdown", ReconnectShutdown, nil, 0, 0},
+		{"connect failed", ReconnectConnectFailed, nil, 0, delay},
+		{"idle timeout", ReconnectIdleTimeout, nil, 0, delay},
+		{"TLS rejection", ReconnectRejected, nil, 1, RejectedReconnectDelay},
+		{"unauthorized", ReconnectRejected, status(http.StatusUnauthorized, ""), 1, RejectedReconnectDelay},
+		{"second rejection", ReconnectRejected, status(http.StatusForbidden, ""), 2, 2 * RejectedReconnectDelay},
+		{"third rejection", ReconnectRejected, status(http.StatusForbidden, ""), 3, 4 * RejectedReconnectDelay},
+		{"capped", ReconnectRejected, status(http.StatusForbidden, ""), 20, MaxReconnectDelay},
+		{"rate limited", ReconnectRejected, status(http.StatusTooManyRequests, ""), 2, 2 * RejectedReconnectDelay},
+		{"rate limited with Retry-After", ReconnectRejected, status(http.StatusTooManyRequests, "90"), 5, 90 * time.Second},
+		{"Retry-After capped", ReconnectRejected, status(http.StatusTooManyRequests, "3600"), 1, MaxReconnectDelay},
+		{"invalid Retry-After", ReconnectRejected, status(http.StatusTooManyRequests, "soon"), 1, RejectedReconnectDelay},
+		{"bad gateway", ReconnectRejected, status(http.StatusBadGateway, ""), 0, delay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reconnectBackoff(tt.reason, tt.rsp, delay, tt.rejections); got != tt.want {
+				t.Errorf("reconnectBackoff = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+const (
+	// BlocklistThreshold is the number of connections in a row without data after which
+	// an endpoint is blocked.
+	BlocklistThreshold = 2
+	// BlocklistBaseDuration is how long an endpoint is blocked the first time. Every further
+	// block doubles it, up to BlocklistMaxDuration.
+	BlocklistBaseDuration = time.Hour
+	// BlocklistMaxDuration is the longest an endpoint is blocked at once.
+	BlocklistMaxDuration = 24 * time.Hour
+	// blocklistDecay is how long after a block expired one doubling of the next block is forgiven.
+	blocklistDecay = 24 * time.Hour
+	// deadConnectionPackets is the number of packets sent without a single one received
+	// that makes a connection count as one without data.
+	deadConnectionPackets = 10
+)
+
+// blocklistEntry is the state of an endpoint in a Blocklist.
+type blocklistEntry struct {
+	Dead  int       `json:"dead"`           // Connections in a row without data
+	Level int       `json:"level"`          // Number of blocks, the next one lasts BlocklistBaseDuration << Level
+	Until time.Time `json:"until,omitzero"` // End of the current or last block
+}
+
+// Blocklist keeps endpoints that accept connections but pass no data, e.g. a broken node
+// behind an anycast address, away from the rotation of EndpointList for hours instead of the
+// minutes of a FailureCache. Blocks get longer each time and shorter again while the endpoint
+// isn't blocked, so a node that was fixed is used again eventually. The list can be persisted,
+// so a restart doesn't pick the same broken node again.
+// It is safe for concurrent use.
+type Blocklist struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*blocklistEntry
+}
+
+// NewBlocklist creates a new empty Blocklist that isn't persisted.
+func NewBlocklist() *Blocklist {
+	return &Blocklist{entries: map[string]*blocklistEntry{}}
+}
+
+// Load reads the blocklist from a file and saves it there on every change from now on.
+// A missing file is an empty blocklist.
+//
+// Parameters:
+//   - path: string - The path of the file.
+//
+// Returns:
+//   - error: An error if the file can't be read or parsed.
+func (b *Blocklist) Load(path string) error {
+	entries := map[string]*blocklistEntry{}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read blocklist: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return fmt.Errorf("failed to parse blocklist: %v", err)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.path, b.entries = path, entries
+	return nil
+}
+
+// Blocked reports whether an endpoint is blocked right now.
+func (b *Blocklist) Blocked(endpoint *net.UDPAddr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.entries[endpoint.String()]
+	return ok && time.Now().Before(entry.Until)
+}
+
+// ReportDead records a connection to an endpoint that carried no data, and blocks the endpoint
+// once that happened BlocklistThreshold times in a row.
+//
+// Parameters:
+//   - endpoint: *net.UDPAddr - The endpoint of the connection.
+//
+// Returns:
+//   - time.Duration: How long the endpoint is blocked, 0 if it isn't.
+func (b *Blocklist) ReportDead(endpoint *net.UDPAddr) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := b.entries[endpoint.String()]
+	if !ok {
+		entry = &blocklistEntry{}
+		b.entries[endpoint.String()] = entry
+	}
+	entry.decay(now)
+	entry.Dead++
+	var blocked time.Duration
+	if entry.Dead >= BlocklistThreshold {
+		blocked = min(BlocklistBaseDuration<<min(entry.Level, 16), BlocklistMaxDuration)
+		entry.Dead = 0
+		entry.Level++
+		entry.Until = now.Add(blocked)
+	}
+	b.save()
+	return blocked
+}
+
+// ReportHealthy records a connection to an endpoint that carried data.
+func (b *Blocklist) ReportHealthy(endpoint *net.UDPAddr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[endpoint.String()]
+	if !ok {
+		return
+	}
+	entry.decay(time.Now())
+	entry.Dead = 0
+	if entry.Level == 0 {
+		delete(b.entries, endpoint.String())
+	}
+	b.save()
+}
+
+// decay forgives one doubling for every blocklistDecay since the last block expired.
+func (e *blocklistEntry) decay(now time.Time) {
+	if e.Level == 0 || e.Until.IsZero() || now.Before(e.Until) {
+		return
+	}
+	forgiven := int(now.Sub(e.Until) / blocklistDecay)
+	e.Level = max(e.Level-forgiven, 0)
+	e.Until = e.Until.Add(time.Duration(forgiven) * blocklistDecay)
+}
+
+// save writes the blocklist to its file, if it has one. b.mu must be held.
+func (b *Blocklist) save() {
+	if b.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(b.entries, "", "  ")
+	if err == nil {
+		err = internal.WriteFileAtomic(b.path, data, 0600)
+	}
+	if err != nil {
+		logFor(componentTunnel).Warn("Failed to save endpoint blocklist", "path", b.path, "error", err)
+	}
+}
+
+// judgeEndpoint reports a connection that ended to the Blocklist of the tunnel. It carried data if anything
+// was received, and none if at least deadConnectionPackets were sent without an answer. Connections
+// that sent less, or ended for a reason on this side, e.g. a device error or a requested reconnect,
+// say nothing about the endpoint.
+//
+// Parameters:
+//   - endpoint: *net.UDPAddr - The endpoint of the connection.
+//   - reason: string - The Reconnect* reason the connection ended for.
+//   - sent: uint64 - The packets sent over the connection.
+//   - received: uint64 - The packets received over the connection.
+func (t *Tunnel) judgeEndpoint(endpoint *net.UDPAddr, reason string, sent, received uint64) {
+	switch {
+	case received > 0:
+		t.Blocklist.ReportHealthy(endpoint)
+	case reason != ReconnectIdleTimeout && reason != ReconnectClosedByPeer:
+	case sent >= deadConnectionPackets:
+		if blocked := t.Blocklist.ReportDead(endpoint); blocked > 0 {
+			logFor(componentTunnel).Warn("Blocking endpoint that passes no data", "endpoint", endpoint, "duration", blocked)
+		} else {
+			logFor(componentTunnel).Warn("Connection passed no data", "endpoint", endpoint, "sent", sent)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrChaosInjected is returned by ChaosDevice when it forces a transport error.
+var ErrChaosInjected = errors.New("chaos: injected transport error")
+
+// ChaosConfig describes the faults a ChaosDevice injects. Meant for testing only.
+type ChaosConfig struct {
+	LossRate      float64       // Probability (0-1) of dropping a packet in either direction
+	DuplicateRate float64       // Probability (0-1) of duplicating a packet written to the device
+	Delay         time.Duration // Fixed delay added to every packet
+	Jitter        time.Duration // Random extra delay (0-Jitter) added to every packet
+	ErrorInterval time.Duration // Force a transport error (and thus a reconnect) this often
+	Seed          int64         // Seed for the random source, so runs are reproducible
+}
+
+// Enabled reports whether any fault injection is configured.
+func (c ChaosConfig) Enabled() bool {
+	return c.LossRate > 0 || c.DuplicateRate > 0 || c.Delay > 0 || c.Jitter > 0 || c.ErrorInterval > 0
+}
+
+// ChaosDevice wraps a TunnelDevice and injects packet loss, latency, duplication
+// and periodic transport errors into the forwarding path.
+type ChaosDevice struct {
+	dev TunnelDevice
+	cfg ChaosConfig
+
+	mu        sync.Mutex
+	rng       *rand.Rand
+	nextError time.Time
+}
+
+// NewChaosDevice creates a new ChaosDevice around dev.
+func NewChaosDevice(dev TunnelDevice, cfg ChaosConfig) TunnelDevice {
+	c := &ChaosDevice{
+		dev: dev,
+		cfg: cfg,
+		rng: rand.New(rand.NewSource(cfg.Seed)),
+	}
+	if cfg.ErrorInterval > 0 {
+		c.nextError = time.Now().Add(cfg.ErrorInterval)
+	}
+	return c
+}
+
+// roll returns true with the given probability.
+func (c *ChaosDevice) roll(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rng.Float64() < probability
+}
+
+// delay sleeps for the configured delay plus jitter.
+func (c *ChaosDevice) delay() {
+	d := c.cfg.Delay
+	if c.cfg.Jitter > 0 {
+		c.mu.Lock()
+		d += time.Duration(c.rng.Int63n(int64(c.cfg.Jitter)))
+		c.mu.Unlock()
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// injectError returns ErrChaosInjected once every ErrorInterval.
+func (c *ChaosDevice) injectError() error {
+	if c.cfg.ErrorInterval <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().Before(c.nextError) {
+		return nil
+	}
+	c.nextError = time.Now().Add(c.cfg.ErrorInterval)
+	return ErrChaosInjected
+}
+
+func (c *ChaosDevice) ReadPacket(buf []byte) (int, error) {
+	for {
+		n, err := c.dev.ReadPacket(buf)
+		if err != nil {
+			return n, err
+		}
+		if err := c.injectError(); err != nil {
+			return 0, err
+		}
+		if c.roll(c.cfg.LossRate) {
+			continue
+		}
+		c.delay()
+		return n, nil
+	}
+}
+
+func (c *ChaosDevice) WritePacket(pkt []byte) error {
+	if c.roll(c.cfg.LossRate) {
+		return nil
+	}
+	c.delay()
+	if err := c.dev.WritePacket(pkt); err != nil {
+		return err
+	}
+	if c.roll(c.cfg.DuplicateRate) {
+		return c.dev.WritePacket(pkt)
+	}
+	return nil
+}
@@ -35,13 +35,34 @@ import (
 //	    log.Fatalf("Registration failed: %v", err)
 //	}
 func Register(model, locale, jwt string, acceptTos bool) (models.AccountData, error) {
+	return RegisterDevice(DeviceProfile{Model: model, Locale: locale}, jwt, acceptTos)
+}
+
+// RegisterDevice is Register with the full device profile, including the platform fields shown in the dashboard.
+//
+// Parameters:
+//   - profile: DeviceProfile - How the device describes itself, validated before registering.
+//   - jwt: string - Team token to register.
+//   - acceptTos: bool - Whether the user accepts the Terms of Service (TOS). If false, the user will be prompted to accept.
+//
+// Returns:
+//   - models.AccountData: The account data returned from the registration process.
+//   - error:              An error if the profile is invalid or registration fails at any step.
+func RegisterDevice(profile DeviceProfile, jwt string, acceptTos bool) (models.AccountData, error) {
+	if err := profile.Validate(); err != nil {
+		return models.AccountData{}, fmt.Errorf("invalid device profile: %v", err)
+	}
+
 	wgKey, err := internal.GenerateRandomWgPubkey()
 	if err != nil {
 		return models.AccountData{}, fmt.Errorf("failed to generate wg key: %v", err)
 	}
-	serial, err := internal.GenerateRandomAndroidSerial()
-	if err != nil {
-		return models.AccountData{}, fmt.Errorf("failed to generate serial: %v", err)
+	serial := profile.Serial
+	if serial == "" {
+		serial, err = internal.GenerateRandomAndroidSerial()
+		if err != nil {
+			return models.AccountData{}, fmt.Errorf("failed to generate serial: %v", err)
+		}
 	}
 
 	if !acceptTos {
@@ -60,12 +81,12 @@ func Register(model, locale, jwt string, acceptTos bool) (models.AccountData, er
 		InstallID: "",
 		FcmToken:  "",
 		Tos:       internal.TimeAsCfString(time.Now()),
-		Model:     model,
+		Model:     profile.Model,
 		Serial:    serial,
-		OsVersion: "",
+		OsVersion: profile.OsVersion,
 		KeyType:   internal.KeyTypeWg,
 		TunType:   internal.TunTypeWg,
-		Locale:    locale,
+		Locale:    profile.Locale,
 	}
 
 	jsonData, err := json.Marshal(data)
@@ -73,22 +94,15 @@ func Register(model, locale, jwt string, acceptTos bool) (models.AccountData, er
 		return models.AccountData{}, fmt.Errorf("failed to marshal json: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", internal.ApiUrl+"/"+internal.ApiVersion+"/reg", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return models.AccountData{}, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	for k, v := range internal.Headers {
-		req.Header.Set(k, v)
-	}
-
-	if jwt != "" {
-		req.Header.Set("CF-Access-Jwt-Assertion", jwt)
-	}
-
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := sendAPIRequest(func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", internal.ApiUrl+"/"+internal.ApiVersion+"/reg", bytes.NewReader(jsonData))
+		if err == nil && jwt != "" {
+			req.Header.Set("CF-Access-Jwt-Assertion", jwt)
+		}
+		return req, err
+	})
 	if err != nil {
-		return models.AccountData{}, fmt.Errorf("failed to send request: %v", err)
+		return models.AccountData{}, err
 	}
 	defer resp.Body.Close()
 
@@ -124,34 +138,52 @@ func Register(model, locale, jwt string, acceptTos bool) (models.AccountData, er
 //	    log.Fatalf("Key enrollment failed: %v", err)
 //	}
 func EnrollKey(accountData models.AccountData, pubKey []byte, deviceName string) (models.AccountData, *models.APIError, error) {
-	deviceUpdate := models.DeviceUpdate{
+	return enrollKey(accountData, models.DeviceUpdate{
 		Key:     base64.StdEncoding.EncodeToString(pubKey),
 		KeyType: internal.KeyTypeMasque,
 		TunType: internal.TunTypeMasque,
-	}
+		Name:    deviceName,
+	})
+}
 
-	if deviceName != "" {
-		deviceUpdate.Name = deviceName
-	}
+// EnrollWireGuardKey updates an existing user account with a new WireGuard public key, switching
+// the device to WireGuard. The MASQUE key of the device stops working, until one is enrolled
+// again with EnrollKey.
+//
+// Parameters:
+//   - accountData: models.AccountData - The account data of the user being updated.
+//   - pubKey: []byte - The new curve25519 public key.
+//   - deviceName: string - The name of the device to enroll. (optional)
+//
+// Returns:
+//   - models.AccountData: The updated account data, with the WireGuard peer of the device.
+//   - *models.APIError: The errors returned by the API, if any.
+//   - error: An error if the update process fails.
+func EnrollWireGuardKey(accountData models.AccountData, pubKey []byte, deviceName string) (models.AccountData, *models.APIError, error) {
+	return enrollKey(accountData, models.DeviceUpdate{
+		Key:     base64.StdEncoding.EncodeToString(pubKey),
+		KeyType: internal.KeyTypeWg,
+		TunType: internal.TunTypeWg,
+		Name:    deviceName,
+	})
+}
 
+// enrollKey sends a device update with a new key.
+func enrollKey(accountData models.AccountData, deviceUpdate models.DeviceUpdate) (models.AccountData, *models.APIError, error) {
 	jsonData, err := json.Marshal(deviceUpdate)
 	if err != nil {
 		return models.AccountData{}, nil, fmt.Errorf("failed to marshal json: %v", err)
 	}
 
-	req, err := http.NewRequest("PATCH", internal.ApiUrl+"/"+internal.ApiVersion+"/reg/"+accountData.ID, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return models.AccountData{}, nil, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	for k, v := range internal.Headers {
-		req.Header.Set(k, v)
-	}
-	req.Header.Set("Authorization", "Bearer "+accountData.Token)
-
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := sendAPIRequest(func() (*http.Request, error) {
+		req, err := http.NewRequest("PATCH", internal.ApiUrl+"/"+internal.ApiVersion+"/reg/"+accountData.ID, bytes.NewReader(jsonData))
+		if err == nil {
+			req.Header.Set("Authorization", "Bearer "+accountData.Token)
+		}
+		return req, err
+	})
 	if err != nil {
-		return models.AccountData{}, nil, fmt.Errorf("failed to send request: %v", err)
+		return models.AccountData{}, nil, err
 	}
 	defer resp.Body.Close()
 
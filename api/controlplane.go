@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// ControlPlaneClient is the HTTP client of all control-plane requests: registration, enrollment
+// and version checks. They must never depend on the tunnel, which may be down and waiting for
+// exactly these requests to recover, so its connections and DNS lookups go through DialControlPlane.
+// With an UpstreamProxy, requests go through the proxy instead.
+var ControlPlaneClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: func(*http.Request) (*url.URL, error) {
+			return UpstreamProxy, nil
+		},
+		DialContext:           DialControlPlane,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+	Timeout: 60 * time.Second,
+}
+
+// ControlPlaneInterface is the interface control-plane connections are bound to while BindInterface
+// isn't set, e.g. the one the MASQUE endpoints are reached through while the tunnel has the
+// default routes. Connections to MASQUE servers don't use it, they are kept out by their routes.
+var ControlPlaneInterface string
+
+// DialControlPlane connects to a control-plane server outside of the tunnel. The connection and the
+// DNS lookup for it honor BindInterface, BindAddress, SocketMark and SocketProtector, the same
+// bypass the connections to MASQUE servers use, and ControlPlaneInterface. Without any of them, it
+// falls back to the routing table and the system resolver.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the connection.
+//   - network: string - The network, e.g. "tcp".
+//   - address: string - The host:port to connect to.
+//
+// Returns:
+//   - net.Conn: The connection.
+//   - error: An error if the name can't be resolved or the connection fails.
+func DialControlPlane(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := controlPlaneDialer()
+	if bypass := ControlPlaneBypass(); bypass != "" {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial:     dialResolver,
+		}
+	}
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	logFor(componentTunnel).Debug("Control-plane connection", "address", address,
+		"local", conn.LocalAddr(), "bypass", ControlPlaneBypass())
+	return conn, nil
+}
+
+// dialResolver connects to a DNS server for DialControlPlane, so name lookups bypass the tunnel too.
+func dialResolver(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := controlPlaneDialer()
+	if BindAddress.IsValid() && strings.HasPrefix(network, "udp") {
+		dialer.LocalAddr = &net.UDPAddr{IP: BindAddress.AsSlice()}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// controlPlaneDialer returns NewDialer, binding its sockets to ControlPlaneInterface too.
+func controlPlaneDialer() *net.Dialer {
+	dialer := NewDialer()
+	if BindInterface != "" || ControlPlaneInterface == "" {
+		return dialer
+	}
+	control := dialer.Control
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		var bindErr error
+		if err := c.Control(func(fd uintptr) {
+			bindErr = internal.BindToInterface(fd, network, ControlPlaneInterface)
+		}); err != nil {
+			return err
+		}
+		if bindErr != nil {
+			return fmt.Errorf("failed to bind to interface %s: %v", ControlPlaneInterface, bindErr)
+		}
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}
+	return dialer
+}
+
+// ControlPlaneBypass describes how control-plane connections are kept out of the tunnel,
+// or returns an empty string if they follow the routing table.
+func ControlPlaneBypass() string {
+	var mechanisms []string
+	if BindInterface != "" {
+		mechanisms = append(mechanisms, "interface "+BindInterface)
+	} else if ControlPlaneInterface != "" {
+		mechanisms = append(mechanisms, "interface "+ControlPlaneInterface)
+	}
+	if BindAddress.IsValid() {
+		mechanisms = append(mechanisms, "source "+BindAddress.String())
+	}
+	if SocketMark != 0 {
+		mechanisms = append(mechanisms, fmt.Sprintf("mark %#x", SocketMark))
+	}
+	if SocketProtector != nil {
+		mechanisms = append(mechanisms, "socket protector")
+	}
+	return strings.Join(mechanisms, ", ")
+}
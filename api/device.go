@@ -0,0 +1,67 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// deviceLocale matches the locales accepted at registration, such as en_US, en-US or es_419.
+var deviceLocale = regexp.MustCompile(`^[a-z]{2,3}([_-]([A-Z]{2}|[0-9]{3}))?$`)
+
+// deviceSerial matches the serial numbers accepted at registration.
+var deviceSerial = regexp.MustCompile(`^[0-9A-Za-z]{1,64}$`)
+
+// deviceFieldMaxLen is the longest model or OS version accepted at registration.
+const deviceFieldMaxLen = 64
+
+// DeviceProfile is how a device describes itself at registration. The model, OS version and serial
+// number are shown in the Cloudflare dashboard, so fleets can set them to tell devices apart.
+type DeviceProfile struct {
+	Model     string // The device model, such as "PC"
+	Locale    string // The locale, such as "en_US"
+	OsVersion string // The OS version, empty to leave it unset like the Android app
+	Serial    string // The serial number, empty to generate a random Android-like one
+}
+
+// DefaultDeviceProfile returns the profile registrations use unless told otherwise.
+func DefaultDeviceProfile() DeviceProfile {
+	return DeviceProfile{Model: internal.DefaultModel, Locale: internal.DefaultLocale}
+}
+
+// Validate checks that the fields of the profile are accepted values.
+//
+// Returns:
+//   - error: An error naming the first invalid field.
+func (p DeviceProfile) Validate() error {
+	if p.Model == "" {
+		return fmt.Errorf("model must not be empty")
+	}
+	if err := validateDeviceField("model", p.Model); err != nil {
+		return err
+	}
+	if !deviceLocale.MatchString(p.Locale) {
+		return fmt.Errorf("invalid locale %q, expected a language and an optional region such as en_US", p.Locale)
+	}
+	if err := validateDeviceField("OS version", p.OsVersion); err != nil {
+		return err
+	}
+	if p.Serial != "" && !deviceSerial.MatchString(p.Serial) {
+		return fmt.Errorf("invalid serial %q, expected up to 64 letters and digits", p.Serial)
+	}
+	return nil
+}
+
+// validateDeviceField checks that a free form field is printable ASCII and not too long.
+func validateDeviceField(name, value string) error {
+	if len(value) > deviceFieldMaxLen {
+		return fmt.Errorf("%s is longer than %d characters", name, deviceFieldMaxLen)
+	}
+	for _, c := range value {
+		if c < ' ' || c > '~' {
+			return fmt.Errorf("%s must only contain printable ASCII characters", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// EndpointFailoverThreshold is the number of consecutive failures after which
+// MaintainTunnel switches to the next endpoint in the list.
+const EndpointFailoverThreshold = 3
+
+// EndpointStats holds the failure counters of a single endpoint.
+type EndpointStats struct {
+	Endpoint            *net.UDPAddr // The endpoint
+	Failures            uint64       // Total number of failed connection attempts
+	ConsecutiveFailures int          // Failed attempts since the last success
+	Active              bool         // Whether this is the endpoint currently in use
+	Blocked             bool         // Whether the endpoint is in the Blocklist of the tunnel
+}
+
+// EndpointList is an ordered list of MASQUE endpoints, highest priority first.
+// It keeps track of the endpoint in use and rotates to the next one on repeated failures.
+// Once an endpoint works, it is kept until it fails repeatedly again. The Failures and
+// Blocklist of the tunnel it is maintained for are taken into account, no endpoint counts as
+// failed or blocked before MaintainTunnel uses the list.
+// It is safe for concurrent use.
+type EndpointList struct {
+	// HappyEyeballsDelay enables dual-stack racing (RFC 8305) when greater than 0.
+	// The current endpoint is raced against the next endpoint of the other address family,
+	// started this long after the first attempt.
+	HappyEyeballsDelay time.Duration
+
+	mu        sync.Mutex
+	tunnel    *Tunnel
+	endpoints []*net.UDPAddr
+	failures  []uint64
+	streak    []int
+	current   int
+}
+
+// NewEndpointList creates a new EndpointList. At least one endpoint is required.
+func NewEndpointList(endpoints []*net.UDPAddr) (*EndpointList, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("at least one endpoint is required")
+	}
+	return &EndpointList{
+		endpoints: endpoints,
+		failures:  make([]uint64, len(endpoints)),
+		streak:    make([]int, len(endpoints)),
+	}, nil
+}
+
+// use makes the list take the failures and blocks of tunnel into account.
+func (l *EndpointList) use(tunnel *Tunnel) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tunnel = tunnel
+}
+
+// failed reports whether endpoint failed lately. The caller holds l.mu.
+func (l *EndpointList) failed(endpoint *net.UDPAddr) bool {
+	return l.tunnel != nil && l.tunnel.Failures.Failed(endpoint)
+}
+
+// blocked reports whether endpoint is blocked. The caller holds l.mu.
+func (l *EndpointList) blocked(endpoint *net.UDPAddr) bool {
+	return l.tunnel != nil && l.tunnel.Blocklist.Blocked(endpoint)
+}
+
+// Current returns the endpoint currently in use.
+func (l *EndpointList) Current() *net.UDPAddr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.endpoints[l.current]
+}
+
+// All returns all endpoints in priority order.
+func (l *EndpointList) All() []*net.UDPAddr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*net.UDPAddr(nil), l.endpoints...)
+}
+
+// Candidates returns the endpoints to connect to next. This is the current endpoint,
+// followed by the next endpoint of the other address family if Happy Eyeballs is enabled.
+// The other endpoint is one that didn't fail lately if there is one, and never a blocked one.
+// If the current endpoint is blocked, the next one that isn't becomes current first.
+func (l *EndpointList) Candidates() []*net.UDPAddr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.blocked(l.endpoints[l.current]) {
+		for i := 1; i < len(l.endpoints); i++ {
+			candidate := (l.current + i) % len(l.endpoints)
+			if !l.blocked(l.endpoints[candidate]) {
+				l.current = candidate
+				break
+			}
+		}
+	}
+
+	current := l.endpoints[l.current]
+	candidates := []*net.UDPAddr{current}
+	if l.HappyEyeballsDelay <= 0 {
+		return candidates
+	}
+
+	isV4 := current.IP.To4() != nil
+	var failed *net.UDPAddr
+	for i := 1; i < len(l.endpoints); i++ {
+		candidate := l.endpoints[(l.current+i)%len(l.endpoints)]
+		if (candidate.IP.To4() != nil) == isV4 || l.blocked(candidate) {
+			continue
+		}
+		if !l.failed(candidate) {
+			return append(candidates, candidate)
+		}
+		if failed == nil {
+			failed = candidate
+		}
+	}
+	if failed != nil {
+		// racing one that failed lately still beats not racing at all
+		candidates = append(candidates, failed)
+	}
+
+	return candidates
+}
+
+// Prefer makes the given endpoint the current one, for example after it won a race.
+// Endpoints not in the list are ignored.
+func (l *EndpointList) Prefer(endpoint *net.UDPAddr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, e := range l.endpoints {
+		if e == endpoint {
+			l.current = i
+			return
+		}
+	}
+}
+
+// ReportFailure records a failed connection attempt to the current endpoint and
+// rotates to the next endpoint after EndpointFailoverThreshold consecutive failures.
+// Endpoints that failed lately or are blocked are skipped while rotating, unless all of them are.
+//
+// Returns:
+//   - bool: Whether the current endpoint changed.
+func (l *EndpointList) ReportFailure() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.failures[l.current]++
+	l.streak[l.current]++
+	if l.tunnel != nil {
+		l.tunnel.Failures.MarkFailed(l.endpoints[l.current])
+	}
+
+	if len(l.endpoints) == 1 || l.streak[l.current] < EndpointFailoverThreshold {
+		return false
+	}
+
+	l.streak[l.current] = 0
+	next := (l.current + 1) % len(l.endpoints)
+	for i := 0; i < len(l.endpoints)-1; i++ {
+		candidate := (l.current + 1 + i) % len(l.endpoints)
+		if !l.failed(l.endpoints[candidate]) && !l.blocked(l.endpoints[candidate]) {
+			next = candidate
+			break
+		}
+	}
+	l.current = next
+
+	return true
+}
+
+// ReportSuccess records a successful connection to the current endpoint.
+func (l *EndpointList) ReportSuccess() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.streak[l.current] = 0
+	if l.tunnel != nil {
+		l.tunnel.Failures.MarkSucceeded(l.endpoints[l.current])
+	}
+}
+
+// Replace swaps the endpoints for another list, e.g. after the config was reloaded.
+// Endpoints in both lists keep their counters, and the current endpoint stays current
+// if it is still in the list. Otherwise the first endpoint of the new list becomes current.
+//
+// Parameters:
+//   - endpoints: []*net.UDPAddr - The new endpoints in order of priority.
+//
+// Returns:
+//   - bool: Whether the current endpoint was removed, so the tunnel should reconnect.
+//   - error: An error if the list is empty.
+func (l *EndpointList) Replace(endpoints []*net.UDPAddr) (bool, error) {
+	if len(endpoints) == 0 {
+		return false, errors.New("at least one endpoint is required")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current := l.endpoints[l.current].String()
+	failures := make([]uint64, len(endpoints))
+	streak := make([]int, len(endpoints))
+	next := -1
+	for i, endpoint := range endpoints {
+		for j, old := range l.endpoints {
+			if old.String() == endpoint.String() {
+				failures[i], streak[i] = l.failures[j], l.streak[j]
+				break
+			}
+		}
+		if next < 0 && endpoint.String() == current {
+			next = i
+		}
+	}
+
+	l.endpoints, l.failures, l.streak = endpoints, failures, streak
+	if next < 0 {
+		l.current = 0
+		return true, nil
+	}
+	l.current = next
+	return false, nil
+}
+
+// Stats returns the failure counters of all endpoints in priority order.
+func (l *EndpointList) Stats() []EndpointStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := make([]EndpointStats, len(l.endpoints))
+	for i, endpoint := range l.endpoints {
+		stats[i] = EndpointStats{
+			Endpoint:            endpoint,
+			Failures:            l.failures[i],
+			ConsecutiveFailures: l.streak[i],
+			Active:              i == l.current,
+			Blocked:             l.blocked(endpoint),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultFailureTTL is how long an endpoint is remembered as failed by default.
+const DefaultFailureTTL = 2 * time.Minute
+
+// FailureCache remembers endpoints that recently failed to connect (negative cache).
+// Entries expire after a TTL, so an endpoint that was unreachable on a previous
+// network (or during a short outage) is tried again eventually.
+// It is safe for concurrent use.
+type FailureCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+// NewFailureCache creates a new FailureCache with the given TTL.
+// If ttl is 0 or less, DefaultFailureTTL is used.
+func NewFailureCache(ttl time.Duration) *FailureCache {
+	if ttl <= 0 {
+		ttl = DefaultFailureTTL
+	}
+	return &FailureCache{
+		ttl:     ttl,
+		entries: make(map[string]time.Time),
+	}
+}
+
+// MarkFailed records that the given endpoint just failed.
+func (c *FailureCache) MarkFailed(endpoint *net.UDPAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[endpoint.String()] = time.Now().Add(c.ttl)
+}
+
+// MarkSucceeded removes the given endpoint from the cache.
+func (c *FailureCache) MarkSucceeded(endpoint *net.UDPAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, endpoint.String())
+}
+
+// Failed reports whether the given endpoint failed within the TTL.
+func (c *FailureCache) Failed(endpoint *net.UDPAddr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, ok := c.entries[endpoint.String()]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(c.entries, endpoint.String())
+		return false
+	}
+	return true
+}
+
+// Reset forgets all failures. Tunnel.NotifyNetworkChange calls it, as failures observed on the
+// previous network don't say much about the new one.
+func (c *FailureCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]time.Time)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// expire makes the failure of endpoint in c run out, as if its TTL had passed.
+func expire(c *FailureCache, endpoint *net.UDPAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[endpoint.String()] = time.Now().Add(-time.Second)
+}
+
+func TestFailedEndpointSkippedUntilExpired(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(162, 159, 198, 1), Port: 443}
+	b := &net.UDPAddr{IP: net.IPv4(162, 159, 198, 2), Port: 443}
+	c := &net.UDPAddr{IP: net.IPv4(162, 159, 198, 3), Port: 443}
+	tunnel := NewTunnel()
+	list, err := NewEndpointList([]*net.UDPAddr{a, b, c})
+	if err != nil {
+		t.Fatalf("NewEndpointList() error = %v", err)
+	}
+	list.use(tunnel)
+
+	failover := func() {
+		t.Helper()
+		for i := 1; i < EndpointFailoverThreshold; i++ {
+			if list.ReportFailure() {
+				t.Fatalf("switched endpoint after %d failures", i)
+			}
+		}
+		if !list.ReportFailure() {
+			t.Fatalf("kept endpoint after %d failures", EndpointFailoverThreshold)
+		}
+	}
+
+	tunnel.Failures.MarkFailed(b)
+	failover()
+	if got := list.Current(); got != c {
+		t.Fatalf("current endpoint = %v, want %v as %v failed lately", got, c, b)
+	}
+
+	// a failed within its TTL as well, only b is left once its failure expired
+	expire(tunnel.Failures, b)
+	failover()
+	if got := list.Current(); got != b {
+		t.Fatalf("current endpoint = %v, want %v once its failure expired", got, b)
+	}
+}
+
+func TestFailedEndpointNotRaced(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.IPv4(162, 159, 198, 1), Port: 443}
+	v6a := &net.UDPAddr{IP: net.ParseIP("2606:4700:103::1"), Port: 443}
+	v6b := &net.UDPAddr{IP: net.ParseIP("2606:4700:103::2"), Port: 443}
+	tunnel := NewTunnel()
+	list, err := NewEndpointList([]*net.UDPAddr{v4, v6a, v6b})
+	if err != nil {
+		t.Fatalf("NewEndpointList() error = %v", err)
+	}
+	list.HappyEyeballsDelay = 50 * time.Millisecond
+	list.use(tunnel)
+
+	tests := []struct {
+		name   string
+		change func()
+		want   *net.UDPAddr
+	}{
+		{"none failed", func() {}, v6a},
+		{"first failed", func() { tunnel.Failures.MarkFailed(v6a) }, v6b},
+		{"both failed", func() { tunnel.Failures.MarkFailed(v6b) }, v6a},
+		{"first expired", func() { expire(tunnel.Failures, v6a) }, v6a},
+	}
+	for _, tt := range tests {
+		tt.change()
+		candidates := list.Candidates()
+		if len(candidates) != 2 || candidates[0] != v4 || candidates[1] != tt.want {
+			t.Errorf("%s: Candidates() = %v, want [%v %v]", tt.name, candidates, v4, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import "github.com/Diniboy1123/usque/internal/packet"
+
+// FamilyFilterDevice wraps a TunnelDevice and drops packets of an IP version that is disabled
+// inside the tunnel, in both directions. Operating systems send IPv6 router and neighbor
+// solicitations to any interface and servers may push packets of either version, none of which
+// have a use if the tunnel only carries one address family. Dropped packets are counted as
+// FamilyDrops in the metrics of the tunnel.
+type FamilyFilterDevice struct {
+	dev        TunnelDevice
+	metrics    *TunnelMetrics
+	ipv4, ipv6 bool
+}
+
+// NewFamilyFilterDevice creates a new FamilyFilterDevice around dev.
+//
+// Parameters:
+//   - tunnel: *Tunnel - The tunnel whose metrics count the dropped packets.
+//   - dev: TunnelDevice - The device to wrap.
+//   - ipv4: bool - Whether IPv4 packets are passed.
+//   - ipv6: bool - Whether IPv6 packets are passed.
+//
+// Returns:
+//   - *FamilyFilterDevice: The filtering device.
+func NewFamilyFilterDevice(tunnel *Tunnel, dev TunnelDevice, ipv4, ipv6 bool) *FamilyFilterDevice {
+	return &FamilyFilterDevice{dev: dev, metrics: tunnel.Metrics, ipv4: ipv4, ipv6: ipv6}
+}
+
+func (f *FamilyFilterDevice) ReadPacket(buf []byte) (int, error) {
+	for {
+		n, err := f.dev.ReadPacket(buf)
+		if err != nil || f.allows(buf[:n]) {
+			return n, err
+		}
+		f.metrics.familyDrops.Add(1)
+	}
+}
+
+func (f *FamilyFilterDevice) WritePacket(pkt []byte) error {
+	if !f.allows(pkt) {
+		f.metrics.familyDrops.Add(1)
+		return nil
+	}
+	return f.dev.WritePacket(pkt)
+}
+
+// allows reports whether the IP version of pkt is enabled.
+func (f *FamilyFilterDevice) allows(pkt []byte) bool {
+	switch packet.Version(pkt) {
+	case 4:
+		return f.ipv4
+	case 6:
+		return f.ipv6
+	}
+	return false
+}
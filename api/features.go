@@ -0,0 +1,145 @@
+package api
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Feature names an experimental behavior that can be switched on and off at runtime.
+// Changes apply from the next connection or the next time the behavior is chosen.
+type Feature string
+
+const (
+	// FeatureECN lets quic-go mark QUIC packets ECN capable and react to congestion marks on Linux and macOS.
+	FeatureECN Feature = "ecn"
+	// FeatureGSO lets quic-go batch outgoing QUIC packets with UDP GSO on Linux.
+	FeatureGSO Feature = "gso"
+	// FeatureRacing races an IPv6 and an IPv4 endpoint if the endpoint list has a happy eyeballs delay.
+	FeatureRacing Feature = "racing"
+)
+
+// featureState holds the switch and counters of a single feature.
+type featureState struct {
+	enabled atomic.Bool
+	used    atomic.Uint64
+	skipped atomic.Uint64
+}
+
+// FeatureStatus is a point in time copy of a feature's switch and counters.
+type FeatureStatus struct {
+	Name    Feature `json:"name"`
+	Enabled bool    `json:"enabled"`
+	Used    uint64  `json:"used"`    // Times the behavior was chosen while enabled
+	Skipped uint64  `json:"skipped"` // Times the behavior would have been chosen but was disabled
+}
+
+// FeatureFlags holds the runtime switches of experimental behaviors.
+// The set of features is fixed, it is safe for concurrent use.
+type FeatureFlags struct {
+	features map[Feature]*featureState
+}
+
+// Features holds the feature switches of all tunnels in this process.
+// Behaviors that already shipped are enabled by default, new ones ship disabled.
+var Features = newFeatureFlags(map[Feature]bool{
+	FeatureECN:    !disabledByEnv("QUIC_GO_DISABLE_ECN"),
+	FeatureGSO:    !disabledByEnv("QUIC_GO_DISABLE_GSO"),
+	FeatureRacing: true,
+})
+
+// disabledByEnv reports whether a quic-go behavior was switched off through its environment variable.
+func disabledByEnv(name string) bool {
+	disabled, _ := strconv.ParseBool(os.Getenv(name))
+	return disabled
+}
+
+// newFeatureFlags creates the switches of the given features with their defaults.
+func newFeatureFlags(defaults map[Feature]bool) *FeatureFlags {
+	f := &FeatureFlags{features: make(map[Feature]*featureState, len(defaults))}
+	for feature, enabled := range defaults {
+		state := &featureState{}
+		state.enabled.Store(enabled)
+		f.features[feature] = state
+	}
+	return f
+}
+
+// Set switches a feature on or off.
+//
+// Parameters:
+//   - feature: Feature - The feature to switch.
+//   - enabled: bool - Whether the feature is enabled.
+//
+// Returns:
+//   - error: An error if the feature is unknown.
+func (f *FeatureFlags) Set(feature Feature, enabled bool) error {
+	state, ok := f.features[feature]
+	if !ok {
+		return fmt.Errorf("unknown feature %q", feature)
+	}
+	state.enabled.Store(enabled)
+	return nil
+}
+
+// Enabled reports whether a feature is enabled, without counting it as a use.
+// Unknown features are disabled.
+func (f *FeatureFlags) Enabled(feature Feature) bool {
+	state, ok := f.features[feature]
+	return ok && state.enabled.Load()
+}
+
+// use reports whether a feature is enabled at a point where its behavior would be chosen
+// and counts the outcome.
+func (f *FeatureFlags) use(feature Feature) bool {
+	state, ok := f.features[feature]
+	if !ok {
+		return false
+	}
+	if state.enabled.Load() {
+		state.used.Add(1)
+		return true
+	}
+	state.skipped.Add(1)
+	return false
+}
+
+// Status returns the switches and counters of all features, sorted by name.
+func (f *FeatureFlags) Status() []FeatureStatus {
+	status := make([]FeatureStatus, 0, len(f.features))
+	for feature, state := range f.features {
+		status = append(status, FeatureStatus{
+			Name:    feature,
+			Enabled: state.enabled.Load(),
+			Used:    state.used.Load(),
+			Skipped: state.skipped.Load(),
+		})
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+	return status
+}
+
+// applySocketFeatures passes the gso and ecn features to quic-go before a connection is made.
+// quic-go checks its environment variables whenever it sets up a socket, there are no options for them.
+func applySocketFeatures() {
+	applyEnvFeature(FeatureGSO, "QUIC_GO_DISABLE_GSO")
+	if SocketDSCP != 0 {
+		// quic-go passes the ECN bits as the whole TOS byte of every packet, clearing the DSCP value
+		os.Setenv("QUIC_GO_DISABLE_ECN", "true")
+		return
+	}
+	applyEnvFeature(FeatureECN, "QUIC_GO_DISABLE_ECN")
+}
+
+// applyEnvFeature sets the quic-go environment variable disabling a behavior from its feature switch.
+func applyEnvFeature(feature Feature, name string) {
+	if Features.use(feature) {
+		os.Unsetenv(name)
+	} else {
+		os.Setenv(name, "true")
+	}
+}
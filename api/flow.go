@@ -0,0 +1,159 @@
+package api
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal/packet"
+)
+
+// IP protocol numbers we extract ports for.
+const (
+	protoTCP = packet.ProtoTCP
+	protoUDP = packet.ProtoUDP
+)
+
+// FlowKey identifies a flow by its 5-tuple.
+type FlowKey struct {
+	Src      netip.Addr
+	Dst      netip.Addr
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
+}
+
+// FlowStats holds the counters of a single flow.
+type FlowStats struct {
+	Packets uint64
+	Bytes   uint64
+	Start   time.Time
+	End     time.Time
+}
+
+// FlowRecord is a flow with its counters, as exported to a collector.
+type FlowRecord struct {
+	FlowKey
+	FlowStats
+}
+
+// FlowTracker aggregates packets into flows keyed by their 5-tuple.
+// It is safe for concurrent use.
+type FlowTracker struct {
+	mu    sync.Mutex
+	flows map[FlowKey]*FlowStats
+}
+
+// NewFlowTracker creates a new, empty FlowTracker.
+func NewFlowTracker() *FlowTracker {
+	return &FlowTracker{flows: make(map[FlowKey]*FlowStats)}
+}
+
+// Observe accounts a raw IPv4 or IPv6 packet. Packets that can't be parsed are ignored.
+func (t *FlowTracker) Observe(pkt []byte) {
+	key, ok := parseFlowKey(pkt)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.flows[key]
+	if !ok {
+		stats = &FlowStats{Start: now}
+		t.flows[key] = stats
+	}
+	stats.Packets++
+	stats.Bytes += uint64(len(pkt))
+	stats.End = now
+}
+
+// Drain returns all flows observed since the previous call and resets the tracker,
+// so that the returned counters are deltas.
+func (t *FlowTracker) Drain() []FlowRecord {
+	t.mu.Lock()
+	flows := t.flows
+	t.flows = make(map[FlowKey]*FlowStats)
+	t.mu.Unlock()
+
+	records := make([]FlowRecord, 0, len(flows))
+	for key, stats := range flows {
+		records = append(records, FlowRecord{FlowKey: key, FlowStats: *stats})
+	}
+	return records
+}
+
+// parseFlowKey extracts the 5-tuple from a raw IP packet.
+// Ports are only filled in for unfragmented (or first fragment) TCP and UDP packets.
+// IPv6 extension headers are skipped, but a packet is only rejected if its fixed
+// header is incomplete, so unusual packets (e.g. SRv6) still pass the filters.
+func parseFlowKey(pkt []byte) (FlowKey, bool) {
+	ip, ok := packet.Parse(pkt)
+	if !ok {
+		return FlowKey{}, false
+	}
+
+	key := FlowKey{Src: ip.Src(), Dst: ip.Dst()}
+	var payload []byte
+	key.Protocol, payload = ip.Transport()
+	key.SrcPort, key.DstPort, _ = packet.Ports(key.Protocol, payload)
+	return key, true
+}
+
+// FlowDevice wraps a TunnelDevice and accounts every packet passing through it
+// in both directions.
+type FlowDevice struct {
+	dev     TunnelDevice
+	tracker *FlowTracker
+}
+
+// NewFlowDevice creates a new FlowDevice around dev that reports to tracker.
+func NewFlowDevice(dev TunnelDevice, tracker *FlowTracker) TunnelDevice {
+	return &FlowDevice{dev: dev, tracker: tracker}
+}
+
+func (f *FlowDevice) ReadPacket(buf []byte) (int, error) {
+	n, err := f.dev.ReadPacket(buf)
+	if err == nil {
+		f.tracker.Observe(buf[:n])
+	}
+	return n, err
+}
+
+func (f *FlowDevice) WritePacket(pkt []byte) error {
+	f.tracker.Observe(pkt)
+	return f.dev.WritePacket(pkt)
+}
+
+// ExportFlows periodically drains the tracker and sends the flows to an IPFIX collector over UDP.
+// It blocks forever, so it should be started in a goroutine.
+//
+// Parameters:
+//   - tracker: *FlowTracker - The tracker to drain.
+//   - collector: string - The collector address. (e.g., "192.0.2.10:4739")
+//   - interval: time.Duration - How often flows are exported.
+//
+// Returns:
+//   - error: An error if the collector can't be reached.
+func ExportFlows(tracker *FlowTracker, collector string, interval time.Duration) error {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	exporter := NewIPFIXExporter(conn, 0)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := exporter.Export(tracker.Drain()); err != nil {
+			logFor(componentTun).Warn("Failed to export flows", "error", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/Diniboy1123/usque/internal/packet"
+)
+
+// IPv6 next header values used by the extension header tests.
+const (
+	nextHopByHop    = 0
+	nextIPv6        = 41
+	nextRouting     = 43
+	nextAuth        = 51
+	nextNone        = 59
+	nextDestOptions = 60
+	nextExperiment  = 253
+)
+
+// memDevice is a TunnelDevice reading from a list of packets and recording the packets written to it.
+type memDevice struct {
+	reads  [][]byte
+	writes [][]byte
+}
+
+func (d *memDevice) ReadPacket(buf []byte) (int, error) {
+	if len(d.reads) == 0 {
+		return 0, io.EOF
+	}
+	pkt := d.reads[0]
+	d.reads = d.reads[1:]
+	return copy(buf, pkt), nil
+}
+
+func (d *memDevice) WritePacket(pkt []byte) error {
+	d.writes = append(d.writes, slices.Clone(pkt))
+	return nil
+}
+
+// segmentRouting builds an SRv6 Segment Routing Header (RFC 8754) listing segments.
+func segmentRouting(next uint8, segments ...netip.Addr) []byte {
+	header := []byte{next, uint8(2 * len(segments)), 4, uint8(len(segments) - 1), uint8(len(segments) - 1), 0, 0, 0}
+	for _, segment := range segments {
+		header = append(header, segment.AsSlice()...)
+	}
+	return header
+}
+
+// optionsHeader builds a hop-by-hop or destination options header of 8 bytes with padding only.
+func optionsHeader(next uint8) []byte {
+	return []byte{next, 0, 1, 4, 0, 0, 0, 0}
+}
+
+func TestExtensionHeaderPassthrough(t *testing.T) {
+	local := netip.MustParseAddr("2606:4700:110::2")
+	remote := netip.AddrPortFrom(netip.MustParseAddr("2001:db8::10"), 5000)
+	segments := []netip.Addr{netip.MustParseAddr("fc00:1::1"), netip.MustParseAddr("fc00:2::1")}
+	udp := natTransport(protoUDP, remote, netip.AddrPortFrom(local, 53))[40:]
+	tcp := natTransport(protoTCP, remote, netip.AddrPortFrom(local, 443))[40:]
+	inner := natTransport(protoUDP, remote, netip.AddrPortFrom(local, 53))
+
+	concat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	auth := append([]byte{protoUDP, 4, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1}, make([]byte, 12)...)
+
+	tests := []struct {
+		name     string
+		next     uint8
+		payload  []byte
+		protocol uint8
+		dstPort  uint16
+	}{
+		{"SRv6 UDP", nextRouting, concat(segmentRouting(protoUDP, segments...), udp), protoUDP, 53},
+		{"SRv6 TCP", nextRouting, concat(segmentRouting(protoTCP, segments...), tcp), protoTCP, 443},
+		{"SRv6 encapsulation", nextRouting, concat(segmentRouting(nextIPv6, segments[0]), inner), nextIPv6, 0},
+		{"SRv6 without payload", nextRouting, segmentRouting(nextNone, segments...), nextNone, 0},
+		{"options around a routing header", nextHopByHop, concat(optionsHeader(nextRouting), segmentRouting(nextDestOptions, segments...), optionsHeader(protoUDP), udp), protoUDP, 53},
+		{"authentication header", nextAuth, concat(auth, udp), protoUDP, 53},
+		{"experimental header", nextExperiment, concat([]byte{protoUDP, 0, 0, 0, 0, 0, 0, 0}, udp), nextExperiment, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := packet.NewIPv6(tt.next, 64, remote.Addr(), local, tt.payload)
+
+			key, ok := parseFlowKey(pkt)
+			if !ok {
+				t.Fatal("parseFlowKey rejected the packet")
+			}
+			if key.Protocol != tt.protocol || key.DstPort != tt.dstPort {
+				t.Errorf("parseFlowKey = protocol %d, port %d, want %d, %d", key.Protocol, key.DstPort, tt.protocol, tt.dstPort)
+			}
+			if tt.dstPort != 0 && key.SrcPort != remote.Port() {
+				t.Errorf("parseFlowKey source port = %d, want %d", key.SrcPort, remote.Port())
+			}
+
+			// the devices between the TUN device and the tunnel, both ways
+			tunnel := NewTunnel()
+			dev := &memDevice{reads: [][]byte{slices.Clone(pkt)}}
+			tracker := NewFlowTracker()
+			inbound := NewInboundFilterDevice(dev, []netip.Prefix{netip.PrefixFrom(local, 128)})
+			var chain TunnelDevice = inbound
+			chain = NewFamilyFilterDevice(tunnel, chain, true, true)
+			chain = NewMSSClampDevice(tunnel, chain)
+			chain = NewPathMTUDevice(tunnel, chain, []netip.Addr{local})
+			chain = NewFlowDevice(chain, tracker)
+
+			buf := make([]byte, 2048)
+			n, err := chain.ReadPacket(buf)
+			if err != nil {
+				t.Fatalf("ReadPacket: %v", err)
+			}
+			if !bytes.Equal(buf[:n], pkt) {
+				t.Errorf("ReadPacket changed the packet:\n got %x\nwant %x", buf[:n], pkt)
+			}
+			if err := chain.WritePacket(slices.Clone(pkt)); err != nil {
+				t.Fatalf("WritePacket: %v", err)
+			}
+			if len(dev.writes) != 1 || !bytes.Equal(dev.writes[0], pkt) {
+				t.Errorf("WritePacket delivered %x, want %x", dev.writes, pkt)
+			}
+			if stats := inbound.Stats(); stats.Accepted != 1 || stats.Dropped != 0 || stats.Malformed != 0 {
+				t.Errorf("inbound filter stats = %+v, want 1 accepted", stats)
+			}
+			if drops := tunnel.Metrics.familyDrops.Load(); drops != 0 {
+				t.Errorf("family filter dropped %d packets", drops)
+			}
+			if flows := tracker.Drain(); len(flows) != 1 || flows[0].Packets != 2 || flows[0].FlowKey != key {
+				t.Errorf("flows = %+v, want one flow of 2 packets keyed %+v", flows, key)
+			}
+		})
+	}
+}
+
+func TestParseFlowKeyIPv4(t *testing.T) {
+	src := netip.AddrPortFrom(netip.MustParseAddr("172.16.0.2"), 40000)
+	dst := netip.AddrPortFrom(netip.MustParseAddr("1.1.1.1"), 443)
+	pkt := natTransport(protoTCP, src, dst)
+	key, ok := parseFlowKey(pkt)
+	want := FlowKey{Src: src.Addr(), Dst: dst.Addr(), SrcPort: src.Port(), DstPort: dst.Port(), Protocol: protoTCP}
+	if !ok || key != want {
+		t.Errorf("parseFlowKey = %+v, %v, want %+v", key, ok, want)
+	}
+
+	// a later fragment has no ports
+	ip, _ := packet.Parse(pkt)
+	ip.SetFragment(8, false)
+	key, ok = parseFlowKey(pkt)
+	if !ok || key.SrcPort != 0 || key.DstPort != 0 {
+		t.Errorf("parseFlowKey of a later fragment = %+v, %v, want no ports", key, ok)
+	}
+
+	for _, pkt := range [][]byte{nil, pkt[:19], {0x50, 0, 0, 0}} {
+		if _, ok := parseFlowKey(pkt); ok {
+			t.Errorf("parseFlowKey(%x) accepted a malformed packet", pkt)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"errors"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/Diniboy1123/usque/internal/packet"
+	"github.com/quic-go/quic-go"
+)
+
+// fragmentMTU is the size of the fragments of packets too large for a datagram while the
+// datagram limit of the connection is unknown. connect-ip promises that much in its packet too
+// big messages.
+const fragmentMTU = minMTUv6
+
+// datagramOverhead is what HTTP/3 and connect-ip put in front of a packet in a datagram: the
+// quarter stream ID of the CONNECT stream, 2 bytes for the first 16384 streams, and the context ID.
+const datagramOverhead = 2 + 1
+
+// datagramProbe is larger than any QUIC datagram, so sending it never sends anything and only
+// returns the current limit.
+var datagramProbe = make([]byte, 1<<16)
+
+// datagramLimit returns the largest packet the current tunnel connection carries right now.
+// The limit follows the path MTU QUIC discovered, connect-ip doesn't pass it on.
+//
+// Returns:
+//   - int: The size in bytes, 0 if there is no connection or it doesn't report a limit.
+func (t *Tunnel) datagramLimit() int {
+	conn := t.quicConn.Load()
+	if conn == nil {
+		return 0
+	}
+	var tooLarge *quic.DatagramTooLargeError
+	if err := conn.SendDatagram(datagramProbe); !errors.As(err, &tooLarge) {
+		return 0
+	}
+	return max(int(tooLarge.MaxDatagramPayloadSize)-datagramOverhead, 0)
+}
+
+// writeTunnelPacket writes a packet from the device to the tunnel. An IPv4 packet without DF that
+// doesn't fit into a datagram, e.g. from a device with a jumbo MTU, is split into fragments of
+// the current datagram limit, like a router in front of a smaller link would. Other packets that
+// don't fit are answered by connect-ip with a packet too big, which is returned for the device.
+// connect-ip refuses packets whose TTL would run out with an error only, those are answered
+// with a time exceeded here, so traceroute sees the tunnel as a hop.
+//
+// Parameters:
+//   - ipConn: *connectip.Conn - The tunnel.
+//   - pkt: []byte - The packet.
+//
+// Returns:
+//   - []byte: The ICMP packet for the device, nil if the packet was sent.
+//   - error: An error if writing to the tunnel failed.
+func (t *Tunnel) writeTunnelPacket(ipConn *connectip.Conn, pkt []byte) ([]byte, error) {
+	if icmp := buildTimeExceeded(pkt); icmp != nil {
+		return icmp, nil
+	}
+	icmp, err := ipConn.WritePacket(pkt)
+	if err != nil || len(icmp) == 0 {
+		return icmp, err
+	}
+	limit := t.datagramLimit()
+	t.Metrics.packetTooLarge(len(pkt), limit)
+	if dontFragment(pkt) {
+		return icmp, nil
+	}
+
+	mtu := fragmentMTU
+	if limit >= minMTUv4 {
+		mtu = limit
+	}
+	fragments := fragmentIPv4(pkt, mtu)
+	if fragments == nil {
+		return icmp, nil
+	}
+	for _, fragment := range fragments {
+		if fragmentICMP, err := ipConn.WritePacket(fragment); err != nil || len(fragmentICMP) > 0 {
+			return icmp, err
+		}
+	}
+	t.Metrics.fragmented.Add(1)
+	return nil, nil
+}
+
+// buildTimeExceeded builds the ICMP message telling the sender of pkt that its TTL or hop limit
+// ran out, as forwarding it through the tunnel decrements it. There is no address of the tunnel
+// to send it from, so it comes from the destination of pkt, like the packet too big messages.
+// Errors aren't answered with errors, and neither are IPv4 fragments but the first, as RFC 1812 and
+// RFC 4443 ask for.
+//
+// Parameters:
+//   - pkt: []byte - The packet to send.
+//
+// Returns:
+//   - []byte: The ICMP packet, nil if pkt may be forwarded or doesn't get an answer.
+func buildTimeExceeded(pkt []byte) []byte {
+	ip, ok := packet.Parse(pkt)
+	if !ok || ip.TTL() > 1 || ip.FragmentOffset() > 0 {
+		return nil
+	}
+	proto, payload := ip.Transport()
+	if (proto == protoICMP || proto == protoICMPv6) && len(payload) > 0 && isICMPError(proto, payload[0]) {
+		return nil
+	}
+
+	if ip.IPv6() {
+		// RFC 4443 quotes as much as fits into 1280 bytes with the IPv6 and ICMPv6 headers
+		quoted := pkt[:min(len(pkt), minMTUv6-48)]
+		return packet.NewICMP(icmpv6TimeExceeded, 0, 0, quoted, 64, 0, ip.Dst(), ip.Src())
+	}
+	quoted := pkt[:min(len(pkt), ip.HeaderLen()+8)]
+	return packet.NewICMP(icmpTimeExceeded, 0, 0, quoted, 64, 0, ip.Dst(), ip.Src())
+}
+
+// fragmentIPv4 splits an IPv4 packet into fragments of at most mtu bytes, as in RFC 791.
+// connect-ip decremented the TTL of pkt when it was rejected, the fragments get it back, as
+// it's decremented again when they are sent.
+//
+// Parameters:
+//   - pkt: []byte - The packet, which may be a fragment itself.
+//   - mtu: int - The largest fragment.
+//
+// Returns:
+//   - [][]byte: The fragments, nil if pkt isn't a valid IPv4 packet or has options, which
+//     would have to be sorted into the ones copied to every fragment.
+func fragmentIPv4(pkt []byte, mtu int) [][]byte {
+	ip, ok := packet.Parse(pkt)
+	if !ok || ip.IPv6() || ip.HeaderLen() != 20 {
+		return nil
+	}
+	total := ip.TotalLen()
+	if total > len(pkt) || total <= 20 {
+		return nil
+	}
+
+	payload := pkt[20:total]
+	size := (mtu - 20) &^ 7
+	var fragments [][]byte
+	for start := 0; start < len(payload); start += size {
+		end := min(start+size, len(payload))
+		fragment := make([]byte, 20+end-start)
+		copy(fragment, pkt[:20])
+		copy(fragment[20:], payload[start:end])
+
+		f, _ := packet.Parse(fragment)
+		f.SetTotalLen(len(fragment))
+		f.SetFragment(ip.FragmentOffset()+start, end < len(payload) || ip.MoreFragments())
+		f.SetTTL(ip.TTL() + 1)
+		f.UpdateChecksum()
+		fragments = append(fragments, fragment)
+	}
+	return fragments
+}
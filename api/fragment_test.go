@@ -0,0 +1,65 @@
+package api
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/Diniboy1123/usque/internal/packet"
+)
+
+func TestBuildTimeExceeded(t *testing.T) {
+	local4, server4 := netip.MustParseAddr("172.16.0.2"), netip.MustParseAddr("1.1.1.1")
+	local6, server6 := netip.MustParseAddr("2606:4700:110::2"), netip.MustParseAddr("2606:4700:4700::1111")
+	udp := []byte{0x30, 0x39, 0x82, 0x9a, 0, 16, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+
+	laterFragment := packet.NewIPv4(protoUDP, 1, 7, local4, server4, udp)
+	ip, _ := packet.Parse(laterFragment)
+	ip.SetFragment(16, false)
+
+	tests := []struct {
+		name     string
+		pkt      []byte
+		icmpType uint8
+		quoted   int
+	}{
+		{"IPv4 TTL 1", packet.NewIPv4(protoUDP, 1, 7, local4, server4, udp), icmpTimeExceeded, 28},
+		{"IPv4 TTL 0", packet.NewIPv4(protoUDP, 0, 7, local4, server4, udp), icmpTimeExceeded, 28},
+		{"IPv6 hop limit 1", packet.NewIPv6(protoUDP, 1, local6, server6, udp), icmpv6TimeExceeded, 56},
+		{"IPv4 TTL 2", packet.NewIPv4(protoUDP, 2, 7, local4, server4, udp), 0, 0},
+		{"IPv6 hop limit 2", packet.NewIPv6(protoUDP, 2, local6, server6, udp), 0, 0},
+		{"IPv4 later fragment", laterFragment, 0, 0},
+		{"ICMP error", packet.NewICMP(icmpDestinationUnreachable, 3, 0, make([]byte, 28), 1, 7, local4, server4), 0, 0},
+		{"ICMPv6 error", packet.NewICMP(icmpv6PacketTooBig, 0, 1280, make([]byte, 48), 1, 0, local6, server6), 0, 0},
+		{"not IP", []byte{0}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildTimeExceeded(tt.pkt)
+			if tt.icmpType == 0 {
+				if got != nil {
+					t.Fatalf("buildTimeExceeded = %x, want nil", got)
+				}
+				return
+			}
+			ip, ok := packet.Parse(got)
+			if !ok {
+				t.Fatalf("buildTimeExceeded = %x, not an IP packet", got)
+			}
+			src, dst := server4, local4
+			if ip.IPv6() {
+				src, dst = server6, local6
+			}
+			if ip.Src() != src || ip.Dst() != dst {
+				t.Errorf("sent from %s to %s, want %s to %s", ip.Src(), ip.Dst(), src, dst)
+			}
+			icmp, ok := packet.ParseICMP(ip.Payload())
+			if !ok || icmp.Type() != tt.icmpType || icmp.Code() != 0 {
+				t.Fatalf("ICMP message %x, want type %d code 0", ip.Payload(), tt.icmpType)
+			}
+			if !bytes.Equal(icmp.Body(), tt.pkt[:tt.quoted]) {
+				t.Errorf("quoted %x, want %x", icmp.Body(), tt.pkt[:tt.quoted])
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// ConnectURI is the URI template of the Connect-IP request MaintainTunnel sends. Its host is
+// what the server sees as :authority. Change it with SetConnectHost.
+var ConnectURI = internal.ConnectURI
+
+// hostname matches DNS names of dot separated labels of letters, digits, hyphens and underscores.
+var hostname = regexp.MustCompile(`^([A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?\.)*[A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?\.?$`)
+
+// ValidateSNI checks that sni can be sent as the Server Name Indication of a TLS handshake.
+// An empty SNI is valid and sends none.
+//
+// Parameters:
+//   - sni: string - The SNI.
+//
+// Returns:
+//   - error: An error if the SNI is an IP address or not a DNS name.
+func ValidateSNI(sni string) error {
+	if sni == "" {
+		return nil
+	}
+	if _, err := netip.ParseAddr(sni); err == nil {
+		// crypto/tls would silently leave it out
+		return fmt.Errorf("invalid SNI %q, IP addresses can't be sent as SNI, leave it empty to send none", sni)
+	}
+	if len(sni) > 253 || !hostname.MatchString(sni) {
+		return fmt.Errorf("invalid SNI %q, expected a DNS name", sni)
+	}
+	return nil
+}
+
+// SetConnectHost changes the host of ConnectURI, which the server sees as :authority of the
+// Connect-IP request. The SNI is set separately with PrepareTlsConfig.
+//
+// Parameters:
+//   - host: string - A DNS name or IP address with an optional port, IPv6 addresses in brackets.
+//     Empty restores the default.
+//
+// Returns:
+//   - error: An error if host isn't a valid host.
+func SetConnectHost(host string) error {
+	if host == "" {
+		ConnectURI = internal.ConnectURI
+		return nil
+	}
+
+	name := host
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port in connect host %q", host)
+		}
+		name = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		name = host[1 : len(host)-1]
+	} else if addr, err := netip.ParseAddr(host); err == nil && addr.Is6() {
+		return fmt.Errorf("invalid connect host %q, IPv6 addresses need brackets, e.g. [%s]", host, host)
+	}
+	if _, err := netip.ParseAddr(name); err != nil && (len(name) > 253 || !hostname.MatchString(name)) {
+		return fmt.Errorf("invalid connect host %q, expected a DNS name or IP address", host)
+	}
+
+	uri := "https://" + host
+	if _, err := uritemplate.New(uri); err != nil {
+		return fmt.Errorf("invalid connect host %q: %v", host, err)
+	}
+	ConnectURI = uri
+	return nil
+}
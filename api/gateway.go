@@ -0,0 +1,197 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// gatewayQueueLen is the number of client packets queued for the tunnel.
+const gatewayQueueLen = 256
+
+// GatewayDevice is a TunnelDevice that serves connect-ip clients, making the tunnel a gateway
+// for other MASQUE speaking devices, such as other usque instances on the LAN.
+//
+// The device is an http.Handler for the connect-ip requests of an HTTP/3 server. Clients
+// aren't assigned addresses and may send from any address: their flows are translated to
+// the tunnel addresses, so several clients share the single pair of addresses the tunnel has. Only TCP, UDP and ICMP echo
+// can be translated, other traffic of clients is dropped.
+type GatewayDevice struct {
+	template *uritemplate.Template
+	nat      *natTable
+	mtu      int
+	packets  chan []byte
+	done     chan struct{}
+
+	mu      sync.Mutex
+	clients map[uint64]*connectip.Conn
+	nextID  uint64
+	closed  bool
+}
+
+// NewGatewayDevice creates a new GatewayDevice.
+//
+// Parameters:
+//   - connectUri: string - The URI clients send their connect-ip requests to.
+//   - ipv4: netip.Addr - The IPv4 address of the tunnel, invalid to drop IPv4 traffic.
+//   - ipv6: netip.Addr - The IPv6 address of the tunnel, invalid to drop IPv6 traffic.
+//   - mtu: int - The MTU of the tunnel, larger packets of clients are dropped.
+//
+// Returns:
+//   - *GatewayDevice: The device.
+func NewGatewayDevice(connectUri string, ipv4, ipv6 netip.Addr, mtu int) *GatewayDevice {
+	return &GatewayDevice{
+		template: uritemplate.MustNew(connectUri),
+		nat:      newNatTable(ipv4, ipv6),
+		mtu:      mtu,
+		packets:  make(chan []byte, gatewayQueueLen),
+		done:     make(chan struct{}),
+		clients:  map[uint64]*connectip.Conn{},
+	}
+}
+
+// ServeHTTP accepts a connect-ip request and relays the packets of the client until it disconnects.
+// Both the connect-ip protocol of RFC 9484 and Cloudflare's cf-connect-ip are accepted.
+func (d *GatewayDevice) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	protocol := r.Proto
+	if protocol != "cf-connect-ip" {
+		protocol = "connect-ip"
+	}
+	req, err := connectip.ParseRequest(r, d.template, protocol)
+	if err != nil {
+		var perr *connectip.RequestParseError
+		if errors.As(err, &perr) {
+			w.WriteHeader(perr.HTTPStatus)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	conn, err := (&connectip.Proxy{}).Proxy(w, req)
+	if err != nil {
+		logFor(componentTun).Error("Failed to accept gateway client", "client", r.RemoteAddr, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// no addresses are assigned, that would make the proxy drop packets from any other
+	// address, while usque clients send from the addresses of their own registration
+	if err := conn.AdvertiseRoute(r.Context(), []connectip.IPRoute{
+		{StartIP: netip.IPv4Unspecified(), EndIP: netip.MustParseAddr("255.255.255.255")},
+		{StartIP: netip.IPv6Unspecified(), EndIP: netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")},
+	}); err != nil {
+		logFor(componentTun).Error("Failed to advertise routes to gateway client", "client", r.RemoteAddr, "error", err)
+		return
+	}
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.nextID++
+	id := d.nextID
+	d.clients[id] = conn
+	d.mu.Unlock()
+
+	logFor(componentTun).Info("Gateway client connected", "client", r.RemoteAddr)
+	err = d.relay(id, conn)
+	logFor(componentTun).Info("Gateway client disconnected", "client", r.RemoteAddr, "error", err)
+
+	d.mu.Lock()
+	delete(d.clients, id)
+	d.mu.Unlock()
+	d.nat.forget(id)
+}
+
+// relay queues the packets of a client for the tunnel until reading from it fails.
+func (d *GatewayDevice) relay(id uint64, conn *connectip.Conn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.ReadPacket(buf, true)
+		if err != nil {
+			return err
+		}
+		// clients may use a larger MTU than the tunnel, such packets couldn't be read from the device
+		if n > d.mtu {
+			logFor(componentTun).Debug("Dropping gateway client packet larger than the MTU", "size", n, "mtu", d.mtu)
+			continue
+		}
+		if !d.nat.translateOut(id, buf[:n]) {
+			continue
+		}
+
+		select {
+		case d.packets <- append([]byte(nil), buf[:n]...):
+		case <-d.done:
+			return net.ErrClosed
+		}
+	}
+}
+
+// Clients returns the number of connected clients.
+func (d *GatewayDevice) Clients() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.clients)
+}
+
+// Close disconnects all clients. ReadPacket returns net.ErrClosed afterwards.
+func (d *GatewayDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	close(d.done)
+	for _, conn := range d.clients {
+		conn.Close()
+	}
+	return nil
+}
+
+// ReadPacket returns the next packet sent by a client, translated to the tunnel addresses.
+// It blocks while no client sends anything. A packet that doesn't fit into buf is dropped
+// with an error wrapping io.ErrShortBuffer, buf has to hold at least the MTU.
+func (d *GatewayDevice) ReadPacket(buf []byte) (int, error) {
+	select {
+	case pkt := <-d.packets:
+		if len(pkt) > len(buf) {
+			return 0, fmt.Errorf("gateway packet of %d bytes doesn't fit into %d bytes: %w", len(pkt), len(buf), io.ErrShortBuffer)
+		}
+		return copy(buf, pkt), nil
+	case <-d.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// WritePacket sends a packet from the tunnel to the client it belongs to.
+// Packets that don't belong to a translated flow are dropped.
+func (d *GatewayDevice) WritePacket(pkt []byte) error {
+	id, ok := d.nat.translateIn(pkt)
+	if !ok {
+		return nil
+	}
+
+	d.mu.Lock()
+	conn := d.clients[id]
+	d.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+
+	// errors concern the client only, they are not reported to the tunnel
+	if _, err := conn.WritePacket(pkt); err != nil {
+		logFor(componentTun).Debug("Failed to write to gateway client", "error", err)
+	}
+	return nil
+}
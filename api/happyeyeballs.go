@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// DefaultConnectionAttemptDelay is the delay between connection attempts recommended by RFC 8305.
+const DefaultConnectionAttemptDelay = 250 * time.Millisecond
+
+// tunnelAttempt is the outcome of a single ConnectTunnel call.
+type tunnelAttempt struct {
+	endpoint *net.UDPAddr
+	udpConn  net.PacketConn
+	tr       *http3.Transport
+	hconn    *http3.ClientConn
+	quicConn *quic.Conn
+	ipConn   *connectip.Conn
+	rsp      *http.Response
+	err      error
+}
+
+// close releases whatever resources the attempt managed to open.
+func (a tunnelAttempt) close() {
+	if a.ipConn != nil {
+		a.ipConn.Close()
+	}
+	if a.tr != nil {
+		a.tr.Close()
+	}
+	if a.udpConn != nil {
+		a.udpConn.Close()
+	}
+}
+
+// ConnectTunnelRace connects to multiple endpoints in the style of Happy Eyeballs (RFC 8305).
+// Attempts are started in the given order, each one delay after the previous or as soon as
+// the previous one failed. The first attempt to complete the Connect-IP handshake wins and
+// all others are cancelled.
+//
+// Parameters:
+//   - ctx: context.Context - The QUIC TLS context.
+//   - tlsConfig: *tls.Config - The TLS configuration for secure communication.
+//   - quicConfig: *quic.Config - The QUIC configuration settings.
+//   - connectUri: string - The URI template for the Connect-IP request.
+//   - endpoints: []*net.UDPAddr - The candidate endpoints in order of preference.
+//   - delay: time.Duration - The delay between starting attempts.
+//
+// Returns:
+//   - *net.UDPAddr: The endpoint that won.
+//   - net.PacketConn: The UDP socket used for the QUIC session.
+//   - *http3.Transport: The HTTP/3 transport used for initial request.
+//   - *connectip.Conn: The Connect-IP connection instance.
+//   - *http.Response: The response from the Connect-IP handshake.
+//   - error: An error if all attempts fail.
+func ConnectTunnelRace(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoints []*net.UDPAddr, delay time.Duration) (*net.UDPAddr, net.PacketConn, *http3.Transport, *connectip.Conn, *http.Response, error) {
+	winner, err := raceTunnel(ctx, nil, tlsConfig, quicConfig, connectUri, endpoints, delay)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	return winner.endpoint, winner.udpConn, winner.tr, winner.ipConn, winner.rsp, nil
+}
+
+// raceTunnel is ConnectTunnelRace, keeping the HTTP/3 connection of the winner for a later RefreshTunnel.
+// The progress is recorded in status unless it is nil.
+func raceTunnel(ctx context.Context, status *TunnelStatus, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoints []*net.UDPAddr, delay time.Duration) (*tunnelAttempt, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("no endpoints to connect to")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan tunnelAttempt, len(endpoints))
+	start := func(endpoint *net.UDPAddr) {
+		go func() {
+			attempt := connectTunnel(ctx, status, tlsConfig.Clone(), quicConfig.Clone(), connectUri, endpoint)
+			if attempt.err == nil && attempt.rsp.StatusCode != http.StatusOK {
+				attempt.err = fmt.Errorf("tunnel connection failed: %s", attempt.rsp.Status)
+			}
+			results <- attempt
+		}()
+	}
+
+	start(endpoints[0])
+	next, pending := 1, 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var winner *tunnelAttempt
+	var errs []error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if winner == nil && next < len(endpoints) {
+				start(endpoints[next])
+				next++
+				pending++
+				timer.Reset(delay)
+			}
+		case attempt := <-results:
+			pending--
+			if attempt.err != nil {
+				attempt.close()
+				errs = append(errs, fmt.Errorf("%s: %v", attempt.endpoint, attempt.err))
+				// a failed attempt starts the next one right away
+				if winner == nil && next < len(endpoints) {
+					start(endpoints[next])
+					next++
+					pending++
+					timer.Reset(delay)
+				}
+				continue
+			}
+			if winner != nil {
+				attempt.close()
+				continue
+			}
+			winner = &attempt
+			cancel()
+		}
+	}
+
+	if winner == nil {
+		return nil, errors.Join(errs...)
+	}
+
+	return winner, nil
+}
@@ -0,0 +1,57 @@
+package api
+
+import "net"
+
+// TunnelHooks holds callbacks for state changes of MaintainTunnel, so embedders and scripts
+// can react to them, e.g. update DNS or notify a UI, without parsing logs. Every field is optional.
+// The callbacks run on the goroutine of MaintainTunnel, slow work belongs in a goroutine of its own.
+type TunnelHooks struct {
+	// OnConnect is called once the tunnel is up.
+	OnConnect func(endpoint *net.UDPAddr)
+	// OnDisconnect is called when an established tunnel is lost or shut down.
+	OnDisconnect func(endpoint *net.UDPAddr, err error)
+	// OnReconnect is called whenever MaintainTunnel decides to try again, after OnError or OnDisconnect.
+	OnReconnect func(decision ReconnectDecision)
+	// OnError is called when a connection attempt fails.
+	OnError func(err error)
+	// OnStandby is called when the primary registration is rejected and Standby takes over.
+	OnStandby func(deviceID string)
+}
+
+// Hooks are the callbacks of all tunnels in this process. Set them before starting MaintainTunnel.
+var Hooks TunnelHooks
+
+// hookConnect calls Hooks.OnConnect if set.
+func hookConnect(endpoint *net.UDPAddr) {
+	if Hooks.OnConnect != nil {
+		Hooks.OnConnect(endpoint)
+	}
+}
+
+// hookDisconnect calls Hooks.OnDisconnect if set.
+func hookDisconnect(endpoint *net.UDPAddr, err error) {
+	if Hooks.OnDisconnect != nil {
+		Hooks.OnDisconnect(endpoint, err)
+	}
+}
+
+// hookReconnect calls Hooks.OnReconnect if set.
+func hookReconnect(decision ReconnectDecision) {
+	if Hooks.OnReconnect != nil {
+		Hooks.OnReconnect(decision)
+	}
+}
+
+// hookError calls Hooks.OnError if set.
+func hookError(err error) {
+	if Hooks.OnError != nil {
+		Hooks.OnError(err)
+	}
+}
+
+// hookStandby calls Hooks.OnStandby if set.
+func hookStandby(deviceID string) {
+	if Hooks.OnStandby != nil {
+		Hooks.OnStandby(deviceID)
+	}
+}
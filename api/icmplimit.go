@@ -0,0 +1,117 @@
+package api
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal/packet"
+)
+
+// ICMPRateLimit is how many ICMP error messages usque generates per second in total, such as
+// the packet too big answers to packets that don't fit into a datagram. 0 for no limit.
+// Up to a second worth of messages may be sent at once.
+var ICMPRateLimit = 1000
+
+// ICMPFlowRateLimit is how many ICMP error messages usque generates per second for the packets
+// between the same two addresses, so a single sender ignoring them can't use up ICMPRateLimit.
+// 0 for no limit.
+var ICMPFlowRateLimit = 10
+
+// icmpLimitFlows bounds the flows the limiter keeps, idle ones are removed first once it's full.
+const icmpLimitFlows = 4096
+
+// tokenBucket allows rate events per second, up to rate at once.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take reports whether an event may happen now, taking a token if so.
+func (b *tokenBucket) take(rate int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens = min(float64(rate), b.tokens+now.Sub(b.last).Seconds()*float64(rate))
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// icmpFlow is the pair of addresses of an ICMP error message.
+type icmpFlow struct {
+	src, dst netip.Addr
+}
+
+// icmpLimiter rate limits the ICMP error messages of all tunnels in this process.
+var icmpLimiter = struct {
+	mu     sync.Mutex
+	global tokenBucket
+	flows  map[icmpFlow]*tokenBucket
+}{flows: map[icmpFlow]*tokenBucket{}}
+
+// allowICMPError reports whether a locally generated ICMP error message may be written to the
+// device, as limited by ICMPRateLimit and ICMPFlowRateLimit, and counts it in the metrics of t.
+//
+// Parameters:
+//   - icmp: []byte - The IP packet carrying the ICMP message.
+//
+// Returns:
+//   - bool: False if the message has to be dropped.
+func (t *Tunnel) allowICMPError(icmp []byte) bool {
+	flow, ok := icmpFlowOf(icmp)
+	now := time.Now()
+
+	icmpLimiter.mu.Lock()
+	allowed := true
+	if ok && ICMPFlowRateLimit > 0 {
+		bucket := icmpLimiter.flows[flow]
+		if bucket == nil {
+			if len(icmpLimiter.flows) >= icmpLimitFlows {
+				pruneICMPFlows(now)
+			}
+			bucket = &tokenBucket{}
+			icmpLimiter.flows[flow] = bucket
+		}
+		allowed = bucket.take(ICMPFlowRateLimit, now)
+	}
+	// messages dropped for their flow don't use up the global limit
+	allowed = allowed && icmpLimiter.global.take(ICMPRateLimit, now)
+	icmpLimiter.mu.Unlock()
+
+	if !allowed {
+		t.Metrics.icmpLimited.Add(1)
+		return false
+	}
+	t.Metrics.icmpErrors.Add(1)
+	return true
+}
+
+// pruneICMPFlows removes the flows that have been idle long enough to have a full bucket again,
+// or all of them if none has. The caller holds icmpLimiter.mu.
+func pruneICMPFlows(now time.Time) {
+	for flow, bucket := range icmpLimiter.flows {
+		if now.Sub(bucket.last) >= time.Second {
+			delete(icmpLimiter.flows, flow)
+		}
+	}
+	if len(icmpLimiter.flows) >= icmpLimitFlows {
+		clear(icmpLimiter.flows)
+	}
+}
+
+// icmpFlowOf returns the addresses of an IP packet.
+func icmpFlowOf(pkt []byte) (icmpFlow, bool) {
+	ip, ok := packet.Parse(pkt)
+	if !ok {
+		return icmpFlow{}, false
+	}
+	return icmpFlow{ip.Src(), ip.Dst()}, true
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/netip"
+	"sync/atomic"
+)
+
+// InboundFilterStats holds the counters of an InboundFilterDevice.
+type InboundFilterStats struct {
+	Accepted  uint64 // Packets delivered to the device
+	Dropped   uint64 // Packets dropped because of their destination address
+	Malformed uint64 // Packets dropped because they could not be parsed
+}
+
+// InboundFilterDevice wraps a TunnelDevice and drops packets received from the server
+// whose destination address isn't one of the allowed prefixes, usually the addresses
+// assigned to us. This protects the local stack (and hosts behind it) from unexpected
+// traffic injected on the provider side. Outgoing packets are passed through unchanged.
+type InboundFilterDevice struct {
+	dev     TunnelDevice
+	allowed []netip.Prefix
+
+	accepted  atomic.Uint64
+	dropped   atomic.Uint64
+	malformed atomic.Uint64
+}
+
+// NewInboundFilterDevice creates a new InboundFilterDevice around dev.
+//
+// Parameters:
+//   - dev: TunnelDevice - The device to wrap.
+//   - allowed: []netip.Prefix - Destination prefixes accepted from the server.
+//
+// Returns:
+//   - *InboundFilterDevice: The filtering device.
+func NewInboundFilterDevice(dev TunnelDevice, allowed []netip.Prefix) *InboundFilterDevice {
+	return &InboundFilterDevice{dev: dev, allowed: allowed}
+}
+
+func (f *InboundFilterDevice) ReadPacket(buf []byte) (int, error) {
+	return f.dev.ReadPacket(buf)
+}
+
+func (f *InboundFilterDevice) WritePacket(pkt []byte) error {
+	key, ok := parseFlowKey(pkt)
+	if !ok {
+		f.malformed.Add(1)
+		return nil
+	}
+
+	if !f.allows(key.Dst) {
+		f.dropped.Add(1)
+		return nil
+	}
+
+	f.accepted.Add(1)
+	return f.dev.WritePacket(pkt)
+}
+
+// allows reports whether addr is within one of the allowed prefixes.
+func (f *InboundFilterDevice) allows(addr netip.Addr) bool {
+	for _, prefix := range f.allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats returns a snapshot of the filter counters.
+func (f *InboundFilterDevice) Stats() InboundFilterStats {
+	return InboundFilterStats{
+		Accepted:  f.accepted.Load(),
+		Dropped:   f.dropped.Load(),
+		Malformed: f.malformed.Load(),
+	}
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// IPFIX (RFC 7011) constants.
+const (
+	ipfixVersion        = 10
+	ipfixTemplateSetID  = 2
+	ipfixTemplateIPv4   = 256
+	ipfixTemplateIPv6   = 257
+	ipfixMaxMessageSize = 1400
+)
+
+// ipfixField is an information element in a template.
+type ipfixField struct {
+	id     uint16
+	length uint16
+}
+
+// IPFIX information elements (https://www.iana.org/assignments/ipfix/ipfix.xhtml).
+var (
+	ipfixFieldsIPv4 = []ipfixField{
+		{8, 4},   // sourceIPv4Address
+		{12, 4},  // destinationIPv4Address
+		{4, 1},   // protocolIdentifier
+		{7, 2},   // sourceTransportPort
+		{11, 2},  // destinationTransportPort
+		{1, 8},   // octetDeltaCount
+		{2, 8},   // packetDeltaCount
+		{152, 8}, // flowStartMilliseconds
+		{153, 8}, // flowEndMilliseconds
+	}
+	ipfixFieldsIPv6 = []ipfixField{
+		{27, 16}, // sourceIPv6Address
+		{28, 16}, // destinationIPv6Address
+		{4, 1},   // protocolIdentifier
+		{7, 2},   // sourceTransportPort
+		{11, 2},  // destinationTransportPort
+		{1, 8},   // octetDeltaCount
+		{2, 8},   // packetDeltaCount
+		{152, 8}, // flowStartMilliseconds
+		{153, 8}, // flowEndMilliseconds
+	}
+)
+
+// IPFIXExporter encodes flow records as IPFIX messages and writes them to a collector.
+// Templates are included in every message, as recommended for unreliable transports like UDP.
+type IPFIXExporter struct {
+	w             io.Writer
+	domainID      uint32
+	sequence      uint32
+	templateSet   []byte
+	recordLenIPv4 int
+	recordLenIPv6 int
+}
+
+// NewIPFIXExporter creates a new IPFIXExporter writing one message per Write call to w.
+//
+// Parameters:
+//   - w: io.Writer - The writer, usually a connected UDP socket.
+//   - domainID: uint32 - The observation domain ID to put in message headers.
+//
+// Returns:
+//   - *IPFIXExporter: The exporter.
+func NewIPFIXExporter(w io.Writer, domainID uint32) *IPFIXExporter {
+	e := &IPFIXExporter{
+		w:        w,
+		domainID: domainID,
+	}
+
+	templates := []byte{}
+	for _, tmpl := range []struct {
+		id     uint16
+		fields []ipfixField
+	}{{ipfixTemplateIPv4, ipfixFieldsIPv4}, {ipfixTemplateIPv6, ipfixFieldsIPv6}} {
+		templates = binary.BigEndian.AppendUint16(templates, tmpl.id)
+		templates = binary.BigEndian.AppendUint16(templates, uint16(len(tmpl.fields)))
+		for _, field := range tmpl.fields {
+			templates = binary.BigEndian.AppendUint16(templates, field.id)
+			templates = binary.BigEndian.AppendUint16(templates, field.length)
+		}
+	}
+	e.templateSet = binary.BigEndian.AppendUint16(nil, ipfixTemplateSetID)
+	e.templateSet = binary.BigEndian.AppendUint16(e.templateSet, uint16(4+len(templates)))
+	e.templateSet = append(e.templateSet, templates...)
+
+	for _, field := range ipfixFieldsIPv4 {
+		e.recordLenIPv4 += int(field.length)
+	}
+	for _, field := range ipfixFieldsIPv6 {
+		e.recordLenIPv6 += int(field.length)
+	}
+
+	return e
+}
+
+// Export encodes the records and writes them in as many messages as needed.
+//
+// Parameters:
+//   - records: []FlowRecord - The flows to export.
+//
+// Returns:
+//   - error: An error if writing a message fails.
+func (e *IPFIXExporter) Export(records []FlowRecord) error {
+	var v4, v6 []FlowRecord
+	for _, record := range records {
+		if record.Src.Is4() {
+			v4 = append(v4, record)
+		} else {
+			v6 = append(v6, record)
+		}
+	}
+
+	// at least send the templates, so collectors learn about us early
+	if len(v4) == 0 && len(v6) == 0 {
+		return e.writeMessage(nil, nil)
+	}
+
+	free := ipfixMaxMessageSize - 16 - len(e.templateSet) - 2*4
+	for len(v4) > 0 || len(v6) > 0 {
+		n4 := min(len(v4), free/e.recordLenIPv4)
+		n6 := min(len(v6), (free-n4*e.recordLenIPv4)/e.recordLenIPv6)
+		if err := e.writeMessage(v4[:n4], v6[:n6]); err != nil {
+			return err
+		}
+		v4 = v4[n4:]
+		v6 = v6[n6:]
+	}
+
+	return nil
+}
+
+// writeMessage writes a single IPFIX message with the templates and the given records.
+func (e *IPFIXExporter) writeMessage(v4, v6 []FlowRecord) error {
+	msg := make([]byte, 16, ipfixMaxMessageSize)
+	msg = append(msg, e.templateSet...)
+	msg = appendIPFIXDataSet(msg, ipfixTemplateIPv4, v4)
+	msg = appendIPFIXDataSet(msg, ipfixTemplateIPv6, v6)
+
+	binary.BigEndian.PutUint16(msg[0:2], ipfixVersion)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)))
+	binary.BigEndian.PutUint32(msg[4:8], uint32(time.Now().Unix()))
+	binary.BigEndian.PutUint32(msg[8:12], e.sequence)
+	binary.BigEndian.PutUint32(msg[12:16], e.domainID)
+
+	if _, err := e.w.Write(msg); err != nil {
+		return err
+	}
+	// sequence counts data records, not messages
+	e.sequence += uint32(len(v4) + len(v6))
+
+	return nil
+}
+
+// appendIPFIXDataSet appends a data set for the given template to msg.
+// Nothing is appended if records is empty.
+func appendIPFIXDataSet(msg []byte, templateID uint16, records []FlowRecord) []byte {
+	if len(records) == 0 {
+		return msg
+	}
+
+	start := len(msg)
+	msg = binary.BigEndian.AppendUint16(msg, templateID)
+	msg = binary.BigEndian.AppendUint16(msg, 0) // length, filled in below
+
+	for _, record := range records {
+		msg = append(msg, record.Src.AsSlice()...)
+		msg = append(msg, record.Dst.AsSlice()...)
+		msg = append(msg, record.Protocol)
+		msg = binary.BigEndian.AppendUint16(msg, record.SrcPort)
+		msg = binary.BigEndian.AppendUint16(msg, record.DstPort)
+		msg = binary.BigEndian.AppendUint64(msg, record.Bytes)
+		msg = binary.BigEndian.AppendUint64(msg, record.Packets)
+		msg = binary.BigEndian.AppendUint64(msg, uint64(record.Start.UnixMilli()))
+		msg = binary.BigEndian.AppendUint64(msg, uint64(record.End.UnixMilli()))
+	}
+
+	binary.BigEndian.PutUint16(msg[start+2:start+4], uint16(len(msg)-start))
+	return msg
+}
@@ -0,0 +1,244 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+// messageWriter records every message written to it.
+type messageWriter struct {
+	messages [][]byte
+	err      error
+}
+
+func (w *messageWriter) Write(msg []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.messages = append(w.messages, slices.Clone(msg))
+	return len(msg), nil
+}
+
+// ipfixMessage is a decoded IPFIX message.
+type ipfixMessage struct {
+	sequence  uint32
+	domainID  uint32
+	templates map[uint16][]ipfixField
+	records   []FlowRecord
+}
+
+// decodeIPFIX decodes a message written by IPFIXExporter, checking its framing as a collector would.
+func decodeIPFIX(t *testing.T, msg []byte) ipfixMessage {
+	t.Helper()
+	if len(msg) < 16 || binary.BigEndian.Uint16(msg[0:2]) != ipfixVersion {
+		t.Fatalf("invalid message header %x", msg)
+	}
+	if length := int(binary.BigEndian.Uint16(msg[2:4])); length != len(msg) {
+		t.Fatalf("message length = %d, want %d", length, len(msg))
+	}
+	if len(msg) > ipfixMaxMessageSize {
+		t.Fatalf("message of %d bytes exceeds %d", len(msg), ipfixMaxMessageSize)
+	}
+	decoded := ipfixMessage{
+		sequence:  binary.BigEndian.Uint32(msg[8:12]),
+		domainID:  binary.BigEndian.Uint32(msg[12:16]),
+		templates: map[uint16][]ipfixField{},
+	}
+
+	for sets := msg[16:]; len(sets) > 0; {
+		if len(sets) < 4 {
+			t.Fatalf("truncated set header %x", sets)
+		}
+		id, length := binary.BigEndian.Uint16(sets[0:2]), int(binary.BigEndian.Uint16(sets[2:4]))
+		if length < 4 || length > len(sets) {
+			t.Fatalf("set %d has length %d of %d bytes left", id, length, len(sets))
+		}
+		body := sets[4:length]
+		sets = sets[length:]
+
+		if id == ipfixTemplateSetID {
+			for len(body) > 0 {
+				templateID, count := binary.BigEndian.Uint16(body[0:2]), int(binary.BigEndian.Uint16(body[2:4]))
+				var fields []ipfixField
+				for i := 0; i < count; i++ {
+					field := body[4+4*i:]
+					fields = append(fields, ipfixField{binary.BigEndian.Uint16(field[0:2]), binary.BigEndian.Uint16(field[2:4])})
+				}
+				decoded.templates[templateID] = fields
+				body = body[4+4*count:]
+			}
+			continue
+		}
+
+		fields, ok := decoded.templates[id]
+		if !ok {
+			t.Fatalf("data set %d without a template", id)
+		}
+		for len(body) > 0 {
+			var record FlowRecord
+			for _, field := range fields {
+				value := body[:field.length]
+				body = body[field.length:]
+				switch field.id {
+				case 8, 27:
+					record.Src, _ = netip.AddrFromSlice(value)
+				case 12, 28:
+					record.Dst, _ = netip.AddrFromSlice(value)
+				case 4:
+					record.Protocol = value[0]
+				case 7:
+					record.SrcPort = binary.BigEndian.Uint16(value)
+				case 11:
+					record.DstPort = binary.BigEndian.Uint16(value)
+				case 1:
+					record.Bytes = binary.BigEndian.Uint64(value)
+				case 2:
+					record.Packets = binary.BigEndian.Uint64(value)
+				case 152:
+					record.Start = time.UnixMilli(int64(binary.BigEndian.Uint64(value)))
+				case 153:
+					record.End = time.UnixMilli(int64(binary.BigEndian.Uint64(value)))
+				}
+			}
+			decoded.records = append(decoded.records, record)
+		}
+	}
+	return decoded
+}
+
+// flowRecord builds a record with times at millisecond precision, as IPFIX carries them.
+func flowRecord(src, dst string, protocol uint8, srcPort, dstPort uint16, packets uint64) FlowRecord {
+	start := time.UnixMilli(1700000000000)
+	return FlowRecord{
+		FlowKey:   FlowKey{Src: netip.MustParseAddr(src), Dst: netip.MustParseAddr(dst), SrcPort: srcPort, DstPort: dstPort, Protocol: protocol},
+		FlowStats: FlowStats{Packets: packets, Bytes: packets * 100, Start: start, End: start.Add(1500 * time.Millisecond)},
+	}
+}
+
+func TestIPFIXExport(t *testing.T) {
+	records := []FlowRecord{
+		flowRecord("172.16.0.2", "1.1.1.1", protoUDP, 40000, 53, 2),
+		flowRecord("2606:4700:110::2", "2606:4700:4700::1111", protoTCP, 40001, 443, 10),
+		flowRecord("172.16.0.2", "1.0.0.1", protoICMP, 0, 0, 1),
+	}
+	w := &messageWriter{}
+	exporter := NewIPFIXExporter(w, 42)
+	if err := exporter.Export(records); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if len(w.messages) != 1 {
+		t.Fatalf("Export wrote %d messages, want 1", len(w.messages))
+	}
+
+	msg := decodeIPFIX(t, w.messages[0])
+	if msg.domainID != 42 || msg.sequence != 0 {
+		t.Errorf("domain ID, sequence = %d, %d, want 42, 0", msg.domainID, msg.sequence)
+	}
+	if !slices.Equal(msg.templates[ipfixTemplateIPv4], ipfixFieldsIPv4) || !slices.Equal(msg.templates[ipfixTemplateIPv6], ipfixFieldsIPv6) {
+		t.Errorf("templates = %v", msg.templates)
+	}
+	// IPv4 records come first, in their own data set
+	want := []FlowRecord{records[0], records[2], records[1]}
+	if len(msg.records) != len(want) {
+		t.Fatalf("decoded %d records, want %d", len(msg.records), len(want))
+	}
+	for i := range want {
+		if got := msg.records[i]; got.FlowKey != want[i].FlowKey || got.Packets != want[i].Packets || got.Bytes != want[i].Bytes ||
+			!got.Start.Equal(want[i].Start) || !got.End.Equal(want[i].End) {
+			t.Errorf("record %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+
+	// the sequence number counts the records exported before
+	if err := exporter.Export(records[:1]); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if msg := decodeIPFIX(t, w.messages[1]); msg.sequence != 3 {
+		t.Errorf("sequence of the second message = %d, want 3", msg.sequence)
+	}
+}
+
+func TestIPFIXExportSplitsMessages(t *testing.T) {
+	var records []FlowRecord
+	for i := range 100 {
+		records = append(records, flowRecord("172.16.0.2", "1.1.1.1", protoUDP, uint16(10000+i), 53, 1))
+		records = append(records, flowRecord("2606:4700:110::2", "2606:4700:4700::1111", protoUDP, uint16(20000+i), 53, 1))
+	}
+	w := &messageWriter{}
+	if err := NewIPFIXExporter(w, 0).Export(records); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if len(w.messages) < 2 {
+		t.Fatalf("Export wrote %d messages for %d records, want them split", len(w.messages), len(records))
+	}
+
+	exported := 0
+	for _, raw := range w.messages {
+		msg := decodeIPFIX(t, raw)
+		if int(msg.sequence) != exported {
+			t.Errorf("sequence = %d, want %d", msg.sequence, exported)
+		}
+		exported += len(msg.records)
+	}
+	if exported != len(records) {
+		t.Errorf("exported %d records, want %d", exported, len(records))
+	}
+}
+
+func TestIPFIXExportEmpty(t *testing.T) {
+	w := &messageWriter{}
+	if err := NewIPFIXExporter(w, 0).Export(nil); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if len(w.messages) != 1 {
+		t.Fatalf("Export wrote %d messages, want the templates alone", len(w.messages))
+	}
+	if msg := decodeIPFIX(t, w.messages[0]); len(msg.templates) != 2 || len(msg.records) != 0 {
+		t.Errorf("message = %+v, want 2 templates and no records", msg)
+	}
+
+	w.err = errors.New("collector gone")
+	if err := NewIPFIXExporter(w, 0).Export(nil); !errors.Is(err, w.err) {
+		t.Errorf("Export = %v, want the write error", err)
+	}
+}
+
+func TestFlowTrackerDrain(t *testing.T) {
+	client := netip.AddrPortFrom(netip.MustParseAddr("172.16.0.2"), 40000)
+	server := netip.AddrPortFrom(netip.MustParseAddr("1.1.1.1"), 53)
+	request := natTransport(protoUDP, client, server)
+	reply := natTransport(protoUDP, server, client)
+
+	tracker := NewFlowTracker()
+	tracker.Observe(request)
+	tracker.Observe(request)
+	tracker.Observe(reply)
+	tracker.Observe([]byte{0x45})
+
+	flows := tracker.Drain()
+	if len(flows) != 2 {
+		t.Fatalf("Drain = %+v, want the two directions as flows", flows)
+	}
+	for _, flow := range flows {
+		want := FlowStats{Packets: 1, Bytes: uint64(len(reply))}
+		if flow.Src == client.Addr() {
+			want = FlowStats{Packets: 2, Bytes: uint64(2 * len(request))}
+		}
+		if flow.Packets != want.Packets || flow.Bytes != want.Bytes || flow.End.Before(flow.Start) {
+			t.Errorf("flow %+v, want %d packets and %d bytes", flow, want.Packets, want.Bytes)
+		}
+	}
+
+	// counters are deltas since the last drain
+	if flows := tracker.Drain(); len(flows) != 0 {
+		t.Errorf("second Drain = %+v, want nothing", flows)
+	}
+	tracker.Observe(request)
+	if flows := tracker.Drain(); len(flows) != 1 || flows[0].Packets != 1 {
+		t.Errorf("Drain after another packet = %+v, want one packet", flows)
+	}
+}
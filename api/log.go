@@ -0,0 +1,24 @@
+package api
+
+import "log/slog"
+
+// Logger receives the log messages of the api package, nil for slog.Default().
+// Every message carries a component attribute: "tunnel" for connecting and reconnecting,
+// "h3" for the MASQUE connection and "tun" for the device side.
+var Logger *slog.Logger
+
+// Components of the api package's log messages.
+const (
+	componentTunnel = "tunnel"
+	componentH3     = "h3"
+	componentTun    = "tun"
+)
+
+// logFor returns the logger for messages of the given component.
+func logFor(component string) *slog.Logger {
+	logger := Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With("component", component)
+}
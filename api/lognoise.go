@@ -0,0 +1,64 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+)
+
+// protocolQuirk is a log line of connect-ip-go that reports a known-benign server behavior.
+type protocolQuirk struct {
+	match   [][]byte                              // all of these must appear in the line
+	counter func(m *TunnelMetrics) *atomic.Uint64 // where occurrences are counted instead
+}
+
+// protocolQuirks lists the log lines ProtocolLogFilter counts instead of printing.
+var protocolQuirks = []protocolQuirk{
+	// the server occasionally sends packets to addresses outside of the assigned ones, other reasons
+	// for dropping a packet from the server (malformed, foreign source) are still logged
+	{match: [][]byte{[]byte("dropping proxied packet: "), []byte("destination address / protocol not allowed")}, counter: func(m *TunnelMetrics) *atomic.Uint64 { return &m.foreignDestinations }},
+	// the server closes idle streams cleanly, MaintainTunnel already logs the reconnect
+	{match: [][]byte{[]byte("handling stream failed"), []byte("NO_ERROR")}, counter: func(m *TunnelMetrics) *atomic.Uint64 { return &m.noErrorResets }},
+}
+
+// ProtocolLogFilter is a log writer that counts known-benign protocol messages in the metrics of
+// a tunnel instead of printing them, so long-running logs stay readable. All other lines are passed through.
+type ProtocolLogFilter struct {
+	out     io.Writer
+	metrics *TunnelMetrics
+}
+
+// NewProtocolLogFilter creates a ProtocolLogFilter, meant to be used with log.SetOutput.
+// The log package is shared by the whole process, so the messages of all tunnels are counted
+// in the metrics of the given one.
+//
+// Parameters:
+//   - out: io.Writer - Where lines that aren't filtered are written to.
+//   - tunnel: *Tunnel - The tunnel whose metrics count the filtered lines.
+//
+// Returns:
+//   - *ProtocolLogFilter: The filter.
+func NewProtocolLogFilter(out io.Writer, tunnel *Tunnel) *ProtocolLogFilter {
+	return &ProtocolLogFilter{out: out, metrics: tunnel.Metrics}
+}
+
+// Write implements io.Writer. The log package calls it once per line.
+func (f *ProtocolLogFilter) Write(p []byte) (int, error) {
+	for _, quirk := range protocolQuirks {
+		if matchesAll(p, quirk.match) {
+			quirk.counter(f.metrics).Add(1)
+			return len(p), nil
+		}
+	}
+	return f.out.Write(p)
+}
+
+// matchesAll reports whether line contains all of the given substrings.
+func matchesAll(line []byte, match [][]byte) bool {
+	for _, m := range match {
+		if !bytes.Contains(line, m) {
+			return false
+		}
+	}
+	return true
+}
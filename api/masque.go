@@ -7,10 +7,15 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
 
 	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/Diniboy1123/usque/internal"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/yosida95/uritemplate/v3"
@@ -27,8 +32,11 @@ import (
 //
 // Returns:
 //   - *tls.Config: A TLS configuration for secure communication.
-//   - error: An error if TLS setup fails.
+//   - error: An error if the SNI is invalid or TLS setup fails.
 func PrepareTlsConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, cert [][]byte, sni string) (*tls.Config, error) {
+	if err := ValidateSNI(sni); err != nil {
+		return nil, err
+	}
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{
 			{
@@ -51,6 +59,10 @@ func PrepareTlsConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, ce
 				return err
 			}
 
+			if err := verifyPinnedLeaf(cert); err != nil {
+				return err
+			}
+
 			if _, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok {
 				// we only support ECDSA
 				// TODO: don't hardcode cert type in the future
@@ -73,6 +85,106 @@ func PrepareTlsConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, ce
 	return tlsConfig, nil
 }
 
+// SocketProtector, if set, is called with the file descriptor of every UDP socket opened to reach
+// a MASQUE server, before it is used. VPN apps need this to keep the tunnel's own traffic out of
+// the tunnel, e.g. with VpnService.protect on Android.
+var SocketProtector func(fd uintptr) error
+
+// BindInterface, if set, is the network interface sockets to MASQUE servers and proxies are bound to,
+// so multi-homed hosts can pick the uplink and the tunnel's own traffic can't loop back into it.
+var BindInterface string
+
+// BindAddress, if valid, is the local source address of sockets to MASQUE servers and proxies.
+var BindAddress netip.Addr
+
+// SocketMark, if not 0, is the firewall mark (SO_MARK on Linux) of sockets to MASQUE servers and proxies,
+// so firewall rules on the same host can tell tunnel traffic apart from everything else.
+var SocketMark uint32
+
+// SocketDSCP, if not 0, is the DSCP value of the packets sent to MASQUE servers and proxies, so routers
+// can prioritize the tunnel. quic-go's ECN marks would reset it, so ECN is off while it is set.
+var SocketDSCP uint8
+
+// controlSocket binds a socket to BindInterface, marks it with SocketMark and SocketDSCP and applies
+// SocketProtector before it is connected or bound.
+func controlSocket(network, address string, c syscall.RawConn) error {
+	var controlErr error
+	if err := c.Control(func(fd uintptr) {
+		if BindInterface != "" {
+			if controlErr = internal.BindToInterface(fd, network, BindInterface); controlErr != nil {
+				controlErr = fmt.Errorf("failed to bind to interface %s: %v", BindInterface, controlErr)
+				return
+			}
+		}
+		if SocketMark != 0 {
+			if controlErr = internal.SetSocketMark(fd, SocketMark); controlErr != nil {
+				controlErr = fmt.Errorf("failed to set socket mark: %v", controlErr)
+				return
+			}
+		}
+		if SocketDSCP != 0 {
+			if controlErr = internal.SetSocketDSCP(fd, network, SocketDSCP); controlErr != nil {
+				controlErr = fmt.Errorf("failed to set DSCP: %v", controlErr)
+				return
+			}
+		}
+		if SocketProtector != nil {
+			controlErr = SocketProtector(fd)
+		}
+	}); err != nil {
+		return err
+	}
+	return controlErr
+}
+
+// needsSocketControl reports whether sockets need controlSocket applied.
+func needsSocketControl() bool {
+	return BindInterface != "" || SocketMark != 0 || SocketDSCP != 0 || SocketProtector != nil
+}
+
+// NewDialer returns a dialer for TCP connections honoring BindInterface, BindAddress, SocketMark, SocketDSCP and SocketProtector.
+func NewDialer() *net.Dialer {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if BindAddress.IsValid() {
+		dialer.LocalAddr = &net.TCPAddr{IP: BindAddress.AsSlice()}
+	}
+	if needsSocketControl() {
+		dialer.Control = controlSocket
+	}
+	return dialer
+}
+
+// listenUDPFor opens an unconnected UDP socket on a random port matching the address family of the endpoint.
+func listenUDPFor(endpoint *net.UDPAddr) (*net.UDPConn, error) {
+	laddr := &net.UDPAddr{
+		IP:   net.IPv4zero,
+		Port: 0,
+	}
+	network := "udp4"
+	if endpoint.IP.To4() == nil {
+		laddr.IP = net.IPv6zero
+		network = "udp6"
+	}
+
+	if BindAddress.IsValid() {
+		if BindAddress.Unmap().Is4() != (network == "udp4") {
+			return nil, fmt.Errorf("bind address %s can't reach %s", BindAddress, endpoint)
+		}
+		laddr.IP = BindAddress.AsSlice()
+	}
+
+	if !needsSocketControl() {
+		return net.ListenUDP("udp", laddr)
+	}
+
+	lc := net.ListenConfig{Control: controlSocket}
+	conn, err := lc.ListenPacket(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
 // ConnectTunnel establishes a QUIC connection and sets up a Connect-IP tunnel with the provided endpoint.
 // Endpoint address is used to check whether the authentication/connection is successful or not.
 // Requires modified connect-ip-go for now to support Cloudflare's non RFC compliant implementation.
@@ -85,29 +197,29 @@ func PrepareTlsConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, ce
 //   - endpoint: *net.UDPAddr - The UDP address of the QUIC server.
 //
 // Returns:
-//   - *net.UDPConn: The UDP connection used for the QUIC session.
+//   - net.PacketConn: The UDP socket used for the QUIC session, relayed through UpstreamProxy if set.
 //   - *http3.Transport: The HTTP/3 transport used for initial request.
 //   - *connectip.Conn: The Connect-IP connection instance.
 //   - *http.Response: The response from the Connect-IP handshake.
 //   - error: An error if the connection setup fails.
-func ConnectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoint *net.UDPAddr) (*net.UDPConn, *http3.Transport, *connectip.Conn, *http.Response, error) {
-	var udpConn *net.UDPConn
-	var err error
-	if endpoint.IP.To4() == nil {
-		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IPv6zero,
-			Port: 0,
-		})
-	} else {
-		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IPv4zero,
-			Port: 0,
-		})
-	}
+func ConnectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoint *net.UDPAddr) (net.PacketConn, *http3.Transport, *connectip.Conn, *http.Response, error) {
+	attempt := connectTunnel(ctx, nil, tlsConfig, quicConfig, connectUri, endpoint)
+	return attempt.udpConn, attempt.tr, attempt.ipConn, attempt.rsp, attempt.err
+}
+
+// connectTunnel is ConnectTunnel, keeping the HTTP/3 connection for a later RefreshTunnel.
+// The progress is recorded in status unless it is nil.
+func connectTunnel(ctx context.Context, status *TunnelStatus, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoint *net.UDPAddr) tunnelAttempt {
+	attempt := tunnelAttempt{endpoint: endpoint}
+	reportProgress(status, endpoint, ConnectDialing)
+	udpConn, err := listenPacketFor(endpoint)
 	if err != nil {
-		return udpConn, nil, nil, nil, err
+		attempt.err = err
+		return attempt
 	}
+	attempt.udpConn = udpConn
 
+	reportProgress(status, endpoint, ConnectHandshaking)
 	conn, err := quic.Dial(
 		ctx,
 		udpConn,
@@ -116,35 +228,69 @@ func ConnectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.
 		quicConfig,
 	)
 	if err != nil {
-		return udpConn, nil, nil, nil, err
+		attempt.err = err
+		return attempt
 	}
 
 	tr := &http3.Transport{
-		EnableDatagrams: true,
-		AdditionalSettings: map[uint64]uint64{
-			// official client still sends this out as well, even though
-			// it's deprecated, see https://datatracker.ietf.org/doc/draft-ietf-masque-h3-datagram/00/
-			// SETTINGS_H3_DATAGRAM_00 = 0x0000000000000276
-			// https://github.com/cloudflare/quiche/blob/7c66757dbc55b8d0c3653d4b345c6785a181f0b7/quiche/src/h3/frame.rs#L46
-			0x276: 1,
-		},
+		EnableDatagrams:    true,
+		AdditionalSettings: maps.Clone(internal.H3Settings),
 		DisableCompression: true,
 	}
 
 	hconn := tr.NewClientConn(conn)
 
+	// connectip.Dial waits for the settings too, waiting here tells the stages apart
+	reportProgress(status, endpoint, ConnectWaitingSettings)
+	select {
+	case <-ctx.Done():
+		attempt.err = context.Cause(ctx)
+		return attempt
+	case <-hconn.Context().Done():
+		attempt.err = context.Cause(hconn.Context())
+		return attempt
+	case <-hconn.ReceivedSettings():
+	}
+
+	attempt.ipConn, attempt.rsp, attempt.err = connectIP(ctx, status, hconn, connectUri, endpoint)
+	if attempt.err != nil {
+		return attempt
+	}
+	attempt.tr, attempt.hconn, attempt.quicConn = tr, hconn, conn
+	return attempt
+}
+
+// connectIP sends the Extended CONNECT request of Connect-IP on an established HTTP/3 connection.
+//
+// Parameters:
+//   - ctx: context.Context - The context of the request.
+//   - status: *TunnelStatus - Where the progress is recorded, nil for none.
+//   - hconn: *http3.ClientConn - The HTTP/3 connection, with the settings of the server received.
+//   - connectUri: string - The URI template for the Connect-IP request.
+//   - endpoint: *net.UDPAddr - The endpoint, for progress reports.
+//
+// Returns:
+//   - *connectip.Conn: The Connect-IP connection instance.
+//   - *http.Response: The response to the request.
+//   - error: An error if the request fails.
+func connectIP(ctx context.Context, status *TunnelStatus, hconn *http3.ClientConn, connectUri string, endpoint *net.UDPAddr) (*connectip.Conn, *http.Response, error) {
 	additionalHeaders := http.Header{
 		"User-Agent": []string{""},
 	}
 
 	template := uritemplate.MustNew(connectUri)
+	reportProgress(status, endpoint, ConnectRequestSent)
 	ipConn, rsp, err := connectip.Dial(ctx, hconn, template, "cf-connect-ip", additionalHeaders, true)
 	if err != nil {
 		if err.Error() == "CRYPTO_ERROR 0x131 (remote): tls: access denied" {
-			return udpConn, nil, nil, nil, errors.New("login failed! Please double-check if your tls key and cert is enrolled in the Cloudflare Access service")
+			return nil, nil, errors.New("login failed! Please double-check if your tls key and cert is enrolled in the Cloudflare Access service")
 		}
-		return udpConn, nil, nil, nil, fmt.Errorf("failed to dial connect-ip: %v", err)
+		return nil, nil, fmt.Errorf("failed to dial connect-ip: %w", err)
+	}
+
+	if rsp.StatusCode == http.StatusOK {
+		reportProgress(status, endpoint, ConnectEstablished)
 	}
 
-	return udpConn, tr, ipConn, rsp, nil
+	return ipConn, rsp, nil
 }
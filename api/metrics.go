@@ -0,0 +1,226 @@
+package api
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// cacheLinePad keeps counters written by different goroutines on separate cache lines,
+// so the forwarding loops never contend on the same line.
+type cacheLinePad [64]byte
+
+// directionCounters holds the counters of one forwarding direction.
+// Each direction is updated by a single goroutine unless ForwardWorkers is raised,
+// so the atomics are mostly uncontended.
+type directionCounters struct {
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+	errors  atomic.Uint64
+	drops   atomic.Uint64 // packets dropped because their forwarding queue was full
+	_       cacheLinePad
+}
+
+// add accounts a forwarded packet.
+func (c *directionCounters) add(n int) {
+	c.packets.Add(1)
+	c.bytes.Add(uint64(n))
+}
+
+// TunnelMetrics holds the counters of MaintainTunnel. Updates on the forwarding path are
+// a couple of uncontended atomic additions, everything else is computed in Snapshot.
+// It is safe for concurrent use.
+type TunnelMetrics struct {
+	tx directionCounters // device to server
+	rx directionCounters // server to device
+
+	connects        atomic.Uint64
+	connectFailures atomic.Uint64
+	disconnects     atomic.Uint64
+	connectedSince  atomic.Int64                    // unix nanoseconds, 0 while disconnected
+	connectedTime   atomic.Int64                    // nanoseconds spent connected by connections that ended
+	connectionStart atomic.Pointer[MetricsSnapshot] // counters when the current connection was made
+	handshakeTime   atomic.Int64                    // nanoseconds it took to establish the current connection
+	tooLarge        atomic.Uint64                   // packets rejected as larger than the datagram limit
+	fragmented      atomic.Uint64                   // packets too large that were sent as IPv4 fragments
+	maxPacketSize   atomic.Int64                    // largest packet the current connection carries, 0 if unknown
+	icmpErrors      atomic.Uint64                   // ICMP error messages generated for the device
+	icmpLimited     atomic.Uint64                   // ICMP error messages dropped by the rate limits
+	familyDrops     atomic.Uint64                   // packets of a disabled IP version dropped by FamilyFilterDevice
+
+	foreignDestinations atomic.Uint64 // counted by ProtocolLogFilter
+	noErrorResets       atomic.Uint64 // counted by ProtocolLogFilter
+}
+
+// MetricsSnapshot is a point in time copy of TunnelMetrics.
+type MetricsSnapshot struct {
+	Time            time.Time     // When the snapshot was taken
+	TxPackets       uint64        // Packets sent to the server
+	TxBytes         uint64        // Bytes sent to the server
+	TxErrors        uint64        // Packets that couldn't be sent to the server
+	TxDrops         uint64        // Packets to the server dropped because their forwarding queue was full
+	TxTooLarge      uint64        // Packets to the server rejected as larger than the datagram limit of the connection
+	TxFragmented    uint64        // Packets to the server too large for a datagram, sent as IPv4 fragments instead
+	ICMPErrors      uint64        // ICMP error messages usque generated for the device, e.g. packet too big
+	ICMPLimited     uint64        // ICMP error messages dropped by ICMPRateLimit or ICMPFlowRateLimit
+	RxPackets       uint64        // Packets received from the server
+	RxBytes         uint64        // Bytes received from the server
+	RxErrors        uint64        // Packets that couldn't be received from the server
+	RxDrops         uint64        // Packets from the server dropped because their forwarding queue was full
+	FamilyDrops     uint64        // Packets of an IP version disabled inside the tunnel, dropped in either direction
+	Connects        uint64        // Successful connections
+	ConnectFailures uint64        // Failed connection attempts
+	Disconnects     uint64        // Connections lost
+	ConnectedSince  time.Time     // Start of the current connection, zero while disconnected
+	ConnectedTime   time.Duration // Time spent connected over all connections, including the current one
+	DroppedPackets  uint64        // Packets from the server connect-ip-go dropped as addressed outside of the tunnel, counted from its logs while ProtocolLogFilter is installed
+	NoErrorResets   uint64        // Streams the server closed with H3_NO_ERROR, if logs are filtered
+}
+
+// ConnectionStats holds the counters of a single connection.
+type ConnectionStats struct {
+	TxPackets uint64        // Packets sent to the server
+	TxBytes   uint64        // Bytes sent to the server
+	TxErrors  uint64        // Packets that couldn't be sent to the server
+	RxPackets uint64        // Packets received from the server
+	RxBytes   uint64        // Bytes received from the server
+	RxErrors  uint64        // Packets that couldn't be received from the server
+	Uptime    time.Duration // Time since the connection was made
+	Handshake time.Duration // Time it took to establish the connection, from dialing to the CONNECT response
+
+	// MaxPacketSize is the largest packet the connection carries, as reported by it when it
+	// rejected a packet as too large. 0 until a packet was rejected.
+	MaxPacketSize int
+}
+
+// MetricsRates holds per second rates computed from two snapshots.
+type MetricsRates struct {
+	TxPackets float64
+	TxBytes   float64
+	RxPackets float64
+	RxBytes   float64
+}
+
+// Snapshot returns the current values of all counters.
+func (m *TunnelMetrics) Snapshot() MetricsSnapshot {
+	s := MetricsSnapshot{
+		Time:            time.Now(),
+		TxPackets:       m.tx.packets.Load(),
+		TxBytes:         m.tx.bytes.Load(),
+		TxErrors:        m.tx.errors.Load(),
+		TxDrops:         m.tx.drops.Load(),
+		TxTooLarge:      m.tooLarge.Load(),
+		TxFragmented:    m.fragmented.Load(),
+		ICMPErrors:      m.icmpErrors.Load(),
+		ICMPLimited:     m.icmpLimited.Load(),
+		RxPackets:       m.rx.packets.Load(),
+		RxBytes:         m.rx.bytes.Load(),
+		RxErrors:        m.rx.errors.Load(),
+		RxDrops:         m.rx.drops.Load(),
+		FamilyDrops:     m.familyDrops.Load(),
+		Connects:        m.connects.Load(),
+		ConnectFailures: m.connectFailures.Load(),
+		Disconnects:     m.disconnects.Load(),
+		DroppedPackets:  m.foreignDestinations.Load(),
+		NoErrorResets:   m.noErrorResets.Load(),
+	}
+	s.ConnectedTime = time.Duration(m.connectedTime.Load())
+	if since := m.connectedSince.Load(); since != 0 {
+		s.ConnectedSince = time.Unix(0, since)
+		s.ConnectedTime += s.Time.Sub(s.ConnectedSince)
+	}
+	return s
+}
+
+// Connection returns the counters of the current connection. The totals over all
+// connections are in Snapshot.
+//
+// Returns:
+//   - ConnectionStats: The counters since the current connection was made.
+//   - bool: False while disconnected.
+func (m *TunnelMetrics) Connection() (ConnectionStats, bool) {
+	start := m.connectionStart.Load()
+	s := m.Snapshot()
+	if start == nil || s.ConnectedSince.IsZero() {
+		return ConnectionStats{}, false
+	}
+	return ConnectionStats{
+		TxPackets:     s.TxPackets - start.TxPackets,
+		TxBytes:       s.TxBytes - start.TxBytes,
+		TxErrors:      s.TxErrors - start.TxErrors,
+		RxPackets:     s.RxPackets - start.RxPackets,
+		RxBytes:       s.RxBytes - start.RxBytes,
+		RxErrors:      s.RxErrors - start.RxErrors,
+		Uptime:        s.Time.Sub(s.ConnectedSince),
+		Handshake:     time.Duration(m.handshakeTime.Load()),
+		MaxPacketSize: m.MaxPacketSize(),
+	}, true
+}
+
+// MaxPacketSize returns the largest packet the current connection carries, as reported by the
+// connection the last time it rejected a packet as too large.
+//
+// Returns:
+//   - int: The size in bytes, 0 if no packet was rejected since the connection was made.
+func (m *TunnelMetrics) MaxPacketSize() int {
+	return int(m.maxPacketSize.Load())
+}
+
+// packetTooLarge records a packet of n bytes that the connection rejected as larger than its
+// datagram limit. The limit can change with the path MTU, so the latest one is kept.
+//
+// Parameters:
+//   - n: int - The size of the packet.
+//   - limit: int - The datagram limit of the connection, 0 if unknown, which narrows the
+//     limit down from the rejected size instead.
+func (m *TunnelMetrics) packetTooLarge(n, limit int) {
+	m.tooLarge.Add(1)
+	if limit <= 0 {
+		limit = int(m.maxPacketSize.Load())
+		if limit == 0 || limit >= n {
+			limit = n - 1
+		}
+	}
+	if previous := m.maxPacketSize.Swap(int64(limit)); previous != int64(limit) {
+		logFor(componentTunnel).Debug("Packet too large for the connection", "size", n, "limit", limit)
+	}
+}
+
+// connected records a successful connection that took handshake to establish.
+func (m *TunnelMetrics) connected(handshake time.Duration) {
+	m.connects.Add(1)
+	m.handshakeTime.Store(int64(handshake))
+	// the limit depends on the path of the connection, it is learned again
+	m.maxPacketSize.Store(0)
+	start := m.Snapshot()
+	m.connectionStart.Store(&start)
+	m.connectedSince.Store(start.Time.UnixNano())
+}
+
+// disconnected records the loss of the current connection.
+func (m *TunnelMetrics) disconnected() {
+	m.disconnects.Add(1)
+	if since := m.connectedSince.Swap(0); since != 0 {
+		m.connectedTime.Add(time.Now().UnixNano() - since)
+	}
+	m.connectionStart.Store(nil)
+}
+
+// Rates returns the per second rates between prev and s.
+//
+// Parameters:
+//   - prev: MetricsSnapshot - An earlier snapshot.
+//
+// Returns:
+//   - MetricsRates: The rates, all zero if prev isn't older than s.
+func (s MetricsSnapshot) Rates(prev MetricsSnapshot) MetricsRates {
+	seconds := s.Time.Sub(prev.Time).Seconds()
+	if seconds <= 0 {
+		return MetricsRates{}
+	}
+	return MetricsRates{
+		TxPackets: float64(s.TxPackets-prev.TxPackets) / seconds,
+		TxBytes:   float64(s.TxBytes-prev.TxBytes) / seconds,
+		RxPackets: float64(s.RxPackets-prev.RxPackets) / seconds,
+		RxBytes:   float64(s.RxBytes-prev.RxBytes) / seconds,
+	}
+}
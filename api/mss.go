@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/binary"
+
+	"github.com/Diniboy1123/usque/internal/packet"
+)
+
+// MSSClampDevice wraps a TunnelDevice and lowers the MSS option of TCP SYN packets read from it,
+// so TCP connections never send segments larger than the tunnel carries. The limit is the
+// packet size learned from packets the connection rejected as too large, see TunnelMetrics.MaxPacketSize,
+// so connections opened after the first rejection don't depend on ICMP packet too big reaching the sender.
+type MSSClampDevice struct {
+	dev     TunnelDevice
+	metrics *TunnelMetrics
+}
+
+// NewMSSClampDevice creates a new MSSClampDevice around dev.
+//
+// Parameters:
+//   - tunnel: *Tunnel - The tunnel whose metrics hold the packet size limit.
+//   - dev: TunnelDevice - The device to wrap.
+//
+// Returns:
+//   - *MSSClampDevice: The clamping device.
+func NewMSSClampDevice(tunnel *Tunnel, dev TunnelDevice) *MSSClampDevice {
+	return &MSSClampDevice{dev: dev, metrics: tunnel.Metrics}
+}
+
+func (d *MSSClampDevice) ReadPacket(buf []byte) (int, error) {
+	n, err := d.dev.ReadPacket(buf)
+	if err == nil {
+		if limit := d.metrics.MaxPacketSize(); limit > 0 {
+			clampMSS(buf[:n], limit)
+		}
+	}
+	return n, err
+}
+
+func (d *MSSClampDevice) WritePacket(pkt []byte) error {
+	return d.dev.WritePacket(pkt)
+}
+
+// clampMSS lowers the MSS option of a TCP SYN packet so its segments fit into packets of limit bytes.
+// Other packets are left alone.
+func clampMSS(pkt []byte, limit int) {
+	p, ok := parseNatPacket(pkt)
+	if !ok || p.proto != protoTCP {
+		return
+	}
+	tcp, ok := packet.ParseTCP(pkt[p.l4:])
+	if !ok || tcp.Flags()&packet.TCPFlagSYN == 0 {
+		return
+	}
+
+	mss := limit - p.l4 - 20
+	if mss <= 0 {
+		return
+	}
+
+	options := tcp.Options()
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case 0: // end of options
+			return
+		case 1: // no-op
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			return
+		}
+		if options[i] == packet.TCPOptionMSS && options[i+1] == 4 {
+			if int(binary.BigEndian.Uint16(options[i+2:])) > mss {
+				var value [2]byte
+				binary.BigEndian.PutUint16(value[:], uint16(mss))
+				p.ip.Rewrite(p.l4+20+i+2, value[:])
+			}
+			return
+		}
+		i += int(options[i+1])
+	}
+}
@@ -0,0 +1,344 @@
+package api
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal/packet"
+)
+
+// ICMP protocol numbers and types natTable understands, next to protoTCP and protoUDP.
+const (
+	protoICMP   = packet.ProtoICMP
+	protoICMPv6 = packet.ProtoICMPv6
+
+	icmpEchoReply     = 0
+	icmpEchoRequest   = 8
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+
+	// natFirstPort is the first port handed out to translated flows.
+	natFirstPort = 1024
+	// natSweepInterval is how often expired mappings are removed.
+	natSweepInterval = time.Minute
+)
+
+// NatTimeouts is how long a translated flow is kept without traffic, by IP protocol number.
+var NatTimeouts = map[uint8]time.Duration{
+	protoTCP:    2 * time.Hour,
+	protoUDP:    2 * time.Minute,
+	protoICMP:   30 * time.Second,
+	protoICMPv6: 30 * time.Second,
+}
+
+// natFlow identifies a flow of a client by its source address and port, or ICMP echo identifier.
+type natFlow struct {
+	client uint64
+	proto  uint8
+	addr   netip.Addr
+	port   uint16
+}
+
+// natPort identifies a translated flow on the tunnel side.
+type natPort struct {
+	ipv6  bool
+	proto uint8
+	port  uint16
+}
+
+// natMapping ties a client flow to its translated port.
+type natMapping struct {
+	flow     natFlow
+	port     natPort
+	lastUsed time.Time
+}
+
+// natTable translates the flows of several clients to the single pair of tunnel addresses.
+// The source port (or ICMP echo identifier) of each flow is rewritten to a port unique
+// for the tunnel address, so replies can be told apart and sent back to the right client.
+//
+// TCP, UDP and ICMP echo are translated, together with ICMP errors about them. Other
+// protocols and IPv4 fragments can't be told apart and are dropped.
+type natTable struct {
+	ipv4, ipv6 netip.Addr
+
+	mu        sync.Mutex
+	flows     map[natFlow]*natMapping
+	ports     map[natPort]*natMapping
+	next      uint16
+	lastSweep time.Time
+}
+
+// newNatTable creates a natTable translating to the given tunnel addresses.
+func newNatTable(ipv4, ipv6 netip.Addr) *natTable {
+	return &natTable{
+		ipv4:      ipv4,
+		ipv6:      ipv6,
+		flows:     map[natFlow]*natMapping{},
+		ports:     map[natPort]*natMapping{},
+		next:      natFirstPort,
+		lastSweep: time.Now(),
+	}
+}
+
+// natPacket holds the offsets of the fields natTable rewrites.
+type natPacket struct {
+	ip       packet.IP // rewrites the fields and keeps the checksums up to date
+	ipv6     bool
+	proto    uint8
+	src, dst int // offsets of the addresses
+	addrLen  int
+	l4       int // offset of the transport header
+}
+
+// parseNatPacket locates the addresses and transport header of an IP packet.
+func parseNatPacket(pkt []byte) (natPacket, bool) {
+	ip, ok := packet.Parse(pkt)
+	// later fragments don't carry ports and first ones can't be reassembled here
+	if !ok || ip.Fragment() {
+		return natPacket{}, false
+	}
+	// extension headers aren't followed, only the upper layer header is
+	return natPacket{
+		ip:      ip,
+		ipv6:    ip.IPv6(),
+		proto:   ip.Protocol(),
+		src:     ip.SrcOffset(),
+		dst:     ip.DstOffset(),
+		addrLen: ip.AddrLen(),
+		l4:      ip.HeaderLen(),
+	}, true
+}
+
+// addr returns the address at off.
+func (p natPacket) addr(pkt []byte, off int) netip.Addr {
+	addr, _ := netip.AddrFromSlice(pkt[off : off+p.addrLen])
+	return addr
+}
+
+// ports returns the offsets of the source and destination ports. ICMP echo messages
+// use their identifier as both.
+//
+// Returns:
+//   - int: The offset of the source port.
+//   - int: The offset of the destination port.
+//   - bool: Whether the packet has ports.
+func (p natPacket) ports(pkt []byte) (int, int, bool) {
+	switch p.proto {
+	case protoTCP, protoUDP:
+		if len(pkt) < p.l4+8 {
+			return 0, 0, false
+		}
+		return p.l4, p.l4 + 2, true
+	case protoICMP, protoICMPv6:
+		if len(pkt) < p.l4+8 || !isEcho(p.proto, pkt[p.l4]) {
+			return 0, 0, false
+		}
+		return p.l4 + 4, p.l4 + 4, true
+	}
+	return 0, 0, false
+}
+
+// isEcho reports whether an ICMP message of the given type is an echo request or reply.
+func isEcho(proto, icmpType uint8) bool {
+	if proto == protoICMP {
+		return icmpType == icmpEchoRequest || icmpType == icmpEchoReply
+	}
+	return icmpType == icmpv6EchoRequest || icmpType == icmpv6EchoReply
+}
+
+// isICMPError reports whether an ICMP message of the given type quotes the packet that caused it.
+func isICMPError(proto, icmpType uint8) bool {
+	if proto == protoICMP {
+		// destination unreachable, time exceeded, parameter problem
+		return icmpType == 3 || icmpType == 11 || icmpType == 12
+	}
+	// destination unreachable, packet too big, time exceeded, parameter problem
+	return icmpType >= 1 && icmpType <= 4
+}
+
+// translateOut rewrites a packet sent by client to come from the tunnel address.
+//
+// Parameters:
+//   - client: uint64 - The client that sent the packet.
+//   - pkt: []byte - The packet, rewritten in place.
+//
+// Returns:
+//   - bool: Whether the packet was translated. Untranslatable packets must be dropped.
+func (t *natTable) translateOut(client uint64, pkt []byte) bool {
+	p, ok := parseNatPacket(pkt)
+	if !ok {
+		return false
+	}
+	srcPort, _, ok := p.ports(pkt)
+	// only echo requests start flows, replies and errors from clients aren't translated
+	if !ok || (p.proto == protoICMP || p.proto == protoICMPv6) && pkt[p.l4] != icmpEchoRequest && pkt[p.l4] != icmpv6EchoRequest {
+		return false
+	}
+	tunnelAddr := t.ipv4
+	if p.ipv6 {
+		tunnelAddr = t.ipv6
+	}
+	if !tunnelAddr.IsValid() {
+		return false
+	}
+
+	flow := natFlow{client: client, proto: p.proto, addr: p.addr(pkt, p.src), port: binary.BigEndian.Uint16(pkt[srcPort:])}
+	port, ok := t.lookupOut(flow, p.ipv6)
+	if !ok {
+		return false
+	}
+
+	var value [2]byte
+	binary.BigEndian.PutUint16(value[:], port)
+	p.ip.Rewrite(srcPort, value[:])
+	p.ip.SetSrc(tunnelAddr)
+	return true
+}
+
+// translateIn rewrites a packet from the tunnel to be addressed to the client flow it belongs to.
+//
+// Parameters:
+//   - pkt: []byte - The packet, rewritten in place.
+//
+// Returns:
+//   - uint64: The client the packet belongs to.
+//   - bool: Whether the packet belongs to a client. Other packets must be dropped.
+func (t *natTable) translateIn(pkt []byte) (uint64, bool) {
+	p, ok := parseNatPacket(pkt)
+	if !ok {
+		return 0, false
+	}
+
+	if (p.proto == protoICMP || p.proto == protoICMPv6) && len(pkt) >= p.l4+8 && isICMPError(p.proto, pkt[p.l4]) {
+		return t.translateICMPError(p, pkt)
+	}
+
+	_, dstPort, ok := p.ports(pkt)
+	if !ok || (p.proto == protoICMP || p.proto == protoICMPv6) && pkt[p.l4] != icmpEchoReply && pkt[p.l4] != icmpv6EchoReply {
+		return 0, false
+	}
+	m, ok := t.lookupIn(natPort{ipv6: p.ipv6, proto: p.proto, port: binary.BigEndian.Uint16(pkt[dstPort:])})
+	if !ok {
+		return 0, false
+	}
+
+	var value [2]byte
+	binary.BigEndian.PutUint16(value[:], m.flow.port)
+	p.ip.Rewrite(dstPort, value[:])
+	p.ip.SetDst(m.flow.addr)
+	return m.flow.client, true
+}
+
+// translateICMPError rewrites an ICMP error about a translated packet. Both the destination
+// of the error and the source of the quoted packet are restored to the client flow.
+func (t *natTable) translateICMPError(p natPacket, pkt []byte) (uint64, bool) {
+	quoted := pkt[p.l4+8:]
+	q, ok := parseNatPacket(quoted)
+	if !ok || q.ipv6 != p.ipv6 {
+		return 0, false
+	}
+	srcPort, _, ok := q.ports(quoted)
+	if !ok {
+		return 0, false
+	}
+	m, ok := t.lookupIn(natPort{ipv6: q.ipv6, proto: q.proto, port: binary.BigEndian.Uint16(quoted[srcPort:])})
+	if !ok {
+		return 0, false
+	}
+
+	var value [2]byte
+	binary.BigEndian.PutUint16(value[:], m.flow.port)
+	q.ip.Rewrite(srcPort, value[:])
+	q.ip.SetSrc(m.flow.addr)
+
+	// the quoted packet changed, so the ICMP checksum is computed again
+	if p.ipv6 {
+		copy(pkt[p.dst:], m.flow.addr.AsSlice())
+		icmp := pkt[p.l4:]
+		binary.BigEndian.PutUint16(icmp[2:4], 0)
+		binary.BigEndian.PutUint16(icmp[2:4], packet.PseudoHeaderChecksum(protoICMPv6, p.addr(pkt, p.src), m.flow.addr, icmp))
+	} else {
+		p.ip.SetDst(m.flow.addr)
+		icmp := pkt[p.l4:]
+		binary.BigEndian.PutUint16(icmp[2:4], 0)
+		binary.BigEndian.PutUint16(icmp[2:4], packet.Checksum(icmp))
+	}
+	return m.flow.client, true
+}
+
+// lookupOut returns the translated port of flow, mapping a new one if needed.
+func (t *natTable) lookupOut(flow natFlow, ipv6 bool) (uint16, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.lastSweep) > natSweepInterval {
+		t.sweep(now)
+	}
+
+	if m, ok := t.flows[flow]; ok {
+		m.lastUsed = now
+		return m.port.port, true
+	}
+
+	for range 65536 - natFirstPort {
+		port := natPort{ipv6: ipv6, proto: flow.proto, port: t.next}
+		if t.next == 65535 {
+			t.next = natFirstPort
+		} else {
+			t.next++
+		}
+
+		if old, ok := t.ports[port]; ok {
+			if now.Sub(old.lastUsed) < NatTimeouts[old.flow.proto] {
+				continue
+			}
+			delete(t.flows, old.flow)
+		}
+		m := &natMapping{flow: flow, port: port, lastUsed: now}
+		t.flows[flow] = m
+		t.ports[port] = m
+		return port.port, true
+	}
+	return 0, false
+}
+
+// lookupIn returns the mapping of a translated port.
+func (t *natTable) lookupIn(port natPort) (natMapping, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.ports[port]
+	if !ok {
+		return natMapping{}, false
+	}
+	m.lastUsed = time.Now()
+	return *m, true
+}
+
+// sweep removes expired mappings. t.mu must be held.
+func (t *natTable) sweep(now time.Time) {
+	t.lastSweep = now
+	for flow, m := range t.flows {
+		if now.Sub(m.lastUsed) >= NatTimeouts[flow.proto] {
+			delete(t.flows, flow)
+			delete(t.ports, m.port)
+		}
+	}
+}
+
+// forget removes all mappings of client.
+func (t *natTable) forget(client uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for flow, m := range t.flows {
+		if flow.client == client {
+			delete(t.flows, flow)
+			delete(t.ports, m.port)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package api
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/Diniboy1123/usque/internal/packet"
+)
+
+var (
+	natTunnelV4 = netip.MustParseAddr("172.16.0.2")
+	natTunnelV6 = netip.MustParseAddr("2606:4700:110::2")
+)
+
+// natTransport builds a TCP or UDP packet with a valid checksum.
+func natTransport(proto uint8, src, dst netip.AddrPort) []byte {
+	var l4 []byte
+	if proto == protoTCP {
+		l4 = make([]byte, 20)
+		l4[12] = 5 << 4
+	} else {
+		l4 = make([]byte, 12)
+		binary.BigEndian.PutUint16(l4[4:6], uint16(len(l4)))
+		copy(l4[8:], "ping")
+	}
+	binary.BigEndian.PutUint16(l4[0:2], src.Port())
+	binary.BigEndian.PutUint16(l4[2:4], dst.Port())
+
+	sum := 16
+	if proto == protoUDP {
+		sum = 6
+	}
+	binary.BigEndian.PutUint16(l4[sum:], packet.PseudoHeaderChecksum(proto, src.Addr(), dst.Addr(), l4))
+	if src.Addr().Is4() {
+		return packet.NewIPv4(proto, 64, 1, src.Addr(), dst.Addr(), l4)
+	}
+	return packet.NewIPv6(proto, 64, src.Addr(), dst.Addr(), l4)
+}
+
+// natEcho builds an ICMP or ICMPv6 echo request or reply.
+func natEcho(reply bool, id uint16, src, dst netip.Addr) []byte {
+	icmpType := uint8(icmpEchoRequest)
+	if reply {
+		icmpType = icmpEchoReply
+	}
+	if src.Is6() {
+		icmpType = icmpv6EchoRequest
+		if reply {
+			icmpType = icmpv6EchoReply
+		}
+	}
+	return packet.NewICMP(icmpType, 0, uint32(id)<<16|1, []byte("ping"), 64, 1, src, dst)
+}
+
+// natEndpoints returns the source and destination of a packet, with its port or echo identifier.
+func natEndpoints(t *testing.T, pkt []byte) (netip.AddrPort, netip.AddrPort) {
+	t.Helper()
+	ip, ok := packet.Parse(pkt)
+	if !ok {
+		t.Fatalf("packet doesn't parse")
+	}
+	proto, l4 := ip.Transport()
+	if proto == protoICMP || proto == protoICMPv6 {
+		id := binary.BigEndian.Uint16(l4[4:6])
+		return netip.AddrPortFrom(ip.Src(), id), netip.AddrPortFrom(ip.Dst(), id)
+	}
+	return netip.AddrPortFrom(ip.Src(), binary.BigEndian.Uint16(l4[0:2])), netip.AddrPortFrom(ip.Dst(), binary.BigEndian.Uint16(l4[2:4]))
+}
+
+// checkNatChecksums fails the test if the IPv4 header or transport checksum of a packet is wrong.
+func checkNatChecksums(t *testing.T, pkt []byte) {
+	t.Helper()
+	ip, ok := packet.Parse(pkt)
+	if !ok {
+		t.Fatalf("packet doesn't parse")
+	}
+	if !ip.IPv6() && packet.Checksum(pkt[:ip.HeaderLen()]) != 0 {
+		t.Errorf("IPv4 header checksum is wrong")
+	}
+	proto, l4 := ip.Transport()
+	if proto == protoUDP && !ip.IPv6() && binary.BigEndian.Uint16(l4[6:8]) == 0 {
+		return
+	}
+	var sum uint16
+	if proto == protoICMP {
+		sum = packet.Checksum(l4)
+	} else {
+		sum = packet.PseudoHeaderChecksum(proto, ip.Src(), ip.Dst(), l4)
+	}
+	if sum != 0 {
+		t.Errorf("checksum of protocol %d is wrong", proto)
+	}
+}
+
+func TestNatTranslate(t *testing.T) {
+	client4 := netip.MustParseAddr("10.0.0.2")
+	client6 := netip.MustParseAddr("fd00::2")
+	server4 := netip.MustParseAddr("1.1.1.1")
+	server6 := netip.MustParseAddr("2606:4700:4700::1111")
+
+	tests := []struct {
+		name  string
+		out   []byte
+		reply func(tunnel netip.AddrPort) []byte
+	}{
+		{
+			name: "TCP over IPv4",
+			out:  natTransport(protoTCP, netip.AddrPortFrom(client4, 40000), netip.AddrPortFrom(server4, 443)),
+			reply: func(tunnel netip.AddrPort) []byte {
+				return natTransport(protoTCP, netip.AddrPortFrom(server4, 443), tunnel)
+			},
+		},
+		{
+			name: "UDP over IPv4",
+			out:  natTransport(protoUDP, netip.AddrPortFrom(client4, 5000), netip.AddrPortFrom(server4, 53)),
+			reply: func(tunnel netip.AddrPort) []byte {
+				return natTransport(protoUDP, netip.AddrPortFrom(server4, 53), tunnel)
+			},
+		},
+		{
+			name: "TCP over IPv6",
+			out:  natTransport(protoTCP, netip.AddrPortFrom(client6, 40000), netip.AddrPortFrom(server6, 443)),
+			reply: func(tunnel netip.AddrPort) []byte {
+				return natTransport(protoTCP, netip.AddrPortFrom(server6, 443), tunnel)
+			},
+		},
+		{
+			name: "UDP over IPv6",
+			out:  natTransport(protoUDP, netip.AddrPortFrom(client6, 5000), netip.AddrPortFrom(server6, 53)),
+			reply: func(tunnel netip.AddrPort) []byte {
+				return natTransport(protoUDP, netip.AddrPortFrom(server6, 53), tunnel)
+			},
+		},
+		{
+			name: "ICMP echo",
+			out:  natEcho(false, 7, client4, server4),
+			reply: func(tunnel netip.AddrPort) []byte {
+				return natEcho(true, tunnel.Port(), server4, tunnel.Addr())
+			},
+		},
+		{
+			name: "ICMPv6 echo",
+			out:  natEcho(false, 7, client6, server6),
+			reply: func(tunnel netip.AddrPort) []byte {
+				return natEcho(true, tunnel.Port(), server6, tunnel.Addr())
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nat := newNatTable(natTunnelV4, natTunnelV6)
+			clientSrc, serverDst := natEndpoints(t, tt.out)
+
+			if !nat.translateOut(1, tt.out) {
+				t.Fatalf("translateOut dropped the packet")
+			}
+			checkNatChecksums(t, tt.out)
+			tunnelSrc, dst := natEndpoints(t, tt.out)
+			want := natTunnelV4
+			if clientSrc.Addr().Is6() {
+				want = natTunnelV6
+			}
+			if tunnelSrc.Addr() != want {
+				t.Errorf("source is %s, want %s", tunnelSrc.Addr(), want)
+			}
+			if tunnelSrc.Port() < natFirstPort {
+				t.Errorf("translated port %d is below %d", tunnelSrc.Port(), natFirstPort)
+			}
+			// the identifier of ICMP echo is both ports, so it changes with the source
+			if ip, _ := packet.Parse(tt.out); ip.Protocol() == protoICMP || ip.Protocol() == protoICMPv6 {
+				serverDst = netip.AddrPortFrom(serverDst.Addr(), tunnelSrc.Port())
+			}
+			if dst != serverDst {
+				t.Errorf("destination is %s, want %s", dst, serverDst)
+			}
+
+			reply := tt.reply(tunnelSrc)
+			client, ok := nat.translateIn(reply)
+			if !ok || client != 1 {
+				t.Fatalf("translateIn = %d, %v, want 1, true", client, ok)
+			}
+			checkNatChecksums(t, reply)
+			if _, dst := natEndpoints(t, reply); dst != clientSrc {
+				t.Errorf("reply is addressed to %s, want %s", dst, clientSrc)
+			}
+		})
+	}
+}
+
+func TestNatClientsSharingAPort(t *testing.T) {
+	nat := newNatTable(natTunnelV4, netip.Addr{})
+	server := netip.MustParseAddrPort("1.1.1.1:53")
+	src := netip.MustParseAddrPort("10.0.0.2:5000")
+
+	ports := map[uint64]netip.AddrPort{}
+	for _, client := range []uint64{1, 2} {
+		pkt := natTransport(protoUDP, src, server)
+		if !nat.translateOut(client, pkt) {
+			t.Fatalf("translateOut dropped the packet of client %d", client)
+		}
+		ports[client], _ = natEndpoints(t, pkt)
+	}
+	if ports[1] == ports[2] {
+		t.Fatalf("both clients were translated to %s", ports[1])
+	}
+
+	for _, client := range []uint64{1, 2} {
+		got, ok := nat.translateIn(natTransport(protoUDP, server, ports[client]))
+		if !ok || got != client {
+			t.Errorf("reply to %s went to client %d, %v, want %d", ports[client], got, ok, client)
+		}
+	}
+
+	nat.forget(1)
+	if _, ok := nat.translateIn(natTransport(protoUDP, server, ports[1])); ok {
+		t.Errorf("reply to a forgotten client was translated")
+	}
+	if _, ok := nat.translateIn(natTransport(protoUDP, server, ports[2])); !ok {
+		t.Errorf("reply to the remaining client was dropped")
+	}
+}
+
+func TestNatDrops(t *testing.T) {
+	client := netip.MustParseAddr("10.0.0.2")
+	server := netip.MustParseAddr("1.1.1.1")
+
+	fragment := natTransport(protoUDP, netip.AddrPortFrom(client, 5000), netip.AddrPortFrom(server, 53))
+	ip, _ := packet.Parse(fragment)
+	ip.SetFragment(0, true)
+	ip.UpdateChecksum()
+
+	tests := []struct {
+		name string
+		nat  *natTable
+		pkt  []byte
+	}{
+		{"fragment", newNatTable(natTunnelV4, natTunnelV6), fragment},
+		{"unsupported protocol", newNatTable(natTunnelV4, natTunnelV6), packet.NewIPv4(47, 64, 1, client, server, make([]byte, 8))},
+		{"echo reply from a client", newNatTable(natTunnelV4, natTunnelV6), natEcho(true, 7, client, server)},
+		{"family without a tunnel address", newNatTable(netip.Addr{}, natTunnelV6), natTransport(protoUDP, netip.AddrPortFrom(client, 5000), netip.AddrPortFrom(server, 53))},
+		{"truncated transport header", newNatTable(natTunnelV4, natTunnelV6), packet.NewIPv4(protoTCP, 64, 1, client, server, make([]byte, 4))},
+		{"not IP", newNatTable(natTunnelV4, natTunnelV6), []byte{0x10, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.nat.translateOut(1, tt.pkt) {
+				t.Errorf("translateOut accepted the packet")
+			}
+		})
+	}
+
+	t.Run("reply without a mapping", func(t *testing.T) {
+		nat := newNatTable(natTunnelV4, natTunnelV6)
+		if _, ok := nat.translateIn(natTransport(protoUDP, netip.AddrPortFrom(server, 53), netip.AddrPortFrom(natTunnelV4, 1024))); ok {
+			t.Errorf("translateIn accepted the packet")
+		}
+	})
+}
+
+func TestNatICMPError(t *testing.T) {
+	router4 := netip.MustParseAddr("192.0.2.1")
+	router6 := netip.MustParseAddr("2001:db8::1")
+
+	tests := []struct {
+		name   string
+		out    []byte
+		router netip.Addr
+		// icmpType is destination unreachable of the family
+		icmpType uint8
+	}{
+		{"IPv4", natTransport(protoUDP, netip.MustParseAddrPort("10.0.0.2:5000"), netip.MustParseAddrPort("1.1.1.1:53")), router4, 3},
+		{"IPv6", natTransport(protoUDP, netip.MustParseAddrPort("[fd00::2]:5000"), netip.MustParseAddrPort("[2606:4700:4700::1111]:53")), router6, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nat := newNatTable(natTunnelV4, natTunnelV6)
+			clientSrc, _ := natEndpoints(t, tt.out)
+			if !nat.translateOut(1, tt.out) {
+				t.Fatalf("translateOut dropped the packet")
+			}
+			tunnelSrc, _ := natEndpoints(t, tt.out)
+
+			icmpErr := packet.NewICMP(tt.icmpType, 0, 0, tt.out, 64, 2, tt.router, tunnelSrc.Addr())
+			client, ok := nat.translateIn(icmpErr)
+			if !ok || client != 1 {
+				t.Fatalf("translateIn = %d, %v, want 1, true", client, ok)
+			}
+			checkNatChecksums(t, icmpErr)
+
+			ip, _ := packet.Parse(icmpErr)
+			if ip.Dst() != clientSrc.Addr() {
+				t.Errorf("error is addressed to %s, want %s", ip.Dst(), clientSrc.Addr())
+			}
+			_, icmp := ip.Transport()
+			quoted := icmp[8:]
+			if src, _ := natEndpoints(t, quoted); src != clientSrc {
+				t.Errorf("quoted packet is from %s, want %s", src, clientSrc)
+			}
+			checkNatChecksums(t, quoted)
+		})
+	}
+}
+
+func TestNatUDPWithoutChecksum(t *testing.T) {
+	nat := newNatTable(natTunnelV4, natTunnelV6)
+	pkt := natTransport(protoUDP, netip.MustParseAddrPort("10.0.0.2:5000"), netip.MustParseAddrPort("1.1.1.1:53"))
+	ip, _ := packet.Parse(pkt)
+	_, l4 := ip.Transport()
+	binary.BigEndian.PutUint16(l4[6:8], 0)
+
+	if !nat.translateOut(1, pkt) {
+		t.Fatalf("translateOut dropped the packet")
+	}
+	if sum := binary.BigEndian.Uint16(l4[6:8]); sum != 0 {
+		t.Errorf("omitted UDP checksum was set to %#04x", sum)
+	}
+	checkNatChecksums(t, pkt)
+}
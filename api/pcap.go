@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// pcapng block types, options and values used by PcapDevice.
+const (
+	pcapngSectionHeader     = 0x0a0d0d0a
+	pcapngInterfaceDesc     = 0x00000001
+	pcapngEnhancedPacket    = 0x00000006
+	pcapngByteOrderMagic    = 0x1a2b3c4d
+	pcapngLinkTypeRaw       = 101 // LINKTYPE_RAW, packets begin with the IP header
+	pcapngOptionEnd         = 0
+	pcapngOptionName        = 2 // if_name
+	pcapngOptionFlags       = 2 // epb_flags
+	pcapngDirectionInbound  = 1
+	pcapngDirectionOutbound = 2
+)
+
+// PcapDevice wraps a TunnelDevice and writes every packet passing through it to a pcapng file.
+// Packets read from the device leave through the tunnel and are marked outbound, packets
+// written to the device came from the tunnel and are marked inbound.
+//
+// Each packet is written with a single Write call, so the capture stays readable up to the
+// last packet if usque is killed. Write errors stop the capture, they never affect the tunnel.
+type PcapDevice struct {
+	dev     TunnelDevice
+	snaplen int
+
+	mu     sync.Mutex
+	w      io.Writer
+	failed bool
+	block  []byte
+}
+
+// NewPcapDevice creates a new PcapDevice around dev and writes the pcapng header to w.
+//
+// Parameters:
+//   - dev: TunnelDevice - The device to wrap.
+//   - w: io.Writer - Where the capture is written, usually a file.
+//   - snaplen: int - Bytes captured of each packet, 0 to capture whole packets.
+//
+// Returns:
+//   - *PcapDevice: The capturing device.
+//   - error: An error if the header can't be written.
+func NewPcapDevice(dev TunnelDevice, w io.Writer, snaplen int) (*PcapDevice, error) {
+	p := &PcapDevice{dev: dev, snaplen: snaplen, w: w}
+
+	var header []byte
+	header = pcapngBlock(header, pcapngSectionHeader, func(b []byte) []byte {
+		b = binary.LittleEndian.AppendUint32(b, pcapngByteOrderMagic)
+		b = binary.LittleEndian.AppendUint16(b, 1) // major version
+		b = binary.LittleEndian.AppendUint16(b, 0) // minor version
+		return binary.LittleEndian.AppendUint64(b, ^uint64(0))
+	})
+	header = pcapngBlock(header, pcapngInterfaceDesc, func(b []byte) []byte {
+		b = binary.LittleEndian.AppendUint16(b, pcapngLinkTypeRaw)
+		b = binary.LittleEndian.AppendUint16(b, 0) // reserved
+		b = binary.LittleEndian.AppendUint32(b, uint32(snaplen))
+		b = pcapngOption(b, pcapngOptionName, []byte("usque"))
+		return pcapngOption(b, pcapngOptionEnd, nil)
+	})
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PcapDevice) ReadPacket(buf []byte) (int, error) {
+	n, err := p.dev.ReadPacket(buf)
+	if err == nil {
+		p.capture(buf[:n], pcapngDirectionOutbound)
+	}
+	return n, err
+}
+
+func (p *PcapDevice) WritePacket(pkt []byte) error {
+	p.capture(pkt, pcapngDirectionInbound)
+	return p.dev.WritePacket(pkt)
+}
+
+// capture writes pkt as an enhanced packet block with the given direction.
+func (p *PcapDevice) capture(pkt []byte, direction uint32) {
+	captured := pkt
+	if p.snaplen > 0 && len(captured) > p.snaplen {
+		captured = captured[:p.snaplen]
+	}
+	// timestamps are in microseconds, the default resolution
+	ts := uint64(time.Now().UnixMicro())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failed {
+		return
+	}
+
+	p.block = pcapngBlock(p.block[:0], pcapngEnhancedPacket, func(b []byte) []byte {
+		b = binary.LittleEndian.AppendUint32(b, 0) // interface ID
+		b = binary.LittleEndian.AppendUint32(b, uint32(ts>>32))
+		b = binary.LittleEndian.AppendUint32(b, uint32(ts))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(captured)))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(pkt)))
+		b = append(b, captured...)
+		b = append(b, make([]byte, pcapngPadding(len(captured)))...)
+		b = pcapngOption(b, pcapngOptionFlags, binary.LittleEndian.AppendUint32(nil, direction))
+		return pcapngOption(b, pcapngOptionEnd, nil)
+	})
+	if _, err := p.w.Write(p.block); err != nil {
+		logFor(componentTun).Error("Packet capture stopped", "error", err)
+		p.failed = true
+	}
+}
+
+// pcapngBlock appends a block of the given type to b. body appends the block body,
+// the total length is filled in around it.
+func pcapngBlock(b []byte, blockType uint32, body func([]byte) []byte) []byte {
+	start := len(b)
+	b = binary.LittleEndian.AppendUint32(b, blockType)
+	b = binary.LittleEndian.AppendUint32(b, 0) // total length, set below
+	b = body(b)
+	length := uint32(len(b) - start + 4)
+	binary.LittleEndian.PutUint32(b[start+4:], length)
+	return binary.LittleEndian.AppendUint32(b, length)
+}
+
+// pcapngOption appends an option padded to 32 bits.
+func pcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pcapngPadding(len(value)))...)
+}
+
+// pcapngPadding returns the padding needed after n bytes to reach a 32 bit boundary.
+func pcapngPadding(n int) int {
+	return (4 - n%4) % 4
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// pcapngTestBlock is a decoded pcapng block.
+type pcapngTestBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+// decodePcapng splits a capture into its blocks, checking both length fields of each.
+func decodePcapng(t *testing.T, data []byte) []pcapngTestBlock {
+	t.Helper()
+	var blocks []pcapngTestBlock
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block %x", data)
+		}
+		length := int(binary.LittleEndian.Uint32(data[4:8]))
+		if length%4 != 0 || length < 12 || length > len(data) {
+			t.Fatalf("invalid block length %d with %d bytes left", length, len(data))
+		}
+		if trailing := int(binary.LittleEndian.Uint32(data[length-4 : length])); trailing != length {
+			t.Fatalf("block lengths %d and %d differ", length, trailing)
+		}
+		blocks = append(blocks, pcapngTestBlock{binary.LittleEndian.Uint32(data[0:4]), data[8 : length-4]})
+		data = data[length:]
+	}
+	return blocks
+}
+
+// decodePcapngOptions returns the options of a block by code, checking their padding.
+func decodePcapngOptions(t *testing.T, options []byte) map[uint16][]byte {
+	t.Helper()
+	decoded := map[uint16][]byte{}
+	for len(options) >= 4 {
+		code, length := binary.LittleEndian.Uint16(options[0:2]), int(binary.LittleEndian.Uint16(options[2:4]))
+		if code == pcapngOptionEnd {
+			if length != 0 || len(options) != 4 {
+				t.Fatalf("opt_endofopt followed by %x", options[4:])
+			}
+			return decoded
+		}
+		padded := length + pcapngPadding(length)
+		if 4+padded > len(options) {
+			t.Fatalf("option %d of %d bytes overruns the block", code, length)
+		}
+		decoded[code] = options[4 : 4+length]
+		options = options[4+padded:]
+	}
+	t.Fatalf("options without opt_endofopt")
+	return nil
+}
+
+func TestPcapDevice(t *testing.T) {
+	client := netip.AddrPortFrom(netip.MustParseAddr("172.16.0.2"), 40000)
+	server := netip.AddrPortFrom(netip.MustParseAddr("1.1.1.1"), 53)
+	outbound := natTransport(protoUDP, client, server)
+	inbound := natTransport(protoTCP, server, client)
+
+	tests := []struct {
+		name    string
+		snaplen int
+	}{
+		{"whole packets", 0},
+		{"snaplen", 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var capture bytes.Buffer
+			dev := &memDevice{reads: [][]byte{outbound}}
+			pcap, err := NewPcapDevice(dev, &capture, tt.snaplen)
+			if err != nil {
+				t.Fatalf("NewPcapDevice: %v", err)
+			}
+			before := time.Now()
+			buf := make([]byte, 2048)
+			if n, err := pcap.ReadPacket(buf); err != nil || !bytes.Equal(buf[:n], outbound) {
+				t.Fatalf("ReadPacket = %x, %v, want the packet unchanged", buf[:n], err)
+			}
+			if err := pcap.WritePacket(inbound); err != nil || len(dev.writes) != 1 || !bytes.Equal(dev.writes[0], inbound) {
+				t.Fatalf("WritePacket = %v, wrote %x, want the packet unchanged", err, dev.writes)
+			}
+
+			blocks := decodePcapng(t, capture.Bytes())
+			if len(blocks) != 4 {
+				t.Fatalf("capture has %d blocks, want a section header, an interface and 2 packets", len(blocks))
+			}
+
+			shb := blocks[0]
+			if shb.blockType != pcapngSectionHeader || binary.LittleEndian.Uint32(shb.body[0:4]) != pcapngByteOrderMagic ||
+				binary.LittleEndian.Uint16(shb.body[4:6]) != 1 || binary.LittleEndian.Uint16(shb.body[6:8]) != 0 {
+				t.Errorf("invalid section header block %x", shb.body)
+			}
+
+			idb := blocks[1]
+			if idb.blockType != pcapngInterfaceDesc || binary.LittleEndian.Uint16(idb.body[0:2]) != pcapngLinkTypeRaw ||
+				int(binary.LittleEndian.Uint32(idb.body[4:8])) != tt.snaplen {
+				t.Errorf("invalid interface description block %x", idb.body)
+			}
+			if name := decodePcapngOptions(t, idb.body[8:])[pcapngOptionName]; string(name) != "usque" {
+				t.Errorf("if_name = %q, want usque", name)
+			}
+
+			for i, want := range []struct {
+				pkt       []byte
+				direction uint32
+			}{{outbound, pcapngDirectionOutbound}, {inbound, pcapngDirectionInbound}} {
+				epb := blocks[2+i]
+				if epb.blockType != pcapngEnhancedPacket {
+					t.Fatalf("block %d has type %#x, want an enhanced packet block", 2+i, epb.blockType)
+				}
+				body := epb.body
+				ts := int64(binary.LittleEndian.Uint32(body[4:8]))<<32 | int64(binary.LittleEndian.Uint32(body[8:12]))
+				if captured := time.UnixMicro(ts); captured.Before(before.Truncate(time.Microsecond)) || captured.After(time.Now()) {
+					t.Errorf("packet %d captured at %v, want between %v and now", i, captured, before)
+				}
+				capturedLen, originalLen := int(binary.LittleEndian.Uint32(body[12:16])), int(binary.LittleEndian.Uint32(body[16:20]))
+				wantData := want.pkt
+				if tt.snaplen > 0 {
+					wantData = wantData[:min(tt.snaplen, len(wantData))]
+				}
+				if originalLen != len(want.pkt) || !bytes.Equal(body[20:20+capturedLen], wantData) {
+					t.Errorf("packet %d = %x of %d bytes, want %x of %d bytes", i, body[20:20+capturedLen], originalLen, wantData, len(want.pkt))
+				}
+				options := decodePcapngOptions(t, body[20+capturedLen+pcapngPadding(capturedLen):])
+				flags := options[pcapngOptionFlags]
+				if len(flags) != 4 || binary.LittleEndian.Uint32(flags)&3 != want.direction {
+					t.Errorf("epb_flags of packet %d = %x, want direction %d", i, flags, want.direction)
+				}
+			}
+		})
+	}
+}
+
+// failingWriter accepts a number of writes, then fails.
+type failingWriter struct {
+	left int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if w.left == 0 {
+		return 0, errors.New("disk full")
+	}
+	w.left--
+	return len(b), nil
+}
+
+func TestPcapDeviceWriteError(t *testing.T) {
+	if _, err := NewPcapDevice(&memDevice{}, &failingWriter{}, 0); err == nil {
+		t.Fatal("NewPcapDevice ignored a failing header write")
+	}
+
+	w := &failingWriter{left: 1}
+	dev := &memDevice{}
+	pcap, err := NewPcapDevice(dev, w, 0)
+	if err != nil {
+		t.Fatalf("NewPcapDevice: %v", err)
+	}
+	pkt := natTransport(protoUDP, netip.MustParseAddrPort("1.1.1.1:53"), netip.MustParseAddrPort("172.16.0.2:40000"))
+	for range 3 {
+		if err := pcap.WritePacket(pkt); err != nil {
+			t.Fatalf("WritePacket = %v, capture errors must not reach the tunnel", err)
+		}
+	}
+	if len(dev.writes) != 3 {
+		t.Errorf("delivered %d packets, want 3", len(dev.writes))
+	}
+	if !pcap.failed {
+		t.Error("capture continued after a write error")
+	}
+}
@@ -0,0 +1,338 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal/packet"
+)
+
+// pingQueueLen is the number of echo requests queued for the tunnel.
+const pingQueueLen = 16
+
+// ErrPingTimeout is returned by Pinger.Ping when no reply arrived in time.
+var ErrPingTimeout = errors.New("no reply")
+
+// PingReply is the answer to an echo request: either the echo reply of the destination,
+// or an ICMP error sent by a router on the way, such as time exceeded.
+type PingReply struct {
+	From    netip.Addr    // The address the reply came from
+	RTT     time.Duration // Time from sending the request to receiving the reply
+	Reached bool          // Whether the reply is an echo reply, false for ICMP errors
+	Type    uint8         // ICMP type of the reply
+	Code    uint8         // ICMP code of the reply
+	TTL     uint8         // TTL or hop limit the reply arrived with
+	Size    int           // Bytes of the ICMP message
+}
+
+// pingWaiter is an echo request waiting for its reply.
+type pingWaiter struct {
+	sent  time.Time
+	reply chan PingReply
+}
+
+// pingRead is a packet read from the wrapped device.
+type pingRead struct {
+	pkt []byte
+	err error
+}
+
+// Pinger wraps a TunnelDevice and sends ICMP echo requests through the tunnel itself,
+// so connectivity inside the tunnel can be checked without a TUN device or raw sockets.
+//
+// The requests carry an identifier chosen by the Pinger. Echo replies and ICMP errors
+// quoting a request with that identifier are consumed by the Pinger, all other packets
+// pass to the wrapped device, which usually is a netstack used to resolve host names.
+type Pinger struct {
+	dev          TunnelDevice
+	ipv4, ipv6   netip.Addr
+	id           uint16
+	requests     chan []byte
+	reads        chan pingRead
+	done         chan struct{}
+	closeOnce    sync.Once
+	mu           sync.Mutex
+	seq          uint16
+	waiters      map[uint16]*pingWaiter
+	ipv4PacketID uint16
+}
+
+// NewPinger creates a new Pinger around dev.
+//
+// Parameters:
+//   - dev: TunnelDevice - The device other traffic is passed to.
+//   - ipv4: netip.Addr - The IPv4 address of the tunnel, requests to IPv4 hosts are sent from it.
+//   - ipv6: netip.Addr - The IPv6 address of the tunnel, requests to IPv6 hosts are sent from it.
+//
+// Returns:
+//   - *Pinger: The pinger.
+func NewPinger(dev TunnelDevice, ipv4, ipv6 netip.Addr) *Pinger {
+	var id [2]byte
+	rand.Read(id[:])
+
+	p := &Pinger{
+		dev:      dev,
+		ipv4:     ipv4,
+		ipv6:     ipv6,
+		id:       binary.BigEndian.Uint16(id[:]),
+		requests: make(chan []byte, pingQueueLen),
+		reads:    make(chan pingRead),
+		done:     make(chan struct{}),
+		waiters:  map[uint16]*pingWaiter{},
+	}
+	go p.readDevice()
+	return p
+}
+
+// readDevice moves packets from the wrapped device to ReadPacket.
+func (p *Pinger) readDevice() {
+	buf := make([]byte, 65535)
+	for {
+		n, err := p.dev.ReadPacket(buf)
+		read := pingRead{err: err}
+		if err == nil {
+			read.pkt = append([]byte(nil), buf[:n]...)
+		}
+		select {
+		case p.reads <- read:
+		case <-p.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Ping sends an echo request to dst and waits for the reply.
+//
+// Parameters:
+//   - ctx: context.Context - Bounds the wait for the reply.
+//   - dst: netip.Addr - The host to ping.
+//   - ttl: uint8 - The TTL or hop limit of the request.
+//   - size: int - Bytes of data carried by the request.
+//
+// Returns:
+//   - PingReply: The reply.
+//   - error: ErrPingTimeout if ctx ended before a reply arrived, or another error if the request couldn't be sent.
+func (p *Pinger) Ping(ctx context.Context, dst netip.Addr, ttl uint8, size int) (PingReply, error) {
+	dst = dst.Unmap()
+	src := p.ipv4
+	if dst.Is6() {
+		src = p.ipv6
+	}
+	if !src.IsValid() {
+		return PingReply{}, errors.New("no tunnel address of the destination's family")
+	}
+	if size < 0 || size > 65000 {
+		return PingReply{}, errors.New("invalid packet size")
+	}
+
+	waiter := &pingWaiter{reply: make(chan PingReply, 1)}
+	p.mu.Lock()
+	p.seq++
+	seq := p.seq
+	p.ipv4PacketID++
+	pkt := buildEchoRequest(src, dst, ttl, p.id, seq, p.ipv4PacketID, size)
+	waiter.sent = time.Now()
+	p.waiters[seq] = waiter
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.waiters, seq)
+		p.mu.Unlock()
+	}()
+
+	select {
+	case p.requests <- pkt:
+	case <-p.done:
+		return PingReply{}, net.ErrClosed
+	case <-ctx.Done():
+		return PingReply{}, ErrPingTimeout
+	}
+
+	select {
+	case reply := <-waiter.reply:
+		return reply, nil
+	case <-p.done:
+		return PingReply{}, net.ErrClosed
+	case <-ctx.Done():
+		return PingReply{}, ErrPingTimeout
+	}
+}
+
+// Close stops the Pinger. ReadPacket returns net.ErrClosed afterwards.
+// The wrapped device isn't closed.
+func (p *Pinger) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	return nil
+}
+
+// ReadPacket returns the next echo request or packet of the wrapped device.
+func (p *Pinger) ReadPacket(buf []byte) (int, error) {
+	select {
+	case pkt := <-p.requests:
+		return copy(buf, pkt), nil
+	case read := <-p.reads:
+		if read.err != nil {
+			return 0, read.err
+		}
+		return copy(buf, read.pkt), nil
+	case <-p.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// WritePacket consumes replies to the echo requests of the Pinger and passes all
+// other packets to the wrapped device.
+func (p *Pinger) WritePacket(pkt []byte) error {
+	if p.consume(pkt) {
+		return nil
+	}
+	return p.dev.WritePacket(pkt)
+}
+
+// consume delivers pkt to the waiting Ping call if it answers one of its requests.
+func (p *Pinger) consume(pkt []byte) bool {
+	ip, ok := packet.Parse(pkt)
+	if !ok || ip.Fragment() || (ip.Protocol() != protoICMP && ip.Protocol() != protoICMPv6) {
+		return false
+	}
+	icmp, ok := packet.ParseICMP(ip.Payload())
+	if !ok {
+		return false
+	}
+
+	echo := icmp
+	reached := false
+	switch {
+	case isEcho(ip.Protocol(), icmp.Type()) && icmp.Type() != icmpEchoRequest && icmp.Type() != icmpv6EchoRequest:
+		reached = true
+	case isICMPError(ip.Protocol(), icmp.Type()):
+		// errors quote the request, which carries the identifier and sequence number
+		q, ok := packet.Parse(icmp.Body())
+		if !ok || q.Fragment() || q.IPv6() != ip.IPv6() || q.Protocol() != ip.Protocol() {
+			return false
+		}
+		echo, ok = packet.ParseICMP(q.Payload())
+		if !ok || echo.Type() != icmpEchoRequest && echo.Type() != icmpv6EchoRequest {
+			return false
+		}
+	default:
+		return false
+	}
+	if echo.ID() != p.id {
+		return false
+	}
+
+	received := time.Now()
+	p.mu.Lock()
+	waiter := p.waiters[echo.Seq()]
+	p.mu.Unlock()
+	if waiter == nil {
+		// a late or duplicate reply, still ours
+		return true
+	}
+
+	select {
+	case waiter.reply <- PingReply{
+		From:    ip.Src(),
+		RTT:     received.Sub(waiter.sent),
+		Reached: reached,
+		Type:    icmp.Type(),
+		Code:    icmp.Code(),
+		TTL:     ip.TTL(),
+		Size:    len(icmp),
+	}:
+	default:
+	}
+	return true
+}
+
+// buildEchoRequest builds an IP packet carrying an ICMP echo request.
+//
+// Parameters:
+//   - src: netip.Addr - The source address.
+//   - dst: netip.Addr - The destination address, of the same family as src.
+//   - ttl: uint8 - The TTL or hop limit.
+//   - id: uint16 - The echo identifier.
+//   - seq: uint16 - The echo sequence number.
+//   - packetID: uint16 - The identification of the IPv4 header, unused for IPv6.
+//   - size: int - Bytes of data after the ICMP header.
+//
+// Returns:
+//   - []byte: The packet.
+func buildEchoRequest(src, dst netip.Addr, ttl uint8, id, seq, packetID uint16, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	rest := uint32(id)<<16 | uint32(seq)
+
+	if dst.Is6() {
+		return packet.NewICMP(icmpv6EchoRequest, 0, rest, data, ttl, 0, src, dst)
+	}
+	return packet.NewICMP(icmpEchoRequest, 0, rest, data, ttl, packetID, src, dst)
+}
+
+// AnswerEchoes answers the ICMP echo requests read from dev with echo replies and drops all other
+// packets, as if every destination answered pings and nothing else. It stands in for the tunnel
+// where there is no server, e.g. behind a gateway used for tests. It returns when reading fails.
+//
+// Parameters:
+//   - dev: TunnelDevice - The device to answer.
+//
+// Returns:
+//   - error: The error reading from dev.
+func AnswerEchoes(dev TunnelDevice) error {
+	buf := make([]byte, 65535)
+	for {
+		n, err := dev.ReadPacket(buf)
+		if err != nil {
+			return err
+		}
+		if reply, ok := echoReply(buf[:n]); ok {
+			if err := dev.WritePacket(reply); err != nil {
+				logFor(componentTun).Warn("Error writing echo reply, continuing", "error", err)
+			}
+		}
+	}
+}
+
+// echoReply turns an ICMP echo request into its reply in place, by swapping the addresses and
+// changing the type. Swapping doesn't change the ICMPv6 pseudo-header checksum.
+//
+// Parameters:
+//   - pkt: []byte - The packet.
+//
+// Returns:
+//   - []byte: The reply.
+//   - bool: Whether pkt was an echo request.
+func echoReply(pkt []byte) ([]byte, bool) {
+	p, ok := parseNatPacket(pkt)
+	if !ok || len(pkt) < p.l4+8 {
+		return nil, false
+	}
+	var reply byte
+	switch {
+	case p.proto == protoICMP && pkt[p.l4] == icmpEchoRequest:
+		reply = icmpEchoReply
+	case p.proto == protoICMPv6 && pkt[p.l4] == icmpv6EchoRequest:
+		reply = icmpv6EchoReply
+	default:
+		return nil, false
+	}
+
+	src := append([]byte(nil), pkt[p.src:p.src+p.addrLen]...)
+	copy(pkt[p.src:], pkt[p.dst:p.dst+p.addrLen])
+	copy(pkt[p.dst:], src)
+	p.ip.Rewrite(p.l4, []byte{reply, pkt[p.l4+1]})
+	return pkt, true
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal/packet"
+)
+
+const (
+	// PathMTUTimeout is how long a learned path MTU is used before larger packets are tried again,
+	// as recommended by RFC 1191 and RFC 8201.
+	PathMTUTimeout = 10 * time.Minute
+	// pathMTUEntries bounds the cache, expired entries are removed first once it's full.
+	pathMTUEntries = 4096
+
+	icmpDestinationUnreachable = 3
+	icmpFragmentationNeeded    = 4
+	icmpTimeExceeded           = 11
+	icmpv6PacketTooBig         = 2
+	icmpv6TimeExceeded         = 3
+
+	// smaller values in a packet too big are ignored: the minimum MTU of RFC 8200 for IPv6, for
+	// IPv4 the floor Linux applies (min_pmtu), as the 68 of RFC 791 only serves to shrink TCP
+	// segments to a few bytes
+	minMTUv4 = 552
+	minMTUv6 = 1280
+)
+
+// PathMTUStats holds the counters of a PathMTUDevice.
+type PathMTUStats struct {
+	Destinations int    // Destinations with a learned path MTU
+	Learned      uint64 // Packet too big messages from the server that lowered a path MTU
+	TooBig       uint64 // Packets answered with a packet too big by usque
+}
+
+// pathMTU is a learned path MTU and when it expires.
+type pathMTU struct {
+	mtu     int
+	expires time.Time
+}
+
+// PathMTUDevice wraps a TunnelDevice and keeps the path MTU of destinations behind the server,
+// learned from the ICMP packet too big messages the server passes on. Later packets to such a
+// destination are answered with a packet too big right away if they don't fit, and TCP SYNs to it
+// get their MSS lowered, so clients behind a router don't have to send a too large packet first
+// for every connection. The messages from the server are still delivered.
+// It is safe for concurrent use.
+type PathMTUDevice struct {
+	dev    TunnelDevice
+	tunnel *Tunnel
+	local  []netip.Addr
+
+	mu    sync.Mutex
+	paths map[netip.Addr]pathMTU
+	size  atomic.Int64
+
+	learned atomic.Uint64
+	tooBig  atomic.Uint64
+}
+
+// NewPathMTUDevice creates a new PathMTUDevice around dev.
+//
+// Parameters:
+//   - tunnel: *Tunnel - The tunnel whose ICMP rate limit and metrics apply to the packet too big messages.
+//   - dev: TunnelDevice - The device to wrap.
+//   - local: []netip.Addr - The tunnel addresses. Only packet too big messages about packets
+//     sent from one of them are learned from.
+//
+// Returns:
+//   - *PathMTUDevice: The device.
+func NewPathMTUDevice(tunnel *Tunnel, dev TunnelDevice, local []netip.Addr) *PathMTUDevice {
+	return &PathMTUDevice{dev: dev, tunnel: tunnel, local: local, paths: map[netip.Addr]pathMTU{}}
+}
+
+func (d *PathMTUDevice) ReadPacket(buf []byte) (int, error) {
+	for {
+		n, err := d.dev.ReadPacket(buf)
+		if err != nil || d.size.Load() == 0 {
+			return n, err
+		}
+		pkt := buf[:n]
+		mtu := d.lookup(pkt)
+		if mtu == 0 {
+			return n, nil
+		}
+		if n <= mtu || !dontFragment(pkt) {
+			clampMSS(pkt, mtu)
+			return n, nil
+		}
+
+		d.tooBig.Add(1)
+		if icmp := buildPacketTooBig(pkt, mtu); icmp != nil && d.tunnel.allowICMPError(icmp) {
+			if err := d.dev.WritePacket(icmp); err != nil {
+				logFor(componentTun).Warn("Error writing ICMP to TUN device, continuing", "error", err)
+			}
+		}
+	}
+}
+
+func (d *PathMTUDevice) WritePacket(pkt []byte) error {
+	d.learn(pkt)
+	return d.dev.WritePacket(pkt)
+}
+
+// Stats returns the counters of the device.
+func (d *PathMTUDevice) Stats() PathMTUStats {
+	return PathMTUStats{
+		Destinations: int(d.size.Load()),
+		Learned:      d.learned.Load(),
+		TooBig:       d.tooBig.Load(),
+	}
+}
+
+// lookup returns the path MTU of the destination of a packet, 0 if none is known.
+func (d *PathMTUDevice) lookup(pkt []byte) int {
+	p, ok := parseNatPacket(pkt)
+	if !ok {
+		return 0
+	}
+	dst := p.addr(pkt, p.dst)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	path, ok := d.paths[dst]
+	if !ok {
+		return 0
+	}
+	if time.Now().After(path.expires) {
+		delete(d.paths, dst)
+		d.size.Store(int64(len(d.paths)))
+		return 0
+	}
+	return path.mtu
+}
+
+// learn records the path MTU of a packet too big message, other packets are ignored.
+func (d *PathMTUDevice) learn(pkt []byte) {
+	dst, mtu, ok := parsePacketTooBig(pkt, d.local)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if path, ok := d.paths[dst]; ok && path.mtu <= mtu && now.Before(path.expires) {
+		return
+	}
+	if len(d.paths) >= pathMTUEntries {
+		d.evict(now)
+	}
+	d.paths[dst] = pathMTU{mtu: mtu, expires: now.Add(PathMTUTimeout)}
+	d.size.Store(int64(len(d.paths)))
+	d.learned.Add(1)
+	logFor(componentTun).Debug("Learned path MTU", "destination", dst, "mtu", mtu)
+}
+
+// evict removes expired entries, or the one expiring first if none has expired. d.mu must be held.
+func (d *PathMTUDevice) evict(now time.Time) {
+	var oldest netip.Addr
+	var oldestExpiry time.Time
+	for dst, path := range d.paths {
+		if now.After(path.expires) {
+			delete(d.paths, dst)
+			continue
+		}
+		if !oldest.IsValid() || path.expires.Before(oldestExpiry) {
+			oldest, oldestExpiry = dst, path.expires
+		}
+	}
+	if len(d.paths) >= pathMTUEntries {
+		delete(d.paths, oldest)
+	}
+}
+
+// parsePacketTooBig reads an ICMP fragmentation needed or ICMPv6 packet too big message. As any
+// host behind the server can send one, it is only accepted if it is addressed to a local address
+// and quotes a packet sent from there, so it can't lower the path MTU of others.
+//
+// Parameters:
+//   - pkt: []byte - The packet.
+//   - local: []netip.Addr - The tunnel addresses.
+//
+// Returns:
+//   - netip.Addr: The destination of the quoted packet, whose path the MTU belongs to.
+//   - int: The MTU.
+//   - bool: Whether the packet is such a message with a usable MTU.
+func parsePacketTooBig(pkt []byte, local []netip.Addr) (netip.Addr, int, bool) {
+	ip, ok := packet.Parse(pkt)
+	if !ok || ip.Fragment() {
+		return netip.Addr{}, 0, false
+	}
+	icmp, ok := packet.ParseICMP(ip.Payload())
+	if !ok {
+		return netip.Addr{}, 0, false
+	}
+	quoted, ok := packet.Parse(icmp.Body())
+	if !ok || quoted.IPv6() != ip.IPv6() {
+		return netip.Addr{}, 0, false
+	}
+	if quoted.Src() != ip.Dst() || !slices.Contains(local, ip.Dst()) {
+		return netip.Addr{}, 0, false
+	}
+
+	switch {
+	case ip.Protocol() == protoICMP && icmp.Type() == icmpDestinationUnreachable && icmp.Code() == icmpFragmentationNeeded:
+		// the MTU is the low half of the rest of the header
+		mtu := int(icmp.Rest() & 0xffff)
+		if mtu < minMTUv4 {
+			return netip.Addr{}, 0, false
+		}
+		return quoted.Dst(), mtu, true
+	case ip.Protocol() == protoICMPv6 && icmp.Type() == icmpv6PacketTooBig:
+		mtu := icmp.Rest()
+		if mtu < minMTUv6 || mtu > 0xffff {
+			return netip.Addr{}, 0, false
+		}
+		return quoted.Dst(), int(mtu), true
+	}
+	return netip.Addr{}, 0, false
+}
+
+// dontFragment reports whether a packet may not be fragmented on its way, see
+// packet.IP.DontFragment. Packets that aren't IP count as fragmentable.
+func dontFragment(pkt []byte) bool {
+	ip, ok := packet.Parse(pkt)
+	return ok && ip.DontFragment()
+}
+
+// buildPacketTooBig builds the ICMP message telling the sender of pkt that it doesn't fit into mtu,
+// sent from the destination of pkt like connect-ip does.
+//
+// Parameters:
+//   - pkt: []byte - The packet that is too big.
+//   - mtu: int - The path MTU of its destination.
+//
+// Returns:
+//   - []byte: The ICMP packet, nil if pkt isn't a valid IP packet.
+func buildPacketTooBig(pkt []byte, mtu int) []byte {
+	ip, ok := packet.Parse(pkt)
+	if !ok || ip.Fragment() {
+		return nil
+	}
+
+	if ip.IPv6() {
+		// the message must fit into the minimum MTU
+		quoted := pkt[:min(len(pkt), minMTUv6-48)]
+		return packet.NewICMP(icmpv6PacketTooBig, 0, uint32(mtu), quoted, 64, 0, ip.Dst(), ip.Src())
+	}
+
+	// the IP header and the first 8 bytes of the payload, as RFC 792 asks for
+	quoted := pkt[:min(len(pkt), ip.HeaderLen()+8)]
+	return packet.NewICMP(icmpDestinationUnreachable, icmpFragmentationNeeded, uint32(uint16(mtu)), quoted, 64, 0, ip.Dst(), ip.Src())
+}
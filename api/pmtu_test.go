@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/Diniboy1123/usque/internal/packet"
+)
+
+func TestParsePacketTooBig(t *testing.T) {
+	local4 := netip.MustParseAddr("172.16.0.2")
+	local6 := netip.MustParseAddr("2606:4700:110::2")
+	other4 := netip.MustParseAddr("172.16.0.3")
+	server4 := netip.MustParseAddr("1.1.1.1")
+	server6 := netip.MustParseAddr("2606:4700:4700::1111")
+	router4 := netip.MustParseAddr("192.0.2.1")
+	router6 := netip.MustParseAddr("2001:db8::1")
+	local := []netip.Addr{local4, local6}
+
+	quoted4 := func(src netip.Addr) []byte {
+		return packet.NewIPv4(protoUDP, 64, 1, src, server4, make([]byte, 8))
+	}
+	quoted6 := packet.NewIPv6(protoUDP, 64, local6, server6, make([]byte, 8))
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		dst  netip.Addr
+		mtu  int
+		ok   bool
+	}{
+		{"IPv4", packet.NewICMP(icmpDestinationUnreachable, icmpFragmentationNeeded, 1400, quoted4(local4), 64, 1, router4, local4), server4, 1400, true},
+		{"IPv6", packet.NewICMP(icmpv6PacketTooBig, 0, 1400, quoted6, 64, 0, router6, local6), server6, 1400, true},
+		{"IPv4 below the floor", packet.NewICMP(icmpDestinationUnreachable, icmpFragmentationNeeded, 68, quoted4(local4), 64, 1, router4, local4), netip.Addr{}, 0, false},
+		{"IPv6 below the minimum MTU", packet.NewICMP(icmpv6PacketTooBig, 0, 1279, quoted6, 64, 0, router6, local6), netip.Addr{}, 0, false},
+		{"addressed to another host", packet.NewICMP(icmpDestinationUnreachable, icmpFragmentationNeeded, 1400, quoted4(other4), 64, 1, router4, other4), netip.Addr{}, 0, false},
+		{"quoting a packet of another host", packet.NewICMP(icmpDestinationUnreachable, icmpFragmentationNeeded, 1400, quoted4(other4), 64, 1, router4, local4), netip.Addr{}, 0, false},
+		{"other ICMP message", packet.NewICMP(icmpDestinationUnreachable, 1, 1400, quoted4(local4), 64, 1, router4, local4), netip.Addr{}, 0, false},
+		{"quoted packet of the other family", packet.NewICMP(icmpv6PacketTooBig, 0, 1400, quoted4(local4), 64, 0, router6, local6), netip.Addr{}, 0, false},
+		{"truncated", packet.NewICMP(icmpDestinationUnreachable, icmpFragmentationNeeded, 1400, quoted4(local4)[:12], 64, 1, router4, local4), netip.Addr{}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, mtu, ok := parsePacketTooBig(tt.pkt, local)
+			if dst != tt.dst || mtu != tt.mtu || ok != tt.ok {
+				t.Errorf("parsePacketTooBig = %s, %d, %v, want %s, %d, %v", dst, mtu, ok, tt.dst, tt.mtu, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package api
+
+import "net"
+
+// ConnectStage is a step of establishing a tunnel connection.
+type ConnectStage int
+
+const (
+	ConnectDialing         ConnectStage = iota // opening the socket, including the proxy association
+	ConnectHandshaking                         // QUIC and TLS handshake
+	ConnectWaitingSettings                     // waiting for the HTTP/3 SETTINGS of the server
+	ConnectRequestSent                         // CONNECT request sent, waiting for the response
+	ConnectEstablished                         // the server accepted the CONNECT request
+)
+
+func (s ConnectStage) String() string {
+	switch s {
+	case ConnectDialing:
+		return "dialing"
+	case ConnectHandshaking:
+		return "handshaking"
+	case ConnectWaitingSettings:
+		return "waiting for settings"
+	case ConnectRequestSent:
+		return "CONNECT sent"
+	case ConnectEstablished:
+		return "established"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnectProgress, if set, is called whenever a connection attempt reaches the next stage,
+// so users on slow links can see where establishing the tunnel is stuck. Happy Eyeballs
+// runs attempts concurrently, so it must be safe for concurrent use.
+var ConnectProgress func(endpoint *net.UDPAddr, stage ConnectStage)
+
+// reportProgress records stage in status, if the attempt is made for a tunnel, and calls
+// ConnectProgress if set.
+func reportProgress(status *TunnelStatus, endpoint *net.UDPAddr, stage ConnectStage) {
+	if status != nil {
+		status.stage(stage)
+	}
+	if ConnectProgress != nil {
+		ConnectProgress(endpoint, stage)
+	}
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UpstreamProxy is the SOCKS5 proxy (socks5://[user:pass@]host:port) QUIC packets to
+// MASQUE servers are relayed through using UDP ASSOCIATE, or nil to send them directly.
+var UpstreamProxy *url.URL
+
+const (
+	socks5Version       = 0x05
+	socks5AuthNone      = 0x00
+	socks5AuthPassword  = 0x02
+	socks5AuthNoMethod  = 0xff
+	socks5CmdAssociate  = 0x03
+	socks5AtypIPv4      = 0x01
+	socks5AtypIPv6      = 0x04
+	socks5HandshakeTime = 10 * time.Second
+	// socks5UDPHeaderMax is the size of the UDP request header with an IPv6 address.
+	socks5UDPHeaderMax = 3 + 1 + 16 + 2
+)
+
+// listenPacketFor opens the socket QUIC packets to the endpoint are sent from.
+// It goes through UpstreamProxy if set.
+func listenPacketFor(endpoint *net.UDPAddr) (net.PacketConn, error) {
+	if UpstreamProxy == nil {
+		conn, err := listenUDPFor(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	switch UpstreamProxy.Scheme {
+	case "socks5", "socks5h":
+		return dialSocks5UDP(UpstreamProxy)
+	default:
+		return nil, fmt.Errorf("%s proxies can't relay UDP, use a SOCKS5 proxy supporting UDP ASSOCIATE", UpstreamProxy.Scheme)
+	}
+}
+
+// socks5PacketConn sends and receives datagrams through a SOCKS5 UDP relay.
+// The association lives as long as the TCP control connection.
+type socks5PacketConn struct {
+	conn    *net.UDPConn
+	ctrl    net.Conn
+	relay   *net.UDPAddr
+	bufPool sync.Pool
+}
+
+// dialSocks5UDP asks the proxy for a UDP association and returns a PacketConn using it.
+//
+// Parameters:
+//   - proxy: *url.URL - The SOCKS5 proxy, optionally with credentials.
+//
+// Returns:
+//   - net.PacketConn: The connection relaying datagrams through the proxy.
+//   - error: An error if the proxy refused the association.
+func dialSocks5UDP(proxy *url.URL) (net.PacketConn, error) {
+	dialer := NewDialer()
+	dialer.Timeout = socks5HandshakeTime
+	ctrl, err := dialer.Dial("tcp", proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy: %v", err)
+	}
+
+	relay, err := socks5Associate(ctrl, proxy.User)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	// a relay on an unspecified address is reachable at the address of the proxy itself
+	if relay.IP.IsUnspecified() {
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	udpConn, err := listenUDPFor(relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	c := &socks5PacketConn{conn: udpConn, ctrl: ctrl, relay: relay}
+	c.bufPool.New = func() any {
+		return make([]byte, 0, 2048)
+	}
+	go func() {
+		// the proxy drops the association when it closes the control connection
+		io.Copy(io.Discard, ctrl)
+		udpConn.Close()
+	}()
+
+	return c, nil
+}
+
+// socks5Associate performs the SOCKS5 handshake and the UDP ASSOCIATE request on ctrl.
+func socks5Associate(ctrl net.Conn, user *url.Userinfo) (*net.UDPAddr, error) {
+	ctrl.SetDeadline(time.Now().Add(socks5HandshakeTime))
+	defer ctrl.SetDeadline(time.Time{})
+
+	method := byte(socks5AuthNone)
+	if user != nil {
+		method = socks5AuthPassword
+	}
+	if _, err := ctrl.Write([]byte{socks5Version, 1, method}); err != nil {
+		return nil, fmt.Errorf("failed to send proxy greeting: %v", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		return nil, fmt.Errorf("failed to read proxy greeting: %v", err)
+	}
+	if reply[0] != socks5Version || reply[1] == socks5AuthNoMethod || reply[1] != method {
+		return nil, errors.New("proxy doesn't accept our authentication method")
+	}
+
+	if method == socks5AuthPassword {
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return nil, errors.New("proxy username or password too long")
+		}
+		req := []byte{0x01, byte(len(user.Username()))}
+		req = append(req, user.Username()...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := ctrl.Write(req); err != nil {
+			return nil, fmt.Errorf("failed to send proxy credentials: %v", err)
+		}
+		if _, err := io.ReadFull(ctrl, reply); err != nil {
+			return nil, fmt.Errorf("failed to read proxy authentication reply: %v", err)
+		}
+		if reply[1] != 0x00 {
+			return nil, errors.New("proxy rejected the credentials")
+		}
+	}
+
+	// we don't know our public address, 0.0.0.0:0 tells the proxy to accept datagrams from anywhere
+	if _, err := ctrl.Write([]byte{socks5Version, socks5CmdAssociate, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, fmt.Errorf("failed to send UDP ASSOCIATE: %v", err)
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(ctrl, header); err != nil {
+		return nil, fmt.Errorf("failed to read UDP ASSOCIATE reply: %v", err)
+	}
+	if header[1] != 0x00 {
+		return nil, fmt.Errorf("proxy refused UDP ASSOCIATE (reply code %d)", header[1])
+	}
+	addr, err := readSocks5Addr(ctrl, header[3])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read UDP relay address: %v", err)
+	}
+
+	return net.UDPAddrFromAddrPort(addr), nil
+}
+
+// readSocks5Addr reads an address and port of the given type from r.
+func readSocks5Addr(r io.Reader, atyp byte) (netip.AddrPort, error) {
+	var buf []byte
+	switch atyp {
+	case socks5AtypIPv4:
+		buf = make([]byte, 4+2)
+	case socks5AtypIPv6:
+		buf = make([]byte, 16+2)
+	default:
+		// a relay must be reachable without resolving names
+		return netip.AddrPort{}, fmt.Errorf("unsupported address type %d", atyp)
+	}
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr, _ := netip.AddrFromSlice(buf[:len(buf)-2])
+	return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(buf[len(buf)-2:])), nil
+}
+
+func (c *socks5PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := c.bufPool.Get().([]byte)
+	defer c.bufPool.Put(buf)
+	buf = buf[:cap(buf)]
+	if len(buf) < len(p)+socks5UDPHeaderMax {
+		buf = make([]byte, len(p)+socks5UDPHeaderMax)
+	}
+
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// fragmented datagrams are rare and optional to support, drop them like the spec allows
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+
+		var headerLen int
+		switch buf[3] {
+		case socks5AtypIPv4:
+			headerLen = 4 + 4 + 2
+		case socks5AtypIPv6:
+			headerLen = 4 + 16 + 2
+		default:
+			continue
+		}
+		if n < headerLen {
+			continue
+		}
+
+		addr, _ := netip.AddrFromSlice(buf[4 : headerLen-2])
+		from := net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(buf[headerLen-2:headerLen])))
+		return copy(p, buf[headerLen:n]), from, nil
+	}
+}
+
+func (c *socks5PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unsupported address type %T", addr)
+	}
+	ap := udpAddr.AddrPort()
+
+	buf := c.bufPool.Get().([]byte)
+	defer c.bufPool.Put(buf)
+
+	buf = append(buf[:0], 0, 0, 0)
+	if ap.Addr().Unmap().Is4() {
+		buf = append(buf, socks5AtypIPv4)
+		buf = append(buf, ap.Addr().Unmap().AsSlice()...)
+	} else {
+		buf = append(buf, socks5AtypIPv6)
+		buf = append(buf, ap.Addr().AsSlice()...)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, ap.Port())
+	buf = append(buf, p...)
+
+	if _, err := c.conn.WriteTo(buf, c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socks5PacketConn) Close() error {
+	c.ctrl.Close()
+	return c.conn.Close()
+}
+
+func (c *socks5PacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *socks5PacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *socks5PacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *socks5PacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetReadBuffer lets quic-go raise the receive buffer size like it does for plain UDP sockets.
+func (c *socks5PacketConn) SetReadBuffer(bytes int) error {
+	return c.conn.SetReadBuffer(bytes)
+}
+
+// SetWriteBuffer lets quic-go raise the send buffer size like it does for plain UDP sockets.
+func (c *socks5PacketConn) SetWriteBuffer(bytes int) error {
+	return c.conn.SetWriteBuffer(bytes)
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/quic-go/quic-go"
+)
+
+// ReconnectHistoryLen is the number of reconnect decisions Reconnects keeps.
+const ReconnectHistoryLen = 64
+
+// Reasons MaintainTunnel reconnects for, see ReconnectDecision.
+const (
+	ReconnectConnectFailed  = "connect-failed"  // the connection couldn't be made
+	ReconnectRejected       = "rejected"        // the server answered CONNECT with an error status
+	ReconnectIdleTimeout    = "idle-timeout"    // nothing was received for the QUIC idle timeout
+	ReconnectClosedByPeer   = "closed-by-peer"  // the server closed the connection or the CONNECT stream
+	ReconnectDevice         = "device"          // reading from or writing to the device failed
+	ReconnectNetworkChanged = "network-changed" // NotifyNetworkChange was called
+	ReconnectRequested      = "requested"       // RequestReconnect was called, or RequestRefresh failed
+	ReconnectShutdown       = "shutdown"        // the context of MaintainTunnel was cancelled
+	ReconnectOther          = "other"
+)
+
+// ReconnectDecision records why MaintainTunnel dropped a connection attempt or connection
+// and what it did next, so an intermittent drop can be explained after the fact.
+type ReconnectDecision struct {
+	Time     time.Time     `json:"time"`
+	Endpoint string        `json:"endpoint"`           // The endpoint of the failed attempt or lost connection
+	Reason   string        `json:"reason"`             // One of the Reconnect* reasons
+	Error    string        `json:"error"`              // The error as logged
+	Uptime   time.Duration `json:"uptime"`             // How long the connection lasted, zero if it was never made
+	Failures int           `json:"failures"`           // Consecutive failures of the endpoint, including this one
+	Failover bool          `json:"failover"`           // Whether the endpoint list switched to another endpoint
+	Next     string        `json:"next"`               // The endpoint tried next
+	Delay    time.Duration `json:"delay"`              // The wait before the next attempt
+	Features []string      `json:"features,omitempty"` // Enabled feature switches at the time
+}
+
+// String explains the decision in one line.
+func (d ReconnectDecision) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s: %s", d.Time.Format(time.DateTime), d.Endpoint, d.Reason)
+	if d.Uptime > 0 {
+		fmt.Fprintf(&b, " after %s connected", d.Uptime.Round(time.Second))
+	}
+	if d.Error != "" {
+		fmt.Fprintf(&b, " (%s)", d.Error)
+	}
+	if d.Failures > 0 {
+		fmt.Fprintf(&b, ", %d consecutive failures", d.Failures)
+	}
+	if d.Failover {
+		fmt.Fprintf(&b, ", failed over to %s", d.Next)
+	} else if d.Next != "" {
+		fmt.Fprintf(&b, ", retrying %s", d.Next)
+	}
+	if d.Reason != ReconnectShutdown {
+		fmt.Fprintf(&b, " in %s", d.Delay)
+	}
+	return b.String()
+}
+
+// ReconnectLog keeps the latest reconnect decisions. It is safe for concurrent use.
+type ReconnectLog struct {
+	mu        sync.Mutex
+	decisions []ReconnectDecision
+}
+
+// Reconnects holds the reconnect decisions of all tunnels in this process.
+var Reconnects = &ReconnectLog{}
+
+// add records a decision, dropping the oldest one if the log is full.
+func (l *ReconnectLog) add(d ReconnectDecision) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.decisions) == ReconnectHistoryLen {
+		l.decisions = append(l.decisions[:0], l.decisions[1:]...)
+	}
+	l.decisions = append(l.decisions, d)
+}
+
+// Recent returns the last n decisions, oldest first. n <= 0 returns all of them.
+func (l *ReconnectLog) Recent(n int) []ReconnectDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n <= 0 || n > len(l.decisions) {
+		n = len(l.decisions)
+	}
+	return append([]ReconnectDecision(nil), l.decisions[len(l.decisions)-n:]...)
+}
+
+// errTunDevice is wrapped into the errors of reading from and writing to the TUN device.
+var errTunDevice = errors.New("TUN device")
+
+// reconnectReason classifies the error that ended a connection or connection attempt.
+func reconnectReason(err error) string {
+	var idleErr *quic.IdleTimeoutError
+	var appErr *quic.ApplicationError
+	var closeErr *connectip.CloseError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ReconnectShutdown
+	case errors.Is(err, errNetworkChanged):
+		return ReconnectNetworkChanged
+	case errors.Is(err, errReconnectRequested), errors.Is(err, errRefreshFailed):
+		return ReconnectRequested
+	case errors.As(err, &idleErr):
+		return ReconnectIdleTimeout
+	case errors.Is(err, errTunDevice), errors.Is(err, errDeviceDown), errors.Is(err, errDeviceMTUGrew):
+		return ReconnectDevice
+	case errors.As(err, &appErr), errors.As(err, &closeErr):
+		// closed on this side, e.g. by a refresh or while shutting down
+		if (appErr == nil || !appErr.Remote) && (closeErr == nil || !closeErr.Remote) {
+			return ReconnectOther
+		}
+		return ReconnectClosedByPeer
+	case errors.As(err, &netErr), errors.Is(err, context.DeadlineExceeded):
+		return ReconnectConnectFailed
+	}
+	return ReconnectOther
+}
+
+// enabledFeatures lists the names of the enabled feature switches.
+func enabledFeatures() []string {
+	var names []string
+	for _, feature := range Features.Status() {
+		if feature.Enabled {
+			names = append(names, string(feature.Name))
+		}
+	}
+	return names
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/quic-go/quic-go"
+)
+
+func TestReconnectReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"shutdown", context.Canceled, ReconnectShutdown},
+		{"network change", errNetworkChanged, ReconnectNetworkChanged},
+		{"requested", errReconnectRequested, ReconnectRequested},
+		{"refresh failed", fmt.Errorf("%w: timeout", errRefreshFailed), ReconnectRequested},
+		{"idle timeout behind the stream", fmt.Errorf("connection closed while reading from IP connection: %w: %w", &connectip.CloseError{Remote: true}, &quic.IdleTimeoutError{}), ReconnectIdleTimeout},
+		{"closed by the server", fmt.Errorf("connection closed while reading from IP connection: %w", &connectip.CloseError{Remote: true}), ReconnectClosedByPeer},
+		{"server application error", &quic.ApplicationError{Remote: true, ErrorCode: 0x100}, ReconnectClosedByPeer},
+		{"closed locally", fmt.Errorf("connection closed while writing to IP connection: %w", &connectip.CloseError{Remote: false}), ReconnectOther},
+		{"local application error", &quic.ApplicationError{Remote: false}, ReconnectOther},
+		{"device read", fmt.Errorf("failed to read from %w: %w", errTunDevice, os.ErrClosed), ReconnectDevice},
+		{"device down", errDeviceDown, ReconnectDevice},
+		{"handshake timeout", &quic.HandshakeTimeoutError{}, ReconnectConnectFailed},
+		{"deadline", context.DeadlineExceeded, ReconnectConnectFailed},
+		// messages alone don't classify an error anymore
+		{"message only", errors.New("timeout: no recent network activity"), ReconnectOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reconnectReason(tt.err); got != tt.want {
+				t.Errorf("reconnectReason(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// ScanResult holds the outcome of probing a single endpoint.
+type ScanResult struct {
+	Endpoint *net.UDPAddr  // The probed endpoint
+	RTT      time.Duration // Time it took to complete the QUIC handshake
+	Colo     string        // Cloudflare data center that answered, empty if unknown
+	Err      error         // Non-nil if the handshake failed
+}
+
+// ProbeEndpoint performs a QUIC handshake with the given endpoint and measures how long it takes.
+// The connection is closed right after the handshake completes.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the handshake, should carry a timeout.
+//   - tlsConfig: *tls.Config - The TLS configuration for secure communication.
+//   - quicConfig: *quic.Config - The QUIC configuration settings.
+//   - endpoint: *net.UDPAddr - The endpoint to probe.
+//
+// Returns:
+//   - time.Duration: The handshake duration.
+//   - error: An error if the handshake fails.
+func ProbeEndpoint(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, endpoint *net.UDPAddr) (time.Duration, error) {
+	udpConn, err := listenPacketFor(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	defer udpConn.Close()
+
+	start := time.Now()
+	conn, err := quic.Dial(ctx, udpConn, endpoint, tlsConfig, quicConfig)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.CloseWithError(0, "")
+
+	return rtt, nil
+}
+
+// ProbeEndpointColo performs a QUIC handshake with the given endpoint like ProbeEndpoint and then
+// asks the server for /cdn-cgi/trace over the same connection to learn which data center answered.
+// No tunnel is set up. A failed trace doesn't fail the probe, the colo is left empty instead.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the handshake and the trace, should carry a timeout.
+//   - tlsConfig: *tls.Config - The TLS configuration for secure communication.
+//   - quicConfig: *quic.Config - The QUIC configuration settings.
+//   - endpoint: *net.UDPAddr - The endpoint to probe.
+//
+// Returns:
+//   - time.Duration: The handshake duration.
+//   - string: The IATA code of the data center, empty if the server didn't tell.
+//   - error: An error if the handshake fails.
+func ProbeEndpointColo(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, endpoint *net.UDPAddr) (time.Duration, string, error) {
+	udpConn, err := listenPacketFor(endpoint)
+	if err != nil {
+		return 0, "", err
+	}
+	defer udpConn.Close()
+
+	start := time.Now()
+	conn, err := quic.Dial(ctx, udpConn, endpoint, tlsConfig, quicConfig)
+	if err != nil {
+		return 0, "", err
+	}
+	rtt := time.Since(start)
+	defer conn.CloseWithError(0, "")
+
+	colo, _ := traceColo(ctx, conn, tlsConfig.ServerName)
+	return rtt, colo, nil
+}
+
+// traceColo requests /cdn-cgi/trace on an established connection and returns its colo field.
+func traceColo(ctx context.Context, conn *quic.Conn, host string) (string, error) {
+	tr := &http3.Transport{
+		AdditionalSettings: maps.Clone(internal.H3Settings),
+		DisableCompression: true,
+	}
+	hconn := tr.NewClientConn(conn)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+"/cdn-cgi/trace", nil)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := hconn.RoundTrip(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request trace: %v", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("trace returned status %d", rsp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(rsp.Body)
+	for scanner.Scan() {
+		if colo, ok := strings.CutPrefix(scanner.Text(), "colo="); ok {
+			return colo, nil
+		}
+	}
+	return "", fmt.Errorf("no colo in trace: %v", scanner.Err())
+}
+
+// ScanEndpoints probes all endpoints concurrently and returns the results sorted
+// with successful probes first, fastest first.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the scan.
+//   - tlsConfig: *tls.Config - The TLS configuration for secure communication.
+//   - quicConfig: *quic.Config - The QUIC configuration settings.
+//   - endpoints: []*net.UDPAddr - The endpoints to probe.
+//   - timeout: time.Duration - The timeout for a single probe.
+//   - concurrency: int - The maximum number of probes running at once.
+//   - colo: bool - Whether to also ask every endpoint for its data center, see ProbeEndpointColo.
+//
+// Returns:
+//   - []ScanResult: The probe results.
+func ScanEndpoints(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, endpoints []*net.UDPAddr, timeout time.Duration, concurrency int, colo bool) []ScanResult {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	results := make([]ScanResult, len(endpoints))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint *net.UDPAddr) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			probeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			result := ScanResult{Endpoint: endpoint}
+			if colo {
+				result.RTT, result.Colo, result.Err = ProbeEndpointColo(probeCtx, tlsConfig.Clone(), quicConfig.Clone(), endpoint)
+			} else {
+				result.RTT, result.Err = ProbeEndpoint(probeCtx, tlsConfig.Clone(), quicConfig.Clone(), endpoint)
+			}
+			results[i] = result
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if (results[i].Err == nil) != (results[j].Err == nil) {
+			return results[i].Err == nil
+		}
+		return results[i].RTT < results[j].RTT
+	})
+
+	return results
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+)
+
+// States of the tunnel reported by TunnelSnapshot.
+const (
+	TunnelStopped    = "stopped"    // MaintainTunnel isn't running
+	TunnelConnecting = "connecting" // a connection is being made, or the tunnel waits to reconnect
+	TunnelConnected  = "connected"  // packets are forwarded
+)
+
+// TunnelErrorsLen is the number of errors TunnelSnapshot.LastErrors keeps.
+const TunnelErrorsLen = 8
+
+// TunnelError is an error that ended a connection or connection attempt.
+type TunnelError struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"` // One of the Reconnect* reasons
+	Error  string    `json:"error"`
+}
+
+// TunnelSnapshot is a point in time view of the tunnel for user interfaces.
+// The slices are shared between snapshots and must not be modified.
+type TunnelSnapshot struct {
+	Version    uint64           `json:"version"`              // Increases with every change announced by TunnelStatus.Changed
+	State      string           `json:"state"`                // One of TunnelStopped, TunnelConnecting or TunnelConnected
+	Stage      ConnectStage     `json:"stage"`                // How far the latest connection attempt got
+	Transport  string           `json:"transport"`            // Protocol carrying the tunnel, empty until connected
+	Endpoint   string           `json:"endpoint"`             // The endpoint connected or connecting to
+	Addresses  []netip.Prefix   `json:"addresses"`            // Addresses the server assigned on the current connection
+	Counters   MetricsSnapshot  `json:"counters"`             // Counters over all connections
+	Connection *ConnectionStats `json:"connection,omitempty"` // Counters of the current connection, nil while disconnected
+	LastErrors []TunnelError    `json:"last_errors"`          // The latest errors, oldest first
+}
+
+// TunnelStatus tracks the state of MaintainTunnel for Snapshot. It is safe for concurrent use.
+type TunnelStatus struct {
+	current atomic.Pointer[TunnelSnapshot]
+
+	metrics *TunnelMetrics // the counters of the tunnel, added to snapshots
+
+	mu      sync.Mutex
+	changed chan struct{}
+	ipConn  *connectip.Conn // the current connection, its addresses are followed
+}
+
+// newTunnelStatus creates a TunnelStatus of a stopped tunnel that counts in metrics.
+func newTunnelStatus(metrics *TunnelMetrics) *TunnelStatus {
+	t := &TunnelStatus{metrics: metrics, changed: make(chan struct{})}
+	t.current.Store(&TunnelSnapshot{State: TunnelStopped})
+	return t
+}
+
+// Snapshot returns the current state of the tunnel. It takes no locks and only reads a few
+// atomics, so user interfaces can call it on every frame.
+//
+// Returns:
+//   - TunnelSnapshot: The state, with counters taken now.
+func (t *TunnelStatus) Snapshot() TunnelSnapshot {
+	s := *t.current.Load()
+	s.Counters = t.metrics.Snapshot()
+	if connection, ok := t.metrics.Connection(); ok {
+		s.Connection = &connection
+	}
+	return s
+}
+
+// Connected reports whether the tunnel is connected and forwards packets.
+func (t *TunnelStatus) Connected() bool {
+	return t.current.Load().State == TunnelConnected
+}
+
+// Changed returns a channel that is closed on the next change of the state, stage, endpoint,
+// addresses or errors. Counters change all the time and aren't announced. Call Changed again
+// after the channel was closed to wait for the change after it.
+//
+// Returns:
+//   - <-chan struct{}: The channel.
+func (t *TunnelStatus) Changed() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.changed
+}
+
+// update applies change to a copy of the current snapshot, stores it and announces it.
+func (t *TunnelStatus) update(change func(*TunnelSnapshot)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := *t.current.Load()
+	change(&s)
+	s.Version++
+	t.current.Store(&s)
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// connecting records a new connection attempt to endpoint.
+func (t *TunnelStatus) connecting(endpoint string) {
+	t.update(func(s *TunnelSnapshot) {
+		s.State = TunnelConnecting
+		s.Stage = ConnectDialing
+		s.Transport = ""
+		s.Endpoint = endpoint
+		s.Addresses = nil
+		t.ipConn = nil
+	})
+}
+
+// stage records the progress of the connection attempt.
+func (t *TunnelStatus) stage(stage ConnectStage) {
+	if current := t.current.Load(); current.State != TunnelConnecting || current.Stage == stage {
+		return
+	}
+	t.update(func(s *TunnelSnapshot) { s.Stage = stage })
+}
+
+// connected records an established connection and follows the addresses the server assigns to it.
+func (t *TunnelStatus) connected(endpoint string, transport string, ipConn *connectip.Conn) {
+	t.update(func(s *TunnelSnapshot) {
+		s.State = TunnelConnected
+		s.Stage = ConnectEstablished
+		s.Transport = transport
+		s.Endpoint = endpoint
+		t.ipConn = ipConn
+	})
+	if ipConn == nil {
+		// the WireGuard fallback, which has no address assignments
+		return
+	}
+	go func() {
+		for {
+			// returns an error once the connection is closed
+			prefixes, err := ipConn.LocalPrefixes(context.Background())
+			if err != nil {
+				return
+			}
+			t.update(func(s *TunnelSnapshot) {
+				// a late assignment of a connection that was replaced already
+				if t.ipConn == ipConn {
+					s.Addresses = prefixes
+				}
+			})
+		}
+	}()
+}
+
+// failed records the error that ended a connection or connection attempt. The tunnel
+// reconnects afterwards, so it is connecting again.
+func (t *TunnelStatus) failed(d ReconnectDecision) {
+	t.update(func(s *TunnelSnapshot) {
+		s.State = TunnelConnecting
+		s.Transport = ""
+		s.Endpoint = d.Next
+		s.Addresses = nil
+		t.ipConn = nil
+		errs := s.LastErrors
+		if len(errs) == TunnelErrorsLen {
+			errs = errs[1:]
+		}
+		// a new slice, earlier snapshots keep theirs
+		s.LastErrors = append(append([]TunnelError(nil), errs...), TunnelError{Time: d.Time, Reason: d.Reason, Error: d.Error})
+	})
+}
+
+// stopped records the end of MaintainTunnel.
+func (t *TunnelStatus) stopped() {
+	t.update(func(s *TunnelSnapshot) {
+		s.State = TunnelStopped
+		s.Transport = ""
+		s.Addresses = nil
+		t.ipConn = nil
+	})
+}
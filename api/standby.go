@@ -0,0 +1,74 @@
+package api
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+)
+
+// StandbyRegistration is a second enrolled device MaintainTunnel switches to when the server
+// keeps rejecting the primary registration, e.g. because it was revoked or expired.
+// Unattended devices then stay online until someone registers again.
+type StandbyRegistration struct {
+	TLSConfig *tls.Config // TLS configuration with the certificate of the standby device
+	ID        string      // Device ID of the standby registration, for logs and hooks
+}
+
+// Standby is the standby registration of all tunnels in this process, nil if there is none.
+// Set it before starting MaintainTunnel.
+var Standby *StandbyRegistration
+
+// StandbyThreshold is the number of consecutive rejections of the primary registration
+// after which MaintainTunnel switches to Standby.
+var StandbyThreshold = 3
+
+// TLS alerts a server sends when it doesn't accept the client certificate.
+var registrationAlerts = map[tls.AlertError]bool{
+	42: true, // bad_certificate
+	44: true, // certificate_revoked
+	45: true, // certificate_expired
+	46: true, // certificate_unknown
+	49: true, // access_denied
+}
+
+// registrationRejected reports whether a connection attempt failed because the server
+// doesn't accept the registration, as opposed to network or server trouble.
+//
+// Parameters:
+//   - rsp: *http.Response - The response to the CONNECT request, nil if there is none.
+//   - err: error - The error of the connection attempt, nil if there is none.
+//
+// Returns:
+//   - bool: Whether the registration was rejected.
+func registrationRejected(rsp *http.Response, err error) bool {
+	if rsp != nil && (rsp.StatusCode == http.StatusUnauthorized || rsp.StatusCode == http.StatusForbidden) {
+		return true
+	}
+	var transportErr *quic.TransportError
+	if errors.As(err, &transportErr) && transportErr.Remote && transportErr.ErrorCode.IsCryptoError() {
+		return registrationAlerts[tls.AlertError(transportErr.ErrorCode-0x100)]
+	}
+	return false
+}
+
+// useStandby returns the TLS configuration to connect with next. Once the primary registration
+// was rejected StandbyThreshold times in a row, it switches to Standby for good and alerts the user.
+//
+// Parameters:
+//   - tlsConfig: *tls.Config - The TLS configuration currently used.
+//   - rejections: int - The consecutive rejections of the current registration.
+//
+// Returns:
+//   - *tls.Config: The TLS configuration to use.
+//   - bool: Whether it switched to the standby registration.
+func useStandby(tlsConfig *tls.Config, rejections int) (*tls.Config, bool) {
+	if Standby == nil || rejections < StandbyThreshold || tlsConfig == Standby.TLSConfig {
+		return tlsConfig, false
+	}
+	logFor(componentTunnel).Error("Primary registration rejected, switching to the standby registration. Register again to restore a standby.",
+		"rejections", rejections, "device", Standby.ID)
+	hookStandby(Standby.ID)
+	return Standby.TLSConfig, true
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// Tunnel is the state of one tunnel, shared by MaintainTunnel and the devices wrapped around
+// its TUN device. The caller creates it and passes it to both, so a process can run several
+// tunnels side by side. The CLI runs one and uses DefaultTunnel.
+// It is safe for concurrent use.
+type Tunnel struct {
+	Status    *TunnelStatus  // The state for user interfaces
+	Metrics   *TunnelMetrics // The counters over all connections of the tunnel
+	Failures  *FailureCache  // Endpoints that failed to connect lately, skipped for minutes
+	Blocklist *Blocklist     // Endpoints that pass no data, skipped for hours
+
+	reconnectRequests chan error                 // a pending reconnect request, with its reason
+	refreshRequests   chan struct{}              // a pending refresh request
+	nextTLSConfig     atomic.Pointer[tls.Config] // set by ReplaceTLSConfig until MaintainTunnel picks it up
+	deviceEvents      chan tun.Event             // events of the TUN device until MaintainTunnel picks them up
+	deviceMTU         atomic.Int64               // the last MTU the TUN device reported, 0 if it never changed
+	quicConn          atomic.Pointer[quic.Conn]  // the QUIC connection of the current connection, nil while there is none
+}
+
+// NewTunnel creates the state of a stopped tunnel, with empty counters and caches.
+func NewTunnel() *Tunnel {
+	metrics := &TunnelMetrics{}
+	return &Tunnel{
+		Status:            newTunnelStatus(metrics),
+		Metrics:           metrics,
+		Failures:          NewFailureCache(DefaultFailureTTL),
+		Blocklist:         NewBlocklist(),
+		reconnectRequests: make(chan error, 1),
+		refreshRequests:   make(chan struct{}, 1),
+		deviceEvents:      make(chan tun.Event, 8),
+	}
+}
+
+// DefaultTunnel is the tunnel of the CLI, which runs a single one per process.
+var DefaultTunnel = NewTunnel()
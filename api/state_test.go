@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTunnelStateIsolated(t *testing.T) {
+	a, b := NewTunnel(), NewTunnel()
+	endpoint := &net.UDPAddr{IP: net.IPv4(162, 159, 198, 1), Port: 443}
+
+	list, err := NewEndpointList([]*net.UDPAddr{endpoint})
+	if err != nil {
+		t.Fatalf("NewEndpointList() error = %v", err)
+	}
+	list.use(a)
+	list.ReportFailure()
+	if !a.Failures.Failed(endpoint) {
+		t.Errorf("failure wasn't recorded in the tunnel of the list")
+	}
+	if b.Failures.Failed(endpoint) {
+		t.Errorf("failure of one tunnel was recorded in another")
+	}
+
+	for range BlocklistThreshold {
+		a.Blocklist.ReportDead(endpoint)
+	}
+	if !a.Blocklist.Blocked(endpoint) || b.Blocklist.Blocked(endpoint) {
+		t.Errorf("blocked in a = %v, in b = %v, want only a", a.Blocklist.Blocked(endpoint), b.Blocklist.Blocked(endpoint))
+	}
+
+	a.Metrics.tx.add(100)
+	if got := b.Metrics.Snapshot().TxBytes; got != 0 {
+		t.Errorf("bytes sent by one tunnel counted in another: %d", got)
+	}
+	if got := a.Status.Snapshot().Counters.TxBytes; got != 100 {
+		t.Errorf("status counters = %d bytes sent, want those of its own tunnel", got)
+	}
+
+	a.NotifyNetworkChange()
+	if a.Failures.Failed(endpoint) {
+		t.Errorf("network change didn't reset the failures of its tunnel")
+	}
+	select {
+	case <-b.reconnectRequests:
+		t.Errorf("reconnect requested for one tunnel reached another")
+	default:
+	}
+	select {
+	case err := <-a.reconnectRequests:
+		if err != errNetworkChanged {
+			t.Errorf("reconnect reason = %v, want %v", err, errNetworkChanged)
+		}
+	default:
+		t.Errorf("network change didn't request a reconnect")
+	}
+}
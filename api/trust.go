@@ -0,0 +1,170 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// RootCAs, if set, are the certificate authorities control-plane connections trust, e.g. the system
+// roots plus the CA of a TLS-intercepting middlebox. nil trusts the system roots. Connections to
+// MASQUE servers don't use it, they are pinned to the endpoint public key of the config.
+var RootCAs *x509.CertPool
+
+// PinnedKeys, if not empty, are the SHA-256 hashes of the SubjectPublicKeyInfo of certificates that
+// both control-plane and MASQUE connections require. A control-plane connection is accepted if a
+// certificate of a verified chain has one of these keys, a MASQUE connection if the server's own
+// certificate has, so the keys of every server in use have to be given.
+var PinnedKeys [][sha256.Size]byte
+
+// LoadCAFile adds the PEM certificates of a file to the system roots and trusts them for
+// control-plane connections.
+//
+// Parameters:
+//   - path: string - The PEM file, empty to trust the system roots only.
+//
+// Returns:
+//   - error: An error if the file can't be read or has no certificates.
+func LoadCAFile(path string) error {
+	if path == "" {
+		RootCAs = nil
+		applyControlPlaneTLS()
+		return nil
+	}
+
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read CA file: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		// e.g. on systems without a certificate store, only the file is trusted then
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no PEM certificates found in %s", path)
+	}
+
+	RootCAs = pool
+	applyControlPlaneTLS()
+	return nil
+}
+
+// SetPinnedKeys requires control-plane and MASQUE connections to present one of the given keys.
+//
+// Parameters:
+//   - pins: []string - SHA-256 hashes of SubjectPublicKeyInfo in base64, optionally prefixed with
+//     "sha256/" or "sha256//" like in HPKP and curl, or in hex. None disables pinning.
+//
+// Returns:
+//   - error: An error if a pin isn't a SHA-256 hash.
+func SetPinnedKeys(pins []string) error {
+	keys := make([][sha256.Size]byte, 0, len(pins))
+	for _, pin := range pins {
+		key, err := parsePin(pin)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	PinnedKeys = keys
+	applyControlPlaneTLS()
+	return nil
+}
+
+// parsePin decodes a pin given to SetPinnedKeys.
+func parsePin(pin string) ([sha256.Size]byte, error) {
+	var key [sha256.Size]byte
+	value := strings.TrimSpace(pin)
+	if trimmed, ok := strings.CutPrefix(value, "sha256//"); ok {
+		value = trimmed
+	} else {
+		value = strings.TrimPrefix(value, "sha256/")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(decoded) != sha256.Size {
+		decoded, err = hex.DecodeString(value)
+	}
+	if err != nil || len(decoded) != sha256.Size {
+		return key, fmt.Errorf("invalid pin %q: expected the base64 or hex SHA-256 hash of a public key", pin)
+	}
+	copy(key[:], decoded)
+	return key, nil
+}
+
+// hasPinnedKey reports whether a certificate has a key in PinnedKeys.
+func hasPinnedKey(cert *x509.Certificate) bool {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, key := range PinnedKeys {
+		if hash == key {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPinnedChains checks that a chain verified against the roots contains a certificate with a
+// key in PinnedKeys. Only verified chains count: any server can append a public certificate with
+// a pinned key to the ones it sends.
+//
+// Parameters:
+//   - chains: [][]*x509.Certificate - The chains crypto/tls verified.
+//
+// Returns:
+//   - error: An error if pinning is on and no verified certificate matches.
+func verifyPinnedChains(chains [][]*x509.Certificate) error {
+	if len(PinnedKeys) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if hasPinnedKey(cert) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("none of the %d verified chains of the server has a pinned public key", len(chains))
+}
+
+// verifyPinnedLeaf checks that the certificate of a MASQUE server has a key in PinnedKeys. Those
+// certificates aren't verified against roots, so the leaf, whose key the handshake proves the
+// server holds, is the only one that can be trusted.
+//
+// Parameters:
+//   - leaf: *x509.Certificate - The first certificate the server sent.
+//
+// Returns:
+//   - error: An error if pinning is on and the leaf doesn't match.
+func verifyPinnedLeaf(leaf *x509.Certificate) error {
+	if len(PinnedKeys) == 0 || hasPinnedKey(leaf) {
+		return nil
+	}
+	return fmt.Errorf("the certificate of the server has no pinned public key")
+}
+
+// applyControlPlaneTLS sets up the TLS config of ControlPlaneClient for RootCAs and PinnedKeys.
+// The usual verification against the roots still happens before the pins are checked.
+func applyControlPlaneTLS() {
+	transport, ok := ControlPlaneClient.Transport.(*http.Transport)
+	if !ok {
+		return
+	}
+	if RootCAs == nil && len(PinnedKeys) == 0 {
+		transport.TLSClientConfig = nil
+		return
+	}
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs: RootCAs,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return verifyPinnedChains(verifiedChains)
+		},
+	}
+}
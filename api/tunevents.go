@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// errDeviceDown is the reason for dropping the connection when the TUN device went down.
+var errDeviceDown = errors.New("TUN device went down")
+
+// errDeviceMTUGrew is the reason for reconnecting when the MTU of the TUN device grew beyond
+// the packet buffers, which are made larger for the next connection.
+var errDeviceMTUGrew = errors.New("TUN device MTU grew")
+
+// watchDeviceEvents passes the events of dev on to the MaintainTunnel of t until dev is closed.
+// Devices that aren't monitored by wireguard-go only report EventUp once.
+func (t *Tunnel) watchDeviceEvents(dev tun.Device) {
+	tunLog := logFor(componentTun)
+	for event := range dev.Events() {
+		if event&tun.EventMTUUpdate != 0 {
+			mtu, err := dev.MTU()
+			if err != nil {
+				tunLog.Warn("Failed to get MTU of TUN device", "error", err)
+				continue
+			}
+			if previous := t.deviceMTU.Swap(int64(mtu)); previous == int64(mtu) {
+				continue
+			}
+			tunLog.Info("TUN device MTU changed", "mtu", mtu)
+		}
+		if event&tun.EventDown != 0 {
+			tunLog.Warn("TUN device went down")
+		}
+		select {
+		case t.deviceEvents <- event:
+		default:
+			// MaintainTunnel is behind, the MTU is kept in t.deviceMTU anyway
+		}
+	}
+}
+
+// deviceEventError returns why the connection has to be dropped after event, nil if it can stay.
+//
+// Parameters:
+//   - event: tun.Event - The event of the device.
+//   - bufferSize: int - The size of the packet buffers of the connection.
+//
+// Returns:
+//   - error: errDeviceDown, errDeviceMTUGrew or nil.
+func (t *Tunnel) deviceEventError(event tun.Event, bufferSize int) error {
+	if event&tun.EventDown != 0 {
+		return errDeviceDown
+	}
+	if event&tun.EventMTUUpdate != 0 && int(t.deviceMTU.Load()) > bufferSize {
+		return errDeviceMTUGrew
+	}
+	return nil
+}
+
+// waitDeviceUp waits until the TUN device comes up again after errDeviceDown, or ctx is done.
+func (t *Tunnel) waitDeviceUp(ctx context.Context) {
+	for {
+		select {
+		case event := <-t.deviceEvents:
+			if event&tun.EventUp != 0 {
+				logFor(componentTun).Info("TUN device is up again")
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
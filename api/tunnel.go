@@ -5,13 +5,18 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	connectip "github.com/Diniboy1123/connect-ip-go"
 	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/songgao/water"
 	"golang.zx2c4.com/wireguard/tun"
 )
@@ -23,10 +28,25 @@ import (
 type NetBuffer struct {
 	capacity int
 	buf      sync.Pool
+
+	gets     atomic.Uint64
+	puts     atomic.Uint64
+	allocs   atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// NetBufferStats is a point in time copy of the counters of a NetBuffer.
+type NetBufferStats struct {
+	Capacity int    `json:"capacity"` // Size of the byte slices
+	Gets     uint64 `json:"gets"`     // Slices taken from the pool
+	Puts     uint64 `json:"puts"`     // Slices returned to the pool
+	Allocs   uint64 `json:"allocs"`   // Slices allocated because the pool was empty
+	Rejected uint64 `json:"rejected"` // Slices not taken back because of a wrong capacity
 }
 
 // Get returns a byte slice from the pool.
 func (n *NetBuffer) Get() []byte {
+	n.gets.Add(1)
 	return *(n.buf.Get().(*[]byte))
 }
 
@@ -35,30 +55,58 @@ func (n *NetBuffer) Get() []byte {
 // If it doesn't match, the byte slice is not returned to the pool.
 func (n *NetBuffer) Put(buf []byte) {
 	if cap(buf) != n.capacity {
+		n.rejected.Add(1)
 		return
 	}
+	n.puts.Add(1)
 	n.buf.Put(&buf)
 }
 
+// Stats returns the counters of the pool. Gets minus Puts is roughly the number of slices in use,
+// a high Allocs compared to Gets means the pool is drained faster than it is refilled.
+func (n *NetBuffer) Stats() NetBufferStats {
+	return NetBufferStats{
+		Capacity: n.capacity,
+		Gets:     n.gets.Load(),
+		Puts:     n.puts.Load(),
+		Allocs:   n.allocs.Load(),
+		Rejected: n.rejected.Load(),
+	}
+}
+
 // NewNetBuffer creates a new NetBuffer with the specified capacity.
 // The capacity must be greater than 0.
 func NewNetBuffer(capacity int) *NetBuffer {
 	if capacity <= 0 {
 		panic("capacity must be greater than 0")
 	}
-	return &NetBuffer{
-		capacity: capacity,
-		buf: sync.Pool{
-			New: func() interface{} {
-				b := make([]byte, capacity)
-				return &b
-			},
-		},
+	n := &NetBuffer{capacity: capacity}
+	n.buf.New = func() interface{} {
+		n.allocs.Add(1)
+		b := make([]byte, capacity)
+		return &b
 	}
+	return n
+}
+
+// activeBuffers holds the packet buffer pools of running MaintainTunnel calls.
+var activeBuffers sync.Map
+
+// BufferPoolStats returns the counters of the packet buffer pools of all running tunnels.
+func BufferPoolStats() []NetBufferStats {
+	var stats []NetBufferStats
+	activeBuffers.Range(func(key, _ any) bool {
+		stats = append(stats, key.(*NetBuffer).Stats())
+		return true
+	})
+	return stats
 }
 
 // TunnelDevice abstracts a TUN device so that we can use the same tunnel-maintenance code
 // regardless of the underlying implementation.
+//
+// MaintainTunnel reads from a single goroutine, but writes from several at once if ForwardWorkers
+// is above 1, so WritePacket must be safe for concurrent use and must not keep pkt after returning.
 type TunnelDevice interface {
 	// ReadPacket reads a packet from the device (using the given mtu) and returns its contents.
 	ReadPacket(buf []byte) (int, error)
@@ -69,8 +117,10 @@ type TunnelDevice interface {
 // NetstackAdapter wraps a tun.Device (e.g. from netstack) to satisfy TunnelDevice.
 type NetstackAdapter struct {
 	dev             tun.Device
+	offset          int
 	tunnelBufPool   sync.Pool
 	tunnelSizesPool sync.Pool
+	headroomPool    sync.Pool
 }
 
 func (n *NetstackAdapter) ReadPacket(buf []byte) (int, error) {
@@ -83,27 +133,72 @@ func (n *NetstackAdapter) ReadPacket(buf []byte) (int, error) {
 		n.tunnelSizesPool.Put(sizesPtr)
 	}()
 
-	(*packetBufsPtr)[0] = buf
+	readBuf := buf
+	if n.offset > 0 {
+		headroom := n.headroom(len(buf))
+		defer n.headroomPool.Put(headroom)
+		readBuf = *headroom
+	}
+
+	(*packetBufsPtr)[0] = readBuf
 	(*sizesPtr)[0] = 0
 
-	_, err := n.dev.Read(*packetBufsPtr, *sizesPtr, 0)
+	_, err := n.dev.Read(*packetBufsPtr, *sizesPtr, n.offset)
 	if err != nil {
 		return 0, err
 	}
 
+	if n.offset > 0 {
+		return copy(buf, readBuf[n.offset:n.offset+(*sizesPtr)[0]]), nil
+	}
+
 	return (*sizesPtr)[0], nil
 }
 
 func (n *NetstackAdapter) WritePacket(pkt []byte) error {
+	if n.offset > 0 {
+		headroom := n.headroom(len(pkt))
+		defer n.headroomPool.Put(headroom)
+		copy((*headroom)[n.offset:], pkt)
+		pkt = *headroom
+	}
+
 	// Write expects a slice of packet buffers.
-	_, err := n.dev.Write([][]byte{pkt}, 0)
+	_, err := n.dev.Write([][]byte{pkt}, n.offset)
 	return err
 }
 
-// NewNetstackAdapter creates a new NetstackAdapter.
-func NewNetstackAdapter(dev tun.Device) TunnelDevice {
+// headroom returns a pooled buffer of size bytes plus the space the device needs in front of packets.
+func (n *NetstackAdapter) headroom(size int) *[]byte {
+	bufPtr := n.headroomPool.Get().(*[]byte)
+	if cap(*bufPtr) < n.offset+size {
+		*bufPtr = make([]byte, n.offset+size)
+	}
+	*bufPtr = (*bufPtr)[:n.offset+size]
+	return bufPtr
+}
+
+// NewNetstackAdapter creates a new NetstackAdapter. The events of dev, such as a change of
+// its MTU, are passed to the MaintainTunnel of tunnel.
+func NewNetstackAdapter(tunnel *Tunnel, dev tun.Device) TunnelDevice {
+	return NewNetstackAdapterWithOffset(tunnel, dev, 0)
+}
+
+// NewNetstackAdapterWithOffset creates a new NetstackAdapter for a device that needs
+// room in front of each packet, such as the 4 byte protocol header of macOS utun devices.
+//
+// Parameters:
+//   - tunnel: *Tunnel - The tunnel the events of dev are passed to.
+//   - dev: tun.Device - The device to wrap.
+//   - offset: int - The number of bytes the device needs in front of each packet.
+//
+// Returns:
+//   - TunnelDevice: The adapter.
+func NewNetstackAdapterWithOffset(tunnel *Tunnel, dev tun.Device, offset int) TunnelDevice {
+	go tunnel.watchDeviceEvents(dev)
 	return &NetstackAdapter{
-		dev: dev,
+		dev:    dev,
+		offset: offset,
 		tunnelBufPool: sync.Pool{
 			New: func() interface{} {
 				buf := make([][]byte, 1)
@@ -116,6 +211,12 @@ func NewNetstackAdapter(dev tun.Device) TunnelDevice {
 				return &sizes
 			},
 		},
+		headroomPool: sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, 0)
+				return &buf
+			},
+		},
 	}
 }
 
@@ -147,34 +248,176 @@ func NewWaterAdapter(iface *water.Interface) TunnelDevice {
 // forwarding goroutines: one forwarding from the device to the IP connection (and handling
 // any ICMP reply), and the other forwarding from the IP connection to the device.
 // If an error occurs in either loop, the connection is closed and a reconnect is attempted.
+// After repeated failures to connect, the next endpoint in the list is tried.
+// If the server keeps rejecting the registration, Standby is used instead. If the server can't be
+// reached at all, the traffic goes over WireGuardFallback until MASQUE works again.
+// Tunnel.NotifyNetworkChange and Tunnel.RequestReconnect trigger an immediate reconnect,
+// Tunnel.ReplaceTLSConfig one with other credentials. It returns once ctx is cancelled.
 //
 // Parameters:
 //   - ctx: context.Context - The context for the connection.
+//   - tunnel: *Tunnel - The state of the tunnel, also passed to the devices wrapped around its TUN device.
 //   - tlsConfig: *tls.Config - The TLS configuration for secure communication.
 //   - keepalivePeriod: time.Duration - The keepalive period for the QUIC connection.
 //   - initialPacketSize: uint16 - The initial packet size for the QUIC connection.
-//   - endpoint: *net.UDPAddr - The UDP address of the MASQUE server.
+//   - endpoints: *EndpointList - The MASQUE server endpoints in order of priority.
 //   - device: TunnelDevice - The TUN device to forward packets to and from.
 //   - mtu: int - The MTU of the TUN device.
-//   - reconnectDelay: time.Duration - The delay between reconnect attempts.
-func MaintainTunnel(ctx context.Context, tlsConfig *tls.Config, keepalivePeriod time.Duration, initialPacketSize uint16, endpoint *net.UDPAddr, device TunnelDevice, mtu int, reconnectDelay time.Duration) {
+//   - reconnectDelay: time.Duration - The delay between reconnect attempts after transient failures, see reconnectBackoff.
+func MaintainTunnel(ctx context.Context, tunnel *Tunnel, tlsConfig *tls.Config, keepalivePeriod time.Duration, initialPacketSize uint16, endpoints *EndpointList, device TunnelDevice, mtu int, reconnectDelay time.Duration) {
 	packetBufferPool := NewNetBuffer(mtu)
-	for {
-		log.Printf("Establishing MASQUE connection to %s:%d", endpoint.IP, endpoint.Port)
-		udpConn, tr, ipConn, rsp, err := ConnectTunnel(
-			ctx,
-			tlsConfig,
-			internal.DefaultQuicConfig(keepalivePeriod, initialPacketSize),
-			internal.ConnectURI,
-			endpoint,
+	activeBuffers.Store(packetBufferPool, struct{}{})
+	defer func() { activeBuffers.Delete(packetBufferPool) }()
+	tunnelLog := logFor(componentTunnel)
+	defer tunnel.Status.stopped()
+	endpoints.use(tunnel)
+	rejections := 0
+	// rejections of any kind in a row, which back off longer and longer
+	rejectedInARow := 0
+	// attempts in a row that didn't reach the server, which end up on WireGuardFallback
+	unreachable := 0
+	probe := func(tlsConfig *tls.Config) bool {
+		probeCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		defer cancel()
+		attempt := connectTunnel(probeCtx, tunnel.Status, tlsConfig, internal.DefaultQuicConfig(keepalivePeriod, initialPacketSize), ConnectURI, endpoints.Current())
+		if attempt.ipConn != nil {
+			attempt.ipConn.Close()
+		}
+		if attempt.tr != nil {
+			attempt.tr.Close()
+		}
+		if attempt.udpConn != nil {
+			attempt.udpConn.Close()
+		}
+		return attempt.err == nil && attempt.rsp.StatusCode == http.StatusOK
+	}
+	for ctx.Err() == nil {
+		var (
+			udpConn  net.PacketConn
+			tr       *http3.Transport
+			hconn    *http3.ClientConn
+			quicConn *quic.Conn
+			ipConn   *connectip.Conn
+			rsp      *http.Response
+			err      error
 		)
+		if next := tunnel.nextTLSConfig.Swap(nil); next != nil {
+			tlsConfig = next
+			rejections = 0
+		}
+		if grown := int(tunnel.deviceMTU.Load()); grown > packetBufferPool.capacity {
+			// the buffers of the last connection can't hold the packets of the device anymore
+			activeBuffers.Delete(packetBufferPool)
+			packetBufferPool = NewNetBuffer(grown)
+			activeBuffers.Store(packetBufferPool, struct{}{})
+			mtu = grown
+		}
+		candidates := endpoints.Candidates()
+		if len(candidates) > 1 && !Features.use(FeatureRacing) {
+			candidates = candidates[:1]
+		}
+		applySocketFeatures()
+		tunnel.Status.connecting(attempted(candidates))
+		attemptStart := time.Now()
+		if len(candidates) > 1 {
+			tunnelLog.Info("Establishing MASQUE connection", "endpoint", candidates[0], "fallback", candidates[1])
+			var winner *tunnelAttempt
+			winner, err = raceTunnel(
+				ctx,
+				tunnel.Status,
+				tlsConfig,
+				internal.DefaultQuicConfig(keepalivePeriod, initialPacketSize),
+				ConnectURI,
+				candidates,
+				endpoints.HappyEyeballsDelay,
+			)
+			if err == nil {
+				udpConn, tr, hconn, quicConn, ipConn, rsp = winner.udpConn, winner.tr, winner.hconn, winner.quicConn, winner.ipConn, winner.rsp
+				tunnelLog.Info("Connected via endpoint", "endpoint", winner.endpoint)
+				endpoints.Prefer(winner.endpoint)
+			}
+		} else {
+			endpoint := candidates[0]
+			tunnelLog.Info("Establishing MASQUE connection", "endpoint", endpoint)
+			attempt := connectTunnel(
+				ctx,
+				tunnel.Status,
+				tlsConfig,
+				internal.DefaultQuicConfig(keepalivePeriod, initialPacketSize),
+				ConnectURI,
+				endpoint,
+			)
+			udpConn, tr, hconn, quicConn, ipConn, rsp, err = attempt.udpConn, attempt.tr, attempt.hconn, attempt.quicConn, attempt.ipConn, attempt.rsp, attempt.err
+		}
 		if err != nil {
-			log.Printf("Failed to connect tunnel: %v", err)
-			time.Sleep(reconnectDelay)
+			tunnelLog.Warn("Failed to connect tunnel", "error", err)
+			tunnel.Metrics.connectFailures.Add(1)
+			hookError(err)
+			failures, failover := reportEndpointFailure(endpoints)
+			reason := reconnectReason(err)
+			if reason == ReconnectOther {
+				reason = ReconnectConnectFailed
+			}
+			if registrationRejected(nil, err) {
+				reason = ReconnectRejected
+				rejections++
+			} else {
+				rejections = 0
+			}
+			if reason == ReconnectRejected {
+				rejectedInARow++
+			} else {
+				rejectedInARow = 0
+			}
+			delay := reconnectBackoff(reason, nil, reconnectDelay, rejectedInARow)
+			tunnel.recordReconnect(ReconnectDecision{
+				Endpoint: attempted(candidates),
+				Reason:   reason,
+				Failures: failures,
+				Failover: failover,
+				Delay:    delay,
+			}, err, endpoints)
+			if standbyConfig, switched := useStandby(tlsConfig, rejections); switched {
+				tlsConfig = standbyConfig
+				rejections = 0
+			}
+			if reason == ReconnectRejected {
+				unreachable = 0
+			} else {
+				unreachable++
+			}
+			if WireGuardFallback != nil && unreachable >= WireGuardFallbackThreshold {
+				unreachable = 0
+				current := tlsConfig
+				if err := tunnel.runWireGuardFallback(ctx, device, packetBufferPool, mtu, func() bool { return probe(current) }); err != nil {
+					logFor(componentWireGuard).Warn("WireGuard fallback failed", "error", err)
+					tunnel.sleepContext(ctx, delay)
+				}
+				continue
+			}
+			tunnel.sleepContext(ctx, delay)
 			continue
 		}
 		if rsp.StatusCode != 200 {
-			log.Printf("Tunnel connection failed: %s", rsp.Status)
+			tunnelLog.Warn("Tunnel connection failed", "status", rsp.Status)
+			tunnel.Metrics.connectFailures.Add(1)
+			hookError(fmt.Errorf("tunnel connection failed: %s", rsp.Status))
+			failures, failover := reportEndpointFailure(endpoints)
+			if registrationRejected(rsp, nil) || rsp.StatusCode == http.StatusTooManyRequests {
+				rejectedInARow++
+			} else {
+				// other statuses, e.g. a 502 of an overloaded node, are retried without growing the wait
+				rejectedInARow = 0
+			}
+			unreachable = 0
+			delay := reconnectBackoff(ReconnectRejected, rsp, reconnectDelay, rejectedInARow)
+			tunnel.recordReconnect(ReconnectDecision{
+				Endpoint: attempted(candidates),
+				Reason:   ReconnectRejected,
+				Failures: failures,
+				Failover: failover,
+				Delay:    delay,
+			}, errors.New(rsp.Status), endpoints)
 			ipConn.Close()
 			if udpConn != nil {
 				udpConn.Close()
@@ -182,75 +425,323 @@ func MaintainTunnel(ctx context.Context, tlsConfig *tls.Config, keepalivePeriod
 			if tr != nil {
 				tr.Close()
 			}
-			time.Sleep(reconnectDelay)
+			if registrationRejected(rsp, nil) {
+				rejections++
+			} else {
+				rejections = 0
+			}
+			if standbyConfig, switched := useStandby(tlsConfig, rejections); switched {
+				tlsConfig = standbyConfig
+				rejections = 0
+			}
+			tunnel.sleepContext(ctx, delay)
 			continue
 		}
 
-		log.Println("Connected to MASQUE server")
-		errChan := make(chan error, 2)
+		tunnelLog.Info("Connected to MASQUE server")
+		endpoints.ReportSuccess()
+		rejections, rejectedInARow, unreachable = 0, 0, 0
+		// requests before this connection was made don't concern it
+		select {
+		case <-tunnel.reconnectRequests:
+		default:
+		}
+		select {
+		case <-tunnel.refreshRequests:
+		default:
+		}
+		if tunnel.nextTLSConfig.Load() != nil {
+			// replaced while this connection was being made
+			tunnel.RequestReconnect()
+		}
+		tunnel.Metrics.connected(time.Since(attemptStart))
+		tunnel.quicConn.Store(quicConn)
+		connectedAt := time.Now()
+		connectedTo := endpoints.Current()
+		sentAtConnect, receivedAtConnect := tunnel.Metrics.tx.packets.Load(), tunnel.Metrics.rx.packets.Load()
+		tunnel.Status.connected(connectedTo.String(), "HTTP/3", ipConn)
+		hookConnect(connectedTo)
+		for {
+			// one error per forwarding goroutine, so none of them blocks on exit
+			errChan := make(chan error, 3)
+			done := make(chan struct{})
+			tunnel.forward(device, ipConn, packetBufferPool, errChan, done)
+
+			refresh := false
+			for err == nil && !refresh {
+				select {
+				case err = <-errChan:
+				case <-ctx.Done():
+					err = ctx.Err()
+				case err = <-tunnel.reconnectRequests:
+				case <-tunnel.refreshRequests:
+					refresh = true
+				case event := <-tunnel.deviceEvents:
+					err = tunnel.deviceEventError(event, packetBufferPool.capacity)
+				}
+			}
+			close(done)
+			if !refresh {
+				break
+			}
+
+			refreshed, refreshErr := refreshTunnel(ctx, tunnel.Status, hconn, ipConn, connectedTo)
+			if refreshErr != nil {
+				tunnelLog.Warn("Failed to refresh tunnel stream, reconnecting", "error", refreshErr)
+				err = fmt.Errorf("%w: %v", errRefreshFailed, refreshErr)
+				break
+			}
+			tunnelLog.Info("Tunnel stream refreshed")
+			ipConn = refreshed
+			tunnel.Status.connected(connectedTo.String(), "HTTP/3", ipConn)
+		}
+		// connect-ip only reports that its stream is gone, the QUIC connection knows why
+		if quicConn != nil && quicConn.Context().Err() != nil && errors.As(err, new(*connectip.CloseError)) {
+			err = fmt.Errorf("%w: %w", err, context.Cause(quicConn.Context()))
+		}
+		tunnel.quicConn.Store(nil)
+		tunnel.Metrics.disconnected()
+		tunnelLog.Warn("Tunnel connection lost, reconnecting", "error", err)
+		ipConn.Close()
+		if udpConn != nil {
+			udpConn.Close()
+		}
+		if tr != nil {
+			tr.Close()
+		}
+		delay := reconnectBackoff(reconnectReason(err), nil, reconnectDelay, 0)
+		if ctx.Err() != nil || errors.Is(err, errDeviceDown) || errors.Is(err, errDeviceMTUGrew) {
+			delay = 0
+		}
+		if ctx.Err() == nil {
+			tunnel.judgeEndpoint(connectedTo, reconnectReason(err), tunnel.Metrics.tx.packets.Load()-sentAtConnect, tunnel.Metrics.rx.packets.Load()-receivedAtConnect)
+		}
+		hookDisconnect(connectedTo, err)
+		tunnel.recordReconnect(ReconnectDecision{
+			Endpoint: connectedTo.String(),
+			Uptime:   time.Since(connectedAt),
+			Delay:    delay,
+		}, err, endpoints)
+		if errors.Is(err, errDeviceDown) {
+			tunnel.waitDeviceUp(ctx)
+		} else if delay > 0 {
+			tunnel.sleepContext(ctx, delay)
+		}
+	}
+}
 
+// forward starts the goroutines forwarding packets between device and ipConn. Each of them
+// sends at most one error to errChan when it stops; done tells them the connection is gone.
+func (t *Tunnel) forward(device TunnelDevice, ipConn *connectip.Conn, packetBufferPool *NetBuffer, errChan chan error, done chan struct{}) {
+	if useSendQueue() {
+		t.forwardWithWorkers(device, ipConn, packetBufferPool, errChan, done)
+	} else {
 		go func() {
 			for {
 				buf := packetBufferPool.Get()
 				n, err := device.ReadPacket(buf)
 				if err != nil {
 					packetBufferPool.Put(buf)
-					errChan <- fmt.Errorf("failed to read from TUN device: %v", err)
+					errChan <- fmt.Errorf("failed to read from %w: %w", errTunDevice, err)
 					return
 				}
-				icmp, err := ipConn.WritePacket(buf[:n])
+				icmp, err := t.writeTunnelPacket(ipConn, buf[:n])
 				if err != nil {
 					packetBufferPool.Put(buf)
+					t.Metrics.tx.errors.Add(1)
 					if errors.As(err, new(*connectip.CloseError)) {
-						errChan <- fmt.Errorf("connection closed while writing to IP connection: %v", err)
+						errChan <- fmt.Errorf("connection closed while writing to IP connection: %w", err)
 						return
 					}
-					log.Printf("Error writing to IP connection: %v, continuing...", err)
+					logFor(componentH3).Warn("Error writing to IP connection, continuing", "error", err)
 					continue
 				}
 				packetBufferPool.Put(buf)
-
-				if len(icmp) > 0 {
-					if err := device.WritePacket(icmp); err != nil {
-						if errors.As(err, new(*connectip.CloseError)) {
-							errChan <- fmt.Errorf("connection closed while writing ICMP to TUN device: %v", err)
-							return
-						}
-						log.Printf("Error writing ICMP to TUN device: %v, continuing...", err)
-					}
+				if len(icmp) == 0 {
+					t.Metrics.tx.add(n)
+					continue
 				}
-			}
-		}()
 
-		go func() {
-			buf := packetBufferPool.Get()
-			defer packetBufferPool.Put(buf)
-			for {
-				n, err := ipConn.ReadPacket(buf, true)
-				if err != nil {
+				// the packet wasn't sent and is answered instead, see writeTunnelPacket
+				if !t.allowICMPError(icmp) {
+					continue
+				}
+				if err := device.WritePacket(icmp); err != nil {
 					if errors.As(err, new(*connectip.CloseError)) {
-						errChan <- fmt.Errorf("connection closed while reading from IP connection: %v", err)
+						errChan <- fmt.Errorf("connection closed while writing ICMP to %w: %w", errTunDevice, err)
 						return
 					}
-					log.Printf("Error reading from IP connection: %v, continuing...", err)
-					continue
-				}
-				if err := device.WritePacket(buf[:n]); err != nil {
-					errChan <- fmt.Errorf("failed to write to TUN device: %v", err)
-					return
+					logFor(componentTun).Warn("Error writing ICMP to TUN device, continuing", "error", err)
 				}
 			}
 		}()
 
-		err = <-errChan
-		log.Printf("Tunnel connection lost: %v. Reconnecting...", err)
-		ipConn.Close()
-		if udpConn != nil {
-			udpConn.Close()
+		go t.receivePackets(device, ipConn, packetBufferPool, errChan)
+	}
+}
+
+// receivePackets writes the packets read from ipConn to device as they arrive, until either
+// of them fails. The error ending it is sent to errChan.
+func (t *Tunnel) receivePackets(device TunnelDevice, ipConn *connectip.Conn, packetBufferPool *NetBuffer, errChan chan<- error) {
+	buf := packetBufferPool.Get()
+	defer packetBufferPool.Put(buf)
+	for {
+		n, err := ipConn.ReadPacket(buf, true)
+		if err != nil {
+			if errors.As(err, new(*connectip.CloseError)) {
+				reportForwardError(errChan, fmt.Errorf("connection closed while reading from IP connection: %w", err))
+				return
+			}
+			logFor(componentH3).Warn("Error reading from IP connection, continuing", "error", err)
+			t.Metrics.rx.errors.Add(1)
+			continue
 		}
-		if tr != nil {
-			tr.Close()
+		t.Metrics.rx.add(n)
+		if err := device.WritePacket(buf[:n]); err != nil {
+			reportForwardError(errChan, fmt.Errorf("failed to write to %w: %w", errTunDevice, err))
+			return
+		}
+	}
+}
+
+// sleepContext waits for d, until ctx is cancelled or until a reconnect is requested, whichever comes first.
+func (t *Tunnel) sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-t.reconnectRequests:
+	}
+}
+
+// errNetworkChanged is the reason for reconnecting after NotifyNetworkChange.
+var errNetworkChanged = errors.New("network changed")
+
+// errReconnectRequested is the reason for reconnecting after RequestReconnect.
+var errReconnectRequested = errors.New("reconnect requested")
+
+// NotifyNetworkChange tells MaintainTunnel that the default route or addresses of the system
+// changed. The current connection is dropped and a new one is made right away, instead of
+// waiting for the old one to time out. Endpoints that failed on the old network are tried
+// again. It never blocks.
+func (t *Tunnel) NotifyNetworkChange() {
+	t.Failures.Reset()
+	select {
+	case t.reconnectRequests <- errNetworkChanged:
+	default:
+	}
+}
+
+// RequestReconnect makes MaintainTunnel drop the current connection and connect again
+// right away, e.g. after switching the endpoint. It never blocks.
+func (t *Tunnel) RequestReconnect() {
+	select {
+	case t.reconnectRequests <- errReconnectRequested:
+	default:
+	}
+}
+
+// ReplaceTLSConfig makes MaintainTunnel reconnect with another TLS config, e.g. after the
+// credentials in the config file changed. It never blocks.
+//
+// Parameters:
+//   - tlsConfig: *tls.Config - The TLS configuration for the next connections.
+func (t *Tunnel) ReplaceTLSConfig(tlsConfig *tls.Config) {
+	t.nextTLSConfig.Store(tlsConfig)
+	t.RequestReconnect()
+}
+
+// errRefreshFailed is the reason for reconnecting when RequestRefresh couldn't open a new stream.
+var errRefreshFailed = errors.New("refresh failed")
+
+// RequestRefresh makes MaintainTunnel close the Connect-IP request stream and send a new
+// Extended CONNECT on the same QUIC connection. It recovers from a stream that stopped
+// passing traffic faster than a full reconnect, as the QUIC and TLS handshakes are skipped.
+// If the server doesn't accept the new request, MaintainTunnel reconnects. It never blocks.
+func (t *Tunnel) RequestRefresh() {
+	select {
+	case t.refreshRequests <- struct{}{}:
+	default:
+	}
+}
+
+// refreshTunnel replaces the Connect-IP stream of a connection with a new one.
+//
+// Parameters:
+//   - ctx: context.Context - The context of the tunnel.
+//   - status: *TunnelStatus - Where the progress is recorded.
+//   - hconn: *http3.ClientConn - The HTTP/3 connection of the tunnel.
+//   - ipConn: *connectip.Conn - The current stream, closed first.
+//   - endpoint: *net.UDPAddr - The endpoint of the connection.
+//
+// Returns:
+//   - *connectip.Conn: The new stream.
+//   - error: An error if the connection is gone or the server refused the request.
+func refreshTunnel(ctx context.Context, status *TunnelStatus, hconn *http3.ClientConn, ipConn *connectip.Conn, endpoint *net.UDPAddr) (*connectip.Conn, error) {
+	ipConn.Close()
+	if err := context.Cause(hconn.Context()); err != nil {
+		return nil, err
+	}
+
+	refreshed, rsp, err := connectIP(ctx, status, hconn, ConnectURI, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		refreshed.Close()
+		return nil, fmt.Errorf("tunnel connection failed: %s", rsp.Status)
+	}
+	return refreshed, nil
+}
+
+// reportEndpointFailure records a failed connection attempt and logs the
+// failure counters if MaintainTunnel switches to another endpoint.
+// It returns the consecutive failures of the endpoint and whether it was switched.
+func reportEndpointFailure(endpoints *EndpointList) (int, bool) {
+	var failures int
+	for _, stat := range endpoints.Stats() {
+		if stat.Active {
+			failures = stat.ConsecutiveFailures + 1
 		}
-		time.Sleep(reconnectDelay)
+	}
+	if !endpoints.ReportFailure() {
+		return failures, false
+	}
+
+	var counters []any
+	for _, stat := range endpoints.Stats() {
+		counters = append(counters, slog.Uint64(stat.Endpoint.String(), stat.Failures))
+	}
+	logFor(componentTunnel).Warn("Switching endpoint after consecutive failures",
+		"endpoint", endpoints.Current(), "threshold", EndpointFailoverThreshold, slog.Group("failures", counters...))
+	return failures, true
+}
+
+// attempted describes the endpoints of a connection attempt.
+func attempted(candidates []*net.UDPAddr) string {
+	names := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		names[i] = candidate.String()
+	}
+	return strings.Join(names, " and ")
+}
+
+// recordReconnect completes a reconnect decision and adds it to Reconnects.
+// The reason is derived from err unless already set.
+func (t *Tunnel) recordReconnect(d ReconnectDecision, err error, endpoints *EndpointList) {
+	d.Time = time.Now()
+	if err != nil {
+		d.Error = err.Error()
+	}
+	if d.Reason == "" {
+		d.Reason = reconnectReason(err)
+	}
+	d.Next = endpoints.Current().String()
+	d.Features = enabledFeatures()
+	Reconnects.add(d)
+	if d.Reason != ReconnectShutdown {
+		t.Status.failed(d)
+		hookReconnect(d)
 	}
 }
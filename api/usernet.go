@@ -0,0 +1,286 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/Diniboy1123/usque/internal/packet"
+)
+
+// Ethernet and neighbor discovery constants used by UsernetDevice.
+const (
+	etherHeaderLen = 14
+	etherTypeIPv4  = 0x0800
+	etherTypeARP   = 0x0806
+	etherTypeIPv6  = 0x86dd
+
+	arpOpRequest = 1
+	arpOpReply   = 2
+
+	icmpv6NeighborSolicitation  = 135
+	icmpv6NeighborAdvertisement = 136
+
+	// usernetMaxFrame is the largest frame accepted from a client.
+	usernetMaxFrame = 65535 + etherHeaderLen
+)
+
+// UsernetGatewayMAC is the MAC address UsernetDevice answers neighbor lookups with.
+var UsernetGatewayMAC = net.HardwareAddr{0x02, 0x75, 0x73, 0x71, 0x75, 0x65}
+
+// UsernetDevice is a TunnelDevice that serves Ethernet frames over a stream socket
+// using the framing of QEMU's stream netdev and passt (a 4 byte big endian length followed
+// by the frame). This allows unprivileged virtual machines and sandboxes to use the tunnel
+// without a TUN device.
+//
+// The device acts as the gateway for the client: it answers ARP requests and IPv6 neighbor
+// solicitations for every address except the client's own, so the client can simply use an
+// on-link default route. Only one client is served at a time, a new connection replaces the old one.
+type UsernetDevice struct {
+	listener net.Listener
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	conn      net.Conn
+	clientMAC net.HardwareAddr
+	closed    bool
+
+	writeMu sync.Mutex
+	frame   []byte
+}
+
+// NewUsernetDevice creates a new UsernetDevice and starts accepting clients on listener.
+//
+// Parameters:
+//   - listener: net.Listener - The listener clients connect to, usually a UNIX socket.
+//
+// Returns:
+//   - *UsernetDevice: The device.
+func NewUsernetDevice(listener net.Listener) *UsernetDevice {
+	d := &UsernetDevice{
+		listener: listener,
+		frame:    make([]byte, usernetMaxFrame),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	go d.accept()
+	return d
+}
+
+// accept accepts clients until the listener is closed.
+func (d *UsernetDevice) accept() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			d.mu.Lock()
+			d.closed = true
+			d.cond.Broadcast()
+			d.mu.Unlock()
+			if !errors.Is(err, net.ErrClosed) {
+				logFor(componentTun).Error("Usernet listener stopped", "error", err)
+			}
+			return
+		}
+
+		logFor(componentTun).Info("Usernet client connected", "client", conn.RemoteAddr())
+
+		d.mu.Lock()
+		if d.conn != nil {
+			d.conn.Close()
+		}
+		d.conn = conn
+		d.clientMAC = nil
+		d.cond.Broadcast()
+		d.mu.Unlock()
+	}
+}
+
+// client blocks until a client is connected and returns its connection.
+func (d *UsernetDevice) client() (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for d.conn == nil && !d.closed {
+		d.cond.Wait()
+	}
+	if d.conn == nil {
+		return nil, net.ErrClosed
+	}
+	return d.conn, nil
+}
+
+// disconnect forgets conn if it is still the current client.
+func (d *UsernetDevice) disconnect(conn net.Conn, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn == conn {
+		logFor(componentTun).Info("Usernet client disconnected", "error", err)
+		d.conn.Close()
+		d.conn = nil
+		d.clientMAC = nil
+	}
+}
+
+// Close stops accepting clients and disconnects the current one.
+func (d *UsernetDevice) Close() error {
+	err := d.listener.Close()
+	d.mu.Lock()
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+	d.mu.Unlock()
+	return err
+}
+
+// ReadPacket returns the next IP packet sent by the client. Neighbor discovery is handled internally.
+// If no client is connected, it blocks until one connects.
+func (d *UsernetDevice) ReadPacket(buf []byte) (int, error) {
+	for {
+		conn, err := d.client()
+		if err != nil {
+			return 0, err
+		}
+
+		var length [4]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			d.disconnect(conn, err)
+			continue
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > usernetMaxFrame {
+			d.disconnect(conn, fmt.Errorf("frame too large: %d bytes", size))
+			continue
+		}
+		frame := d.frame[:size]
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			d.disconnect(conn, err)
+			continue
+		}
+		if len(frame) < etherHeaderLen {
+			continue
+		}
+
+		d.mu.Lock()
+		if d.conn == conn {
+			d.clientMAC = append(d.clientMAC[:0], frame[6:12]...)
+		}
+		d.mu.Unlock()
+
+		payload := frame[etherHeaderLen:]
+		switch binary.BigEndian.Uint16(frame[12:14]) {
+		case etherTypeARP:
+			d.handleARP(conn, payload)
+		case etherTypeIPv6:
+			if d.handleNeighborSolicitation(conn, payload) {
+				continue
+			}
+			return copy(buf, payload), nil
+		case etherTypeIPv4:
+			return copy(buf, payload), nil
+		}
+	}
+}
+
+// WritePacket sends an IP packet to the client. Packets are dropped while no client is connected.
+func (d *UsernetDevice) WritePacket(pkt []byte) error {
+	if len(pkt) == 0 {
+		return nil
+	}
+
+	d.mu.Lock()
+	conn, clientMAC := d.conn, d.clientMAC
+	d.mu.Unlock()
+	if conn == nil || clientMAC == nil {
+		return nil
+	}
+
+	etherType := uint16(etherTypeIPv4)
+	if packet.Version(pkt) == 6 {
+		etherType = etherTypeIPv6
+	}
+
+	d.writeFrame(conn, clientMAC, etherType, pkt)
+	return nil
+}
+
+// writeFrame sends a single Ethernet frame from the gateway to the client.
+// Write errors disconnect the client, they are not reported to the tunnel.
+func (d *UsernetDevice) writeFrame(conn net.Conn, dst net.HardwareAddr, etherType uint16, payload []byte) {
+	msg := make([]byte, 4+etherHeaderLen, 4+etherHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(msg[0:4], uint32(etherHeaderLen+len(payload)))
+	copy(msg[4:10], dst)
+	copy(msg[10:16], UsernetGatewayMAC)
+	binary.BigEndian.PutUint16(msg[16:18], etherType)
+	msg = append(msg, payload...)
+
+	d.writeMu.Lock()
+	_, err := conn.Write(msg)
+	d.writeMu.Unlock()
+	if err != nil {
+		d.disconnect(conn, err)
+	}
+}
+
+// handleARP answers IPv4 ARP requests for any address except the sender's own.
+func (d *UsernetDevice) handleARP(conn net.Conn, arp []byte) {
+	if len(arp) < 28 || binary.BigEndian.Uint16(arp[6:8]) != arpOpRequest {
+		return
+	}
+	senderMAC, senderIP, targetIP := arp[8:14], arp[14:18], arp[24:28]
+	// skip probes and announcements of the client's own address
+	if netip.AddrFrom4([4]byte(senderIP)).IsUnspecified() || string(senderIP) == string(targetIP) {
+		return
+	}
+
+	reply := make([]byte, 28)
+	copy(reply[0:6], arp[0:6]) // hardware type, protocol type, sizes
+	binary.BigEndian.PutUint16(reply[6:8], arpOpReply)
+	copy(reply[8:14], UsernetGatewayMAC)
+	copy(reply[14:18], targetIP)
+	copy(reply[18:24], senderMAC)
+	copy(reply[24:28], senderIP)
+
+	d.writeFrame(conn, net.HardwareAddr(senderMAC), etherTypeARP, reply)
+}
+
+// handleNeighborSolicitation answers IPv6 neighbor solicitations for any address except
+// the sender's own.
+//
+// Returns:
+//   - bool: Whether pkt was a neighbor solicitation and shouldn't be forwarded.
+func (d *UsernetDevice) handleNeighborSolicitation(conn net.Conn, pkt []byte) bool {
+	// only solicitations without extension headers, as sent by every common stack
+	ip, ok := packet.Parse(pkt)
+	if !ok || !ip.IPv6() || ip.Protocol() != packet.ProtoICMPv6 {
+		return false
+	}
+	icmp, ok := packet.ParseICMP(ip.Payload())
+	if !ok || len(icmp) < 24 || icmp.Type() != icmpv6NeighborSolicitation {
+		return false
+	}
+
+	src := ip.Src()
+	target := netip.AddrFrom16([16]byte(icmp.Body()[:16]))
+	// duplicate address detection or a lookup of the client's own address
+	if src.IsUnspecified() || src == target {
+		return true
+	}
+
+	advertisement := make([]byte, 24)
+	copy(advertisement[0:16], target.AsSlice())
+	advertisement[16] = 2 // target link-layer address option
+	advertisement[17] = 1 // length in units of 8 bytes
+	copy(advertisement[18:24], UsernetGatewayMAC)
+	// router, solicited, override, with the hop limit required by RFC 4861
+	reply := packet.NewICMP(icmpv6NeighborAdvertisement, 0, 0xe0<<24, advertisement, 255, 0, target, src)
+
+	d.mu.Lock()
+	clientMAC := append(net.HardwareAddr(nil), d.clientMAC...)
+	d.mu.Unlock()
+
+	d.writeFrame(conn, clientMAC, etherTypeIPv6, reply)
+	return true
+}
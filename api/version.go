@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/models"
+)
+
+// ClientVersionManifest describes the latest official client version known to work.
+type ClientVersionManifest struct {
+	ClientVersion string `json:"client_version"` // Official client version (e.g., "a-6.35-4471")
+}
+
+// FetchClientVersionManifest downloads the client version manifest from the given URL.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the request.
+//   - url: string - The manifest URL.
+//
+// Returns:
+//   - ClientVersionManifest: The parsed manifest.
+//   - error: An error if the manifest cannot be fetched or parsed.
+func FetchClientVersionManifest(ctx context.Context, url string) (ClientVersionManifest, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return ClientVersionManifest{}, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := ControlPlaneClient.Do(req)
+	if err != nil {
+		return ClientVersionManifest{}, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ClientVersionManifest{}, fmt.Errorf("failed to fetch manifest: %v", resp.Status)
+	}
+
+	var manifest ClientVersionManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return ClientVersionManifest{}, fmt.Errorf("failed to decode manifest: %v", err)
+	}
+
+	return manifest, nil
+}
+
+// fallbackClientVersion is the manifest version sendAPIRequest switches to when the server
+// rejects the client version in use, empty if there is none.
+var fallbackClientVersion struct {
+	sync.Mutex
+	version string
+}
+
+// CheckClientVersion compares the built-in client version with the one in the manifest
+// and logs both. If they differ and override is set, the manifest version is kept as a
+// fallback, which API requests only switch to once the server rejects the built-in one.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the request.
+//   - url: string - The manifest URL.
+//   - override: bool - Whether to fall back to the manifest version on a rejection.
+//
+// Returns:
+//   - error: An error if the manifest cannot be fetched or holds an invalid version.
+func CheckClientVersion(ctx context.Context, url string, override bool) error {
+	manifest, err := FetchClientVersionManifest(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	logFor(componentTunnel).Info("Checked client version", "builtin", internal.BuiltinClientVersion, "latest", manifest.ClientVersion)
+
+	if manifest.ClientVersion == "" || manifest.ClientVersion == internal.BuiltinClientVersion {
+		return nil
+	}
+	if err := internal.ValidateClientVersion(manifest.ClientVersion); err != nil {
+		return fmt.Errorf("manifest has invalid client version %q: %v", manifest.ClientVersion, err)
+	}
+
+	if !override {
+		logFor(componentTunnel).Info("Built-in client version differs from the manifest, it is kept as set")
+		return nil
+	}
+
+	fallbackClientVersion.Lock()
+	fallbackClientVersion.version = manifest.ClientVersion
+	fallbackClientVersion.Unlock()
+	logFor(componentTunnel).Info("Keeping the built-in client version, the manifest version is used if the server rejects it", "fallback", manifest.ClientVersion)
+
+	return nil
+}
+
+// clientVersionRejected reports whether an API response rejects the client version: a 426
+// Upgrade Required, or an error status whose API errors are about the version.
+func clientVersionRejected(resp *http.Response, body []byte) bool {
+	if resp.StatusCode == http.StatusUpgradeRequired {
+		return true
+	}
+	if resp.StatusCode < 400 || resp.StatusCode >= 500 {
+		return false
+	}
+	var apiErr models.APIError
+	if err := json.Unmarshal(body, &apiErr); err != nil {
+		return false
+	}
+	for _, info := range apiErr.Errors {
+		message := strings.ToLower(info.Message)
+		if strings.Contains(message, "version") && (strings.Contains(message, "client") || strings.Contains(message, "unsupported") || strings.Contains(message, "outdated")) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendAPIRequest sends a request to the Cloudflare API. If the server rejects the client
+// version and CheckClientVersion left a fallback, it switches to that version for good and
+// sends the request again, built anew for the new API path.
+//
+// Parameters:
+//   - build: func() (*http.Request, error) - Builds the request for the current internal.ApiVersion,
+//     the headers of internal.Headers are added to it.
+//
+// Returns:
+//   - *http.Response: The response, with the body readable.
+//   - error: An error if the request couldn't be built or sent.
+func sendAPIRequest(build func() (*http.Request, error)) (*http.Response, error) {
+	for retried := false; ; retried = true {
+		req, err := build()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+		for k, v := range internal.Headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := ControlPlaneClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send request: %v", err)
+		}
+		if resp.StatusCode < 400 || retried {
+			return resp, nil
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body: %v", err)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if !clientVersionRejected(resp, body) {
+			return resp, nil
+		}
+
+		fallbackClientVersion.Lock()
+		fallback := fallbackClientVersion.version
+		fallbackClientVersion.version = ""
+		fallbackClientVersion.Unlock()
+		current := internal.Headers["CF-Client-Version"]
+		if fallback == "" || fallback == current {
+			logFor(componentTunnel).Warn("Server rejected the client version, try --check-client-version or --client-version", "version", current)
+			return resp, nil
+		}
+		if err := internal.SetClientVersion(fallback); err != nil {
+			return resp, nil
+		}
+		logFor(componentTunnel).Warn("Server rejected the client version, retrying with the manifest version", "rejected", current, "version", fallback)
+	}
+}
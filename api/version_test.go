@@ -0,0 +1,87 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+func TestCheckClientVersionFallback(t *testing.T) {
+	const latest = "a-6.36-4500"
+
+	tests := []struct {
+		name        string
+		override    bool
+		status      int
+		body        string
+		wantStatus  int
+		wantVersion string
+	}{
+		{"accepted", true, http.StatusOK, `{}`, http.StatusOK, internal.BuiltinClientVersion},
+		{"upgrade required", true, http.StatusUpgradeRequired, `{}`, http.StatusOK, latest},
+		{"version error", true, http.StatusBadRequest, `{"success":false,"errors":[{"code":1000,"message":"Unsupported client version"}]}`, http.StatusOK, latest},
+		{"other error", true, http.StatusBadRequest, `{"success":false,"errors":[{"code":1001,"message":"Invalid public key"}]}`, http.StatusBadRequest, internal.BuiltinClientVersion},
+		{"no override", false, http.StatusUpgradeRequired, `{}`, http.StatusUpgradeRequired, internal.BuiltinClientVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := ControlPlaneClient
+			apiVersion, headerVersion := internal.ApiVersion, internal.Headers["CF-Client-Version"]
+			defer func() {
+				ControlPlaneClient = client
+				internal.ApiVersion, internal.Headers["CF-Client-Version"] = apiVersion, headerVersion
+				fallbackClientVersion.version = ""
+			}()
+
+			var versions, paths []string
+			ControlPlaneClient = &http.Client{Transport: roundTripper(func(req *http.Request) (*http.Response, error) {
+				status, body := http.StatusOK, `{"client_version":"`+latest+`"}`
+				if req.URL.Path != "/manifest.json" {
+					versions = append(versions, req.Header.Get("CF-Client-Version"))
+					paths = append(paths, req.URL.Path)
+					status, body = http.StatusOK, `{}`
+					if req.Header.Get("CF-Client-Version") == internal.BuiltinClientVersion {
+						status, body = tt.status, tt.body
+					}
+				}
+				return &http.Response{
+					StatusCode: status,
+					Status:     http.StatusText(status),
+					Body:       io.NopCloser(strings.NewReader(body)),
+					Request:    req,
+				}, nil
+			})}
+
+			if err := CheckClientVersion(t.Context(), "https://example.com/manifest.json", tt.override); err != nil {
+				t.Fatalf("CheckClientVersion() error = %v", err)
+			}
+			if got := internal.Headers["CF-Client-Version"]; got != internal.BuiltinClientVersion {
+				t.Fatalf("client version before any request = %q, want the built-in one", got)
+			}
+
+			resp, err := sendAPIRequest(func() (*http.Request, error) {
+				return http.NewRequest("POST", internal.ApiUrl+"/"+internal.ApiVersion+"/reg", strings.NewReader(`{}`))
+			})
+			if err != nil {
+				t.Fatalf("sendAPIRequest() error = %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := versions[len(versions)-1]; got != tt.wantVersion {
+				t.Errorf("last request sent version %q, want %q", got, tt.wantVersion)
+			}
+			if got := internal.Headers["CF-Client-Version"]; got != tt.wantVersion {
+				t.Errorf("client version after the request = %q, want %q", got, tt.wantVersion)
+			}
+			if tt.wantVersion == latest && (len(paths) != 2 || !strings.Contains(paths[1], "/v0a4500/")) {
+				t.Errorf("retried paths = %v, want a second request to /v0a4500/", paths)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// WireGuardFallbackConfig is a WireGuard device MaintainTunnel carries the traffic over while
+// MASQUE can't connect, e.g. on networks that block QUIC. Its addresses are translated to the
+// ones of the TunnelDevice, so the device keeps its addresses. Connections don't survive a
+// switch in either direction, as the server doesn't share their state between the two paths.
+type WireGuardFallbackConfig struct {
+	PrivateKey    []byte        // Curve25519 private key of the WireGuard device
+	PeerPublicKey []byte        // Curve25519 public key of the peer
+	Endpoint      *net.UDPAddr  // Endpoint of the peer
+	Addresses     []netip.Addr  // Tunnel addresses of the WireGuard device
+	DeviceAddrs   []netip.Addr  // Addresses the TunnelDevice uses, translated to Addresses
+	ID            string        // Device ID of the WireGuard registration, for logs
+	Keepalive     time.Duration // Persistent keepalive, 0 for none
+	translations  map[netip.Addr]netip.Addr
+	reverse       map[netip.Addr]netip.Addr
+	translateOnce sync.Once
+}
+
+// WireGuardFallback is the WireGuard fallback of all tunnels in this process, nil if there is none.
+// Set it before starting MaintainTunnel.
+var WireGuardFallback *WireGuardFallbackConfig
+
+// WireGuardFallbackThreshold is the number of failed MASQUE connection attempts in a row after
+// which MaintainTunnel switches to WireGuardFallback.
+var WireGuardFallbackThreshold = 3
+
+// WireGuardHandshakeTimeout is how long the fallback may go without a completed handshake before
+// MaintainTunnel leaves it again, e.g. when the network is down for both protocols.
+var WireGuardHandshakeTimeout = 20 * time.Second
+
+// WireGuardProbeInterval is how often MASQUE is tried again while the fallback carries the traffic.
+var WireGuardProbeInterval = time.Minute
+
+// componentWireGuard is the component of the fallback's log messages.
+const componentWireGuard = "wireguard"
+
+// translate rewrites the source address of a packet from the device to the one of the WireGuard
+// device, or the destination address of a packet from WireGuard back, if they differ.
+func (c *WireGuardFallbackConfig) translate(pkt []byte, out bool) {
+	c.translateOnce.Do(func() {
+		c.translations, c.reverse = map[netip.Addr]netip.Addr{}, map[netip.Addr]netip.Addr{}
+		for _, from := range c.DeviceAddrs {
+			for _, to := range c.Addresses {
+				if from.Is4() == to.Is4() && from != to {
+					c.translations[from], c.reverse[to] = to, from
+				}
+			}
+		}
+	})
+	if len(c.translations) == 0 {
+		return
+	}
+
+	p, ok := parseNatPacket(pkt)
+	if !ok {
+		return
+	}
+	if out {
+		if to, ok := c.translations[p.addr(pkt, p.src)]; ok {
+			p.ip.SetSrc(to)
+		}
+	} else if to, ok := c.reverse[p.addr(pkt, p.dst)]; ok {
+		p.ip.SetDst(to)
+	}
+}
+
+// uapi returns the configuration of the WireGuard device in the UAPI format of wireguard-go.
+func (c *WireGuardFallbackConfig) uapi() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "private_key=%s\n", hex.EncodeToString(c.PrivateKey))
+	if SocketMark != 0 {
+		fmt.Fprintf(&b, "fwmark=%d\n", SocketMark)
+	}
+	fmt.Fprintf(&b, "replace_peers=true\n")
+	fmt.Fprintf(&b, "public_key=%s\n", hex.EncodeToString(c.PeerPublicKey))
+	fmt.Fprintf(&b, "endpoint=%s\n", c.Endpoint)
+	fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", int(c.Keepalive/time.Second))
+	fmt.Fprintf(&b, "allowed_ip=0.0.0.0/0\n")
+	fmt.Fprintf(&b, "allowed_ip=::/0\n")
+	return b.String()
+}
+
+// runWireGuardFallback carries the traffic of device over WireGuardFallback until probe finds
+// MASQUE working again, a reconnect is requested, e.g. after a network change, or ctx is done.
+//
+// Parameters:
+//   - ctx: context.Context - The context of MaintainTunnel.
+//   - device: TunnelDevice - The device of the tunnel.
+//   - pool: *NetBuffer - The packet buffers of the tunnel.
+//   - mtu: int - The MTU of the device.
+//   - probe: func() bool - Tries to connect MASQUE, true if it works again.
+//
+// Returns:
+//   - error: An error if the fallback couldn't be started or stopped by itself, nil if it was left
+//     for MASQUE.
+func (t *Tunnel) runWireGuardFallback(ctx context.Context, device TunnelDevice, pool *NetBuffer, mtu int, probe func() bool) error {
+	fallback := WireGuardFallback
+	tunnelLog := logFor(componentWireGuard)
+	if BindInterface != "" || BindAddress.IsValid() || SocketDSCP != 0 {
+		tunnelLog.Warn("The WireGuard fallback doesn't bind to an interface or address and doesn't set DSCP")
+	}
+
+	wgTun := newWireGuardTun(device, pool, mtu, fallback, t.Metrics)
+	bind := conn.NewDefaultBind()
+	wgDevice := newWireGuardDevice(wgTun, bind)
+	defer wgDevice.Close()
+	if err := wgDevice.IpcSet(fallback.uapi()); err != nil {
+		return fmt.Errorf("failed to configure WireGuard: %v", err)
+	}
+	if err := wgDevice.Up(); err != nil {
+		return fmt.Errorf("failed to start WireGuard: %v", err)
+	}
+	if err := protectBind(bind); err != nil {
+		return err
+	}
+
+	tunnelLog.Warn("MASQUE keeps failing, carrying traffic over WireGuard", "endpoint", fallback.Endpoint, "device", fallback.ID)
+	t.Status.connected(fallback.Endpoint.String(), "WireGuard", nil)
+	t.Metrics.connected(0)
+	defer t.Metrics.disconnected()
+	hookConnect(fallback.Endpoint)
+
+	ticker := time.NewTicker(WireGuardProbeInterval)
+	defer ticker.Stop()
+	handshake := time.NewTimer(WireGuardHandshakeTimeout)
+	defer handshake.Stop()
+	var err error
+	for err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-wgDevice.Wait():
+			err = errors.New("WireGuard fallback stopped")
+		case err = <-t.reconnectRequests:
+			tunnelLog.Info("Trying MASQUE again", "reason", err)
+		case <-handshake.C:
+			if !handshakeCompleted(wgDevice) {
+				err = fmt.Errorf("no WireGuard handshake within %s", WireGuardHandshakeTimeout)
+			}
+		case <-ticker.C:
+			if probe() {
+				tunnelLog.Info("MASQUE works again, leaving the WireGuard fallback")
+				err = errMasqueRecovered
+			}
+		}
+	}
+	hookDisconnect(fallback.Endpoint, err)
+	if err == errMasqueRecovered || errors.Is(err, errNetworkChanged) || errors.Is(err, errReconnectRequested) || ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// handshakeCompleted reports whether wgDevice completed a handshake with its peer.
+func handshakeCompleted(wgDevice *device.Device) bool {
+	state, err := wgDevice.IpcGet()
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(state, "\n") {
+		if value, ok := strings.CutPrefix(line, "last_handshake_time_sec="); ok && value != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// errMasqueRecovered is the reason for leaving the WireGuard fallback once MASQUE connects again.
+var errMasqueRecovered = errors.New("MASQUE works again")
+
+// newWireGuardDevice creates a wireguard-go device logging through the api logger.
+func newWireGuardDevice(wgTun tun.Device, bind conn.Bind) *device.Device {
+	logger := &device.Logger{
+		Verbosef: func(format string, args ...any) {
+			logFor(componentWireGuard).Debug(fmt.Sprintf(format, args...))
+		},
+		Errorf: func(format string, args ...any) {
+			logFor(componentWireGuard).Warn(fmt.Sprintf(format, args...))
+		},
+	}
+	return device.NewDevice(wgTun, bind, logger)
+}
+
+// protectBind hands the sockets of bind to SocketProtector, where the platform lets them be
+// reached, so the fallback's own traffic stays out of a VPN app's tunnel too.
+func protectBind(bind conn.Bind) error {
+	peek, ok := bind.(conn.PeekLookAtSocketFd)
+	if SocketProtector == nil {
+		return nil
+	}
+	if !ok {
+		return errors.New("the WireGuard fallback can't protect its sockets on this platform")
+	}
+	for _, socket := range []func() (int, error){peek.PeekLookAtSocketFd4, peek.PeekLookAtSocketFd6} {
+		fd, err := socket()
+		if err != nil {
+			// e.g. no IPv6 on the host
+			continue
+		}
+		if err := SocketProtector(uintptr(fd)); err != nil {
+			return fmt.Errorf("failed to protect WireGuard socket: %v", err)
+		}
+	}
+	return nil
+}
+
+// wireGuardPacket is a packet read from the TunnelDevice for WireGuard, or the error reading it.
+type wireGuardPacket struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// wireGuardTun presents a TunnelDevice as the tun.Device of a wireguard-go device. A goroutine
+// reads the TunnelDevice, so closing doesn't have to wait for the next packet.
+type wireGuardTun struct {
+	dev       TunnelDevice
+	pool      *NetBuffer
+	mtu       int
+	fallback  *WireGuardFallbackConfig
+	metrics   *TunnelMetrics
+	packets   chan wireGuardPacket
+	events    chan tun.Event
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newWireGuardTun starts reading dev for WireGuard.
+func newWireGuardTun(dev TunnelDevice, pool *NetBuffer, mtu int, fallback *WireGuardFallbackConfig, metrics *TunnelMetrics) *wireGuardTun {
+	t := &wireGuardTun{
+		dev:      dev,
+		pool:     pool,
+		mtu:      mtu,
+		fallback: fallback,
+		metrics:  metrics,
+		packets:  make(chan wireGuardPacket),
+		events:   make(chan tun.Event, 1),
+		closed:   make(chan struct{}),
+	}
+	t.events <- tun.EventUp
+	go func() {
+		for {
+			buf := pool.Get()
+			n, err := dev.ReadPacket(buf)
+			select {
+			case t.packets <- wireGuardPacket{buf: buf, n: n, err: err}:
+			case <-t.closed:
+				// the packet is lost, as when a MASQUE connection drops
+				pool.Put(buf)
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return t
+}
+
+func (t *wireGuardTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	select {
+	case packet := <-t.packets:
+		defer t.pool.Put(packet.buf)
+		if packet.err != nil {
+			return 0, fmt.Errorf("failed to read from %w: %w", errTunDevice, packet.err)
+		}
+		n := copy(bufs[0][offset:], packet.buf[:packet.n])
+		t.fallback.translate(bufs[0][offset:offset+n], true)
+		sizes[0] = n
+		t.metrics.tx.add(n)
+		return 1, nil
+	case <-t.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (t *wireGuardTun) Write(bufs [][]byte, offset int) (int, error) {
+	for i, buf := range bufs {
+		pkt := buf[offset:]
+		t.fallback.translate(pkt, false)
+		if err := t.dev.WritePacket(pkt); err != nil {
+			return i, fmt.Errorf("failed to write to %w: %w", errTunDevice, err)
+		}
+		t.metrics.rx.add(len(pkt))
+	}
+	return len(bufs), nil
+}
+
+func (t *wireGuardTun) File() *os.File           { return nil }
+func (t *wireGuardTun) MTU() (int, error)        { return t.mtu, nil }
+func (t *wireGuardTun) Name() (string, error)    { return "usque-wireguard", nil }
+func (t *wireGuardTun) Events() <-chan tun.Event { return t.events }
+func (t *wireGuardTun) BatchSize() int           { return 1 }
+
+// Close stops handing packets to WireGuard. The TunnelDevice stays open for MASQUE.
+func (t *wireGuardTun) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		close(t.events)
+	})
+	return nil
+}
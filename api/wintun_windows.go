@@ -0,0 +1,132 @@
+//go:build windows
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wintun"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// WintunAdapter is a TunnelDevice backed directly by a Wintun session.
+// Unlike tun.CreateTUN, it allows choosing the ring capacity of the session.
+type WintunAdapter struct {
+	adapter    *wintun.Adapter
+	session    wintun.Session
+	readWait   windows.Handle
+	closeEvent windows.Handle // set by Close, wakes up a ReadPacket waiting for packets
+
+	// mu is held for reading while the session is in use and for writing by Close,
+	// so the session isn't ended under a running ReadPacket or WritePacket
+	mu        sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+}
+
+// NewWintunAdapter creates a Wintun interface (or reuses an existing one with the same name)
+// and starts a session with the given ring capacity.
+//
+// Parameters:
+//   - name: string - The name of the interface.
+//   - guid: *windows.GUID - The requested GUID of the interface, nil for a random one.
+//   - ringCapacity: uint32 - The ring capacity in bytes, a power of two between wintun.RingCapacityMin and wintun.RingCapacityMax.
+//
+// Returns:
+//   - *WintunAdapter: The adapter.
+//   - error: An error if the interface or the session couldn't be created.
+func NewWintunAdapter(name string, guid *windows.GUID, ringCapacity uint32) (*WintunAdapter, error) {
+	adapter, err := wintun.CreateAdapter(name, tun.WintunTunnelType, guid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create interface: %v", err)
+	}
+
+	closeEvent, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		adapter.Close()
+		return nil, fmt.Errorf("failed to create close event: %v", err)
+	}
+
+	session, err := adapter.StartSession(ringCapacity)
+	if err != nil {
+		windows.CloseHandle(closeEvent)
+		adapter.Close()
+		return nil, fmt.Errorf("failed to start session: %v", err)
+	}
+
+	return &WintunAdapter{
+		adapter:    adapter,
+		session:    session,
+		readWait:   session.ReadWaitEvent(),
+		closeEvent: closeEvent,
+	}, nil
+}
+
+func (w *WintunAdapter) ReadPacket(buf []byte) (int, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	for {
+		if w.closed {
+			return 0, os.ErrClosed
+		}
+		packet, err := w.session.ReceivePacket()
+		switch {
+		case err == nil:
+			n := copy(buf, packet)
+			w.session.ReleaseReceivePacket(packet)
+			return n, nil
+		case errors.Is(err, windows.ERROR_NO_MORE_ITEMS):
+			event, err := windows.WaitForMultipleObjects([]windows.Handle{w.readWait, w.closeEvent}, false, windows.INFINITE)
+			if err != nil {
+				return 0, err
+			}
+			if event == windows.WAIT_OBJECT_0+1 {
+				return 0, os.ErrClosed
+			}
+		default:
+			return 0, err
+		}
+	}
+}
+
+func (w *WintunAdapter) WritePacket(pkt []byte) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+
+	packet, err := w.session.AllocateSendPacket(len(pkt))
+	if err != nil {
+		// the ring is full, drop the packet like a full queue would
+		if errors.Is(err, windows.ERROR_BUFFER_OVERFLOW) {
+			return nil
+		}
+		return err
+	}
+	copy(packet, pkt)
+	w.session.SendPacket(packet)
+	return nil
+}
+
+// Close ends the session and removes the interface. A blocked ReadPacket returns os.ErrClosed.
+func (w *WintunAdapter) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		// wake up ReadPacket first, it holds mu while waiting
+		windows.SetEvent(w.closeEvent)
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.closed = true
+		w.session.End()
+		windows.CloseHandle(w.closeEvent)
+		err = w.adapter.Close()
+	})
+	return err
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"hash/maphash"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/Diniboy1123/usque/internal/packet"
+)
+
+// ForwardWorkers is the number of goroutines writing packets per direction in MaintainTunnel.
+// With more than 1, packets are spread over the workers by flow, so a slow write only stalls
+// the flows of one worker and writes use several cores. Packets of a flow always take
+// the same worker and keep their order.
+var ForwardWorkers = 1
+
+// ForwardQueueLen is the number of packets each forwarding worker queues up.
+// Packets for a full queue are dropped, like a router drops packets for a congested link.
+const ForwardQueueLen = 256
+
+// SendQueueLen is the number of packets queued for sending on the connection, split over the
+// ForwardWorkers. With 0, packets read from the device are sent right away, so a stalled send
+// holds up reading the device and every packet queues up behind it in the device. With a queue,
+// the device is always read and packets arriving while the queue is full are dropped and
+// counted in the metrics of the tunnel, keeping the latency low for every other flow. Only the sending direction
+// is queued, received packets are still written to the device as they arrive unless
+// ForwardWorkers is above 1.
+var SendQueueLen = 0
+
+// useSendQueue reports whether MaintainTunnel forwards packets through queues.
+func useSendQueue() bool {
+	return ForwardWorkers > 1 || SendQueueLen > 0
+}
+
+// flowSeed keys the flow hash spreading packets over forwarding workers.
+var flowSeed = maphash.MakeSeed()
+
+// flowQueues spreads packets over a fixed set of bounded queues by flow.
+type flowQueues []chan []byte
+
+// newFlowQueues creates count queues of length packets each.
+func newFlowQueues(count, length int) flowQueues {
+	queues := make(flowQueues, count)
+	for i := range queues {
+		queues[i] = make(chan []byte, length)
+	}
+	return queues
+}
+
+// push queues the packet on the queue of its flow. Packets that aren't IP go to the first queue.
+// It returns false without queueing the packet if that queue is full.
+func (q flowQueues) push(pkt []byte) bool {
+	queue := q[0]
+	if key, ok := queueKey(pkt); ok {
+		queue = q[maphash.Comparable(flowSeed, key)%uint64(len(q))]
+	}
+	select {
+	case queue <- pkt:
+		return true
+	default:
+		return false
+	}
+}
+
+// queueKey returns the key a packet is spread over the queues by. Only the first fragment of a
+// packet carries the ports, so fragments are keyed by addresses and protocol alone, which keeps
+// all fragments of a packet on one queue and in order.
+func queueKey(pkt []byte) (FlowKey, bool) {
+	key, ok := parseFlowKey(pkt)
+	if !ok {
+		return key, false
+	}
+	if ip, _ := packet.Parse(pkt); ip.Fragment() || ip.FragmentHeader() {
+		key.SrcPort, key.DstPort = 0, 0
+	}
+	return key, true
+}
+
+// close closes all queues, which stops their workers once they are drained.
+func (q flowQueues) close() {
+	for _, queue := range q {
+		close(queue)
+	}
+}
+
+// reportForwardError reports the error ending the connection, unless another one already did.
+func reportForwardError(errChan chan<- error, err error) {
+	select {
+	case errChan <- err:
+	default:
+	}
+}
+
+// forwardWithWorkers forwards packets in both directions with ForwardWorkers writers per
+// direction, queueing up to SendQueueLen packets for sending if set. A single reader per
+// direction keeps the packets of each flow in order. With a single worker, only the sending
+// direction is queued. All goroutines stop once done is closed or the connection fails, which
+// is reported on errChan.
+func (t *Tunnel) forwardWithWorkers(device TunnelDevice, ipConn *connectip.Conn, packetBufferPool *NetBuffer, errChan chan<- error, done <-chan struct{}) {
+	upLen := ForwardQueueLen
+	if SendQueueLen > 0 {
+		upLen = max(SendQueueLen/ForwardWorkers, 1)
+	}
+	up := newFlowQueues(ForwardWorkers, upLen)
+
+	for i := range ForwardWorkers {
+		go func() {
+			for pkt := range up[i] {
+				icmp, err := t.writeTunnelPacket(ipConn, pkt)
+				packetBufferPool.Put(pkt[:cap(pkt)])
+				if err != nil {
+					t.Metrics.tx.errors.Add(1)
+					if errors.As(err, new(*connectip.CloseError)) {
+						reportForwardError(errChan, fmt.Errorf("connection closed while writing to IP connection: %w", err))
+						continue
+					}
+					logFor(componentH3).Warn("Error writing to IP connection, continuing", "error", err)
+					continue
+				}
+				if len(icmp) == 0 {
+					t.Metrics.tx.add(len(pkt))
+					continue
+				}
+
+				// the packet wasn't sent and is answered instead, see writeTunnelPacket
+				if !t.allowICMPError(icmp) {
+					continue
+				}
+				if err := device.WritePacket(icmp); err != nil {
+					logFor(componentTun).Warn("Error writing ICMP to TUN device, continuing", "error", err)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer up.close()
+		for {
+			buf := packetBufferPool.Get()
+			n, err := device.ReadPacket(buf)
+			if err != nil {
+				packetBufferPool.Put(buf)
+				reportForwardError(errChan, fmt.Errorf("failed to read from %w: %w", errTunDevice, err))
+				return
+			}
+			select {
+			case <-done:
+				// the packet was read for a connection that is gone, the next one reads on its own
+				packetBufferPool.Put(buf)
+				return
+			default:
+			}
+			if !up.push(buf[:n]) {
+				packetBufferPool.Put(buf)
+				t.Metrics.tx.drops.Add(1)
+			}
+		}
+	}()
+
+	if ForwardWorkers == 1 {
+		// a send queue alone leaves receiving as it is, without a queue to drop from
+		go t.receivePackets(device, ipConn, packetBufferPool, errChan)
+		return
+	}
+
+	down := newFlowQueues(ForwardWorkers, ForwardQueueLen)
+	for i := range ForwardWorkers {
+		go func() {
+			for pkt := range down[i] {
+				err := device.WritePacket(pkt)
+				packetBufferPool.Put(pkt[:cap(pkt)])
+				if err != nil {
+					reportForwardError(errChan, fmt.Errorf("failed to write to %w: %w", errTunDevice, err))
+					continue
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer down.close()
+		for {
+			buf := packetBufferPool.Get()
+			n, err := ipConn.ReadPacket(buf, true)
+			if err != nil {
+				packetBufferPool.Put(buf)
+				if errors.As(err, new(*connectip.CloseError)) {
+					reportForwardError(errChan, fmt.Errorf("connection closed while reading from IP connection: %w", err))
+					return
+				}
+				logFor(componentH3).Warn("Error reading from IP connection, continuing", "error", err)
+				t.Metrics.rx.errors.Add(1)
+				continue
+			}
+			t.Metrics.rx.add(n)
+			if !down.push(buf[:n]) {
+				packetBufferPool.Put(buf)
+				t.Metrics.rx.drops.Add(1)
+			}
+		}
+	}()
+}
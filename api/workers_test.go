@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/Diniboy1123/usque/internal/packet"
+)
+
+func TestQueueKeyFragments(t *testing.T) {
+	src4, dst4 := netip.MustParseAddr("172.16.0.2"), netip.MustParseAddr("1.1.1.1")
+	src6, dst6 := netip.MustParseAddr("2606:4700:110::2"), netip.MustParseAddr("2606:4700:4700::1111")
+	udp := []byte{0x30, 0x39, 0x00, 0x35, 0, 16, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+
+	fragment4 := func(offset int, more bool) []byte {
+		pkt := packet.NewIPv4(protoUDP, 64, 7, src4, dst4, udp)
+		ip, _ := packet.Parse(pkt)
+		ip.SetFragment(offset, more)
+		return pkt
+	}
+	fragment6 := func(offset int, more bool) []byte {
+		header := []byte{protoUDP, 0, byte(offset >> 8), byte(offset) &^ 7, 0, 0, 0, 7}
+		if more {
+			header[3] |= 1
+		}
+		return packet.NewIPv6(44, 64, src6, dst6, append(header, udp...))
+	}
+
+	tests := []struct {
+		name   string
+		first  []byte
+		second []byte
+	}{
+		{"IPv4", fragment4(0, true), fragment4(16, false)},
+		{"IPv6", fragment6(0, true), fragment6(16, false)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, ok := queueKey(tt.first)
+			if !ok {
+				t.Fatal("first fragment has no key")
+			}
+			second, ok := queueKey(tt.second)
+			if !ok {
+				t.Fatal("second fragment has no key")
+			}
+			if first != second {
+				t.Errorf("fragments keyed differently: %+v and %+v", first, second)
+			}
+			if first.SrcPort != 0 || first.DstPort != 0 {
+				t.Errorf("fragment keyed by ports: %+v", first)
+			}
+		})
+	}
+
+	whole, ok := queueKey(packet.NewIPv4(protoUDP, 64, 7, src4, dst4, udp))
+	if !ok || whole.SrcPort != 12345 || whole.DstPort != 53 {
+		t.Errorf("unfragmented packet keyed as %+v, want ports 12345 and 53", whole)
+	}
+}
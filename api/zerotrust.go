@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// teamName matches Zero Trust team names, the first label of <team>.cloudflareaccess.com.
+var teamName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// teamTokenCookie is the cookie Cloudflare Access stores the team token in after a successful login.
+const teamTokenCookie = "CF_Authorization"
+
+// ValidateTeamName checks that team is a valid Zero Trust team name.
+//
+// Parameters:
+//   - team: string - The team name, such as "example" for example.cloudflareaccess.com.
+//
+// Returns:
+//   - error: An error if the name isn't a valid DNS label.
+func ValidateTeamName(team string) error {
+	if !teamName.MatchString(team) {
+		return fmt.Errorf("invalid team name %q, expected the first part of <team>.cloudflareaccess.com", team)
+	}
+	return nil
+}
+
+// TeamLoginURL returns the page where users of a Zero Trust team log in to enroll a device.
+// After the login, the page offers the team token through an "Open Cloudflare WARP" link.
+//
+// Parameters:
+//   - team: string - The team name.
+//
+// Returns:
+//   - string: The URL of the login page.
+func TeamLoginURL(team string) string {
+	return "https://" + team + ".cloudflareaccess.com/warp"
+}
+
+// ParseTeamToken extracts the team token from what the login page gives to the user: either the
+// token itself, or the com.cloudflare.warp:// link of the "Open Cloudflare WARP" button carrying it.
+//
+// Parameters:
+//   - input: string - The token or the link.
+//
+// Returns:
+//   - string: The team token.
+//   - error: An error if input holds no token.
+func ParseTeamToken(input string) (string, error) {
+	token := strings.TrimSpace(input)
+	if strings.Contains(token, "://") {
+		link, err := url.Parse(token)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse link: %v", err)
+		}
+		token = link.Query().Get("token")
+	}
+	// a JWT: header, claims and signature
+	if parts := strings.Split(token, "."); len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("no team token found, expected a token or a com.cloudflare.warp:// link")
+	}
+	return token, nil
+}
+
+// TeamFromToken returns the team a team token was issued by, taken from its "iss" claim
+// https://<team>.cloudflareaccess.com. The signature isn't checked, the server does that.
+//
+// Parameters:
+//   - token: string - The team token.
+//
+// Returns:
+//   - string: The team name.
+//   - error: An error if the token has no claims or wasn't issued by a team.
+func TeamFromToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("team token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode team token claims: %v", err)
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("failed to parse team token claims: %v", err)
+	}
+	issuer, err := url.Parse(claims.Issuer)
+	if err != nil || issuer.Scheme != "https" {
+		return "", fmt.Errorf("team token has no team issuer: %q", claims.Issuer)
+	}
+	team, ok := strings.CutSuffix(strings.ToLower(issuer.Hostname()), ".cloudflareaccess.com")
+	if !ok || ValidateTeamName(team) != nil {
+		return "", fmt.Errorf("team token has no team issuer: %q", claims.Issuer)
+	}
+	return team, nil
+}
+
+// FetchTeamToken gets a team token for headless devices by authenticating to the login page of a
+// Zero Trust team with a service token instead of a user login. The team has to allow the service
+// token in its device enrollment rules.
+//
+// Parameters:
+//   - team: string - The team name.
+//   - clientID: string - The Client ID of the service token.
+//   - clientSecret: string - The Client Secret of the service token.
+//
+// Returns:
+//   - string: The team token, to be passed to RegisterDevice.
+//   - error: An error if the request fails or the service token isn't accepted.
+func FetchTeamToken(team, clientID, clientSecret string) (string, error) {
+	if err := ValidateTeamName(team); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("GET", TeamLoginURL(team), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("User-Agent", internal.Headers["User-Agent"])
+	req.Header.Set("CF-Access-Client-Id", clientID)
+	req.Header.Set("CF-Access-Client-Secret", clientSecret)
+
+	// the token is set on the first response, the redirect after it leads to the app
+	client := *ControlPlaneClient
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == teamTokenCookie && cookie.Value != "" {
+			return cookie.Value, nil
+		}
+	}
+	return "", fmt.Errorf("service token was not accepted by team %s: %v", team, resp.Status)
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// roundTripper answers requests with a function instead of the network.
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// jwt builds an unsigned token with the given claims.
+func jwt(claims string) string {
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2ln"
+}
+
+func TestFetchTeamToken(t *testing.T) {
+	token := jwt(`{"iss":"https://example.cloudflareaccess.com"}`)
+
+	tests := []struct {
+		name    string
+		status  int
+		cookies []string
+		want    string
+		wantErr bool
+	}{
+		{"accepted", http.StatusFound, []string{"CF_Authorization=" + token + "; Path=/"}, token, false},
+		{"accepted among other cookies", http.StatusFound, []string{"CF_AppSession=x", "CF_Authorization=" + token}, token, false},
+		{"rejected", http.StatusForbidden, nil, "", true},
+		{"empty cookie", http.StatusFound, []string{"CF_Authorization="}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := ControlPlaneClient
+			defer func() { ControlPlaneClient = client }()
+
+			var requests []*http.Request
+			ControlPlaneClient = &http.Client{Transport: roundTripper(func(req *http.Request) (*http.Response, error) {
+				requests = append(requests, req)
+				header := http.Header{"Location": {"https://example.cloudflareaccess.com/app"}}
+				for _, cookie := range tt.cookies {
+					header.Add("Set-Cookie", cookie)
+				}
+				return &http.Response{
+					StatusCode: tt.status,
+					Status:     http.StatusText(tt.status),
+					Header:     header,
+					Body:       io.NopCloser(strings.NewReader("")),
+					Request:    req,
+				}, nil
+			})}
+
+			got, err := FetchTeamToken("example", "id.access", "secret")
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("FetchTeamToken = %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+			if len(requests) != 1 {
+				t.Fatalf("sent %d requests, want 1 without following the redirect", len(requests))
+			}
+			req := requests[0]
+			if req.URL.String() != "https://example.cloudflareaccess.com/warp" {
+				t.Errorf("requested %s", req.URL)
+			}
+			if req.Header.Get("CF-Access-Client-Id") != "id.access" || req.Header.Get("CF-Access-Client-Secret") != "secret" {
+				t.Errorf("service token headers = %q, %q", req.Header.Get("CF-Access-Client-Id"), req.Header.Get("CF-Access-Client-Secret"))
+			}
+		})
+	}
+
+	if _, err := FetchTeamToken("Not a team", "id.access", "secret"); err == nil {
+		t.Error("FetchTeamToken accepted an invalid team name")
+	}
+}
+
+func TestTeamFromToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		want    string
+		wantErr bool
+	}{
+		{"team issuer", jwt(`{"iss":"https://example.cloudflareaccess.com"}`), "example", false},
+		{"issuer with path", jwt(`{"iss":"https://Example.cloudflareaccess.com/cdn-cgi/access"}`), "example", false},
+		{"other issuer", jwt(`{"iss":"https://example.com"}`), "", true},
+		{"plain http", jwt(`{"iss":"http://example.cloudflareaccess.com"}`), "", true},
+		{"no issuer", jwt(`{"sub":"device"}`), "", true},
+		{"not JSON", jwt(`example`), "", true},
+		{"not a JWT", "token", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := TeamFromToken(tt.token)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("TeamFromToken = %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseTeamToken(t *testing.T) {
+	token := jwt(`{"iss":"https://example.cloudflareaccess.com"}`)
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"token", token + "\n", token, false},
+		{"link", "com.cloudflare.warp://example.cloudflareaccess.com/auth?token=" + token, token, false},
+		{"link without token", "com.cloudflare.warp://example.cloudflareaccess.com/auth", "", true},
+		{"garbage", "hello", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTeamToken(tt.input)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("ParseTeamToken = %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"text/tabwriter"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/models"
+	"github.com/spf13/cobra"
+)
+
+// registeredAccount returns the credentials of the loaded config for the account API.
+func registeredAccount() models.AccountData {
+	return models.AccountData{
+		ID:    config.AppConfig.ID,
+		Token: config.AppConfig.AccessToken,
+	}
+}
+
+// saveLicense stores the license of account in the config if it changed.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose config flag is read.
+//   - account: models.Account - The account as returned by the API.
+func saveLicense(cmd *cobra.Command, account models.Account) {
+	if account.License == "" || account.License == config.AppConfig.License {
+		return
+	}
+	configPath, err := getConfigPath(cmd)
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get config path: %v", err)
+	}
+	config.AppConfig.License = account.License
+	if err := config.AppConfig.SaveConfig(configPath); err != nil {
+		fatalWith(ExitConfig, "Failed to save config: %v", err)
+	}
+	log.Printf("License updated in %s", configPath)
+}
+
+// printAccount prints the account as a table, or as JSON if asJSON is set.
+func printAccount(cmd *cobra.Command, account models.Account, asJSON bool) {
+	if asJSON {
+		printJSON(cmd, account)
+		return
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Account:\t%s\n", account.ID)
+	fmt.Fprintf(w, "Type:\t%s\n", account.AccountType)
+	if account.Organization != "" {
+		fmt.Fprintf(w, "Organization:\t%s\n", account.Organization)
+	}
+	if account.Role != "" {
+		fmt.Fprintf(w, "Role:\t%s\n", account.Role)
+	}
+	fmt.Fprintf(w, "WARP+:\t%t\n", account.WarpPlus)
+	if account.PremiumData > 0 || account.Quota > 0 {
+		fmt.Fprintf(w, "Premium data:\t%s\n", formatBytes(uint64(account.PremiumData)))
+		fmt.Fprintf(w, "Quota:\t%s\n", formatBytes(uint64(account.Quota)))
+	}
+	if account.ReferralCount > 0 {
+		fmt.Fprintf(w, "Referrals:\t%d\n", account.ReferralCount)
+	}
+	if account.License != "" {
+		fmt.Fprintf(w, "License:\t%s\n", account.License)
+	}
+	w.Flush()
+}
+
+var accountCmd = &cobra.Command{
+	Use:   "account",
+	Short: "Show the account of the registration",
+	Long: "Shows the type of the account the registration belongs to, whether WARP+ is active, the remaining data quota" +
+		" and the license key. The license stored in the config is updated if it changed.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.ConfigLoaded {
+			exitNotRegistered(cmd)
+		}
+
+		asJSON, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get json flag: %v\n", err)
+		}
+
+		account, apiErr, err := api.GetAccount(registeredAccount())
+		if err != nil {
+			if apiErr != nil {
+				fatalWith(ExitAuth, "Failed to get account: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
+			}
+			fatalWith(ExitFailure, "Failed to get account: %v", err)
+		}
+
+		printAccount(cmd, account, asJSON)
+		saveLicense(cmd, account)
+	},
+}
+
+var licenseCmd = &cobra.Command{
+	Use:   "license",
+	Short: "Manage the license key of the registration",
+}
+
+var licenseSetCmd = &cobra.Command{
+	Use:   "set <key>",
+	Short: "Attach the registration to the account of a license key",
+	Long: "Attaches the registration to the account of a license key, such as a WARP+ key shown in the official app," +
+		" and stores the key in the config. The registration keeps its keys and addresses.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.ConfigLoaded {
+			exitNotRegistered(cmd)
+		}
+		if config.AppConfig.Team != "" {
+			exitWith(cmd, ExitUsage, "License keys only apply to consumer WARP, this device is enrolled in team %s\n", config.AppConfig.Team)
+		}
+
+		asJSON, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get json flag: %v\n", err)
+		}
+
+		account, apiErr, err := api.SetLicense(registeredAccount(), args[0])
+		if err != nil {
+			if apiErr != nil {
+				fatalWith(ExitAuth, "Failed to set license: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
+			}
+			fatalWith(ExitFailure, "Failed to set license: %v", err)
+		}
+		if account.License == "" {
+			account.License = args[0]
+		}
+
+		printAccount(cmd, account, asJSON)
+		saveLicense(cmd, account)
+	},
+}
+
+func init() {
+	accountCmd.Flags().Bool("json", false, "Print the account as JSON")
+	licenseSetCmd.Flags().Bool("json", false, "Print the account as JSON")
+	licenseCmd.AddCommand(licenseSetCmd)
+	rootCmd.AddCommand(accountCmd, licenseCmd)
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"log"
+	"net/url"
+	"sort"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// redactedFlags hold credentials and are never logged.
+var redactedFlags = map[string]bool{
+	"password":     true,
+	"access-token": true,
+	"jwt":          true,
+}
+
+// effectiveConfig summarizes what a tunnel command actually runs with, after the config file and flags are merged.
+type effectiveConfig struct {
+	Version   string            `json:"version"`
+	Command   string            `json:"command"`
+	DeviceID  string            `json:"device_id"`
+	IPv4      string            `json:"ipv4"`
+	IPv6      string            `json:"ipv6"`
+	Endpoints []string          `json:"endpoints"`
+	Expert    bool              `json:"expert"`
+	Features  map[string]bool   `json:"features"`
+	Flags     map[string]string `json:"flags"`   // every flag, credentials redacted
+	Changed   []string          `json:"changed"` // flags not at their default value
+}
+
+// currentConfig is the effective configuration of the running tunnel command, nil before it starts.
+var currentConfig *effectiveConfig
+
+// logEffectiveConfig records the effective configuration and logs it as one block,
+// so the log answers what the tunnel is actually doing.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - endpoints: *api.EndpointList - The MASQUE endpoints in use.
+func logEffectiveConfig(cmd *cobra.Command, endpoints *api.EndpointList) {
+	c := &effectiveConfig{
+		Version:  version,
+		Command:  cmd.Name(),
+		DeviceID: config.AppConfig.ID,
+		IPv4:     config.AppConfig.IPv4,
+		IPv6:     config.AppConfig.IPv6,
+		Expert:   config.AppConfig.Expert != nil,
+		Flags:    map[string]string{},
+		Features: map[string]bool{},
+	}
+	for _, feature := range api.Features.Status() {
+		c.Features[string(feature.Name)] = feature.Enabled
+	}
+	for _, endpoint := range endpoints.All() {
+		c.Endpoints = append(c.Endpoints, endpoint.String())
+	}
+
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		c.Flags[f.Name] = redactFlag(f)
+		if f.Changed {
+			c.Changed = append(c.Changed, f.Name)
+		}
+	})
+	sort.Strings(c.Changed)
+	currentConfig = c
+
+	log.Printf("Effective configuration:")
+	log.Printf("  version: %s (%s)", c.Version, commit)
+	log.Printf("  command: %s", c.Command)
+	log.Printf("  device: %s, IPv4 %s, IPv6 %s", c.DeviceID, c.IPv4, c.IPv6)
+	log.Printf("  endpoints: %v", c.Endpoints)
+	log.Printf("  MTU: %s, keepalive: %s, SNI: %s", c.Flags["mtu"], c.Flags["keepalive-period"], c.Flags["sni-address"])
+	log.Printf("  features: %v", c.Features)
+	if c.Expert {
+		log.Printf("  expert section present (only applied with --expert)")
+	}
+	for _, name := range c.Changed {
+		log.Printf("  --%s=%s", name, c.Flags[name])
+	}
+}
+
+// redactFlag returns the value of a flag with credentials removed.
+func redactFlag(f *pflag.Flag) string {
+	value := f.Value.String()
+	if redactedFlags[f.Name] && value != "" {
+		return "[redacted]"
+	}
+	if f.Name == "proxy" && value != "" {
+		if u, err := url.Parse(value); err == nil {
+			return u.Redacted()
+		}
+		return "[redacted]"
+	}
+	return value
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// setupSocketBinding binds outgoing sockets to the interface given with --bind-iface
+// and the source address given with --bind-address, and marks them with --outer-mark and --dscp.
+// This covers the connections to MASQUE servers as well as API requests.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - error: An error if the bind address or DSCP value is invalid.
+func setupSocketBinding(cmd *cobra.Command) error {
+	iface, err := cmd.Flags().GetString("bind-iface")
+	if err != nil {
+		return err
+	}
+	address, err := cmd.Flags().GetString("bind-address")
+	if err != nil {
+		return err
+	}
+	mark, err := cmd.Flags().GetUint32("outer-mark")
+	if err != nil {
+		return err
+	}
+	dscp, err := cmd.Flags().GetString("dscp")
+	if err != nil {
+		return err
+	}
+	if iface == "" && address == "" && mark == 0 && dscp == "" {
+		return nil
+	}
+
+	if dscp != "" {
+		value, err := parseDSCP(dscp)
+		if err != nil {
+			return err
+		}
+		api.SocketDSCP = value
+	}
+
+	if address != "" {
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			return fmt.Errorf("invalid bind address: %v", err)
+		}
+		api.BindAddress = addr.Unmap()
+	}
+	api.BindInterface = iface
+	api.SocketMark = mark
+	// api.ControlPlaneClient picks these up too, so API requests bypass the tunnel the same way
+	return nil
+}
+
+// parseDSCP parses a DSCP value given as a number from 0 to 63 or as a name such as ef, af41 or cs1.
+//
+// Parameters:
+//   - s: string - The value.
+//
+// Returns:
+//   - uint8: The DSCP value.
+//   - error: An error if s is neither.
+func parseDSCP(s string) (uint8, error) {
+	name := strings.ToLower(s)
+	switch {
+	case name == "ef":
+		return 46, nil
+	case len(name) == 3 && strings.HasPrefix(name, "cs") && name[2] >= '0' && name[2] <= '7':
+		return (name[2] - '0') << 3, nil
+	case len(name) == 4 && strings.HasPrefix(name, "af") && name[2] >= '1' && name[2] <= '4' && name[3] >= '1' && name[3] <= '3':
+		return (name[2]-'0')<<3 | (name[3]-'0')<<1, nil
+	}
+
+	value, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || value > 63 {
+		return 0, fmt.Errorf("invalid DSCP value %q, expected 0 to 63 or a name such as ef, af41 or cs1", s)
+	}
+	return uint8(value), nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().String("bind-iface", "", "Interface to send outgoing connections through, regardless of the routing table (e.g. eth0)")
+	rootCmd.PersistentFlags().String("bind-address", "", "Source address of outgoing connections")
+	rootCmd.PersistentFlags().Uint32("outer-mark", 0, "Linux only: firewall mark (SO_MARK) of outgoing connections, to tell tunnel traffic apart in nftables or tc rules")
+	rootCmd.PersistentFlags().String("dscp", "", "Linux and macOS only: DSCP value of outgoing connections, a number from 0 to 63 or a name such as ef, af41 or cs1 (turns off ECN)")
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// withChaos wraps the device in an api.ChaosDevice if any of the hidden chaos flags are set.
+// Used for reproducible testing of reconnects and packet handling, never in production.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - dev: api.TunnelDevice - The device to wrap.
+//
+// Returns:
+//   - api.TunnelDevice: The wrapped device, or dev itself if chaos is disabled.
+func withChaos(cmd *cobra.Command, dev api.TunnelDevice) api.TunnelDevice {
+	var cfg api.ChaosConfig
+	var err error
+
+	if cfg.LossRate, err = cmd.Flags().GetFloat64("chaos-loss"); err != nil {
+		fatalWith(ExitUsage, "Failed to get chaos loss rate: %v", err)
+	}
+	if cfg.DuplicateRate, err = cmd.Flags().GetFloat64("chaos-duplicate"); err != nil {
+		fatalWith(ExitUsage, "Failed to get chaos duplicate rate: %v", err)
+	}
+	if cfg.Delay, err = cmd.Flags().GetDuration("chaos-delay"); err != nil {
+		fatalWith(ExitUsage, "Failed to get chaos delay: %v", err)
+	}
+	if cfg.Jitter, err = cmd.Flags().GetDuration("chaos-jitter"); err != nil {
+		fatalWith(ExitUsage, "Failed to get chaos jitter: %v", err)
+	}
+	if cfg.ErrorInterval, err = cmd.Flags().GetDuration("chaos-error-interval"); err != nil {
+		fatalWith(ExitUsage, "Failed to get chaos error interval: %v", err)
+	}
+	if cfg.Seed, err = cmd.Flags().GetInt64("chaos-seed"); err != nil {
+		fatalWith(ExitUsage, "Failed to get chaos seed: %v", err)
+	}
+
+	if !cfg.Enabled() {
+		return dev
+	}
+
+	log.Printf("Warning: chaos mode enabled (loss %.2f, duplicate %.2f, delay %s, jitter %s, error interval %s, seed %d)",
+		cfg.LossRate, cfg.DuplicateRate, cfg.Delay, cfg.Jitter, cfg.ErrorInterval, cfg.Seed)
+
+	return api.NewChaosDevice(dev, cfg)
+}
+
+func init() {
+	rootCmd.PersistentFlags().Float64("chaos-loss", 0, "Testing only: probability of dropping a packet")
+	rootCmd.PersistentFlags().Float64("chaos-duplicate", 0, "Testing only: probability of duplicating a packet")
+	rootCmd.PersistentFlags().Duration("chaos-delay", 0, "Testing only: delay added to every packet")
+	rootCmd.PersistentFlags().Duration("chaos-jitter", 0, "Testing only: random extra delay added to every packet")
+	rootCmd.PersistentFlags().Duration("chaos-error-interval", 0, "Testing only: force a transport error this often")
+	rootCmd.PersistentFlags().Int64("chaos-seed", 1, "Testing only: seed for the chaos random source")
+	for _, name := range []string{"chaos-loss", "chaos-duplicate", "chaos-delay", "chaos-jitter", "chaos-error-interval", "chaos-seed"} {
+		rootCmd.PersistentFlags().MarkHidden(name)
+	}
+}
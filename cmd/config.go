@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+// promptPassphrase asks for the passphrase of an encrypted config on the terminal.
+func promptPassphrase() (string, error) {
+	fmt.Fprint(os.Stderr, "Config passphrase: ")
+	passphrase, err := internal.ReadPassword(os.Stdin)
+	fmt.Fprintln(os.Stderr)
+	if errors.Is(err, internal.ErrNotTerminal) {
+		return "", fmt.Errorf("config is encrypted, set %s or passphrase_command", config.PassphraseEnv)
+	}
+	return passphrase, err
+}
+
+// promptNewPassphrase asks for a new passphrase twice on the terminal.
+func promptNewPassphrase() (string, error) {
+	fmt.Fprint(os.Stderr, "New config passphrase: ")
+	passphrase, err := internal.ReadPassword(os.Stdin)
+	fmt.Fprintln(os.Stderr)
+	if errors.Is(err, internal.ErrNotTerminal) {
+		return "", fmt.Errorf("no terminal to ask for a passphrase, set %s", config.PassphraseEnv)
+	}
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("passphrase must not be empty")
+	}
+
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	repeated, err := internal.ReadPassword(os.Stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if repeated != passphrase {
+		return "", errors.New("passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the config file",
+}
+
+var configEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt the secrets in the config with a passphrase",
+	Long: "Encrypts the private keys and access tokens in the config with a passphrase. The passphrase is read from " +
+		config.PassphraseEnv + ", the output of --passphrase-command, the OS keychain or the terminal, in this order.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.ConfigLoaded {
+			exitNotRegistered(cmd)
+		}
+		if secrets := config.AppConfig.Secrets; secrets != nil && secrets.Backend == config.SecretBackendEncrypted {
+			exitWith(cmd, ExitUsage, "Config is already encrypted\n")
+		}
+
+		configPath, err := getConfigPath(cmd)
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get config path: %v", err)
+		}
+		passphraseCommand, err := cmd.Flags().GetString("passphrase-command")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get passphrase command: %v", err)
+		}
+
+		if secrets := config.AppConfig.Secrets; secrets != nil && secrets.Backend != config.SecretBackendConfig {
+			log.Printf("Moving secrets from the %s secret store into the config, the copies there are left alone", secrets.Backend)
+		}
+		config.PassphrasePrompt = promptNewPassphrase
+		config.AppConfig.Secrets = &config.SecretsConfig{
+			Backend:           config.SecretBackendEncrypted,
+			Service:           profileSecretService(cmd),
+			PassphraseCommand: passphraseCommand,
+		}
+		if err := config.AppConfig.SaveConfig(configPath); err != nil {
+			fatalWith(ExitConfig, "Failed to save config: %v", err)
+		}
+
+		log.Printf("Config encrypted in %s", configPath)
+	},
+}
+
+var configDecryptCmd = &cobra.Command{
+	Use:   "decrypt",
+	Short: "Store the secrets in the config in plain text again",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.ConfigLoaded {
+			exitNotRegistered(cmd)
+		}
+		if secrets := config.AppConfig.Secrets; secrets == nil || secrets.Backend != config.SecretBackendEncrypted {
+			exitWith(cmd, ExitUsage, "Config is not encrypted\n")
+		}
+
+		configPath, err := getConfigPath(cmd)
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get config path: %v", err)
+		}
+
+		config.AppConfig.Secrets = nil
+		if err := config.AppConfig.SaveConfig(configPath); err != nil {
+			fatalWith(ExitConfig, "Failed to save config: %v", err)
+		}
+
+		log.Printf("Config decrypted in %s", configPath)
+	},
+}
+
+var configGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate a config without registering",
+	Long: "Generates a complete config with a fresh key and a fake registration, for a local gateway run with --no-upstream " +
+		"instead of Cloudflare. Every mode can be tried and tested with it without real credentials.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		test, err := cmd.Flags().GetBool("test")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get test flag: %v", err)
+		}
+		if !test {
+			exitWith(cmd, ExitUsage, "Only test configs can be generated, use --test or register a device with register\n")
+		}
+
+		configPath, err := getConfigPath(cmd)
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get config path: %v", err)
+		}
+		keyPath, err := cmd.Flags().GetString("key")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get key path: %v", err)
+		}
+		endpoint, err := cmd.Flags().GetString("endpoint")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get endpoint: %v", err)
+		}
+		if _, err := os.Stat(configPath); err == nil {
+			exitWith(cmd, ExitUsage, "%s already exists, choose another path with --config\n", configPath)
+		}
+
+		gatewayKey, err := loadGatewayKey(keyPath)
+		if err != nil {
+			fatalWith(ExitConfig, "Failed to load gateway key: %v", err)
+		}
+		gatewayPubKey, err := x509.MarshalPKIXPublicKey(&gatewayKey.PublicKey)
+		if err != nil {
+			fatalWith(ExitFailure, "Failed to marshal gateway public key: %v", err)
+		}
+		privKey, _, err := internal.GenerateEcKeyPair()
+		if err != nil {
+			fatalWith(ExitFailure, "Failed to generate key pair: %v", err)
+		}
+		id := make([]byte, 16)
+		token := make([]byte, 32)
+		if _, err := rand.Read(id); err != nil {
+			fatalWith(ExitFailure, "Failed to generate device ID: %v", err)
+		}
+		if _, err := rand.Read(token); err != nil {
+			fatalWith(ExitFailure, "Failed to generate access token: %v", err)
+		}
+
+		config.AppConfig = config.Config{
+			PrivateKey:     base64.StdEncoding.EncodeToString(privKey),
+			EndpointV4:     "127.0.0.1",
+			EndpointV6:     "::1",
+			EndpointPubKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: gatewayPubKey})),
+			Endpoints:      []string{endpoint},
+			ID:             "test-" + hex.EncodeToString(id),
+			AccessToken:    hex.EncodeToString(token),
+			IPv4:           "172.16.0.2",
+			IPv6:           "fd00:7465:7374::2",
+		}
+		if err := config.AppConfig.SaveConfig(configPath); err != nil {
+			fatalWith(ExitConfig, "Failed to save config: %v", err)
+		}
+
+		log.Printf("Test config saved to %s, start the gateway it connects to with:", configPath)
+		log.Printf("  usque -c %s gateway --no-upstream --listen %s --key %s", configPath, endpoint, keyPath)
+		log.Printf("and use any mode with -c %s against it, e.g. usque -c %s ping 1.1.1.1", configPath, configPath)
+	},
+}
+
+func init() {
+	configGenerateCmd.Flags().Bool("test", false, "Generate a test config for a local gateway instead of Cloudflare")
+	configGenerateCmd.Flags().String("key", "test-gateway.pem", "Path of the key of the test gateway, generated if it doesn't exist")
+	configGenerateCmd.Flags().String("endpoint", "127.0.0.1:4443", "Address the test gateway listens on")
+	configEncryptCmd.Flags().String("passphrase-command", "", "Command printing the passphrase whenever the config is loaded, e.g. to decrypt it with age")
+	configCmd.AddCommand(configEncryptCmd, configDecryptCmd, configGenerateCmd)
+	rootCmd.AddCommand(configCmd)
+}
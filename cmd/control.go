@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+// Control is the JSON-RPC service of the control socket. Its methods are called as "Control.<Method>".
+type Control struct {
+	cmd       *cobra.Command
+	endpoints *api.EndpointList
+}
+
+// ControlStatus is the reply of Control.Status.
+type ControlStatus struct {
+	State          string              `json:"state"`     // "connected" or "connecting"
+	Transport      string              `json:"transport"` // Protocol carrying the tunnel
+	Endpoint       string              `json:"endpoint"`
+	ConnectedSince time.Time           `json:"connected_since"`
+	Endpoints      []api.EndpointStats `json:"endpoints"`
+	Features       []api.FeatureStatus `json:"features"`
+	Config         *effectiveConfig    `json:"config"`
+}
+
+// ControlStats is the reply of Control.Stats.
+type ControlStats struct {
+	Total      api.MetricsSnapshot  `json:"total"`
+	Connection *api.ConnectionStats `json:"connection,omitempty"` // nil while disconnected
+}
+
+// ControlFeature is the argument of Control.SetFeature.
+type ControlFeature struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// Status returns the state of the tunnel and the configuration it runs with.
+func (c *Control) Status(_ struct{}, reply *ControlStatus) error {
+	snapshot := api.DefaultTunnel.Metrics.Snapshot()
+	*reply = ControlStatus{
+		State:          "connecting",
+		Transport:      "HTTP/3",
+		Endpoint:       c.endpoints.Current().String(),
+		ConnectedSince: snapshot.ConnectedSince,
+		Endpoints:      c.endpoints.Stats(),
+		Features:       api.Features.Status(),
+		Config:         currentConfig,
+	}
+	if !snapshot.ConnectedSince.IsZero() {
+		reply.State = "connected"
+	}
+	return nil
+}
+
+// Stats returns the traffic counters over all connections and of the current one.
+func (c *Control) Stats(_ struct{}, reply *ControlStats) error {
+	reply.Total = api.DefaultTunnel.Metrics.Snapshot()
+	if connection, ok := api.DefaultTunnel.Metrics.Connection(); ok {
+		reply.Connection = &connection
+	}
+	return nil
+}
+
+// Reconnect drops the current connection and connects again right away.
+func (c *Control) Reconnect(_ struct{}, _ *struct{}) error {
+	api.DefaultTunnel.RequestReconnect()
+	return nil
+}
+
+// Refresh sends a new Connect-IP request on the current QUIC connection, reconnecting if that fails.
+func (c *Control) Refresh(_ struct{}, _ *struct{}) error {
+	api.DefaultTunnel.RequestRefresh()
+	return nil
+}
+
+// SwitchEndpoint reconnects to the given endpoint of the endpoint list, or to the next one if empty.
+// The reply is the endpoint switched to.
+func (c *Control) SwitchEndpoint(endpoint string, reply *string) error {
+	stats := c.endpoints.Stats()
+	var target *net.UDPAddr
+	if endpoint == "" {
+		for i, stat := range stats {
+			if stat.Active {
+				target = stats[(i+1)%len(stats)].Endpoint
+			}
+		}
+	} else {
+		for _, stat := range stats {
+			if stat.Endpoint.String() == endpoint {
+				target = stat.Endpoint
+			}
+		}
+		if target == nil {
+			return fmt.Errorf("%s is not in the endpoint list", endpoint)
+		}
+	}
+
+	c.endpoints.Prefer(target)
+	api.DefaultTunnel.RequestReconnect()
+	*reply = target.String()
+	return nil
+}
+
+// Reload reloads the config file like SIGHUP does, e.g. after rotate-keys replaced the key.
+// New credentials reconnect the tunnel with them.
+func (c *Control) Reload(_ struct{}, _ *struct{}) error {
+	configPath, err := getConfigPath(c.cmd)
+	if err != nil {
+		return err
+	}
+	return reloadConfig(c.cmd, configPath, c.endpoints)
+}
+
+// Why returns the last n reconnect decisions, all kept ones if n <= 0.
+func (c *Control) Why(n int, reply *[]api.ReconnectDecision) error {
+	*reply = api.Reconnects.Recent(n)
+	if *reply == nil {
+		// jsonrpc takes a null result for an error
+		*reply = []api.ReconnectDecision{}
+	}
+	return nil
+}
+
+// SetFeature switches a feature on or off.
+func (c *Control) SetFeature(args ControlFeature, _ *struct{}) error {
+	return api.Features.Set(api.Feature(args.Name), args.Enabled)
+}
+
+// Shutdown stops the tunnel command like SIGTERM does.
+func (c *Control) Shutdown(_ struct{}, _ *struct{}) error {
+	requestStop()
+	return nil
+}
+
+// serveControl serves the control socket in the background if --control is set.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - endpoints: *api.EndpointList - The endpoints of the running tunnel.
+func serveControl(cmd *cobra.Command, endpoints *api.EndpointList) {
+	enabled, err := cmd.Flags().GetBool("control")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get control flag: %v", err)
+	}
+	if !enabled {
+		return
+	}
+	path, err := getControlSocket(cmd)
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get control socket: %v", err)
+	}
+
+	server := rpc.NewServer()
+	if err := server.Register(&Control{cmd: cmd, endpoints: endpoints}); err != nil {
+		fatalWith(ExitFailure, "Failed to register control service: %v", err)
+	}
+	listener, err := internal.ListenControl(path)
+	if err != nil {
+		fatalWith(ExitFailure, "Failed to listen on control socket: %v", err)
+	}
+
+	log.Printf("Control socket listening on %s", path)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				slog.Warn("Control socket stopped", "error", err)
+				return
+			}
+			go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+		}
+	}()
+}
+
+func init() {
+	rootCmd.PersistentFlags().Bool("control", false, "Serve the control socket, for managing the running tunnel with 'usque ctl'")
+	rootCmd.PersistentFlags().String("control-socket", internal.DefaultControlSocket, "Path of the control socket (a named pipe on Windows)")
+}
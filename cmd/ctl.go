@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/rpc/jsonrpc"
+	"strings"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+// callControl calls a method of the control socket of a running usque.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - method: string - The method of the Control service, without the service name.
+//   - args: any - The argument of the method.
+//   - reply: any - Where the reply is decoded to.
+//
+// Returns:
+//   - error: An error if the socket can't be reached or the method failed.
+func callControl(cmd *cobra.Command, method string, args any, reply any) error {
+	path, err := getControlSocket(cmd)
+	if err != nil {
+		return err
+	}
+
+	conn, err := internal.DialControl(path, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to control socket (is usque running with --control?): %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	client := jsonrpc.NewClient(conn)
+	defer client.Close()
+	return client.Call("Control."+method, args, reply)
+}
+
+// printJSON prints a reply indented.
+func printJSON(cmd *cobra.Command, v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fatalWith(ExitFailure, "Failed to marshal reply: %v", err)
+	}
+	cmd.Println(string(data))
+}
+
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Manage a running tunnel through its control socket",
+	Long:  "Talks to the control socket of a tunnel command started with --control. Use the same --control-socket for both.",
+}
+
+var ctlStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the state, endpoints, features and configuration of the tunnel",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var status ControlStatus
+		if err := callControl(cmd, "Status", struct{}{}, &status); err != nil {
+			fatalWith(ExitFailure, "Failed to get status: %v", err)
+		}
+		printJSON(cmd, status)
+	},
+}
+
+var ctlStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show the traffic counters of the tunnel and of the current connection",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var stats ControlStats
+		if err := callControl(cmd, "Stats", struct{}{}, &stats); err != nil {
+			fatalWith(ExitFailure, "Failed to get stats: %v", err)
+		}
+		printJSON(cmd, stats)
+	},
+}
+
+var ctlReconnectCmd = &cobra.Command{
+	Use:   "reconnect",
+	Short: "Drop the current connection and reconnect right away",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := callControl(cmd, "Reconnect", struct{}{}, &struct{}{}); err != nil {
+			fatalWith(ExitFailure, "Failed to reconnect: %v", err)
+		}
+		log.Println("Reconnect requested")
+	},
+}
+
+var ctlRefreshCmd = &cobra.Command{
+	Use:   "refresh",
+	Short: "Send a new CONNECT request on the current connection, keeping the QUIC connection",
+	Long: "Closes only the Connect-IP request stream and sends a new Extended CONNECT on the existing QUIC connection." +
+		" Recovers from a stream that stopped passing traffic faster than reconnect. Falls back to a reconnect if the server refuses.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := callControl(cmd, "Refresh", struct{}{}, &struct{}{}); err != nil {
+			fatalWith(ExitFailure, "Failed to refresh: %v", err)
+		}
+		log.Println("Refresh requested")
+	},
+}
+
+var ctlReloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload the config file of the tunnel, like SIGHUP",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := callControl(cmd, "Reload", struct{}{}, &struct{}{}); err != nil {
+			fatalWith(ExitFailure, "Failed to reload: %v", err)
+		}
+		log.Println("Config reloaded")
+	},
+}
+
+var ctlSwitchEndpointCmd = &cobra.Command{
+	Use:   "switch-endpoint [ip:port]",
+	Short: "Reconnect to another endpoint of the endpoint list, the next one if none is given",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		endpoint := ""
+		if len(args) == 1 {
+			endpoint = args[0]
+		}
+		var switched string
+		if err := callControl(cmd, "SwitchEndpoint", endpoint, &switched); err != nil {
+			fatalWith(ExitFailure, "Failed to switch endpoint: %v", err)
+		}
+		log.Printf("Switching to %s", switched)
+	},
+}
+
+var ctlWhyCmd = &cobra.Command{
+	Use:   "why",
+	Short: "Explain the latest reconnects",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		count, err := cmd.Flags().GetInt("count")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get count: %v\n", err)
+		}
+		var decisions []api.ReconnectDecision
+		if err := callControl(cmd, "Why", count, &decisions); err != nil {
+			fatalWith(ExitFailure, "Failed to get reconnect history: %v", err)
+		}
+		if len(decisions) == 0 {
+			cmd.Println("No reconnects so far.")
+			return
+		}
+		for _, decision := range decisions {
+			cmd.Println(decision)
+		}
+	},
+}
+
+var ctlFeatureCmd = &cobra.Command{
+	Use:   "feature name=on|off",
+	Short: "Switch an experimental feature of the tunnel on or off",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, value, ok := strings.Cut(args[0], "=")
+		if !ok {
+			fatalWith(ExitUsage, "Invalid feature switch %q, expected name=on or name=off", args[0])
+		}
+		enabled, err := parseSwitch(value)
+		if err != nil {
+			fatalWith(ExitUsage, "Invalid feature switch %q: %v", args[0], err)
+		}
+		if err := callControl(cmd, "SetFeature", ControlFeature{Name: name, Enabled: enabled}, &struct{}{}); err != nil {
+			fatalWith(ExitFailure, "Failed to switch feature: %v", err)
+		}
+		log.Printf("Feature %s switched %s", name, value)
+	},
+}
+
+var ctlShutdownCmd = &cobra.Command{
+	Use:   "shutdown",
+	Short: "Stop the tunnel command",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := callControl(cmd, "Shutdown", struct{}{}, &struct{}{}); err != nil {
+			fatalWith(ExitFailure, "Failed to shut down: %v", err)
+		}
+		log.Println("Shutdown requested")
+	},
+}
+
+func init() {
+	ctlWhyCmd.Flags().IntP("count", "n", 10, "Number of reconnects to explain, 0 for all kept ones")
+	ctlCmd.AddCommand(ctlStatusCmd, ctlStatsCmd, ctlReconnectCmd, ctlRefreshCmd, ctlReloadCmd, ctlSwitchEndpointCmd, ctlWhyCmd, ctlFeatureCmd, ctlShutdownCmd)
+	rootCmd.AddCommand(ctlCmd)
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// debugBuffers is the reply of /debug/buffers.
+type debugBuffers struct {
+	Pools      []api.NetBufferStats `json:"pools"`
+	Goroutines int                  `json:"goroutines"`
+	HeapAlloc  uint64               `json:"heap_alloc"`  // Bytes of allocated heap objects
+	HeapInuse  uint64               `json:"heap_inuse"`  // Bytes in in-use heap spans
+	Mallocs    uint64               `json:"mallocs"`     // Heap objects allocated so far
+	NumGC      uint32               `json:"num_gc"`      // Completed GC cycles
+	PauseTotal uint64               `json:"pause_total"` // Nanoseconds spent in GC pauses
+}
+
+// setupDebugServer serves pprof profiles, goroutine and heap dumps and the buffer pool
+// statistics on the address given with --debug-listen.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - error: An error if the address can't be listened on.
+func setupDebugServer(cmd *cobra.Command) error {
+	addr, err := cmd.Flags().GetString("debug-listen")
+	if err != nil {
+		return err
+	}
+	if addr == "" {
+		return nil
+	}
+
+	// a mux of its own, so the profiles never end up on another server of the process
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/buffers", func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(debugBuffers{
+			Pools:      api.BufferPoolStats(),
+			Goroutines: runtime.NumGoroutine(),
+			HeapAlloc:  mem.HeapAlloc,
+			HeapInuse:  mem.HeapInuse,
+			Mallocs:    mem.Mallocs,
+			NumGC:      mem.NumGC,
+			PauseTotal: mem.PauseTotalNs,
+		})
+	})
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			log.Printf("Warning: the debug server on %s is reachable from other hosts and has no authentication", addr)
+		}
+	}
+
+	log.Printf("Debug server listening on %s", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			slog.Warn("Debug server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().String("debug-listen", "", "Address to serve pprof profiles and buffer pool statistics on (e.g. 127.0.0.1:6060)")
+}
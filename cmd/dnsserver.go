@@ -0,0 +1,29 @@
+//go:build !nodns
+
+package cmd
+
+import (
+	"log"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// serveDNSForwarder serves plain DNS over UDP and TCP on addr in the background.
+func serveDNSForwarder(forwarder *internal.DNSForwarder, addr string) {
+	go func() {
+		log.Printf("DNS forwarder listening on %s", addr)
+		if err := forwarder.ServeDNS(addr); err != nil {
+			log.Printf("DNS forwarder stopped: %v", err)
+		}
+	}()
+}
+
+// serveDoH serves DNS-over-HTTPS on addr in the background, over plain HTTP if certFile is empty.
+func serveDoH(forwarder *internal.DNSForwarder, addr, certFile, keyFile string) {
+	go func() {
+		log.Printf("DoH server listening on %s", addr)
+		if err := forwarder.ServeDoH(addr, certFile, keyFile); err != nil {
+			log.Printf("DoH server stopped: %v", err)
+		}
+	}()
+}
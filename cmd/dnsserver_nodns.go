@@ -0,0 +1,13 @@
+//go:build nodns
+
+package cmd
+
+import "github.com/Diniboy1123/usque/internal"
+
+func serveDNSForwarder(forwarder *internal.DNSForwarder, addr string) {
+	fatalWith(ExitUsage, "DNS forwarder is not supported by this build (built with the nodns tag)")
+}
+
+func serveDoH(forwarder *internal.DNSForwarder, addr, certFile, keyFile string) {
+	fatalWith(ExitUsage, "DoH server is not supported by this build (built with the nodns tag)")
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// getEndpoints builds the list of MASQUE endpoints to connect to.
+// If the config has an endpoint list, it is used as-is in the given order.
+// Otherwise the single IPv4 or IPv6 endpoint (depending on --ipv6) is used with --connect-port.
+// With --happy-eyeballs, both the IPv6 and IPv4 endpoints are raced against each other.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - cfg: *config.Config - The config with the endpoints.
+//
+// Returns:
+//   - *api.EndpointList: The endpoints in order of priority.
+//   - error: An error if the flags or endpoints are invalid.
+func getEndpoints(cmd *cobra.Command, cfg *config.Config) (*api.EndpointList, error) {
+	happyEyeballs, err := cmd.Flags().GetBool("happy-eyeballs")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get happy-eyeballs flag: %v", err)
+	}
+
+	var list *api.EndpointList
+	if len(cfg.Endpoints) > 0 {
+		var endpoints []*net.UDPAddr
+		for _, entry := range cfg.Endpoints {
+			endpoint, err := net.ResolveUDPAddr("udp", entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid endpoint %q: %v", entry, err)
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		if list, err = api.NewEndpointList(endpoints); err != nil {
+			return nil, err
+		}
+	} else if list, err = legacyEndpoints(cmd, cfg, happyEyeballs); err != nil {
+		return nil, err
+	}
+
+	if happyEyeballs {
+		list.HappyEyeballsDelay = api.DefaultConnectionAttemptDelay
+	}
+
+	return list, nil
+}
+
+// legacyEndpoints builds the endpoint list from the endpoint_v4 and endpoint_v6 config fields.
+func legacyEndpoints(cmd *cobra.Command, cfg *config.Config, dualStack bool) (*api.EndpointList, error) {
+
+	connectPort, err := cmd.Flags().GetInt("connect-port")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connect port: %v", err)
+	}
+
+	ipv6, err := cmd.Flags().GetBool("ipv6")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ipv6 flag: %v", err)
+	}
+
+	v4 := &net.UDPAddr{
+		IP:   net.ParseIP(cfg.EndpointV4),
+		Port: connectPort,
+	}
+	v6 := &net.UDPAddr{
+		IP:   net.ParseIP(cfg.EndpointV6),
+		Port: connectPort,
+	}
+
+	if dualStack {
+		// RFC 8305 prefers IPv6
+		return api.NewEndpointList([]*net.UDPAddr{v6, v4})
+	}
+
+	if ipv6 {
+		return api.NewEndpointList([]*net.UDPAddr{v6})
+	}
+	return api.NewEndpointList([]*net.UDPAddr{v4})
+}
+
+// loadEndpointBlocklist loads the persisted api.DefaultTunnel.Blocklist, from --endpoint-blocklist or next
+// to the config. With --endpoint-blocklist none it's only kept in memory.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+func loadEndpointBlocklist(cmd *cobra.Command) {
+	path, err := cmd.Flags().GetString("endpoint-blocklist")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get endpoint blocklist path: %v", err)
+	}
+	if path == "none" {
+		return
+	}
+	if path == "" {
+		configPath, err := getConfigPath(cmd)
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get config path: %v", err)
+		}
+		path = strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".blocklist.json"
+	}
+	if err := api.DefaultTunnel.Blocklist.Load(path); err != nil {
+		fatalWith(ExitConfig, "Failed to load endpoint blocklist: %v", err)
+	}
+}
+
+func init() {
+	rootCmd.PersistentFlags().String("endpoint-blocklist", "", "File remembering endpoints that passed no data, so they are avoided for hours across restarts (default is next to the config, none to not persist it)")
+}
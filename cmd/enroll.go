@@ -20,26 +20,25 @@ var enrollCmd = &cobra.Command{
 		" Or if you just want to deploy a new key.",
 	Run: func(cmd *cobra.Command, args []string) {
 		if !config.ConfigLoaded {
-			cmd.Println("Config not loaded. Please register first.")
-			return
+			exitNotRegistered(cmd)
 		}
 
-		configPath, err := cmd.Flags().GetString("config")
+		configPath, err := getConfigPath(cmd)
 		if err != nil {
-			log.Fatalf("Failed to get config path: %v", err)
+			fatalWith(ExitUsage, "Failed to get config path: %v", err)
 		}
 		if configPath == "" {
-			log.Fatalf("Config path is required")
+			fatalWith(ExitUsage, "Config path is required")
 		}
 
 		deviceName, err := cmd.Flags().GetString("name")
 		if err != nil {
-			log.Fatalf("Failed to get device name: %v", err)
+			fatalWith(ExitUsage, "Failed to get device name: %v", err)
 		}
 
 		regenKey, err := cmd.Flags().GetBool("regen-key")
 		if err != nil {
-			log.Fatalf("Failed to get regen-key: %v", err)
+			fatalWith(ExitUsage, "Failed to get regen-key: %v", err)
 		}
 
 		log.Printf("Enrolling device key...")
@@ -58,22 +57,22 @@ var enrollCmd = &cobra.Command{
 			log.Printf("Regenerating key pair...")
 			privKeyBytes, publicKey, err = internal.GenerateEcKeyPair()
 			if err != nil {
-				log.Fatalf("Failed to generate key pair: %v", err)
+				fatalWith(ExitFailure, "Failed to generate key pair: %v", err)
 			}
 		} else {
 			privKey, err := config.AppConfig.GetEcPrivateKey()
 			if err != nil {
-				log.Fatalf("Failed to get private key: %v", err)
+				fatalWith(ExitConfig, "Failed to get private key: %v", err)
 			}
 
 			publicKey, err = x509.MarshalPKIXPublicKey(&privKey.PublicKey)
 			if err != nil {
-				log.Fatalf("Failed to marshal public key: %v", err)
+				fatalWith(ExitFailure, "Failed to marshal public key: %v", err)
 			}
 
 			privKeyBytes, err = x509.MarshalECPrivateKey(privKey)
 			if err != nil {
-				log.Fatalf("Failed to marshal private key: %v", err)
+				fatalWith(ExitFailure, "Failed to marshal private key: %v", err)
 			}
 		}
 
@@ -84,29 +83,29 @@ var enrollCmd = &cobra.Command{
 
 				var response string
 				if _, err := fmt.Scanln(&response); err != nil {
-					log.Fatalf("Failed to read user input: %v", err)
+					fatalWith(ExitFailure, "Failed to read user input: %v", err)
 				}
 
 				if response == "y" {
 					log.Printf("Regenerating key pair...")
 					privKeyBytes, publicKey, err = internal.GenerateEcKeyPair()
 					if err != nil {
-						log.Fatalf("Failed to generate key pair: %v", err)
+						fatalWith(ExitFailure, "Failed to generate key pair: %v", err)
 					}
 
 					log.Println("Re-enrolling device key with new key pair...")
 					updatedAccountData, apiErr, err = api.EnrollKey(accountData, publicKey, deviceName)
 					if err != nil {
 						if apiErr != nil {
-							log.Fatalf("Failed to enroll key: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
+							fatalWith(ExitAuth, "Failed to enroll key: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
 						}
-						log.Fatalf("Failed to enroll key: %v", err)
+						fatalWith(ExitAuth, "Failed to enroll key: %v", err)
 					}
 				} else {
-					log.Fatalf("Enrollment aborted by user. API errors: %s", apiErr.ErrorsAsString("; "))
+					fatalWith(ExitAuth, "Enrollment aborted by user. API errors: %s", apiErr.ErrorsAsString("; "))
 				}
 			} else {
-				log.Fatalf("Failed to enroll key: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
+				fatalWith(ExitAuth, "Failed to enroll key: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
 			}
 		}
 
@@ -120,14 +119,19 @@ var enrollCmd = &cobra.Command{
 			// strip [ from beginning and ]:0 from end
 			EndpointV6:     updatedAccountData.Config.Peers[0].Endpoint.V6[1 : len(updatedAccountData.Config.Peers[0].Endpoint.V6)-3],
 			EndpointPubKey: updatedAccountData.Config.Peers[0].PublicKey,
+			Endpoints:      config.AppConfig.Endpoints,
 			License:        updatedAccountData.Account.License,
 			ID:             updatedAccountData.ID,
 			AccessToken:    accountData.Token,
 			IPv4:           updatedAccountData.Config.Interface.Addresses.V4,
 			IPv6:           updatedAccountData.Config.Interface.Addresses.V6,
+			Secrets:        config.AppConfig.Secrets,
+			WireGuard:      config.AppConfig.WireGuard,
 		}
 
-		config.AppConfig.SaveConfig(configPath)
+		if err := config.AppConfig.SaveConfig(configPath); err != nil {
+			fatalWith(ExitConfig, "Failed to save config: %v", err)
+		}
 
 		log.Printf("Config saved to %s", configPath)
 	},
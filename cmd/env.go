@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// EnvPrefix is the prefix of the environment variables setting flags, e.g. USQUE_FLAG_MTU for
+// --mtu. It is kept apart from the USQUE_* variables of the env secret backend and hook scripts,
+// which would otherwise set flags such as --access-token of a usque run by a hook.
+const EnvPrefix = "USQUE_FLAG_"
+
+// flagEnvNames returns the environment variables of a flag, most specific first: the one
+// qualified with the command, e.g. USQUE_FLAG_SOCKS_PORT, and the plain one, e.g.
+// USQUE_FLAG_PORT.
+func flagEnvNames(cmd *cobra.Command, flag string) []string {
+	name := strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+	command := strings.ToUpper(strings.ReplaceAll(cmd.Name(), "-", "_"))
+	return []string{EnvPrefix + command + "_" + name, EnvPrefix + name}
+}
+
+// applyEnvFlags sets the flags not given on the command line from their environment variables,
+// see flagEnvNames. A flag set this way counts as given. Values of repeatable flags are
+// separated by commas.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are set.
+//
+// Returns:
+//   - error: An error if a value is invalid for its flag.
+func applyEnvFlags(cmd *cobra.Command) error {
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || flag.Name == "help" {
+			return
+		}
+		for _, env := range flagEnvNames(cmd, flag.Name) {
+			value, ok := os.LookupEnv(env)
+			if !ok {
+				continue
+			}
+			values := []string{value}
+			if flag.Value.Type() == "stringArray" {
+				values = strings.Split(value, ",")
+			}
+			for _, value := range values {
+				if setErr := cmd.Flags().Set(flag.Name, value); setErr != nil {
+					err = fmt.Errorf("invalid %s: %v", env, setErr)
+					return
+				}
+			}
+			return
+		}
+	})
+	return err
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestApplyEnvFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		port    int
+		dns     []string
+		changed bool
+		wantErr string
+	}{
+		{name: "unset", port: 1080},
+		{name: "plain variable", env: map[string]string{EnvPrefix + "PORT": "2000"}, port: 2000, changed: true},
+		{
+			name:    "qualified variable first",
+			env:     map[string]string{EnvPrefix + "PORT": "2000", EnvPrefix + "SOCKS_PORT": "3000"},
+			port:    3000,
+			changed: true,
+		},
+		{name: "command line first", args: []string{"--port", "4000"}, env: map[string]string{EnvPrefix + "SOCKS_PORT": "3000"}, port: 4000, changed: true},
+		{name: "repeatable flag", env: map[string]string{EnvPrefix + "DNS": "1.1.1.1,9.9.9.9"}, port: 1080, dns: []string{"1.1.1.1", "9.9.9.9"}},
+		{name: "repeatable flag on the command line", args: []string{"--dns", "8.8.8.8"}, env: map[string]string{EnvPrefix + "DNS": "1.1.1.1"}, port: 1080, dns: []string{"8.8.8.8"}},
+		{name: "invalid value", env: map[string]string{EnvPrefix + "SOCKS_PORT": "many"}, wantErr: EnvPrefix + "SOCKS_PORT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			cmd := &cobra.Command{Use: "socks"}
+			cmd.Flags().Int("port", 1080, "")
+			cmd.Flags().StringArray("dns", nil, "")
+			if err := cmd.ParseFlags(tt.args); err != nil {
+				t.Fatalf("ParseFlags: %v", err)
+			}
+
+			err := applyEnvFlags(cmd)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("applyEnvFlags error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyEnvFlags: %v", err)
+			}
+			port, _ := cmd.Flags().GetInt("port")
+			dns, _ := cmd.Flags().GetStringArray("dns")
+			if port != tt.port || !slices.Equal(dns, tt.dns) {
+				t.Errorf("port, dns = %d, %q, want %d, %q", port, dns, tt.port, tt.dns)
+			}
+			if changed := cmd.Flags().Changed("port"); changed != tt.changed {
+				t.Errorf("port changed = %v, want %v", changed, tt.changed)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// Exit codes of the process, so supervisors (systemd, Docker, procd) can tell a failure worth
+// restarting for from one that needs the user. They are documented in the README.
+const (
+	ExitOK       = 0 // clean shutdown
+	ExitFailure  = 1 // any failure not covered below
+	ExitUsage    = 2 // unknown command, flag or argument
+	ExitConfig   = 3 // the config is missing, unreadable or invalid
+	ExitAuth     = 4 // the registration was refused, register again
+	ExitTUN      = 5 // the TUN device or the network setup around it is unavailable
+	ExitEndpoint = 6 // no endpoint could be reached
+	ExitProtocol = 7 // the tunnel failed for a reason other than reachability
+)
+
+// exitWith prints a message and terminates the process with the given exit code.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command the message is printed for.
+//   - code: int - One of the Exit* codes.
+//   - format: string - The message format, as for cmd.Printf.
+//   - args: ...any - The message arguments.
+func exitWith(cmd *cobra.Command, code int, format string, args ...any) {
+	cmd.Printf(format, args...)
+	exit(code)
+}
+
+// fatalWith logs a message and terminates the process with the given exit code, like log.Fatalf
+// but with a specific code.
+//
+// Parameters:
+//   - code: int - One of the Exit* codes.
+//   - format: string - The message format, as for log.Printf.
+//   - args: ...any - The message arguments.
+func fatalWith(code int, format string, args ...any) {
+	log.Printf(format, args...)
+	exit(code)
+}
+
+var (
+	exitCleanupMu sync.Mutex
+	exitCleanup   func()
+)
+
+// setExitCleanup registers the function undoing the system changes of the running command. It
+// runs before exitWith and fatalWith terminate the process, so a setup step or the
+// --exit-after-failures limit failing after nativetun changed the routes doesn't leave them
+// behind.
+//
+// Parameters:
+//   - cleanup: func() - The function to run, nil to unregister.
+func setExitCleanup(cleanup func()) {
+	exitCleanupMu.Lock()
+	defer exitCleanupMu.Unlock()
+	exitCleanup = cleanup
+}
+
+// exit runs the registered exit cleanup and terminates the process with the given code.
+//
+// Parameters:
+//   - code: int - One of the Exit* codes.
+func exit(code int) {
+	exitCleanupMu.Lock()
+	cleanup := exitCleanup
+	exitCleanupMu.Unlock()
+	if cleanup != nil {
+		cleanup()
+	}
+	os.Exit(code)
+}
+
+// exitNotRegistered terminates the process when a command needs a config that isn't loaded.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command that needs the config.
+func exitNotRegistered(cmd *cobra.Command) {
+	exitWith(cmd, ExitConfig, "Config not loaded. Please register first.\n")
+}
+
+// reconnectExitCode maps the reason of a reconnect decision to the exit code reported when the
+// process gives up on the tunnel.
+//
+// Parameters:
+//   - reason: string - One of the api.Reconnect* reasons.
+//
+// Returns:
+//   - int: The exit code.
+func reconnectExitCode(reason string) int {
+	switch reason {
+	case api.ReconnectRejected:
+		return ExitAuth
+	case api.ReconnectConnectFailed, api.ReconnectIdleTimeout:
+		return ExitEndpoint
+	case api.ReconnectDevice:
+		return ExitTUN
+	}
+	return ExitProtocol
+}
+
+// setupExitAfterFailures makes the process exit once the tunnel failed --exit-after-failures times
+// in a row without connecting, with the exit code of the last failure. By default usque retries
+// forever, which hides a lost registration or a blocked network from the supervisor.
+// It wraps the hooks set up before it, so it has to run after setupHookScript.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - error: An error if the flag can't be read.
+func setupExitAfterFailures(cmd *cobra.Command) error {
+	limit, err := cmd.Flags().GetInt("exit-after-failures")
+	if err != nil {
+		return err
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	var failures atomic.Int64
+	onConnect, onReconnect := api.Hooks.OnConnect, api.Hooks.OnReconnect
+	api.Hooks.OnConnect = func(endpoint *net.UDPAddr) {
+		failures.Store(0)
+		if onConnect != nil {
+			onConnect(endpoint)
+		}
+	}
+	api.Hooks.OnReconnect = func(decision api.ReconnectDecision) {
+		if onReconnect != nil {
+			onReconnect(decision)
+		}
+		// user-initiated reconnects aren't failures
+		if decision.Reason == api.ReconnectRequested || decision.Reason == api.ReconnectNetworkChanged {
+			return
+		}
+		if failures.Add(1) >= int64(limit) {
+			fatalWith(reconnectExitCode(decision.Reason), "Giving up after %d consecutive tunnel failures, last: %s", limit, decision)
+		}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().Int("exit-after-failures", 0, "Exit after this many consecutive tunnel failures with a code telling the cause (0 retries forever)")
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+// quicVarintMax is the largest value a QUIC variable-length integer can hold,
+// which limits HTTP/3 setting identifiers and values.
+const quicVarintMax = 1<<62 - 1
+
+// applyExpertConfig applies the expert section of the config if --expert is set.
+// Without the flag, the section is ignored so a forgotten experiment can't silently break the tunnel.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - error: An error if the expert section is invalid.
+func applyExpertConfig(cmd *cobra.Command) error {
+	expert, err := cmd.Flags().GetBool("expert")
+	if err != nil {
+		return err
+	}
+
+	if config.AppConfig.Expert == nil {
+		return nil
+	}
+	if !expert {
+		log.Println("Ignoring the expert section of the config, pass --expert to apply it")
+		return nil
+	}
+
+	if config.AppConfig.Expert.ContextID != 0 {
+		return fmt.Errorf("context ID %d is not supported, connect-ip-go only proxies IP payloads with context ID 0", config.AppConfig.Expert.ContextID)
+	}
+
+	for key, value := range config.AppConfig.Expert.H3Settings {
+		id, err := strconv.ParseUint(key, 0, 64)
+		if err != nil || id > quicVarintMax {
+			return fmt.Errorf("invalid HTTP/3 setting identifier %q", key)
+		}
+		if value > quicVarintMax {
+			return fmt.Errorf("HTTP/3 setting %s value %d is too large", key, value)
+		}
+		internal.H3Settings[id] = value
+	}
+
+	log.Printf("Warning: expert mode enabled, sending HTTP/3 settings %v", internal.H3Settings)
+	return nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().Bool("expert", false, "Apply the expert section of the config (protocol experiments, may break connectivity)")
+}
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/models"
+	"github.com/spf13/cobra"
+)
+
+// wireGuardPort is the port of the WireGuard endpoints, used when the API only returns addresses.
+const wireGuardPort = "2408"
+
+var exportWireGuardCmd = &cobra.Command{
+	Use:   "export-wireguard",
+	Short: "Write a wg-quick profile for devices that can't run usque",
+	Long: "Enrolls a new curve25519 key and writes a wg-quick config with it, for routers and other devices that" +
+		" only speak WireGuard. A device has a single key, so by default this switches the device of the config" +
+		" to WireGuard and usque stops working with it until enroll switches it back. With --new-device a" +
+		" separate device is registered for the profile instead and the config keeps working.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get output path: %v", err)
+		}
+		newDevice, err := cmd.Flags().GetBool("new-device")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get new-device flag: %v", err)
+		}
+		acceptTos, err := cmd.Flags().GetBool("accept-tos")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get accept-tos flag: %v", err)
+		}
+		deviceName, err := cmd.Flags().GetString("name")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get device name: %v", err)
+		}
+		fallback, err := cmd.Flags().GetBool("fallback")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get fallback flag: %v", err)
+		}
+		if fallback {
+			if !newDevice {
+				exitWith(cmd, ExitUsage, "--fallback needs --new-device, the device of the config has to keep its MASQUE key\n")
+			}
+			if !config.ConfigLoaded {
+				exitNotRegistered(cmd)
+			}
+		} else if output != "-" {
+			if _, err := os.Stat(output); err == nil {
+				exitWith(cmd, ExitUsage, "%s already exists, choose another path with --output\n", output)
+			}
+		}
+
+		var accountData models.AccountData
+		if newDevice {
+			log.Printf("Registering a new device for the WireGuard profile")
+			profile := api.DeviceProfile{Model: internal.DefaultModel, Locale: internal.DefaultLocale}
+			if accountData, err = api.RegisterDevice(profile, "", acceptTos); err != nil {
+				fatalWith(ExitAuth, "Failed to register: %v", err)
+			}
+		} else {
+			if !config.ConfigLoaded {
+				exitNotRegistered(cmd)
+			}
+			fmt.Printf("This replaces the MASQUE key of device %s, usque stops working with it until you run enroll. Continue? (y/n) ", config.AppConfig.ID)
+			var response string
+			if _, err := fmt.Scanln(&response); err != nil {
+				fatalWith(ExitFailure, "Failed to read response: %v", err)
+			}
+			if response != "y" {
+				return
+			}
+			accountData = models.AccountData{
+				ID:    config.AppConfig.ID,
+				Token: config.AppConfig.AccessToken,
+			}
+		}
+
+		privKey, pubKey, err := internal.GenerateWgKeyPair()
+		if err != nil {
+			fatalWith(ExitFailure, "Failed to generate key pair: %v", err)
+		}
+		log.Printf("Enrolling WireGuard key...")
+		updatedAccountData, apiErr, err := api.EnrollWireGuardKey(accountData, pubKey, deviceName)
+		if err != nil {
+			if apiErr != nil {
+				fatalWith(ExitAuth, "Failed to enroll key: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
+			}
+			fatalWith(ExitAuth, "Failed to enroll key: %v", err)
+		}
+
+		if fallback {
+			configPath, err := getConfigPath(cmd)
+			if err != nil {
+				fatalWith(ExitUsage, "Failed to get config path: %v", err)
+			}
+			peerKey, endpoint, err := wireGuardPeer(updatedAccountData)
+			if err != nil {
+				fatalWith(ExitProtocol, "Failed to set up WireGuard fallback: %v", err)
+			}
+			config.AppConfig.WireGuard = &config.WireGuard{
+				PrivateKey:    base64.StdEncoding.EncodeToString(privKey),
+				PeerPublicKey: peerKey,
+				Endpoint:      endpoint,
+				ID:            updatedAccountData.ID,
+				IPv4:          updatedAccountData.Config.Interface.Addresses.V4,
+				IPv6:          updatedAccountData.Config.Interface.Addresses.V6,
+			}
+			if err := config.AppConfig.SaveConfig(configPath); err != nil {
+				fatalWith(ExitConfig, "Failed to save config: %v", err)
+			}
+			log.Printf("WireGuard fallback saved to %s, tunnels switch to it when MASQUE keeps failing", configPath)
+			return
+		}
+
+		profile, err := wireGuardProfile(privKey, updatedAccountData)
+		if err != nil {
+			fatalWith(ExitProtocol, "Failed to build WireGuard profile: %v", err)
+		}
+		if output == "-" {
+			fmt.Print(profile)
+			return
+		}
+		// holds the private key
+		if err := os.WriteFile(output, []byte(profile), 0600); err != nil {
+			fatalWith(ExitFailure, "Failed to write WireGuard profile: %v", err)
+		}
+		log.Printf("WireGuard profile saved to %s, bring it up with: wg-quick up ./%s", output, strings.TrimPrefix(output, "./"))
+		if !newDevice {
+			log.Printf("Run enroll to switch the device back to MASQUE for usque")
+		}
+	},
+}
+
+func init() {
+	exportWireGuardCmd.Flags().StringP("output", "o", "warp.conf", "Path of the wg-quick config, - for stdout. wg-quick names the interface after the file")
+	exportWireGuardCmd.Flags().Bool("new-device", false, "Register a separate device for the profile instead of switching the one of the config")
+	exportWireGuardCmd.Flags().BoolP("accept-tos", "a", false, "accept Cloudflare TOS when registering with --new-device (not interactive setup)")
+	exportWireGuardCmd.Flags().StringP("name", "n", "", "device name")
+	exportWireGuardCmd.Flags().Bool("fallback", false, "Save the new device to the config as the WireGuard fallback of the tunnel instead of writing a profile, needs --new-device")
+	rootCmd.AddCommand(exportWireGuardCmd)
+}
+
+// wireGuardProfile builds a wg-quick config that routes everything through the WireGuard peer
+// of an account.
+//
+// Parameters:
+//   - privKey: []byte - The enrolled curve25519 private key.
+//   - account: models.AccountData - The account data returned by the enrollment.
+//
+// Returns:
+//   - string: The wg-quick config.
+//   - error: An error if the account has no WireGuard peer.
+func wireGuardProfile(privKey []byte, account models.AccountData) (string, error) {
+	peerKey, endpoint, err := wireGuardPeer(account)
+	if err != nil {
+		return "", err
+	}
+
+	var addresses []string
+	if v4 := account.Config.Interface.Addresses.V4; v4 != "" {
+		addresses = append(addresses, v4+"/32")
+	}
+	if v6 := account.Config.Interface.Addresses.V6; v6 != "" {
+		addresses = append(addresses, v6+"/128")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", base64.StdEncoding.EncodeToString(privKey))
+	fmt.Fprintf(&b, "Address = %s\n", strings.Join(addresses, ", "))
+	fmt.Fprintf(&b, "DNS = 1.1.1.1, 1.0.0.1, 2606:4700:4700::1111, 2606:4700:4700::1001\n")
+	fmt.Fprintf(&b, "MTU = 1280\n")
+	fmt.Fprintf(&b, "\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", peerKey)
+	fmt.Fprintf(&b, "AllowedIPs = 0.0.0.0/0, ::/0\n")
+	fmt.Fprintf(&b, "Endpoint = %s\n", endpoint)
+	return b.String(), nil
+}
+
+// wireGuardPeer returns the WireGuard peer of an account.
+//
+// Parameters:
+//   - account: models.AccountData - The account data returned by the enrollment.
+//
+// Returns:
+//   - string: The base64 public key of the peer.
+//   - string: The host:port endpoint of the peer.
+//   - error: An error if the account has no WireGuard peer.
+func wireGuardPeer(account models.AccountData) (string, string, error) {
+	if len(account.Config.Peers) == 0 {
+		return "", "", fmt.Errorf("the account has no peer")
+	}
+	peer := account.Config.Peers[0]
+	if peerKey, err := base64.StdEncoding.DecodeString(peer.PublicKey); err != nil || len(peerKey) != 32 {
+		return "", "", fmt.Errorf("the peer key %q isn't a WireGuard key", peer.PublicKey)
+	}
+
+	endpoint := peer.Endpoint.Host
+	if endpoint == "" {
+		host, _, err := net.SplitHostPort(peer.Endpoint.V4)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid peer endpoint %q: %v", peer.Endpoint.V4, err)
+		}
+		endpoint = net.JoinHostPort(host, wireGuardPort)
+	}
+	return peer.PublicKey, endpoint, nil
+}
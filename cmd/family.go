@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// tunnelAddresses returns the tunnel addresses of the address families used inside the tunnel.
+// The families follow tunnel_family in the config, narrowed down by --no-tunnel-ipv4 and
+// --no-tunnel-ipv6 on the commands that have them. The address of a disabled family isn't
+// parsed, so configs without one work on single-stack hosts.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - cfg: *config.Config - The config with the tunnel addresses.
+//
+// Returns:
+//   - netip.Addr: The IPv4 address, invalid if IPv4 is disabled.
+//   - netip.Addr: The IPv6 address, invalid if IPv6 is disabled.
+//   - error: An error if both families are disabled or an address is invalid.
+func tunnelAddresses(cmd *cobra.Command, cfg *config.Config) (netip.Addr, netip.Addr, error) {
+	var ipv4, ipv6 bool
+	switch cfg.TunnelFamily {
+	case "":
+		ipv4, ipv6 = true, true
+	case "ipv4":
+		ipv4 = true
+	case "ipv6":
+		ipv6 = true
+	default:
+		return netip.Addr{}, netip.Addr{}, fmt.Errorf("invalid tunnel family %q, expected ipv4 or ipv6", cfg.TunnelFamily)
+	}
+
+	for _, family := range []struct {
+		flag    string
+		enabled *bool
+	}{
+		{"no-tunnel-ipv4", &ipv4},
+		{"no-tunnel-ipv6", &ipv6},
+	} {
+		if cmd.Flags().Lookup(family.flag) == nil {
+			continue
+		}
+		disabled, err := cmd.Flags().GetBool(family.flag)
+		if err != nil {
+			return netip.Addr{}, netip.Addr{}, err
+		}
+		if disabled {
+			*family.enabled = false
+		}
+	}
+	if !ipv4 && !ipv6 {
+		return netip.Addr{}, netip.Addr{}, fmt.Errorf("IPv4 and IPv6 are both disabled inside the tunnel")
+	}
+
+	var v4, v6 netip.Addr
+	var err error
+	if ipv4 {
+		if v4, err = netip.ParseAddr(cfg.IPv4); err != nil || !v4.Is4() {
+			return netip.Addr{}, netip.Addr{}, fmt.Errorf("invalid IPv4 address %q in config", cfg.IPv4)
+		}
+	}
+	if ipv6 {
+		if v6, err = netip.ParseAddr(cfg.IPv6); err != nil || !v6.Is6() {
+			return netip.Addr{}, netip.Addr{}, fmt.Errorf("invalid IPv6 address %q in config", cfg.IPv6)
+		}
+	}
+	return v4, v6, nil
+}
+
+// withFamilyFilter wraps the device in an api.FamilyFilterDevice if only one address family is
+// used inside the tunnel, so packets of the other family neither reach the server nor the device.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - dev: api.TunnelDevice - The device to wrap.
+//
+// Returns:
+//   - api.TunnelDevice: The wrapped device, or dev itself if both families are used.
+func withFamilyFilter(cmd *cobra.Command, dev api.TunnelDevice) api.TunnelDevice {
+	v4, v6, err := tunnelAddresses(cmd, &config.AppConfig)
+	if err != nil {
+		fatalWith(ExitConfig, "Failed to get tunnel addresses: %v", err)
+	}
+	if v4.IsValid() && v6.IsValid() {
+		return dev
+	}
+	return api.NewFamilyFilterDevice(api.DefaultTunnel, dev, v4.IsValid(), v6.IsValid())
+}
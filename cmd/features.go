@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// applyFeatures applies the features section of the config and then --feature, so flags win.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - cfg: *config.Config - The config with the feature switches.
+//
+// Returns:
+//   - error: An error if a feature is unknown or a switch is invalid.
+func applyFeatures(cmd *cobra.Command, cfg *config.Config) error {
+	for name, enabled := range cfg.Features {
+		if err := api.Features.Set(api.Feature(name), enabled); err != nil {
+			return err
+		}
+	}
+
+	entries, err := cmd.Flags().GetStringArray("feature")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid feature switch %q, expected name=on or name=off", entry)
+		}
+		enabled, err := parseSwitch(value)
+		if err != nil {
+			return fmt.Errorf("invalid feature switch %q: %v", entry, err)
+		}
+		if err := api.Features.Set(api.Feature(name), enabled); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseSwitch parses on/off in addition to the values strconv.ParseBool accepts.
+func parseSwitch(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringArray("feature", nil, "Switch an experimental feature on or off (name=on|off, repeatable): ecn, gso, racing")
+}
@@ -0,0 +1,47 @@
+//go:build !nometrics
+
+package cmd
+
+import (
+	"log"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// withFlowExport wraps the device in an api.FlowDevice and starts exporting flows
+// to an IPFIX collector if --flow-collector is set.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - dev: api.TunnelDevice - The device to wrap.
+//
+// Returns:
+//   - api.TunnelDevice: The wrapped device, or dev itself if flow export is disabled.
+func withFlowExport(cmd *cobra.Command, dev api.TunnelDevice) api.TunnelDevice {
+	collector, err := cmd.Flags().GetString("flow-collector")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get flow collector: %v", err)
+	}
+	if collector == "" {
+		return dev
+	}
+
+	interval, err := cmd.Flags().GetDuration("flow-interval")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get flow interval: %v", err)
+	}
+	if interval <= 0 {
+		fatalWith(ExitUsage, "Flow interval must be positive")
+	}
+
+	tracker := api.NewFlowTracker()
+	go func() {
+		log.Printf("Exporting IPFIX flow records to %s every %s", collector, interval)
+		if err := api.ExportFlows(tracker, collector, interval); err != nil {
+			log.Printf("Flow export stopped: %v", err)
+		}
+	}()
+
+	return api.NewFlowDevice(dev, tracker)
+}
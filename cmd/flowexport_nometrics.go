@@ -0,0 +1,15 @@
+//go:build nometrics
+
+package cmd
+
+import (
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+func withFlowExport(cmd *cobra.Command, dev api.TunnelDevice) api.TunnelDevice {
+	if collector, _ := cmd.Flags().GetString("flow-collector"); collector != "" {
+		fatalWith(ExitUsage, "Flow export is not supported by this build (built with the nometrics tag)")
+	}
+	return dev
+}
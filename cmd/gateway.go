@@ -0,0 +1,318 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/spf13/cobra"
+)
+
+var gatewayCmd = &cobra.Command{
+	Use:   "gateway",
+	Short: "Relay the tunnel to other MASQUE clients (experimental)",
+	Long: "Accepts connect-ip clients over HTTP/3, such as other usque instances on the LAN, and relays their traffic through the tunnel." +
+		" One enrolled device becomes the gateway of many MASQUE speaking clients this way." +
+		" Clients are translated to the tunnel addresses, only TCP, UDP and ICMP echo are relayed." +
+		" Clients pin the public key printed at startup, a usque client puts it in endpoint_pub_key and the gateway address in endpoint_v4 or endpoint_v6.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.ConfigLoaded {
+			exitNotRegistered(cmd)
+		}
+
+		sni, err := getSNI(cmd)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get SNI address: %v\n", err)
+		}
+
+		privKey, err := config.AppConfig.GetEcPrivateKey()
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get private key: %v\n", err)
+		}
+		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get public key: %v\n", err)
+		}
+
+		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to generate cert: %v\n", err)
+		}
+
+		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to prepare TLS config: %v\n", err)
+		}
+
+		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get keepalive period: %v\n", err)
+		}
+		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get initial packet size: %v\n", err)
+		}
+
+		endpoints, err := getEndpoints(cmd, &config.AppConfig)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get endpoints: %v\n", err)
+		}
+
+		mtu, err := cmd.Flags().GetInt("mtu")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get MTU: %v\n", err)
+		}
+		if err := checkMTU(mtu); err != nil {
+			exitWith(cmd, ExitUsage, "Invalid MTU: %v\n", err)
+		}
+
+		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get reconnect delay: %v\n", err)
+		}
+
+		v4, v6, err := tunnelAddresses(cmd, &config.AppConfig)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get tunnel addresses: %v\n", err)
+		}
+
+		listen, err := cmd.Flags().GetString("listen")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get listen address: %v\n", err)
+		}
+
+		keyPath, err := cmd.Flags().GetString("key")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get gateway key path: %v\n", err)
+		}
+
+		clientKeyPaths, err := cmd.Flags().GetStringArray("allow-client")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get allowed clients: %v\n", err)
+		}
+
+		noUpstream, err := cmd.Flags().GetBool("no-upstream")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get no-upstream flag: %v\n", err)
+		}
+
+		allowAny, err := cmd.Flags().GetBool("allow-any")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get allow-any flag: %v\n", err)
+		}
+		// a gateway without an upstream relays nothing, it can't be abused
+		if len(clientKeyPaths) == 0 && !allowAny && !noUpstream {
+			exitWith(cmd, ExitUsage, "Refusing to relay the tunnel for any client, give the clients with --allow-client or pass --allow-any\n")
+		}
+
+		gatewayKey, err := loadGatewayKey(keyPath)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to load gateway key: %v\n", err)
+		}
+
+		var clientKeys []*ecdsa.PublicKey
+		for _, path := range clientKeyPaths {
+			key, err := loadPublicKey(path)
+			if err != nil {
+				exitWith(cmd, ExitConfig, "Failed to load client key %s: %v\n", path, err)
+			}
+			clientKeys = append(clientKeys, key)
+		}
+
+		serverTlsConfig, err := gatewayTlsConfig(gatewayKey, clientKeys)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to prepare gateway TLS config: %v\n", err)
+		}
+
+		dev := api.NewGatewayDevice(internal.ConnectURI, v4, v6, mtu)
+		defer dev.Close()
+
+		server := &http3.Server{
+			Addr:            listen,
+			Handler:         dev,
+			TLSConfig:       http3.ConfigureTLSConfig(serverTlsConfig),
+			EnableDatagrams: true,
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatalWith(ExitFailure, "Gateway server failed: %v", err)
+			}
+		}()
+		defer server.Close()
+
+		logEffectiveConfig(cmd, endpoints)
+		watchNetwork(cmd, "")
+		serveControl(cmd, endpoints)
+		watchConfig(cmd, endpoints)
+		setupStandby(cmd)
+		setupWireGuardFallback(cmd)
+		loadEndpointBlocklist(cmd)
+		if noUpstream {
+			log.Println("Running without an upstream tunnel, pings are answered and everything else is dropped")
+			go api.AnswerEchoes(withPcap(cmd, dev))
+		} else {
+			go api.MaintainTunnel(context.Background(), api.DefaultTunnel, tlsConfig, keepalivePeriod, initialPacketSize, endpoints, withPcap(cmd, withChaos(cmd, withMSSClamp(cmd, withInboundFilter(cmd, withFamilyFilter(cmd, withFlowExport(cmd, withPathMTU(cmd, dev))))))), mtu, reconnectDelay)
+		}
+
+		pubKey, err := x509.MarshalPKIXPublicKey(&gatewayKey.PublicKey)
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to marshal gateway public key: %v\n", err)
+		}
+
+		log.Printf("Gateway listening on %s", listen)
+		if len(clientKeys) == 0 && !noUpstream {
+			log.Println("Warning: --allow-any is set, any client reaching the gateway can use the tunnel.")
+		}
+		log.Println("Clients have to trust the following public key (endpoint_pub_key):")
+		log.Print(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKey})))
+
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		<-sigChan
+
+		log.Println("Shutting down...")
+	},
+}
+
+// loadGatewayKey loads the ECDSA key of the gateway, generating and saving one if path doesn't exist yet.
+// The key has to stay the same across runs, since clients pin its public key.
+//
+// Parameters:
+//   - path: string - The path of the PEM encoded key.
+//
+// Returns:
+//   - *ecdsa.PrivateKey: The key.
+//   - error: An error if the key can't be read, parsed or generated.
+func loadGatewayKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key: %v", err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal key: %v", err)
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return nil, fmt.Errorf("failed to save key: %v", err)
+		}
+		log.Printf("Generated a new gateway key in %s", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode key")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key: %v", err)
+	}
+	return key, nil
+}
+
+// loadPublicKey loads a PEM encoded ECDSA public key.
+func loadPublicKey(path string) (*ecdsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key: %v", err)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ECDSA public key")
+	}
+	return ecKey, nil
+}
+
+// gatewayTlsConfig prepares the server TLS config of the gateway. Like the MASQUE endpoints,
+// the gateway authenticates clients by the public key of their self-signed certificate.
+//
+// Parameters:
+//   - key: *ecdsa.PrivateKey - The key of the gateway.
+//   - clientKeys: []*ecdsa.PublicKey - The keys of the allowed clients, empty to allow any client.
+//
+// Returns:
+//   - *tls.Config: The TLS config.
+//   - error: An error if the certificate can't be generated.
+func gatewayTlsConfig(key *ecdsa.PrivateKey, clientKeys []*ecdsa.PublicKey) (*tls.Config, error) {
+	// clients pin the key, the certificate itself is never verified
+	cert, err := internal.GenerateCert(key, &key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: cert, PrivateKey: key}},
+		ClientAuth:   tls.RequestClientCert,
+	}
+	if len(clientKeys) == 0 {
+		return tlsConfig, nil
+	}
+
+	tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		for _, clientKey := range clientKeys {
+			if clientKey.Equal(cert.PublicKey) {
+				return nil
+			}
+		}
+		return fmt.Errorf("client key not allowed")
+	}
+	return tlsConfig, nil
+}
+
+func init() {
+	gatewayCmd.Flags().String("listen", ":443", "UDP address to accept connect-ip clients on")
+	gatewayCmd.Flags().String("key", "gateway.pem", "Path of the gateway key, generated if it doesn't exist")
+	gatewayCmd.Flags().StringArray("allow-client", []string{}, "Path of a PEM public key of a client allowed to connect (can be repeated)")
+	gatewayCmd.Flags().Bool("allow-any", false, "Let any client reaching the gateway use the tunnel, required without --allow-client")
+	gatewayCmd.Flags().Bool("no-upstream", false, "Don't connect a tunnel, answer pings of clients and drop everything else, e.g. to test against a config from config generate --test")
+	gatewayCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
+	gatewayCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	gatewayCmd.Flags().Bool("happy-eyeballs", false, "Race the IPv6 and IPv4 endpoints and use whichever connects first")
+	gatewayCmd.Flags().Bool("watch-network", false, "Reconnect right away when the default route or addresses of the system change")
+	gatewayCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
+	gatewayCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
+	gatewayCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	gatewayCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
+	gatewayCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
+	gatewayCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
+	gatewayCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts after transient failures, rejections wait longer")
+	gatewayCmd.Flags().String("flow-collector", "", "IPFIX collector to export flow records to (e.g. 192.0.2.10:4739)")
+	gatewayCmd.Flags().Duration("flow-interval", 60*time.Second, "How often flow records are exported")
+	gatewayCmd.Flags().Bool("strict-inbound", false, "Drop packets from the server not addressed to the tunnel addresses or --inbound-allow prefixes")
+	gatewayCmd.Flags().StringArray("inbound-allow", []string{}, "Extra destination CIDR accepted from the server with --strict-inbound (can be repeated)")
+	rootCmd.AddCommand(gatewayCmd)
+}
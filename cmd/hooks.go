@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// hookScriptQueueLen is the number of events queued for the hook script while it runs.
+const hookScriptQueueLen = 16
+
+// hookEvent is a state change passed to the hook script.
+type hookEvent struct {
+	name string
+	env  []string
+}
+
+// setupHookScript runs the script given with --hook-script on every state change of the tunnel.
+// The script gets the event (up, down, reconnect, error or standby) as its only argument and the details
+// in USQUE_* environment variables. Events are passed one at a time, in order.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - error: An error if the flag can't be read.
+func setupHookScript(cmd *cobra.Command) error {
+	script, err := cmd.Flags().GetString("hook-script")
+	if err != nil {
+		return err
+	}
+	if script == "" {
+		return nil
+	}
+
+	events := make(chan hookEvent, hookScriptQueueLen)
+	go func() {
+		for event := range events {
+			run := exec.Command(script, event.name)
+			run.Env = append(os.Environ(), event.env...)
+			if output, err := run.CombinedOutput(); err != nil {
+				slog.Warn("Hook script failed", "component", "tunnel", "event", event.name, "error", err, "output", string(output))
+			}
+		}
+	}()
+	send := func(event hookEvent) {
+		select {
+		case events <- event:
+		default:
+			slog.Warn("Hook script is too slow, dropping event", "component", "tunnel", "event", event.name)
+		}
+	}
+
+	api.Hooks = api.TunnelHooks{
+		OnConnect: func(endpoint *net.UDPAddr) {
+			send(hookEvent{name: "up", env: []string{"USQUE_ENDPOINT=" + endpoint.String()}})
+		},
+		OnDisconnect: func(endpoint *net.UDPAddr, err error) {
+			send(hookEvent{name: "down", env: []string{"USQUE_ENDPOINT=" + endpoint.String(), "USQUE_ERROR=" + err.Error()}})
+		},
+		OnReconnect: func(decision api.ReconnectDecision) {
+			send(hookEvent{name: "reconnect", env: []string{
+				"USQUE_ENDPOINT=" + decision.Next,
+				"USQUE_REASON=" + decision.Reason,
+				"USQUE_ERROR=" + decision.Error,
+				fmt.Sprintf("USQUE_DELAY=%d", decision.Delay.Milliseconds()),
+			}})
+		},
+		OnError: func(err error) {
+			send(hookEvent{name: "error", env: []string{"USQUE_ERROR=" + err.Error()}})
+		},
+		OnStandby: func(deviceID string) {
+			send(hookEvent{name: "standby", env: []string{"USQUE_DEVICE_ID=" + deviceID}})
+		},
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().String("hook-script", "", "Executable run on tunnel state changes with the event (up, down, reconnect, error, standby) as argument and details in USQUE_* environment variables")
+}
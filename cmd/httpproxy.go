@@ -23,145 +23,107 @@ var httpProxyCmd = &cobra.Command{
 	Long:  "Dual-stack HTTP proxy with CONNECT support. Doesn't require elevated privileges.",
 	Run: func(cmd *cobra.Command, args []string) {
 		if !config.ConfigLoaded {
-			cmd.Println("Config not loaded. Please register first.")
-			return
+			exitNotRegistered(cmd)
 		}
 
-		sni, err := cmd.Flags().GetString("sni-address")
+		sni, err := getSNI(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get SNI address: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get SNI address: %v\n", err)
 		}
 
 		privKey, err := config.AppConfig.GetEcPrivateKey()
 		if err != nil {
-			cmd.Printf("Failed to get private key: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get private key: %v\n", err)
 		}
 		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
 		if err != nil {
-			cmd.Printf("Failed to get public key: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get public key: %v\n", err)
 		}
 
 		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
 		if err != nil {
-			cmd.Printf("Failed to generate cert: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to generate cert: %v\n", err)
 		}
 
 		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
 		if err != nil {
-			cmd.Printf("Failed to prepare TLS config: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to prepare TLS config: %v\n", err)
 		}
 
 		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
 		if err != nil {
-			cmd.Printf("Failed to get keepalive period: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get keepalive period: %v\n", err)
 		}
 		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
 		if err != nil {
-			cmd.Printf("Failed to get initial packet size: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get initial packet size: %v\n", err)
 		}
 
 		bindAddress, err := cmd.Flags().GetString("bind")
 		if err != nil {
-			cmd.Printf("Failed to get bind address: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get bind address: %v\n", err)
 		}
 
 		port, err := cmd.Flags().GetString("port")
 		if err != nil {
-			cmd.Printf("Failed to get port: %v\n", err)
-			return
-		}
-
-		connectPort, err := cmd.Flags().GetInt("connect-port")
-		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get port: %v\n", err)
 		}
 
-		var endpoint *net.UDPAddr
-		if ipv6, err := cmd.Flags().GetBool("ipv6"); err == nil && !ipv6 {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV4),
-				Port: connectPort,
-			}
-		} else {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV6),
-				Port: connectPort,
-			}
-		}
-
-		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
+		endpoints, err := getEndpoints(cmd, &config.AppConfig)
 		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get endpoints: %v\n", err)
 		}
 
-		tunnelIPv6, err := cmd.Flags().GetBool("no-tunnel-ipv6")
+		v4, v6, err := tunnelAddresses(cmd, &config.AppConfig)
 		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv6: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get tunnel addresses: %v\n", err)
 		}
 
 		var localAddresses []netip.Addr
-		if !tunnelIPv4 {
-			v4, err := netip.ParseAddr(config.AppConfig.IPv4)
-			if err != nil {
-				cmd.Printf("Failed to parse IPv4 address: %v\n", err)
-				return
+		for _, addr := range []netip.Addr{v4, v6} {
+			if addr.IsValid() {
+				localAddresses = append(localAddresses, addr)
 			}
-			localAddresses = append(localAddresses, v4)
-		}
-		if !tunnelIPv6 {
-			v6, err := netip.ParseAddr(config.AppConfig.IPv6)
-			if err != nil {
-				cmd.Printf("Failed to parse IPv6 address: %v\n", err)
-				return
-			}
-			localAddresses = append(localAddresses, v6)
 		}
 
 		dnsServers, err := cmd.Flags().GetStringArray("dns")
 		if err != nil {
-			cmd.Printf("Failed to get DNS servers: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get DNS servers: %v\n", err)
 		}
 
 		var dnsAddrs []netip.Addr
 		for _, dns := range dnsServers {
 			addr, err := netip.ParseAddr(dns)
 			if err != nil {
-				cmd.Printf("Failed to parse DNS server: %v\n", err)
-				return
+				exitWith(cmd, ExitUsage, "Failed to parse DNS server: %v\n", err)
 			}
 			dnsAddrs = append(dnsAddrs, addr)
 		}
 
 		dnsTimeout, err := cmd.Flags().GetDuration("dns-timeout")
 		if err != nil {
-			cmd.Printf("Failed to get DNS timeout: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get DNS timeout: %v\n", err)
+		}
+
+		dnsServeStale, err := cmd.Flags().GetDuration("dns-serve-stale")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DNS serve-stale duration: %v\n", err)
 		}
 
 		localDNS, err := cmd.Flags().GetBool("local-dns")
 		if err != nil {
-			cmd.Printf("Failed to get local-dns flag: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get local-dns flag: %v\n", err)
 		}
 
 		mtu, err := cmd.Flags().GetInt("mtu")
 		if err != nil {
-			cmd.Printf("Failed to get MTU: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get MTU: %v\n", err)
 		}
-		if mtu != 1280 {
+		netstackMTU, err := getNetstackMTU(cmd, mtu, initialPacketSize)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Invalid packet sizes: %v\n", err)
+		}
+		if netstackMTU != 1280 {
 			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
 		}
 
@@ -174,10 +136,34 @@ var httpProxyCmd = &cobra.Command{
 			password = p
 		}
 
+		dohListen, err := cmd.Flags().GetString("doh-listen")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DoH listen address: %v\n", err)
+		}
+
+		dohUpstreamServers, err := cmd.Flags().GetStringArray("doh-upstream")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DoH upstreams: %v\n", err)
+		}
+
+		dohUpstreams, err := internal.ParseDNSUpstreams(dohUpstreamServers)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to parse DoH upstreams: %v\n", err)
+		}
+
+		dohCert, err := cmd.Flags().GetString("doh-cert")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DoH certificate: %v\n", err)
+		}
+
+		dohKey, err := cmd.Flags().GetString("doh-key")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DoH key: %v\n", err)
+		}
+
 		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
 		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get reconnect delay: %v\n", err)
 		}
 
 		var authHeader string
@@ -185,16 +171,34 @@ var httpProxyCmd = &cobra.Command{
 			authHeader = "Basic " + internal.LoginToBase64(username, password)
 		}
 
-		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, mtu)
+		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, netstackMTU)
 		if err != nil {
-			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
-			return
+			exitWith(cmd, ExitTUN, "Failed to create virtual TUN device: %v\n", err)
 		}
 		defer tunDev.Close()
 
 		resolver := internal.GetProxyResolver(localDNS, tunNet, dnsAddrs, dnsTimeout)
 
-		go api.MaintainTunnel(context.Background(), tlsConfig, keepalivePeriod, initialPacketSize, endpoint, api.NewNetstackAdapter(tunDev), mtu, reconnectDelay)
+		logEffectiveConfig(cmd, endpoints)
+		watchNetwork(cmd, "")
+		serveControl(cmd, endpoints)
+		watchConfig(cmd, endpoints)
+		setupStandby(cmd)
+		setupWireGuardFallback(cmd)
+		loadEndpointBlocklist(cmd)
+		go api.MaintainTunnel(context.Background(), api.DefaultTunnel, tlsConfig, keepalivePeriod, initialPacketSize, endpoints, withPcap(cmd, withChaos(cmd, withMSSClamp(cmd, withInboundFilter(cmd, withFamilyFilter(cmd, withFlowExport(cmd, withPathMTU(cmd, api.NewNetstackAdapter(api.DefaultTunnel, tunDev)))))))), mtu, reconnectDelay)
+
+		if dohListen != "" {
+			forwarder := &internal.DNSForwarder{
+				TunNet:     tunNet,
+				Upstreams:  dohUpstreams,
+				Timeout:    dnsTimeout,
+				Cache:      internal.NewDNSCache(0),
+				Available:  api.DefaultTunnel.Status.Connected,
+				ServeStale: dnsServeStale,
+			}
+			serveDoH(forwarder, dohListen, dohCert, dohKey)
+		}
 
 		server := &http.Server{
 			Addr: net.JoinHostPort(bindAddress, port),
@@ -213,8 +217,13 @@ var httpProxyCmd = &cobra.Command{
 			}),
 		}
 
+		listener, err := listenTCP(cmd, server.Addr)
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to listen for HTTP proxy: %v\n", err)
+		}
+
 		log.Printf("HTTP proxy listening on %s:%s\n", bindAddress, port)
-		if err := server.ListenAndServe(); err != nil {
+		if err := server.Serve(listener); err != nil {
 			cmd.Printf("Failed to start HTTP proxy: %v\n", err)
 		}
 	},
@@ -373,14 +382,27 @@ func init() {
 	httpProxyCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
 	httpProxyCmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers to use")
 	httpProxyCmd.Flags().DurationP("dns-timeout", "t", 2*time.Second, "Timeout for DNS queries")
+	httpProxyCmd.Flags().Duration("dns-serve-stale", 0, "How long after their expiry cached DNS answers are still served while the tunnel is down or the DNS servers don't answer (0 to answer SERVFAIL instead)")
 	httpProxyCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	httpProxyCmd.Flags().Bool("happy-eyeballs", false, "Race the IPv6 and IPv4 endpoints and use whichever connects first")
+	httpProxyCmd.Flags().Bool("reuse-port", false, "Linux and macOS only: allow several usque processes to share the listening port, Linux balances clients between them")
+	httpProxyCmd.Flags().Bool("watch-network", false, "Reconnect right away when the default route or addresses of the system change")
 	httpProxyCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	httpProxyCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
 	httpProxyCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
 	httpProxyCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
 	httpProxyCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
+	httpProxyCmd.Flags().Int("netstack-mtu", 0, "Link MTU of the userspace network stack, sets the size of its packets and the MSS of its TCP connections (0 for --mtu)")
 	httpProxyCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
-	httpProxyCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	httpProxyCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts after transient failures, rejections wait longer")
 	httpProxyCmd.Flags().BoolP("local-dns", "l", false, "Don't use the tunnel for DNS queries")
+	httpProxyCmd.Flags().String("doh-listen", "", "Address to serve DNS-over-HTTPS on (e.g. 127.0.0.1:8053), queries are answered through the tunnel")
+	httpProxyCmd.Flags().StringArray("doh-upstream", []string{"1.1.1.1", "1.0.0.1"}, "Upstream DNS servers used by the DoH server")
+	httpProxyCmd.Flags().String("doh-cert", "", "TLS certificate for the DoH server (plain HTTP if unset)")
+	httpProxyCmd.Flags().String("doh-key", "", "TLS private key for the DoH server")
+	httpProxyCmd.Flags().String("flow-collector", "", "IPFIX collector to export flow records to (e.g. 192.0.2.10:4739)")
+	httpProxyCmd.Flags().Duration("flow-interval", 60*time.Second, "How often flow records are exported")
+	httpProxyCmd.Flags().Bool("strict-inbound", false, "Drop packets from the server not addressed to the tunnel addresses or --inbound-allow prefixes")
+	httpProxyCmd.Flags().StringArray("inbound-allow", []string{}, "Extra destination CIDR accepted from the server with --strict-inbound (can be repeated)")
 	rootCmd.AddCommand(httpProxyCmd)
 }
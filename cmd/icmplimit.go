@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// setupICMPRateLimit applies --icmp-rate-limit and --icmp-flow-rate-limit.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - error: An error if a limit is negative.
+func setupICMPRateLimit(cmd *cobra.Command) error {
+	limit, err := cmd.Flags().GetInt("icmp-rate-limit")
+	if err != nil {
+		return err
+	}
+	flowLimit, err := cmd.Flags().GetInt("icmp-flow-rate-limit")
+	if err != nil {
+		return err
+	}
+	if limit < 0 || flowLimit < 0 {
+		return fmt.Errorf("ICMP rate limits must not be negative, got %d and %d", limit, flowLimit)
+	}
+
+	api.ICMPRateLimit = limit
+	api.ICMPFlowRateLimit = flowLimit
+	return nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().Int("icmp-rate-limit", api.ICMPRateLimit, "ICMP error messages usque generates per second, such as packet too big answers (0 for no limit)")
+	rootCmd.PersistentFlags().Int("icmp-flow-rate-limit", api.ICMPFlowRateLimit, "ICMP error messages usque generates per second for the packets between the same two addresses (0 for no limit)")
+}
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/models"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/spf13/cobra"
+)
+
+// defaultImportPaths are the files import looks for without an argument: the registration of
+// warp-cli on Linux and a wgcf account in the working directory.
+var defaultImportPaths = []string{"/var/lib/cloudflare-warp/reg.json", "wgcf-account.toml"}
+
+// importedRegistration is a registration read from the files of another client.
+type importedRegistration struct {
+	Source  string // Client the registration comes from
+	ID      string // Device ID
+	Token   string // Access token
+	License string // License key, empty if the file has none
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Take over the registration of warp-cli or wgcf",
+	Long: "Reads the registration of an existing warp-cli (reg.json) or wgcf (wgcf-account.toml) install and" +
+		" enrolls a new MASQUE key for the same device, so no new device is registered. Without a file," +
+		" " + strings.Join(defaultImportPaths, " and ") + " are tried. The client the registration came from" +
+		" stops working with it, as its key is replaced. Saves the config to a file.",
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := ""
+		if len(args) > 0 {
+			path = args[0]
+		} else {
+			for _, candidate := range defaultImportPaths {
+				if _, err := os.Stat(candidate); err == nil {
+					path = candidate
+					break
+				}
+			}
+			if path == "" {
+				exitWith(cmd, ExitUsage, "No registration found in %s, pass the file to import\n", strings.Join(defaultImportPaths, " or "))
+			}
+		}
+
+		registration, err := readImportedRegistration(path)
+		if err != nil {
+			fatalWith(ExitConfig, "Failed to import %s: %v", path, err)
+		}
+
+		fmt.Printf("This replaces the key of %s registration %s, %s stops working with it. Continue? (y/n) ", registration.Source, registration.ID, registration.Source)
+		var response string
+		if _, err := fmt.Scanln(&response); err != nil {
+			fatalWith(ExitFailure, "Failed to read response: %v", err)
+		}
+		if response != "y" {
+			return
+		}
+
+		if config.ConfigLoaded {
+			fmt.Printf("You already have a config. Do you want to overwrite it? (y/n) ")
+			if _, err := fmt.Scanln(&response); err != nil {
+				fatalWith(ExitFailure, "Failed to read response: %v", err)
+			}
+			if response != "y" {
+				return
+			}
+		}
+
+		configPath, err := getConfigPath(cmd)
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get config path: %v", err)
+		}
+		if configPath == "" {
+			fatalWith(ExitUsage, "Config path is required")
+		}
+		if err := prepareProfileDir(configPath); err != nil {
+			fatalWith(ExitConfig, "Failed to create profile directory: %v", err)
+		}
+
+		deviceName, err := cmd.Flags().GetString("name")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get device name: %v", err)
+		}
+		secrets, err := getSecretsConfig(cmd, configPath)
+		if err != nil {
+			fatalWith(ExitConfig, "Failed to get secret store: %v", err)
+		}
+
+		privKey, pubKey, err := internal.GenerateEcKeyPair()
+		if err != nil {
+			fatalWith(ExitFailure, "Failed to generate key pair: %v", err)
+		}
+
+		log.Printf("Enrolling a MASQUE key for %s registration %s", registration.Source, registration.ID)
+		accountData := models.AccountData{
+			ID:    registration.ID,
+			Token: registration.Token,
+		}
+		updatedAccountData, apiErr, err := api.EnrollKey(accountData, pubKey, deviceName)
+		if err != nil {
+			if apiErr != nil {
+				fatalWith(ExitAuth, "Failed to enroll key: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
+			}
+			fatalWith(ExitAuth, "Failed to enroll key: %v", err)
+		}
+
+		config.AppConfig = newAccountConfig(privKey, registration.Token, updatedAccountData)
+		if config.AppConfig.License == "" {
+			config.AppConfig.License = registration.License
+		}
+		config.AppConfig.Secrets = secrets
+		if err := config.AppConfig.SaveConfig(configPath); err != nil {
+			fatalWith(ExitConfig, "Failed to save config: %v", err)
+		}
+
+		log.Printf("Config saved to %s", configPath)
+	},
+}
+
+func init() {
+	importCmd.Flags().StringP("name", "n", "", "Rename the device while enrolling the new key")
+	importCmd.Flags().String("secret-store", "", "where to store the private key and access token: config, file, keychain, env or encrypted (default keeps them in the config)")
+	rootCmd.AddCommand(importCmd)
+}
+
+// readImportedRegistration reads the registration from a warp-cli reg.json or a wgcf account
+// file. wgcf files are TOML, everything else is read as JSON.
+//
+// Parameters:
+//   - path: string - The path of the file.
+//
+// Returns:
+//   - importedRegistration: The registration.
+//   - error: An error if the file can't be read or holds no registration.
+func readImportedRegistration(path string) (importedRegistration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return importedRegistration{}, err
+	}
+
+	values := map[string]any{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, &values)
+	} else {
+		err = json.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return importedRegistration{}, fmt.Errorf("failed to parse registration: %v", err)
+	}
+
+	field := func(keys ...string) string {
+		for _, key := range keys {
+			if value, ok := values[key].(string); ok && value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	registration := importedRegistration{Source: "warp-cli"}
+	if _, ok := values["device_id"]; ok {
+		registration.Source = "wgcf"
+	}
+	registration.ID = field("registration_id", "device_id", "id")
+	registration.Token = field("api_token", "access_token", "token")
+	registration.License = field("license_key", "license")
+	if registration.ID == "" || registration.Token == "" {
+		return importedRegistration{}, errors.New("no device ID and access token found, expected a warp-cli reg.json or a wgcf account file")
+	}
+	return registration, nil
+}
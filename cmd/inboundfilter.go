@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// inboundFilterLogInterval is how often drop counters are logged if they changed.
+const inboundFilterLogInterval = time.Minute
+
+// withInboundFilter wraps the device in an api.InboundFilterDevice if --strict-inbound is set.
+// Packets from the server are only accepted if addressed to the tunnel addresses in the config
+// or to one of the prefixes given with --inbound-allow.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - dev: api.TunnelDevice - The device to wrap.
+//
+// Returns:
+//   - api.TunnelDevice: The wrapped device, or dev itself if the filter is disabled.
+func withInboundFilter(cmd *cobra.Command, dev api.TunnelDevice) api.TunnelDevice {
+	strict, err := cmd.Flags().GetBool("strict-inbound")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get strict inbound: %v", err)
+	}
+	if !strict {
+		return dev
+	}
+
+	allowed, err := getPrefixes(cmd, "inbound-allow")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get allowed inbound prefixes: %v", err)
+	}
+
+	v4, v6, err := tunnelAddresses(cmd, &config.AppConfig)
+	if err != nil {
+		fatalWith(ExitConfig, "Failed to get tunnel addresses: %v", err)
+	}
+	for _, addr := range []netip.Addr{v4, v6} {
+		if addr.IsValid() {
+			allowed = append(allowed, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+
+	filter := api.NewInboundFilterDevice(dev, allowed)
+	go func() {
+		var last api.InboundFilterStats
+		for range time.Tick(inboundFilterLogInterval) {
+			stats := filter.Stats()
+			if stats.Dropped != last.Dropped || stats.Malformed != last.Malformed {
+				slog.Info("Inbound filter", "component", "tun",
+					"accepted", stats.Accepted, "dropped", stats.Dropped, "malformed", stats.Malformed)
+			}
+			last = stats
+		}
+	}()
+
+	log.Printf("Strict inbound filtering enabled, accepting packets to %v", allowed)
+	return filter
+}
+
+// getPrefixes parses a string array flag of CIDR prefixes.
+// Plain IP addresses are accepted as host prefixes.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - name: string - The flag name.
+//
+// Returns:
+//   - []netip.Prefix: The parsed prefixes.
+//   - error: An error if the flag is missing or an entry is invalid.
+func getPrefixes(cmd *cobra.Command, name string) ([]netip.Prefix, error) {
+	entries, err := cmd.Flags().GetStringArray(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %v", entry, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// logLevel is the minimum level of the JSON handler, so it can change at runtime.
+var logLevel slog.LevelVar
+
+// setupLogging applies --log-level and --log-format. With the JSON format, lines logged
+// through the log package, including the ones of quic-go and connect-ip-go, become JSON
+// records too, so the whole output is machine-parsable.
+// It has to run before setupProtocolLogging, which filters whatever log writer is set.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - error: An error if the level or format is invalid.
+func setupLogging(cmd *cobra.Command) error {
+	levelName, err := cmd.Flags().GetString("log-level")
+	if err != nil {
+		return err
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(levelName)); err != nil {
+		return fmt.Errorf("invalid log level %q: %v", levelName, err)
+	}
+
+	format, err := cmd.Flags().GetString("log-format")
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "text":
+	case "json":
+		// log.Writer is stderr, or the event log for the Windows service
+		handler := slog.NewJSONHandler(log.Writer(), &slog.HandlerOptions{Level: &logLevel})
+		slog.SetDefault(slog.New(handler))
+	default:
+		return fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+	setLogLevel(level)
+	return nil
+}
+
+// setLogLevel changes the minimum level of logged messages, for either log format.
+func setLogLevel(level slog.Level) {
+	logLevel.Set(level)
+	slog.SetLogLoggerLevel(level)
+}
+
+// applyConfigLogLevel applies the log level of the config, unless --log-level is given.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - cfg: *config.Config - The config with the log level.
+//
+// Returns:
+//   - error: An error if the level in the config is invalid.
+func applyConfigLogLevel(cmd *cobra.Command, cfg *config.Config) error {
+	if cmd.Flags().Changed("log-level") || cfg.LogLevel == "" {
+		return nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q: %v", cfg.LogLevel, err)
+	}
+	setLogLevel(level)
+	return nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+	rootCmd.PersistentFlags().String("log-format", "text", "Log format: text or json")
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// protocolQuirkLogInterval is how often the counts of suppressed protocol messages are logged.
+const protocolQuirkLogInterval = 10 * time.Minute
+
+var protocolLogOnce sync.Once
+
+// setupProtocolLogging counts known-benign protocol messages instead of logging each one,
+// unless --verbose-protocol is set. A summary is logged whenever the counts change.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+func setupProtocolLogging(cmd *cobra.Command) {
+	verbose, err := cmd.Flags().GetBool("verbose-protocol")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get verbose-protocol flag: %v", err)
+	}
+	if verbose {
+		return
+	}
+
+	// commands may be executed more than once with a different output, e.g. by the Windows service
+	if _, ok := log.Writer().(*api.ProtocolLogFilter); !ok {
+		log.SetOutput(api.NewProtocolLogFilter(log.Writer(), api.DefaultTunnel))
+	}
+
+	protocolLogOnce.Do(func() {
+		go func() {
+			var last api.MetricsSnapshot
+			for range time.Tick(protocolQuirkLogInterval) {
+				s := api.DefaultTunnel.Metrics.Snapshot()
+				if s.DroppedPackets != last.DroppedPackets || s.NoErrorResets != last.NoErrorResets {
+					log.Printf("Suppressed protocol messages: %d packets to addresses outside the tunnel, %d H3_NO_ERROR resets (use --verbose-protocol to log them)",
+						s.DroppedPackets, s.NoErrorResets)
+				}
+				last = s
+			}
+		}()
+	})
+}
+
+func init() {
+	rootCmd.PersistentFlags().Bool("verbose-protocol", false, "Log every known-benign protocol message (packets to addresses outside the tunnel, H3_NO_ERROR resets) instead of counting them")
+}
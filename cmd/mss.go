@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"net/netip"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// withMSSClamp wraps the device in an api.MSSClampDevice if --clamp-mss is set. Once the
+// connection rejected a packet as too large, new TCP connections are told to send segments
+// that fit, instead of relying on the ICMP packet too big reaching the sender.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - dev: api.TunnelDevice - The device to wrap.
+//
+// Returns:
+//   - api.TunnelDevice: The wrapped device, or dev itself if clamping is disabled.
+func withMSSClamp(cmd *cobra.Command, dev api.TunnelDevice) api.TunnelDevice {
+	clamp, err := cmd.Flags().GetBool("clamp-mss")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get clamp-mss flag: %v", err)
+	}
+	if !clamp {
+		return dev
+	}
+	return api.NewMSSClampDevice(api.DefaultTunnel, dev)
+}
+
+// withPathMTU wraps the device in an api.PathMTUDevice if --path-mtu-cache is set. The path MTUs
+// the server reports in packet too big messages are remembered per destination, so later packets
+// and new TCP connections to it fit without another round trip to the server.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - dev: api.TunnelDevice - The device to wrap.
+//
+// Returns:
+//   - api.TunnelDevice: The wrapped device, or dev itself if the cache is disabled.
+func withPathMTU(cmd *cobra.Command, dev api.TunnelDevice) api.TunnelDevice {
+	enabled, err := cmd.Flags().GetBool("path-mtu-cache")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get path-mtu-cache flag: %v", err)
+	}
+	if !enabled {
+		return dev
+	}
+
+	v4, v6, err := tunnelAddresses(cmd, &config.AppConfig)
+	if err != nil {
+		fatalWith(ExitConfig, "Failed to get tunnel addresses: %v", err)
+	}
+	var local []netip.Addr
+	for _, addr := range []netip.Addr{v4, v6} {
+		if addr.IsValid() {
+			local = append(local, addr)
+		}
+	}
+	return api.NewPathMTUDevice(api.DefaultTunnel, dev, local)
+}
+
+func init() {
+	rootCmd.PersistentFlags().Bool("path-mtu-cache", false, "Remember the path MTU of destinations from packet too big messages of the server, answer larger packets to them locally and clamp the MSS of new TCP connections to them")
+	rootCmd.PersistentFlags().Bool("clamp-mss", false, "Lower the MSS of new TCP connections to the packet size the connection carries, once it rejected a packet as too large")
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// minTunnelMTU is the smallest MTU IPv6 allows, smaller MTUs only carry IPv4.
+	minTunnelMTU = 1280
+	// minIPv4MTU is the smallest MTU IPv4 allows.
+	minIPv4MTU = 68
+	// maxTunnelMTU is the largest IP packet, jumbo MTUs above a QUIC datagram rely on fragments
+	// and packet too big messages toward the server.
+	maxTunnelMTU = 65535
+	// minQuicPacketSize is the smallest QUIC packet size, QUIC needs paths carrying at least 1200 bytes.
+	minQuicPacketSize = 1200
+	// maxQuicPacketSize is the largest QUIC packet quic-go sends, even if path MTU discovery finds more.
+	maxQuicPacketSize = 1452
+	// minDatagramOverhead is the least a QUIC packet adds around a tunneled packet: the short header
+	// with an empty connection ID and a one byte packet number, the AEAD tag, the DATAGRAM frame
+	// type and the context ID. Longer connection IDs and packet numbers add more.
+	minDatagramOverhead = 1 + 1 + 16 + 1 + 1
+)
+
+// checkMTU checks --mtu, the MTU of the tunnel device and the size of the tunnel's packet
+// buffers. A jumbo MTU above what a QUIC datagram carries speeds up traffic that stays on the
+// device's side and cuts the packets per syscall, but every packet toward the server that doesn't
+// fit is either split into IPv4 fragments, if it allows that, or answered with packet too big.
+// An MTU below the IPv6 minimum is allowed for IPv4-only setups, but logged.
+//
+// Parameters:
+//   - mtu: int - The value of --mtu.
+//
+// Returns:
+//   - error: An error if the MTU is out of range.
+func checkMTU(mtu int) error {
+	if mtu < minIPv4MTU || mtu > maxTunnelMTU {
+		return fmt.Errorf("MTU %d must be between the IPv4 minimum of %d and %d", mtu, minIPv4MTU, maxTunnelMTU)
+	}
+	if mtu < minTunnelMTU {
+		warnBelowIPv6(mtu)
+	} else if largest := maxQuicPacketSize - minDatagramOverhead; mtu > largest {
+		log.Printf("Jumbo MTU %d: packets to the server larger than %d bytes are sent as IPv4 fragments if they allow it, others are answered with ICMP packet too big", mtu, largest)
+	} else if mtu != minTunnelMTU {
+		log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
+	}
+	return nil
+}
+
+// getNetstackMTU reads --netstack-mtu and checks it against the other packet sizes. Three sizes
+// are involved in the proxy modes:
+//   - --netstack-mtu, the link MTU of the userspace network stack, which sizes the packets it
+//     sends and the MSS of its TCP connections.
+//   - --mtu, the largest packet the tunnel forwards, which sizes its packet buffers.
+//   - --initial-packet-size, the size of the QUIC packets before path MTU discovery raises it.
+//
+// Conflicting sizes end in packets that silently vanish, so impossible combinations are errors.
+// A netstack MTU that no QUIC packet can carry and MTUs below the IPv6 minimum are logged.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - mtu: int - The value of --mtu.
+//   - initialPacketSize: uint16 - The value of --initial-packet-size.
+//
+// Returns:
+//   - int: The link MTU of the network stack, --mtu unless set.
+//   - error: An error if a size is out of range or the sizes contradict each other.
+func getNetstackMTU(cmd *cobra.Command, mtu int, initialPacketSize uint16) (int, error) {
+	netstackMTU, err := cmd.Flags().GetInt("netstack-mtu")
+	if err != nil {
+		return 0, err
+	}
+	if netstackMTU == 0 {
+		netstackMTU = mtu
+	}
+
+	if mtu < minIPv4MTU || mtu > maxTunnelMTU {
+		return 0, fmt.Errorf("MTU %d must be between the IPv4 minimum of %d and %d", mtu, minIPv4MTU, maxTunnelMTU)
+	}
+	if netstackMTU < minIPv4MTU || netstackMTU > mtu {
+		return 0, fmt.Errorf("netstack MTU %d must be between %d and the MTU %d, larger packets wouldn't fit into the tunnel's buffers", netstackMTU, minIPv4MTU, mtu)
+	}
+	if netstackMTU < minTunnelMTU {
+		warnBelowIPv6(netstackMTU)
+	}
+	if initialPacketSize < minQuicPacketSize || initialPacketSize > maxQuicPacketSize {
+		return 0, fmt.Errorf("initial packet size %d must be between %d and %d", initialPacketSize, minQuicPacketSize, maxQuicPacketSize)
+	}
+
+	// packets up to the initial packet size rely on path MTU discovery on every connection,
+	// that is the default, only packets that can never fit are worth a warning
+	if largest := maxQuicPacketSize - minDatagramOverhead; netstackMTU > largest {
+		log.Printf("Warning: packets larger than %d bytes never fit into a QUIC datagram, the netstack MTU %d relies on ICMP packet too big to get them resent smaller", largest, netstackMTU)
+	}
+	return netstackMTU, nil
+}
+
+// warnBelowIPv6 logs that an MTU below the IPv6 minimum leaves only IPv4 working.
+func warnBelowIPv6(mtu int) {
+	log.Printf("Warning: MTU %d is below the IPv6 minimum of %d, IPv6 through the tunnel will fail, only IPv4 is usable", mtu, minTunnelMTU)
+}
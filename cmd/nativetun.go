@@ -1,9 +1,15 @@
+//go:build !nonative
+
 package cmd
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net"
+	"net/netip"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/Diniboy1123/usque/api"
@@ -13,11 +19,105 @@ import (
 )
 
 type tunDevice struct {
-	name     string
-	mtu      int
-	iproute2 bool
-	ipv4     bool
-	ipv6     bool
+	name           string
+	profile        string // selected profile, keeps the Windows adapters of profiles apart
+	mtu            int
+	iproute2       bool
+	ipv4           bool
+	ipv6           bool
+	routesInclude  []netip.Prefix
+	routesExclude  []netip.Prefix
+	endpointRoutes []netip.Prefix // MASQUE endpoints kept out of the tunnel, failing that only warns as their family has no route then
+	metric         int
+	queueLen       int    // transmit queue length in packets, 0 keeps the system default
+	cgroup         string // cgroup whose traffic is routed through the tunnel
+	fwmark         uint32 // firewall mark of traffic routed through the tunnel
+	dnsOverrides   map[string][]netip.AddrPort
+	strict         bool // fail instead of warning when part of the configuration can't be applied
+	// cleanup holds functions undoing system changes (e.g. routes), run in reverse order on exit
+	cleanup []func() error
+	// killSwitchStep is the position of the kill switch in cleanup, counting from 1, 0 if it isn't armed
+	killSwitchStep int
+	// cleanupMu guards cleanup and killSwitchStep
+	cleanupMu sync.Mutex
+	// cleanupOnce lets only the first of shutdown, abort and exit undo the changes
+	cleanupOnce sync.Once
+	// platform holds state only some platforms need
+	platform tunPlatform
+}
+
+// addCleanup registers a function undoing a system change.
+//
+// Parameters:
+//   - step: func() error - The function, run by runCleanup or teardown.
+func (t *tunDevice) addCleanup(step func() error) {
+	t.cleanupMu.Lock()
+	defer t.cleanupMu.Unlock()
+	t.cleanup = append(t.cleanup, step)
+}
+
+// runCleanup undoes all system changes made for the device in reverse order.
+func (t *tunDevice) runCleanup() {
+	t.undo(false)
+}
+
+// undo runs the cleanup steps once. The DNS forwarder in strict mode and the exit paths of
+// other goroutines can tear down concurrently with the shutdown on the main goroutine, so only
+// the first call does the work and later ones wait for it to finish.
+//
+// Parameters:
+//   - keepKillSwitch: bool - Whether to leave an armed kill switch in place.
+func (t *tunDevice) undo(keepKillSwitch bool) {
+	t.cleanupOnce.Do(func() {
+		t.cleanupMu.Lock()
+		defer t.cleanupMu.Unlock()
+
+		if keepKillSwitch && t.killSwitchStep > 0 {
+			if killSwitchOutlivesProcess {
+				t.cleanup = slices.Delete(t.cleanup, t.killSwitchStep-1, t.killSwitchStep)
+				log.Println("Strict mode: leaving the kill switch armed, traffic stays blocked until it is removed")
+			} else {
+				log.Println("Strict mode: the kill switch can't outlive the process on this platform, traffic is no longer blocked")
+			}
+			t.killSwitchStep = 0
+		}
+		for i := len(t.cleanup) - 1; i >= 0; i-- {
+			if err := t.cleanup[i](); err != nil {
+				log.Printf("Cleanup failed: %v", err)
+			}
+		}
+		t.cleanup = nil
+	})
+}
+
+// tolerate handles a failure to apply an optional part of the configuration. It is logged
+// as a warning, unless --strict is set, then it is returned so startup is aborted.
+//
+// Parameters:
+//   - err: error - The failure.
+//   - what: string - What couldn't be applied.
+//
+// Returns:
+//   - error: The failure in strict mode, nil otherwise.
+func (t *tunDevice) tolerate(err error, what string) error {
+	if t.strict {
+		return fmt.Errorf("%s: %v", what, err)
+	}
+	log.Printf("Warning: %s: %v", what, err)
+	return nil
+}
+
+// teardown undoes the system changes made so far before the process exits on a failure. In
+// strict mode an armed kill switch is kept where it outlives the process, so nothing leaks past
+// the partially configured network.
+func (t *tunDevice) teardown() {
+	t.undo(t.strict)
+}
+
+// abort undoes the system changes made so far and exits.
+func (t *tunDevice) abort(format string, args ...any) {
+	t.teardown()
+	fatalWith(ExitTUN, format, args...)
 }
 
 var nativeTunCmd = &cobra.Command{
@@ -26,151 +126,382 @@ var nativeTunCmd = &cobra.Command{
 	Long:  longDescription,
 	Run: func(cmd *cobra.Command, args []string) {
 		if !config.ConfigLoaded {
-			cmd.Println("Config not loaded. Please register first.")
-			return
+			exitNotRegistered(cmd)
 		}
 
-		sni, err := cmd.Flags().GetString("sni-address")
+		sni, err := getSNI(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get SNI address: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get SNI address: %v\n", err)
 		}
 
 		privKey, err := config.AppConfig.GetEcPrivateKey()
 		if err != nil {
-			cmd.Printf("Failed to get private key: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get private key: %v\n", err)
 		}
 		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
 		if err != nil {
-			cmd.Printf("Failed to get public key: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get public key: %v\n", err)
 		}
 
 		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
 		if err != nil {
-			cmd.Printf("Failed to generate cert: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to generate cert: %v\n", err)
 		}
 
 		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
 		if err != nil {
-			cmd.Printf("Failed to prepare TLS config: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to prepare TLS config: %v\n", err)
 		}
 
 		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
 		if err != nil {
-			cmd.Printf("Failed to get keepalive period: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get keepalive period: %v\n", err)
 		}
 		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
 		if err != nil {
-			cmd.Printf("Failed to get initial packet size: %v\n", err)
-			return
-		}
-
-		connectPort, err := cmd.Flags().GetInt("connect-port")
-		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get initial packet size: %v\n", err)
 		}
 
-		var endpoint *net.UDPAddr
-		if ipv6, err := cmd.Flags().GetBool("ipv6"); err == nil && !ipv6 {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV4),
-				Port: connectPort,
-			}
-		} else {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV6),
-				Port: connectPort,
-			}
-		}
-
-		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
+		endpoints, err := getEndpoints(cmd, &config.AppConfig)
 		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get endpoints: %v\n", err)
 		}
 
-		tunnelIPv6, err := cmd.Flags().GetBool("no-tunnel-ipv6")
+		v4, v6, err := tunnelAddresses(cmd, &config.AppConfig)
 		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv6: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get tunnel addresses: %v\n", err)
 		}
 
 		mtu, err := cmd.Flags().GetInt("mtu")
 		if err != nil {
-			cmd.Printf("Failed to get MTU: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get MTU: %v\n", err)
 		}
-		if mtu != 1280 {
-			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
+		if err := checkMTU(mtu); err != nil {
+			exitWith(cmd, ExitUsage, "Invalid MTU: %v\n", err)
 		}
 
 		setIproute2, err := cmd.Flags().GetBool("no-iproute2")
 		if err != nil {
-			cmd.Printf("Failed to get no set address: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get no set address: %v\n", err)
 		}
 
 		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
 		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get reconnect delay: %v\n", err)
 		}
 
 		interfaceName, err := cmd.Flags().GetString("interface-name")
 		if err != nil {
-			cmd.Printf("Failed to get interface name: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get interface name: %v\n", err)
 		}
 
 		if interfaceName != "" {
 			err = internal.CheckIfname(interfaceName)
 			if err != nil {
-				log.Printf("Invalid interface name: %v", err)
-				return
+				exitWith(cmd, ExitUsage, "Invalid interface name: %v\n", err)
+			}
+		}
+
+		dnsServers, err := cmd.Flags().GetStringArray("dns")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DNS servers: %v\n", err)
+		}
+
+		var dnsAddrs []netip.Addr
+		for _, dns := range dnsServers {
+			addr, err := netip.ParseAddr(dns)
+			if err != nil {
+				exitWith(cmd, ExitUsage, "Failed to parse DNS server: %v\n", err)
+			}
+			dnsAddrs = append(dnsAddrs, addr)
+		}
+
+		dnsTimeout, err := cmd.Flags().GetDuration("dns-timeout")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DNS timeout: %v\n", err)
+		}
+
+		dnsServeStale, err := cmd.Flags().GetDuration("dns-serve-stale")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DNS serve-stale duration: %v\n", err)
+		}
+
+		dnsListen, err := cmd.Flags().GetString("dns-listen")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DNS listen address: %v\n", err)
+		}
+
+		dnsOverrideEntries, err := cmd.Flags().GetStringArray("dns-override")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DNS overrides: %v\n", err)
+		}
+
+		dnsOverrides, err := internal.ParseDNSOverrides(dnsOverrideEntries)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to parse DNS overrides: %v\n", err)
+		}
+
+		routesInclude, err := getPrefixes(cmd, "route-include")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get included routes: %v\n", err)
+		}
+		for _, prefix := range routesInclude {
+			// the tunnel has no address to send such packets from
+			if prefix.Addr().Is4() && !v4.IsValid() || prefix.Addr().Is6() && !v6.IsValid() {
+				exitWith(cmd, ExitUsage, "Included route %s is of an address family disabled inside the tunnel\n", prefix)
 			}
 		}
 
+		routesExclude, err := getPrefixes(cmd, "route-exclude")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get excluded routes: %v\n", err)
+		}
+
+		setRoutes, err := cmd.Flags().GetBool("set-routes")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get set routes: %v\n", err)
+		}
+
+		metric, err := cmd.Flags().GetInt("interface-metric")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get interface metric: %v\n", err)
+		}
+
+		queueLen, err := cmd.Flags().GetInt("tun-queue-len")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get TUN queue length: %v\n", err)
+		}
+		if queueLen < 0 {
+			exitWith(cmd, ExitUsage, "TUN queue length must not be negative\n")
+		}
+
+		setDNS, err := cmd.Flags().GetBool("set-dns")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get set DNS: %v\n", err)
+		}
+
+		routeCgroup, err := cmd.Flags().GetString("route-cgroup")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get route cgroup: %v\n", err)
+		}
+
+		routeFwmark, err := cmd.Flags().GetUint32("route-fwmark")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get route fwmark: %v\n", err)
+		}
+
+		killSwitch, err := cmd.Flags().GetBool("kill-switch")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get kill switch: %v\n", err)
+		}
+
+		strict, err := cmd.Flags().GetBool("strict")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get strict: %v\n", err)
+		}
+
+		profile, err := getProfile(cmd)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get profile: %v\n", err)
+		}
+
 		t := &tunDevice{
-			name:     interfaceName,
-			mtu:      mtu,
-			iproute2: !setIproute2,
-			ipv4:     !tunnelIPv4,
-			ipv6:     !tunnelIPv6,
+			name:          interfaceName,
+			profile:       profile,
+			mtu:           mtu,
+			iproute2:      !setIproute2,
+			ipv4:          v4.IsValid(),
+			ipv6:          v6.IsValid(),
+			routesInclude: routesInclude,
+			routesExclude: routesExclude,
+			metric:        metric,
+			queueLen:      queueLen,
+			cgroup:        routeCgroup,
+			fwmark:        routeFwmark,
+			dnsOverrides:  dnsOverrides,
+			strict:        strict,
+		}
+
+		// the WireGuard fallback has to reach its endpoint outside of the tunnel as well
+		outside := tunnelEndpoints(cmd, endpoints)
+		if setRoutes {
+			t.setDefaultRoutes(outside)
+			bypassControlPlane(outside)
 		}
 
+		// any later fatal exit, including the ones of the setup steps below and
+		// --exit-after-failures, has to undo the routes and the kill switch first
+		setExitCleanup(t.teardown)
+
 		dev, err := t.create()
 		if err != nil {
 			log.Println("Are you root/administrator? TUN device creation usually requires elevated privileges.")
-			log.Fatalf("Failed to create TUN device: %v", err)
+			fatalWith(ExitTUN, "Failed to create TUN device: %v", err)
 		}
 
 		log.Printf("Created TUN device: %s", t.name)
 
-		go api.MaintainTunnel(context.Background(), tlsConfig, keepalivePeriod, initialPacketSize, endpoint, dev, mtu, reconnectDelay)
+		// the wrappers exit on invalid flags, so they are set up before any system change
+		tunnelDev := withPcap(cmd, withChaos(cmd, withMSSClamp(cmd, withInboundFilter(cmd, withFamilyFilter(cmd, withFlowExport(cmd, withPathMTU(cmd, dev)))))))
+
+		// armed before anything else, so nothing leaks while the tunnel connects
+		if killSwitch {
+			if err := t.enableKillSwitch(endpointAddrPorts(outside)); err != nil {
+				t.abort("Failed to enable kill switch: %v", err)
+			}
+			t.cleanupMu.Lock()
+			t.killSwitchStep = len(t.cleanup)
+			t.cleanupMu.Unlock()
+			log.Println("Kill switch enabled, traffic outside of the tunnel is blocked")
+		}
+
+		if len(t.routesInclude) > 0 || len(t.routesExclude) > 0 || len(t.endpointRoutes) > 0 || t.metric > 0 {
+			if err := t.setupRoutes(); err != nil {
+				t.abort("Failed to set up routes: %v", err)
+			}
+		}
+
+		if t.cgroup != "" || t.fwmark != 0 {
+			if err := t.setupPolicyRouting(); err != nil {
+				t.abort("Failed to set up per-application routing: %v", err)
+			}
+		}
+
+		if setDNS {
+			if err := t.setupDNS(dnsAddrs); err != nil {
+				t.abort("Failed to set DNS servers: %v", err)
+			}
+		}
+
+		t.watchAdapter()
+
+		logEffectiveConfig(cmd, endpoints)
+		watchNetwork(cmd, t.name)
+		serveControl(cmd, endpoints)
+		watchConfig(cmd, endpoints)
+		setupStandby(cmd)
+		setupWireGuardFallback(cmd)
+		loadEndpointBlocklist(cmd)
+		go api.MaintainTunnel(context.Background(), api.DefaultTunnel, tlsConfig, keepalivePeriod, initialPacketSize, endpoints, tunnelDev, mtu, reconnectDelay)
+
+		if dnsListen != "" {
+			forwarder := &internal.DNSForwarder{
+				Dial:       t.dialer(), // queries stay in the tunnel even if --route-exclude covers the upstreams
+				Upstreams:  internal.DNSUpstreamsFromAddrs(dnsAddrs),
+				Overrides:  dnsOverrides,
+				Timeout:    dnsTimeout,
+				Cache:      internal.NewDNSCache(0),
+				Available:  api.DefaultTunnel.Status.Connected,
+				ServeStale: dnsServeStale,
+			}
+			if t.strict {
+				// the forwarder is part of the configuration, losing it must not go unnoticed
+				go func() {
+					log.Printf("DNS forwarder listening on %s", dnsListen)
+					if err := forwarder.ServeDNS(dnsListen); err != nil {
+						t.abort("DNS forwarder stopped: %v", err)
+					}
+				}()
+			} else {
+				serveDNSForwarder(forwarder, dnsListen)
+			}
+		}
 
 		log.Println("Tunnel established, you may now set up routing and DNS")
 
-		select {}
+		waitForShutdown()
+
+		log.Println("Shutting down...")
+		setExitCleanup(nil)
+		t.runCleanup()
 	},
 }
 
+// endpointAddrPorts converts the MASQUE endpoints for the kill switch.
+func endpointAddrPorts(endpoints []*net.UDPAddr) []netip.AddrPort {
+	addrs := make([]netip.AddrPort, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		addrPort := endpoint.AddrPort()
+		addrs = append(addrs, netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()))
+	}
+	return addrs
+}
+
+// bypassControlPlane binds API requests, such as key rotation and re-enrollment, to the
+// interface the endpoints are reached through, so the default routes of the tunnel don't
+// capture them. It does nothing if they bypass the tunnel another way, e.g. with --bind-iface.
+// It must run before the routes are set, while the lookup still sees the original routes.
+//
+// Parameters:
+//   - endpoints: []*net.UDPAddr - The endpoints kept outside of the tunnel.
+func bypassControlPlane(endpoints []*net.UDPAddr) {
+	if api.ControlPlaneBypass() != "" || len(endpoints) == 0 {
+		return
+	}
+	iface, err := internal.InterfaceTo(endpoints[0].AddrPort().Addr().Unmap())
+	if err != nil {
+		log.Printf("Warning: API requests may go through the tunnel, failed to find the outside interface: %v", err)
+		return
+	}
+	api.ControlPlaneInterface = iface
+	log.Printf("API requests bypass the tunnel through %s", iface)
+}
+
+// setDefaultRoutes adds routes sending all traffic of the enabled address families through
+// the TUN device. Two halves are used instead of a default route, so they take precedence
+// over the existing default route without replacing it. The endpoints get host routes via
+// the original gateway, otherwise the tunnel would be routed into itself.
+//
+// Parameters:
+//   - endpoints: []*net.UDPAddr - The MASQUE endpoints to keep outside of the tunnel.
+func (t *tunDevice) setDefaultRoutes(endpoints []*net.UDPAddr) {
+	if t.ipv4 {
+		t.routesInclude = append(t.routesInclude,
+			netip.MustParsePrefix("0.0.0.0/1"), netip.MustParsePrefix("128.0.0.0/1"))
+	}
+	if t.ipv6 {
+		t.routesInclude = append(t.routesInclude,
+			netip.MustParsePrefix("::/1"), netip.MustParsePrefix("8000::/1"))
+	}
+
+	for _, endpoint := range endpoints {
+		addr := endpoint.AddrPort().Addr().Unmap()
+		t.endpointRoutes = append(t.endpointRoutes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+}
+
 func init() {
 	nativeTunCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
 	nativeTunCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	nativeTunCmd.Flags().Bool("happy-eyeballs", false, "Race the IPv6 and IPv4 endpoints and use whichever connects first")
+	nativeTunCmd.Flags().Bool("watch-network", false, "Reconnect right away when the default route or addresses of the system change")
 	nativeTunCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	nativeTunCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
 	nativeTunCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
 	nativeTunCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
 	nativeTunCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
 	nativeTunCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
-	nativeTunCmd.Flags().BoolP("no-iproute2", "I", false, "Linux only: Do not set up IP addresses and do not set the link up")
-	nativeTunCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	nativeTunCmd.Flags().BoolP("no-iproute2", "I", false, "Linux and macOS only: Do not set up IP addresses and do not set the link up")
+	nativeTunCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts after transient failures, rejections wait longer")
 	nativeTunCmd.Flags().StringP("interface-name", "n", "", "Custom inteface name for the TUN interface")
+	nativeTunCmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers used by the DNS forwarder")
+	nativeTunCmd.Flags().DurationP("dns-timeout", "t", 2*time.Second, "Timeout for DNS queries")
+	nativeTunCmd.Flags().Duration("dns-serve-stale", 0, "How long after their expiry cached DNS answers are still served while the tunnel is down or the DNS servers don't answer (0 to answer SERVFAIL instead)")
+	nativeTunCmd.Flags().String("dns-listen", "", "Address to serve plain DNS on over UDP and TCP (e.g. 127.0.0.1:53), queries are forwarded through the TUN device")
+	nativeTunCmd.Flags().StringArray("dns-override", []string{}, "Per-domain DNS servers for the DNS forwarder (e.g. corp.example.com=10.0.0.53)")
+	nativeTunCmd.Flags().String("flow-collector", "", "IPFIX collector to export flow records to (e.g. 192.0.2.10:4739)")
+	nativeTunCmd.Flags().Duration("flow-interval", 60*time.Second, "How often flow records are exported")
+	nativeTunCmd.Flags().Bool("strict-inbound", false, "Drop packets from the server not addressed to the tunnel addresses or --inbound-allow prefixes")
+	nativeTunCmd.Flags().StringArray("inbound-allow", []string{}, "Extra destination CIDR accepted from the server with --strict-inbound (can be repeated)")
+	nativeTunCmd.Flags().StringArray("route-include", []string{}, "CIDR to route through the TUN device (can be repeated)")
+	nativeTunCmd.Flags().StringArray("route-exclude", []string{}, "CIDR to keep routed via the original gateway (can be repeated)")
+	nativeTunCmd.Flags().Bool("set-routes", false, "Route all traffic through the TUN device, except for the MASQUE endpoints")
+	nativeTunCmd.Flags().Int("interface-metric", 0, "Windows only: interface metric of the TUN device, lower is preferred (0 keeps the automatic metric)")
+	nativeTunCmd.Flags().Int("tun-queue-len", 0, "Linux and Windows only: queue length of the TUN device in packets, raise it if bursts get dropped on fast links (0 keeps the system default)")
+	nativeTunCmd.Flags().Bool("set-dns", false, "macOS and Windows only: use the --dns servers as system resolvers while running (on Windows, only the --dns-override domains if any are given)")
+	nativeTunCmd.Flags().String("route-cgroup", "", "Linux only: route only the traffic of processes in this cgroup v2 (e.g. usque, created if missing) through the TUN device")
+	nativeTunCmd.Flags().Uint32("route-fwmark", 0, "Linux only: route only packets with this firewall mark through the TUN device")
+	nativeTunCmd.Flags().Bool("strict", false, "Abort startup if any part of the configuration can't be applied, instead of warning and continuing. Only checked while starting, later changes to routes, DNS or firewall rules aren't detected. On Linux an armed kill switch is left in place")
+	nativeTunCmd.Flags().Bool("kill-switch", false, "Linux and Windows only: block all traffic that doesn't go through the TUN device or to the MASQUE endpoints while running")
 	rootCmd.AddCommand(nativeTunCmd)
 }
@@ -0,0 +1,179 @@
+//go:build darwin && !nonative
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+var longDescription = "Expose Warp as a native TUN device that accepts any IP traffic." +
+	" Requires root."
+
+// tunPlatform holds no state on this platform.
+type tunPlatform struct{}
+
+// killSwitchOutlivesProcess is false, there is no kill switch on this platform.
+const killSwitchOutlivesProcess = false
+
+// watchAdapter does nothing, the device keeps its configuration on this platform.
+func (t *tunDevice) watchAdapter() {}
+
+func (t *tunDevice) create() (api.TunnelDevice, error) {
+	// utun devices are always named utunN, the kernel picks N unless given
+	if t.name == "" {
+		t.name = "utun"
+	}
+
+	if t.queueLen > 0 {
+		return nil, errors.New("setting the queue length is not supported on macOS")
+	}
+
+	dev, err := tun.CreateTUN(t.name, t.mtu)
+	if err != nil {
+		return nil, err
+	}
+
+	t.name, err = dev.Name()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.iproute2 {
+		if t.ipv4 {
+			if err := internal.SetIPv4Address(t.name, config.AppConfig.IPv4); err != nil {
+				return nil, fmt.Errorf("failed to set IPv4 address: %v", err)
+			}
+		}
+		if t.ipv6 {
+			if err := internal.SetIPv6Address(t.name, config.AppConfig.IPv6, 128); err != nil {
+				return nil, fmt.Errorf("failed to set IPv6 address: %v", err)
+			}
+		}
+	} else {
+		log.Println("Skipping IP address setup. You should set the addresses manually.")
+		log.Println("Config has the following IP addresses:")
+		log.Printf("IPv4: %s", config.AppConfig.IPv4)
+		log.Printf("IPv6: %s", config.AppConfig.IPv6)
+	}
+
+	// utun prefixes every packet with its address family
+	return api.NewNetstackAdapterWithOffset(api.DefaultTunnel, dev, 4), nil
+}
+
+// dialer returns a dial function binding its sockets to the utun device.
+func (t *tunDevice) dialer() func(ctx context.Context, network, address string) (net.Conn, error) {
+	d := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var bindErr error
+			if err := c.Control(func(fd uintptr) {
+				bindErr = internal.BindToInterface(fd, network, t.name)
+			}); err != nil {
+				return err
+			}
+			return bindErr
+		},
+	}
+	return d.DialContext
+}
+
+// setupRoutes installs the requested split tunneling routes. Excluded prefixes get
+// routed via the gateway currently used to reach them, included prefixes via the TUN device.
+// Every route installed is removed again by runCleanup.
+func (t *tunDevice) setupRoutes() error {
+	iface, err := net.InterfaceByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get interface: %v", err)
+	}
+
+	// the RTM_GET of FindRoute has to run before the included routes capture the prefixes
+	for _, prefix := range t.routesExclude {
+		if err := t.addExcludedRoute(prefix); err != nil {
+			return err
+		}
+	}
+	// failures are only warnings, see the endpointRoutes field
+	for _, prefix := range t.endpointRoutes {
+		if err := t.addExcludedRoute(prefix); err != nil {
+			log.Printf("Warning: not excluding endpoint %s from the tunnel: %v", prefix, err)
+		}
+	}
+
+	for _, prefix := range t.routesInclude {
+		if err := t.addRoute(prefix, iface.Index, netip.Addr{}); err != nil {
+			return fmt.Errorf("failed to add included route %s: %v", prefix, err)
+		}
+	}
+
+	return nil
+}
+
+// addExcludedRoute routes prefix via the gateway currently used to reach it.
+func (t *tunDevice) addExcludedRoute(prefix netip.Prefix) error {
+	iface, err := net.InterfaceByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get interface: %v", err)
+	}
+
+	ifindex, gateway, err := internal.FindRoute(prefix.Addr())
+	if err != nil {
+		return fmt.Errorf("failed to find route for %s: %v", prefix, err)
+	}
+	if ifindex == iface.Index {
+		return fmt.Errorf("%s is already routed via %s", prefix, t.name)
+	}
+	if err := t.addRoute(prefix, ifindex, gateway); err != nil {
+		return fmt.Errorf("failed to add excluded route %s: %v", prefix, err)
+	}
+	return nil
+}
+
+// addRoute adds a route and registers its removal as a cleanup step.
+func (t *tunDevice) addRoute(prefix netip.Prefix, ifindex int, gateway netip.Addr) error {
+	if err := internal.AddRoute(prefix, ifindex, gateway); err != nil {
+		return err
+	}
+	log.Printf("Added route: %s", prefix)
+
+	t.addCleanup(func() error {
+		if err := internal.DeleteRoute(prefix, ifindex, gateway); err != nil {
+			return fmt.Errorf("failed to delete route %s: %v", prefix, err)
+		}
+		return nil
+	})
+	return nil
+}
+
+// setupDNS makes the given servers the system resolvers until runCleanup.
+func (t *tunDevice) setupDNS(servers []netip.Addr) error {
+	serviceID := "usque-" + t.name
+	if err := internal.SetDNS(serviceID, servers); err != nil {
+		return err
+	}
+
+	t.addCleanup(func() error {
+		if err := internal.RemoveDNS(serviceID); err != nil {
+			return fmt.Errorf("failed to remove DNS configuration: %v", err)
+		}
+		return nil
+	})
+	return nil
+}
+
+func (t *tunDevice) enableKillSwitch(endpoints []netip.AddrPort) error {
+	return errors.New("the kill switch is not supported on this platform")
+}
+
+func (t *tunDevice) setupPolicyRouting() error {
+	return errors.New("per-application routing is not supported on this platform")
+}
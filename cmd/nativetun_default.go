@@ -1,9 +1,12 @@
-//go:build !linux && !windows
+//go:build !linux && !windows && !darwin && !nonative
 
 package cmd
 
 import (
+	"context"
 	"errors"
+	"net"
+	"net/netip"
 
 	"github.com/Diniboy1123/usque/api"
 )
@@ -11,6 +14,36 @@ import (
 var longDescription = "Expose Warp as a native TUN device that accepts any IP traffic." +
 	" This command is not supported on your platform."
 
+// tunPlatform holds no state on this platform.
+type tunPlatform struct{}
+
+// killSwitchOutlivesProcess is false, there is no kill switch on this platform.
+const killSwitchOutlivesProcess = false
+
+// watchAdapter does nothing, the device keeps its configuration on this platform.
+func (t *tunDevice) watchAdapter() {}
+
 func (tun *tunDevice) create() (api.TunnelDevice, error) {
 	return nil, errors.New("nativetun is not supported on this platform")
 }
+
+// dialer returns nil, so connections use the system network and follow the routing table.
+func (t *tunDevice) dialer() func(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil
+}
+
+func (t *tunDevice) setupRoutes() error {
+	return errors.New("routes are not supported on this platform")
+}
+
+func (t *tunDevice) setupDNS(servers []netip.Addr) error {
+	return errors.New("setting the system DNS servers is not supported on this platform")
+}
+
+func (t *tunDevice) enableKillSwitch(endpoints []netip.AddrPort) error {
+	return errors.New("the kill switch is not supported on this platform")
+}
+
+func (t *tunDevice) setupPolicyRouting() error {
+	return errors.New("per-application routing is not supported on this platform")
+}
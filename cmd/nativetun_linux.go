@@ -1,21 +1,43 @@
-//go:build linux
+//go:build linux && !nonative
 
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"syscall"
 
 	"github.com/Diniboy1123/usque/api"
 	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
 	"github.com/songgao/water"
 	"github.com/vishvananda/netlink"
 )
 
+// policyRouteTable is the routing table used for per-application routing.
+const policyRouteTable = 0x7573
+
+// defaultPolicyMark marks the traffic of --route-cgroup unless --route-fwmark is given.
+const defaultPolicyMark = 0x7573
+
 var longDescription = "Expose Warp as a native TUN device that accepts any IP traffic." +
 	" Requires root, tun.ko, and iproute2."
 
+// tunPlatform holds no state on this platform.
+type tunPlatform struct{}
+
+// killSwitchOutlivesProcess is true, the nftables table stays until it is deleted.
+const killSwitchOutlivesProcess = true
+
+// watchAdapter does nothing, the device keeps its configuration on this platform.
+func (t *tunDevice) watchAdapter() {}
+
 func (t *tunDevice) create() (api.TunnelDevice, error) {
 	platformSpecificParams := water.PlatformSpecificParams{
 		Name: t.name,
@@ -28,6 +50,16 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 
 	t.name = dev.Name()
 
+	if t.queueLen > 0 {
+		link, err := netlink.LinkByName(dev.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get link: %v", err)
+		}
+		if err := netlink.LinkSetTxQLen(link, t.queueLen); err != nil {
+			return nil, fmt.Errorf("failed to set queue length: %v", err)
+		}
+	}
+
 	if t.iproute2 {
 		link, err := netlink.LinkByName(dev.Name())
 		if err != nil {
@@ -47,11 +79,19 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 			}
 		}
 		if t.ipv6 {
+			if err := disableIPv6Autoconf(dev.Name()); err != nil {
+				if err := t.tolerate(err, "failed to disable IPv6 address autoconfiguration"); err != nil {
+					return nil, err
+				}
+			}
+			// the assigned address is the only valid one, no need to wait for DAD
 			if err := netlink.AddrAdd(link, &netlink.Addr{
 				IPNet: &net.IPNet{
 					IP:   net.ParseIP(config.AppConfig.IPv6),
 					Mask: net.CIDRMask(128, 128),
-				}}); err != nil {
+				},
+				Flags: syscall.IFA_F_NODAD,
+			}); err != nil {
 				return nil, fmt.Errorf("failed to add IPv6 address: %v", err)
 			}
 		}
@@ -67,3 +107,242 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 
 	return api.NewWaterAdapter(dev), nil
 }
+
+// dialer returns a dial function binding its sockets to the TUN device.
+func (t *tunDevice) dialer() func(ctx context.Context, network, address string) (net.Conn, error) {
+	d := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var bindErr error
+			if err := c.Control(func(fd uintptr) {
+				bindErr = internal.BindToInterface(fd, network, t.name)
+			}); err != nil {
+				return err
+			}
+			return bindErr
+		},
+	}
+	return d.DialContext
+}
+
+// disableIPv6Autoconf makes sure the kernel doesn't generate any IPv6 addresses on the interface
+// (link-local, SLAAC or temporary privacy addresses). The server only accepts the address assigned
+// to us, so source address selection must never pick anything else.
+// Must be called before the link is set up.
+func disableIPv6Autoconf(name string) error {
+	settings := []struct {
+		key   string
+		value string
+	}{
+		{"addr_gen_mode", "1"}, // don't generate a link-local address
+		{"use_tempaddr", "0"},  // no temporary (privacy) addresses
+		{"autoconf", "0"},      // no SLAAC addresses
+		{"accept_ra", "0"},     // ignore router advertisements
+	}
+
+	for _, setting := range settings {
+		path := filepath.Join("/proc/sys/net/ipv6/conf", name, setting.key)
+		if err := os.WriteFile(path, []byte(setting.value), 0644); err != nil {
+			return fmt.Errorf("failed to set %s: %v", setting.key, err)
+		}
+	}
+
+	return nil
+}
+
+// setupRoutes installs the requested split tunneling routes. Excluded prefixes get
+// routed via the gateway currently used to reach them, included prefixes via the TUN device.
+// Every route installed is removed again by runCleanup.
+func (t *tunDevice) setupRoutes() error {
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get link: %v", err)
+	}
+
+	// RouteGet in addExcludedRoute would return the included routes once they exist
+	for _, prefix := range t.routesExclude {
+		if err := t.addExcludedRoute(prefix); err != nil {
+			return err
+		}
+	}
+	// failures are only warnings, see the endpointRoutes field
+	for _, prefix := range t.endpointRoutes {
+		if err := t.addExcludedRoute(prefix); err != nil {
+			log.Printf("Warning: not excluding endpoint %s from the tunnel: %v", prefix, err)
+		}
+	}
+
+	for _, prefix := range t.routesInclude {
+		if err := t.addRoute(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       internal.PrefixToIPNet(prefix),
+		}); err != nil {
+			return fmt.Errorf("failed to add included route %s: %v", prefix, err)
+		}
+	}
+
+	return nil
+}
+
+// addExcludedRoute routes prefix via the gateway currently used to reach it.
+func (t *tunDevice) addExcludedRoute(prefix netip.Prefix) error {
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get link: %v", err)
+	}
+
+	existing, err := netlink.RouteGet(net.IP(prefix.Addr().AsSlice()))
+	if err != nil || len(existing) == 0 {
+		return fmt.Errorf("failed to find route for %s: %v", prefix, err)
+	}
+	if existing[0].LinkIndex == link.Attrs().Index {
+		return fmt.Errorf("%s is already routed via %s", prefix, t.name)
+	}
+
+	if err := t.addRoute(&netlink.Route{
+		LinkIndex: existing[0].LinkIndex,
+		Dst:       internal.PrefixToIPNet(prefix),
+		Gw:        existing[0].Gw,
+	}); err != nil {
+		return fmt.Errorf("failed to add excluded route %s: %v", prefix, err)
+	}
+	return nil
+}
+
+// addRoute adds a route and registers its removal as a cleanup step.
+func (t *tunDevice) addRoute(route *netlink.Route) error {
+	if err := netlink.RouteAdd(route); err != nil {
+		return err
+	}
+	log.Printf("Added route: %s", route)
+
+	t.addCleanup(func() error {
+		if err := netlink.RouteDel(route); err != nil {
+			return fmt.Errorf("failed to delete route %s: %v", route.Dst, err)
+		}
+		return nil
+	})
+	return nil
+}
+
+func (t *tunDevice) setupDNS(servers []netip.Addr) error {
+	return errors.New("setting the system DNS servers is not supported on this platform")
+}
+
+// enableKillSwitch blocks traffic outside of the tunnel with nftables until runCleanup.
+func (t *tunDevice) enableKillSwitch(endpoints []netip.AddrPort) error {
+	if err := internal.EnableKillSwitch(t.name, endpoints); err != nil {
+		return err
+	}
+
+	t.addCleanup(func() error {
+		if err := internal.DisableKillSwitch(); err != nil {
+			return fmt.Errorf("failed to disable kill switch: %v", err)
+		}
+		return nil
+	})
+	return nil
+}
+
+// setupPolicyRouting routes only marked packets through the TUN device, using a separate
+// routing table selected by a firewall mark. With a cgroup, the packets of its processes
+// are marked by nftables, otherwise the user's own rules have to set the mark.
+func (t *tunDevice) setupPolicyRouting() error {
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get link: %v", err)
+	}
+
+	mark := t.fwmark
+	if mark == 0 {
+		mark = defaultPolicyMark
+	}
+
+	var cgroup string
+	if t.cgroup != "" {
+		cgroup = internal.CgroupRelPath(t.cgroup)
+		if err := t.createCgroup(cgroup); err != nil {
+			return err
+		}
+	}
+
+	type family struct {
+		enabled bool
+		id      int
+		prefix  netip.Prefix
+	}
+	for _, f := range []family{
+		{t.ipv4, netlink.FAMILY_V4, netip.MustParsePrefix("0.0.0.0/0")},
+		{t.ipv6, netlink.FAMILY_V6, netip.MustParsePrefix("::/0")},
+	} {
+		if !f.enabled {
+			continue
+		}
+
+		if err := t.addRoute(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       internal.PrefixToIPNet(f.prefix),
+			Table:     policyRouteTable,
+		}); err != nil {
+			return fmt.Errorf("failed to add default route to table %d: %v", policyRouteTable, err)
+		}
+
+		rule := netlink.NewRule()
+		rule.Family = f.id
+		rule.Mark = mark
+		rule.Table = policyRouteTable
+		if err := netlink.RuleAdd(rule); err != nil {
+			return fmt.Errorf("failed to add routing rule: %v", err)
+		}
+		t.addCleanup(func() error {
+			if err := netlink.RuleDel(rule); err != nil {
+				return fmt.Errorf("failed to delete routing rule: %v", err)
+			}
+			return nil
+		})
+	}
+
+	if t.ipv4 {
+		// replies come in on the TUN device, while the main table routes their source elsewhere
+		path := filepath.Join("/proc/sys/net/ipv4/conf", t.name, "rp_filter")
+		if err := os.WriteFile(path, []byte("2"), 0644); err != nil {
+			return fmt.Errorf("failed to set rp_filter: %v", err)
+		}
+	}
+
+	if err := internal.EnablePolicyNAT(t.name, cgroup, mark); err != nil {
+		return err
+	}
+	t.addCleanup(func() error {
+		if err := internal.DisablePolicyNAT(); err != nil {
+			return fmt.Errorf("failed to remove per-application routing rules: %v", err)
+		}
+		return nil
+	})
+
+	if cgroup != "" {
+		log.Printf("Routing processes in cgroup %s through %s", cgroup, t.name)
+	} else {
+		log.Printf("Routing packets with mark %#x through %s", mark, t.name)
+	}
+	return nil
+}
+
+// createCgroup creates the cgroup if it doesn't exist yet and removes it again on cleanup.
+func (t *tunDevice) createCgroup(cgroup string) error {
+	path := filepath.Join(internal.CgroupRoot, cgroup)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := os.Mkdir(path, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup %s: %v", cgroup, err)
+	}
+	t.addCleanup(func() error {
+		// fails while processes are still in it, they keep running without the tunnel then
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove cgroup %s: %v", cgroup, err)
+		}
+		return nil
+	})
+	return nil
+}
@@ -1,57 +1,470 @@
-//go:build windows
+//go:build windows && !nonative
 
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/Diniboy1123/usque/api"
 	"github.com/Diniboy1123/usque/config"
 	"github.com/Diniboy1123/usque/internal"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wintun"
 	"golang.zx2c4.com/wireguard/tun"
 )
 
 var longDescription = "Expose Warp as a native TUN device that accepts any IP traffic." +
 	" Requires wintun.dll and administrator rights."
 
+// adapterRecoveryDebounce groups the burst of notifications of an adapter reset into one recovery.
+const adapterRecoveryDebounce = 2 * time.Second
+
+// killSwitchOutlivesProcess is false, the WFP filters live in a dynamic session that Windows
+// closes with the process.
+const killSwitchOutlivesProcess = false
+
+// tunPlatform holds the state needed to recover the adapter when Windows resets it.
+type tunPlatform struct {
+	mu      sync.Mutex // serializes recoveries
+	adapter *adapterDevice
+	// luid is the adapter the configuration was applied to
+	luid uint64
+	// dnsServers are the servers set on the interface, nil unless setupDNS set them
+	dnsServers []netip.Addr
+	// killSwitchEndpoints are the endpoints allowed by the kill switch, nil unless it is armed
+	killSwitchEndpoints []netip.AddrPort
+}
+
+// adapterDevice forwards to the current adapter, so it can be replaced while the tunnel runs.
+type adapterDevice struct {
+	current atomic.Pointer[adapterHandle]
+}
+
+// adapterHandle is an adapter and what closes it.
+type adapterHandle struct {
+	dev    api.TunnelDevice
+	closer io.Closer
+}
+
+func (a *adapterDevice) ReadPacket(buf []byte) (int, error) {
+	return a.current.Load().dev.ReadPacket(buf)
+}
+
+func (a *adapterDevice) WritePacket(pkt []byte) error {
+	return a.current.Load().dev.WritePacket(pkt)
+}
+
+// replace switches to a new adapter and closes the old one.
+func (a *adapterDevice) replace(dev api.TunnelDevice, closer io.Closer) {
+	if old := a.current.Swap(&adapterHandle{dev: dev, closer: closer}); old != nil {
+		old.closer.Close()
+	}
+}
+
 func (t *tunDevice) create() (api.TunnelDevice, error) {
 	if t.name == "" {
 		t.name = "usque"
+		if t.profile != "" {
+			t.name += "-" + t.profile
+		}
 	}
 
-	dev, err := tun.CreateTUN(t.name, t.mtu)
+	dev, closer, err := t.createAdapter()
 	if err != nil {
 		return nil, err
 	}
+	if err := t.configureAdapter(); err != nil {
+		closer.Close()
+		return nil, err
+	}
 
-	t.name, err = dev.Name()
+	t.platform.adapter = &adapterDevice{}
+	t.platform.adapter.replace(dev, closer)
+	return t.platform.adapter, nil
+}
+
+// createAdapter creates the Wintun adapter.
+//
+// Returns:
+//   - api.TunnelDevice: The adapter.
+//   - io.Closer: Closes and removes the adapter.
+//   - error: An error if the adapter couldn't be created.
+func (t *tunDevice) createAdapter() (api.TunnelDevice, io.Closer, error) {
+	// a GUID per profile and name lets several instances run side by side with separate adapters
+	guid := internal.AdapterGUID(t.profile, t.name)
+
+	if t.queueLen > 0 {
+		dev, err := api.NewWintunAdapter(t.name, guid, ringCapacity(t.queueLen, t.mtu))
+		if err != nil {
+			return nil, nil, err
+		}
+		return dev, dev, nil
+	}
+
+	nt, err := tun.CreateTUNWithRequestedGUID(t.name, guid, t.mtu)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if t.name, err = nt.Name(); err != nil {
+		nt.Close()
+		return nil, nil, err
 	}
+	return api.NewNetstackAdapter(api.DefaultTunnel, nt), nt, nil
+}
 
+// configureAdapter sets the tunnel addresses and the MTU on the adapter.
+func (t *tunDevice) configureAdapter() error {
+	// also called by recoverAdapter while a reload may publish a new config
+	cfg := config.Current()
 	if t.ipv4 {
-		err = internal.SetIPv4Address(t.name, config.AppConfig.IPv4, "255.255.255.255")
+		err := internal.SetIPv4Address(t.name, cfg.IPv4, "255.255.255.255")
 		if err != nil {
-			return nil, fmt.Errorf("failed to set IPv4 address: %v", err)
+			return fmt.Errorf("failed to set IPv4 address: %v", err)
 		}
 
 		err = internal.SetIPv4MTU(t.name, t.mtu)
 		if err != nil {
-			return nil, fmt.Errorf("failed to set IPv4 MTU: %v", err)
+			return fmt.Errorf("failed to set IPv4 MTU: %v", err)
 		}
 	}
 
 	if t.ipv6 {
-		err = internal.SetIPv6Address(t.name, config.AppConfig.IPv6, "128")
+		if err := internal.DisableIPv6RouterDiscovery(t.name); err != nil {
+			if err := t.tolerate(err, "failed to disable IPv6 router discovery"); err != nil {
+				return err
+			}
+		}
+
+		err := internal.SetIPv6Address(t.name, cfg.IPv6, "128")
 		if err != nil {
-			return nil, fmt.Errorf("failed to set IPv6 address: %v", err)
+			return fmt.Errorf("failed to set IPv6 address: %v", err)
 		}
 
 		err = internal.SetIPv6MTU(t.name, t.mtu)
 		if err != nil {
-			return nil, fmt.Errorf("failed to set IPv6 MTU: %v", err)
+			return fmt.Errorf("failed to set IPv6 MTU: %v", err)
 		}
 	}
 
-	return api.NewNetstackAdapter(dev), nil
+	return nil
+}
+
+// watchAdapter recovers the adapter when Windows resets it, e.g. after a driver update or
+// when resuming from fast startup. A removed adapter is created again, an adapter that lost
+// its addresses or MTU is configured again, together with its routes, DNS servers and the kill switch.
+func (t *tunDevice) watchAdapter() {
+	luid, err := internal.InterfaceLUID(t.name)
+	if err != nil {
+		log.Printf("Warning: not watching adapter %s for resets: %v", t.name, err)
+		return
+	}
+	t.platform.luid = luid
+
+	var mu sync.Mutex
+	timer := time.AfterFunc(adapterRecoveryDebounce, t.recoverAdapter)
+	timer.Stop()
+
+	err = internal.WatchInterfaces(func(luid uint64) {
+		t.platform.mu.Lock()
+		ours := luid == t.platform.luid
+		t.platform.mu.Unlock()
+		if ours {
+			mu.Lock()
+			timer.Reset(adapterRecoveryDebounce)
+			mu.Unlock()
+		}
+	})
+	if err != nil {
+		log.Printf("Warning: not watching adapter %s for resets: %v", t.name, err)
+	}
+}
+
+// recoverAdapter creates or configures the adapter again if Windows reset it.
+func (t *tunDevice) recoverAdapter() {
+	t.platform.mu.Lock()
+	defer t.platform.mu.Unlock()
+
+	luid, err := internal.InterfaceLUID(t.name)
+	if err == nil {
+		if t.adapterConfigured() {
+			return
+		}
+		log.Printf("Adapter %s lost its configuration, applying it again", t.name)
+	} else {
+		log.Printf("Adapter %s is gone, creating it again", t.name)
+		dev, closer, err := t.createAdapter()
+		if err != nil {
+			log.Printf("Failed to create adapter again: %v", err)
+			return
+		}
+		t.platform.adapter.replace(dev, closer)
+		if luid, err = internal.InterfaceLUID(t.name); err != nil {
+			log.Printf("Failed to find recreated adapter: %v", err)
+			return
+		}
+	}
+
+	if err := t.configureAdapter(); err != nil {
+		log.Printf("Failed to configure adapter again: %v", err)
+		return
+	}
+
+	if t.metric > 0 {
+		for _, family := range t.families() {
+			if err := internal.SetInterfaceMetric(t.name, family, t.metric); err != nil {
+				log.Printf("Failed to set %s interface metric again: %v", family, err)
+			}
+		}
+	}
+	// routes through the adapter disappear with it, so they have no cleanup step
+	for _, prefix := range t.routesInclude {
+		if err := internal.AddRoute(prefix, luid, netip.Addr{}, 0); err != nil && !errors.Is(err, windows.ERROR_OBJECT_ALREADY_EXISTS) {
+			log.Printf("Failed to add included route %s again: %v", prefix, err)
+		}
+	}
+	if t.platform.dnsServers != nil {
+		if err := internal.SetInterfaceDNS(t.name, t.platform.dnsServers); err != nil {
+			log.Printf("Failed to set DNS servers again: %v", err)
+		}
+	}
+	// the kill switch allows the adapter by its LUID
+	if t.platform.killSwitchEndpoints != nil && luid != t.platform.luid {
+		if err := internal.DisableKillSwitch(); err != nil {
+			log.Printf("Failed to disable kill switch for the new adapter: %v", err)
+		}
+		if err := internal.EnableKillSwitch(luid, t.platform.killSwitchEndpoints); err != nil {
+			log.Printf("Failed to enable kill switch for the new adapter: %v", err)
+		}
+	}
+
+	t.platform.luid = luid
+	log.Printf("Adapter %s recovered", t.name)
+}
+
+// adapterConfigured reports whether the adapter still has the tunnel addresses and MTU.
+func (t *tunDevice) adapterConfigured() bool {
+	iface, err := net.InterfaceByName(t.name)
+	if err != nil || iface.MTU != t.mtu {
+		return false
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+
+	cfg := config.Current()
+	var want []string
+	if t.ipv4 {
+		want = append(want, cfg.IPv4)
+	}
+	if t.ipv6 {
+		want = append(want, cfg.IPv6)
+	}
+	for _, addr := range want {
+		wanted, err := netip.ParseAddr(addr)
+		if err != nil {
+			return false
+		}
+		if !slices.ContainsFunc(addrs, func(a net.Addr) bool {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok {
+				return false
+			}
+			have, ok := netip.AddrFromSlice(ipNet.IP)
+			return ok && have.Unmap() == wanted
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringCapacity returns the Wintun ring capacity fitting queueLen packets of the given MTU.
+// Wintun requires a power of two within its limits, so the result is rounded up and clamped.
+func ringCapacity(queueLen, mtu int) uint32 {
+	// every packet is preceded by a 4 byte header and aligned to 4 bytes
+	need := uint64(queueLen) * uint64(4+(mtu+3)&^3)
+	capacity := uint64(wintun.RingCapacityMin)
+	for capacity < need && capacity < wintun.RingCapacityMax {
+		capacity <<= 1
+	}
+	return uint32(capacity)
+}
+
+// dialer returns a dial function binding its sockets to the Wintun adapter.
+func (t *tunDevice) dialer() func(ctx context.Context, network, address string) (net.Conn, error) {
+	d := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var bindErr error
+			if err := c.Control(func(fd uintptr) {
+				bindErr = internal.BindToInterface(fd, network, t.name)
+			}); err != nil {
+				return err
+			}
+			return bindErr
+		},
+	}
+	return d.DialContext
+}
+
+// setupRoutes installs the requested split tunneling routes and the interface metric.
+// Excluded prefixes get routed via the gateway currently used to reach them, included
+// prefixes via the TUN device. Every route installed is removed again by runCleanup.
+func (t *tunDevice) setupRoutes() error {
+	luid, err := internal.InterfaceLUID(t.name)
+	if err != nil {
+		return err
+	}
+
+	if t.metric > 0 {
+		for _, family := range t.families() {
+			if err := internal.SetInterfaceMetric(t.name, family, t.metric); err != nil {
+				return fmt.Errorf("failed to set %s interface metric: %v", family, err)
+			}
+		}
+	}
+
+	// GetBestRoute2 behind FindRoute would pick the included routes, so they come last
+	for _, prefix := range t.routesExclude {
+		if err := t.addExcludedRoute(prefix); err != nil {
+			return err
+		}
+	}
+	// failures are only warnings, see the endpointRoutes field
+	for _, prefix := range t.endpointRoutes {
+		if err := t.addExcludedRoute(prefix); err != nil {
+			log.Printf("Warning: not excluding endpoint %s from the tunnel: %v", prefix, err)
+		}
+	}
+
+	for _, prefix := range t.routesInclude {
+		if err := t.addRoute(prefix, luid, netip.Addr{}); err != nil {
+			return fmt.Errorf("failed to add included route %s: %v", prefix, err)
+		}
+	}
+
+	return nil
+}
+
+// families returns the netsh names of the address families enabled inside the tunnel.
+func (t *tunDevice) families() []string {
+	var families []string
+	if t.ipv4 {
+		families = append(families, "ipv4")
+	}
+	if t.ipv6 {
+		families = append(families, "ipv6")
+	}
+	return families
+}
+
+// addExcludedRoute routes prefix via the gateway currently used to reach it.
+func (t *tunDevice) addExcludedRoute(prefix netip.Prefix) error {
+	tunLUID, err := internal.InterfaceLUID(t.name)
+	if err != nil {
+		return err
+	}
+
+	luid, nexthop, err := internal.FindRoute(prefix.Addr())
+	if err != nil {
+		return fmt.Errorf("failed to find route for %s: %v", prefix, err)
+	}
+	if luid == tunLUID {
+		return fmt.Errorf("%s is already routed via %s", prefix, t.name)
+	}
+	if err := t.addRoute(prefix, luid, nexthop); err != nil {
+		return fmt.Errorf("failed to add excluded route %s: %v", prefix, err)
+	}
+	return nil
+}
+
+// addRoute adds a route and registers its removal as a cleanup step.
+func (t *tunDevice) addRoute(prefix netip.Prefix, luid uint64, nexthop netip.Addr) error {
+	if err := internal.AddRoute(prefix, luid, nexthop, 0); err != nil {
+		return err
+	}
+	log.Printf("Added route: %s", prefix)
+
+	t.addCleanup(func() error {
+		if err := internal.DeleteRoute(prefix, luid, nexthop); err != nil {
+			return fmt.Errorf("failed to delete route %s: %v", prefix, err)
+		}
+		return nil
+	})
+	return nil
+}
+
+// setupDNS configures Windows to resolve names through the tunnel. With DNS overrides,
+// Name Resolution Policy Table rules send only the overridden domains to their servers and
+// the system resolvers stay untouched. Otherwise the servers are set on the TUN interface.
+func (t *tunDevice) setupDNS(servers []netip.Addr) error {
+	if len(t.dnsOverrides) == 0 {
+		if err := internal.SetInterfaceDNS(t.name, servers); err != nil {
+			return err
+		}
+		t.platform.dnsServers = servers
+		return nil
+	}
+
+	i := 0
+	for domain, upstreams := range t.dnsOverrides {
+		var addrs []netip.Addr
+		for _, upstream := range upstreams {
+			// NRPT rules can't carry a port
+			if upstream.Port() != 53 {
+				return fmt.Errorf("DNS server %s for %s must use port 53 for NRPT rules", upstream, domain)
+			}
+			addrs = append(addrs, upstream.Addr())
+		}
+
+		name := fmt.Sprintf("usque-%s-%d", t.name, i)
+		i++
+		if err := internal.AddNRPTRule(name, []string{domain}, addrs); err != nil {
+			return err
+		}
+		log.Printf("Added NRPT rule: %s via %v", domain, addrs)
+
+		t.addCleanup(func() error {
+			return internal.DeleteNRPTRule(name)
+		})
+	}
+
+	return nil
+}
+
+// enableKillSwitch blocks traffic outside of the tunnel with WFP filters until runCleanup.
+// Windows removes the filters by itself if usque exits without cleaning up.
+func (t *tunDevice) enableKillSwitch(endpoints []netip.AddrPort) error {
+	luid, err := internal.InterfaceLUID(t.name)
+	if err != nil {
+		return err
+	}
+
+	if err := internal.EnableKillSwitch(luid, endpoints); err != nil {
+		return err
+	}
+	t.platform.killSwitchEndpoints = endpoints
+
+	t.addCleanup(func() error {
+		if err := internal.DisableKillSwitch(); err != nil {
+			return fmt.Errorf("failed to disable kill switch: %v", err)
+		}
+		return nil
+	})
+	return nil
+}
+
+func (t *tunDevice) setupPolicyRouting() error {
+	return errors.New("per-application routing is not supported on this platform")
 }
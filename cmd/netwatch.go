@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+// networkChangeDebounce groups bursts of changes (e.g. a new DHCP lease) into a single reconnect.
+const networkChangeDebounce = 500 * time.Millisecond
+
+// watchNetwork makes the tunnel reconnect right away when the default route or addresses
+// change, if --watch-network is set.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - ignoreIface: string - Interface whose changes are ignored, e.g. our own TUN device.
+func watchNetwork(cmd *cobra.Command, ignoreIface string) {
+	watch, err := cmd.Flags().GetBool("watch-network")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get watch-network flag: %v", err)
+	}
+	if !watch {
+		return
+	}
+
+	var mu sync.Mutex
+	timer := time.AfterFunc(networkChangeDebounce, func() {
+		slog.Info("Network changed, reconnecting", "component", "tunnel")
+		api.DefaultTunnel.NotifyNetworkChange()
+	})
+	timer.Stop()
+
+	err = internal.WatchNetwork(ignoreIface, func() {
+		mu.Lock()
+		timer.Reset(networkChangeDebounce)
+		mu.Unlock()
+	})
+	if err != nil {
+		slog.Warn("Failed to watch for network changes", "component", "tunnel", "error", err)
+	}
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// setupUDPOffload applies --no-gso and --no-ecn by switching off the gso and ecn features.
+// quic-go batches outgoing packets with UDP GSO, reads incoming ones with recvmmsg and
+// sets and reads the ECN bits of its packets on its own.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - error: An error if a flag can't be read.
+func setupUDPOffload(cmd *cobra.Command) error {
+	noGSO, err := cmd.Flags().GetBool("no-gso")
+	if err != nil {
+		return err
+	}
+	if noGSO {
+		if err := api.Features.Set(api.FeatureGSO, false); err != nil {
+			return err
+		}
+	}
+
+	noECN, err := cmd.Flags().GetBool("no-ecn")
+	if err != nil {
+		return err
+	}
+	if noECN {
+		return api.Features.Set(api.FeatureECN, false)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().Bool("no-gso", false, "Linux only: send every QUIC packet with its own syscall instead of batching them with UDP GSO, for drivers that mishandle GSO")
+	rootCmd.PersistentFlags().Bool("no-ecn", false, "Send QUIC packets without ECN marks and ignore congestion marks on them, for networks that mangle or drop ECN marked packets")
+}
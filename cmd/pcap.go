@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// withPcap wraps the device in an api.PcapDevice if --pcap is set, capturing the packets
+// going through the tunnel in both directions. It wraps the other devices, so the capture
+// shows what the tunnel actually sent and received.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - dev: api.TunnelDevice - The device to wrap.
+//
+// Returns:
+//   - api.TunnelDevice: The wrapped device, or dev itself if capturing is disabled.
+func withPcap(cmd *cobra.Command, dev api.TunnelDevice) api.TunnelDevice {
+	path, err := cmd.Flags().GetString("pcap")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get pcap file: %v", err)
+	}
+	if path == "" {
+		return dev
+	}
+
+	snaplen, err := cmd.Flags().GetInt("pcap-snaplen")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get pcap snap length: %v", err)
+	}
+
+	// the capture holds decrypted traffic, so it is only readable by the owner
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		fatalWith(ExitFailure, "Failed to create pcap file: %v", err)
+	}
+
+	pcap, err := api.NewPcapDevice(dev, file, snaplen)
+	if err != nil {
+		fatalWith(ExitFailure, "Failed to write pcap file: %v", err)
+	}
+
+	log.Printf("Capturing tunnel traffic to %s", path)
+	return pcap
+}
+
+func init() {
+	rootCmd.PersistentFlags().String("pcap", "", "Write the packets going through the tunnel to this pcapng file")
+	rootCmd.PersistentFlags().Int("pcap-snaplen", 0, "Bytes captured of each packet with --pcap, 0 captures whole packets")
+}
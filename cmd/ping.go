@@ -0,0 +1,377 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+var pingCmd = &cobra.Command{
+	Use:   "ping <host>",
+	Short: "Ping a host through the tunnel",
+	Long: "Brings up the tunnel in userspace and sends ICMP echo requests through it, without a TUN device or root." +
+		" Host names are resolved through the tunnel with the configured DNS servers.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		count, err := cmd.Flags().GetInt("count")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get count: %v\n", err)
+		}
+		interval, err := cmd.Flags().GetDuration("interval")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get interval: %v\n", err)
+		}
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get timeout: %v\n", err)
+		}
+		size, err := cmd.Flags().GetInt("size")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get size: %v\n", err)
+		}
+		ttl, err := cmd.Flags().GetUint8("ttl")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get TTL: %v\n", err)
+		}
+
+		pinger, tunNet, ok := startPinger(cmd)
+		if !ok {
+			return
+		}
+		defer pinger.Close()
+
+		dst, err := resolvePingTarget(cmd, tunNet, args[0])
+		if err != nil {
+			fatalWith(ExitFailure, "Failed to resolve %s: %v", args[0], err)
+		}
+
+		cmd.Printf("PING %s (%s): %d data bytes\n", args[0], dst, size)
+		var sent, received int
+		var minRTT, maxRTT, total time.Duration
+		for i := 0; count == 0 || i < count; i++ {
+			if i > 0 {
+				time.Sleep(interval)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			reply, err := pinger.Ping(ctx, dst, ttl, size)
+			cancel()
+			sent++
+			switch {
+			case errors.Is(err, api.ErrPingTimeout):
+				cmd.Printf("Request timeout for icmp_seq=%d\n", i+1)
+			case err != nil:
+				fatalWith(ExitFailure, "Failed to ping: %v", err)
+			case !reply.Reached:
+				cmd.Printf("From %s icmp_seq=%d %s\n", reply.From, i+1, icmpErrorText(reply))
+			default:
+				received++
+				total += reply.RTT
+				if minRTT == 0 || reply.RTT < minRTT {
+					minRTT = reply.RTT
+				}
+				maxRTT = max(maxRTT, reply.RTT)
+				cmd.Printf("%d bytes from %s: icmp_seq=%d ttl=%d time=%s\n", reply.Size, reply.From, i+1, reply.TTL, formatLatency(reply.RTT))
+			}
+		}
+
+		cmd.Printf("\n--- %s ping statistics ---\n", args[0])
+		cmd.Printf("%d packets transmitted, %d received, %.1f%% packet loss\n", sent, received, float64(sent-received)*100/float64(sent))
+		if received > 0 {
+			cmd.Printf("rtt min/avg/max = %s/%s/%s\n", formatLatency(minRTT), formatLatency(total/time.Duration(received)), formatLatency(maxRTT))
+		}
+	},
+}
+
+var tracerouteCmd = &cobra.Command{
+	Use:   "traceroute <host>",
+	Short: "Trace the route to a host through the tunnel",
+	Long: "Brings up the tunnel in userspace and sends ICMP echo requests with increasing TTL through it, printing" +
+		" the routers answering with time exceeded, without a TUN device or root." +
+		" The first hops are inside Cloudflare's network and may not answer.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		maxHops, err := cmd.Flags().GetUint8("max-hops")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get max hops: %v\n", err)
+		}
+		queries, err := cmd.Flags().GetInt("queries")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get queries: %v\n", err)
+		}
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get timeout: %v\n", err)
+		}
+		size, err := cmd.Flags().GetInt("size")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get size: %v\n", err)
+		}
+
+		pinger, tunNet, ok := startPinger(cmd)
+		if !ok {
+			return
+		}
+		defer pinger.Close()
+
+		dst, err := resolvePingTarget(cmd, tunNet, args[0])
+		if err != nil {
+			fatalWith(ExitFailure, "Failed to resolve %s: %v", args[0], err)
+		}
+
+		cmd.Printf("traceroute to %s (%s), %d hops max\n", args[0], dst, maxHops)
+		for ttl := uint8(1); ttl <= maxHops; ttl++ {
+			cmd.Printf("%2d ", ttl)
+			var from netip.Addr
+			reached := false
+			for range queries {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				reply, err := pinger.Ping(ctx, dst, ttl, size)
+				cancel()
+				if errors.Is(err, api.ErrPingTimeout) {
+					cmd.Print(" *")
+					continue
+				}
+				if err != nil {
+					fatalWith(ExitFailure, "Failed to send probe: %v", err)
+				}
+				if reply.From != from {
+					from = reply.From
+					cmd.Printf(" %s", from)
+				}
+				cmd.Printf("  %s", formatLatency(reply.RTT))
+				switch {
+				case reply.Reached:
+					reached = true
+				case !timeExceeded(reply):
+					cmd.Printf(" (%s)", icmpErrorText(reply))
+				}
+			}
+			cmd.Println()
+			if reached {
+				return
+			}
+		}
+	},
+}
+
+// startPinger brings up the tunnel in userspace with a Pinger in front of a netstack.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command with the tunnel flags.
+//
+// Returns:
+//   - *api.Pinger: The pinger, connected.
+//   - *netstack.Net: The netstack, used to resolve host names.
+//   - bool: Whether the tunnel is up. Errors are printed.
+func startPinger(cmd *cobra.Command) (*api.Pinger, *netstack.Net, bool) {
+	if !config.ConfigLoaded {
+		cmd.Println("Config not loaded. Please register first.")
+		return nil, nil, false
+	}
+
+	sni, err := getSNI(cmd)
+	if err != nil {
+		cmd.Printf("Failed to get SNI address: %v\n", err)
+		return nil, nil, false
+	}
+
+	privKey, err := config.AppConfig.GetEcPrivateKey()
+	if err != nil {
+		cmd.Printf("Failed to get private key: %v\n", err)
+		return nil, nil, false
+	}
+	peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
+	if err != nil {
+		cmd.Printf("Failed to get public key: %v\n", err)
+		return nil, nil, false
+	}
+
+	cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+	if err != nil {
+		cmd.Printf("Failed to generate cert: %v\n", err)
+		return nil, nil, false
+	}
+
+	tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
+	if err != nil {
+		cmd.Printf("Failed to prepare TLS config: %v\n", err)
+		return nil, nil, false
+	}
+
+	keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
+	if err != nil {
+		cmd.Printf("Failed to get keepalive period: %v\n", err)
+		return nil, nil, false
+	}
+	initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
+	if err != nil {
+		cmd.Printf("Failed to get initial packet size: %v\n", err)
+		return nil, nil, false
+	}
+
+	endpoints, err := getEndpoints(cmd, &config.AppConfig)
+	if err != nil {
+		cmd.Printf("Failed to get endpoints: %v\n", err)
+		return nil, nil, false
+	}
+
+	v4, v6, err := tunnelAddresses(cmd, &config.AppConfig)
+	if err != nil {
+		cmd.Printf("Failed to get tunnel addresses: %v\n", err)
+		return nil, nil, false
+	}
+
+	var localAddresses []netip.Addr
+	for _, addr := range []netip.Addr{v4, v6} {
+		if addr.IsValid() {
+			localAddresses = append(localAddresses, addr)
+		}
+	}
+
+	dnsServers, err := cmd.Flags().GetStringArray("dns")
+	if err != nil {
+		cmd.Printf("Failed to get DNS servers: %v\n", err)
+		return nil, nil, false
+	}
+
+	var dnsAddrs []netip.Addr
+	for _, dns := range dnsServers {
+		addr, err := netip.ParseAddr(dns)
+		if err != nil {
+			cmd.Printf("Failed to parse DNS server: %v\n", err)
+			return nil, nil, false
+		}
+		dnsAddrs = append(dnsAddrs, addr)
+	}
+
+	mtu, err := cmd.Flags().GetInt("mtu")
+	if err != nil {
+		cmd.Printf("Failed to get MTU: %v\n", err)
+		return nil, nil, false
+	}
+	if err := checkMTU(mtu); err != nil {
+		cmd.Printf("Invalid MTU: %v\n", err)
+		return nil, nil, false
+	}
+
+	reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
+	if err != nil {
+		cmd.Printf("Failed to get reconnect delay: %v\n", err)
+		return nil, nil, false
+	}
+	connectTimeout, err := cmd.Flags().GetDuration("connect-timeout")
+	if err != nil {
+		cmd.Printf("Failed to get connect timeout: %v\n", err)
+		return nil, nil, false
+	}
+
+	tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, mtu)
+	if err != nil {
+		cmd.Printf("Failed to create virtual TUN device: %v\n", err)
+		return nil, nil, false
+	}
+
+	pinger := api.NewPinger(api.NewNetstackAdapter(api.DefaultTunnel, tunDev), localAddresses[0], localAddresses[1])
+	go api.MaintainTunnel(context.Background(), api.DefaultTunnel, tlsConfig, keepalivePeriod, initialPacketSize, endpoints, withPcap(cmd, withChaos(cmd, pinger)), mtu, reconnectDelay)
+
+	if _, err := waitConnected(connectTimeout); err != nil {
+		fatalWith(ExitEndpoint, "Failed to connect: %v", err)
+	}
+	return pinger, tunNet, true
+}
+
+// resolvePingTarget returns the address to ping for host, resolving names through the tunnel.
+// IPv4 addresses are preferred unless --inet6 is set.
+func resolvePingTarget(cmd *cobra.Command, tunNet *netstack.Net, host string) (netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr, nil
+	}
+
+	inet6, err := cmd.Flags().GetBool("inet6")
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := tunNet.LookupContextHost(ctx, host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, a := range addrs {
+		addr, err := netip.ParseAddr(a)
+		if err == nil && addr.Is6() == inet6 {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("no IPv%d address", map[bool]int{false: 4, true: 6}[inet6])
+}
+
+// timeExceeded reports whether reply is an ICMP time exceeded error, the answer of routers to traceroute probes.
+func timeExceeded(reply api.PingReply) bool {
+	if reply.From.Is4() {
+		return reply.Type == 11
+	}
+	return reply.Type == 3
+}
+
+// icmpErrorText describes the ICMP error of reply.
+func icmpErrorText(reply api.PingReply) string {
+	if reply.From.Is4() {
+		switch reply.Type {
+		case 3:
+			return fmt.Sprintf("Destination Unreachable (code %d)", reply.Code)
+		case 11:
+			return "Time to live exceeded"
+		}
+	} else {
+		switch reply.Type {
+		case 1:
+			return fmt.Sprintf("Destination Unreachable (code %d)", reply.Code)
+		case 2:
+			return "Packet too big"
+		case 3:
+			return "Hop limit exceeded"
+		}
+	}
+	return fmt.Sprintf("ICMP type %d code %d", reply.Type, reply.Code)
+}
+
+// addPingFlags adds the flags shared by ping and traceroute.
+func addPingFlags(c *cobra.Command) {
+	c.Flags().Bool("inet6", false, "Resolve host names to IPv6 addresses")
+	c.Flags().Duration("timeout", 2*time.Second, "How long to wait for each reply")
+	c.Flags().Duration("connect-timeout", 30*time.Second, "How long to wait for the tunnel to connect")
+	c.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
+	c.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	c.Flags().Bool("happy-eyeballs", false, "Race the IPv6 and IPv4 endpoints and use whichever connects first")
+	c.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers to use")
+	c.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	c.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
+	c.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
+	c.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
+	c.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts after transient failures, rejections wait longer")
+}
+
+func init() {
+	pingCmd.Flags().IntP("count", "n", 4, "Number of echo requests to send, 0 to ping until interrupted")
+	pingCmd.Flags().Duration("interval", time.Second, "Time between echo requests")
+	pingCmd.Flags().Int("size", 56, "Bytes of data in each echo request")
+	pingCmd.Flags().Uint8("ttl", 64, "TTL or hop limit of the echo requests")
+	addPingFlags(pingCmd)
+	rootCmd.AddCommand(pingCmd)
+
+	tracerouteCmd.Flags().Uint8("max-hops", 30, "Maximum number of hops")
+	tracerouteCmd.Flags().Int("queries", 3, "Probes sent to each hop")
+	tracerouteCmd.Flags().Int("size", 32, "Bytes of data in each probe")
+	addPingFlags(tracerouteCmd)
+	rootCmd.AddCommand(tracerouteCmd)
+}
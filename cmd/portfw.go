@@ -25,134 +25,93 @@ var portFwCmd = &cobra.Command{
 		"Doesn't require elevated privileges.",
 	Run: func(cmd *cobra.Command, args []string) {
 		if !config.ConfigLoaded {
-			cmd.Println("Config not loaded. Please register first.")
-			return
+			exitNotRegistered(cmd)
 		}
 
-		sni, err := cmd.Flags().GetString("sni-address")
+		sni, err := getSNI(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get SNI address: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get SNI address: %v\n", err)
 		}
 
 		privKey, err := config.AppConfig.GetEcPrivateKey()
 		if err != nil {
-			cmd.Printf("Failed to get private key: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get private key: %v\n", err)
 		}
 		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
 		if err != nil {
-			cmd.Printf("Failed to get public key: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get public key: %v\n", err)
 		}
 
 		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
 		if err != nil {
-			cmd.Printf("Failed to generate cert: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to generate cert: %v\n", err)
 		}
 
 		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
 		if err != nil {
-			cmd.Printf("Failed to prepare TLS config: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to prepare TLS config: %v\n", err)
 		}
 
 		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
 		if err != nil {
-			cmd.Printf("Failed to get keepalive period: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get keepalive period: %v\n", err)
 		}
 		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
 		if err != nil {
-			cmd.Printf("Failed to get initial packet size: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get initial packet size: %v\n", err)
 		}
 
-		connectPort, err := cmd.Flags().GetInt("connect-port")
+		endpoints, err := getEndpoints(cmd, &config.AppConfig)
 		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get endpoints: %v\n", err)
 		}
 
-		var endpoint *net.UDPAddr
-		if ipv6, err := cmd.Flags().GetBool("ipv6"); err == nil && !ipv6 {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV4),
-				Port: connectPort,
-			}
-		} else {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV6),
-				Port: connectPort,
-			}
-		}
-
-		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
-		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
-			return
-		}
-
-		tunnelIPv6, err := cmd.Flags().GetBool("no-tunnel-ipv6")
+		v4, v6, err := tunnelAddresses(cmd, &config.AppConfig)
 		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv6: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get tunnel addresses: %v\n", err)
 		}
 
 		var localAddresses []netip.Addr
-		if !tunnelIPv4 {
-			v4, err := netip.ParseAddr(config.AppConfig.IPv4)
-			if err != nil {
-				cmd.Printf("Failed to parse IPv4 address: %v\n", err)
-				return
-			}
-			localAddresses = append(localAddresses, v4)
-		}
-		if !tunnelIPv6 {
-			v6, err := netip.ParseAddr(config.AppConfig.IPv6)
-			if err != nil {
-				cmd.Printf("Failed to parse IPv6 address: %v\n", err)
-				return
+		for _, addr := range []netip.Addr{v4, v6} {
+			if addr.IsValid() {
+				localAddresses = append(localAddresses, addr)
 			}
-			localAddresses = append(localAddresses, v6)
 		}
 
 		dnsServers, err := cmd.Flags().GetStringArray("dns")
 		if err != nil {
-			cmd.Printf("Failed to get DNS servers: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get DNS servers: %v\n", err)
 		}
 
 		var dnsAddrs []netip.Addr
 		for _, dns := range dnsServers {
 			addr, err := netip.ParseAddr(dns)
 			if err != nil {
-				cmd.Printf("Failed to parse DNS server: %v\n", err)
-				return
+				exitWith(cmd, ExitUsage, "Failed to parse DNS server: %v\n", err)
 			}
 			dnsAddrs = append(dnsAddrs, addr)
 		}
 
 		mtu, err := cmd.Flags().GetInt("mtu")
 		if err != nil {
-			cmd.Printf("Failed to get MTU: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get MTU: %v\n", err)
+		}
+		netstackMTU, err := getNetstackMTU(cmd, mtu, initialPacketSize)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Invalid packet sizes: %v\n", err)
 		}
-		if mtu != 1280 {
+		if netstackMTU != 1280 {
 			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
 		}
 
 		localPorts, err := cmd.Flags().GetStringArray("local-ports")
 		if err != nil {
-			cmd.Printf("Failed to get local ports: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get local ports: %v\n", err)
 		}
 
 		remotePorts, err := cmd.Flags().GetStringArray("remote-ports")
 		if err != nil {
-			cmd.Printf("Failed to get remote ports: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get remote ports: %v\n", err)
 		}
 
 		var localPortMappings []internal.PortMapping
@@ -161,8 +120,7 @@ var portFwCmd = &cobra.Command{
 		for _, port := range localPorts {
 			portMapping, err := internal.ParsePortMapping(port)
 			if err != nil {
-				cmd.Printf("Failed to parse local port mapping: %v\n", err)
-				return
+				exitWith(cmd, ExitUsage, "Failed to parse local port mapping: %v\n", err)
 			}
 			localPortMappings = append(localPortMappings, portMapping)
 		}
@@ -170,26 +128,30 @@ var portFwCmd = &cobra.Command{
 		for _, port := range remotePorts {
 			portMapping, err := internal.ParsePortMapping(port)
 			if err != nil {
-				cmd.Printf("Failed to parse remote port mapping: %v\n", err)
-				return
+				exitWith(cmd, ExitUsage, "Failed to parse remote port mapping: %v\n", err)
 			}
 			remotePortMappings = append(remotePortMappings, portMapping)
 		}
 
 		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
 		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get reconnect delay: %v\n", err)
 		}
 
-		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, mtu)
+		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, netstackMTU)
 		if err != nil {
-			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
-			return
+			exitWith(cmd, ExitTUN, "Failed to create virtual TUN device: %v\n", err)
 		}
 		defer tunDev.Close()
 
-		go api.MaintainTunnel(context.Background(), tlsConfig, keepalivePeriod, initialPacketSize, endpoint, api.NewNetstackAdapter(tunDev), mtu, reconnectDelay)
+		logEffectiveConfig(cmd, endpoints)
+		watchNetwork(cmd, "")
+		serveControl(cmd, endpoints)
+		watchConfig(cmd, endpoints)
+		setupStandby(cmd)
+		setupWireGuardFallback(cmd)
+		loadEndpointBlocklist(cmd)
+		go api.MaintainTunnel(context.Background(), api.DefaultTunnel, tlsConfig, keepalivePeriod, initialPacketSize, endpoints, withPcap(cmd, withChaos(cmd, withMSSClamp(cmd, withInboundFilter(cmd, withFamilyFilter(cmd, withFlowExport(cmd, withPathMTU(cmd, api.NewNetstackAdapter(api.DefaultTunnel, tunDev)))))))), mtu, reconnectDelay)
 
 		log.Printf("Virtual tunnel created, forwarding ports")
 
@@ -222,13 +184,11 @@ var portFwCmd = &cobra.Command{
 		}
 		resp, err := client.Get("https://cloudflareok.com/test")
 		if err != nil {
-			cmd.Printf("Failed to make request to cloudflare.com: %v\n", err)
-			return
+			exitWith(cmd, ExitEndpoint, "Failed to make request to cloudflare.com: %v\n", err)
 		}
 		defer resp.Body.Close()
 		if resp.StatusCode != 204 {
-			cmd.Printf("Failed to make request to cloudflare.com: %s\n", resp.Status)
-			return
+			exitWith(cmd, ExitEndpoint, "Failed to make request to cloudflare.com: %s\n", resp.Status)
 		}
 		log.Println("Successfully connected to Cloudflare")
 
@@ -333,12 +293,19 @@ func init() {
 	portFwCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
 	portFwCmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers to use inside the MASQUE tunnel")
 	portFwCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	portFwCmd.Flags().Bool("happy-eyeballs", false, "Race the IPv6 and IPv4 endpoints and use whichever connects first")
+	portFwCmd.Flags().Bool("watch-network", false, "Reconnect right away when the default route or addresses of the system change")
 	portFwCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	portFwCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
 	portFwCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
 	portFwCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
 	portFwCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
+	portFwCmd.Flags().Int("netstack-mtu", 0, "Link MTU of the userspace network stack, sets the size of its packets and the MSS of its TCP connections (0 for --mtu)")
 	portFwCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
-	portFwCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	portFwCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts after transient failures, rejections wait longer")
+	portFwCmd.Flags().String("flow-collector", "", "IPFIX collector to export flow records to (e.g. 192.0.2.10:4739)")
+	portFwCmd.Flags().Duration("flow-interval", 60*time.Second, "How often flow records are exported")
+	portFwCmd.Flags().Bool("strict-inbound", false, "Drop packets from the server not addressed to the tunnel addresses or --inbound-allow prefixes")
+	portFwCmd.Flags().StringArray("inbound-allow", []string{}, "Extra destination CIDR accepted from the server with --strict-inbound (can be repeated)")
 	rootCmd.AddCommand(portFwCmd)
 }
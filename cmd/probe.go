@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+var endpointsCmd = &cobra.Command{
+	Use:   "endpoints",
+	Short: "Inspect MASQUE endpoints",
+}
+
+var endpointsProbeCmd = &cobra.Command{
+	Use:   "probe",
+	Short: "Rank MASQUE endpoints by latency and data center",
+	Long: "Performs a QUIC handshake with Cloudflare anycast IPs on the known MASQUE ports without setting up a tunnel," +
+		" asks every endpoint which data center answered and prints the endpoints ranked by handshake time." +
+		" The ranking is printed as an endpoint list ready for the config and can be saved to it with --save.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.ConfigLoaded {
+			exitNotRegistered(cmd)
+		}
+
+		configPath, err := getConfigPath(cmd)
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get config path: %v", err)
+		}
+
+		sni, err := getSNI(cmd)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get SNI address: %v\n", err)
+		}
+
+		privKey, err := config.AppConfig.GetEcPrivateKey()
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get private key: %v\n", err)
+		}
+		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get public key: %v\n", err)
+		}
+
+		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to generate cert: %v\n", err)
+		}
+
+		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to prepare TLS config: %v\n", err)
+		}
+
+		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get initial packet size: %v\n", err)
+		}
+
+		ips, err := cmd.Flags().GetStringArray("ip")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get IPs: %v\n", err)
+		}
+
+		ports, err := cmd.Flags().GetIntSlice("ports")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get ports: %v\n", err)
+		}
+
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get timeout: %v\n", err)
+		}
+
+		concurrency, err := cmd.Flags().GetInt("concurrency")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get concurrency: %v\n", err)
+		}
+
+		top, err := cmd.Flags().GetInt("top")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get top: %v\n", err)
+		}
+
+		save, err := cmd.Flags().GetBool("save")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get save flag: %v\n", err)
+		}
+
+		endpoints := scanCandidates(ips, ports)
+		log.Printf("Probing %d endpoints...", len(endpoints))
+
+		results := api.ScanEndpoints(context.Background(), tlsConfig, internal.DefaultQuicConfig(0, initialPacketSize), endpoints, timeout, concurrency, true)
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "RANK\tENDPOINT\tRTT\tCOLO")
+		var ranked []string
+		for _, result := range results {
+			if result.Err != nil {
+				fmt.Fprintf(w, "-\t%s\tfailed\t%v\n", result.Endpoint, result.Err)
+				continue
+			}
+			colo := result.Colo
+			if colo == "" {
+				colo = "?"
+			}
+			ranked = append(ranked, result.Endpoint.String())
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", len(ranked), result.Endpoint, result.RTT.Round(time.Millisecond), colo)
+		}
+		w.Flush()
+
+		if len(ranked) == 0 {
+			fatalWith(ExitEndpoint, "No working endpoint found")
+		}
+		if top > 0 && len(ranked) > top {
+			ranked = ranked[:top]
+		}
+
+		list, err := json.Marshal(ranked)
+		if err != nil {
+			fatalWith(ExitFailure, "Failed to marshal endpoints: %v", err)
+		}
+		cmd.Printf("\n\"endpoints\": %s\n", list)
+
+		if !save {
+			return
+		}
+
+		config.AppConfig.Endpoints = ranked
+		if err := config.AppConfig.SaveConfig(configPath); err != nil {
+			fatalWith(ExitConfig, "Failed to save config: %v", err)
+		}
+		log.Printf("Endpoint list saved to %s", configPath)
+	},
+}
+
+func init() {
+	endpointsProbeCmd.Flags().StringArray("ip", internal.KnownMasqueEndpoints, "Endpoint IPs to probe in addition to the ones in the config")
+	endpointsProbeCmd.Flags().IntSlice("ports", internal.KnownMasquePorts, "UDP ports to probe on every IP")
+	endpointsProbeCmd.Flags().Duration("timeout", 3*time.Second, "Timeout for a single probe, including the data center lookup")
+	endpointsProbeCmd.Flags().Int("concurrency", 8, "Number of probes to run at once")
+	endpointsProbeCmd.Flags().Int("top", 4, "Number of endpoints in the printed endpoint list, 0 for all working ones")
+	endpointsProbeCmd.Flags().Bool("save", false, "Save the endpoint list to the config")
+	endpointsProbeCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	endpointsProbeCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
+	endpointsCmd.AddCommand(endpointsProbeCmd)
+	rootCmd.AddCommand(endpointsCmd)
+}
@@ -0,0 +1,295 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// ProfileEnv is the environment variable selecting the profile when --profile isn't given.
+const ProfileEnv = "USQUE_PROFILE"
+
+// profileName matches valid profile names, which become file names.
+var profileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// profileExtensions are the extensions of profile configs, one per config format.
+var profileExtensions = []string{".json", ".yaml", ".yml", ".toml"}
+
+// profilesDir returns the directory profiles are stored in, usque/profiles in the user config directory.
+// Under sudo, that is the config directory of the user who ran sudo, so sudo finds the profiles the
+// user registered without it.
+func profilesDir() (string, error) {
+	if sudoUser := sudoUser(); sudoUser != nil {
+		dir := filepath.Join(sudoUser.HomeDir, ".config")
+		if runtime.GOOS == "darwin" {
+			dir = filepath.Join(sudoUser.HomeDir, "Library", "Application Support")
+		}
+		return filepath.Join(dir, "usque", "profiles"), nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "usque", "profiles"), nil
+}
+
+// sudoUser returns the user who ran usque through sudo, nil if usque wasn't run by sudo.
+func sudoUser() *user.User {
+	name := os.Getenv("SUDO_USER")
+	if os.Geteuid() != 0 || name == "" || name == "root" {
+		return nil
+	}
+	sudoUser, err := user.Lookup(name)
+	if err != nil {
+		return nil
+	}
+	return sudoUser
+}
+
+// selectedProfile returns the profile given with --profile, or USQUE_PROFILE if the flag isn't
+// given. A profile is given as its name, or as its name with the extension of a config format,
+// which picks the format of a new profile.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - string: The profile name, empty if none is selected.
+//   - string: The extension given with the name, empty if none was given.
+//   - error: An error if the flag can't be read or the name is invalid.
+func selectedProfile(cmd *cobra.Command) (string, string, error) {
+	profile, err := cmd.Flags().GetString("profile")
+	if err != nil {
+		return "", "", err
+	}
+	if !cmd.Flags().Changed("profile") {
+		profile = os.Getenv(ProfileEnv)
+	}
+	if profile == "" {
+		return "", "", nil
+	}
+
+	ext := filepath.Ext(profile)
+	if slices.Contains(profileExtensions, ext) {
+		profile = strings.TrimSuffix(profile, ext)
+	} else {
+		ext = ""
+	}
+	if !profileName.MatchString(profile) {
+		return "", "", fmt.Errorf("invalid profile name %q, use letters, digits, - and _", profile)
+	}
+	return profile, ext, nil
+}
+
+// getProfile returns the name of the selected profile, see selectedProfile.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - string: The profile name, empty if none is selected.
+//   - error: An error if the flag can't be read or the name is invalid.
+func getProfile(cmd *cobra.Command) (string, error) {
+	profile, _, err := selectedProfile(cmd)
+	return profile, err
+}
+
+// getConfigPath returns the path of the config: --config if given, otherwise the config of the
+// selected profile, otherwise the default of --config. The config of a profile is the file named
+// after it with the extension of any config format. A new profile is JSON, unless the profile
+// was given with another extension.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - string: The config path.
+//   - error: An error if the flags can't be read, both --config and a profile are given, or
+//     the profile exists in several formats.
+func getConfigPath(cmd *cobra.Command) (string, error) {
+	configPath, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return "", err
+	}
+	profile, ext, err := selectedProfile(cmd)
+	if err != nil || profile == "" {
+		return configPath, err
+	}
+	if cmd.Flags().Changed("config") {
+		return "", fmt.Errorf("--config and profile %s can't be used together", profile)
+	}
+
+	dir, err := profilesDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find profiles directory: %v", err)
+	}
+	var existing []string
+	for _, candidate := range profileExtensions {
+		path := filepath.Join(dir, profile+candidate)
+		if _, err := os.Stat(path); err == nil {
+			existing = append(existing, path)
+		}
+	}
+
+	if ext != "" {
+		path := filepath.Join(dir, profile+ext)
+		if len(existing) > 0 && !slices.Contains(existing, path) {
+			return "", fmt.Errorf("profile %s already exists as %s", profile, existing[0])
+		}
+		return path, nil
+	}
+	switch len(existing) {
+	case 0:
+		return filepath.Join(dir, profile+".json"), nil
+	case 1:
+		return existing[0], nil
+	}
+	return "", fmt.Errorf("profile %s exists in several formats: %s", profile, strings.Join(existing, ", "))
+}
+
+// getControlSocket returns --control-socket, made unique to the selected profile unless given,
+// so tunnels of several profiles can run side by side.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - string: The path of the control socket.
+//   - error: An error if the flags can't be read.
+func getControlSocket(cmd *cobra.Command) (string, error) {
+	path, err := cmd.Flags().GetString("control-socket")
+	if err != nil {
+		return "", err
+	}
+	profile, err := getProfile(cmd)
+	if err != nil || profile == "" || cmd.Flags().Changed("control-socket") {
+		return path, err
+	}
+	if base, ok := strings.CutSuffix(path, ".sock"); ok {
+		return base + "-" + profile + ".sock", nil
+	}
+	return path + "-" + profile, nil
+}
+
+var profileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Manage named profiles",
+	Long: "Profiles keep several registrations (e.g. personal and team) side by side. Select one with --profile or " +
+		ProfileEnv + ", and register into it like into any config.",
+}
+
+var profileListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the profiles",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, err := profilesDir()
+		if err != nil {
+			fatalWith(ExitConfig, "Failed to find profiles directory: %v", err)
+		}
+		current, err := getProfile(cmd)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get profile: %v\n", err)
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			fatalWith(ExitConfig, "Failed to read profiles directory: %v", err)
+		}
+		found := false
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			name := strings.TrimSuffix(entry.Name(), ext)
+			if entry.IsDir() || !slices.Contains(profileExtensions, ext) || !profileName.MatchString(name) {
+				continue
+			}
+			found = true
+			marker := " "
+			if name == current {
+				marker = "*"
+			}
+			cmd.Printf("%s %s\n", marker, name)
+		}
+		if !found {
+			cmd.Printf("No profiles in %s, create one with: usque register --profile <name>\n", dir)
+		}
+	},
+}
+
+var profilePathCmd = &cobra.Command{
+	Use:   "path",
+	Short: "Print the config path of the selected profile",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		configPath, err := getConfigPath(cmd)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get config path: %v\n", err)
+		}
+		cmd.Println(configPath)
+	},
+}
+
+// prepareProfileDir creates the directory of a profile config before it's saved for the first time.
+// Under sudo, the directories are handed to the user who ran sudo, who owns the config directory
+// they are in. The configs saved into them still belong to root.
+//
+// Parameters:
+//   - configPath: string - The config path.
+//
+// Returns:
+//   - error: An error if the directory can't be created.
+func prepareProfileDir(configPath string) error {
+	dir, err := profilesDir()
+	if err != nil || filepath.Dir(configPath) != dir {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	sudoUser := sudoUser()
+	if sudoUser == nil {
+		return nil
+	}
+	uid, err := strconv.Atoi(sudoUser.Uid)
+	if err != nil {
+		return nil
+	}
+	gid, err := strconv.Atoi(sudoUser.Gid)
+	if err != nil {
+		return nil
+	}
+	// the usque directory and profiles below it
+	for _, path := range []string{filepath.Dir(dir), dir} {
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// profileSecretService returns the keychain service of the selected profile, so the secrets
+// of several profiles don't overwrite each other.
+func profileSecretService(cmd *cobra.Command) string {
+	profile, err := getProfile(cmd)
+	if err != nil || profile == "" {
+		return ""
+	}
+	return config.DefaultSecretService + "-" + profile
+}
+
+func init() {
+	rootCmd.PersistentFlags().String("profile", "", "Use the config of a named profile instead of --config (or set "+ProfileEnv+"), a new profile is YAML or TOML if given as <name>.yaml or <name>.toml")
+	profileCmd.AddCommand(profileListCmd, profilePathCmd)
+	rootCmd.AddCommand(profileCmd)
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+// profileCommand returns a command with the flags profiles depend on, parsed from args.
+func profileCommand(t *testing.T, args ...string) *cobra.Command {
+	t.Helper()
+	cmd := &cobra.Command{}
+	cmd.Flags().String("profile", "", "")
+	cmd.Flags().StringP("config", "c", "config.json", "")
+	cmd.Flags().String("control-socket", internal.DefaultControlSocket, "")
+	if err := cmd.ParseFlags(args); err != nil {
+		t.Fatalf("ParseFlags(%q): %v", args, err)
+	}
+	return cmd
+}
+
+// useProfilesDir points the user config directory to a temporary one and returns its profiles directory.
+func useProfilesDir(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("AppData", home)
+	t.Setenv("SUDO_USER", "")
+	t.Setenv(ProfileEnv, "")
+	dir, err := profilesDir()
+	if err != nil {
+		t.Fatalf("profilesDir: %v", err)
+	}
+	if !strings.HasPrefix(dir, home) {
+		t.Fatalf("profilesDir = %s, want it below %s", dir, home)
+	}
+	return dir
+}
+
+func TestSelectedProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     string
+		profile string
+		ext     string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "flag", args: []string{"--profile", "work"}, profile: "work"},
+		{name: "environment", env: "home", profile: "home"},
+		{name: "flag over environment", args: []string{"--profile", "work"}, env: "home", profile: "work"},
+		{name: "empty flag over environment", args: []string{"--profile", ""}, env: "home"},
+		{name: "with extension", args: []string{"--profile", "work.toml"}, profile: "work", ext: ".toml"},
+		{name: "other extension", args: []string{"--profile", "work.conf"}, wantErr: true},
+		{name: "path", args: []string{"--profile", "../work"}, wantErr: true},
+		{name: "separator", args: []string{"--profile", "a/b"}, wantErr: true},
+		{name: "hidden", env: ".work", wantErr: true},
+		{name: "too long", args: []string{"--profile", strings.Repeat("a", 65)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(ProfileEnv, tt.env)
+			profile, ext, err := selectedProfile(profileCommand(t, tt.args...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectedProfile error = %v, want error %v", err, tt.wantErr)
+			}
+			if profile != tt.profile || ext != tt.ext {
+				t.Errorf("selectedProfile = %q, %q, want %q, %q", profile, ext, tt.profile, tt.ext)
+			}
+		})
+	}
+}
+
+func TestGetConfigPath(t *testing.T) {
+	dir := useProfilesDir(t)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"yaml.yaml", "both.json", "both.toml"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{name: "default config", want: "config.json"},
+		{name: "explicit config", args: []string{"-c", "other.yaml"}, want: "other.yaml"},
+		{name: "new profile", args: []string{"--profile", "new"}, want: filepath.Join(dir, "new.json")},
+		{name: "new profile in another format", args: []string{"--profile", "new.toml"}, want: filepath.Join(dir, "new.toml")},
+		{name: "existing profile", args: []string{"--profile", "yaml"}, want: filepath.Join(dir, "yaml.yaml")},
+		{name: "existing profile with its extension", args: []string{"--profile", "yaml.yaml"}, want: filepath.Join(dir, "yaml.yaml")},
+		{name: "existing profile with another extension", args: []string{"--profile", "yaml.json"}, wantErr: "already exists"},
+		{name: "profile in several formats", args: []string{"--profile", "both"}, wantErr: "several formats"},
+		{name: "profile and config", args: []string{"--profile", "new", "-c", "config.json"}, wantErr: "can't be used together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getConfigPath(profileCommand(t, tt.args...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("getConfigPath = %q, %v, want an error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("getConfigPath = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestProfileIsolation(t *testing.T) {
+	useProfilesDir(t)
+	work := profileCommand(t, "--profile", "work")
+	home := profileCommand(t, "--profile", "home")
+	none := profileCommand(t)
+
+	workSocket, _ := getControlSocket(work)
+	homeSocket, _ := getControlSocket(home)
+	noneSocket, _ := getControlSocket(none)
+	if workSocket == homeSocket || workSocket == noneSocket || homeSocket == noneSocket {
+		t.Errorf("control sockets %q, %q and %q aren't distinct", workSocket, homeSocket, noneSocket)
+	}
+	if explicit, _ := getControlSocket(profileCommand(t, "--profile", "work", "--control-socket", "/tmp/my.sock")); explicit != "/tmp/my.sock" {
+		t.Errorf("getControlSocket with --control-socket = %q, want it as given", explicit)
+	}
+
+	if profileSecretService(none) != "" || profileSecretService(work) == profileSecretService(home) {
+		t.Errorf("keychain services %q and %q aren't distinct", profileSecretService(work), profileSecretService(home))
+	}
+
+	// each profile keeps its own registration
+	for i, cmd := range []*cobra.Command{work, home} {
+		path, err := getConfigPath(cmd)
+		if err != nil {
+			t.Fatalf("getConfigPath: %v", err)
+		}
+		if err := prepareProfileDir(path); err != nil {
+			t.Fatalf("prepareProfileDir: %v", err)
+		}
+		cfg := config.Config{ID: []string{"work device", "home device"}[i]}
+		if err := cfg.SaveConfig(path); err != nil {
+			t.Fatalf("SaveConfig: %v", err)
+		}
+	}
+	for i, cmd := range []*cobra.Command{work, home} {
+		path, _ := getConfigPath(cmd)
+		cfg, err := config.ReadConfig(path)
+		if want := []string{"work device", "home device"}[i]; err != nil || cfg.ID != want {
+			t.Errorf("ReadConfig(%s) = %q, %v, want %q", path, cfg.ID, err, want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// setupConnectProgress logs every stage of establishing the tunnel if --connect-progress is set,
+// with the time since the attempt started, so it's visible where a slow link gets stuck.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - error: An error if the flag can't be read.
+func setupConnectProgress(cmd *cobra.Command) error {
+	progress, err := cmd.Flags().GetBool("connect-progress")
+	if err != nil {
+		return err
+	}
+	if !progress {
+		return nil
+	}
+
+	var (
+		mu     sync.Mutex
+		starts = map[string]time.Time{}
+	)
+	logger := slog.With("component", "h3")
+	api.ConnectProgress = func(endpoint *net.UDPAddr, stage api.ConnectStage) {
+		mu.Lock()
+		if stage == api.ConnectDialing {
+			starts[endpoint.String()] = time.Now()
+		}
+		elapsed := time.Since(starts[endpoint.String()])
+		mu.Unlock()
+
+		logger.Info("Connecting", "endpoint", endpoint, "stage", stage.String(), "elapsed", elapsed.Round(time.Millisecond))
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().Bool("connect-progress", false, "Log every stage of establishing the tunnel (dialing, handshaking, waiting for settings, CONNECT sent, established)")
+}
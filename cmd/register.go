@@ -1,13 +1,20 @@
 package cmd
 
 import (
+	"bufio"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/Diniboy1123/usque/api"
 	"github.com/Diniboy1123/usque/config"
 	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/models"
 	"github.com/spf13/cobra"
 )
 
@@ -17,64 +24,166 @@ var registerCmd = &cobra.Command{
 	Long: "Registers a new account and enrolls a device key. Also makes sure that it switches to" +
 		" MASQUE mode. Saves the config to a file.",
 	Run: func(cmd *cobra.Command, args []string) {
-		if config.ConfigLoaded {
+		standby, err := cmd.Flags().GetBool("standby")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get standby flag: %v", err)
+		}
+		if standby && !config.ConfigLoaded {
+			fatalWith(ExitConfig, "A standby registration needs an existing config, register without --standby first")
+		}
+
+		if config.ConfigLoaded && !standby {
 			fmt.Printf("You already have a config. Do you want to overwrite it? (y/n) ")
 			var response string
 			if _, err := fmt.Scanln(&response); err != nil {
-				log.Fatalf("Failed to read response: %v", err)
+				fatalWith(ExitFailure, "Failed to read response: %v", err)
 			}
 			if response != "y" {
 				return
 			}
 		}
 
-		configPath, err := cmd.Flags().GetString("config")
+		configPath, err := getConfigPath(cmd)
 		if err != nil {
-			log.Fatalf("Failed to get config path: %v", err)
+			fatalWith(ExitUsage, "Failed to get config path: %v", err)
 		}
 		if configPath == "" {
-			log.Fatalf("Config path is required")
+			fatalWith(ExitUsage, "Config path is required")
+		}
+		if err := prepareProfileDir(configPath); err != nil {
+			fatalWith(ExitConfig, "Failed to create profile directory: %v", err)
 		}
 
 		deviceName, err := cmd.Flags().GetString("name")
 		if err != nil {
-			log.Fatalf("Failed to get device name: %v", err)
+			fatalWith(ExitUsage, "Failed to get device name: %v", err)
 		}
 
 		locale, err := cmd.Flags().GetString("locale")
 		if err != nil {
-			log.Fatalf("Failed to get locale: %v", err)
+			fatalWith(ExitUsage, "Failed to get locale: %v", err)
 		}
 
 		model, err := cmd.Flags().GetString("model")
 		if err != nil {
-			log.Fatalf("Failed to get model: %v", err)
+			fatalWith(ExitUsage, "Failed to get model: %v", err)
+		}
+
+		osVersion, err := cmd.Flags().GetString("os-version")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get OS version: %v", err)
+		}
+
+		serial, err := cmd.Flags().GetString("serial")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get serial: %v", err)
+		}
+
+		profile := api.DeviceProfile{Model: model, Locale: locale, OsVersion: osVersion, Serial: serial}
+		if err := profile.Validate(); err != nil {
+			fatalWith(ExitUsage, "Invalid device profile: %v", err)
 		}
 
 		jwt, err := cmd.Flags().GetString("jwt")
 		if err != nil {
-			log.Fatalf("Failed to get jwt: %v", err)
+			fatalWith(ExitUsage, "Failed to get jwt: %v", err)
 		}
 
-		if jwt != "" {
+		team, err := cmd.Flags().GetString("team")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get team: %v", err)
+		}
+		team = strings.ToLower(team)
+		if team != "" {
+			if err := api.ValidateTeamName(team); err != nil {
+				fatalWith(ExitUsage, "Invalid team: %v", err)
+			}
+		}
+
+		clientID, err := cmd.Flags().GetString("client-id")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get client ID: %v", err)
+		}
+
+		clientSecret, err := getClientSecret(cmd)
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get client secret: %v", err)
+		}
+
+		if (clientID == "") != (clientSecret == "") {
+			fatalWith(ExitUsage, "--client-id and --client-secret must be used together")
+		}
+		if clientID != "" && team == "" {
+			fatalWith(ExitUsage, "A service token needs the team given with --team")
+		}
+		if jwt != "" && team == "" {
+			// the team selects the Zero Trust SNI of every later connection
+			if team, err = api.TeamFromToken(jwt); err != nil {
+				fatalWith(ExitUsage, "Failed to get the team of the token, pass it with --team: %v", err)
+			}
+			log.Printf("Enrolling into team %s", team)
+		}
+
+		if jwt != "" || team != "" {
 			log.Printf("Registering with locale %s and model %s using jwt authentication", locale, model)
 		} else {
 			log.Printf("Registering with locale %s and model %s", locale, model)
 		}
 
+		secrets, err := getSecretsConfig(cmd, configPath)
+		if err != nil {
+			fatalWith(ExitConfig, "Failed to get secret store: %v", err)
+		}
+
 		acceptTos, err := cmd.Flags().GetBool("accept-tos")
 		if err != nil {
-			log.Fatalf("Failed to get accept-tos flag: %v", err)
+			fatalWith(ExitUsage, "Failed to get accept-tos flag: %v", err)
+		}
+
+		deviceID, err := cmd.Flags().GetString("device-id")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get device ID: %v", err)
 		}
 
-		accountData, err := api.Register(model, locale, jwt, acceptTos)
+		accessToken, err := cmd.Flags().GetString("access-token")
 		if err != nil {
-			log.Fatalf("Failed to register: %v", err)
+			fatalWith(ExitUsage, "Failed to get access token: %v", err)
+		}
+
+		if (deviceID == "") != (accessToken == "") {
+			fatalWith(ExitUsage, "--device-id and --access-token must be used together")
+		}
+
+		var accountData models.AccountData
+		if deviceID != "" {
+			// take over a registration exported from an official client instead of creating a new one
+			log.Printf("Using existing registration %s. The client it was exported from will stop working.", deviceID)
+			accountData = models.AccountData{
+				ID:    deviceID,
+				Token: accessToken,
+			}
+		} else {
+			if team != "" && jwt == "" {
+				if clientID != "" {
+					log.Printf("Getting a team token for %s with the service token...", team)
+					jwt, err = api.FetchTeamToken(team, clientID, clientSecret)
+				} else {
+					jwt, err = readTeamToken(team)
+				}
+				if err != nil {
+					fatalWith(ExitAuth, "Failed to get team token: %v", err)
+				}
+			}
+
+			accountData, err = api.RegisterDevice(profile, jwt, acceptTos)
+			if err != nil {
+				fatalWith(ExitAuth, "Failed to register: %v", err)
+			}
 		}
 
 		privKey, pubKey, err := internal.GenerateEcKeyPair()
 		if err != nil {
-			log.Fatalf("Failed to generate key pair: %v", err)
+			fatalWith(ExitFailure, "Failed to generate key pair: %v", err)
 		}
 
 		log.Printf("Enrolling device key...")
@@ -82,30 +191,40 @@ var registerCmd = &cobra.Command{
 		updatedAccountData, apiErr, err := api.EnrollKey(accountData, pubKey, deviceName)
 		if err != nil {
 			if apiErr != nil {
-				log.Fatalf("Failed to enroll key: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
+				fatalWith(ExitAuth, "Failed to enroll key: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
 			} else {
-				log.Fatalf("Failed to enroll key: %v", err)
+				fatalWith(ExitAuth, "Failed to enroll key: %v", err)
 			}
 		}
 
 		log.Printf("Successful registration. Saving config...")
 
-		config.AppConfig = config.Config{
-			PrivateKey: base64.StdEncoding.EncodeToString(privKey),
-			// TODO: proper endpoint parsing in utils
-			// strip :0
-			EndpointV4: updatedAccountData.Config.Peers[0].Endpoint.V4[:len(updatedAccountData.Config.Peers[0].Endpoint.V4)-2],
-			// strip [ from beginning and ]:0 from end
-			EndpointV6:     updatedAccountData.Config.Peers[0].Endpoint.V6[1 : len(updatedAccountData.Config.Peers[0].Endpoint.V6)-3],
-			EndpointPubKey: updatedAccountData.Config.Peers[0].PublicKey,
-			License:        updatedAccountData.Account.License,
-			ID:             updatedAccountData.ID,
-			AccessToken:    accountData.Token,
-			IPv4:           updatedAccountData.Config.Interface.Addresses.V4,
-			IPv6:           updatedAccountData.Config.Interface.Addresses.V6,
+		if standby {
+			config.AppConfig.Standby = &config.Registration{
+				PrivateKey:     base64.StdEncoding.EncodeToString(privKey),
+				EndpointPubKey: updatedAccountData.Config.Peers[0].PublicKey,
+				ID:             updatedAccountData.ID,
+				AccessToken:    accountData.Token,
+				IPv4:           updatedAccountData.Config.Interface.Addresses.V4,
+				IPv6:           updatedAccountData.Config.Interface.Addresses.V6,
+			}
+			if err := config.AppConfig.SaveConfig(configPath); err != nil {
+				fatalWith(ExitConfig, "Failed to save config: %v", err)
+			}
+			log.Printf("Standby registration saved to %s", configPath)
+			if standby := config.AppConfig.Standby; standby.IPv4 != config.AppConfig.IPv4 || standby.IPv6 != config.AppConfig.IPv6 {
+				log.Printf("Warning: the standby registration got other tunnel addresses than the primary one, tunnel commands won't use it")
+			}
+			return
 		}
 
-		config.AppConfig.SaveConfig(configPath)
+		config.AppConfig = newAccountConfig(privKey, accountData.Token, updatedAccountData)
+		config.AppConfig.Team = team
+		config.AppConfig.Secrets = secrets
+
+		if err := config.AppConfig.SaveConfig(configPath); err != nil {
+			fatalWith(ExitConfig, "Failed to save config: %v", err)
+		}
 
 		log.Printf("Config saved to %s", configPath)
 	},
@@ -114,8 +233,141 @@ var registerCmd = &cobra.Command{
 func init() {
 	registerCmd.Flags().StringP("locale", "l", internal.DefaultLocale, "locale")
 	registerCmd.Flags().StringP("model", "m", internal.DefaultModel, "model")
+	registerCmd.Flags().String("os-version", "", "OS version shown in the dashboard")
+	registerCmd.Flags().String("serial", "", "serial number shown in the dashboard, up to 64 letters and digits (default random)")
 	registerCmd.Flags().StringP("name", "n", "", "device name")
 	registerCmd.Flags().String("jwt", "", "team token")
+	registerCmd.Flags().String("team", "", "Zero Trust team to enroll into, the first part of <team>.cloudflareaccess.com (asks for a browser login unless --jwt or a service token is given)")
+	registerCmd.Flags().String("client-id", "", "Client ID of a Zero Trust service token, to enroll without a browser login")
+	registerCmd.Flags().String("client-secret", "", "Client Secret of the service token given by --client-id, also read from USQUE_FLAG_CLIENT_SECRET")
+	registerCmd.Flags().String("client-secret-file", "", "file holding the Client Secret of the service token, - for stdin")
 	registerCmd.Flags().BoolP("accept-tos", "a", false, "accept Cloudflare TOS (not interactive setup)")
+	registerCmd.Flags().String("device-id", "", "take over an existing registration with this device ID (e.g. exported from the official app) instead of registering a new one")
+	registerCmd.Flags().String("access-token", "", "access token of the registration given by --device-id")
+	registerCmd.Flags().Bool("standby", false, "enroll a second device as warm standby of the existing config, used when the primary registration is rejected")
+	registerCmd.Flags().String("secret-store", "", "where to store the private key and access token: config, file, keychain, env or encrypted (default keeps them in the config)")
 	rootCmd.AddCommand(registerCmd)
 }
+
+// newAccountConfig builds the config of a registration whose key was just enrolled.
+//
+// Parameters:
+//   - privKey: []byte - The enrolled private key.
+//   - token: string - The access token of the registration.
+//   - account: models.AccountData - The account data returned by the enrollment.
+//
+// Returns:
+//   - config.Config: The config of the registration.
+func newAccountConfig(privKey []byte, token string, account models.AccountData) config.Config {
+	peer := account.Config.Peers[0]
+	return config.Config{
+		PrivateKey: base64.StdEncoding.EncodeToString(privKey),
+		// TODO: proper endpoint parsing in utils
+		// strip :0
+		EndpointV4: peer.Endpoint.V4[:len(peer.Endpoint.V4)-2],
+		// strip [ from beginning and ]:0 from end
+		EndpointV6:     peer.Endpoint.V6[1 : len(peer.Endpoint.V6)-3],
+		EndpointPubKey: peer.PublicKey,
+		License:        account.Account.License,
+		ID:             account.ID,
+		AccessToken:    token,
+		IPv4:           account.Config.Interface.Addresses.V4,
+		IPv6:           account.Config.Interface.Addresses.V6,
+	}
+}
+
+// readTeamToken asks the user to log in to a Zero Trust team in a browser and to paste the token
+// the login page hands out.
+//
+// Parameters:
+//   - team: string - The team name.
+//
+// Returns:
+//   - string: The team token.
+//   - error: An error if the input can't be read or holds no token.
+func readTeamToken(team string) (string, error) {
+	fmt.Printf("Log in to your team at %s\n", api.TeamLoginURL(team))
+	fmt.Printf("After the login, copy the link of the \"Open Cloudflare WARP\" button and paste it here: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read user input: %v", err)
+	}
+	return api.ParseTeamToken(line)
+}
+
+// getClientSecret returns the Client Secret of a service token from --client-secret or
+// --client-secret-file. The file keeps the secret out of the process list and shell history.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - string: The Client Secret, empty if none was given.
+//   - error: An error if both flags are given or the file can't be read.
+func getClientSecret(cmd *cobra.Command) (string, error) {
+	secret, err := cmd.Flags().GetString("client-secret")
+	if err != nil {
+		return "", err
+	}
+	path, err := cmd.Flags().GetString("client-secret-file")
+	if err != nil || path == "" {
+		return secret, err
+	}
+	if secret != "" {
+		return "", errors.New("--client-secret and --client-secret-file are mutually exclusive")
+	}
+
+	var data []byte
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	secret, _, _ = strings.Cut(string(data), "\n")
+	if secret = strings.TrimSpace(secret); secret == "" {
+		return "", fmt.Errorf("%s holds no client secret", path)
+	}
+	return secret, nil
+}
+
+// getSecretsConfig builds the secret store configuration for a new config from --secret-store.
+// Without the flag, the store of the existing config (if any) is kept.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - configPath: string - The config path, the file backend stores secrets next to it.
+//
+// Returns:
+//   - *config.SecretsConfig: The secret store configuration, nil to keep secrets in the config.
+//   - error: An error if the backend is unknown or needs manual configuration.
+func getSecretsConfig(cmd *cobra.Command, configPath string) (*config.SecretsConfig, error) {
+	backend, err := cmd.Flags().GetString("secret-store")
+	if err != nil {
+		return nil, err
+	}
+
+	switch backend {
+	case "":
+		return config.AppConfig.Secrets, nil
+	case config.SecretBackendConfig:
+		return nil, nil
+	case config.SecretBackendFile:
+		path := strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".secrets.json"
+		return &config.SecretsConfig{Backend: backend, Path: path}, nil
+	case config.SecretBackendKeychain, config.SecretBackendEncrypted:
+		if backend == config.SecretBackendEncrypted {
+			// a new passphrase, asked for when the config is saved
+			config.PassphrasePrompt = promptNewPassphrase
+		}
+		return &config.SecretsConfig{Backend: backend, Service: profileSecretService(cmd)}, nil
+	case config.SecretBackendEnv:
+		return &config.SecretsConfig{Backend: backend}, nil
+	case config.SecretBackendCommand:
+		return nil, errors.New("the command backend needs get_command and set_command, set them in the config file")
+	}
+
+	return nil, fmt.Errorf("unknown secret store %q", backend)
+}
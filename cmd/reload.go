@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+// configWatchInterval is how often --watch-config checks the config file for changes.
+const configWatchInterval = 2 * time.Second
+
+// reloadMu serializes reloads from signals, file changes and the control socket.
+var reloadMu sync.Mutex
+
+// watchConfig reloads the config on SIGHUP and, with --watch-config, whenever the file changes.
+// See reloadConfig for what a reload applies.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - endpoints: *api.EndpointList - The endpoints of the running tunnel.
+func watchConfig(cmd *cobra.Command, endpoints *api.EndpointList) {
+	configPath, err := getConfigPath(cmd)
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get config path: %v", err)
+	}
+	watch, err := cmd.Flags().GetBool("watch-config")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get watch-config flag: %v", err)
+	}
+
+	reloads := make(chan struct{}, 1)
+	requestReload := func() {
+		select {
+		case reloads <- struct{}{}:
+		default:
+		}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	go func() {
+		for range sigChan {
+			requestReload()
+		}
+	}()
+
+	if watch {
+		go pollConfig(configPath, requestReload)
+	}
+
+	go func() {
+		for range reloads {
+			if err := reloadConfig(cmd, configPath, endpoints); err != nil {
+				slog.Warn("Failed to reload config, keeping the running one", "component", "config", "error", err)
+			}
+		}
+	}()
+}
+
+// pollConfig calls changed whenever the modification time or size of the config file changes.
+// Polling needs no platform specific file notifications and catches editors replacing the file.
+func pollConfig(configPath string, changed func()) {
+	last, _ := os.Stat(configPath)
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(configPath)
+		if err != nil {
+			// e.g. in the middle of being replaced
+			continue
+		}
+		if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+			last = info
+			changed()
+		}
+	}
+}
+
+// reloadConfig reads the config file again and applies the changes to the running tunnel.
+// The endpoint list, the log level and feature switches apply without dropping the tunnel,
+// unless the endpoint in use was removed from the list. Changed credentials reconnect the
+// tunnel with them. Tunnel addresses, the standby registration and expert settings need a
+// restart, as do all flags. If the new config is invalid, the running one is kept.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - configPath: string - The path of the config file.
+//   - endpoints: *api.EndpointList - The endpoints of the running tunnel.
+//
+// Returns:
+//   - error: An error if the config can't be read or is invalid.
+func reloadConfig(cmd *cobra.Command, configPath string, endpoints *api.EndpointList) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	next, err := config.ReadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if _, err := next.ApplyEnv(); err != nil {
+		return err
+	}
+	previous := config.Current()
+
+	if next.IPv4 != previous.IPv4 || next.IPv6 != previous.IPv6 || next.TunnelFamily != previous.TunnelFamily ||
+		!reflect.DeepEqual(next.Standby, previous.Standby) || !reflect.DeepEqual(next.Expert, previous.Expert) ||
+		!reflect.DeepEqual(next.WireGuard, previous.WireGuard) {
+		slog.Warn("Tunnel addresses, standby registration, WireGuard fallback and expert settings only change on restart", "component", "config")
+		next.IPv4, next.IPv6, next.TunnelFamily = previous.IPv4, previous.IPv6, previous.TunnelFamily
+		next.Standby, next.Expert, next.WireGuard = previous.Standby, previous.Expert, previous.WireGuard
+	}
+	credentialsChanged := next.PrivateKey != previous.PrivateKey || next.EndpointPubKey != previous.EndpointPubKey
+
+	list, err := getEndpoints(cmd, &next)
+	if err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if credentialsChanged {
+		if tlsConfig, err = newTunnelTLSConfig(cmd, &next); err != nil {
+			return err
+		}
+	}
+	if err := applyConfigLogLevel(cmd, &next); err != nil {
+		return err
+	}
+
+	config.Publish(next)
+	if err := applyFeatures(cmd, &next); err != nil {
+		slog.Warn("Failed to apply feature switches of the reloaded config", "component", "config", "error", err)
+	}
+	removed, err := endpoints.Replace(list.All())
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case tlsConfig != nil:
+		slog.Info("Config reloaded, reconnecting with the new credentials", "component", "config")
+		api.DefaultTunnel.ReplaceTLSConfig(tlsConfig)
+	case removed:
+		slog.Info("Config reloaded, reconnecting as the endpoint in use was removed", "component", "config")
+		api.DefaultTunnel.RequestReconnect()
+	default:
+		slog.Info("Config reloaded", "component", "config")
+	}
+	return nil
+}
+
+// newTunnelTLSConfig prepares the TLS config of the tunnel from the credentials of the config.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - cfg: *config.Config - The config with the credentials.
+//
+// Returns:
+//   - *tls.Config: The TLS configuration.
+//   - error: An error if the credentials are invalid.
+func newTunnelTLSConfig(cmd *cobra.Command, cfg *config.Config) (*tls.Config, error) {
+	sni, err := getSNI(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get SNI address: %v", err)
+	}
+	privKey, err := cfg.GetEcPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	peerPubKey, err := cfg.GetEcEndpointPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate cert: %v", err)
+	}
+	return api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
+}
+
+func init() {
+	rootCmd.PersistentFlags().Bool("watch-config", false, "Reload the config when the file changes, in addition to on SIGHUP")
+}
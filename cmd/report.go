@@ -0,0 +1,291 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// reportLogLines is how many of the last lines of --log go into a report.
+const reportLogLines = 2000
+
+// reportFile is a file of a diagnostic report.
+type reportFile struct {
+	name string
+	data []byte
+}
+
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Collect a diagnostic bundle to attach to a bug report",
+	Long: "Collects the version, platform, the config with credentials redacted, a few checks of the setup and," +
+		" if a tunnel runs with --control, its status, counters and recent reconnect decisions into one .tar.gz." +
+		" With --log, the end of a log file is included too. Nothing is sent anywhere, review the archive" +
+		" and attach it to an issue yourself. There is no separate doctor command, the checks are the ones" +
+		" listed in checks.txt: the keys, the tunnel addresses and a route to each endpoint. QUIC traces" +
+		" (qlog) aren't captured, the reconnect history and the log are what the report has of the connection.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get output path: %v", err)
+		}
+		logPath, err := cmd.Flags().GetString("log")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get log path: %v", err)
+		}
+		if output == "" {
+			output = "usque-report-" + time.Now().Format("20060102-150405") + ".tar.gz"
+		}
+
+		redact := reportRedactor(&config.AppConfig)
+		files := []reportFile{
+			{"version.txt", fmt.Appendf(nil, "usque %s\ncommit %s\nbuilt %s\n%s %s/%s, %d CPUs\n",
+				version, commit, date, runtime.Version(), runtime.GOOS, runtime.GOARCH, runtime.NumCPU())},
+			{"checks.txt", []byte(redact.Replace(reportChecks(cmd)))},
+		}
+		if config.ConfigLoaded {
+			files = append(files, reportFile{"config.json", reportJSON(redactConfig(config.AppConfig))})
+		}
+
+		var status ControlStatus
+		if err := callControl(cmd, "Status", struct{}{}, &status); err == nil {
+			var stats ControlStats
+			var decisions []api.ReconnectDecision
+			if err := callControl(cmd, "Stats", struct{}{}, &stats); err != nil {
+				log.Printf("Failed to get stats of the running tunnel: %v", err)
+			}
+			if err := callControl(cmd, "Why", 0, &decisions); err != nil {
+				log.Printf("Failed to get reconnect history of the running tunnel: %v", err)
+			}
+			files = append(files,
+				reportFile{"status.json", []byte(redact.Replace(string(reportJSON(status))))},
+				reportFile{"stats.json", reportJSON(stats)},
+				reportFile{"reconnects.json", []byte(redact.Replace(string(reportJSON(decisions))))},
+			)
+		} else {
+			log.Printf("No running tunnel found on the control socket, the report has no live state: %v", err)
+		}
+
+		if logPath != "" {
+			lines, err := tailFile(logPath, reportLogLines)
+			if err != nil {
+				fatalWith(ExitFailure, "Failed to read log: %v", err)
+			}
+			files = append(files, reportFile{"usque.log", []byte(redact.Replace(lines))})
+		}
+
+		if err := writeReport(output, files); err != nil {
+			fatalWith(ExitFailure, "Failed to write report: %v", err)
+		}
+		log.Printf("Report saved to %s, review it before attaching it to an issue", output)
+	},
+}
+
+func init() {
+	reportCmd.Flags().StringP("output", "o", "", "Path of the archive (default usque-report-<time>.tar.gz)")
+	reportCmd.Flags().String("log", "", "Log file of the tunnel to include the last lines of")
+	reportCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection, to check the endpoints the tunnel uses")
+	reportCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection, to check the endpoints the tunnel uses")
+	reportCmd.Flags().Bool("happy-eyeballs", false, "Check both the IPv6 and IPv4 endpoints")
+	rootCmd.AddCommand(reportCmd)
+}
+
+// reportChecks runs quick checks of the setup and describes the outcome of each, one per line.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - string: The outcome of the checks.
+func reportChecks(cmd *cobra.Command) string {
+	var b strings.Builder
+	check := func(name string, err error) {
+		if err != nil {
+			fmt.Fprintf(&b, "FAIL %s: %v\n", name, err)
+		} else {
+			fmt.Fprintf(&b, "ok   %s\n", name)
+		}
+	}
+
+	if !config.ConfigLoaded {
+		fmt.Fprintf(&b, "FAIL config: not loaded\n")
+		return b.String()
+	}
+	check("config loaded", nil)
+	_, err := config.AppConfig.GetEcPrivateKey()
+	check("private key", err)
+	_, err = config.AppConfig.GetEcEndpointPublicKey()
+	check("endpoint public key", err)
+	_, _, err = tunnelAddresses(cmd, &config.AppConfig)
+	check("tunnel addresses", err)
+	endpoints, err := getEndpoints(cmd, &config.AppConfig)
+	check("endpoints", err)
+	if err == nil {
+		for _, endpoint := range endpoints.All() {
+			// a connected UDP socket only needs a route, which is what's checked
+			conn, err := net.DialUDP("udp", nil, endpoint)
+			if err == nil {
+				conn.Close()
+			}
+			check("route to "+endpoint.String(), err)
+		}
+	}
+	return b.String()
+}
+
+// redactConfig removes the credentials from a config, keeping whether they were set. Of the
+// secret store, only the backend is kept, as its commands, paths and encrypted values can all
+// give the secrets away.
+func redactConfig(cfg config.Config) config.Config {
+	redacted := func(value string) string {
+		if value == "" {
+			return ""
+		}
+		return "[redacted]"
+	}
+	cfg.PrivateKey = redacted(cfg.PrivateKey)
+	cfg.AccessToken = redacted(cfg.AccessToken)
+	cfg.License = redacted(cfg.License)
+	if cfg.Standby != nil {
+		standby := *cfg.Standby
+		standby.PrivateKey = redacted(standby.PrivateKey)
+		standby.AccessToken = redacted(standby.AccessToken)
+		cfg.Standby = &standby
+	}
+	if cfg.WireGuard != nil {
+		wg := *cfg.WireGuard
+		wg.PrivateKey = redacted(wg.PrivateKey)
+		cfg.WireGuard = &wg
+	}
+	if cfg.Secrets != nil {
+		secrets := &config.SecretsConfig{
+			Backend:           cfg.Secrets.Backend,
+			Path:              redacted(cfg.Secrets.Path),
+			Service:           redacted(cfg.Secrets.Service),
+			GetCommand:        redacted(cfg.Secrets.GetCommand),
+			SetCommand:        redacted(cfg.Secrets.SetCommand),
+			PassphraseCommand: redacted(cfg.Secrets.PassphraseCommand),
+			Salt:              redacted(cfg.Secrets.Salt),
+		}
+		if len(cfg.Secrets.Encrypted) > 0 {
+			secrets.Encrypted = make(map[string]string, len(cfg.Secrets.Encrypted))
+			for name, value := range cfg.Secrets.Encrypted {
+				secrets.Encrypted[name] = redacted(value)
+			}
+		}
+		cfg.Secrets = secrets
+	}
+	return cfg
+}
+
+// reportRedactor replaces the credentials of a config wherever they show up, e.g. in a log.
+func reportRedactor(cfg *config.Config) *strings.Replacer {
+	var pairs []string
+	for _, secret := range []string{cfg.PrivateKey, cfg.AccessToken, cfg.License} {
+		if secret != "" {
+			pairs = append(pairs, secret, "[redacted]")
+		}
+	}
+	if cfg.Standby != nil {
+		for _, secret := range []string{cfg.Standby.PrivateKey, cfg.Standby.AccessToken} {
+			if secret != "" {
+				pairs = append(pairs, secret, "[redacted]")
+			}
+		}
+	}
+	if cfg.WireGuard != nil && cfg.WireGuard.PrivateKey != "" {
+		pairs = append(pairs, cfg.WireGuard.PrivateKey, "[redacted]")
+	}
+	if cfg.Secrets != nil {
+		// the service name and path are left alone, they are often plain words found elsewhere in a log
+		secrets := []string{cfg.Secrets.GetCommand, cfg.Secrets.SetCommand, cfg.Secrets.PassphraseCommand, cfg.Secrets.Salt}
+		for _, value := range cfg.Secrets.Encrypted {
+			secrets = append(secrets, value)
+		}
+		for _, secret := range secrets {
+			if secret != "" {
+				pairs = append(pairs, secret, "[redacted]")
+			}
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// reportJSON encodes a value of a report indented.
+func reportJSON(v any) []byte {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Appendf(nil, "failed to encode: %v\n", err)
+	}
+	return append(data, '\n')
+}
+
+// tailFile returns the last n lines of a file.
+func tailFile(path string, n int) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	lines := make([]string, 0, n)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(lines) == n {
+			lines = lines[1:]
+		}
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// writeReport writes the files of a report into a gzipped tar archive.
+func writeReport(path string, files []reportFile) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, file := range files {
+		header := &tar.Header{
+			Name:    "usque-report/" + file.name,
+			Mode:    0600,
+			Size:    int64(len(file.data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
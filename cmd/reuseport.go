@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"context"
+	"net"
+
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+// listenTCP opens the TCP listener of a proxy. With --reuse-port, several usque processes
+// can listen on the same address, see internal.ReusePort for how connections are spread.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - address: string - The address to listen on.
+//
+// Returns:
+//   - net.Listener: The listener.
+//   - error: An error if the flag can't be read or listening fails.
+func listenTCP(cmd *cobra.Command, address string) (net.Listener, error) {
+	reusePort, err := cmd.Flags().GetBool("reuse-port")
+	if err != nil {
+		return nil, err
+	}
+
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = internal.ReusePort
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
@@ -1,9 +1,14 @@
 package cmd
 
 import (
+	"context"
 	"log"
+	"os"
+	"time"
 
+	"github.com/Diniboy1123/usque/api"
 	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
 	"github.com/spf13/cobra"
 )
 
@@ -12,15 +17,121 @@ var rootCmd = &cobra.Command{
 	Short: "Usque Warp CLI",
 	Long:  "An unofficial Cloudflare Warp CLI that uses the MASQUE protocol and exposes the tunnel as various different services.",
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
-		configPath, err := cmd.Flags().GetString("config")
+		if err := applyEnvFlags(cmd); err != nil {
+			fatalWith(ExitUsage, "Failed to apply environment variables: %v", err)
+		}
+
+		if err := setupLogging(cmd); err != nil {
+			fatalWith(ExitUsage, "Failed to set up logging: %v", err)
+		}
+
+		setupProtocolLogging(cmd)
+
+		if err := setupConnectProgress(cmd); err != nil {
+			fatalWith(ExitUsage, "Failed to set up connect progress: %v", err)
+		}
+
+		if err := setupHookScript(cmd); err != nil {
+			fatalWith(ExitUsage, "Failed to set up hook script: %v", err)
+		}
+
+		if err := setupExitAfterFailures(cmd); err != nil {
+			fatalWith(ExitUsage, "Failed to set up exit after failures: %v", err)
+		}
+
+		if err := setupDebugServer(cmd); err != nil {
+			fatalWith(ExitUsage, "Failed to set up debug server: %v", err)
+		}
+
+		if err := setupForwardWorkers(cmd); err != nil {
+			fatalWith(ExitUsage, "Failed to set up forwarding workers: %v", err)
+		}
+
+		if err := setupICMPRateLimit(cmd); err != nil {
+			fatalWith(ExitUsage, "Failed to set up ICMP rate limit: %v", err)
+		}
+
+		if err := setupSocketBinding(cmd); err != nil {
+			fatalWith(ExitUsage, "Failed to set up socket binding: %v", err)
+		}
+
+		if err := setupUpstreamProxy(cmd); err != nil {
+			fatalWith(ExitUsage, "Failed to set up upstream proxy: %v", err)
+		}
+
+		if err := setupConnectHost(cmd); err != nil {
+			fatalWith(ExitUsage, "Failed to set up connect host: %v", err)
+		}
+
+		if err := setupTrust(cmd); err != nil {
+			fatalWith(ExitUsage, "Failed to set up certificate trust: %v", err)
+		}
+
+		configPath, err := getConfigPath(cmd)
 		if err != nil {
-			log.Fatalf("Failed to get config path: %v", err)
+			fatalWith(ExitUsage, "Failed to get config path: %v", err)
 		}
 
+		config.PassphrasePrompt = promptPassphrase
+		var loadErr error
 		if configPath != "" {
-			if err := config.LoadConfig(configPath); err != nil {
-				log.Printf("Config file not found: %v", err)
-				log.Printf("You may only use the register command to generate one.")
+			loadErr = config.LoadConfig(configPath)
+		}
+		fromEnv, err := config.AppConfig.ApplyEnv()
+		if err != nil {
+			fatalWith(ExitConfig, "Failed to apply config environment variables: %v", err)
+		}
+		if fromEnv && !config.ConfigLoaded && config.AppConfig.PrivateKey != "" {
+			// a config from the environment alone, e.g. in a container
+			config.ConfigLoaded = true
+		}
+		if loadErr != nil && !config.ConfigLoaded {
+			if _, statErr := os.Stat(configPath); statErr == nil {
+				// e.g. a wrong passphrase, not a missing file
+				log.Printf("Failed to load config: %v", loadErr)
+			} else {
+				log.Printf("Config file not found: %v", loadErr)
+				log.Printf("You may only use the register or import command to generate one, or config generate --test for a test config.")
+			}
+		}
+
+		if config.ConfigLoaded {
+			if err := applyExpertConfig(cmd); err != nil {
+				fatalWith(ExitConfig, "Failed to apply expert config: %v", err)
+			}
+			if err := applyConfigLogLevel(cmd, &config.AppConfig); err != nil {
+				fatalWith(ExitConfig, "Failed to apply log level: %v", err)
+			}
+		}
+
+		if err := applyFeatures(cmd, &config.AppConfig); err != nil {
+			fatalWith(ExitUsage, "Failed to apply feature switches: %v", err)
+		}
+
+		if err := setupUDPOffload(cmd); err != nil {
+			fatalWith(ExitUsage, "Failed to set up UDP offload: %v", err)
+		}
+
+		clientVersion, err := cmd.Flags().GetString("client-version")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get client version: %v", err)
+		}
+		if clientVersion != "" {
+			if err := internal.SetClientVersion(clientVersion); err != nil {
+				fatalWith(ExitUsage, "Failed to set client version: %v", err)
+			}
+		}
+
+		checkVersion, err := cmd.Flags().GetBool("check-client-version")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get check-client-version flag: %v", err)
+		}
+		if checkVersion {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			// an explicit --client-version always wins over the manifest
+			if err := api.CheckClientVersion(ctx, internal.ClientVersionManifestURL, clientVersion == ""); err != nil {
+				log.Printf("Failed to check client version: %v", err)
 			}
 		}
 	},
@@ -32,4 +143,6 @@ func Execute() error {
 
 func init() {
 	rootCmd.PersistentFlags().StringP("config", "c", "config.json", "config file (default is config.json)")
+	rootCmd.PersistentFlags().String("client-version", "", "Override the official client version to mimic (e.g. a-6.35-4471)")
+	rootCmd.PersistentFlags().Bool("check-client-version", false, "Check the latest known client version on startup and switch to it if the API rejects the built-in one")
 }
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"log"
+	"os"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/models"
+	"github.com/spf13/cobra"
+)
+
+var rotateKeysCmd = &cobra.Command{
+	Use:   "rotate-keys",
+	Short: "Replace the device key with a new one",
+	Long: "Generates a new secp256r1 key, enrolls it in place of the current one and replaces it in the config atomically." +
+		" A tunnel running with --control on the same --control-socket reloads the config and reconnects with the new key." +
+		" Other tunnels keep the old key until they get SIGHUP or are restarted, and fail to reconnect until then.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.ConfigLoaded {
+			exitNotRegistered(cmd)
+		}
+
+		configPath, err := getConfigPath(cmd)
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get config path: %v", err)
+		}
+		deviceName, err := cmd.Flags().GetString("name")
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get device name: %v", err)
+		}
+
+		privKey, publicKey, err := internal.GenerateEcKeyPair()
+		if err != nil {
+			fatalWith(ExitFailure, "Failed to generate key pair: %v", err)
+		}
+
+		log.Printf("Enrolling the new key...")
+		accountData := models.AccountData{
+			Token: config.AppConfig.AccessToken,
+			ID:    config.AppConfig.ID,
+		}
+		updatedAccountData, apiErr, err := api.EnrollKey(accountData, publicKey, deviceName)
+		if err != nil {
+			if apiErr != nil {
+				fatalWith(ExitAuth, "Failed to enroll key: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
+			}
+			fatalWith(ExitAuth, "Failed to enroll key: %v", err)
+		}
+
+		// the old key is revoked now, so the new one must not get lost
+		encodedKey := base64.StdEncoding.EncodeToString(privKey)
+		config.AppConfig.PrivateKey = encodedKey
+		config.AppConfig.EndpointPubKey = updatedAccountData.Config.Peers[0].PublicKey
+		addresses := updatedAccountData.Config.Interface.Addresses
+		if addresses.V4 != config.AppConfig.IPv4 || addresses.V6 != config.AppConfig.IPv6 {
+			log.Printf("The tunnel addresses changed to %s and %s, running tunnels need a restart", addresses.V4, addresses.V6)
+			config.AppConfig.IPv4, config.AppConfig.IPv6 = addresses.V4, addresses.V6
+		}
+		if err := config.AppConfig.SaveConfig(configPath); err != nil {
+			keyPath := configPath + ".new-key"
+			if writeErr := os.WriteFile(keyPath, []byte(encodedKey+"\n"), 0600); writeErr != nil {
+				fatalWith(ExitConfig, "Failed to save config: %v. The new key, which replaced the old one, is: %s", err, encodedKey)
+			}
+			fatalWith(ExitConfig, "Failed to save config: %v. The new key, which replaced the old one, is in %s, put it into private_key", err, keyPath)
+		}
+		log.Printf("New key saved to %s", configPath)
+
+		if err := callControl(cmd, "Reload", struct{}{}, &struct{}{}); err != nil {
+			log.Printf("No running tunnel reloaded the config (%v), send SIGHUP to or restart running tunnels", err)
+			return
+		}
+		log.Printf("Running tunnel reconnects with the new key")
+	},
+}
+
+func init() {
+	rotateKeysCmd.Flags().StringP("name", "n", "", "Rename the device while enrolling the new key")
+	rootCmd.AddCommand(rotateKeysCmd)
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+var scanCmd = &cobra.Command{
+	Use:   "scan",
+	Short: "Find the fastest MASQUE endpoint",
+	Long: "Probes Cloudflare anycast IPs on the known MASQUE ports concurrently, measures the QUIC handshake time" +
+		" and saves the fastest working endpoint to the config. Useful where some IP ranges are throttled or blocked.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.ConfigLoaded {
+			exitNotRegistered(cmd)
+		}
+
+		configPath, err := getConfigPath(cmd)
+		if err != nil {
+			fatalWith(ExitUsage, "Failed to get config path: %v", err)
+		}
+
+		sni, err := getSNI(cmd)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get SNI address: %v\n", err)
+		}
+
+		privKey, err := config.AppConfig.GetEcPrivateKey()
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get private key: %v\n", err)
+		}
+		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get public key: %v\n", err)
+		}
+
+		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to generate cert: %v\n", err)
+		}
+
+		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to prepare TLS config: %v\n", err)
+		}
+
+		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get initial packet size: %v\n", err)
+		}
+
+		ips, err := cmd.Flags().GetStringArray("ip")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get IPs: %v\n", err)
+		}
+
+		ports, err := cmd.Flags().GetIntSlice("ports")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get ports: %v\n", err)
+		}
+
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get timeout: %v\n", err)
+		}
+
+		concurrency, err := cmd.Flags().GetInt("concurrency")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get concurrency: %v\n", err)
+		}
+
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get dry-run flag: %v\n", err)
+		}
+
+		endpoints := scanCandidates(ips, ports)
+
+		log.Printf("Probing %d endpoints...", len(endpoints))
+
+		results := api.ScanEndpoints(context.Background(), tlsConfig, internal.DefaultQuicConfig(0, initialPacketSize), endpoints, timeout, concurrency, false)
+
+		var bestV4, bestV6 *api.ScanResult
+		for i, result := range results {
+			if result.Err != nil {
+				log.Printf("%-45s failed: %v", result.Endpoint, result.Err)
+				continue
+			}
+			log.Printf("%-45s %s", result.Endpoint, result.RTT.Round(time.Millisecond))
+			if result.Endpoint.IP.To4() != nil && bestV4 == nil {
+				bestV4 = &results[i]
+			} else if result.Endpoint.IP.To4() == nil && bestV6 == nil {
+				bestV6 = &results[i]
+			}
+		}
+
+		if bestV4 == nil && bestV6 == nil {
+			fatalWith(ExitEndpoint, "No working endpoint found")
+		}
+
+		if bestV4 != nil {
+			log.Printf("Fastest IPv4 endpoint: %s (%s)", bestV4.Endpoint, bestV4.RTT.Round(time.Millisecond))
+			config.AppConfig.EndpointV4 = bestV4.Endpoint.IP.String()
+		}
+		if bestV6 != nil {
+			log.Printf("Fastest IPv6 endpoint: %s (%s)", bestV6.Endpoint, bestV6.RTT.Round(time.Millisecond))
+			config.AppConfig.EndpointV6 = bestV6.Endpoint.IP.String()
+		}
+
+		if dryRun {
+			return
+		}
+
+		if err := config.AppConfig.SaveConfig(configPath); err != nil {
+			fatalWith(ExitConfig, "Failed to save config: %v", err)
+		}
+		log.Printf("Config saved to %s", configPath)
+		for _, best := range []*api.ScanResult{bestV4, bestV6} {
+			if best != nil && best.Endpoint.Port != 443 {
+				log.Printf("Note: %s works best on port %d, pass -P %d when connecting", best.Endpoint.IP, best.Endpoint.Port, best.Endpoint.Port)
+			}
+		}
+	},
+}
+
+// scanCandidates combines every IP with every port. The endpoints already in the config
+// are always included, invalid and duplicate IPs are skipped.
+//
+// Parameters:
+//   - ips: []string - The IPs to probe in addition to the configured ones.
+//   - ports: []int - The UDP ports to probe on every IP.
+//
+// Returns:
+//   - []*net.UDPAddr: The endpoints to probe.
+func scanCandidates(ips []string, ports []int) []*net.UDPAddr {
+	configured := append([]string{config.AppConfig.EndpointV4, config.AppConfig.EndpointV6}, config.AppConfig.Endpoints...)
+
+	seen := make(map[string]bool)
+	var candidates []net.IP
+	for _, ip := range append(configured, ips...) {
+		// entries of the endpoint list carry a port, only their IP is of interest here
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			if ip != "" {
+				log.Printf("Skipping invalid IP: %s", ip)
+			}
+			continue
+		}
+		if seen[parsed.String()] {
+			continue
+		}
+		seen[parsed.String()] = true
+		candidates = append(candidates, parsed)
+	}
+
+	var endpoints []*net.UDPAddr
+	for _, ip := range candidates {
+		for _, port := range ports {
+			endpoints = append(endpoints, &net.UDPAddr{IP: ip, Port: port})
+		}
+	}
+	return endpoints
+}
+
+func init() {
+	scanCmd.Flags().StringArray("ip", internal.KnownMasqueEndpoints, "Endpoint IPs to probe in addition to the ones in the config")
+	scanCmd.Flags().IntSlice("ports", internal.KnownMasquePorts, "UDP ports to probe on every IP")
+	scanCmd.Flags().Duration("timeout", 3*time.Second, "Timeout for a single probe")
+	scanCmd.Flags().Int("concurrency", 8, "Number of probes to run at once")
+	scanCmd.Flags().Bool("dry-run", false, "Only print the results, don't update the config")
+	scanCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	scanCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
+	rootCmd.AddCommand(scanCmd)
+}
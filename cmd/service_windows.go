@@ -0,0 +1,330 @@
+//go:build windows
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceStopTimeout is how long the running command gets to clean up after a stop request.
+const serviceStopTimeout = 10 * time.Second
+
+var serviceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Run usque as a Windows service",
+	Long: "Install, remove and control a Windows service running usque, so the tunnel starts at boot" +
+		" without a logged-in user. Requires Administrator privileges.",
+}
+
+var serviceInstallCmd = &cobra.Command{
+	Use:   "install -- <command> [flags]",
+	Short: "Install the service",
+	Long: "Install a service that runs the given usque command at boot, e.g." +
+		" `usque service install -- nativetun -c C:\\usque\\config.json`." +
+		" Use absolute paths, services don't start in the directory of the executable.",
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, err := cmd.Flags().GetString("name")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get service name: %v\n", err)
+		}
+
+		exePath, err := os.Executable()
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to get executable path: %v\n", err)
+		}
+		exePath, err = filepath.Abs(exePath)
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to get executable path: %v\n", err)
+		}
+
+		m, err := mgr.Connect()
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to connect to service manager: %v\n", err)
+		}
+		defer m.Disconnect()
+
+		if s, err := m.OpenService(name); err == nil {
+			s.Close()
+			exitWith(cmd, ExitFailure, "Service %s already exists\n", name)
+		}
+
+		runArgs := append([]string{"service", "run", "--name", name, "--"}, args...)
+		s, err := m.CreateService(name, exePath, mgr.Config{
+			StartType:   mgr.StartAutomatic,
+			DisplayName: "usque (" + name + ")",
+			Description: "Cloudflare WARP tunnel over MASQUE: usque " + strings.Join(args, " "),
+		}, runArgs...)
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to create service: %v\n", err)
+		}
+		defer s.Close()
+
+		// restart after crashes, e.g. a fatal error while setting up the tunnel
+		if err := s.SetRecoveryActions([]mgr.RecoveryAction{
+			{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+			{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+			{Type: mgr.ServiceRestart, Delay: 60 * time.Second},
+		}, uint32((24 * time.Hour).Seconds())); err != nil {
+			log.Printf("Failed to set recovery actions: %v", err)
+		}
+
+		if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			s.Delete()
+			exitWith(cmd, ExitFailure, "Failed to register event log source: %v\n", err)
+		}
+
+		log.Printf("Installed service %s, start it with `usque service start --name %s` or reboot", name, name)
+	},
+}
+
+var serviceUninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Stop and remove the service",
+	Run: func(cmd *cobra.Command, args []string) {
+		name, err := cmd.Flags().GetString("name")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get service name: %v\n", err)
+		}
+
+		m, err := mgr.Connect()
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to connect to service manager: %v\n", err)
+		}
+		defer m.Disconnect()
+
+		s, err := m.OpenService(name)
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to open service %s: %v\n", name, err)
+		}
+		defer s.Close()
+
+		if err := stopService(s); err != nil {
+			log.Printf("Failed to stop service: %v", err)
+		}
+
+		if err := s.Delete(); err != nil {
+			exitWith(cmd, ExitFailure, "Failed to delete service: %v\n", err)
+		}
+		if err := eventlog.Remove(name); err != nil {
+			log.Printf("Failed to remove event log source: %v", err)
+		}
+
+		log.Printf("Removed service %s", name)
+	},
+}
+
+var serviceStartCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Start the service",
+	Run: func(cmd *cobra.Command, args []string) {
+		name, err := cmd.Flags().GetString("name")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get service name: %v\n", err)
+		}
+
+		m, err := mgr.Connect()
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to connect to service manager: %v\n", err)
+		}
+		defer m.Disconnect()
+
+		s, err := m.OpenService(name)
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to open service %s: %v\n", name, err)
+		}
+		defer s.Close()
+
+		if err := s.Start(); err != nil {
+			exitWith(cmd, ExitFailure, "Failed to start service: %v\n", err)
+		}
+
+		log.Printf("Started service %s, its logs are in the Application event log", name)
+	},
+}
+
+var serviceStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop the service",
+	Run: func(cmd *cobra.Command, args []string) {
+		name, err := cmd.Flags().GetString("name")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get service name: %v\n", err)
+		}
+
+		m, err := mgr.Connect()
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to connect to service manager: %v\n", err)
+		}
+		defer m.Disconnect()
+
+		s, err := m.OpenService(name)
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to open service %s: %v\n", name, err)
+		}
+		defer s.Close()
+
+		if err := stopService(s); err != nil {
+			exitWith(cmd, ExitFailure, "Failed to stop service: %v\n", err)
+		}
+
+		log.Printf("Stopped service %s", name)
+	},
+}
+
+var serviceRunCmd = &cobra.Command{
+	Use:    "run -- <command> [flags]",
+	Short:  "Run the given command as a service (used by the service manager)",
+	Hidden: true,
+	Args:   cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, err := cmd.Flags().GetString("name")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get service name: %v\n", err)
+		}
+
+		isService, err := svc.IsWindowsService()
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to determine if running as a service: %v\n", err)
+		}
+		if !isService {
+			exitWith(cmd, ExitFailure, "This command is meant to be started by the service manager, use `usque service start` instead\n")
+		}
+
+		elog, err := eventlog.Open(name)
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to open event log: %v\n", err)
+		}
+		defer elog.Close()
+
+		// services have no console, send everything to the event log
+		writer := &eventLogWriter{elog: elog}
+		log.SetOutput(writer)
+		log.SetFlags(0)
+		rootCmd.SetOut(writer)
+		rootCmd.SetErr(writer)
+
+		if err := svc.Run(name, &serviceHandler{args: args}); err != nil {
+			elog.Error(1, fmt.Sprintf("Service failed: %v", err))
+		}
+	},
+}
+
+// serviceHandler runs a usque command under the Windows service manager.
+type serviceHandler struct {
+	args []string
+}
+
+// Execute implements svc.Handler. It runs the command until it exits or the service is stopped.
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	done := make(chan error, 1)
+	go func() {
+		rootCmd.SetArgs(h.args)
+		done <- rootCmd.Execute()
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Printf("Command failed: %v", err)
+				return true, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.Println("Stop requested by the service manager")
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(serviceStopTimeout.Milliseconds())}
+				requestStop()
+				// commands without cleanup never return, don't wait for them forever
+				select {
+				case <-done:
+				case <-time.After(serviceStopTimeout):
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventLogWriter writes every line it receives as an event log entry.
+// Errors and warnings are recognized by the usual prefixes of our log messages.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if msg == "" {
+		return len(p), nil
+	}
+
+	var err error
+	switch {
+	case strings.HasPrefix(msg, "Failed"), strings.HasPrefix(msg, "Error"):
+		err = w.elog.Error(1, msg)
+	case strings.HasPrefix(msg, "Warning"):
+		err = w.elog.Warning(1, msg)
+	default:
+		err = w.elog.Info(1, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// stopService asks the service to stop and waits until it did.
+func stopService(s *mgr.Service) error {
+	st, err := s.Query()
+	if err != nil {
+		return err
+	}
+	if st.State == svc.Stopped {
+		return nil
+	}
+
+	if st.State != svc.StopPending {
+		if st, err = s.Control(svc.Stop); err != nil {
+			return err
+		}
+	}
+
+	deadline := time.Now().Add(serviceStopTimeout + 5*time.Second)
+	for st.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service didn't stop in time")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if st, err = s.Query(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	for _, c := range []*cobra.Command{serviceInstallCmd, serviceUninstallCmd, serviceStartCmd, serviceStopCmd, serviceRunCmd} {
+		c.Flags().String("name", "usque", "Name of the Windows service")
+		serviceCmd.AddCommand(c)
+	}
+	rootCmd.AddCommand(serviceCmd)
+}
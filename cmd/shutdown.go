@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// stopRequested is closed when something other than a signal, such as the Windows
+// service manager or the control socket, asks the running command to shut down.
+var stopRequested = make(chan struct{})
+
+var stopOnce sync.Once
+
+// requestStop closes stopRequested. It may be called more than once.
+func requestStop() {
+	stopOnce.Do(func() {
+		close(stopRequested)
+	})
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM is received or a stop is requested.
+func waitForShutdown() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	select {
+	case <-sigChan:
+	case <-stopRequested:
+	}
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+// getSNI returns the SNI of the MASQUE connection: --sni-address if given, otherwise the
+// Zero Trust SNI for devices enrolled in a team and the flag's default for all others.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - string: The SNI.
+//   - error: An error if the flag can't be read.
+func getSNI(cmd *cobra.Command) (string, error) {
+	sni, err := cmd.Flags().GetString("sni-address")
+	if err != nil {
+		return "", err
+	}
+	if config.AppConfig.Team != "" && !cmd.Flags().Changed("sni-address") {
+		return internal.ZeroTierSNI, nil
+	}
+	return sni, nil
+}
+
+// setupConnectHost points the Connect-IP request at the host given with --connect-host.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - error: An error if the host is invalid.
+func setupConnectHost(cmd *cobra.Command) error {
+	host, err := cmd.Flags().GetString("connect-host")
+	if err != nil {
+		return err
+	}
+	return api.SetConnectHost(host)
+}
+
+func init() {
+	rootCmd.PersistentFlags().String("connect-host", "", "Host (and optional port) of the Connect-IP request, what the server sees as :authority (default cloudflareaccess.com)")
+}
@@ -1,3 +1,5 @@
+//go:build !nosocks
+
 package cmd
 
 import (
@@ -22,145 +24,107 @@ var socksCmd = &cobra.Command{
 	Long:  "Dual-stack SOCKS5 proxy with optional authentication. Doesn't require elevated privileges.",
 	Run: func(cmd *cobra.Command, args []string) {
 		if !config.ConfigLoaded {
-			cmd.Println("Config not loaded. Please register first.")
-			return
+			exitNotRegistered(cmd)
 		}
 
-		sni, err := cmd.Flags().GetString("sni-address")
+		sni, err := getSNI(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get SNI address: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get SNI address: %v\n", err)
 		}
 
 		privKey, err := config.AppConfig.GetEcPrivateKey()
 		if err != nil {
-			cmd.Printf("Failed to get private key: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get private key: %v\n", err)
 		}
 		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
 		if err != nil {
-			cmd.Printf("Failed to get public key: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get public key: %v\n", err)
 		}
 
 		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
 		if err != nil {
-			cmd.Printf("Failed to generate cert: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to generate cert: %v\n", err)
 		}
 
 		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
 		if err != nil {
-			cmd.Printf("Failed to prepare TLS config: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to prepare TLS config: %v\n", err)
 		}
 
 		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
 		if err != nil {
-			cmd.Printf("Failed to get keepalive period: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get keepalive period: %v\n", err)
 		}
 		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
 		if err != nil {
-			cmd.Printf("Failed to get initial packet size: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get initial packet size: %v\n", err)
 		}
 
 		bindAddress, err := cmd.Flags().GetString("bind")
 		if err != nil {
-			cmd.Printf("Failed to get bind address: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get bind address: %v\n", err)
 		}
 
 		port, err := cmd.Flags().GetString("port")
 		if err != nil {
-			cmd.Printf("Failed to get port: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get port: %v\n", err)
 		}
 
-		connectPort, err := cmd.Flags().GetInt("connect-port")
+		endpoints, err := getEndpoints(cmd, &config.AppConfig)
 		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
-			return
-		}
-
-		var endpoint *net.UDPAddr
-		if ipv6, err := cmd.Flags().GetBool("ipv6"); err == nil && !ipv6 {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV4),
-				Port: connectPort,
-			}
-		} else {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV6),
-				Port: connectPort,
-			}
+			exitWith(cmd, ExitConfig, "Failed to get endpoints: %v\n", err)
 		}
 
-		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
+		v4, v6, err := tunnelAddresses(cmd, &config.AppConfig)
 		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
-			return
-		}
-
-		tunnelIPv6, err := cmd.Flags().GetBool("no-tunnel-ipv6")
-		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv6: %v\n", err)
-			return
+			exitWith(cmd, ExitConfig, "Failed to get tunnel addresses: %v\n", err)
 		}
 
 		var localAddresses []netip.Addr
-		if !tunnelIPv4 {
-			v4, err := netip.ParseAddr(config.AppConfig.IPv4)
-			if err != nil {
-				cmd.Printf("Failed to parse IPv4 address: %v\n", err)
-				return
+		for _, addr := range []netip.Addr{v4, v6} {
+			if addr.IsValid() {
+				localAddresses = append(localAddresses, addr)
 			}
-			localAddresses = append(localAddresses, v4)
-		}
-		if !tunnelIPv6 {
-			v6, err := netip.ParseAddr(config.AppConfig.IPv6)
-			if err != nil {
-				cmd.Printf("Failed to parse IPv6 address: %v\n", err)
-				return
-			}
-			localAddresses = append(localAddresses, v6)
 		}
 
 		dnsServers, err := cmd.Flags().GetStringArray("dns")
 		if err != nil {
-			cmd.Printf("Failed to get DNS servers: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get DNS servers: %v\n", err)
 		}
 
 		var dnsAddrs []netip.Addr
 		for _, dns := range dnsServers {
 			addr, err := netip.ParseAddr(dns)
 			if err != nil {
-				cmd.Printf("Failed to parse DNS server: %v\n", err)
-				return
+				exitWith(cmd, ExitUsage, "Failed to parse DNS server: %v\n", err)
 			}
 			dnsAddrs = append(dnsAddrs, addr)
 		}
 
 		var dnsTimeout time.Duration
 		if dnsTimeout, err = cmd.Flags().GetDuration("dns-timeout"); err != nil {
-			cmd.Printf("Failed to get DNS timeout: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get DNS timeout: %v\n", err)
+		}
+
+		dnsServeStale, err := cmd.Flags().GetDuration("dns-serve-stale")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DNS serve-stale duration: %v\n", err)
 		}
 
 		localDNS, err := cmd.Flags().GetBool("local-dns")
 		if err != nil {
-			cmd.Printf("Failed to get local-dns flag: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get local-dns flag: %v\n", err)
 		}
 
 		mtu, err := cmd.Flags().GetInt("mtu")
 		if err != nil {
-			cmd.Printf("Failed to get MTU: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get MTU: %v\n", err)
+		}
+		netstackMTU, err := getNetstackMTU(cmd, mtu, initialPacketSize)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Invalid packet sizes: %v\n", err)
 		}
-		if mtu != 1280 {
+		if netstackMTU != 1280 {
 			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
 		}
 
@@ -173,20 +137,70 @@ var socksCmd = &cobra.Command{
 			password = p
 		}
 
+		dnsListen, err := cmd.Flags().GetString("dns-listen")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DNS listen address: %v\n", err)
+		}
+
+		dnsOverrideEntries, err := cmd.Flags().GetStringArray("dns-override")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DNS overrides: %v\n", err)
+		}
+
+		dnsOverrides, err := internal.ParseDNSOverrides(dnsOverrideEntries)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to parse DNS overrides: %v\n", err)
+		}
+
+		dohListen, err := cmd.Flags().GetString("doh-listen")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DoH listen address: %v\n", err)
+		}
+
+		dohUpstreamServers, err := cmd.Flags().GetStringArray("doh-upstream")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DoH upstreams: %v\n", err)
+		}
+
+		dohUpstreams, err := internal.ParseDNSUpstreams(dohUpstreamServers)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to parse DoH upstreams: %v\n", err)
+		}
+
+		dohCert, err := cmd.Flags().GetString("doh-cert")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DoH certificate: %v\n", err)
+		}
+
+		dohKey, err := cmd.Flags().GetString("doh-key")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DoH key: %v\n", err)
+		}
+
 		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
 		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get reconnect delay: %v\n", err)
 		}
 
-		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, mtu)
+		genericUDP, err := cmd.Flags().GetBool("generic-udp")
 		if err != nil {
-			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
-			return
+			exitWith(cmd, ExitUsage, "Failed to get generic UDP: %v\n", err)
+		}
+
+		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, netstackMTU)
+		if err != nil {
+			exitWith(cmd, ExitTUN, "Failed to create virtual TUN device: %v\n", err)
 		}
 		defer tunDev.Close()
 
-		go api.MaintainTunnel(context.Background(), tlsConfig, keepalivePeriod, initialPacketSize, endpoint, api.NewNetstackAdapter(tunDev), mtu, reconnectDelay)
+		logEffectiveConfig(cmd, endpoints)
+		watchNetwork(cmd, "")
+		serveControl(cmd, endpoints)
+		watchConfig(cmd, endpoints)
+		setupStandby(cmd)
+		setupWireGuardFallback(cmd)
+		loadEndpointBlocklist(cmd)
+		go api.MaintainTunnel(context.Background(), api.DefaultTunnel, tlsConfig, keepalivePeriod, initialPacketSize, endpoints, withPcap(cmd, withChaos(cmd, withMSSClamp(cmd, withInboundFilter(cmd, withFamilyFilter(cmd, withFlowExport(cmd, withPathMTU(cmd, api.NewNetstackAdapter(api.DefaultTunnel, tunDev)))))))), mtu, reconnectDelay)
 
 		var resolver socks5.NameResolver
 		if localDNS {
@@ -195,38 +209,65 @@ var socksCmd = &cobra.Command{
 			resolver = internal.TunnelDNSResolver{TunNet: tunNet, DNSAddrs: dnsAddrs, Timeout: dnsTimeout}
 		}
 
-		var server *socks5.Server
-		if username == "" || password == "" {
-			server = socks5.NewServer(
-				socks5.WithLogger(socks5.NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags))),
-				socks5.WithDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
-					return tunNet.DialContext(ctx, network, addr)
-				}),
-				socks5.WithResolver(resolver),
-			)
-		} else {
-			server = socks5.NewServer(
-				socks5.WithLogger(socks5.NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags))),
-				socks5.WithDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
-					return tunNet.DialContext(ctx, network, addr)
-				}),
-				socks5.WithResolver(resolver),
-				socks5.WithAuthMethods(
-					[]socks5.Authenticator{
-						socks5.UserPassAuthenticator{
-							Credentials: socks5.StaticCredentials{
-								username: password,
-							},
+		if dohListen != "" {
+			forwarder := &internal.DNSForwarder{
+				TunNet:     tunNet,
+				Upstreams:  dohUpstreams,
+				Timeout:    dnsTimeout,
+				Cache:      internal.NewDNSCache(0),
+				Available:  api.DefaultTunnel.Status.Connected,
+				ServeStale: dnsServeStale,
+			}
+			serveDoH(forwarder, dohListen, dohCert, dohKey)
+		}
+
+		if dnsListen != "" {
+			forwarder := &internal.DNSForwarder{
+				Upstreams:  internal.DNSUpstreamsFromAddrs(dnsAddrs),
+				Overrides:  dnsOverrides,
+				Timeout:    dnsTimeout,
+				Cache:      internal.NewDNSCache(0),
+				ServeStale: dnsServeStale,
+			}
+			if !localDNS {
+				forwarder.TunNet = tunNet
+				forwarder.Available = api.DefaultTunnel.Status.Connected
+			}
+			serveDNSForwarder(forwarder, dnsListen)
+		}
+
+		options := []socks5.Option{
+			socks5.WithLogger(socks5.NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags))),
+			socks5.WithDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return tunNet.DialContext(ctx, network, addr)
+			}),
+			socks5.WithResolver(resolver),
+		}
+		if !genericUDP {
+			relay := &udpRelay{tunNet: tunNet, resolver: resolver}
+			options = append(options, socks5.WithAssociateHandle(relay.handleAssociate))
+		}
+		if username != "" && password != "" {
+			options = append(options, socks5.WithAuthMethods(
+				[]socks5.Authenticator{
+					socks5.UserPassAuthenticator{
+						Credentials: socks5.StaticCredentials{
+							username: password,
 						},
 					},
-				),
-			)
+				},
+			))
+		}
+		server := socks5.NewServer(options...)
+
+		listener, err := listenTCP(cmd, net.JoinHostPort(bindAddress, port))
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to listen for SOCKS proxy: %v\n", err)
 		}
 
 		log.Printf("SOCKS proxy listening on %s:%s", bindAddress, port)
-		if err := server.ListenAndServe("tcp", net.JoinHostPort(bindAddress, port)); err != nil {
-			cmd.Printf("Failed to start SOCKS proxy: %v\n", err)
-			return
+		if err := server.Serve(listener); err != nil {
+			exitWith(cmd, ExitFailure, "Failed to start SOCKS proxy: %v\n", err)
 		}
 	},
 }
@@ -239,14 +280,30 @@ func init() {
 	socksCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
 	socksCmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers to use")
 	socksCmd.Flags().DurationP("dns-timeout", "t", 2*time.Second, "Timeout for DNS queries")
+	socksCmd.Flags().Duration("dns-serve-stale", 0, "How long after their expiry cached DNS answers are still served while the tunnel is down or the DNS servers don't answer (0 to answer SERVFAIL instead)")
 	socksCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	socksCmd.Flags().Bool("happy-eyeballs", false, "Race the IPv6 and IPv4 endpoints and use whichever connects first")
+	socksCmd.Flags().Bool("reuse-port", false, "Linux and macOS only: allow several usque processes to share the listening port, Linux balances clients between them")
+	socksCmd.Flags().Bool("watch-network", false, "Reconnect right away when the default route or addresses of the system change")
 	socksCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	socksCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
 	socksCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
 	socksCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
 	socksCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
+	socksCmd.Flags().Int("netstack-mtu", 0, "Link MTU of the userspace network stack, sets the size of its packets and the MSS of its TCP connections (0 for --mtu)")
 	socksCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
-	socksCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	socksCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts after transient failures, rejections wait longer")
+	socksCmd.Flags().Bool("generic-udp", false, "Relay UDP ASSOCIATE with the generic handler of the SOCKS library instead of the faster built-in relay")
 	socksCmd.Flags().BoolP("local-dns", "l", false, "Don't use the tunnel for DNS queries")
+	socksCmd.Flags().String("dns-listen", "", "Address to serve plain DNS on over UDP and TCP (e.g. 127.0.0.1:53), queries are forwarded to the DNS servers")
+	socksCmd.Flags().StringArray("dns-override", []string{}, "Per-domain DNS servers for the DNS forwarder (e.g. corp.example.com=10.0.0.53)")
+	socksCmd.Flags().String("doh-listen", "", "Address to serve DNS-over-HTTPS on (e.g. 127.0.0.1:8053), queries are answered through the tunnel")
+	socksCmd.Flags().StringArray("doh-upstream", []string{"1.1.1.1", "1.0.0.1"}, "Upstream DNS servers used by the DoH server")
+	socksCmd.Flags().String("doh-cert", "", "TLS certificate for the DoH server (plain HTTP if unset)")
+	socksCmd.Flags().String("doh-key", "", "TLS private key for the DoH server")
+	socksCmd.Flags().String("flow-collector", "", "IPFIX collector to export flow records to (e.g. 192.0.2.10:4739)")
+	socksCmd.Flags().Duration("flow-interval", 60*time.Second, "How often flow records are exported")
+	socksCmd.Flags().Bool("strict-inbound", false, "Drop packets from the server not addressed to the tunnel addresses or --inbound-allow prefixes")
+	socksCmd.Flags().StringArray("inbound-allow", []string{}, "Extra destination CIDR accepted from the server with --strict-inbound (can be repeated)")
 	rootCmd.AddCommand(socksCmd)
 }
@@ -0,0 +1,250 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+var speedtestCmd = &cobra.Command{
+	Use:   "speedtest",
+	Short: "Measure latency and throughput through the tunnel",
+	Long: "Brings up the tunnel in userspace and measures latency, download and upload throughput against speed.cloudflare.com through it." +
+		" Latency is also measured while transferring (loaded latency), which shows bufferbloat." +
+		" Nothing on the system is changed, so endpoints and MTUs can be compared by running it with different flags.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.ConfigLoaded {
+			exitNotRegistered(cmd)
+		}
+
+		sni, err := getSNI(cmd)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get SNI address: %v\n", err)
+		}
+
+		privKey, err := config.AppConfig.GetEcPrivateKey()
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get private key: %v\n", err)
+		}
+		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get public key: %v\n", err)
+		}
+
+		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to generate cert: %v\n", err)
+		}
+
+		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to prepare TLS config: %v\n", err)
+		}
+
+		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get keepalive period: %v\n", err)
+		}
+		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get initial packet size: %v\n", err)
+		}
+
+		endpoints, err := getEndpoints(cmd, &config.AppConfig)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get endpoints: %v\n", err)
+		}
+
+		v4, v6, err := tunnelAddresses(cmd, &config.AppConfig)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get tunnel addresses: %v\n", err)
+		}
+
+		var localAddresses []netip.Addr
+		for _, addr := range []netip.Addr{v4, v6} {
+			if addr.IsValid() {
+				localAddresses = append(localAddresses, addr)
+			}
+		}
+
+		dnsServers, err := cmd.Flags().GetStringArray("dns")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get DNS servers: %v\n", err)
+		}
+
+		var dnsAddrs []netip.Addr
+		for _, dns := range dnsServers {
+			addr, err := netip.ParseAddr(dns)
+			if err != nil {
+				exitWith(cmd, ExitUsage, "Failed to parse DNS server: %v\n", err)
+			}
+			dnsAddrs = append(dnsAddrs, addr)
+		}
+
+		mtu, err := cmd.Flags().GetInt("mtu")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get MTU: %v\n", err)
+		}
+		if err := checkMTU(mtu); err != nil {
+			exitWith(cmd, ExitUsage, "Invalid MTU: %v\n", err)
+		}
+
+		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get reconnect delay: %v\n", err)
+		}
+
+		server, err := cmd.Flags().GetString("server")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get server: %v\n", err)
+		}
+		duration, err := cmd.Flags().GetDuration("duration")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get duration: %v\n", err)
+		}
+		connections, err := cmd.Flags().GetInt("connections")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get connections: %v\n", err)
+		}
+		latencySamples, err := cmd.Flags().GetInt("latency-samples")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get latency samples: %v\n", err)
+		}
+		connectTimeout, err := cmd.Flags().GetDuration("connect-timeout")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get connect timeout: %v\n", err)
+		}
+		asJSON, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get json flag: %v\n", err)
+		}
+
+		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, mtu)
+		if err != nil {
+			exitWith(cmd, ExitTUN, "Failed to create virtual TUN device: %v\n", err)
+		}
+		defer tunDev.Close()
+
+		go api.MaintainTunnel(context.Background(), api.DefaultTunnel, tlsConfig, keepalivePeriod, initialPacketSize, endpoints, withPcap(cmd, withChaos(cmd, api.NewNetstackAdapter(api.DefaultTunnel, tunDev))), mtu, reconnectDelay)
+
+		connection, err := waitConnected(connectTimeout)
+		if err != nil {
+			fatalWith(ExitEndpoint, "Failed to connect: %v", err)
+		}
+		log.Printf("Connected in %s, running speed test against %s", connection.Handshake.Round(time.Millisecond), server)
+
+		test := &internal.SpeedTest{
+			Server:      server,
+			NewClient:   func() *http.Client { return speedtestClient(tunNet) },
+			Duration:    duration,
+			Connections: connections,
+		}
+
+		var result struct {
+			Handshake time.Duration           `json:"handshake"`
+			Latency   internal.LatencyResult  `json:"latency"`
+			Download  internal.TransferResult `json:"download"`
+			Upload    internal.TransferResult `json:"upload"`
+		}
+		result.Handshake = connection.Handshake
+
+		ctx := context.Background()
+		if result.Latency, err = test.Latency(ctx, latencySamples); err != nil {
+			fatalWith(ExitFailure, "Failed to measure latency: %v", err)
+		}
+		if result.Download, err = test.Download(ctx); err != nil {
+			fatalWith(ExitFailure, "Failed to measure download: %v", err)
+		}
+		if result.Upload, err = test.Upload(ctx); err != nil {
+			fatalWith(ExitFailure, "Failed to measure upload: %v", err)
+		}
+
+		if asJSON {
+			printJSON(cmd, result)
+			return
+		}
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "Handshake:\t%s\n", result.Handshake.Round(time.Millisecond))
+		fmt.Fprintf(w, "Latency:\t%s (jitter %s)\n", formatLatency(result.Latency.Median), formatLatency(result.Latency.Jitter))
+		for _, transfer := range []struct {
+			name   string
+			result internal.TransferResult
+		}{{"Download", result.Download}, {"Upload", result.Upload}} {
+			fmt.Fprintf(w, "%s:\t%.1f Mbps (%s in %s)\n", transfer.name, transfer.result.BitsPerSecond/1e6,
+				formatBytes(transfer.result.Bytes), transfer.result.Duration.Round(100*time.Millisecond))
+			if loaded := transfer.result.LoadedLatency; loaded.Samples > 0 {
+				fmt.Fprintf(w, "%s latency:\t%s (jitter %s)\n", transfer.name, formatLatency(loaded.Median), formatLatency(loaded.Jitter))
+			}
+		}
+		w.Flush()
+	},
+}
+
+// waitConnected waits until the tunnel is connected.
+//
+// Parameters:
+//   - timeout: time.Duration - How long to wait.
+//
+// Returns:
+//   - api.ConnectionStats: The counters of the connection.
+//   - error: An error if the tunnel didn't connect in time.
+func waitConnected(timeout time.Duration) (api.ConnectionStats, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if connection, ok := api.DefaultTunnel.Metrics.Connection(); ok {
+			return connection, nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return api.ConnectionStats{}, fmt.Errorf("tunnel not connected after %s", timeout)
+}
+
+// speedtestClient returns an HTTP client with its own connections dialed through the tunnel.
+// Custom dialers disable HTTP/2, so parallel requests really use parallel connections.
+func speedtestClient(tunNet *netstack.Net) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return tunNet.DialContext(ctx, network, address)
+			},
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// formatLatency rounds a latency for display.
+func formatLatency(d time.Duration) string {
+	return d.Round(100 * time.Microsecond).String()
+}
+
+func init() {
+	speedtestCmd.Flags().String("server", internal.DefaultSpeedTestServer, "Speed test server, must speak the speed.cloudflare.com protocol")
+	speedtestCmd.Flags().Duration("duration", 10*time.Second, "How long the download and the upload each run")
+	speedtestCmd.Flags().Int("connections", 4, "Parallel connections used for the download and the upload")
+	speedtestCmd.Flags().Int("latency-samples", 20, "Requests used to measure the idle latency")
+	speedtestCmd.Flags().Duration("connect-timeout", 30*time.Second, "How long to wait for the tunnel to connect")
+	speedtestCmd.Flags().Bool("json", false, "Print the results as JSON")
+	speedtestCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
+	speedtestCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	speedtestCmd.Flags().Bool("happy-eyeballs", false, "Race the IPv6 and IPv4 endpoints and use whichever connects first")
+	speedtestCmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers to use")
+	speedtestCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	speedtestCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
+	speedtestCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
+	speedtestCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
+	speedtestCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts after transient failures, rejections wait longer")
+	rootCmd.AddCommand(speedtestCmd)
+}
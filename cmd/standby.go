@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+// setupStandby prepares the standby registration of the config, if there is one,
+// so the tunnel can switch to it when the primary registration is rejected.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+func setupStandby(cmd *cobra.Command) {
+	cfg := config.Current()
+	standby := cfg.Standby
+	if standby == nil {
+		return
+	}
+	if standby.IPv4 != cfg.IPv4 || standby.IPv6 != cfg.IPv6 {
+		// the tunnel addresses are configured once at startup, so traffic
+		// through the standby registration would carry the wrong source
+		log.Printf("Warning: not using standby registration %s, its tunnel addresses (IPv4 %s, IPv6 %s) differ from the primary ones (IPv4 %s, IPv6 %s)",
+			standby.ID, standby.IPv4, standby.IPv6, cfg.IPv4, cfg.IPv6)
+		return
+	}
+
+	threshold, err := cmd.Flags().GetInt("standby-threshold")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get standby threshold: %v", err)
+	}
+	sni, err := getSNI(cmd)
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get SNI address: %v", err)
+	}
+
+	privKey, err := standby.GetEcPrivateKey()
+	if err != nil {
+		fatalWith(ExitConfig, "Failed to get standby private key: %v", err)
+	}
+	peerPubKey, err := standby.GetEcEndpointPublicKey()
+	if err != nil {
+		fatalWith(ExitConfig, "Failed to get standby public key: %v", err)
+	}
+	cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+	if err != nil {
+		fatalWith(ExitConfig, "Failed to generate standby cert: %v", err)
+	}
+	tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
+	if err != nil {
+		fatalWith(ExitConfig, "Failed to prepare standby TLS config: %v", err)
+	}
+
+	api.Standby = &api.StandbyRegistration{TLSConfig: tlsConfig, ID: standby.ID}
+	api.StandbyThreshold = threshold
+	log.Printf("Standby registration %s ready", standby.ID)
+}
+
+func init() {
+	rootCmd.PersistentFlags().Int("standby-threshold", 3, "Consecutive rejections of the registration before switching to the standby registration of the config")
+}
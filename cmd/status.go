@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// formatBytes formats a byte count with a binary unit, e.g. 1.5 MiB.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the state of the running tunnel",
+	Long: "Asks a tunnel command started with --control for its transport, endpoint, handshake time, uptime," +
+		" tunnel addresses and traffic counters.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		asJSON, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get json flag: %v\n", err)
+		}
+
+		var status ControlStatus
+		if err := callControl(cmd, "Status", struct{}{}, &status); err != nil {
+			fatalWith(ExitFailure, "Failed to get status: %v", err)
+		}
+		var stats ControlStats
+		if err := callControl(cmd, "Stats", struct{}{}, &stats); err != nil {
+			fatalWith(ExitFailure, "Failed to get stats: %v", err)
+		}
+
+		if asJSON {
+			printJSON(cmd, struct {
+				Status ControlStatus `json:"status"`
+				Stats  ControlStats  `json:"stats"`
+			}{status, stats})
+			return
+		}
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "State:\t%s\n", status.State)
+		fmt.Fprintf(w, "Transport:\t%s\n", status.Transport)
+		fmt.Fprintf(w, "Endpoint:\t%s\n", status.Endpoint)
+		if connection := stats.Connection; connection != nil {
+			fmt.Fprintf(w, "Handshake:\t%s\n", connection.Handshake.Round(time.Millisecond))
+			fmt.Fprintf(w, "Uptime:\t%s\n", connection.Uptime.Round(time.Second))
+		}
+		if status.Config != nil {
+			fmt.Fprintf(w, "Device:\t%s\n", status.Config.DeviceID)
+			fmt.Fprintf(w, "IPv4:\t%s\n", status.Config.IPv4)
+			fmt.Fprintf(w, "IPv6:\t%s\n", status.Config.IPv6)
+		}
+		if connection := stats.Connection; connection != nil {
+			fmt.Fprintf(w, "Sent:\t%d packets, %s, %d errors\n", connection.TxPackets, formatBytes(connection.TxBytes), connection.TxErrors)
+			fmt.Fprintf(w, "Received:\t%d packets, %s, %d errors\n", connection.RxPackets, formatBytes(connection.RxBytes), connection.RxErrors)
+			if connection.MaxPacketSize > 0 {
+				fmt.Fprintf(w, "Max packet size:\t%d bytes\n", connection.MaxPacketSize)
+			}
+		}
+		total := stats.Total
+		fmt.Fprintf(w, "Total sent:\t%d packets, %s, %d errors, %d drops, %d too large, %d fragmented\n", total.TxPackets, formatBytes(total.TxBytes), total.TxErrors, total.TxDrops, total.TxTooLarge, total.TxFragmented)
+		fmt.Fprintf(w, "Total received:\t%d packets, %s, %d errors, %d drops\n", total.RxPackets, formatBytes(total.RxBytes), total.RxErrors, total.RxDrops)
+		fmt.Fprintf(w, "Connections:\t%d made, %d failed attempts, %d lost\n", total.Connects, total.ConnectFailures, total.Disconnects)
+		if total.FamilyDrops > 0 {
+			fmt.Fprintf(w, "Disabled IP version:\t%d packets dropped\n", total.FamilyDrops)
+		}
+		if total.ICMPErrors > 0 || total.ICMPLimited > 0 {
+			fmt.Fprintf(w, "ICMP errors:\t%d sent, %d rate limited\n", total.ICMPErrors, total.ICMPLimited)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	statusCmd.Flags().Bool("json", false, "Print the status as JSON")
+	rootCmd.AddCommand(statusCmd)
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// setupTrust loads the CA bundle of --ca-file and the public key pins of --pin-sha256.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - error: An error if the file can't be loaded or a pin is invalid.
+func setupTrust(cmd *cobra.Command) error {
+	caFile, err := cmd.Flags().GetString("ca-file")
+	if err != nil {
+		return err
+	}
+	pins, err := cmd.Flags().GetStringArray("pin-sha256")
+	if err != nil {
+		return err
+	}
+
+	if err := api.LoadCAFile(caFile); err != nil {
+		return err
+	}
+	return api.SetPinnedKeys(pins)
+}
+
+func init() {
+	rootCmd.PersistentFlags().String("ca-file", "", "PEM bundle of extra certificate authorities trusted for API requests, e.g. of a TLS-intercepting proxy")
+	rootCmd.PersistentFlags().StringArray("pin-sha256", nil, "Base64 or hex SHA-256 hash of a public key the API and MASQUE servers must present (can be repeated)")
+}
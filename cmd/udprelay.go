@@ -0,0 +1,410 @@
+//go:build !nosocks
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+const (
+	// udpRelayIdleTimeout is how long a flow lives without packets in either direction.
+	udpRelayIdleTimeout = 2 * time.Minute
+	// udpRelayQueue is the number of packets queued towards the tunnel per flow.
+	udpRelayQueue = 64
+	// udpRelayQUICQueue is the queue of UDP/443 flows, HTTP/3 sends in bursts of whole congestion windows.
+	udpRelayQUICQueue = 1024
+	// udpRelaySocketBuffer is the requested buffer size of the socket facing the SOCKS client.
+	udpRelaySocketBuffer = 4 << 20
+	// udpRelayPacketSize fits the payload of any packet of the tunnel, larger ones are allocated.
+	udpRelayPacketSize = 2048
+	// udpRelayMaxDatagram is the largest UDP payload.
+	udpRelayMaxDatagram = 65535
+)
+
+var udpRelayPackets = sync.Pool{New: func() any {
+	packet := make([]byte, udpRelayPacketSize)
+	return &packet
+}}
+
+// udpRelay serves SOCKS5 UDP ASSOCIATE requests through the tunnel. Unlike the generic handler of
+// the SOCKS library, it looks flows up by address instead of by formatted string, parses only the
+// address of each datagram, prepends a reply header built once per flow and expires idle flows.
+// Every flow has its own queue towards the tunnel, so a slow flow doesn't stall the others, and
+// UDP/443 flows get a deeper one, as QUIC traffic suffers most from drops on the generic path.
+type udpRelay struct {
+	tunNet   *netstack.Net
+	resolver socks5.NameResolver
+}
+
+// udpFlowKey identifies a flow of an association by client and destination.
+type udpFlowKey struct {
+	client netip.AddrPort
+	dst    netip.AddrPort // only the port is set if the destination is a domain name
+	fqdn   string
+}
+
+// udpFlow is a flow between a SOCKS client and a destination in the tunnel.
+type udpFlow struct {
+	queue  chan *[]byte
+	header []byte // the SOCKS header of replies, the address of the destination as the client sent it
+	active atomic.Int64
+	done   chan struct{}
+	once   sync.Once
+}
+
+// udpAssociation is the state of a single UDP ASSOCIATE request.
+type udpAssociation struct {
+	relay      *udpRelay
+	ln         *net.UDPConn
+	clientAddr netip.Addr // the address datagrams have to come from
+	clientPort uint16     // the port datagrams have to come from, 0 until the first datagram sets it
+	mu         sync.Mutex
+	flows      map[udpFlowKey]*udpFlow
+}
+
+// handleAssociate serves a UDP ASSOCIATE request, to be passed to socks5.WithAssociateHandle.
+// The association lasts until the client closes the TCP connection of the request.
+//
+// Parameters:
+//   - ctx: context.Context - The context of the request.
+//   - writer: io.Writer - The TCP connection of the request.
+//   - request: *socks5.Request - The request.
+//
+// Returns:
+//   - error: An error if the association can't be set up or the TCP connection fails.
+func (r *udpRelay) handleAssociate(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	laddr := &net.UDPAddr{}
+	if tcpAddr, ok := request.LocalAddr.(*net.TCPAddr); ok {
+		laddr.IP = tcpAddr.IP
+	}
+	ln, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		if err := socks5.SendReply(writer, statute.RepServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("failed to listen for UDP: %v", err)
+	}
+	defer ln.Close()
+	_ = ln.SetReadBuffer(udpRelaySocketBuffer)
+	_ = ln.SetWriteBuffer(udpRelaySocketBuffer)
+
+	if err := socks5.SendReply(writer, statute.RepSuccess, ln.LocalAddr()); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+
+	association := &udpAssociation{relay: r, ln: ln, flows: map[udpFlowKey]*udpFlow{}}
+	association.clientAddr, association.clientPort = associationClient(request)
+	go association.serve(ctx)
+
+	_, err = io.Copy(io.Discard, request.Reader)
+	return err
+}
+
+// associationClient returns the address a client sends its datagrams from. Most clients announce
+// 0.0.0.0:0 in their request, the address of the TCP connection is used then, and the port is left
+// to the first datagram.
+//
+// Parameters:
+//   - request: *socks5.Request - The UDP ASSOCIATE request.
+//
+// Returns:
+//   - netip.Addr: The address of the client, invalid if it's unknown.
+//   - uint16: The port of the client, 0 if it wasn't announced.
+func associationClient(request *socks5.Request) (netip.Addr, uint16) {
+	var addr netip.Addr
+	var port uint16
+	if announced := request.DestAddr; announced != nil {
+		if ip, ok := netip.AddrFromSlice(announced.IP); ok && !ip.IsUnspecified() {
+			addr = ip.Unmap()
+		}
+		port = uint16(announced.Port)
+	}
+	if tcpAddr, ok := request.RemoteAddr.(*net.TCPAddr); ok && !addr.IsValid() {
+		if ip, ok := netip.AddrFromSlice(tcpAddr.IP); ok {
+			addr = ip.Unmap()
+		}
+	}
+	return addr, port
+}
+
+// allowed reports whether a datagram comes from the client of the association. Without the check,
+// anyone who learns the port of the relay could use the tunnel without the SOCKS authentication.
+// The first datagram from the client's address sets the port, if the client didn't announce one.
+func (a *udpAssociation) allowed(src netip.AddrPort) bool {
+	if !a.clientAddr.IsValid() || src.Addr() != a.clientAddr {
+		return false
+	}
+	if a.clientPort == 0 {
+		a.clientPort = src.Port()
+	}
+	return src.Port() == a.clientPort
+}
+
+// serve reads datagrams from the client and queues them to their flows until the socket is closed.
+func (a *udpAssociation) serve(ctx context.Context) {
+	defer a.closeFlows()
+
+	buf := make([]byte, udpRelayMaxDatagram)
+	for {
+		n, src, err := a.ln.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		if !a.allowed(src) {
+			continue
+		}
+		key, headerLen, ok := parseUDPDatagram(buf[:n])
+		if !ok {
+			continue
+		}
+		key.client = src
+
+		a.mu.Lock()
+		flow := a.flows[key]
+		a.mu.Unlock()
+		if flow == nil {
+			flow = a.open(ctx, key, buf[:headerLen])
+		}
+		flow.send(buf[headerLen:n])
+	}
+}
+
+// parseUDPDatagram reads the destination of a SOCKS5 UDP datagram, see RFC 1928 section 7.
+// Fragmented datagrams are dropped, clients don't send them in practice.
+//
+// Parameters:
+//   - b: []byte - The datagram.
+//
+// Returns:
+//   - udpFlowKey: The destination, without the client.
+//   - int: The length of the header, the payload follows it.
+//   - bool: Whether the datagram is valid.
+func parseUDPDatagram(b []byte) (udpFlowKey, int, bool) {
+	var key udpFlowKey
+	if len(b) < 4 || b[2] != 0 {
+		return key, 0, false
+	}
+	switch b[3] {
+	case statute.ATYPIPv4:
+		if len(b) < 10 {
+			return key, 0, false
+		}
+		key.dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[4:8])), binary.BigEndian.Uint16(b[8:10]))
+		return key, 10, true
+	case statute.ATYPIPv6:
+		if len(b) < 22 {
+			return key, 0, false
+		}
+		addr := netip.AddrFrom16([16]byte(b[4:20])).Unmap()
+		key.dst = netip.AddrPortFrom(addr, binary.BigEndian.Uint16(b[20:22]))
+		return key, 22, true
+	case statute.ATYPDomain:
+		if len(b) < 5 {
+			return key, 0, false
+		}
+		end := 5 + int(b[4])
+		if b[4] == 0 || len(b) < end+2 {
+			return key, 0, false
+		}
+		key.fqdn = string(b[5:end])
+		key.dst = netip.AddrPortFrom(netip.Addr{}, binary.BigEndian.Uint16(b[end:end+2]))
+		return key, end + 2, true
+	}
+	return key, 0, false
+}
+
+// open creates the flow of a new destination. It is resolved and dialed in the background while
+// the first datagrams wait in the queue of the flow, so a slow DNS answer only holds up its own flow.
+//
+// Parameters:
+//   - ctx: context.Context - The context of the association.
+//   - key: udpFlowKey - The flow.
+//   - header: []byte - The SOCKS header of the first datagram, reused for replies.
+//
+// Returns:
+//   - *udpFlow: The flow.
+func (a *udpAssociation) open(ctx context.Context, key udpFlowKey, header []byte) *udpFlow {
+	queue := udpRelayQueue
+	if key.dst.Port() == 443 {
+		queue = udpRelayQUICQueue
+	}
+	flow := &udpFlow{
+		queue:  make(chan *[]byte, queue),
+		header: bytes.Clone(header),
+		done:   make(chan struct{}),
+	}
+	flow.active.Store(time.Now().UnixNano())
+
+	a.mu.Lock()
+	a.flows[key] = flow
+	a.mu.Unlock()
+
+	go a.run(ctx, key, flow)
+	return flow
+}
+
+// run connects a flow to its destination and relays it until it is idle or closed.
+func (a *udpAssociation) run(ctx context.Context, key udpFlowKey, flow *udpFlow) {
+	conn, err := a.dial(ctx, key)
+	if err != nil {
+		log.Printf("Failed to relay UDP from %s: %v", key.client, err)
+		a.remove(key, flow)
+		return
+	}
+	go func() {
+		<-flow.done
+		conn.Close()
+	}()
+
+	go flow.write(conn)
+	a.reply(key, flow, conn)
+}
+
+// dial connects to the destination of a flow in the tunnel, resolving it first if it's a domain name.
+//
+// Parameters:
+//   - ctx: context.Context - The context of the association.
+//   - key: udpFlowKey - The flow.
+//
+// Returns:
+//   - *gonet.UDPConn: The connection to the destination.
+//   - error: An error if the destination can't be resolved or dialed.
+func (a *udpAssociation) dial(ctx context.Context, key udpFlowKey) (*gonet.UDPConn, error) {
+	dst := key.dst
+	if key.fqdn != "" {
+		_, ip, err := a.relay.resolver.Resolve(ctx, key.fqdn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %v", key.fqdn, err)
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			return nil, fmt.Errorf("invalid address for %s: %v", key.fqdn, ip)
+		}
+		dst = netip.AddrPortFrom(addr.Unmap(), dst.Port())
+	}
+
+	conn, err := a.relay.tunNet.DialUDPAddrPort(netip.AddrPort{}, dst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %v", dst, err)
+	}
+	return conn, nil
+}
+
+// reply relays datagrams from the destination back to the client until the flow is idle or closed.
+func (a *udpAssociation) reply(key udpFlowKey, flow *udpFlow, conn *gonet.UDPConn) {
+	defer a.remove(key, flow)
+
+	buf := make([]byte, len(flow.header)+udpRelayMaxDatagram)
+	copy(buf, flow.header)
+	payload := buf[len(flow.header):]
+
+	_ = conn.SetReadDeadline(time.Now().Add(udpRelayIdleTimeout))
+	for {
+		n, err := conn.Read(payload)
+		if err != nil {
+			// the deadline is only moved once it passes, not for every packet
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				return
+			}
+			idle := time.Since(time.Unix(0, flow.active.Load()))
+			if idle >= udpRelayIdleTimeout {
+				return
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(udpRelayIdleTimeout - idle))
+			continue
+		}
+		flow.active.Store(time.Now().UnixNano())
+		if _, err := a.ln.WriteToUDPAddrPort(buf[:len(flow.header)+n], key.client); errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+// remove closes a flow and forgets it, unless it was replaced in the meantime.
+func (a *udpAssociation) remove(key udpFlowKey, flow *udpFlow) {
+	a.mu.Lock()
+	if a.flows[key] == flow {
+		delete(a.flows, key)
+	}
+	a.mu.Unlock()
+	flow.close()
+}
+
+// closeFlows closes all flows of the association.
+func (a *udpAssociation) closeFlows() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, flow := range a.flows {
+		flow.close()
+		delete(a.flows, key)
+	}
+}
+
+// send queues a payload towards the destination, dropping it if the queue is full.
+func (f *udpFlow) send(payload []byte) {
+	var packet *[]byte
+	if len(payload) <= udpRelayPacketSize {
+		packet = udpRelayPackets.Get().(*[]byte)
+		*packet = (*packet)[:len(payload)]
+	} else {
+		large := make([]byte, len(payload))
+		packet = &large
+	}
+	copy(*packet, payload)
+	f.active.Store(time.Now().UnixNano())
+
+	select {
+	case f.queue <- packet:
+	default:
+		putUDPPacket(packet)
+	}
+}
+
+// write sends queued payloads into the tunnel until the flow is closed.
+func (f *udpFlow) write(conn *gonet.UDPConn) {
+	for {
+		select {
+		case packet := <-f.queue:
+			_, _ = conn.Write(*packet)
+			putUDPPacket(packet)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// close stops the flow, which closes its connection in the tunnel.
+func (f *udpFlow) close() {
+	f.once.Do(func() {
+		close(f.done)
+	})
+}
+
+// putUDPPacket returns a packet buffer to the pool, unless it was allocated for a large payload.
+func putUDPPacket(packet *[]byte) {
+	if cap(*packet) == udpRelayPacketSize {
+		*packet = (*packet)[:udpRelayPacketSize]
+		udpRelayPackets.Put(packet)
+	}
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+var usernetCmd = &cobra.Command{
+	Use:   "usernet",
+	Short: "Serve the tunnel to virtual machines and sandboxes over a UNIX socket",
+	Long: "Serves the tunnel as a virtual Ethernet link over a UNIX socket, using the stream protocol of passt and QEMU's stream netdev." +
+		" Unprivileged virtual machines and sandboxes get full-tunnel networking this way, without TUN devices or elevated privileges anywhere." +
+		" usque acts as the gateway, the client has to use the addresses from the config.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.ConfigLoaded {
+			exitNotRegistered(cmd)
+		}
+
+		sni, err := getSNI(cmd)
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get SNI address: %v\n", err)
+		}
+
+		privKey, err := config.AppConfig.GetEcPrivateKey()
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get private key: %v\n", err)
+		}
+		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get public key: %v\n", err)
+		}
+
+		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to generate cert: %v\n", err)
+		}
+
+		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to prepare TLS config: %v\n", err)
+		}
+
+		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get keepalive period: %v\n", err)
+		}
+		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get initial packet size: %v\n", err)
+		}
+
+		endpoints, err := getEndpoints(cmd, &config.AppConfig)
+		if err != nil {
+			exitWith(cmd, ExitConfig, "Failed to get endpoints: %v\n", err)
+		}
+
+		mtu, err := cmd.Flags().GetInt("mtu")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get MTU: %v\n", err)
+		}
+		if err := checkMTU(mtu); err != nil {
+			exitWith(cmd, ExitUsage, "Invalid MTU: %v\n", err)
+		}
+
+		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get reconnect delay: %v\n", err)
+		}
+
+		socketPath, err := cmd.Flags().GetString("socket")
+		if err != nil {
+			exitWith(cmd, ExitUsage, "Failed to get socket path: %v\n", err)
+		}
+
+		// a stale socket from a previous run would make listening fail
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			exitWith(cmd, ExitFailure, "Failed to remove stale socket: %v\n", err)
+		}
+
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			exitWith(cmd, ExitFailure, "Failed to listen on %s: %v\n", socketPath, err)
+		}
+
+		dev := api.NewUsernetDevice(listener)
+		defer dev.Close()
+
+		logEffectiveConfig(cmd, endpoints)
+		watchNetwork(cmd, "")
+		serveControl(cmd, endpoints)
+		watchConfig(cmd, endpoints)
+		setupStandby(cmd)
+		setupWireGuardFallback(cmd)
+		loadEndpointBlocklist(cmd)
+		go api.MaintainTunnel(context.Background(), api.DefaultTunnel, tlsConfig, keepalivePeriod, initialPacketSize, endpoints, withPcap(cmd, withChaos(cmd, withMSSClamp(cmd, withInboundFilter(cmd, withFamilyFilter(cmd, withFlowExport(cmd, withPathMTU(cmd, dev))))))), mtu, reconnectDelay)
+
+		log.Printf("Serving usernet on %s", socketPath)
+		log.Println("Configure the client with the following, using an on-link default route:")
+		log.Printf("IPv4: %s/32", config.AppConfig.IPv4)
+		log.Printf("IPv6: %s/128", config.AppConfig.IPv6)
+		log.Printf("MTU: %d", mtu)
+
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		<-sigChan
+
+		log.Println("Shutting down...")
+	},
+}
+
+func init() {
+	usernetCmd.Flags().String("socket", "usque.sock", "Path of the UNIX socket to serve clients on")
+	usernetCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
+	usernetCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	usernetCmd.Flags().Bool("happy-eyeballs", false, "Race the IPv6 and IPv4 endpoints and use whichever connects first")
+	usernetCmd.Flags().Bool("watch-network", false, "Reconnect right away when the default route or addresses of the system change")
+	usernetCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	usernetCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
+	usernetCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
+	usernetCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
+	usernetCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts after transient failures, rejections wait longer")
+	usernetCmd.Flags().String("flow-collector", "", "IPFIX collector to export flow records to (e.g. 192.0.2.10:4739)")
+	usernetCmd.Flags().Duration("flow-interval", 60*time.Second, "How often flow records are exported")
+	usernetCmd.Flags().Bool("strict-inbound", false, "Drop packets from the server not addressed to the tunnel addresses or --inbound-allow prefixes")
+	usernetCmd.Flags().StringArray("inbound-allow", []string{}, "Extra destination CIDR accepted from the server with --strict-inbound (can be repeated)")
+	rootCmd.AddCommand(usernetCmd)
+}
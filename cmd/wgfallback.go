@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// wireGuardKeepalive keeps the NAT mappings of the fallback open, as wg-quick configs usually do.
+const wireGuardKeepalive = 25 * time.Second
+
+// setupWireGuardFallback prepares the WireGuard fallback of the config, if there is one,
+// so the tunnel can carry the traffic over WireGuard while MASQUE is blocked.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+func setupWireGuardFallback(cmd *cobra.Command) {
+	cfg := config.Current()
+	wg := cfg.WireGuard
+	if wg == nil {
+		return
+	}
+
+	threshold, err := cmd.Flags().GetInt("wireguard-fallback-threshold")
+	if err != nil {
+		fatalWith(ExitUsage, "Failed to get WireGuard fallback threshold: %v", err)
+	}
+	if threshold <= 0 {
+		log.Printf("WireGuard fallback disabled by --wireguard-fallback-threshold")
+		return
+	}
+
+	privKey, err := base64.StdEncoding.DecodeString(wg.PrivateKey)
+	if err != nil || len(privKey) != 32 {
+		fatalWith(ExitConfig, "Invalid private key of the WireGuard fallback")
+	}
+	peerPubKey, err := base64.StdEncoding.DecodeString(wg.PeerPublicKey)
+	if err != nil || len(peerPubKey) != 32 {
+		fatalWith(ExitConfig, "Invalid peer public key of the WireGuard fallback")
+	}
+	endpoint, err := net.ResolveUDPAddr("udp", wg.Endpoint)
+	if err != nil {
+		fatalWith(ExitConfig, "Invalid endpoint of the WireGuard fallback: %v", err)
+	}
+
+	fallback := &api.WireGuardFallbackConfig{
+		PrivateKey:    privKey,
+		PeerPublicKey: peerPubKey,
+		Endpoint:      endpoint,
+		ID:            wg.ID,
+		Keepalive:     wireGuardKeepalive,
+	}
+	for _, pair := range [][2]string{{wg.IPv4, cfg.IPv4}, {wg.IPv6, cfg.IPv6}} {
+		addr, err := netip.ParseAddr(pair[0])
+		if err != nil {
+			continue
+		}
+		fallback.Addresses = append(fallback.Addresses, addr)
+		if deviceAddr, err := netip.ParseAddr(pair[1]); err == nil {
+			fallback.DeviceAddrs = append(fallback.DeviceAddrs, deviceAddr)
+		}
+	}
+
+	api.WireGuardFallback = fallback
+	api.WireGuardFallbackThreshold = threshold
+	log.Printf("WireGuard fallback via %s ready", endpoint)
+}
+
+// tunnelEndpoints returns the endpoints the tunnel connects to: the MASQUE endpoints and
+// the one of the WireGuard fallback, if the config has one and it is enabled.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//   - endpoints: *api.EndpointList - The MASQUE endpoints.
+//
+// Returns:
+//   - []*net.UDPAddr: The endpoints.
+func tunnelEndpoints(cmd *cobra.Command, endpoints *api.EndpointList) []*net.UDPAddr {
+	all := endpoints.All()
+	wg := config.Current().WireGuard
+	if threshold, err := cmd.Flags().GetInt("wireguard-fallback-threshold"); err != nil || threshold <= 0 || wg == nil {
+		return all
+	}
+	endpoint, err := net.ResolveUDPAddr("udp", wg.Endpoint)
+	if err != nil {
+		// setupWireGuardFallback exits on it
+		return all
+	}
+	return append(all, endpoint)
+}
+
+func init() {
+	rootCmd.PersistentFlags().Int("wireguard-fallback-threshold", 3, "Failed MASQUE connection attempts in a row before switching to the WireGuard fallback of the config, 0 to never switch")
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// setupForwardWorkers applies --forward-workers and --send-queue.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command whose flags are read.
+//
+// Returns:
+//   - error: An error if the number of workers or the queue length is invalid.
+func setupForwardWorkers(cmd *cobra.Command) error {
+	workers, err := cmd.Flags().GetInt("forward-workers")
+	if err != nil {
+		return err
+	}
+	if workers < 1 {
+		return fmt.Errorf("forward workers must be at least 1, got %d", workers)
+	}
+
+	sendQueue, err := cmd.Flags().GetInt("send-queue")
+	if err != nil {
+		return err
+	}
+	if sendQueue < 0 {
+		return fmt.Errorf("send queue length must not be negative, got %d", sendQueue)
+	}
+
+	api.ForwardWorkers = workers
+	api.SendQueueLen = sendQueue
+	return nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().Int("forward-workers", 1, "Goroutines writing packets per direction, spread by flow so a slow write doesn't stall every flow (e.g. the number of cores)")
+	rootCmd.PersistentFlags().Int("send-queue", 0, "Packets queued for sending to the MASQUE server, the ones beyond are dropped instead of stalling the device (0 to send synchronously)")
+}
@@ -8,71 +8,225 @@ import (
 	"encoding/pem"
 	"fmt"
 	"os"
+	"sync/atomic"
+
+	"github.com/Diniboy1123/usque/internal"
 )
 
 // Config represents the application configuration structure, containing essential details such as keys, endpoints, and access tokens.
 type Config struct {
+	PrivateKey     string          `json:"private_key"`                  // Base64-encoded ECDSA private key
+	EndpointV4     string          `json:"endpoint_v4"`                  // IPv4 address of the endpoint
+	EndpointV6     string          `json:"endpoint_v6"`                  // IPv6 address of the endpoint
+	EndpointPubKey string          `json:"endpoint_pub_key"`             // PEM-encoded ECDSA public key of the endpoint to verify against
+	Endpoints      []string        `json:"endpoints,omitempty"`          // Optional "ip:port" endpoints in order of priority, takes precedence over EndpointV4/EndpointV6
+	License        string          `json:"license"`                      // Application license key
+	ID             string          `json:"id"`                           // Device unique identifier
+	AccessToken    string          `json:"access_token"`                 // Authentication token for API access
+	IPv4           string          `json:"ipv4"`                         // Assigned IPv4 address
+	IPv6           string          `json:"ipv6"`                         // Assigned IPv6 address
+	TunnelFamily   string          `json:"tunnel_family,omitempty"`      // Optional "ipv4" or "ipv6" to only use that address family inside the tunnel
+	Team           string          `json:"team,omitempty"`               // Zero Trust team the device is enrolled in, empty for consumer WARP
+	Secrets        *SecretsConfig  `json:"secrets,omitempty"`            // Optional store for the private key and access token, inline if unset
+	Expert         *ExpertConfig   `json:"expert,omitempty"`             // Protocol experiments, only applied with --expert
+	Features       map[string]bool `json:"features,omitempty"`           // Optional runtime feature switches by name, overriding the defaults
+	Standby        *Registration   `json:"standby,omitempty"`            // Optional second enrolled device, used when this one is rejected
+	LogLevel       string          `json:"log_level,omitempty"`          // Optional minimum log level, used unless --log-level is given
+	WireGuard      *WireGuard      `json:"wireguard_fallback,omitempty"` // Optional WireGuard device, used while MASQUE can't connect
+
+	envOverrides []envOverride // fields set by ApplyEnv, SaveConfig keeps them out of the file
+}
+
+// Registration holds the credentials of a further enrolled device, kept as a warm standby
+// for when the server rejects the primary registration (e.g. because it was revoked).
+type Registration struct {
 	PrivateKey     string `json:"private_key"`      // Base64-encoded ECDSA private key
-	EndpointV4     string `json:"endpoint_v4"`      // IPv4 address of the endpoint
-	EndpointV6     string `json:"endpoint_v6"`      // IPv6 address of the endpoint
 	EndpointPubKey string `json:"endpoint_pub_key"` // PEM-encoded ECDSA public key of the endpoint to verify against
-	License        string `json:"license"`          // Application license key
 	ID             string `json:"id"`               // Device unique identifier
 	AccessToken    string `json:"access_token"`     // Authentication token for API access
 	IPv4           string `json:"ipv4"`             // Assigned IPv4 address
 	IPv6           string `json:"ipv6"`             // Assigned IPv6 address
 }
 
-// AppConfig holds the global application configuration.
+// WireGuard holds a WireGuard device of the account, which carries the traffic while MASQUE is
+// blocked. It must be a device of its own, as enrolling a WireGuard key replaces the MASQUE key.
+type WireGuard struct {
+	PrivateKey    string `json:"private_key"`     // Base64-encoded curve25519 private key
+	PeerPublicKey string `json:"peer_public_key"` // Base64-encoded curve25519 public key of the peer
+	Endpoint      string `json:"endpoint"`        // "host:port" of the peer
+	ID            string `json:"id"`              // Device unique identifier
+	IPv4          string `json:"ipv4"`            // Assigned IPv4 address
+	IPv6          string `json:"ipv6"`            // Assigned IPv6 address
+}
+
+// ExpertConfig holds protocol settings meant for research. Wrong values break connectivity.
+type ExpertConfig struct {
+	ContextID  uint64            `json:"context_id"`            // Datagram context ID of IP payloads, connect-ip-go only supports 0 for now
+	H3Settings map[string]uint64 `json:"h3_settings,omitempty"` // Extra HTTP/3 SETTINGS by identifier (decimal or 0x prefixed hex), overriding the defaults
+}
+
+// AppConfig holds the global application configuration. Commands read it while they set up,
+// a running tunnel reads Current instead, as reloads replace the config concurrently.
 var AppConfig Config
 
+// current is the config a reload published last, nil until the first reload.
+var current atomic.Pointer[Config]
+
+// Current returns a snapshot of the config of the running process: the one a reload published
+// last, or AppConfig before the first reload. It is safe to call while a reload publishes a new
+// one.
+//
+// Returns:
+//   - Config: The config. Its pointers and maps are shared and must not be modified.
+func Current() Config {
+	if cfg := current.Load(); cfg != nil {
+		return *cfg
+	}
+	return AppConfig
+}
+
+// Publish makes cfg the config returned by Current, e.g. after it was reloaded. AppConfig keeps
+// the config loaded at startup.
+//
+// Parameters:
+//   - cfg: Config - The config, which must not be modified afterwards.
+func Publish(cfg Config) {
+	current.Store(&cfg)
+}
+
 // ConfigLoaded indicates whether the configuration has been successfully loaded.
 var ConfigLoaded bool
 
-// LoadConfig loads the application configuration from a JSON file.
+// LoadConfig loads the application configuration from a JSON, YAML or TOML file,
+// depending on the extension of configPath.
 //
 // Parameters:
-//   - configPath: string - The path to the configuration JSON file.
+//   - configPath: string - The path to the configuration file.
 //
 // Returns:
 //   - error: An error if the configuration file cannot be loaded or parsed.
 func LoadConfig(configPath string) error {
-	file, err := os.Open(configPath)
+	cfg, err := ReadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	AppConfig = cfg
+	ConfigLoaded = true
+
+	return nil
+}
+
+// ReadConfig reads a configuration file like LoadConfig, but returns it instead of replacing
+// AppConfig, so a reloaded config can be compared against the running one.
+// Unknown keys and values of the wrong type are rejected with the line they are on.
+//
+// Parameters:
+//   - configPath: string - The path to the configuration file.
+//
+// Returns:
+//   - Config: The configuration, with secrets loaded from their store.
+//   - error: An error if the configuration file cannot be loaded or parsed.
+func ReadConfig(configPath string) (Config, error) {
+	data, err := os.ReadFile(configPath)
 	if err != nil {
-		return fmt.Errorf("failed to open config file: %v", err)
+		return Config{}, fmt.Errorf("failed to open config file: %v", err)
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&AppConfig); err != nil {
-		return fmt.Errorf("failed to decode config file: %v", err)
+	format := FormatForPath(configPath)
+	converted, err := toJSON(format, data)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := validateConfig(format, data, converted); err != nil {
+		return Config{}, err
 	}
+	data = converted
+
+	return ParseConfig(data)
+}
 
+// LoadConfigJSON loads the application configuration from JSON data,
+// for platforms where the config doesn't live in a file, such as mobile apps.
+//
+// Parameters:
+//   - data: []byte - The configuration JSON.
+//
+// Returns:
+//   - error: An error if the configuration cannot be parsed.
+func LoadConfigJSON(data []byte) error {
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return err
+	}
+
+	AppConfig = cfg
 	ConfigLoaded = true
 
 	return nil
 }
 
-// SaveConfig writes the current application configuration to a prettified JSON file.
+// ParseConfig decodes a configuration from JSON and loads its secrets, without touching
+// AppConfig. Library users keep the returned Config themselves, so several of them can
+// coexist in one process.
+//
+// Parameters:
+//   - data: []byte - The configuration JSON.
+//
+// Returns:
+//   - Config: The parsed configuration.
+//   - error: An error if the configuration cannot be parsed.
+func ParseConfig(data []byte) (Config, error) {
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("failed to decode config file: %v", err)
+	}
+
+	if err := cfg.loadSecrets(); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+// SaveConfig writes the configuration to a prettified JSON, YAML or TOML file,
+// depending on the extension of configPath. Comments in an existing YAML or TOML file are kept.
+// If a secret store is configured, secrets are written there instead of the file.
+// The file is replaced atomically, so a running tunnel reloading it never reads half of it.
 //
 // Parameters:
-//   - configPath: string - The path to save the configuration JSON file.
+//   - configPath: string - The path to save the configuration file.
 //
 // Returns:
 //   - error: An error if the configuration file cannot be written.
-func (*Config) SaveConfig(configPath string) error {
-	file, err := os.Create(configPath)
+func (c *Config) SaveConfig(configPath string) error {
+	saved := c.withoutEnv()
+	stripped, err := saved.storeSecrets()
 	if err != nil {
-		return fmt.Errorf("failed to create config file: %v", err)
+		return err
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(AppConfig); err != nil {
-		return fmt.Errorf("failed to encode config file: %v", err)
+	var data []byte
+	if format := FormatForPath(configPath); format != FormatJSON {
+		if data, err = json.Marshal(stripped); err != nil {
+			return fmt.Errorf("failed to encode config file: %v", err)
+		}
+		// a missing file just has no comments to keep
+		existing, _ := os.ReadFile(configPath)
+		if data, err = fromJSON(format, data, existing); err != nil {
+			return err
+		}
+	} else {
+		if data, err = json.MarshalIndent(stripped, "", "  "); err != nil {
+			return fmt.Errorf("failed to encode config file: %v", err)
+		}
+		data = append(data, '\n')
 	}
 
+	// new files get 0600, as they hold the private key
+	if err := internal.WriteFileAtomic(configPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
 	return nil
 }
 
@@ -81,8 +235,40 @@ func (*Config) SaveConfig(configPath string) error {
 // Returns:
 //   - *ecdsa.PrivateKey: The parsed ECDSA private key.
 //   - error: An error if decoding or parsing the private key fails.
-func (*Config) GetEcPrivateKey() (*ecdsa.PrivateKey, error) {
-	privKeyB64, err := base64.StdEncoding.DecodeString(AppConfig.PrivateKey)
+func (c *Config) GetEcPrivateKey() (*ecdsa.PrivateKey, error) {
+	return parseEcPrivateKey(c.PrivateKey)
+}
+
+// GetEcEndpointPublicKey retrieves the ECDSA public key from the stored PEM-encoded string.
+//
+// Returns:
+//   - *ecdsa.PublicKey: The parsed ECDSA public key.
+//   - error: An error if decoding or parsing the public key fails.
+func (c *Config) GetEcEndpointPublicKey() (*ecdsa.PublicKey, error) {
+	return parseEcPublicKey(c.EndpointPubKey)
+}
+
+// GetEcPrivateKey retrieves the ECDSA private key of the registration.
+//
+// Returns:
+//   - *ecdsa.PrivateKey: The parsed ECDSA private key.
+//   - error: An error if decoding or parsing the private key fails.
+func (r *Registration) GetEcPrivateKey() (*ecdsa.PrivateKey, error) {
+	return parseEcPrivateKey(r.PrivateKey)
+}
+
+// GetEcEndpointPublicKey retrieves the ECDSA public key of the endpoint of the registration.
+//
+// Returns:
+//   - *ecdsa.PublicKey: The parsed ECDSA public key.
+//   - error: An error if decoding or parsing the public key fails.
+func (r *Registration) GetEcEndpointPublicKey() (*ecdsa.PublicKey, error) {
+	return parseEcPublicKey(r.EndpointPubKey)
+}
+
+// parseEcPrivateKey parses a Base64-encoded DER ECDSA private key.
+func parseEcPrivateKey(encoded string) (*ecdsa.PrivateKey, error) {
+	privKeyB64, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode private key: %v", err)
 	}
@@ -95,13 +281,9 @@ func (*Config) GetEcPrivateKey() (*ecdsa.PrivateKey, error) {
 	return privKey, nil
 }
 
-// GetEcEndpointPublicKey retrieves the ECDSA public key from the stored PEM-encoded string.
-//
-// Returns:
-//   - *ecdsa.PublicKey: The parsed ECDSA public key.
-//   - error: An error if decoding or parsing the public key fails.
-func (*Config) GetEcEndpointPublicKey() (*ecdsa.PublicKey, error) {
-	endpointPubKeyB64, _ := pem.Decode([]byte(AppConfig.EndpointPubKey))
+// parseEcPublicKey parses a PEM-encoded ECDSA public key.
+func parseEcPublicKey(encoded string) (*ecdsa.PublicKey, error) {
+	endpointPubKeyB64, _ := pem.Decode([]byte(encoded))
 	if endpointPubKeyB64 == nil {
 		return nil, fmt.Errorf("failed to decode endpoint public key")
 	}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PassphraseEnv is the environment variable the passphrase of an encrypted config is read from.
+const PassphraseEnv = "USQUE_CONFIG_PASSPHRASE"
+
+// SecretPassphrase is the name the passphrase is looked up under in the OS keychain.
+const SecretPassphrase = "config_passphrase"
+
+// scrypt parameters recommended for interactive logins as of 2017, about 100 ms per derivation.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptSalt   = 16
+	encryptedKey = chacha20poly1305.KeySize
+)
+
+// PassphrasePrompt asks the user for the passphrase of an encrypted config when it isn't found
+// anywhere else. Set it to read from a terminal; if nil, loading fails instead of prompting.
+var PassphrasePrompt func() (string, error)
+
+// encryptedSecretStore keeps secrets in the config file itself, encrypted with XChaCha20-Poly1305
+// under a key derived from a passphrase with scrypt. The secret name is authenticated along with
+// the value, so values can't be swapped between fields.
+type encryptedSecretStore struct {
+	cfg *SecretsConfig
+}
+
+// deriveKey derives the key from the passphrase, generating the salt on first use.
+func (s *encryptedSecretStore) deriveKey() ([]byte, error) {
+	if s.cfg.key != nil {
+		return s.cfg.key, nil
+	}
+
+	if s.cfg.Salt == "" {
+		salt := make([]byte, scryptSalt)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, fmt.Errorf("failed to generate salt: %v", err)
+		}
+		s.cfg.Salt = base64.StdEncoding.EncodeToString(salt)
+	}
+	salt, err := base64.StdEncoding.DecodeString(s.cfg.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode salt: %v", err)
+	}
+
+	passphrase, err := s.cfg.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %v", err)
+	}
+	s.cfg.key = key
+	return key, nil
+}
+
+func (s *encryptedSecretStore) Get(name string) (string, error) {
+	encoded, ok := s.cfg.Encrypted[name]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s: %v", name, err)
+	}
+	if len(data) < chacha20poly1305.NonceSizeX {
+		return "", fmt.Errorf("encrypted %s is too short", name)
+	}
+
+	key, err := s.deriveKey()
+	if err != nil {
+		return "", err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", err
+	}
+	nonce, ciphertext := data[:chacha20poly1305.NonceSizeX], data[chacha20poly1305.NonceSizeX:]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", errors.New("wrong passphrase or corrupted config")
+	}
+	return string(plaintext), nil
+}
+
+func (s *encryptedSecretStore) Set(name, value string) error {
+	key, err := s.deriveKey()
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX, chacha20poly1305.NonceSizeX+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	if s.cfg.Encrypted == nil {
+		s.cfg.Encrypted = map[string]string{}
+	}
+	s.cfg.Encrypted[name] = base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(value), []byte(name)))
+	return nil
+}
+
+// passphrase looks up the passphrase of an encrypted config: the USQUE_CONFIG_PASSPHRASE
+// environment variable, the output of passphrase_command, the OS keychain, and finally
+// PassphrasePrompt, in this order. An empty passphrase is an error, wherever it comes from,
+// so a mistyped variable or a command that prints nothing can't encrypt the secrets with it.
+func (cfg *SecretsConfig) passphrase() (string, error) {
+	if passphrase, ok := os.LookupEnv(PassphraseEnv); ok {
+		if passphrase == "" {
+			return "", fmt.Errorf("%s is empty", PassphraseEnv)
+		}
+		return passphrase, nil
+	}
+
+	if cfg.PassphraseCommand != "" {
+		cmd, err := splitCommand(cfg.PassphraseCommand)
+		if err != nil {
+			return "", fmt.Errorf("invalid passphrase command: %v", err)
+		}
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to run passphrase command: %v", err)
+		}
+		passphrase, _, _ := strings.Cut(string(output), "\n")
+		if passphrase = strings.TrimSpace(passphrase); passphrase == "" {
+			return "", errors.New("passphrase command printed an empty passphrase")
+		}
+		return passphrase, nil
+	}
+
+	service := cfg.Service
+	if service == "" {
+		service = DefaultSecretService
+	}
+	keychain := &keychainSecretStore{service: service}
+	if passphrase, err := keychain.Get(SecretPassphrase); err == nil {
+		if passphrase == "" {
+			return "", fmt.Errorf("keychain entry %s of %s is empty", SecretPassphrase, service)
+		}
+		return passphrase, nil
+	}
+
+	if PassphrasePrompt == nil {
+		return "", fmt.Errorf("config is encrypted, set %s or passphrase_command", PassphraseEnv)
+	}
+	passphrase, err := PassphrasePrompt()
+	if err == nil && passphrase == "" {
+		return "", errors.New("passphrase must not be empty")
+	}
+	return passphrase, err
+}
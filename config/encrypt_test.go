@@ -0,0 +1,131 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A secret encrypted by the current on-disk format. Changing the key derivation, the cipher,
+// the layout of nonce and ciphertext or the associated data breaks existing configs, and this.
+const (
+	vectorPassphrase = "correct horse battery staple"
+	vectorSalt       = "dXNxdWUgdGVzdCBzYWx0IQ=="
+	vectorEncrypted  = "dXNxdWUgcGlubmVkIHRlc3Qgbm9uY2UhhaMYZLgHU7nEq/3WKIQ0At6qTx36HWB2MA8FuXuBNg=="
+	vectorPlaintext  = "MHcCAQEEIAbc+/="
+)
+
+func TestEncryptedSecretStoreVector(t *testing.T) {
+	t.Setenv(PassphraseEnv, vectorPassphrase)
+	store := &encryptedSecretStore{cfg: &SecretsConfig{
+		Backend:   SecretBackendEncrypted,
+		Salt:      vectorSalt,
+		Encrypted: map[string]string{SecretPrivateKey: vectorEncrypted},
+	}}
+	if got, err := store.Get(SecretPrivateKey); err != nil || got != vectorPlaintext {
+		t.Fatalf("Get(%s) = %q, %v, want %q", SecretPrivateKey, got, err, vectorPlaintext)
+	}
+}
+
+func TestEncryptedSecretStore(t *testing.T) {
+	t.Setenv(PassphraseEnv, vectorPassphrase)
+	cfg := &SecretsConfig{Backend: SecretBackendEncrypted}
+	store := &encryptedSecretStore{cfg: cfg}
+	if _, err := store.Get(SecretPrivateKey); !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("Get before Set = %v, want ErrSecretNotFound", err)
+	}
+	if err := store.Set(SecretPrivateKey, "private"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := store.Set(SecretAccessToken, "token"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if cfg.Salt == "" {
+		t.Fatal("Set didn't generate a salt")
+	}
+	for _, encrypted := range cfg.Encrypted {
+		if strings.Contains(encrypted, "private") || strings.Contains(encrypted, "token") {
+			t.Fatalf("secret stored in the clear: %q", encrypted)
+		}
+	}
+
+	// reload the way a new process would, without the cached key
+	reload := func(encrypted map[string]string) *encryptedSecretStore {
+		return &encryptedSecretStore{cfg: &SecretsConfig{Backend: SecretBackendEncrypted, Salt: cfg.Salt, Encrypted: encrypted}}
+	}
+	if got, err := reload(cfg.Encrypted).Get(SecretPrivateKey); err != nil || got != "private" {
+		t.Fatalf("Get after reload = %q, %v, want %q", got, err, "private")
+	}
+
+	// tamper flips a bit of the encrypted private key, counting from the end if index is negative
+	tamper := func(index int) string {
+		data, _ := base64.StdEncoding.DecodeString(cfg.Encrypted[SecretPrivateKey])
+		if index < 0 {
+			index += len(data)
+		}
+		data[index] ^= 1
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	tests := []struct {
+		name      string
+		encrypted string
+	}{
+		{"tampered nonce", tamper(0)},
+		{"tampered ciphertext", tamper(chacha20poly1305.NonceSizeX)},
+		{"tampered tag", tamper(-1)},
+		{"swapped with another secret", cfg.Encrypted[SecretAccessToken]},
+		{"too short", base64.StdEncoding.EncodeToString([]byte("short"))},
+		{"not Base64", "%%%"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := reload(map[string]string{SecretPrivateKey: tt.encrypted}).Get(SecretPrivateKey)
+			if err == nil {
+				t.Fatalf("Get = %q, want an error", got)
+			}
+		})
+	}
+
+	t.Setenv(PassphraseEnv, "wrong")
+	if got, err := reload(cfg.Encrypted).Get(SecretPrivateKey); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Fatalf("Get with the wrong passphrase = %q, %v, want a wrong passphrase error", got, err)
+	}
+	t.Setenv(PassphraseEnv, "")
+	if _, err := reload(cfg.Encrypted).Get(SecretPrivateKey); err == nil || !strings.Contains(err.Error(), PassphraseEnv) {
+		t.Fatalf("Get with an empty passphrase = %v, want an error naming %s", err, PassphraseEnv)
+	}
+}
+
+func TestEncryptedConfigRoundTrip(t *testing.T) {
+	t.Setenv(PassphraseEnv, vectorPassphrase)
+	path := filepath.Join(t.TempDir(), "config.json")
+	cfg := Config{
+		PrivateKey:  "private",
+		AccessToken: "token",
+		ID:          "device",
+		Secrets:     &SecretsConfig{Backend: SecretBackendEncrypted},
+	}
+	if err := cfg.SaveConfig(path); err != nil {
+		t.Fatalf("SaveConfig: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), `"private"`) || strings.Contains(string(data), `"token"`) {
+		t.Fatalf("saved config contains a secret in the clear:\n%s", data)
+	}
+
+	read, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig: %v", err)
+	}
+	if read.PrivateKey != "private" || read.AccessToken != "token" || read.ID != "device" {
+		t.Errorf("ReadConfig = %+v", read)
+	}
+}
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding config fields, followed by
+// the field name in upper case, e.g. USQUE_CONFIG_PRIVATE_KEY for private_key.
+const EnvPrefix = "USQUE_CONFIG_"
+
+// envOverride is a config field ApplyEnv set.
+type envOverride struct {
+	field    int // index of the field in Config
+	original any // the value before, from the config file
+	applied  any // the value from the environment
+}
+
+// ApplyEnv overrides the fields of the config with their USQUE_CONFIG_* environment variables,
+// so a config can come from the environment alone, e.g. in a container. Fields of nested
+// objects add their name to the one of the object, e.g. USQUE_CONFIG_STANDBY_ID for the id of
+// standby. Lists such as endpoints are separated by commas, maps such as features are given as
+// name=value pairs. SaveConfig writes the values of the file for these fields, unless a command
+// changed them since.
+//
+// Returns:
+//   - bool: Whether any variable was set.
+//   - error: An error if a value can't be parsed.
+func (c *Config) ApplyEnv() (bool, error) {
+	applied := false
+	value := reflect.ValueOf(c).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := envFieldName(value.Type().Field(i))
+		if name == "" {
+			continue
+		}
+		original := value.Field(i).Interface()
+		set, err := applyEnvField(EnvPrefix+name, value.Field(i))
+		if err != nil {
+			return applied, err
+		}
+		if !set {
+			continue
+		}
+		c.envOverrides = append(c.envOverrides, envOverride{field: i, original: original, applied: value.Field(i).Interface()})
+		applied = true
+	}
+	return applied, nil
+}
+
+// applyEnvField sets a field from the environment variable env, or the fields of a nested
+// object from the variables starting with env. A nested object is replaced by a changed copy,
+// so the one from the file is kept intact for withoutEnv.
+func applyEnvField(env string, field reflect.Value) (bool, error) {
+	if field.Kind() == reflect.Pointer && field.Type().Elem().Kind() == reflect.Struct {
+		nested := reflect.New(field.Type().Elem())
+		if !field.IsNil() {
+			nested.Elem().Set(field.Elem())
+		}
+		set := false
+		for i := 0; i < nested.Elem().NumField(); i++ {
+			name := envFieldName(nested.Elem().Type().Field(i))
+			if name == "" {
+				continue
+			}
+			ok, err := applyEnvField(env+"_"+name, nested.Elem().Field(i))
+			if err != nil {
+				return false, err
+			}
+			set = set || ok
+		}
+		if set {
+			field.Set(nested)
+		}
+		return set, nil
+	}
+
+	raw, ok := os.LookupEnv(env)
+	if !ok {
+		return false, nil
+	}
+	switch {
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+		field.Set(reflect.ValueOf(splitEnvList(raw)))
+	case field.Kind() == reflect.Map && field.Type().Key().Kind() == reflect.String:
+		entries := reflect.MakeMap(field.Type())
+		for _, entry := range splitEnvList(raw) {
+			key, value, ok := strings.Cut(entry, "=")
+			if !ok {
+				return false, fmt.Errorf("invalid %s entry %q, expected name=value", env, entry)
+			}
+			parsed := reflect.New(field.Type().Elem()).Elem()
+			if err := setEnvValue(parsed, value); err != nil {
+				return false, fmt.Errorf("invalid %s entry %q: %v", env, entry, err)
+			}
+			entries.SetMapIndex(reflect.ValueOf(key), parsed)
+		}
+		field.Set(entries)
+	default:
+		if err := setEnvValue(field, raw); err != nil {
+			return false, fmt.Errorf("invalid %s: %v", env, err)
+		}
+	}
+	return true, nil
+}
+
+// setEnvValue parses raw into a string, boolean or number field.
+func setEnvValue(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(parsed)
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(raw, 0, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(parsed)
+	default:
+		return fmt.Errorf("a %s can't be set from the environment, use the config file", typeName(field.Type()))
+	}
+	return nil
+}
+
+// envFieldName returns the upper case name of a field in environment variables, or an empty
+// string if the field isn't part of the config file.
+func envFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" || !field.IsExported() {
+		return ""
+	}
+	return strings.ToUpper(name)
+}
+
+// withoutEnv returns a copy of the config with the fields ApplyEnv set back at their values from
+// the file, so they aren't saved. Fields a command changed since are kept.
+func (c *Config) withoutEnv() Config {
+	saved := *c
+	saved.envOverrides = nil
+	value := reflect.ValueOf(&saved).Elem()
+	for _, override := range c.envOverrides {
+		field := value.Field(override.field)
+		if reflect.DeepEqual(field.Interface(), override.applied) {
+			field.Set(reflect.ValueOf(override.original))
+		}
+	}
+	return saved
+}
+
+// splitEnvList splits a comma separated list, dropping empty entries and surrounding spaces.
+func splitEnvList(raw string) []string {
+	var list []string
+	for _, entry := range strings.Split(raw, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
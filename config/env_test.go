@@ -0,0 +1,149 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		config  Config
+		want    Config
+		wantErr string
+	}{
+		{
+			name: "top level fields",
+			env: map[string]string{
+				EnvPrefix + "PRIVATE_KEY": "key",
+				EnvPrefix + "ENDPOINTS":   " 162.159.198.1:443, ,[2606:4700:103::1]:443",
+				EnvPrefix + "FEATURES":    "racing=true,pmtud=false",
+			},
+			config: Config{PrivateKey: "old", ID: "device"},
+			want: Config{
+				PrivateKey: "key",
+				ID:         "device",
+				Endpoints:  []string{"162.159.198.1:443", "[2606:4700:103::1]:443"},
+				Features:   map[string]bool{"racing": true, "pmtud": false},
+			},
+		},
+		{
+			name:   "nested field of a missing object",
+			env:    map[string]string{EnvPrefix + "STANDBY_ID": "spare", EnvPrefix + "SECRETS_BACKEND": SecretBackendEnv},
+			config: Config{ID: "device"},
+			want:   Config{ID: "device", Standby: &Registration{ID: "spare"}, Secrets: &SecretsConfig{Backend: SecretBackendEnv}},
+		},
+		{
+			name:   "nested field of an object from the file",
+			env:    map[string]string{EnvPrefix + "STANDBY_IPV4": "172.16.0.3"},
+			config: Config{Standby: &Registration{ID: "spare", IPv4: "172.16.0.2"}},
+			want:   Config{Standby: &Registration{ID: "spare", IPv4: "172.16.0.3"}},
+		},
+		{
+			name:   "numbers",
+			env:    map[string]string{EnvPrefix + "EXPERT_CONTEXT_ID": "0x10", EnvPrefix + "EXPERT_H3_SETTINGS": "0x33=1"},
+			config: Config{},
+			want:   Config{Expert: &ExpertConfig{ContextID: 16, H3Settings: map[string]uint64{"0x33": 1}}},
+		},
+		{
+			name:    "invalid feature entry",
+			env:     map[string]string{EnvPrefix + "FEATURES": "racing"},
+			wantErr: EnvPrefix + "FEATURES",
+		},
+		{
+			name:    "invalid boolean",
+			env:     map[string]string{EnvPrefix + "FEATURES": "racing=maybe"},
+			wantErr: "racing=maybe",
+		},
+		{
+			name:    "invalid number",
+			env:     map[string]string{EnvPrefix + "EXPERT_CONTEXT_ID": "-1"},
+			wantErr: EnvPrefix + "EXPERT_CONTEXT_ID",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			cfg := tt.config
+			applied, err := cfg.ApplyEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ApplyEnv() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !applied {
+				t.Fatalf("ApplyEnv() = %v, %v, want true, nil", applied, err)
+			}
+			cfg.envOverrides = nil
+			if !reflect.DeepEqual(cfg, tt.want) {
+				t.Errorf("ApplyEnv() config = %+v, want %+v", cfg, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyEnvKeepsFileObject(t *testing.T) {
+	t.Setenv(EnvPrefix+"STANDBY_ID", "from env")
+	standby := &Registration{ID: "from file"}
+	cfg := Config{Standby: standby}
+	if _, err := cfg.ApplyEnv(); err != nil {
+		t.Fatalf("ApplyEnv() error = %v", err)
+	}
+	if standby.ID != "from file" {
+		t.Errorf("ApplyEnv() changed the standby of the file to %q", standby.ID)
+	}
+}
+
+func TestApplyEnvUnset(t *testing.T) {
+	cfg := Config{ID: "device"}
+	applied, err := cfg.ApplyEnv()
+	if err != nil || applied {
+		t.Fatalf("ApplyEnv() = %v, %v, want false, nil", applied, err)
+	}
+	if cfg.Standby != nil || cfg.Expert != nil {
+		t.Errorf("ApplyEnv() created nested objects without variables: %+v", cfg)
+	}
+}
+
+func TestSaveConfigWithoutEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	file := Config{PrivateKey: "file key", License: "file license", ID: "device"}
+	if err := file.SaveConfig(path); err != nil {
+		t.Fatalf("SaveConfig() error = %v", err)
+	}
+
+	t.Setenv(EnvPrefix+"PRIVATE_KEY", "env key")
+	t.Setenv(EnvPrefix+"LICENSE", "env license")
+	t.Setenv(EnvPrefix+"STANDBY_ID", "env standby")
+	cfg, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	if _, err := cfg.ApplyEnv(); err != nil {
+		t.Fatalf("ApplyEnv() error = %v", err)
+	}
+	// a command changing a field set from the environment saves its value
+	cfg.License = "changed"
+	cfg.ID = "new device"
+	if err := cfg.SaveConfig(path); err != nil {
+		t.Fatalf("SaveConfig() error = %v", err)
+	}
+
+	saved, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	want := Config{PrivateKey: "file key", License: "changed", ID: "new device"}
+	if !reflect.DeepEqual(saved, want) {
+		t.Errorf("saved %+v, want %+v", saved, want)
+	}
+	if cfg.PrivateKey != "env key" || cfg.Standby == nil || cfg.Standby.ID != "env standby" {
+		t.Errorf("SaveConfig() reverted the config in use: %+v", cfg)
+	}
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config file formats, picked by the extension of the config path.
+const (
+	FormatJSON = "json" // .json and anything unknown
+	FormatYAML = "yaml" // .yaml and .yml
+	FormatTOML = "toml" // .toml
+)
+
+// FormatForPath returns the format of the config file at path, based on its extension.
+func FormatForPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatJSON
+}
+
+// toJSON converts a YAML or TOML config to JSON, so all formats share the field names
+// and decoding of LoadConfigJSON.
+//
+// Parameters:
+//   - format: string - The format of data.
+//   - data: []byte - The config file contents.
+//
+// Returns:
+//   - []byte: The config as JSON.
+//   - error: An error if data can't be parsed.
+func toJSON(format string, data []byte) ([]byte, error) {
+	values := map[string]any{}
+	var err error
+	switch format {
+	case FormatYAML:
+		err = yaml.Unmarshal(data, &values)
+	case FormatTOML:
+		err = toml.Unmarshal(data, &values)
+	default:
+		return data, nil
+	}
+	var decodeErr *toml.DecodeError
+	if errors.As(err, &decodeErr) {
+		row, column := decodeErr.Position()
+		return nil, fmt.Errorf("failed to decode config file: line %d column %d: %v", row, column, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config file: %v", err)
+	}
+	return json.Marshal(values)
+}
+
+// fromJSON converts the JSON encoded config to format. Comments of the existing file
+// are carried over to the keys and tables they were written above or next to,
+// so hand-edited configs survive commands that save the config.
+//
+// Parameters:
+//   - format: string - The format to convert to.
+//   - data: []byte - The config as JSON.
+//   - existing: []byte - The current contents of the config file, empty if there is none.
+//
+// Returns:
+//   - []byte: The config file contents.
+//   - error: An error if data can't be converted.
+func fromJSON(format string, data, existing []byte) ([]byte, error) {
+	// JSON is valid YAML, decoding it to a node keeps the field order of Config
+	var updated yaml.Node
+	if err := yaml.Unmarshal(data, &updated); err != nil {
+		return nil, fmt.Errorf("failed to convert config: %v", err)
+	}
+	root := updated.Content[0]
+	plainStyle(root)
+
+	switch format {
+	case FormatYAML:
+		return encodeYAML(root, existing)
+	case FormatTOML:
+		return encodeTOML(root, parseTOMLComments(existing))
+	}
+	return data, nil
+}
+
+// plainStyle drops the JSON quoting and flow style of a node tree, so it is written as block YAML.
+func plainStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		plainStyle(child)
+	}
+}
+
+// encodeYAML writes root as YAML. If existing holds a YAML mapping, root is merged into it,
+// keeping its comments, key order and style.
+func encodeYAML(root *yaml.Node, existing []byte) ([]byte, error) {
+	doc := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}
+	var current yaml.Node
+	if err := yaml.Unmarshal(existing, &current); err == nil && len(current.Content) == 1 && current.Content[0].Kind == yaml.MappingNode {
+		mergeYAML(current.Content[0], root)
+		doc = &current
+	}
+
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, fmt.Errorf("failed to encode config file: %v", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode config file: %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+// mergeYAML updates dst to the values of src. Comments of dst are kept, keys missing from src
+// are removed and new keys are appended.
+func mergeYAML(dst, src *yaml.Node) {
+	if dst.Kind != src.Kind {
+		replaceYAML(dst, src)
+		return
+	}
+
+	switch src.Kind {
+	case yaml.MappingNode:
+		// keep the keys of dst that are still set in their order, then add the new ones
+		merged := make([]*yaml.Node, 0, len(src.Content))
+		for j := 0; j+1 < len(dst.Content); j += 2 {
+			if value := mappingValue(src, dst.Content[j].Value); value != nil {
+				mergeYAML(dst.Content[j+1], value)
+				merged = append(merged, dst.Content[j], dst.Content[j+1])
+			}
+		}
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			if mappingValue(dst, src.Content[i].Value) == nil {
+				merged = append(merged, src.Content[i], src.Content[i+1])
+			}
+		}
+		dst.Content = merged
+	case yaml.SequenceNode:
+		for i, item := range src.Content {
+			if i < len(dst.Content) {
+				mergeYAML(dst.Content[i], item)
+			} else {
+				dst.Content = append(dst.Content, item)
+			}
+		}
+		dst.Content = dst.Content[:len(src.Content)]
+	default:
+		replaceYAML(dst, src)
+	}
+}
+
+// replaceYAML overwrites dst with src, keeping the comments of dst.
+func replaceYAML(dst, src *yaml.Node) {
+	head, line, foot := dst.HeadComment, dst.LineComment, dst.FootComment
+	*dst = *src
+	dst.HeadComment, dst.LineComment, dst.FootComment = head, line, foot
+}
+
+// mappingValue returns the value of key in a mapping node, nil if it isn't set.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
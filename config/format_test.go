@@ -0,0 +1,231 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testPubKey is a PEM value spanning lines, written as a multi-line string in TOML.
+const testPubKey = "-----BEGIN PUBLIC KEY-----\nMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE\n-----END PUBLIC KEY-----\n"
+
+func TestToJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		data    string
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "TOML nested tables",
+			format: FormatTOML,
+			data:   "id = \"device\"\n[standby]\nid = \"spare\"\n[expert.h3_settings]\n0x33 = 1\n",
+			want:   `{"id":"device","standby":{"id":"spare"},"expert":{"h3_settings":{"0x33":1}}}`,
+		},
+		{
+			name:   "TOML dotted keys",
+			format: FormatTOML,
+			data:   "expert.context_id = 0\nfeatures.racing = true\n",
+			want:   `{"expert":{"context_id":0},"features":{"racing":true}}`,
+		},
+		{
+			name:   "TOML arrays",
+			format: FormatTOML,
+			data:   "endpoints = [\n  \"162.159.198.1:443\", # primary\n  \"[2606:4700:103::1]:443\",\n]\n",
+			want:   `{"endpoints":["162.159.198.1:443","[2606:4700:103::1]:443"]}`,
+		},
+		{
+			name:   "TOML quoting and escapes",
+			format: FormatTOML,
+			data:   "license = \"a\\\"b\\\\c\\u00e9\"\nid = 'C:\\usque'\n\"access_token\" = \"x#y\"\nendpoint_pub_key = '''\n" + testPubKey + "'''\n",
+			want:   `{"license":"a\"b\\cé","id":"C:\\usque","access_token":"x#y","endpoint_pub_key":` + jsonString(testPubKey) + `}`,
+		},
+		{
+			name:   "TOML comments",
+			format: FormatTOML,
+			data:   "# header\nid = \"device\" # trailing\n\n# above table\n[standby] # on table\n# inside\nid = \"spare\"\n# end\n",
+			want:   `{"id":"device","standby":{"id":"spare"}}`,
+		},
+		{
+			name:   "YAML nested, lists, quoting and comments",
+			format: FormatYAML,
+			data:   "# header\nid: device # trailing\nlicense: \"a\\\"b\"\nendpoints:\n  - 162.159.198.1:443\n  - '[2606:4700:103::1]:443'\nstandby:\n  id: spare\nendpoint_pub_key: |\n  -----BEGIN PUBLIC KEY-----\n  MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE\n  -----END PUBLIC KEY-----\n",
+			want:   `{"id":"device","license":"a\"b","endpoints":["162.159.198.1:443","[2606:4700:103::1]:443"],"standby":{"id":"spare"},"endpoint_pub_key":` + jsonString(testPubKey) + `}`,
+		},
+		{name: "TOML missing value", format: FormatTOML, data: "id = \"device\"\nlicense =\n", wantErr: "line 2"},
+		{name: "TOML unterminated string", format: FormatTOML, data: "id = \"device\n", wantErr: "line 1"},
+		{name: "TOML duplicate key", format: FormatTOML, data: "id = \"a\"\nid = \"b\"\n", wantErr: "already defined"},
+		{name: "TOML unclosed table", format: FormatTOML, data: "[standby\nid = \"a\"\n", wantErr: "line 1"},
+		{name: "YAML bad indentation", format: FormatYAML, data: "standby:\n  id: a\n bad: b\n", wantErr: "line 2"},
+		{name: "YAML not a mapping", format: FormatYAML, data: "- a\n- b\n", wantErr: "failed to decode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := toJSON(tt.format, []byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("toJSON() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("toJSON() error = %v", err)
+			}
+			assertSameJSON(t, got, []byte(tt.want))
+		})
+	}
+}
+
+func TestParseTOMLComments(t *testing.T) {
+	data := "# header\n\nid = \"a#b\" # trailing\nendpoints = [\n  \"x\", # inside the array\n]\nlicense = '''\n# not a comment\n'''\n\n# above table\n[standby] # on table\nid = 'c#d'\n# end\n"
+	c := parseTOMLComments([]byte(data))
+
+	if got, want := c.leading["id"], []string{"# header", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("leading comment of id = %q, want %q", got, want)
+	}
+	if got := c.trailing["id"]; got != "# trailing" {
+		t.Errorf("trailing comment of id = %q, want %q", got, "# trailing")
+	}
+	if got := c.trailing["endpoints"]; got != "" {
+		t.Errorf("trailing comment of endpoints = %q, comments inside arrays belong to no key", got)
+	}
+	if _, ok := c.lines["# not a comment"]; ok || len(c.leading["license"]) != 0 {
+		t.Errorf("the content of a multi-line string was read as comments")
+	}
+	if got, want := c.leading["[standby"], []string{"", "# above table"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("leading comment of [standby] = %q, want %q", got, want)
+	}
+	if got := c.trailing["[standby"]; got != "# on table" {
+		t.Errorf("trailing comment of [standby] = %q, want %q", got, "# on table")
+	}
+	if got := c.trailing["standby.id"]; got != "" {
+		t.Errorf("trailing comment of standby.id = %q, a # in a literal string isn't one", got)
+	}
+	if got, want := c.end, []string{"# end"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("end comments = %q, want %q", got, want)
+	}
+	wantLines := map[string]int{"id": 3, "endpoints": 4, "license": 7, "[standby": 12, "standby.id": 13}
+	if !reflect.DeepEqual(c.lines, wantLines) {
+		t.Errorf("lines = %v, want %v", c.lines, wantLines)
+	}
+}
+
+func TestSaveConfigRoundTrip(t *testing.T) {
+	original := Config{
+		PrivateKey:     "MHcCAQEEIAbc+/=",
+		EndpointV4:     "162.159.198.1",
+		EndpointPubKey: testPubKey,
+		Endpoints:      []string{"162.159.198.1:443", "[2606:4700:103::1]:443"},
+		License:        `with "quotes" and \backslash`,
+		ID:             "device",
+		Features:       map[string]bool{"racing": true},
+		Standby:        &Registration{ID: "spare", IPv4: "172.16.0.3"},
+		Expert:         &ExpertConfig{H3Settings: map[string]uint64{"0x33": 1}},
+	}
+	asJSON, err := json.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{FormatJSON, FormatYAML, FormatTOML} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config."+format)
+			if err := original.SaveConfig(path); err != nil {
+				t.Fatalf("SaveConfig() error = %v", err)
+			}
+			read, err := ReadConfig(path)
+			if err != nil {
+				t.Fatalf("ReadConfig() error = %v", err)
+			}
+			if !reflect.DeepEqual(read, original) {
+				t.Errorf("read back %+v, want %+v", read, original)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			converted, err := toJSON(format, data)
+			if err != nil {
+				t.Fatalf("toJSON() error = %v", err)
+			}
+			assertSameJSON(t, converted, asJSON)
+		})
+	}
+}
+
+func TestSaveConfigKeepsComments(t *testing.T) {
+	tests := []struct {
+		format   string
+		data     string
+		comments []string
+	}{
+		{
+			format:   FormatTOML,
+			data:     "# my router\nid = \"device\" # do not change\nlicense = \"old\"\n\n# the spare one\n[standby]\nid = \"spare\"\n# end of file\n",
+			comments: []string{"# my router", "id = \"device\" # do not change", "# the spare one", "# end of file"},
+		},
+		{
+			format:   FormatYAML,
+			data:     "# my router\nid: device # do not change\nlicense: old\n# the spare one\nstandby:\n  id: spare\n",
+			comments: []string{"# my router", "id: device # do not change", "# the spare one"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config."+tt.format)
+			if err := os.WriteFile(path, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := ReadConfig(path)
+			if err != nil {
+				t.Fatalf("ReadConfig() error = %v", err)
+			}
+			cfg.License = "new"
+			if err := cfg.SaveConfig(path); err != nil {
+				t.Fatalf("SaveConfig() error = %v", err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, comment := range tt.comments {
+				if !strings.Contains(string(data), comment) {
+					t.Errorf("saved file lost %q:\n%s", comment, data)
+				}
+			}
+			read, err := ReadConfig(path)
+			if err != nil {
+				t.Fatalf("ReadConfig() after saving error = %v", err)
+			}
+			if read.License != "new" || read.ID != "device" || read.Standby == nil || read.Standby.ID != "spare" {
+				t.Errorf("read back %+v", read)
+			}
+		})
+	}
+}
+
+// jsonString encodes s as a JSON string.
+func jsonString(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded)
+}
+
+// assertSameJSON fails the test unless got and want encode the same values.
+func assertSameJSON(t *testing.T, got, want []byte) {
+	t.Helper()
+	var gotValues, wantValues any
+	if err := json.Unmarshal(got, &gotValues); err != nil {
+		t.Fatalf("invalid JSON %s: %v", got, err)
+	}
+	if err := json.Unmarshal(want, &wantValues); err != nil {
+		t.Fatalf("invalid JSON %s: %v", want, err)
+	}
+	if !reflect.DeepEqual(gotValues, wantValues) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
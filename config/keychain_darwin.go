@@ -0,0 +1,51 @@
+//go:build darwin
+
+package config
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// securityItemNotFound is the exit code of the security tool if the keychain item doesn't exist
+// (errSecItemNotFound).
+const securityItemNotFound = 44
+
+// Get reads the secret from the login keychain using the security tool.
+func (s *keychainSecretStore) Get(name string) (string, error) {
+	cmd := exec.Command("security", "find-generic-password", "-s", s.service, "-a", name, "-w")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == securityItemNotFound {
+		return "", ErrSecretNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read keychain: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Set stores the secret in the login keychain using the security tool, replacing any existing one.
+// The command is passed to an interactive security on stdin, so the secret never shows up in the
+// arguments of a process. It is hex encoded, so it needs no quoting.
+func (s *keychainSecretStore) Set(name, value string) error {
+	if strings.ContainsAny(s.service+name, "\"\\\n") {
+		return fmt.Errorf("keychain service %q or secret name %q contains quotes, backslashes or newlines", s.service, name)
+	}
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s \"%s\" -a \"%s\" -X %s\n", s.service, name, hex.EncodeToString([]byte(value))))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	// security -i exits successfully even if the command failed, so check what was stored
+	if stored, err := s.Get(name); err != nil || stored != value {
+		return fmt.Errorf("secret %s was not stored: %s", name, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build !darwin && !windows
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Get reads the secret from the Secret Service (e.g. GNOME Keyring or KWallet) using secret-tool.
+func (s *keychainSecretStore) Get(name string) (string, error) {
+	cmd := exec.Command("secret-tool", "lookup", "service", s.service, "account", name)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	// a missing secret fails silently, anything else (e.g. no D-Bus session) explains itself
+	if err != nil && (stderr.Len() > 0 || !errors.As(err, new(*exec.ExitError))) {
+		return "", fmt.Errorf("failed to read Secret Service: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil || len(output) == 0 {
+		return "", ErrSecretNotFound
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Set stores the secret in the Secret Service using secret-tool, replacing any existing one.
+func (s *keychainSecretStore) Set(name, value string) error {
+	cmd := exec.Command("secret-tool", "store", "--label", s.service+" "+name, "service", s.service, "account", name)
+	cmd.Stdin = strings.NewReader(value)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to write Secret Service: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// validateConfig checks a config file against the fields of Config before it is decoded, so a
+// misspelled key is reported instead of silently leaving its field unset. Errors point to the
+// line of the offending key in the original file.
+//
+// Parameters:
+//   - format: string - The format of the config file.
+//   - raw: []byte - The contents of the config file.
+//   - data: []byte - The config converted to JSON.
+//
+// Returns:
+//   - error: An error listing the unknown keys and values of the wrong type, or invalid JSON.
+func validateConfig(format string, raw, data []byte) error {
+	var values any
+	if err := json.Unmarshal(data, &values); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) && format == FormatJSON {
+			line := 1 + strings.Count(string(raw[:min(int(syntaxErr.Offset), len(raw))]), "\n")
+			return fmt.Errorf("failed to decode config file: line %d: %v", line, err)
+		}
+		return fmt.Errorf("failed to decode config file: %v", err)
+	}
+
+	lines := keyLines(format, raw)
+	var unknown []string
+	findUnknownKeys(values, reflect.TypeOf(Config{}), "", &unknown)
+	sort.Strings(unknown)
+	sort.SliceStable(unknown, func(i, j int) bool {
+		return lineOf(lines, unknown[i]) < lineOf(lines, unknown[j])
+	})
+
+	var problems []string
+	for _, path := range unknown {
+		problem := fmt.Sprintf("unknown key %q%s", path, onLine(lines, path))
+		if suggestion := suggestKey(path); suggestion != "" {
+			problem += fmt.Sprintf(", did you mean %q", suggestion)
+		}
+		problems = append(problems, problem)
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if err := json.Unmarshal(data, &Config{}); errors.As(err, &typeErr) {
+		problems = append(problems, fmt.Sprintf("%s%s must be a %s, not a %s",
+			typeErr.Field, onLine(lines, typeErr.Field), typeName(typeErr.Type), typeErr.Value))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config file: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// findUnknownKeys collects the paths of the keys in values that aren't fields of t.
+// The keys of maps such as features are free and not checked.
+func findUnknownKeys(values any, t reflect.Type, path string, unknown *[]string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	object, ok := values.(map[string]any)
+	if !ok || t.Kind() != reflect.Struct {
+		return
+	}
+
+	for key, value := range object {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+		field, ok := fieldByKey(t, key)
+		if !ok {
+			*unknown = append(*unknown, keyPath)
+			continue
+		}
+		findUnknownKeys(value, field.Type, keyPath, unknown)
+	}
+}
+
+// fieldByKey returns the field of struct t with the given JSON name.
+func fieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == key && t.Field(i).IsExported() {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// suggestKey returns the known key closest to an unknown one, if it is likely a typo of it.
+func suggestKey(path string) string {
+	parts := strings.Split(path, ".")
+	t := reflect.TypeOf(Config{})
+	for _, part := range parts[:len(parts)-1] {
+		field, ok := fieldByKey(t, part)
+		if !ok {
+			return ""
+		}
+		for t = field.Type; t.Kind() == reflect.Pointer; t = t.Elem() {
+		}
+	}
+
+	key := parts[len(parts)-1]
+	best, bestDistance := "", 3
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if !t.Field(i).IsExported() {
+			continue
+		}
+		if distance := editDistance(strings.ToLower(key), name); distance < bestDistance {
+			best, bestDistance = name, distance
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// typeName describes a Go type the way a config file author thinks of it.
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64, reflect.Uint32, reflect.Uint16:
+		return "number"
+	case reflect.Slice:
+		return "list"
+	case reflect.Map, reflect.Struct, reflect.Pointer:
+		return "table"
+	}
+	return t.String()
+}
+
+// keyLines returns the line of every key in a config file by its dotted path. TOML tables are
+// prefixed with "[". Files that don't parse have no lines.
+func keyLines(format string, raw []byte) map[string]int {
+	if format == FormatTOML {
+		return parseTOMLComments(raw).lines
+	}
+
+	// JSON is valid YAML, so both are read as YAML nodes, which know their lines
+	lines := map[string]int{}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil || len(doc.Content) != 1 {
+		return lines
+	}
+	var walk func(node *yaml.Node, path string)
+	walk = func(node *yaml.Node, path string) {
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyPath := node.Content[i].Value
+			if path != "" {
+				keyPath = path + "." + keyPath
+			}
+			lines[keyPath] = node.Content[i].Line
+			walk(node.Content[i+1], keyPath)
+		}
+	}
+	walk(doc.Content[0], "")
+	return lines
+}
+
+// lineOf returns the line of a key, the first line of the keys below it if it's only
+// implied by a dotted TOML key, or 0 if it's unknown.
+func lineOf(lines map[string]int, path string) int {
+	if line, ok := lines[path]; ok {
+		return line
+	}
+	if line, ok := lines["["+path]; ok {
+		return line
+	}
+	first := 0
+	for key, line := range lines {
+		if strings.HasPrefix(key, path+".") && (first == 0 || line < first) {
+			first = line
+		}
+	}
+	return first
+}
+
+// onLine describes the line of a key for an error message, empty if it's unknown.
+func onLine(lines map[string]int, path string) string {
+	if line := lineOf(lines, path); line > 0 {
+		return fmt.Sprintf(" on line %d", line)
+	}
+	return ""
+}
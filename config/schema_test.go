@@ -0,0 +1,104 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		data    string
+		wantErr string
+	}{
+		{name: "valid JSON", format: FormatJSON, data: "{\n  \"id\": \"device\",\n  \"standby\": {\"id\": \"spare\"}\n}"},
+		{name: "valid TOML", format: FormatTOML, data: "id = \"device\"\n[expert]\ncontext_id = 0\n"},
+		{
+			name:    "unknown JSON key with suggestion",
+			format:  FormatJSON,
+			data:    "{\n  \"id\": \"device\",\n  \"licence\": \"x\"\n}",
+			wantErr: `unknown key "licence" on line 3, did you mean "license"`,
+		},
+		{
+			name:    "unknown YAML key without suggestion",
+			format:  FormatYAML,
+			data:    "id: device\nsomething_else: 1\n",
+			wantErr: `unknown key "something_else" on line 2`,
+		},
+		{
+			name:    "unknown key in a TOML table",
+			format:  FormatTOML,
+			data:    "id = \"device\"\n\n[standby]\nid = \"spare\"\nipv5 = \"x\"\n",
+			wantErr: `unknown key "standby.ipv5" on line 5, did you mean "ipv4"`,
+		},
+		{
+			name:    "unknown TOML table",
+			format:  FormatTOML,
+			data:    "id = \"device\"\n[standbye]\nid = \"spare\"\n",
+			wantErr: `unknown key "standbye" on line 2, did you mean "standby"`,
+		},
+		{
+			name:    "unknown dotted TOML key",
+			format:  FormatTOML,
+			data:    "id = \"device\"\nexpret.context_id = 0\n",
+			wantErr: `unknown key "expret" on line 2, did you mean "expert"`,
+		},
+		{
+			name:    "wrong type",
+			format:  FormatYAML,
+			data:    "id: device\nendpoints: 162.159.198.1:443\n",
+			wantErr: "endpoints on line 2 must be a list, not a string",
+		},
+		{
+			name:    "wrong nested type",
+			format:  FormatTOML,
+			data:    "[standby]\nid = \"spare\"\nipv4 = 4\n",
+			wantErr: "standby.ipv4 on line 3 must be a string, not a number",
+		},
+		{name: "free feature keys", format: FormatYAML, data: "features:\n  anything_at_all: true\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := toJSON(tt.format, []byte(tt.data))
+			if err != nil {
+				t.Fatalf("toJSON() error = %v", err)
+			}
+			err = validateConfig(tt.format, []byte(tt.data), data)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateConfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validateConfig() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateConfigJSONSyntaxLine(t *testing.T) {
+	raw := []byte("{\n  \"id\": \"device\",\n  \"license\" \"x\"\n}")
+	err := validateConfig(FormatJSON, raw, raw)
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("validateConfig() error = %v, want one on line 3", err)
+	}
+}
+
+func TestValidateConfigListsEveryProblem(t *testing.T) {
+	raw := []byte("zzz: 1\nlicence: x\n")
+	data, err := toJSON(FormatYAML, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validateConfig(FormatYAML, raw, data)
+	if err == nil {
+		t.Fatal("validateConfig() accepted two unknown keys")
+	}
+	// problems are listed in the order of the file
+	first, second := strings.Index(err.Error(), `"zzz"`), strings.Index(err.Error(), `"licence"`)
+	if first < 0 || second < first {
+		t.Errorf("validateConfig() error = %v, want both keys in file order", err)
+	}
+}
@@ -0,0 +1,305 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// Names of the secrets kept in a SecretStore.
+const (
+	SecretPrivateKey         = "private_key"
+	SecretAccessToken        = "access_token"
+	SecretStandbyPrivateKey  = "standby_private_key"
+	SecretStandbyAccessToken = "standby_access_token"
+)
+
+// Secret store backends selectable in SecretsConfig.
+const (
+	SecretBackendConfig    = "config"    // Inline in the config file (default)
+	SecretBackendFile      = "file"      // A separate JSON file only readable by the owner
+	SecretBackendKeychain  = "keychain"  // The OS keychain (Keychain, Secret Service or Credential Manager)
+	SecretBackendEnv       = "env"       // Environment variables, read-only
+	SecretBackendCommand   = "command"   // An external command such as pass
+	SecretBackendEncrypted = "encrypted" // Inline in the config file, encrypted with a passphrase
+)
+
+// DefaultSecretService is the service name secrets are stored under in the OS keychain.
+const DefaultSecretService = "usque"
+
+// secretEnvPrefix is the prefix of the environment variables read by the env backend.
+const secretEnvPrefix = "USQUE_"
+
+// ErrSecretNotFound is returned by SecretStore.Get if the secret doesn't exist.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// ErrSecretStoreReadOnly is returned by SecretStore.Set if the backend can't store secrets.
+var ErrSecretStoreReadOnly = errors.New("secret store is read-only")
+
+// SecretStore keeps credentials such as the device private key outside of the config file.
+type SecretStore interface {
+	// Get returns the secret with the given name.
+	Get(name string) (string, error)
+	// Set stores the secret with the given name.
+	Set(name, value string) error
+}
+
+// SecretsConfig selects where secrets are stored.
+type SecretsConfig struct {
+	Backend    string `json:"backend"`               // One of the SecretBackend constants
+	Path       string `json:"path,omitempty"`        // File backend: path of the secrets file
+	Service    string `json:"service,omitempty"`     // Keychain and encrypted backends: keychain service name, defaults to DefaultSecretService
+	GetCommand string `json:"get_command,omitempty"` // Command backend: prints the secret, {name} is replaced (e.g. "pass show usque/{name}"), split on whitespace without a shell
+	SetCommand string `json:"set_command,omitempty"` // Command backend: reads the secret from stdin (e.g. "pass insert -m -f usque/{name}")
+
+	PassphraseCommand string            `json:"passphrase_command,omitempty"` // Encrypted backend: prints the passphrase (e.g. "age -d -i key.txt passphrase.age"), split like GetCommand
+	Salt              string            `json:"salt,omitempty"`               // Encrypted backend: Base64-encoded scrypt salt, generated on first save
+	Encrypted         map[string]string `json:"encrypted,omitempty"`          // Encrypted backend: Base64-encoded encrypted secrets by name
+
+	key []byte // Encrypted backend: the derived key, so the passphrase is only asked for once
+}
+
+// NewSecretStore creates the SecretStore described by cfg. The encrypted backend stores
+// secrets in cfg, so use it through the Secrets of a Config instead.
+//
+// Parameters:
+//   - cfg: SecretsConfig - The backend configuration.
+//
+// Returns:
+//   - SecretStore: The store, or nil for the config backend.
+//   - error: An error if the backend is unknown or misconfigured.
+func NewSecretStore(cfg SecretsConfig) (SecretStore, error) {
+	return newSecretStore(&cfg)
+}
+
+// newSecretStore is NewSecretStore for a configuration the encrypted backend can update.
+func newSecretStore(cfg *SecretsConfig) (SecretStore, error) {
+	switch cfg.Backend {
+	case "", SecretBackendConfig:
+		return nil, nil
+	case SecretBackendFile:
+		if cfg.Path == "" {
+			return nil, errors.New("file secret store requires a path")
+		}
+		return &fileSecretStore{path: cfg.Path}, nil
+	case SecretBackendKeychain:
+		service := cfg.Service
+		if service == "" {
+			service = DefaultSecretService
+		}
+		return &keychainSecretStore{service: service}, nil
+	case SecretBackendEnv:
+		return envSecretStore{}, nil
+	case SecretBackendCommand:
+		if cfg.GetCommand == "" {
+			return nil, errors.New("command secret store requires a get_command")
+		}
+		return &commandSecretStore{get: cfg.GetCommand, set: cfg.SetCommand}, nil
+	case SecretBackendEncrypted:
+		return &encryptedSecretStore{cfg: cfg}, nil
+	}
+
+	return nil, fmt.Errorf("unknown secret store backend %q", cfg.Backend)
+}
+
+// fileSecretStore keeps secrets in a JSON object in a file only readable by the owner.
+type fileSecretStore struct {
+	path string
+}
+
+func (s *fileSecretStore) load() (map[string]string, error) {
+	secrets := map[string]string{}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return secrets, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets file: %v", err)
+	}
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("failed to decode secrets file: %v", err)
+	}
+	return secrets, nil
+}
+
+func (s *fileSecretStore) Get(name string) (string, error) {
+	secrets, err := s.load()
+	if err != nil {
+		return "", err
+	}
+	value, ok := secrets[name]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+func (s *fileSecretStore) Set(name, value string) error {
+	secrets, err := s.load()
+	if err != nil {
+		return err
+	}
+	secrets[name] = value
+
+	data, err := json.MarshalIndent(secrets, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode secrets file: %v", err)
+	}
+	// the file may hold the only copy of the device key, a crash must not leave it truncated
+	if err := internal.WriteFileAtomic(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write secrets file: %v", err)
+	}
+	return nil
+}
+
+// envSecretStore reads secrets from environment variables, e.g. USQUE_PRIVATE_KEY.
+type envSecretStore struct{}
+
+func (envSecretStore) Get(name string) (string, error) {
+	value, ok := os.LookupEnv(secretEnvPrefix + strings.ToUpper(name))
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+func (envSecretStore) Set(name, value string) error {
+	return ErrSecretStoreReadOnly
+}
+
+// commandSecretStore runs external commands to get and set secrets.
+type commandSecretStore struct {
+	get string
+	set string
+}
+
+// splitCommand builds a command from a command line of the config. The line is split on
+// whitespace and not run through a shell, so there is no quoting: neither the program nor
+// its arguments can contain spaces. Wrap anything more involved in a script.
+func splitCommand(line string) (*exec.Cmd, error) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return exec.Command(args[0], args[1:]...), nil
+}
+
+// command builds the command for the given template and secret name.
+func (s *commandSecretStore) command(template, name string) (*exec.Cmd, error) {
+	return splitCommand(strings.ReplaceAll(template, "{name}", name))
+}
+
+func (s *commandSecretStore) Get(name string) (string, error) {
+	cmd, err := s.command(s.get, name)
+	if err != nil {
+		return "", err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	// password managers print the secret on the first line
+	value, _, _ := strings.Cut(string(output), "\n")
+	return strings.TrimSpace(value), nil
+}
+
+func (s *commandSecretStore) Set(name, value string) error {
+	if s.set == "" {
+		return ErrSecretStoreReadOnly
+	}
+	cmd, err := s.command(s.set, name)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = strings.NewReader(value + "\n")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set secret %s: %v: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// keychainSecretStore keeps secrets in the OS keychain. The implementation is platform specific.
+type keychainSecretStore struct {
+	service string
+}
+
+// secretFields returns pointers to the config fields kept in a SecretStore, by secret name.
+func (c *Config) secretFields() map[string]*string {
+	fields := map[string]*string{
+		SecretPrivateKey:  &c.PrivateKey,
+		SecretAccessToken: &c.AccessToken,
+	}
+	if c.Standby != nil {
+		fields[SecretStandbyPrivateKey] = &c.Standby.PrivateKey
+		fields[SecretStandbyAccessToken] = &c.Standby.AccessToken
+	}
+	return fields
+}
+
+// loadSecrets fills in the secret fields from the configured store.
+// Values present in the config file itself take precedence, so a partially migrated config keeps working.
+func (c *Config) loadSecrets() error {
+	if c.Secrets == nil {
+		return nil
+	}
+	store, err := newSecretStore(c.Secrets)
+	if err != nil || store == nil {
+		return err
+	}
+
+	for name, field := range c.secretFields() {
+		if *field != "" {
+			continue
+		}
+		value, err := store.Get(name)
+		if err != nil {
+			return fmt.Errorf("failed to load %s from %s secret store: %v", name, c.Secrets.Backend, err)
+		}
+		*field = value
+	}
+
+	return nil
+}
+
+// storeSecrets writes the secret fields to the configured store and returns a copy
+// of the config without them, ready to be written to disk. Secrets a read-only store
+// can't take are kept in the config.
+func (c *Config) storeSecrets() (Config, error) {
+	stripped := *c
+	if c.Standby != nil {
+		// stripping the copy must not touch the standby registration of c
+		standby := *c.Standby
+		stripped.Standby = &standby
+	}
+	if c.Secrets == nil {
+		return stripped, nil
+	}
+	store, err := newSecretStore(c.Secrets)
+	if err != nil || store == nil {
+		return stripped, err
+	}
+
+	for name, field := range stripped.secretFields() {
+		if *field == "" {
+			continue
+		}
+		if err := store.Set(name, *field); err != nil {
+			if errors.Is(err, ErrSecretStoreReadOnly) {
+				// better to keep it in the config than to lose it
+				continue
+			}
+			return stripped, fmt.Errorf("failed to store %s in %s secret store: %v", name, c.Secrets.Backend, err)
+		}
+		*field = ""
+	}
+
+	return stripped, nil
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFileSecretStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	store, err := NewSecretStore(SecretsConfig{Backend: SecretBackendFile, Path: path})
+	if err != nil {
+		t.Fatalf("NewSecretStore: %v", err)
+	}
+
+	if _, err := store.Get(SecretPrivateKey); !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("Get before Set = %v, want ErrSecretNotFound", err)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{SecretPrivateKey, "MHcCAQEEI..."},
+		{SecretAccessToken, "token with \"quotes\" and\nnewline"},
+		{SecretPrivateKey, "replaced"},
+	}
+	for _, tt := range tests {
+		if err := store.Set(tt.name, tt.value); err != nil {
+			t.Fatalf("Set(%s): %v", tt.name, err)
+		}
+		if got, err := store.Get(tt.name); err != nil || got != tt.value {
+			t.Errorf("Get(%s) = %q, %v, want %q", tt.name, got, err, tt.value)
+		}
+	}
+	if got, _ := store.Get(SecretAccessToken); got != tests[1].value {
+		t.Errorf("Set of another secret changed %s to %q", SecretAccessToken, got)
+	}
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("secrets file mode = %o, want 600", perm)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(SecretPrivateKey); err == nil {
+		t.Error("Get accepted a corrupt secrets file")
+	}
+	if err := store.Set(SecretPrivateKey, "x"); err == nil {
+		t.Error("Set overwrote a corrupt secrets file")
+	}
+}
+
+func TestEnvSecretStore(t *testing.T) {
+	t.Setenv("USQUE_PRIVATE_KEY", "from env")
+	t.Setenv("USQUE_ACCESS_TOKEN", "")
+
+	store, err := NewSecretStore(SecretsConfig{Backend: SecretBackendEnv})
+	if err != nil {
+		t.Fatalf("NewSecretStore: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr error
+	}{
+		{SecretPrivateKey, "from env", nil},
+		{SecretAccessToken, "", nil},
+		{SecretStandbyPrivateKey, "", ErrSecretNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.Get(tt.name)
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Get = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	if err := store.Set(SecretPrivateKey, "x"); !errors.Is(err, ErrSecretStoreReadOnly) {
+		t.Errorf("Set = %v, want ErrSecretStoreReadOnly", err)
+	}
+}
+
+func TestCommandSecretStore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub is a shell script")
+	}
+	dir := t.TempDir()
+	stub := filepath.Join(dir, "stub.sh")
+	script := `#!/bin/sh
+case "$1" in
+get) [ -f "$2" ] || { echo "no such secret" >&2; exit 1; }; cat "$2"; echo; echo "second line" ;;
+set) cat > "$2" ;;
+esac
+`
+	if err := os.WriteFile(stub, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(dir, "{name}")
+
+	store, err := NewSecretStore(SecretsConfig{
+		Backend:    SecretBackendCommand,
+		GetCommand: stub + " get " + secret,
+		SetCommand: stub + " set " + secret,
+	})
+	if err != nil {
+		t.Fatalf("NewSecretStore: %v", err)
+	}
+
+	if _, err := store.Get(SecretPrivateKey); err == nil || !strings.Contains(err.Error(), "no such secret") {
+		t.Errorf("Get of a missing secret = %v, want the stderr of the command", err)
+	}
+	for _, value := range []string{"secret", "  padded  "} {
+		if err := store.Set(SecretPrivateKey, value); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		// only the first line counts and surrounding space is trimmed
+		if got, err := store.Get(SecretPrivateKey); err != nil || got != strings.TrimSpace(value) {
+			t.Errorf("Get = %q, %v, want %q", got, err, strings.TrimSpace(value))
+		}
+	}
+
+	readOnly, err := NewSecretStore(SecretsConfig{Backend: SecretBackendCommand, GetCommand: stub + " get " + secret})
+	if err != nil {
+		t.Fatalf("NewSecretStore: %v", err)
+	}
+	if err := readOnly.Set(SecretPrivateKey, "x"); !errors.Is(err, ErrSecretStoreReadOnly) {
+		t.Errorf("Set without set_command = %v, want ErrSecretStoreReadOnly", err)
+	}
+
+	if _, err := NewSecretStore(SecretsConfig{Backend: SecretBackendCommand}); err == nil {
+		t.Error("NewSecretStore accepted a command store without get_command")
+	}
+}
@@ -0,0 +1,272 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// tomlComments holds the comments of a TOML document by the path of the key or table they belong to.
+// Table paths start with "[", so a table and a key of the same name stay apart.
+type tomlComments struct {
+	leading  map[string][]string // comment and blank lines above a key or table
+	trailing map[string]string   // comment after a key or table on the same line
+	end      []string            // comment lines after the last key
+	lines    map[string]int      // line of a key or table, starting at 1
+}
+
+// tomlScanner tracks strings and arrays spanning several lines of a TOML document.
+type tomlScanner struct {
+	multiline string // closing delimiter of the open multi-line string, if any
+	depth     int    // open brackets and braces
+}
+
+// scan consumes a line, or the rest of it, and returns its comment if it has one.
+// Comments inside multi-line arrays aren't returned.
+func (s *tomlScanner) scan(line string) string {
+	for i := 0; i < len(line); i++ {
+		if s.multiline != "" {
+			if strings.HasPrefix(line[i:], s.multiline) {
+				i += len(s.multiline) - 1
+				s.multiline = ""
+			} else if line[i] == '\\' && s.multiline == `"""` {
+				i++
+			}
+			continue
+		}
+
+		switch c := line[i]; {
+		case strings.HasPrefix(line[i:], `"""`), strings.HasPrefix(line[i:], `'''`):
+			s.multiline = line[i : i+3]
+			i += 2
+		case c == '"':
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+		case c == '\'':
+			for i++; i < len(line) && line[i] != '\''; i++ {
+			}
+		case c == '[', c == '{':
+			s.depth++
+		case c == ']', c == '}':
+			s.depth--
+		case c == '#':
+			if s.depth == 0 {
+				return line[i:]
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// parseTOMLComments collects the comments and the lines of the keys of a TOML document. It only
+// looks at the structure of lines, so it also works on documents that no longer parse.
+func parseTOMLComments(data []byte) *tomlComments {
+	c := &tomlComments{leading: map[string][]string{}, trailing: map[string]string{}, lines: map[string]int{}}
+	var table []string
+	var pending []string
+	var s tomlScanner
+	for number, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if s.multiline != "" || s.depth > 0 {
+			s.scan(line)
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "", strings.HasPrefix(trimmed, "#"):
+			pending = append(pending, line)
+		case strings.HasPrefix(trimmed, "["):
+			header := strings.TrimLeft(trimmed, "[")
+			end := strings.Index(header, "]")
+			if end < 0 {
+				pending = nil
+				continue
+			}
+			table = splitTOMLKey(header[:end])
+			path := "[" + strings.Join(table, ".")
+			c.leading[path] = pending
+			c.lines[path] = number + 1
+			if rest := strings.TrimSpace(strings.TrimLeft(header[end:], "]")); strings.HasPrefix(rest, "#") {
+				c.trailing[path] = rest
+			}
+			pending = nil
+		default:
+			key, value, ok := strings.Cut(trimmed, "=")
+			if !ok {
+				pending = nil
+				continue
+			}
+			path := strings.Join(append(append([]string(nil), table...), splitTOMLKey(key)...), ".")
+			c.leading[path] = pending
+			c.lines[path] = number + 1
+			if comment := s.scan(value); comment != "" {
+				c.trailing[path] = comment
+			}
+			pending = nil
+		}
+	}
+
+	for len(pending) > 0 && strings.TrimSpace(pending[len(pending)-1]) == "" {
+		pending = pending[:len(pending)-1]
+	}
+	c.end = pending
+	return c
+}
+
+// splitTOMLKey splits a dotted TOML key into its unquoted parts.
+func splitTOMLKey(key string) []string {
+	var parts []string
+	var part strings.Builder
+	quote := byte(0)
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == '"' && c == '\\' && i+1 < len(key):
+			i++
+			part.WriteByte(key[i])
+		case quote != 0:
+			part.WriteByte(c)
+		case c == '"', c == '\'':
+			quote = c
+		case c == '.':
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+		case c != ' ' && c != '\t':
+			part.WriteByte(c)
+		}
+	}
+	return append(parts, strings.TrimSpace(part.String()))
+}
+
+// encodeTOML writes a mapping node as a TOML document with the given comments.
+func encodeTOML(root *yaml.Node, comments *tomlComments) ([]byte, error) {
+	var b bytes.Buffer
+	if err := encodeTOMLTable(&b, nil, root, comments); err != nil {
+		return nil, err
+	}
+	for _, line := range comments.end {
+		b.WriteString(line + "\n")
+	}
+	return b.Bytes(), nil
+}
+
+// encodeTOMLTable writes the keys of a table, then its sub-tables.
+func encodeTOMLTable(b *bytes.Buffer, path []string, table *yaml.Node, comments *tomlComments) error {
+	var tables []int
+	for i := 0; i+1 < len(table.Content); i += 2 {
+		key, value := table.Content[i], table.Content[i+1]
+		if value.Kind == yaml.MappingNode {
+			tables = append(tables, i)
+			continue
+		}
+		if value.Tag == "!!null" {
+			continue
+		}
+
+		raw, err := tomlValue(value)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %v", key.Value, err)
+		}
+		keyPath := strings.Join(append(append([]string(nil), path...), key.Value), ".")
+		for _, line := range comments.leading[keyPath] {
+			b.WriteString(line + "\n")
+		}
+		fmt.Fprintf(b, "%s = %s", tomlKey(key.Value), raw)
+		if comment := comments.trailing[keyPath]; comment != "" {
+			b.WriteString(" " + comment)
+		}
+		b.WriteString("\n")
+	}
+
+	for _, i := range tables {
+		tablePath := append(append([]string(nil), path...), table.Content[i].Value)
+		keys := make([]string, len(tablePath))
+		for j, part := range tablePath {
+			keys[j] = tomlKey(part)
+		}
+
+		commentPath := "[" + strings.Join(tablePath, ".")
+		leading, ok := comments.leading[commentPath]
+		if !ok && b.Len() > 0 {
+			leading = []string{""}
+		}
+		for _, line := range leading {
+			b.WriteString(line + "\n")
+		}
+		fmt.Fprintf(b, "[%s]", strings.Join(keys, "."))
+		if comment := comments.trailing[commentPath]; comment != "" {
+			b.WriteString(" " + comment)
+		}
+		b.WriteString("\n")
+
+		if err := encodeTOMLTable(b, tablePath, table.Content[i+1], comments); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tomlKey quotes a key unless it is a bare key.
+func tomlKey(key string) string {
+	if key == "" {
+		return `""`
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			quoted, _ := json.Marshal(key)
+			return string(quoted)
+		}
+	}
+	return key
+}
+
+// tomlValue encodes a scalar or an array of them. JSON strings, numbers and booleans
+// are valid TOML, so the JSON encoding is used. Strings spanning lines, such as
+// PEM keys, are written as multi-line literal strings instead.
+func tomlValue(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!str" && isMultilineLiteral(node.Value) {
+			return "'''\n" + node.Value + "'''", nil
+		}
+		if node.Tag == "!!str" {
+			encoded, err := json.Marshal(node.Value)
+			return string(encoded), err
+		}
+		return node.Value, nil
+	case yaml.SequenceNode:
+		items := make([]string, len(node.Content))
+		for i, item := range node.Content {
+			encoded, err := tomlValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = encoded
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	}
+	return "", fmt.Errorf("unsupported value")
+}
+
+// isMultilineLiteral reports whether s spans lines and can be written as a multi-line
+// literal string, which has no escapes.
+func isMultilineLiteral(s string) bool {
+	if !strings.Contains(s, "\n") || strings.Contains(s, "'''") {
+		return false
+	}
+	for _, c := range s {
+		if c < 0x20 && c != '\n' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+//go:build darwin
+
+package internal
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// BindToInterface restricts a socket to the given interface with IP_BOUND_IF or IPV6_BOUND_IF.
+// Its packets then use the scoped routes of the interface, such as the default route it got
+// from DHCP, which stay in place when a utun device takes over the global default.
+//
+// Parameters:
+//   - fd: uintptr - The socket.
+//   - network: string - The network of the socket (e.g. "udp4" or "tcp6").
+//   - ifaceName: string - The interface to bind to.
+//
+// Returns:
+//   - error: An error if the interface doesn't exist or the socket option couldn't be set.
+func BindToInterface(fd uintptr, network, ifaceName string) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(network, "6") {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_BOUND_IF, iface.Index)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BOUND_IF, iface.Index)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows && !darwin
+
+package internal
+
+import "errors"
+
+// BindToInterface is not supported on this platform.
+func BindToInterface(fd uintptr, network, ifaceName string) error {
+	return errors.New("binding to an interface is not supported on this platform")
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package internal
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// BindToInterface restricts a socket to the given interface with SO_BINDTODEVICE. The kernel
+// then only considers routes through that interface for it, so it isn't captured by routes
+// into a TUN device.
+//
+// Parameters:
+//   - fd: uintptr - The socket.
+//   - network: string - The network of the socket (e.g. "udp4" or "tcp6").
+//   - ifaceName: string - The interface to bind to.
+//
+// Returns:
+//   - error: An error if the socket option couldn't be set.
+func BindToInterface(fd uintptr, network, ifaceName string) error {
+	return unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifaceName)
+}
@@ -0,0 +1,43 @@
+//go:build windows
+
+package internal
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// IP_UNICAST_IF and IPV6_UNICAST_IF from ws2ipdef.h, missing from x/sys/windows.
+const (
+	ipUnicastIf   = 31
+	ipv6UnicastIf = 31
+)
+
+// BindToInterface sends the unicast traffic of a socket out of the given interface with
+// IP_UNICAST_IF or IPV6_UNICAST_IF, even where the best route points at another one. Unlike
+// on Linux, the socket still receives on every interface.
+//
+// Parameters:
+//   - fd: uintptr - The socket.
+//   - network: string - The network of the socket (e.g. "udp4" or "tcp6").
+//   - ifaceName: string - The interface to bind to.
+//
+// Returns:
+//   - error: An error if the interface doesn't exist or the socket option couldn't be set.
+func BindToInterface(fd uintptr, network, ifaceName string) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(network, "6") {
+		return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IPV6, ipv6UnicastIf, iface.Index)
+	}
+	// the IPv4 option takes the index in network byte order
+	var index [4]byte
+	binary.BigEndian.PutUint32(index[:], uint32(iface.Index))
+	return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IP, ipUnicastIf, int(binary.NativeEndian.Uint32(index[:])))
+}
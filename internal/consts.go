@@ -2,9 +2,8 @@ package internal
 
 const (
 	ApiUrl     = "https://api.cloudflareclient.com"
-	ApiVersion = "v0a4471"
 	ConnectSNI = "consumer-masque.cloudflareclient.com"
-	// unused for now
+	// ZeroTierSNI is the SNI of Zero Trust devices
 	ZeroTierSNI   = "zt-masque.cloudflareclient.com"
 	ConnectURI    = "https://cloudflareaccess.com"
 	DefaultModel  = "PC"
@@ -13,11 +12,41 @@ const (
 	KeyTypeMasque = "secp256r1"
 	TunTypeMasque = "masque"
 	DefaultLocale = "en_US"
+	// BuiltinClientVersion is the official client version we mimic by default
+	BuiltinClientVersion = "a-6.35-4471"
+	// ClientVersionManifestURL points to a manifest maintained in the repository
+	// with the latest client version known to be accepted by Cloudflare
+	ClientVersionManifestURL = "https://raw.githubusercontent.com/Diniboy1123/usque/main/client_version.json"
 )
 
+// ApiVersion is the API path version derived from the client version.
+// It is a variable so that it can be updated together with the client version at runtime.
+var ApiVersion = "v0a4471"
+
+// H3Settings are the additional HTTP/3 SETTINGS sent when connecting to the MASQUE server.
+// It is a variable so that protocol experiments can extend it at runtime.
+var H3Settings = map[uint64]uint64{
+	// official client still sends this out as well, even though
+	// it's deprecated, see https://datatracker.ietf.org/doc/draft-ietf-masque-h3-datagram/00/
+	// SETTINGS_H3_DATAGRAM_00 = 0x0000000000000276
+	// https://github.com/cloudflare/quiche/blob/7c66757dbc55b8d0c3653d4b345c6785a181f0b7/quiche/src/h3/frame.rs#L46
+	0x276: 1,
+}
+
 var Headers = map[string]string{
 	"User-Agent":        "WARP for Android",
-	"CF-Client-Version": "a-6.35-4471",
+	"CF-Client-Version": BuiltinClientVersion,
 	"Content-Type":      "application/json; charset=UTF-8",
 	"Connection":        "Keep-Alive",
 }
+
+// KnownMasqueEndpoints is a list of Cloudflare anycast IPs known to serve MASQUE.
+var KnownMasqueEndpoints = []string{
+	"162.159.198.1",
+	"162.159.198.2",
+	"2606:4700:103::1",
+	"2606:4700:103::2",
+}
+
+// KnownMasquePorts is a list of UDP ports the MASQUE endpoints are known to listen on.
+var KnownMasquePorts = []int{443, 500, 1701, 4443, 4500, 8095, 8443}
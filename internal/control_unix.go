@@ -0,0 +1,89 @@
+//go:build !windows
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// DefaultControlSocket is where the control socket is created unless configured otherwise.
+var DefaultControlSocket = defaultControlSocket()
+
+// defaultControlSocket places the socket in a directory only the current user can write to:
+// $XDG_RUNTIME_DIR, /run/usque for root, or a private directory in the temp directory.
+func defaultControlSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "usque.sock")
+	}
+	if os.Geteuid() == 0 {
+		if runtime.GOOS == "darwin" {
+			return "/var/run/usque/usque.sock"
+		}
+		return "/run/usque/usque.sock"
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("usque-%d", os.Geteuid()), "usque.sock")
+}
+
+// privateDir creates dir if it doesn't exist and makes sure only the current user can write to
+// it, so nobody else can put a socket of their own in place.
+func privateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Geteuid() || info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s isn't a directory only the current user can write to", dir)
+	}
+	return nil
+}
+
+// ListenControl creates the control socket at path, only accessible by the current user.
+// A stale socket left behind by a crashed process is replaced.
+//
+// Parameters:
+//   - path: string - The path of the unix socket.
+//
+// Returns:
+//   - net.Listener: The listener.
+//   - error: An error if another process is listening on path or the socket can't be created.
+func ListenControl(path string) (net.Listener, error) {
+	if filepath.Dir(path) == filepath.Dir(DefaultControlSocket) {
+		if err := privateDir(filepath.Dir(path)); err != nil {
+			return nil, fmt.Errorf("failed to prepare control socket directory: %v", err)
+		}
+	}
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict socket permissions: %v", err)
+	}
+	return listener, nil
+}
+
+// DialControl connects to the control socket at path.
+func DialControl(path string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", path, timeout)
+}
@@ -0,0 +1,45 @@
+//go:build windows
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/ipc/namedpipe"
+)
+
+// DefaultControlSocket is where the control pipe is created unless configured otherwise.
+const DefaultControlSocket = `\\.\pipe\usque`
+
+// controlPipeSecurity grants access to SYSTEM, administrators and the user with the SID.
+const controlPipeSecurity = "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GA;;;%s)"
+
+// ListenControl creates the control named pipe at path, only accessible by SYSTEM,
+// administrators and the current user.
+//
+// Parameters:
+//   - path: string - The path of the named pipe, such as \\.\pipe\usque.
+//
+// Returns:
+//   - net.Listener: The listener.
+//   - error: An error if the pipe exists already or can't be created.
+func ListenControl(path string) (net.Listener, error) {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current user: %v", err)
+	}
+	sd, err := windows.SecurityDescriptorFromString(fmt.Sprintf(controlPipeSecurity, user.User.Sid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create security descriptor: %v", err)
+	}
+	config := namedpipe.ListenConfig{SecurityDescriptor: sd}
+	return config.Listen(path)
+}
+
+// DialControl connects to the control named pipe at path.
+func DialControl(path string, timeout time.Duration) (net.Conn, error) {
+	return namedpipe.DialTimeout(path, timeout)
+}
@@ -0,0 +1,726 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// dnsMaxMessageSize is the largest DNS message we are willing to read from an upstream or a client.
+const dnsMaxMessageSize = 65535
+
+// dnsCacheEntry holds a cached raw DNS response and its expiry time.
+type dnsCacheEntry struct {
+	msg     []byte
+	expires time.Time
+}
+
+// DNSCache is a small TTL based cache for raw DNS responses keyed by their question.
+// It is safe for concurrent use.
+type DNSCache struct {
+	mu         sync.Mutex
+	entries    map[string]dnsCacheEntry
+	maxEntries int
+}
+
+// NewDNSCache creates a new DNSCache holding at most maxEntries responses.
+// If maxEntries is 0 or less, the cache holds up to 1024 entries.
+func NewDNSCache(maxEntries int) *DNSCache {
+	if maxEntries <= 0 {
+		maxEntries = 1024
+	}
+	return &DNSCache{
+		entries:    make(map[string]dnsCacheEntry),
+		maxEntries: maxEntries,
+	}
+}
+
+// Get returns a copy of the cached response for the given key if it has not expired yet.
+// Expired responses are kept for GetStale until Put needs the space.
+func (c *DNSCache) Get(key string) ([]byte, bool) {
+	return c.GetStale(key, 0)
+}
+
+// GetStale returns a copy of the cached response for the given key if it expired no longer than
+// maxStale ago, for serving stale answers as described in RFC 8767.
+//
+// Parameters:
+//   - key: string - The cache key.
+//   - maxStale: time.Duration - How long after its expiry a response is still returned.
+//
+// Returns:
+//   - []byte: The response.
+//   - bool: Whether a response was found.
+func (c *DNSCache) GetStale(key string, maxStale time.Duration) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires.Add(maxStale)) {
+		return nil, false
+	}
+
+	msg := make([]byte, len(entry.msg))
+	copy(msg, entry.msg)
+	return msg, true
+}
+
+// Put stores a copy of the response under the given key for ttl.
+// When the cache is full, expired entries are evicted first and if that
+// doesn't free up space, an arbitrary entry is dropped.
+func (c *DNSCache) Put(key string, msg []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.maxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+
+	stored := make([]byte, len(msg))
+	copy(stored, msg)
+	c.entries[key] = dnsCacheEntry{msg: stored, expires: time.Now().Add(ttl)}
+}
+
+// dnsMaxNegativeTTL caps how long negative answers (NXDOMAIN, NODATA) are cached.
+const dnsMaxNegativeTTL = 5 * time.Minute
+
+// dnsStaleTTL is the TTL of stale answers, as recommended by RFC 8767.
+const dnsStaleTTL = 30
+
+// DNSForwarder forwards raw DNS queries to upstream servers, either through
+// a MASQUE tunnel (if TunNet is set) or over the system network (if TunNet is nil).
+type DNSForwarder struct {
+	// TunNet is the network stack for the tunnel you want to forward queries through.
+	// If nil, queries are sent over the system network.
+	TunNet *netstack.Net
+
+	// Dial is an optional dial function used instead of the system network when TunNet is nil.
+	// Useful to pin queries to a native TUN interface.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Upstreams is the list of upstream DNS servers, tried in order.
+	Upstreams []netip.AddrPort
+
+	// Overrides maps domain suffixes to the upstreams that should be used for them
+	// instead of Upstreams. The longest matching suffix wins.
+	Overrides map[string][]netip.AddrPort
+
+	// Timeout is the timeout for a single upstream exchange before trying the next one.
+	Timeout time.Duration
+
+	// Cache is an optional response cache. If nil, every query is forwarded.
+	Cache *DNSCache
+
+	// Available optionally reports whether the upstreams can be reached, e.g. whether the tunnel is
+	// connected. While it returns false, queries are answered from the cache or with SERVFAIL right
+	// away, instead of letting clients wait for upstreams that can't answer.
+	Available func() bool
+
+	// ServeStale is how long after their expiry cached answers are still served, with a TTL of
+	// 30 seconds, when the upstreams can't be reached (RFC 8767). 0 disables stale answers.
+	ServeStale time.Duration
+}
+
+// Exchange forwards a raw DNS query to the upstream servers and returns the raw response.
+// Responses are served from the cache when possible, with the ID rewritten to match the query.
+// If no upstream answers, the response is a stale answer or SERVFAIL, so clients move on
+// instead of waiting for their own timeout.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the exchange.
+//   - query: []byte - The DNS query in wire format.
+//
+// Returns:
+//   - []byte: The DNS response in wire format.
+//   - error: An error if the query is malformed or no upstreams are configured.
+func (f *DNSForwarder) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %v", err)
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse question: %v", err)
+	}
+
+	key := dnsCacheKey(question)
+	if f.Cache != nil {
+		if msg, ok := f.Cache.Get(key); ok {
+			binary.BigEndian.PutUint16(msg, header.ID)
+			return msg, nil
+		}
+	}
+
+	if f.Available != nil && !f.Available() {
+		if msg, ok := f.staleAnswer(key, header.ID); ok {
+			return msg, nil
+		}
+		return dnsServerFailure(header, question)
+	}
+
+	upstreams := f.upstreamsFor(question.Name.String())
+	if len(upstreams) == 0 {
+		return nil, errors.New("no upstream DNS servers configured")
+	}
+
+	var lastErr error
+	for _, upstream := range upstreams {
+		resp, err := f.exchangeWith(ctx, upstream, query)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if f.Cache != nil {
+			f.Cache.Put(key, resp, dnsResponseTTL(resp))
+		}
+		return resp, nil
+	}
+
+	if msg, ok := f.staleAnswer(key, header.ID); ok {
+		return msg, nil
+	}
+	log.Printf("All upstream DNS servers failed for %s: %v", question.Name, lastErr)
+	return dnsServerFailure(header, question)
+}
+
+// staleAnswer returns the expired cached answer for key with its TTLs lowered to dnsStaleTTL,
+// if ServeStale allows it.
+func (f *DNSForwarder) staleAnswer(key string, id uint16) ([]byte, bool) {
+	if f.Cache == nil || f.ServeStale <= 0 {
+		return nil, false
+	}
+	msg, ok := f.Cache.GetStale(key, f.ServeStale)
+	if !ok {
+		return nil, false
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(msg); err != nil {
+		return nil, false
+	}
+	resp.ID = id
+	for _, section := range [][]dnsmessage.Resource{resp.Answers, resp.Authorities, resp.Additionals} {
+		for i := range section {
+			// the TTL of OPT records holds EDNS flags
+			if section[i].Header.Type != dnsmessage.TypeOPT {
+				section[i].Header.TTL = min(section[i].Header.TTL, dnsStaleTTL)
+			}
+		}
+	}
+	msg, err := resp.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return msg, true
+}
+
+// dnsServerFailure builds a SERVFAIL response to a query.
+func dnsServerFailure(query dnsmessage.Header, question dnsmessage.Question) ([]byte, error) {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		OpCode:             query.OpCode,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              dnsmessage.RCodeServerFailure,
+	})
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	return builder.Finish()
+}
+
+// upstreamsFor returns the upstreams to use for the given name,
+// taking per-domain overrides into account.
+func (f *DNSForwarder) upstreamsFor(name string) []netip.AddrPort {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	var best string
+	var bestUpstreams []netip.AddrPort
+	for domain, upstreams := range f.Overrides {
+		if name != domain && !strings.HasSuffix(name, "."+domain) {
+			continue
+		}
+		if len(domain) > len(best) || bestUpstreams == nil {
+			best = domain
+			bestUpstreams = upstreams
+		}
+	}
+	if bestUpstreams != nil {
+		return bestUpstreams
+	}
+
+	return f.Upstreams
+}
+
+// exchangeWith sends a query to a single upstream over UDP and falls back to TCP
+// if the response was truncated.
+func (f *DNSForwarder) exchangeWith(ctx context.Context, upstream netip.AddrPort, query []byte) ([]byte, error) {
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.Timeout)
+		defer cancel()
+	}
+
+	resp, err := f.exchangeUDP(ctx, upstream, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response from %s: %v", upstream, err)
+	}
+	if header.Truncated {
+		return f.exchangeTCP(ctx, upstream, query)
+	}
+
+	return resp, nil
+}
+
+// dial opens a connection to the upstream either through the tunnel or over the system network.
+func (f *DNSForwarder) dial(ctx context.Context, network string, upstream netip.AddrPort) (net.Conn, error) {
+	if f.TunNet != nil {
+		return f.TunNet.DialContext(ctx, network, upstream.String())
+	}
+	if f.Dial != nil {
+		return f.Dial(ctx, network, upstream.String())
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, upstream.String())
+}
+
+func (f *DNSForwarder) exchangeUDP(ctx context.Context, upstream netip.AddrPort, query []byte) ([]byte, error) {
+	conn, err := f.dial(ctx, "udp", upstream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %v", upstream, err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("failed to send query to %s: %v", upstream, err)
+	}
+
+	buf := make([]byte, dnsMaxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from %s: %v", upstream, err)
+	}
+
+	return buf[:n], nil
+}
+
+func (f *DNSForwarder) exchangeTCP(ctx context.Context, upstream netip.AddrPort, query []byte) ([]byte, error) {
+	conn, err := f.dial(ctx, "tcp", upstream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %v", upstream, err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := writeTCPDNSMessage(conn, query); err != nil {
+		return nil, fmt.Errorf("failed to send query to %s: %v", upstream, err)
+	}
+
+	resp, err := readTCPDNSMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from %s: %v", upstream, err)
+	}
+
+	return resp, nil
+}
+
+// writeTCPDNSMessage writes a length-prefixed DNS message as used by DNS over TCP.
+func writeTCPDNSMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readTCPDNSMessage reads a length-prefixed DNS message as used by DNS over TCP.
+func readTCPDNSMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// dnsCacheKey builds a case-insensitive cache key from a DNS question.
+func dnsCacheKey(q dnsmessage.Question) string {
+	return strings.ToLower(q.Name.String()) + "/" + q.Type.String() + "/" + q.Class.String()
+}
+
+// dnsResponseTTL returns how long a response may be cached, which is the lowest
+// TTL among its answers. Negative answers (NXDOMAIN or no answers) are cached
+// according to the SOA record in the authority section as described in RFC 2308.
+// Other error responses are not cached.
+func dnsResponseTTL(resp []byte) time.Duration {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(resp)
+	if err != nil {
+		return 0
+	}
+	if header.RCode != dnsmessage.RCodeSuccess && header.RCode != dnsmessage.RCodeNameError {
+		return 0
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return 0
+	}
+
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		return 0
+	}
+	if header.RCode == dnsmessage.RCodeNameError || len(answers) == 0 {
+		return dnsNegativeTTL(&parser)
+	}
+
+	minTTL := answers[0].Header.TTL
+	for _, answer := range answers[1:] {
+		if answer.Header.TTL < minTTL {
+			minTTL = answer.Header.TTL
+		}
+	}
+
+	return time.Duration(minTTL) * time.Second
+}
+
+// dnsNegativeTTL returns the negative caching TTL from the SOA record in the authority
+// section, which is the lower of the SOA record TTL and its MINIMUM field.
+// The parser must be positioned at the authority section.
+func dnsNegativeTTL(parser *dnsmessage.Parser) time.Duration {
+	authorities, err := parser.AllAuthorities()
+	if err != nil {
+		return 0
+	}
+
+	for _, authority := range authorities {
+		soa, ok := authority.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+		ttl := authority.Header.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		return min(time.Duration(ttl)*time.Second, dnsMaxNegativeTTL)
+	}
+
+	return 0
+}
+
+// ServeHTTP implements a DNS-over-HTTPS (RFC 8484) endpoint supporting both
+// GET requests with a base64url "dns" parameter and POST requests with an
+// application/dns-message body.
+func (f *DNSForwarder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var query []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "Missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		var err error
+		query, err = base64.RawURLEncoding.DecodeString(param)
+		if err != nil {
+			http.Error(w, "Invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		query, err = io.ReadAll(io.LimitReader(r.Body, dnsMaxMessageSize))
+		if err != nil {
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp, err := f.Exchange(r.Context(), query)
+	if err != nil {
+		log.Printf("DoH query failed: %v", err)
+		http.Error(w, "DNS query failed", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(resp)
+}
+
+// ServeDoH starts a DNS-over-HTTPS server on the given address that answers
+// queries using the forwarder. Queries are accepted on the /dns-query path.
+// If certFile and keyFile are both set, the server uses TLS, otherwise plain HTTP.
+//
+// Parameters:
+//   - addr: string - The address to listen on.
+//   - certFile: string - Path to a PEM certificate. (optional)
+//   - keyFile: string - Path to the PEM private key for certFile. (optional)
+//
+// Returns:
+//   - error: An error if the server fails to start or stops unexpectedly.
+func (f *DNSForwarder) ServeDoH(addr, certFile, keyFile string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", f)
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	if certFile != "" && keyFile != "" {
+		return server.ListenAndServeTLS(certFile, keyFile)
+	}
+	return server.ListenAndServe()
+}
+
+// ParseDNSUpstreams parses a list of DNS server addresses into address-port pairs.
+// Entries without a port default to port 53.
+//
+// Parameters:
+//   - servers: []string - The DNS servers, either as "ip" or "ip:port" ("[ipv6]:port").
+//
+// Returns:
+//   - []netip.AddrPort: The parsed upstreams.
+//   - error: An error if any entry is invalid.
+func ParseDNSUpstreams(servers []string) ([]netip.AddrPort, error) {
+	var upstreams []netip.AddrPort
+	for _, server := range servers {
+		if addrPort, err := netip.ParseAddrPort(server); err == nil {
+			upstreams = append(upstreams, addrPort)
+			continue
+		}
+		addr, err := netip.ParseAddr(server)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS upstream %q: %v", server, err)
+		}
+		upstreams = append(upstreams, netip.AddrPortFrom(addr, 53))
+	}
+	return upstreams, nil
+}
+
+// ServeDNS starts a plain DNS server on the given address answering queries
+// over both UDP and TCP using the forwarder.
+//
+// Parameters:
+//   - addr: string - The address to listen on. (e.g., "127.0.0.1:53")
+//
+// Returns:
+//   - error: An error if either listener fails to start or stops unexpectedly.
+func (f *DNSForwarder) ServeDNS(addr string) error {
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %v", addr, err)
+	}
+	defer udpConn.Close()
+
+	tcpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on tcp %s: %v", addr, err)
+	}
+	defer tcpListener.Close()
+
+	errChan := make(chan error, 2)
+	go func() { errChan <- f.serveUDP(udpConn) }()
+	go func() { errChan <- f.serveTCP(tcpListener) }()
+
+	return <-errChan
+}
+
+func (f *DNSForwarder) serveUDP(conn net.PacketConn) error {
+	for {
+		buf := make([]byte, dnsMaxMessageSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("failed to read udp query: %v", err)
+		}
+
+		go func(query []byte, addr net.Addr) {
+			resp, err := f.Exchange(context.Background(), query)
+			if err != nil {
+				log.Printf("DNS query from %s failed: %v", addr, err)
+				return
+			}
+			resp, err = truncateForUDP(query, resp)
+			if err != nil {
+				log.Printf("Failed to truncate DNS response to %s: %v", addr, err)
+				return
+			}
+			if _, err := conn.WriteTo(resp, addr); err != nil {
+				log.Printf("Failed to write DNS response to %s: %v", addr, err)
+			}
+		}(buf[:n], addr)
+	}
+}
+
+// dnsMinUDPSize is the UDP payload size every DNS client accepts, larger responses need EDNS(0).
+const dnsMinUDPSize = 512
+
+// truncateForUDP fits a response into the UDP payload size the client announced in the OPT
+// record of its query, 512 bytes without one. Responses that don't fit, e.g. answers an upstream
+// sent over TCP, are replaced by their header and question with the TC bit set, which makes the
+// client retry over TCP (RFC 1035, RFC 6891).
+//
+// Parameters:
+//   - query: []byte - The DNS query in wire format.
+//   - resp: []byte - The DNS response in wire format.
+//
+// Returns:
+//   - []byte: The response to send over UDP.
+//   - error: An error if a response that doesn't fit can't be parsed.
+func truncateForUDP(query, resp []byte) ([]byte, error) {
+	limit := dnsMinUDPSize
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(query); err == nil && parser.SkipAllQuestions() == nil &&
+		parser.SkipAllAnswers() == nil && parser.SkipAllAuthorities() == nil {
+		if additionals, err := parser.AllAdditionals(); err == nil {
+			for _, additional := range additionals {
+				// the class of the OPT record is the UDP payload size of the client
+				if additional.Header.Type == dnsmessage.TypeOPT {
+					limit = max(limit, int(additional.Header.Class))
+				}
+			}
+		}
+	}
+	if len(resp) <= limit {
+		return resp, nil
+	}
+
+	header, err := parser.Start(resp)
+	if err != nil {
+		return nil, err
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	header.Truncated = true
+	builder := dnsmessage.NewBuilder(nil, header)
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, question := range questions {
+		if err := builder.Question(question); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
+
+func (f *DNSForwarder) serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("failed to accept tcp connection: %v", err)
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+			for {
+				conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+				query, err := readTCPDNSMessage(conn)
+				if err != nil {
+					return
+				}
+				resp, err := f.Exchange(context.Background(), query)
+				if err != nil {
+					log.Printf("DNS query from %s failed: %v", conn.RemoteAddr(), err)
+					return
+				}
+				if err := writeTCPDNSMessage(conn, resp); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+// ParseDNSOverrides parses per-domain upstream overrides.
+// Each entry has the format "domain=server[,server...]" where servers follow
+// the same format as in ParseDNSUpstreams.
+//
+// Parameters:
+//   - entries: []string - The override entries.
+//
+// Returns:
+//   - map[string][]netip.AddrPort: The upstreams keyed by lowercase domain.
+//   - error: An error if any entry is invalid.
+func ParseDNSOverrides(entries []string) (map[string][]netip.AddrPort, error) {
+	overrides := make(map[string][]netip.AddrPort)
+	for _, entry := range entries {
+		domain, servers, ok := strings.Cut(entry, "=")
+		domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+		if !ok || domain == "" || servers == "" {
+			return nil, fmt.Errorf("invalid DNS override %q (expected format: domain=server[,server])", entry)
+		}
+		upstreams, err := ParseDNSUpstreams(strings.Split(servers, ","))
+		if err != nil {
+			return nil, err
+		}
+		overrides[domain] = upstreams
+	}
+	return overrides, nil
+}
+
+// DNSUpstreamsFromAddrs turns a list of DNS server addresses into upstreams on port 53.
+func DNSUpstreamsFromAddrs(addrs []netip.Addr) []netip.AddrPort {
+	upstreams := make([]netip.AddrPort, 0, len(addrs))
+	for _, addr := range addrs {
+		upstreams = append(upstreams, netip.AddrPortFrom(addr, 53))
+	}
+	return upstreams
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsQuery builds a query for example.com, with an OPT record announcing udpSize if it isn't 0.
+func dnsQuery(t *testing.T, udpSize uint16) []byte {
+	t.Helper()
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET})
+	if udpSize > 0 {
+		builder.StartAdditionals()
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(int(udpSize), dnsmessage.RCodeSuccess, false); err != nil {
+			t.Fatal(err)
+		}
+		builder.OPTResource(opt, dnsmessage.OPTResource{})
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+// dnsAnswer builds a response to dnsQuery with TXT records adding up to about size bytes.
+func dnsAnswer(t *testing.T, size int) []byte {
+	t.Helper()
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, Response: true, RecursionDesired: true, RecursionAvailable: true})
+	builder.EnableCompression()
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET})
+	builder.StartAnswers()
+	for written := 0; written < size; written += 200 {
+		builder.TXTResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Class: dnsmessage.ClassINET, TTL: 60},
+			dnsmessage.TXTResource{TXT: []string{string(make([]byte, 200))}})
+	}
+	resp, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestTruncateForUDP(t *testing.T) {
+	tests := []struct {
+		name      string
+		udpSize   uint16
+		respSize  int
+		truncated bool
+	}{
+		{"small answer", 0, 200, false},
+		{"large answer without EDNS", 0, 1000, true},
+		{"large answer within EDNS size", 1232, 1000, false},
+		{"answer beyond EDNS size", 1232, 4000, true},
+		{"EDNS size below the minimum", 256, 400, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := dnsAnswer(t, tt.respSize)
+			got, err := truncateForUDP(dnsQuery(t, tt.udpSize), resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var msg dnsmessage.Message
+			if err := msg.Unpack(got); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if msg.Truncated != tt.truncated {
+				t.Errorf("TC bit = %v, want %v", msg.Truncated, tt.truncated)
+			}
+			if !tt.truncated && len(got) != len(resp) {
+				t.Errorf("response changed from %d to %d bytes", len(resp), len(got))
+			}
+			if tt.truncated && (len(msg.Answers) != 0 || len(msg.Questions) != 1 || msg.ID != 7) {
+				t.Errorf("truncated response has %d answers, %d questions and ID %d", len(msg.Answers), len(msg.Questions), msg.ID)
+			}
+		})
+	}
+}
+
+func TestExchangeUpstreamFailure(t *testing.T) {
+	forwarder := &DNSForwarder{
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+		Upstreams: []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:53")},
+	}
+
+	resp, err := forwarder.Exchange(context.Background(), dnsQuery(t, 0))
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if msg.RCode != dnsmessage.RCodeServerFailure || msg.ID != 7 || !msg.Response {
+		t.Errorf("response has RCode %v, ID %d, response bit %v, want SERVFAIL to ID 7", msg.RCode, msg.ID, msg.Response)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package internal
+
+import "errors"
+
+// SetSocketDSCP is not supported on this platform.
+func SetSocketDSCP(fd uintptr, network string, dscp uint8) error {
+	return errors.New("DSCP marking is not supported on this platform")
+}
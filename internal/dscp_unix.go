@@ -0,0 +1,32 @@
+//go:build linux || darwin
+
+package internal
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetSocketDSCP sets the DSCP value of the packets sent on a socket (IP_TOS for IPv4, IPV6_TCLASS
+// for IPv6), so routers on the way can prioritize them. The ECN bits are left 0.
+//
+// Parameters:
+//   - fd: uintptr - The socket.
+//   - network: string - The network of the socket, such as "udp4" or "tcp6".
+//   - dscp: uint8 - The DSCP value, 0 to 63.
+//
+// Returns:
+//   - error: An error if the socket option couldn't be set.
+func SetSocketDSCP(fd uintptr, network string, dscp uint8) error {
+	tos := int(dscp) << 2
+	if strings.HasSuffix(network, "4") {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+	}
+	if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos); err != nil {
+		return err
+	}
+	// dual-stack sockets send IPv4 packets too, IPv6-only sockets reject this
+	unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+package internal
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// killSwitchTable is the nftables table holding the kill switch rules.
+const killSwitchTable = "usque_killswitch"
+
+// runNft feeds a ruleset to nft.
+func runNft(ruleset string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// EnableKillSwitch installs nftables rules that drop all outgoing traffic except through the
+// TUN interface, to the MASQUE endpoints, on loopback, DHCP and IPv6 neighbor discovery.
+// Replies to incoming connections are still allowed, so existing SSH sessions survive.
+//
+// Parameters:
+//   - ifaceName: string - The TUN interface.
+//   - endpoints: []netip.AddrPort - The MASQUE endpoints.
+//
+// Returns:
+//   - error: An error if nft isn't available or refused the rules.
+func EnableKillSwitch(ifaceName string, endpoints []netip.AddrPort) error {
+	var b strings.Builder
+	// recreate the table if an earlier run didn't clean up
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", killSwitchTable, killSwitchTable)
+	fmt.Fprintf(&b, "table inet %s {\n", killSwitchTable)
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype filter hook output priority 0; policy drop;\n")
+	b.WriteString("\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(&b, "\t\toifname %q accept\n", ifaceName)
+	b.WriteString("\t\tct direction reply accept\n")
+	for _, endpoint := range endpoints {
+		family := "ip"
+		if endpoint.Addr().Is6() {
+			family = "ip6"
+		}
+		fmt.Fprintf(&b, "\t\t%s daddr %s udp dport %d accept\n", family, endpoint.Addr(), endpoint.Port())
+	}
+	b.WriteString("\t\tudp sport 68 udp dport 67 accept\n")
+	b.WriteString("\t\tudp sport 546 udp dport 547 accept\n")
+	b.WriteString("\t\ticmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	b.WriteString("\t}\n}\n")
+
+	return runNft(b.String())
+}
+
+// DisableKillSwitch removes the rules installed by EnableKillSwitch.
+func DisableKillSwitch() error {
+	return runNft(fmt.Sprintf("delete table inet %s\n", killSwitchTable))
+}
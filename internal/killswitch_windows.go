@@ -0,0 +1,336 @@
+//go:build windows
+
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modfwpuclnt = windows.NewLazySystemDLL("fwpuclnt.dll")
+
+	procFwpmEngineOpen0        = modfwpuclnt.NewProc("FwpmEngineOpen0")
+	procFwpmEngineClose0       = modfwpuclnt.NewProc("FwpmEngineClose0")
+	procFwpmTransactionBegin0  = modfwpuclnt.NewProc("FwpmTransactionBegin0")
+	procFwpmTransactionCommit0 = modfwpuclnt.NewProc("FwpmTransactionCommit0")
+	procFwpmTransactionAbort0  = modfwpuclnt.NewProc("FwpmTransactionAbort0")
+	procFwpmSubLayerAdd0       = modfwpuclnt.NewProc("FwpmSubLayerAdd0")
+	procFwpmFilterAdd0         = modfwpuclnt.NewProc("FwpmFilterAdd0")
+
+	procUuidCreate = windows.NewLazySystemDLL("rpcrt4.dll").NewProc("UuidCreate")
+)
+
+// killSwitchEngine is the WFP session holding the kill switch filters, 0 while disabled.
+var killSwitchEngine uintptr
+
+// WFP constants, see fwptypes.h and fwpmtypes.h.
+const (
+	rpcCAuthnWinNT = 10
+
+	fwpmSessionFlagDynamic = 0x1
+
+	fwpUint8                   = 1
+	fwpUint16                  = 2
+	fwpUint32                  = 3
+	fwpUint64                  = 4
+	fwpByteArray16             = 11
+	fwpMatchEqual              = 0
+	fwpMatchFlagsAll           = 6
+	fwpActionBlock             = 0x1001
+	fwpActionPermit            = 0x1002
+	fwpConditionFlagIsLoopback = 0x1
+
+	ipProtoUDP    = 17
+	ipProtoICMPv6 = 58
+)
+
+var (
+	fwpmLayerALEAuthConnectV4 = windows.GUID{Data1: 0xc38d57d1, Data2: 0x05a7, Data3: 0x4c33, Data4: [8]byte{0x90, 0x4f, 0x7f, 0xbc, 0xee, 0xe6, 0x0e, 0x82}}
+	fwpmLayerALEAuthConnectV6 = windows.GUID{Data1: 0x4a72393b, Data2: 0x319f, Data3: 0x44bc, Data4: [8]byte{0x84, 0xc3, 0xba, 0x54, 0xdc, 0xb3, 0xb6, 0xb4}}
+
+	fwpmConditionIPLocalInterface = windows.GUID{Data1: 0x4cd62a49, Data2: 0x59c3, Data3: 0x4969, Data4: [8]byte{0xb7, 0xf3, 0xbd, 0xa5, 0xd3, 0x28, 0x90, 0xa4}}
+	fwpmConditionIPRemoteAddress  = windows.GUID{Data1: 0xb235ae9a, Data2: 0x1d64, Data3: 0x49b8, Data4: [8]byte{0xa4, 0x4c, 0x5f, 0xf3, 0xd9, 0x09, 0x50, 0x45}}
+	fwpmConditionIPRemotePort     = windows.GUID{Data1: 0xc35a604d, Data2: 0xd22b, Data3: 0x4e1a, Data4: [8]byte{0x91, 0xb4, 0x68, 0xf6, 0x74, 0xee, 0x67, 0x4b}}
+	fwpmConditionIPLocalPort      = windows.GUID{Data1: 0x0c1ba1af, Data2: 0x5765, Data3: 0x453f, Data4: [8]byte{0xaf, 0x22, 0xa8, 0xf7, 0x91, 0xac, 0x77, 0x5b}}
+	fwpmConditionIPProtocol       = windows.GUID{Data1: 0x3971ef2b, Data2: 0x623e, Data3: 0x4f9a, Data4: [8]byte{0x8c, 0xb1, 0x6e, 0x79, 0xb8, 0x06, 0xb9, 0xa7}}
+	fwpmConditionFlags            = windows.GUID{Data1: 0x632ce23b, Data2: 0x5167, Data3: 0x435c, Data4: [8]byte{0x86, 0xd7, 0xe9, 0x03, 0x68, 0x4a, 0xa8, 0x0c}}
+)
+
+// fwpmDisplayData0 is the FWPM_DISPLAY_DATA0 structure.
+type fwpmDisplayData0 struct {
+	Name        *uint16
+	Description *uint16
+}
+
+// fwpmSession0 is the FWPM_SESSION0 structure.
+type fwpmSession0 struct {
+	SessionKey           windows.GUID
+	DisplayData          fwpmDisplayData0
+	Flags                uint32
+	TxnWaitTimeoutInMSec uint32
+	ProcessID            uint32
+	SID                  *windows.SID
+	Username             *uint16
+	KernelMode           int32
+}
+
+// fwpByteBlob is the FWP_BYTE_BLOB structure.
+type fwpByteBlob struct {
+	Size uint32
+	Data *uint8
+}
+
+// fwpmSublayer0 is the FWPM_SUBLAYER0 structure.
+type fwpmSublayer0 struct {
+	SubLayerKey  windows.GUID
+	DisplayData  fwpmDisplayData0
+	Flags        uint16
+	ProviderKey  *windows.GUID
+	ProviderData fwpByteBlob
+	Weight       uint16
+}
+
+// fwpValue0 is the FWP_VALUE0 and FWP_CONDITION_VALUE0 structure. Values up to
+// 32 bits are stored in Value itself, everything else is a pointer.
+type fwpValue0 struct {
+	Type  uint32
+	Value uintptr
+}
+
+// fwpmFilterCondition0 is the FWPM_FILTER_CONDITION0 structure.
+type fwpmFilterCondition0 struct {
+	FieldKey       windows.GUID
+	MatchType      uint32
+	ConditionValue fwpValue0
+}
+
+// fwpmAction0 is the FWPM_ACTION0 structure.
+type fwpmAction0 struct {
+	Type       uint32
+	FilterType windows.GUID
+}
+
+// fwpmFilter0 is the FWPM_FILTER0 structure.
+type fwpmFilter0 struct {
+	FilterKey           windows.GUID
+	DisplayData         fwpmDisplayData0
+	Flags               uint32
+	ProviderKey         *windows.GUID
+	ProviderData        fwpByteBlob
+	LayerKey            windows.GUID
+	SubLayerKey         windows.GUID
+	Weight              fwpValue0
+	NumFilterConditions uint32
+	FilterCondition     *fwpmFilterCondition0
+	Action              fwpmAction0
+	ProviderContextKey  [2]uint64 // union with rawContext
+	Reserved            *windows.GUID
+	FilterID            uint64
+	EffectiveWeight     fwpValue0
+}
+
+// wfpCall calls a WFP function and converts its result to an error.
+// Like LazyProc.Call, it keeps pointers passed as uintptr alive for the call.
+//
+//go:uintptrescapes
+func wfpCall(proc *windows.LazyProc, args ...uintptr) error {
+	if ret, _, _ := proc.Call(args...); ret != 0 {
+		return fmt.Errorf("%s failed: %v", proc.Name, windows.Errno(ret))
+	}
+	return nil
+}
+
+// newGUID returns a random GUID.
+func newGUID() (windows.GUID, error) {
+	var guid windows.GUID
+	if ret, _, _ := procUuidCreate.Call(uintptr(unsafe.Pointer(&guid))); ret != 0 {
+		return guid, fmt.Errorf("failed to create GUID: %v", windows.Errno(ret))
+	}
+	return guid, nil
+}
+
+// killSwitchFilters adds filters to the open transaction of engine.
+type killSwitchFilters struct {
+	engine   uintptr
+	sublayer windows.GUID
+	name     *uint16
+	// values referenced by conditions, kept on the heap until the filters are added
+	pinned []any
+}
+
+// uint64Value returns a condition value holding v.
+func (k *killSwitchFilters) uint64Value(v uint64) fwpValue0 {
+	p := &v
+	k.pinned = append(k.pinned, p)
+	return fwpValue0{Type: fwpUint64, Value: uintptr(unsafe.Pointer(p))}
+}
+
+// addrValue returns a condition value holding addr.
+func (k *killSwitchFilters) addrValue(addr netip.Addr) fwpValue0 {
+	if addr.Is4() {
+		ip := addr.As4()
+		// IPv4 addresses are given in host byte order
+		return fwpValue0{Type: fwpUint32, Value: uintptr(binary.BigEndian.Uint32(ip[:]))}
+	}
+	ip := addr.As16()
+	p := &ip
+	k.pinned = append(k.pinned, p)
+	return fwpValue0{Type: fwpByteArray16, Value: uintptr(unsafe.Pointer(p))}
+}
+
+// add adds a filter to the given layer. An empty conditions list matches all traffic.
+func (k *killSwitchFilters) add(layer windows.GUID, action uint32, weight uint8, conditions []fwpmFilterCondition0) error {
+	filter := fwpmFilter0{
+		DisplayData: fwpmDisplayData0{Name: k.name},
+		LayerKey:    layer,
+		SubLayerKey: k.sublayer,
+		Weight:      fwpValue0{Type: fwpUint8, Value: uintptr(weight)},
+		Action:      fwpmAction0{Type: action},
+	}
+	if len(conditions) > 0 {
+		filter.NumFilterConditions = uint32(len(conditions))
+		filter.FilterCondition = &conditions[0]
+	}
+
+	return wfpCall(procFwpmFilterAdd0, k.engine, uintptr(unsafe.Pointer(&filter)), 0, 0)
+}
+
+// EnableKillSwitch adds Windows Filtering Platform filters that block all outgoing connections
+// except through the TUN interface, to the MASQUE endpoints, on loopback, DHCP and IPv6 neighbor
+// discovery. The filters live in a dynamic session, so Windows removes them when usque exits.
+//
+// Parameters:
+//   - luid: uint64 - The LUID of the TUN interface.
+//   - endpoints: []netip.AddrPort - The MASQUE endpoints.
+//
+// Returns:
+//   - error: An error if the filters couldn't be added.
+func EnableKillSwitch(luid uint64, endpoints []netip.AddrPort) error {
+	if killSwitchEngine != 0 {
+		return fmt.Errorf("kill switch is already enabled")
+	}
+
+	name, err := windows.UTF16PtrFromString("usque kill switch")
+	if err != nil {
+		return err
+	}
+
+	session := fwpmSession0{
+		DisplayData:          fwpmDisplayData0{Name: name},
+		Flags:                fwpmSessionFlagDynamic,
+		TxnWaitTimeoutInMSec: windows.INFINITE,
+	}
+	var engine uintptr
+	if err := wfpCall(procFwpmEngineOpen0, 0, rpcCAuthnWinNT, 0, uintptr(unsafe.Pointer(&session)), uintptr(unsafe.Pointer(&engine))); err != nil {
+		return err
+	}
+
+	if err := addKillSwitchFilters(engine, name, luid, endpoints); err != nil {
+		procFwpmEngineClose0.Call(engine)
+		return err
+	}
+
+	killSwitchEngine = engine
+	return nil
+}
+
+// addKillSwitchFilters adds the kill switch sublayer and filters in a single transaction.
+func addKillSwitchFilters(engine uintptr, name *uint16, luid uint64, endpoints []netip.AddrPort) error {
+	sublayerKey, err := newGUID()
+	if err != nil {
+		return err
+	}
+
+	if err := wfpCall(procFwpmTransactionBegin0, engine, 0); err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			procFwpmTransactionAbort0.Call(engine)
+		}
+	}()
+
+	sublayer := fwpmSublayer0{
+		SubLayerKey: sublayerKey,
+		DisplayData: fwpmDisplayData0{Name: name},
+		Weight:      0xffff,
+	}
+	if err := wfpCall(procFwpmSubLayerAdd0, engine, uintptr(unsafe.Pointer(&sublayer)), 0); err != nil {
+		return err
+	}
+
+	k := &killSwitchFilters{engine: engine, sublayer: sublayerKey, name: name}
+	layers := []windows.GUID{fwpmLayerALEAuthConnectV4, fwpmLayerALEAuthConnectV6}
+
+	for _, layer := range layers {
+		permits := [][]fwpmFilterCondition0{
+			{{FieldKey: fwpmConditionIPLocalInterface, MatchType: fwpMatchEqual, ConditionValue: k.uint64Value(luid)}},
+			{{FieldKey: fwpmConditionFlags, MatchType: fwpMatchFlagsAll, ConditionValue: fwpValue0{Type: fwpUint32, Value: fwpConditionFlagIsLoopback}}},
+		}
+		if layer == fwpmLayerALEAuthConnectV4 {
+			permits = append(permits, udpPortConditions(68, 67))
+		} else {
+			permits = append(permits, udpPortConditions(546, 547), []fwpmFilterCondition0{
+				{FieldKey: fwpmConditionIPProtocol, MatchType: fwpMatchEqual, ConditionValue: fwpValue0{Type: fwpUint8, Value: ipProtoICMPv6}},
+			})
+		}
+
+		for _, endpoint := range endpoints {
+			addr := endpoint.Addr().Unmap()
+			if addr.Is4() != (layer == fwpmLayerALEAuthConnectV4) {
+				continue
+			}
+			permits = append(permits, k.endpointConditions(addr, endpoint.Port()))
+		}
+
+		for _, conditions := range permits {
+			if err := k.add(layer, fwpActionPermit, 15, conditions); err != nil {
+				return err
+			}
+		}
+		if err := k.add(layer, fwpActionBlock, 0, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := wfpCall(procFwpmTransactionCommit0, engine); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// udpPortConditions matches UDP traffic between the given local and remote ports.
+func udpPortConditions(local, remote uint16) []fwpmFilterCondition0 {
+	return []fwpmFilterCondition0{
+		{FieldKey: fwpmConditionIPProtocol, MatchType: fwpMatchEqual, ConditionValue: fwpValue0{Type: fwpUint8, Value: ipProtoUDP}},
+		{FieldKey: fwpmConditionIPLocalPort, MatchType: fwpMatchEqual, ConditionValue: fwpValue0{Type: fwpUint16, Value: uintptr(local)}},
+		{FieldKey: fwpmConditionIPRemotePort, MatchType: fwpMatchEqual, ConditionValue: fwpValue0{Type: fwpUint16, Value: uintptr(remote)}},
+	}
+}
+
+// endpointConditions matches UDP traffic to a MASQUE endpoint.
+func (k *killSwitchFilters) endpointConditions(addr netip.Addr, port uint16) []fwpmFilterCondition0 {
+	return []fwpmFilterCondition0{
+		{FieldKey: fwpmConditionIPProtocol, MatchType: fwpMatchEqual, ConditionValue: fwpValue0{Type: fwpUint8, Value: ipProtoUDP}},
+		{FieldKey: fwpmConditionIPRemoteAddress, MatchType: fwpMatchEqual, ConditionValue: k.addrValue(addr)},
+		{FieldKey: fwpmConditionIPRemotePort, MatchType: fwpMatchEqual, ConditionValue: fwpValue0{Type: fwpUint16, Value: uintptr(port)}},
+	}
+}
+
+// DisableKillSwitch removes the filters added by EnableKillSwitch.
+func DisableKillSwitch() error {
+	if killSwitchEngine == 0 {
+		return nil
+	}
+	// closing a dynamic session deletes everything added through it
+	err := wfpCall(procFwpmEngineClose0, killSwitchEngine)
+	killSwitchEngine = 0
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package internal
+
+import "errors"
+
+// SetSocketMark is not supported on this platform.
+func SetSocketMark(fd uintptr, mark uint32) error {
+	return errors.New("firewall marks are not supported on this platform")
+}
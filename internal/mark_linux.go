@@ -0,0 +1,20 @@
+//go:build linux
+
+package internal
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// SetSocketMark sets the firewall mark (SO_MARK) of a socket, so nftables, tc and
+// policy routing rules can match its packets.
+//
+// Parameters:
+//   - fd: uintptr - The socket.
+//   - mark: uint32 - The firewall mark.
+//
+// Returns:
+//   - error: An error if the socket option couldn't be set, e.g. without CAP_NET_ADMIN.
+func SetSocketMark(fd uintptr, mark uint32) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+}
@@ -0,0 +1,85 @@
+//go:build darwin
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/net/route"
+	"golang.org/x/sys/unix"
+)
+
+// WatchNetwork calls onChange whenever a default route or an address changes. Changes on
+// ignoreIface (e.g. our own TUN device) and route changes made by this process are ignored.
+// It listens on the routing socket, which sees the same changes SystemConfiguration reacts to
+// without requiring cgo.
+//
+// Parameters:
+//   - ignoreIface: string - Interface whose changes are ignored, may be empty.
+//   - onChange: func() - Called for every change, from a separate goroutine.
+//
+// Returns:
+//   - error: An error if the routing socket couldn't be opened.
+func WatchNetwork(ignoreIface string, onChange func()) error {
+	ignore := -1
+	if ignoreIface != "" {
+		if iface, err := net.InterfaceByName(ignoreIface); err == nil {
+			ignore = iface.Index
+		}
+	}
+
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("failed to open routing socket: %v", err)
+	}
+
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, os.Getpagesize())
+		for {
+			n, err := unix.Read(fd, buf)
+			if err != nil {
+				return
+			}
+			msgs, err := route.ParseRIB(route.RIBTypeRoute, buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, m := range msgs {
+				if networkChanged(m, ignore) {
+					onChange()
+					break
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// networkChanged reports whether a routing socket message is a relevant change.
+func networkChanged(m route.Message, ignore int) bool {
+	switch m := m.(type) {
+	case *route.RouteMessage:
+		if m.Index == ignore || m.ID == uintptr(os.Getpid()) {
+			return false
+		}
+		if m.Type != unix.RTM_ADD && m.Type != unix.RTM_DELETE && m.Type != unix.RTM_CHANGE {
+			return false
+		}
+		if len(m.Addrs) <= unix.RTAX_DST {
+			return false
+		}
+		switch dst := m.Addrs[unix.RTAX_DST].(type) {
+		case *route.Inet4Addr:
+			return dst.IP == [4]byte{}
+		case *route.Inet6Addr:
+			return dst.IP == [16]byte{}
+		}
+	case *route.InterfaceAddrMessage:
+		return m.Index != ignore
+	}
+	return false
+}
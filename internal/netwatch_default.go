@@ -0,0 +1,10 @@
+//go:build !linux && !windows && !darwin
+
+package internal
+
+import "errors"
+
+// WatchNetwork is not supported on this platform.
+func WatchNetwork(ignoreIface string, onChange func()) error {
+	return errors.New("watching for network changes is not supported on this platform")
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package internal
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// WatchNetwork calls onChange whenever a default route of the main routing table or an
+// address changes. Changes on ignoreIface (e.g. our own TUN device) are ignored.
+//
+// Parameters:
+//   - ignoreIface: string - Interface whose changes are ignored, may be empty.
+//   - onChange: func() - Called for every change, from a separate goroutine.
+//
+// Returns:
+//   - error: An error if the netlink subscriptions failed.
+func WatchNetwork(ignoreIface string, onChange func()) error {
+	ignore := -1
+	if ignoreIface != "" {
+		if link, err := netlink.LinkByName(ignoreIface); err == nil {
+			ignore = link.Attrs().Index
+		}
+	}
+
+	routes := make(chan netlink.RouteUpdate)
+	if err := netlink.RouteSubscribe(routes, nil); err != nil {
+		return fmt.Errorf("failed to subscribe to route changes: %v", err)
+	}
+	addrs := make(chan netlink.AddrUpdate)
+	if err := netlink.AddrSubscribe(addrs, nil); err != nil {
+		return fmt.Errorf("failed to subscribe to address changes: %v", err)
+	}
+
+	go func() {
+		for {
+			select {
+			case update, ok := <-routes:
+				if !ok {
+					return
+				}
+				if update.LinkIndex == ignore || update.Table != unix.RT_TABLE_MAIN {
+					continue
+				}
+				if update.Dst == nil {
+					onChange()
+				} else if ones, _ := update.Dst.Mask.Size(); ones == 0 {
+					onChange()
+				}
+			case update, ok := <-addrs:
+				if !ok {
+					return
+				}
+				if update.LinkIndex != ignore && !update.LinkAddress.IP.IsLoopback() {
+					onChange()
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,85 @@
+//go:build windows
+
+package internal
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	procNotifyIpInterfaceChange = modiphlpapi.NewProc("NotifyIpInterfaceChange")
+	procNotifyRouteChange2      = modiphlpapi.NewProc("NotifyRouteChange2")
+)
+
+// mibIPInterfaceRowHeader is the beginning of the MIB_IPINTERFACE_ROW structure.
+type mibIPInterfaceRowHeader struct {
+	Family        uint16
+	InterfaceLUID uint64
+}
+
+// WatchNetwork calls onChange whenever an interface or a default route changes.
+// Changes on ignoreIface (e.g. our own TUN device) are ignored.
+//
+// Parameters:
+//   - ignoreIface: string - Interface whose changes are ignored, may be empty.
+//   - onChange: func() - Called for every change, from a thread of the notification API.
+//
+// Returns:
+//   - error: An error if the notifications couldn't be registered.
+func WatchNetwork(ignoreIface string, onChange func()) error {
+	var ignore uint64
+	if ignoreIface != "" {
+		if luid, err := InterfaceLUID(ignoreIface); err == nil {
+			ignore = luid
+		}
+	}
+
+	interfaceCallback := windows.NewCallback(func(callerContext uintptr, row *mibIPInterfaceRowHeader, notificationType uint32) uintptr {
+		if row != nil && row.InterfaceLUID != ignore {
+			onChange()
+		}
+		return 0
+	})
+	routeCallback := windows.NewCallback(func(callerContext uintptr, row *mibIPForwardRow2, notificationType uint32) uintptr {
+		if row != nil && row.InterfaceLUID != ignore && row.DestinationPrefix.PrefixLength == 0 {
+			onChange()
+		}
+		return 0
+	})
+
+	var interfaceHandle, routeHandle windows.Handle
+	if ret, _, _ := procNotifyIpInterfaceChange.Call(windows.AF_UNSPEC, interfaceCallback, 0, 0, uintptr(unsafe.Pointer(&interfaceHandle))); ret != 0 {
+		return fmt.Errorf("failed to watch interface changes: %v", windows.Errno(ret))
+	}
+	if ret, _, _ := procNotifyRouteChange2.Call(windows.AF_UNSPEC, routeCallback, 0, 0, uintptr(unsafe.Pointer(&routeHandle))); ret != 0 {
+		return fmt.Errorf("failed to watch route changes: %v", windows.Errno(ret))
+	}
+
+	return nil
+}
+
+// WatchInterfaces calls onChange with the LUID of every interface whose IP configuration or
+// state changes, including interfaces being added or removed.
+//
+// Parameters:
+//   - onChange: func(luid uint64) - Called for every change, from a thread of the notification API.
+//
+// Returns:
+//   - error: An error if the notifications couldn't be registered.
+func WatchInterfaces(onChange func(luid uint64)) error {
+	callback := windows.NewCallback(func(callerContext uintptr, row *mibIPInterfaceRowHeader, notificationType uint32) uintptr {
+		if row != nil {
+			onChange(row.InterfaceLUID)
+		}
+		return 0
+	})
+
+	var handle windows.Handle
+	if ret, _, _ := procNotifyIpInterfaceChange.Call(windows.AF_UNSPEC, callback, 0, 0, uintptr(unsafe.Pointer(&handle))); ret != 0 {
+		return fmt.Errorf("failed to watch interface changes: %v", windows.Errno(ret))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+//go:build windows
+
+package internal
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// nrptKeyPath is where local Name Resolution Policy Table rules are stored.
+const nrptKeyPath = `SYSTEM\CurrentControlSet\Services\Dnscache\Parameters\DnsPolicyConfig`
+
+var procDnsFlushResolverCache = windows.NewLazySystemDLL("dnsapi.dll").NewProc("DnsFlushResolverCache")
+
+// AddNRPTRule adds a Name Resolution Policy Table rule, so names in the given domains
+// are resolved with the given servers, while everything else keeps using the system resolvers.
+//
+// Parameters:
+//   - name: string - A unique name for the rule, used to delete it.
+//   - domains: []string - The domains the rule applies to, including their subdomains.
+//   - servers: []netip.Addr - The DNS servers for these domains.
+//
+// Returns:
+//   - error: An error if the rule couldn't be written.
+func AddNRPTRule(name string, domains []string, servers []netip.Addr) error {
+	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, nrptKeyPath+`\`+name, registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("failed to create NRPT rule: %v", err)
+	}
+	defer key.Close()
+
+	namespaces := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		// a leading dot matches the domain and all of its subdomains
+		namespaces = append(namespaces, "."+strings.Trim(domain, "."))
+	}
+	addrs := make([]string, 0, len(servers))
+	for _, server := range servers {
+		addrs = append(addrs, server.String())
+	}
+
+	values := []func() error{
+		func() error { return key.SetDWordValue("Version", 2) },
+		func() error { return key.SetStringsValue("Name", namespaces) },
+		func() error { return key.SetStringValue("GenericDNSServers", strings.Join(addrs, ";")) },
+		func() error { return key.SetDWordValue("ConfigOptions", 0x8) }, // use GenericDNSServers
+		func() error { return key.SetStringValue("IPSECCARestriction", "") },
+	}
+	for _, set := range values {
+		if err := set(); err != nil {
+			registry.DeleteKey(registry.LOCAL_MACHINE, nrptKeyPath+`\`+name)
+			return fmt.Errorf("failed to write NRPT rule: %v", err)
+		}
+	}
+
+	flushDNSCache()
+	return nil
+}
+
+// DeleteNRPTRule removes a rule added with AddNRPTRule.
+func DeleteNRPTRule(name string) error {
+	if err := registry.DeleteKey(registry.LOCAL_MACHINE, nrptKeyPath+`\`+name); err != nil {
+		return fmt.Errorf("failed to delete NRPT rule: %v", err)
+	}
+
+	flushDNSCache()
+	return nil
+}
+
+// flushDNSCache drops cached answers, so rule changes apply right away.
+func flushDNSCache() {
+	procDnsFlushResolverCache.Call()
+}
@@ -0,0 +1,136 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// Checksum computes the internet checksum of b, as used by the IPv4 header and ICMPv4.
+func Checksum(b []byte) uint16 {
+	return ^fold(sum(0, b))
+}
+
+// PseudoHeaderChecksum computes the checksum of a transport message including the pseudo-header
+// of its IP packet, as used by TCP, UDP and ICMPv6.
+//
+// Parameters:
+//   - proto: uint8 - The protocol of the message.
+//   - src: netip.Addr - The source address of the packet.
+//   - dst: netip.Addr - The destination address of the packet.
+//   - b: []byte - The message, with its checksum field zeroed.
+//
+// Returns:
+//   - uint16: The checksum.
+func PseudoHeaderChecksum(proto uint8, src, dst netip.Addr, b []byte) uint16 {
+	s := sum(0, src.AsSlice())
+	s = sum(s, dst.AsSlice())
+	s += uint32(len(b)) + uint32(proto)
+	return ^fold(sum(s, b))
+}
+
+// ChecksumAdjust updates an internet checksum for data changing from old to updated,
+// as described in RFC 1624. Both must have an even length.
+func ChecksumAdjust(checksum uint16, old, updated []byte) uint16 {
+	acc := uint32(^checksum)
+	for i := 0; i+1 < len(old); i += 2 {
+		acc += uint32(^binary.BigEndian.Uint16(old[i:]))
+		acc += uint32(binary.BigEndian.Uint16(updated[i:]))
+	}
+	return ^fold(acc)
+}
+
+// sum adds b to s as 16 bit words, padding an odd length with a zero byte.
+func sum(s uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// fold folds the carries of s into 16 bits.
+func fold(s uint32) uint16 {
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
+
+// NewIPv4 builds an IPv4 packet without options around payload.
+//
+// Parameters:
+//   - proto: uint8 - The protocol of the payload.
+//   - ttl: uint8 - The TTL.
+//   - id: uint16 - The identification.
+//   - src: netip.Addr - The source address.
+//   - dst: netip.Addr - The destination address.
+//   - payload: []byte - The payload, copied.
+//
+// Returns:
+//   - []byte: The packet, with its header checksum set.
+func NewIPv4(proto, ttl uint8, id uint16, src, dst netip.Addr, payload []byte) []byte {
+	pkt := make([]byte, 20, 20+len(payload))
+	pkt[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(20+len(payload)))
+	binary.BigEndian.PutUint16(pkt[4:6], id)
+	pkt[8] = ttl
+	pkt[9] = proto
+	copy(pkt[12:16], src.AsSlice())
+	copy(pkt[16:20], dst.AsSlice())
+	binary.BigEndian.PutUint16(pkt[10:12], Checksum(pkt))
+	return append(pkt, payload...)
+}
+
+// NewIPv6 builds an IPv6 packet without extension headers around payload.
+//
+// Parameters:
+//   - proto: uint8 - The protocol of the payload.
+//   - hopLimit: uint8 - The hop limit.
+//   - src: netip.Addr - The source address.
+//   - dst: netip.Addr - The destination address.
+//   - payload: []byte - The payload, copied.
+//
+// Returns:
+//   - []byte: The packet.
+func NewIPv6(proto, hopLimit uint8, src, dst netip.Addr, payload []byte) []byte {
+	pkt := make([]byte, 40, 40+len(payload))
+	pkt[0] = 6 << 4
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(payload)))
+	pkt[6] = proto
+	pkt[7] = hopLimit
+	copy(pkt[8:24], src.AsSlice())
+	copy(pkt[24:40], dst.AsSlice())
+	return append(pkt, payload...)
+}
+
+// NewICMP builds an ICMP or ICMPv6 message in an IP packet of the family of src, with the
+// checksum of the message set.
+//
+// Parameters:
+//   - icmpType: uint8 - The message type.
+//   - code: uint8 - The message code.
+//   - rest: uint32 - The 4 bytes after the checksum.
+//   - body: []byte - What follows the 8 byte header, copied.
+//   - ttl: uint8 - The TTL or hop limit.
+//   - id: uint16 - The IPv4 identification, unused for IPv6.
+//   - src: netip.Addr - The source address.
+//   - dst: netip.Addr - The destination address, of the same family as src.
+//
+// Returns:
+//   - []byte: The packet.
+func NewICMP(icmpType, code uint8, rest uint32, body []byte, ttl uint8, id uint16, src, dst netip.Addr) []byte {
+	icmp := make([]byte, 8+len(body))
+	icmp[0] = icmpType
+	icmp[1] = code
+	binary.BigEndian.PutUint32(icmp[4:8], rest)
+	copy(icmp[8:], body)
+
+	if src.Is6() && !src.Is4In6() {
+		binary.BigEndian.PutUint16(icmp[2:4], PseudoHeaderChecksum(ProtoICMPv6, src, dst, icmp))
+		return NewIPv6(ProtoICMPv6, ttl, src, dst, icmp)
+	}
+	binary.BigEndian.PutUint16(icmp[2:4], Checksum(icmp))
+	return NewIPv4(ProtoICMP, ttl, id, src, dst, icmp)
+}
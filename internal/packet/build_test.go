@@ -0,0 +1,121 @@
+package packet
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want uint16
+	}{
+		// the example of RFC 1071, section 3
+		{"RFC 1071", []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, ^uint16(0xddf2)},
+		{"odd length", []byte{0x00, 0x01, 0xf2}, ^uint16(0xf201)},
+		{"carry", []byte{0xff, 0xff, 0x00, 0x01}, ^uint16(0x0001)},
+		{"empty", nil, 0xffff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Checksum(tt.b); got != tt.want {
+				t.Errorf("Checksum = %#04x, want %#04x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuiltChecksums(t *testing.T) {
+	tests := []struct {
+		name string
+		pkt  []byte
+	}{
+		{"IPv4 header", NewIPv4(ProtoUDP, 64, 0x1234, src4, dst4, udpHeader)},
+		{"ICMP", NewICMP(3, 4, 1400, udpHeader, 64, 7, src4, dst4)},
+		{"ICMP odd body", NewICMP(3, 4, 1400, udpHeader[:7], 64, 7, src4, dst4)},
+		{"ICMPv6", NewICMP(2, 0, 1280, udpHeader, 64, 0, src6, dst6)},
+		{"ICMPv6 odd body", NewICMP(2, 0, 1280, udpHeader[:7], 64, 0, src6, dst6)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, ok := Parse(tt.pkt)
+			if !ok {
+				t.Fatal("Parse failed")
+			}
+			if ip.TotalLen() != len(tt.pkt) {
+				t.Errorf("TotalLen = %d, want %d", ip.TotalLen(), len(tt.pkt))
+			}
+			// a valid checksum sums the covered data, checksum included, to zero
+			if !ip.IPv6() && Checksum(tt.pkt[:ip.HeaderLen()]) != 0 {
+				t.Error("invalid IPv4 header checksum")
+			}
+			proto, payload := ip.Transport()
+			switch proto {
+			case ProtoICMP:
+				if Checksum(payload) != 0 {
+					t.Error("invalid ICMP checksum")
+				}
+			case ProtoICMPv6:
+				if PseudoHeaderChecksum(proto, ip.Src(), ip.Dst(), payload) != 0 {
+					t.Error("invalid ICMPv6 checksum")
+				}
+			}
+		})
+	}
+}
+
+func TestPseudoHeaderChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		v6   bool
+	}{
+		{"IPv4", false},
+		{"IPv6", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := src4, dst4
+			if tt.v6 {
+				src, dst = src6, dst6
+			}
+			udp := append([]byte(nil), udpHeader...)
+			binary.BigEndian.PutUint16(udp[6:8], PseudoHeaderChecksum(ProtoUDP, src, dst, udp))
+			if PseudoHeaderChecksum(ProtoUDP, src, dst, udp) != 0 {
+				t.Error("checksum doesn't verify")
+			}
+			if PseudoHeaderChecksum(ProtoUDP, src, src, udp) == 0 {
+				t.Error("addresses aren't covered by the checksum")
+			}
+			if PseudoHeaderChecksum(ProtoTCP, src, dst, udp) == 0 {
+				t.Error("protocol isn't covered by the checksum")
+			}
+		})
+	}
+}
+
+func TestChecksumAdjust(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int
+		value  []byte
+	}{
+		{"TTL and protocol", 8, []byte{63, ProtoUDP}},
+		{"source address", 12, []byte{10, 0, 0, 1}},
+		{"destination address", 16, []byte{255, 255, 255, 255}},
+		{"unchanged", 12, []byte{172, 16, 0, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := NewIPv4(ProtoUDP, 64, 0x1234, src4, dst4, udpHeader)
+			old := append([]byte(nil), pkt[tt.offset:tt.offset+len(tt.value)]...)
+			copy(pkt[tt.offset:], tt.value)
+			adjusted := ChecksumAdjust(binary.BigEndian.Uint16(pkt[10:12]), old, tt.value)
+
+			binary.BigEndian.PutUint16(pkt[10:12], 0)
+			if want := Checksum(pkt[:20]); adjusted != want {
+				t.Errorf("ChecksumAdjust = %#04x, want %#04x", adjusted, want)
+			}
+		})
+	}
+}
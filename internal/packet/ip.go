@@ -0,0 +1,349 @@
+// Package packet provides bounds checked views of IP, TCP, UDP and ICMP headers and builds
+// the packets the tunnel answers with, so the header offsets are only written down once.
+// All multi-byte fields are in network byte order, no view needs its packet to be aligned.
+package packet
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// IP protocol numbers.
+const (
+	ProtoICMP   = 1
+	ProtoTCP    = 6
+	ProtoUDP    = 17
+	ProtoICMPv6 = 58
+)
+
+// IPv6 extension headers skipped by IP.Transport.
+const (
+	ipv6HopByHop     = 0
+	ipv6Routing      = 43
+	ipv6Fragment     = 44
+	ipv6AuthHeader   = 51
+	ipv6NoNextHeader = 59
+	ipv6DestOptions  = 60
+)
+
+// IP is a view of an IPv4 or IPv6 packet whose fixed header, and IPv4 options, are complete.
+// Its accessors don't need further length checks.
+type IP struct {
+	b         []byte
+	v6        bool
+	headerLen int
+}
+
+// Version returns the IP version of a packet, 0 if it's empty.
+func Version(b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	return int(b[0] >> 4)
+}
+
+// Parse returns a view of an IPv4 or IPv6 packet.
+//
+// Parameters:
+//   - b: []byte - The packet.
+//
+// Returns:
+//   - IP: The view.
+//   - bool: False if b isn't IPv4 or IPv6 or its header is cut off.
+func Parse(b []byte) (IP, bool) {
+	switch Version(b) {
+	case 4:
+		if len(b) < 20 {
+			return IP{}, false
+		}
+		headerLen := int(b[0]&0x0f) * 4
+		if headerLen < 20 || len(b) < headerLen {
+			return IP{}, false
+		}
+		return IP{b: b, headerLen: headerLen}, true
+	case 6:
+		if len(b) < 40 {
+			return IP{}, false
+		}
+		// extension headers are left to Transport
+		return IP{b: b, v6: true, headerLen: 40}, true
+	}
+	return IP{}, false
+}
+
+// Bytes returns the whole packet.
+func (p IP) Bytes() []byte { return p.b }
+
+// IPv6 reports whether the packet is IPv6.
+func (p IP) IPv6() bool { return p.v6 }
+
+// HeaderLen returns the length of the IPv4 header with its options, or of the fixed IPv6 header.
+func (p IP) HeaderLen() int { return p.headerLen }
+
+// Payload returns what follows the header returned by HeaderLen.
+func (p IP) Payload() []byte { return p.b[p.headerLen:] }
+
+// Protocol returns the IPv4 protocol or the IPv6 next header.
+func (p IP) Protocol() uint8 {
+	if p.v6 {
+		return p.b[6]
+	}
+	return p.b[9]
+}
+
+// TTL returns the IPv4 TTL or the IPv6 hop limit.
+func (p IP) TTL() uint8 {
+	if p.v6 {
+		return p.b[7]
+	}
+	return p.b[8]
+}
+
+// AddrLen returns the length of the addresses, 4 or 16.
+func (p IP) AddrLen() int {
+	if p.v6 {
+		return 16
+	}
+	return 4
+}
+
+// SrcOffset returns the offset of the source address.
+func (p IP) SrcOffset() int {
+	if p.v6 {
+		return 8
+	}
+	return 12
+}
+
+// DstOffset returns the offset of the destination address.
+func (p IP) DstOffset() int {
+	if p.v6 {
+		return 24
+	}
+	return 16
+}
+
+// Src returns the source address.
+func (p IP) Src() netip.Addr {
+	addr, _ := netip.AddrFromSlice(p.b[p.SrcOffset() : p.SrcOffset()+p.AddrLen()])
+	return addr
+}
+
+// Dst returns the destination address.
+func (p IP) Dst() netip.Addr {
+	addr, _ := netip.AddrFromSlice(p.b[p.DstOffset() : p.DstOffset()+p.AddrLen()])
+	return addr
+}
+
+// TotalLen returns the IPv4 total length, or the fixed IPv6 header plus its payload length.
+func (p IP) TotalLen() int {
+	if p.v6 {
+		return 40 + int(binary.BigEndian.Uint16(p.b[4:6]))
+	}
+	return int(binary.BigEndian.Uint16(p.b[2:4]))
+}
+
+// DontFragment reports whether the packet may not be fragmented on its way, which is always the
+// case for IPv6 and for IPv4 with the DF bit.
+func (p IP) DontFragment() bool {
+	return p.v6 || p.b[6]&0x40 != 0
+}
+
+// MoreFragments reports whether the IPv4 MF bit is set.
+func (p IP) MoreFragments() bool {
+	return !p.v6 && p.b[6]&0x20 != 0
+}
+
+// FragmentOffset returns the IPv4 fragment offset in bytes.
+func (p IP) FragmentOffset() int {
+	if p.v6 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(p.b[6:8])&0x1fff) * 8
+}
+
+// Fragment reports whether the packet is an IPv4 fragment, the first one included.
+// IPv6 fragments are told by their extension header, see FragmentHeader.
+func (p IP) Fragment() bool {
+	return p.MoreFragments() || p.FragmentOffset() != 0
+}
+
+// Transport returns the upper layer protocol and header, skipping IPv6 extension headers.
+// The header is nil for IPv4 and IPv6 fragments other than the first one, which don't carry it,
+// and for cut off extension headers.
+//
+// Returns:
+//   - uint8: The protocol.
+//   - []byte: The upper layer header and what follows it.
+func (p IP) Transport() (uint8, []byte) {
+	if !p.v6 {
+		if p.FragmentOffset() != 0 {
+			return p.Protocol(), nil
+		}
+		return p.Protocol(), p.Payload()
+	}
+	proto, payload, _ := p.extensions()
+	return proto, payload
+}
+
+// FragmentHeader reports whether an IPv6 packet carries a Fragment extension header, which
+// makes it a fragment, the first one included.
+func (p IP) FragmentHeader() bool {
+	if !p.v6 {
+		return false
+	}
+	_, _, fragment := p.extensions()
+	return fragment
+}
+
+// extensions skips the extension headers of an IPv6 packet.
+//
+// Returns:
+//   - uint8: The upper layer protocol.
+//   - []byte: The upper layer header and what follows it, nil if it isn't there, see Transport.
+//   - bool: Whether a Fragment extension header was skipped or stopped the walk.
+func (p IP) extensions() (uint8, []byte, bool) {
+	nextHeader, payload := p.Protocol(), p.Payload()
+	fragment := false
+	for {
+		var length int
+		switch nextHeader {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+			if len(payload) < 2 {
+				return nextHeader, nil, fragment
+			}
+			length = (int(payload[1]) + 1) * 8
+		case ipv6Fragment:
+			fragment = true
+			if len(payload) < 8 {
+				return nextHeader, nil, fragment
+			}
+			// only the first fragment carries the upper-layer header
+			if binary.BigEndian.Uint16(payload[2:4])&0xfff8 != 0 {
+				return payload[0], nil, fragment
+			}
+			length = 8
+		case ipv6AuthHeader:
+			if len(payload) < 2 {
+				return nextHeader, nil, fragment
+			}
+			length = (int(payload[1]) + 2) * 4
+		case ipv6NoNextHeader:
+			return nextHeader, nil, fragment
+		default:
+			return nextHeader, payload, fragment
+		}
+
+		if len(payload) < length {
+			return nextHeader, nil, fragment
+		}
+		nextHeader, payload = payload[0], payload[length:]
+	}
+}
+
+// SetTotalLen sets the IPv4 total length or the IPv6 payload length from the total length.
+func (p IP) SetTotalLen(n int) {
+	if p.v6 {
+		binary.BigEndian.PutUint16(p.b[4:6], uint16(n-40))
+		return
+	}
+	binary.BigEndian.PutUint16(p.b[2:4], uint16(n))
+}
+
+// SetFragment sets the IPv4 fragment offset in bytes, a multiple of 8, and the MF bit.
+// The DF bit is cleared. It does nothing for IPv6.
+func (p IP) SetFragment(offset int, more bool) {
+	if p.v6 {
+		return
+	}
+	flags := uint16(offset / 8)
+	if more {
+		flags |= 0x2000
+	}
+	binary.BigEndian.PutUint16(p.b[6:8], flags)
+}
+
+// SetTTL sets the IPv4 TTL or the IPv6 hop limit.
+func (p IP) SetTTL(ttl uint8) {
+	if p.v6 {
+		p.b[7] = ttl
+		return
+	}
+	p.b[8] = ttl
+}
+
+// UpdateChecksum computes the IPv4 header checksum again after the header changed.
+// IPv6 has none.
+func (p IP) UpdateChecksum() {
+	if p.v6 {
+		return
+	}
+	binary.BigEndian.PutUint16(p.b[10:12], 0)
+	binary.BigEndian.PutUint16(p.b[10:12], Checksum(p.b[:p.headerLen]))
+}
+
+// ChecksumOffset returns the offset of the IPv4 header checksum, -1 for IPv6.
+func (p IP) ChecksumOffset() int {
+	if p.v6 {
+		return -1
+	}
+	return 10
+}
+
+// TransportChecksumOffset returns the offset of the checksum of the TCP, UDP or ICMP header right
+// after the IP header, -1 if there is none to keep up to date: other protocols, IPv6 extension
+// headers, a cut off transport header, or UDP over IPv4 without a checksum.
+func (p IP) TransportChecksumOffset() int {
+	var off int
+	switch p.Protocol() {
+	case ProtoTCP:
+		off = p.headerLen + 16
+	case ProtoUDP:
+		off = p.headerLen + 6
+	case ProtoICMP, ProtoICMPv6:
+		off = p.headerLen + 2
+	default:
+		return -1
+	}
+	if len(p.b) < off+2 {
+		return -1
+	}
+	if p.Protocol() == ProtoUDP && !p.v6 && binary.BigEndian.Uint16(p.b[off:]) == 0 {
+		return -1
+	}
+	return off
+}
+
+// Rewrite replaces the bytes at off with value and adjusts the checksums covering them. Bytes of
+// the IPv4 header are covered by its checksum, the addresses also by the pseudo-header of TCP, UDP
+// and ICMPv6, and the bytes after the IP header by the transport checksum.
+//
+// Parameters:
+//   - off: int - The offset of the bytes in the packet.
+//   - value: []byte - The new bytes.
+func (p IP) Rewrite(off int, value []byte) {
+	old := p.b[off : off+len(value)]
+	pseudoHeader := off >= p.SrcOffset() && off+len(value) <= p.DstOffset()+p.AddrLen()
+	if sum := p.TransportChecksumOffset(); sum >= 0 && (off >= p.headerLen || pseudoHeader && p.Protocol() != ProtoICMP) {
+		adjusted := ChecksumAdjust(binary.BigEndian.Uint16(p.b[sum:]), old, value)
+		if adjusted == 0 && p.Protocol() == ProtoUDP {
+			// a zero UDP checksum means there is none
+			adjusted = 0xffff
+		}
+		binary.BigEndian.PutUint16(p.b[sum:], adjusted)
+	}
+	if sum := p.ChecksumOffset(); sum >= 0 && off < p.headerLen {
+		binary.BigEndian.PutUint16(p.b[sum:], ChecksumAdjust(binary.BigEndian.Uint16(p.b[sum:]), old, value))
+	}
+	copy(old, value)
+}
+
+// SetSrc replaces the source address, of the same IP version, and adjusts the checksums.
+func (p IP) SetSrc(addr netip.Addr) {
+	p.Rewrite(p.SrcOffset(), addr.AsSlice())
+}
+
+// SetDst replaces the destination address, of the same IP version, and adjusts the checksums.
+func (p IP) SetDst(addr netip.Addr) {
+	p.Rewrite(p.DstOffset(), addr.AsSlice())
+}
@@ -0,0 +1,283 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+var (
+	src4 = netip.MustParseAddr("172.16.0.2")
+	dst4 = netip.MustParseAddr("1.1.1.1")
+	src6 = netip.MustParseAddr("2606:4700:110::2")
+	dst6 = netip.MustParseAddr("2606:4700:4700::1111")
+
+	// udpHeader is a UDP header from port 12345 to 53 followed by 8 bytes of payload.
+	udpHeader = []byte{0x30, 0x39, 0x00, 0x35, 0, 16, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+)
+
+// withOptions inserts IPv4 options after the fixed header of pkt and fixes the lengths.
+func withOptions(pkt []byte, options []byte) []byte {
+	out := append(append(append([]byte(nil), pkt[:20]...), options...), pkt[20:]...)
+	out[0] = 4<<4 | byte((20+len(options))/4)
+	ip, _ := Parse(out)
+	ip.SetTotalLen(len(out))
+	ip.UpdateChecksum()
+	return out
+}
+
+// extension builds an IPv6 extension header of the given length in bytes.
+func extension(next uint8, length int) []byte {
+	header := make([]byte, length)
+	header[0] = next
+	header[1] = byte(length/8 - 1)
+	return header
+}
+
+// fragmentHeader builds an IPv6 Fragment extension header.
+func fragmentHeader(next uint8, offset int, more bool) []byte {
+	header := []byte{next, 0, byte(offset >> 8), byte(offset) &^ 7, 0, 0, 0, 1}
+	if more {
+		header[3] |= 1
+	}
+	return header
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestParse(t *testing.T) {
+	v4 := NewIPv4(ProtoUDP, 64, 1, src4, dst4, udpHeader)
+	v6 := NewIPv6(ProtoUDP, 64, src6, dst6, udpHeader)
+	options := withOptions(v4, []byte{1, 1, 1, 0})
+
+	badIHL := append([]byte(nil), v4...)
+	badIHL[0] = 4<<4 | 4
+
+	tests := []struct {
+		name      string
+		pkt       []byte
+		ok        bool
+		v6        bool
+		headerLen int
+	}{
+		{"empty", nil, false, false, 0},
+		{"unknown version", append([]byte{5 << 4}, v4[1:]...), false, false, 0},
+		{"IPv4", v4, true, false, 20},
+		{"IPv4 with options", options, true, false, 24},
+		{"IPv4 cut off fixed header", v4[:19], false, false, 0},
+		{"IPv4 cut off options", options[:22], false, false, 0},
+		{"IPv4 header length below 20", badIHL, false, false, 0},
+		{"IPv6", v6, true, true, 40},
+		{"IPv6 cut off fixed header", v6[:39], false, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, ok := Parse(tt.pkt)
+			if ok != tt.ok {
+				t.Fatalf("Parse ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if ip.IPv6() != tt.v6 || ip.HeaderLen() != tt.headerLen {
+				t.Errorf("IPv6 = %v, HeaderLen = %d, want %v, %d", ip.IPv6(), ip.HeaderLen(), tt.v6, tt.headerLen)
+			}
+			if !bytes.Equal(ip.Payload(), udpHeader) {
+				t.Errorf("Payload = %x, want %x", ip.Payload(), udpHeader)
+			}
+			if ip.TotalLen() != len(tt.pkt) {
+				t.Errorf("TotalLen = %d, want %d", ip.TotalLen(), len(tt.pkt))
+			}
+		})
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	tests := []struct {
+		name     string
+		pkt      []byte
+		src, dst netip.Addr
+	}{
+		{"IPv4", NewIPv4(ProtoUDP, 64, 1, src4, dst4, udpHeader), src4, dst4},
+		{"IPv4 with options", withOptions(NewIPv4(ProtoUDP, 64, 1, src4, dst4, udpHeader), []byte{1, 1, 1, 0}), src4, dst4},
+		{"IPv6", NewIPv6(ProtoUDP, 64, src6, dst6, udpHeader), src6, dst6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, _ := Parse(tt.pkt)
+			if ip.Src() != tt.src || ip.Dst() != tt.dst {
+				t.Errorf("Src, Dst = %s, %s, want %s, %s", ip.Src(), ip.Dst(), tt.src, tt.dst)
+			}
+			src, _ := netip.AddrFromSlice(tt.pkt[ip.SrcOffset() : ip.SrcOffset()+ip.AddrLen()])
+			dst, _ := netip.AddrFromSlice(tt.pkt[ip.DstOffset() : ip.DstOffset()+ip.AddrLen()])
+			if src != tt.src || dst != tt.dst {
+				t.Errorf("SrcOffset, DstOffset point at %s, %s, want %s, %s", src, dst, tt.src, tt.dst)
+			}
+		})
+	}
+}
+
+func TestTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		pkt      []byte
+		proto    uint8
+		payload  []byte
+		fragment bool
+	}{
+		{"IPv4", NewIPv4(ProtoUDP, 64, 1, src4, dst4, udpHeader), ProtoUDP, udpHeader, false},
+		{"IPv4 with options", withOptions(NewIPv4(ProtoUDP, 64, 1, src4, dst4, udpHeader), []byte{1, 1, 1, 0}), ProtoUDP, udpHeader, false},
+		{"IPv6", NewIPv6(ProtoUDP, 64, src6, dst6, udpHeader), ProtoUDP, udpHeader, false},
+		{"IPv6 hop-by-hop and destination options", NewIPv6(ipv6HopByHop, 64, src6, dst6, concat(extension(ipv6DestOptions, 8), extension(ProtoUDP, 16), udpHeader)), ProtoUDP, udpHeader, false},
+		{"IPv6 routing header", NewIPv6(ipv6Routing, 64, src6, dst6, concat(extension(ProtoTCP, 24), udpHeader)), ProtoTCP, udpHeader, false},
+		{"IPv6 authentication header", NewIPv6(ipv6AuthHeader, 64, src6, dst6, concat([]byte{ProtoUDP, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, udpHeader)), ProtoUDP, udpHeader, false},
+		{"IPv6 first fragment", NewIPv6(ipv6Fragment, 64, src6, dst6, concat(fragmentHeader(ProtoUDP, 0, true), udpHeader)), ProtoUDP, udpHeader, true},
+		{"IPv6 later fragment", NewIPv6(ipv6Fragment, 64, src6, dst6, concat(fragmentHeader(ProtoUDP, 1280, false), udpHeader)), ProtoUDP, nil, true},
+		{"IPv6 fragment after options", NewIPv6(ipv6HopByHop, 64, src6, dst6, concat(extension(ipv6Fragment, 8), fragmentHeader(ProtoUDP, 8, true), udpHeader)), ProtoUDP, nil, true},
+		{"IPv6 cut off extension header", NewIPv6(ipv6HopByHop, 64, src6, dst6, extension(ProtoUDP, 16)[:8]), ipv6HopByHop, nil, false},
+		{"IPv6 cut off fragment header", NewIPv6(ipv6Fragment, 64, src6, dst6, fragmentHeader(ProtoUDP, 0, true)[:4]), ipv6Fragment, nil, true},
+		{"IPv6 no next header", NewIPv6(ipv6NoNextHeader, 64, src6, dst6, udpHeader), ipv6NoNextHeader, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, ok := Parse(tt.pkt)
+			if !ok {
+				t.Fatal("Parse failed")
+			}
+			proto, payload := ip.Transport()
+			if proto != tt.proto || !bytes.Equal(payload, tt.payload) || (payload == nil) != (tt.payload == nil) {
+				t.Errorf("Transport = %d, %x, want %d, %x", proto, payload, tt.proto, tt.payload)
+			}
+			if ip.FragmentHeader() != tt.fragment {
+				t.Errorf("FragmentHeader = %v, want %v", ip.FragmentHeader(), tt.fragment)
+			}
+		})
+	}
+}
+
+func TestFragmentIPv4(t *testing.T) {
+	tests := []struct {
+		name     string
+		offset   int
+		more     bool
+		fragment bool
+		payload  bool
+	}{
+		{"whole packet", 0, false, false, true},
+		{"first fragment", 0, true, true, true},
+		{"middle fragment", 1480, true, true, false},
+		{"last fragment", 2960, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := NewIPv4(ProtoUDP, 64, 1, src4, dst4, udpHeader)
+			pkt[6] |= 0x40
+			ip, _ := Parse(pkt)
+			if !ip.DontFragment() {
+				t.Fatal("DF bit not read")
+			}
+			ip.SetFragment(tt.offset, tt.more)
+			ip.UpdateChecksum()
+
+			if ip.DontFragment() {
+				t.Error("SetFragment kept the DF bit")
+			}
+			if ip.FragmentOffset() != tt.offset || ip.MoreFragments() != tt.more || ip.Fragment() != tt.fragment {
+				t.Errorf("FragmentOffset, MoreFragments, Fragment = %d, %v, %v, want %d, %v, %v",
+					ip.FragmentOffset(), ip.MoreFragments(), ip.Fragment(), tt.offset, tt.more, tt.fragment)
+			}
+			if _, payload := ip.Transport(); (payload != nil) != tt.payload {
+				t.Errorf("Transport payload = %x, want one: %v", payload, tt.payload)
+			}
+			if Checksum(pkt[:20]) != 0 {
+				t.Error("header checksum invalid after UpdateChecksum")
+			}
+		})
+	}
+}
+
+func TestIPv6Fields(t *testing.T) {
+	pkt := NewIPv6(ProtoUDP, 64, src6, dst6, udpHeader)
+	ip, _ := Parse(pkt)
+	if !ip.DontFragment() || ip.Fragment() || ip.MoreFragments() {
+		t.Errorf("DontFragment, Fragment, MoreFragments = %v, %v, %v, want true, false, false", ip.DontFragment(), ip.Fragment(), ip.MoreFragments())
+	}
+	ip.SetFragment(8, true)
+	if !bytes.Equal(pkt, NewIPv6(ProtoUDP, 64, src6, dst6, udpHeader)) {
+		t.Error("SetFragment changed an IPv6 packet")
+	}
+	ip.SetTTL(3)
+	if ip.TTL() != 3 {
+		t.Errorf("TTL = %d, want 3", ip.TTL())
+	}
+	if ip.ChecksumOffset() != -1 {
+		t.Errorf("ChecksumOffset = %d, want -1", ip.ChecksumOffset())
+	}
+}
+
+// udpPacket builds a UDP packet with udpHeader and a valid checksum.
+func udpPacket(src, dst netip.Addr) []byte {
+	udp := append([]byte(nil), udpHeader...)
+	binary.BigEndian.PutUint16(udp[6:], PseudoHeaderChecksum(ProtoUDP, src, dst, udp))
+	if src.Is4() {
+		return NewIPv4(ProtoUDP, 64, 0x1234, src, dst, udp)
+	}
+	return NewIPv6(ProtoUDP, 64, src, dst, udp)
+}
+
+func TestRewrite(t *testing.T) {
+	new4 := netip.MustParseAddr("10.0.0.7")
+	new6 := netip.MustParseAddr("fd00::7")
+	port := []byte{0x01, 0xbb}
+
+	tests := []struct {
+		name    string
+		pkt     []byte
+		rewrite func(IP)
+		check   func(IP) bool
+	}{
+		{"IPv4 source", udpPacket(src4, dst4), func(ip IP) { ip.SetSrc(new4) }, func(ip IP) bool { return ip.Src() == new4 }},
+		{"IPv4 destination", udpPacket(src4, dst4), func(ip IP) { ip.SetDst(new4) }, func(ip IP) bool { return ip.Dst() == new4 }},
+		{"IPv6 source", udpPacket(src6, dst6), func(ip IP) { ip.SetSrc(new6) }, func(ip IP) bool { return ip.Src() == new6 }},
+		{"IPv6 destination", udpPacket(src6, dst6), func(ip IP) { ip.SetDst(new6) }, func(ip IP) bool { return ip.Dst() == new6 }},
+		{"port", udpPacket(src4, dst4), func(ip IP) { ip.Rewrite(ip.HeaderLen(), port) }, func(ip IP) bool { return bytes.Equal(ip.Payload()[:2], port) }},
+		{"UDP without checksum", NewIPv4(ProtoUDP, 64, 0x1234, src4, dst4, udpHeader), func(ip IP) { ip.SetSrc(new4) }, func(ip IP) bool { return ip.Payload()[6] == 0 && ip.Payload()[7] == 0 }},
+		{"ICMP source", NewICMP(3, 4, 1400, udpHeader, 64, 7, src4, dst4), func(ip IP) { ip.SetSrc(new4) }, func(ip IP) bool { return ip.Src() == new4 }},
+		{"ICMP type", NewICMP(8, 0, 1, udpHeader, 64, 7, src4, dst4), func(ip IP) { ip.Rewrite(ip.HeaderLen(), []byte{0, 0}) }, func(ip IP) bool { return ip.Payload()[0] == 0 }},
+		{"ICMPv6 destination", NewICMP(2, 0, 1280, udpHeader, 64, 0, src6, dst6), func(ip IP) { ip.SetDst(new6) }, func(ip IP) bool { return ip.Dst() == new6 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, ok := Parse(tt.pkt)
+			if !ok {
+				t.Fatal("Parse failed")
+			}
+			tt.rewrite(ip)
+			if !tt.check(ip) {
+				t.Fatalf("packet not rewritten: %x", tt.pkt)
+			}
+			if !ip.IPv6() && Checksum(tt.pkt[:ip.HeaderLen()]) != 0 {
+				t.Error("invalid IPv4 header checksum")
+			}
+			payload := ip.Payload()
+			switch ip.Protocol() {
+			case ProtoICMP:
+				if Checksum(payload) != 0 {
+					t.Error("invalid ICMP checksum")
+				}
+			case ProtoUDP:
+				if !ip.IPv6() && binary.BigEndian.Uint16(payload[6:]) == 0 {
+					break
+				}
+				fallthrough
+			default:
+				if PseudoHeaderChecksum(ip.Protocol(), ip.Src(), ip.Dst(), payload) != 0 {
+					t.Error("invalid transport checksum")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package packet
+
+import "encoding/binary"
+
+// TCP flags.
+const (
+	TCPFlagSYN = 0x02
+	TCPFlagACK = 0x10
+)
+
+// TCPOptionMSS is the kind of the TCP maximum segment size option.
+const TCPOptionMSS = 2
+
+// TCP is a view of a TCP header whose options are complete.
+type TCP []byte
+
+// ParseTCP returns a view of a TCP header.
+//
+// Parameters:
+//   - b: []byte - The TCP header and what follows it.
+//
+// Returns:
+//   - TCP: The view.
+//   - bool: False if the header or its options are cut off.
+func ParseTCP(b []byte) (TCP, bool) {
+	if len(b) < 20 {
+		return nil, false
+	}
+	headerLen := int(b[12]>>4) * 4
+	if headerLen < 20 || len(b) < headerLen {
+		return nil, false
+	}
+	return TCP(b), true
+}
+
+// SrcPort returns the source port.
+func (t TCP) SrcPort() uint16 { return binary.BigEndian.Uint16(t[0:2]) }
+
+// DstPort returns the destination port.
+func (t TCP) DstPort() uint16 { return binary.BigEndian.Uint16(t[2:4]) }
+
+// Flags returns the flags, such as TCPFlagSYN.
+func (t TCP) Flags() uint8 { return t[13] }
+
+// HeaderLen returns the length of the header with its options.
+func (t TCP) HeaderLen() int { return int(t[12]>>4) * 4 }
+
+// Options returns the options, in place.
+func (t TCP) Options() []byte { return t[20:t.HeaderLen()] }
+
+// UDP is a view of a UDP header.
+type UDP []byte
+
+// ParseUDP returns a view of a UDP header.
+//
+// Parameters:
+//   - b: []byte - The UDP header and what follows it.
+//
+// Returns:
+//   - UDP: The view.
+//   - bool: False if the header is cut off.
+func ParseUDP(b []byte) (UDP, bool) {
+	if len(b) < 8 {
+		return nil, false
+	}
+	return UDP(b), true
+}
+
+// SrcPort returns the source port.
+func (u UDP) SrcPort() uint16 { return binary.BigEndian.Uint16(u[0:2]) }
+
+// DstPort returns the destination port.
+func (u UDP) DstPort() uint16 { return binary.BigEndian.Uint16(u[2:4]) }
+
+// Ports returns the source and destination ports of a TCP or UDP header, which both start
+// with them.
+//
+// Parameters:
+//   - proto: uint8 - The protocol of b.
+//   - b: []byte - The transport header, as returned by IP.Transport.
+//
+// Returns:
+//   - uint16: The source port.
+//   - uint16: The destination port.
+//   - bool: False for other protocols or a cut off header.
+func Ports(proto uint8, b []byte) (uint16, uint16, bool) {
+	if (proto != ProtoTCP && proto != ProtoUDP) || len(b) < 4 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint16(b[0:2]), binary.BigEndian.Uint16(b[2:4]), true
+}
+
+// ICMP is a view of an ICMP or ICMPv6 header.
+type ICMP []byte
+
+// ParseICMP returns a view of an ICMP or ICMPv6 header.
+//
+// Parameters:
+//   - b: []byte - The ICMP message.
+//
+// Returns:
+//   - ICMP: The view.
+//   - bool: False if the 8 byte header is cut off.
+func ParseICMP(b []byte) (ICMP, bool) {
+	if len(b) < 8 {
+		return nil, false
+	}
+	return ICMP(b), true
+}
+
+// Type returns the message type.
+func (m ICMP) Type() uint8 { return m[0] }
+
+// Code returns the message code.
+func (m ICMP) Code() uint8 { return m[1] }
+
+// ID returns the identifier of an echo message.
+func (m ICMP) ID() uint16 { return binary.BigEndian.Uint16(m[4:6]) }
+
+// Seq returns the sequence number of an echo message.
+func (m ICMP) Seq() uint16 { return binary.BigEndian.Uint16(m[6:8]) }
+
+// Rest returns the 4 bytes after the checksum, such as the MTU of an ICMPv6 packet too big.
+func (m ICMP) Rest() uint32 { return binary.BigEndian.Uint32(m[4:8]) }
+
+// Body returns what follows the 8 byte header, such as the packet an error quotes.
+func (m ICMP) Body() []byte { return m[8:] }
@@ -0,0 +1,59 @@
+//go:build linux
+
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// policyTable is the nftables table marking and translating per-application traffic.
+const policyTable = "usque_policy"
+
+// CgroupRoot is where the cgroup v2 hierarchy is mounted.
+const CgroupRoot = "/sys/fs/cgroup"
+
+// CgroupRelPath returns path relative to CgroupRoot, accepting both absolute
+// paths below CgroupRoot and paths that are already relative.
+func CgroupRelPath(path string) string {
+	path = filepath.Clean("/" + strings.TrimPrefix(path, CgroupRoot))
+	return strings.TrimPrefix(path, "/")
+}
+
+// EnablePolicyNAT installs nftables rules for per-application routing. Packets leaving through
+// the TUN interface with the given mark get the tunnel address as source, as the original source
+// address was picked for the regular interface. If cgroup is not empty, packets of processes in
+// that cgroup (relative to CgroupRoot) are marked as well.
+//
+// Parameters:
+//   - ifaceName: string - The TUN interface.
+//   - cgroup: string - The cgroup whose traffic is marked, or empty for marks set by the user.
+//   - mark: uint32 - The firewall mark selecting the tunnel routing table.
+//
+// Returns:
+//   - error: An error if nft isn't available or refused the rules.
+func EnablePolicyNAT(ifaceName, cgroup string, mark uint32) error {
+	var b strings.Builder
+	// declaring the table before deleting it lets the delete succeed whether or not a run that
+	// didn't clean up left one behind
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", policyTable, policyTable)
+	fmt.Fprintf(&b, "table inet %s {\n", policyTable)
+	if cgroup != "" {
+		b.WriteString("\tchain mark {\n")
+		b.WriteString("\t\ttype route hook output priority mangle; policy accept;\n")
+		fmt.Fprintf(&b, "\t\tsocket cgroupv2 level %d %q meta mark set %#x\n", strings.Count(cgroup, "/")+1, cgroup, mark)
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("\tchain nat {\n")
+	b.WriteString("\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+	fmt.Fprintf(&b, "\t\toifname %q meta mark %#x masquerade\n", ifaceName, mark)
+	b.WriteString("\t}\n}\n")
+
+	return runNft(b.String())
+}
+
+// DisablePolicyNAT removes the rules installed by EnablePolicyNAT.
+func DisablePolicyNAT() error {
+	return runNft(fmt.Sprintf("delete table inet %s\n", policyTable))
+}
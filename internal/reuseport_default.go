@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package internal
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ReusePort is not supported on this platform.
+func ReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("sharing a listening port between processes is not supported on this platform")
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin
+
+package internal
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReusePort is a net.ListenConfig control function setting SO_REUSEPORT, so several processes
+// can listen on the same address. Linux spreads new connections among the listeners. macOS
+// doesn't, it hands them all to one listener and the others only take over once it's closed.
+func ReusePort(network, address string, c syscall.RawConn) error {
+	var opErr error
+	if err := c.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,167 @@
+//go:build darwin
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"golang.org/x/net/route"
+	"golang.org/x/sys/unix"
+)
+
+// routeSeq numbers the messages we send on the routing socket.
+var routeSeq atomic.Int32
+
+// routeSockaddr converts an address to its routing socket representation.
+func routeSockaddr(addr netip.Addr) route.Addr {
+	if addr.Is4() {
+		return &route.Inet4Addr{IP: addr.As4()}
+	}
+	// link-local gateways need the interface as zone
+	zone, _ := strconv.Atoi(addr.Zone())
+	return &route.Inet6Addr{IP: addr.As16(), ZoneID: zone}
+}
+
+// routeNetmask returns the netmask of prefix in its routing socket representation.
+func routeNetmask(prefix netip.Prefix) route.Addr {
+	if prefix.Addr().Is4() {
+		var mask [4]byte
+		for i := 0; i < prefix.Bits(); i++ {
+			mask[i/8] |= 0x80 >> (i % 8)
+		}
+		return &route.Inet4Addr{IP: mask}
+	}
+	var mask [16]byte
+	for i := 0; i < prefix.Bits(); i++ {
+		mask[i/8] |= 0x80 >> (i % 8)
+	}
+	return &route.Inet6Addr{IP: mask}
+}
+
+// routeRequest sends a message on a new routing socket and returns the kernel's answer to it.
+func routeRequest(msg *route.RouteMessage) (*route.RouteMessage, error) {
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open routing socket: %v", err)
+	}
+	defer unix.Close(fd)
+
+	msg.Version = unix.RTM_VERSION
+	msg.ID = uintptr(os.Getpid())
+	msg.Seq = int(routeSeq.Add(1))
+
+	b, err := msg.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal route message: %v", err)
+	}
+	if _, err := unix.Write(fd, b); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, err := unix.Read(fd, buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read routing socket: %v", err)
+		}
+		msgs, err := route.ParseRIB(route.RIBTypeRoute, buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse route message: %v", err)
+		}
+		for _, m := range msgs {
+			reply, ok := m.(*route.RouteMessage)
+			// the socket also sees everybody else's routing changes
+			if ok && reply.Seq == msg.Seq && reply.ID == msg.ID {
+				return reply, reply.Err
+			}
+		}
+	}
+}
+
+// routeChange adds or deletes a route via the routing socket.
+func routeChange(typ int, prefix netip.Prefix, ifindex int, gateway netip.Addr) error {
+	msg := &route.RouteMessage{
+		Type:  typ,
+		Flags: unix.RTF_UP | unix.RTF_STATIC,
+		Index: ifindex,
+		Addrs: make([]route.Addr, unix.RTAX_NETMASK+1),
+	}
+	msg.Addrs[unix.RTAX_DST] = routeSockaddr(prefix.Addr())
+	if gateway.IsValid() {
+		msg.Flags |= unix.RTF_GATEWAY
+		msg.Addrs[unix.RTAX_GATEWAY] = routeSockaddr(gateway)
+	} else {
+		msg.Addrs[unix.RTAX_GATEWAY] = &route.LinkAddr{Index: ifindex}
+	}
+	if prefix.IsSingleIP() {
+		msg.Flags |= unix.RTF_HOST
+	} else {
+		msg.Addrs[unix.RTAX_NETMASK] = routeNetmask(prefix)
+	}
+
+	_, err := routeRequest(msg)
+	return err
+}
+
+// AddRoute adds a route using the routing socket.
+//
+// Parameters:
+//   - prefix: netip.Prefix - The destination prefix.
+//   - ifindex: int - The interface to route through.
+//   - gateway: netip.Addr - The gateway, or the zero Addr for a route directly to the interface.
+//
+// Returns:
+//   - error: An error if the route couldn't be created.
+func AddRoute(prefix netip.Prefix, ifindex int, gateway netip.Addr) error {
+	return routeChange(unix.RTM_ADD, prefix, ifindex, gateway)
+}
+
+// DeleteRoute removes a route previously added with AddRoute.
+func DeleteRoute(prefix netip.Prefix, ifindex int, gateway netip.Addr) error {
+	return routeChange(unix.RTM_DELETE, prefix, ifindex, gateway)
+}
+
+// FindRoute looks up the route the system currently uses to reach addr.
+//
+// Parameters:
+//   - addr: netip.Addr - The destination.
+//
+// Returns:
+//   - int: The index of the outgoing interface.
+//   - netip.Addr: The gateway, or the zero Addr if the destination is on-link.
+//   - error: An error if there is no route.
+func FindRoute(addr netip.Addr) (int, netip.Addr, error) {
+	msg := &route.RouteMessage{
+		Type:  unix.RTM_GET,
+		Flags: unix.RTF_UP | unix.RTF_HOST,
+		Addrs: []route.Addr{unix.RTAX_DST: routeSockaddr(addr)},
+	}
+
+	reply, err := routeRequest(msg)
+	if err != nil {
+		return 0, netip.Addr{}, fmt.Errorf("no route to %s: %v", addr, err)
+	}
+	if reply.Index == 0 {
+		return 0, netip.Addr{}, errors.New("route has no interface")
+	}
+
+	var gateway netip.Addr
+	if reply.Flags&unix.RTF_GATEWAY != 0 && len(reply.Addrs) > unix.RTAX_GATEWAY {
+		switch gw := reply.Addrs[unix.RTAX_GATEWAY].(type) {
+		case *route.Inet4Addr:
+			gateway = netip.AddrFrom4(gw.IP)
+		case *route.Inet6Addr:
+			gateway = netip.AddrFrom16(gw.IP)
+			if gw.ZoneID != 0 {
+				gateway = gateway.WithZone(strconv.Itoa(gw.ZoneID))
+			}
+		}
+	}
+
+	return reply.Index, gateway, nil
+}
@@ -0,0 +1,175 @@
+//go:build windows
+
+package internal
+
+import (
+	"fmt"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modiphlpapi = windows.NewLazySystemDLL("iphlpapi.dll")
+
+	procInitializeIpForwardEntry    = modiphlpapi.NewProc("InitializeIpForwardEntry")
+	procCreateIpForwardEntry2       = modiphlpapi.NewProc("CreateIpForwardEntry2")
+	procDeleteIpForwardEntry2       = modiphlpapi.NewProc("DeleteIpForwardEntry2")
+	procGetBestRoute2               = modiphlpapi.NewProc("GetBestRoute2")
+	procConvertInterfaceAliasToLuid = modiphlpapi.NewProc("ConvertInterfaceAliasToLuid")
+)
+
+// rawSockaddrInet is the SOCKADDR_INET union, large enough for both SOCKADDR_IN and SOCKADDR_IN6.
+type rawSockaddrInet struct {
+	Family uint16
+	data   [26]byte
+}
+
+// ipAddressPrefix is the IP_ADDRESS_PREFIX structure.
+type ipAddressPrefix struct {
+	Prefix       rawSockaddrInet
+	PrefixLength uint8
+	_            [2]byte
+}
+
+// mibIPForwardRow2 is the MIB_IPFORWARD_ROW2 structure describing a route.
+type mibIPForwardRow2 struct {
+	InterfaceLUID        uint64
+	InterfaceIndex       uint32
+	DestinationPrefix    ipAddressPrefix
+	NextHop              rawSockaddrInet
+	SitePrefixLength     uint8
+	ValidLifetime        uint32
+	PreferredLifetime    uint32
+	Metric               uint32
+	Protocol             uint32
+	Loopback             bool
+	AutoconfigureAddress bool
+	Publish              bool
+	Immortal             bool
+	Age                  uint32
+	Origin               uint32
+}
+
+// setAddr stores addr (port 0) in the sockaddr.
+func (s *rawSockaddrInet) setAddr(addr netip.Addr) {
+	*s = rawSockaddrInet{}
+	if addr.Is4() {
+		s.Family = windows.AF_INET
+		ip := addr.As4()
+		copy(s.data[2:6], ip[:]) // after sin_port
+		return
+	}
+	s.Family = windows.AF_INET6
+	ip := addr.As16()
+	copy(s.data[6:22], ip[:]) // after sin6_port and sin6_flowinfo
+}
+
+// addr returns the address stored in the sockaddr.
+func (s *rawSockaddrInet) addr() netip.Addr {
+	switch s.Family {
+	case windows.AF_INET:
+		return netip.AddrFrom4([4]byte(s.data[2:6]))
+	case windows.AF_INET6:
+		return netip.AddrFrom16([16]byte(s.data[6:22]))
+	}
+	return netip.Addr{}
+}
+
+// newForwardRow returns an initialized route row for prefix on the given interface.
+// An invalid or unspecified nexthop makes the route on-link.
+func newForwardRow(prefix netip.Prefix, luid uint64, nexthop netip.Addr, metric uint32) *mibIPForwardRow2 {
+	row := &mibIPForwardRow2{}
+	procInitializeIpForwardEntry.Call(uintptr(unsafe.Pointer(row)))
+
+	row.InterfaceLUID = luid
+	row.DestinationPrefix.Prefix.setAddr(prefix.Addr())
+	row.DestinationPrefix.PrefixLength = uint8(prefix.Bits())
+	if !nexthop.IsValid() {
+		nexthop = netip.IPv4Unspecified()
+		if prefix.Addr().Is6() {
+			nexthop = netip.IPv6Unspecified()
+		}
+	}
+	row.NextHop.setAddr(nexthop)
+	row.Metric = metric
+	row.Protocol = 3 // MIB_IPPROTO_NETMGMT, a static route
+
+	return row
+}
+
+// InterfaceLUID returns the locally unique identifier of the interface with the given alias (name).
+func InterfaceLUID(ifaceName string) (uint64, error) {
+	alias, err := windows.UTF16PtrFromString(ifaceName)
+	if err != nil {
+		return 0, err
+	}
+
+	var luid uint64
+	if ret, _, _ := procConvertInterfaceAliasToLuid.Call(uintptr(unsafe.Pointer(alias)), uintptr(unsafe.Pointer(&luid))); ret != 0 {
+		return 0, fmt.Errorf("failed to find interface %s: %v", ifaceName, windows.Errno(ret))
+	}
+
+	return luid, nil
+}
+
+// AddRoute adds a non-persistent route using CreateIpForwardEntry2.
+//
+// Parameters:
+//   - prefix: netip.Prefix - The destination prefix.
+//   - luid: uint64 - The interface to route through.
+//   - nexthop: netip.Addr - The gateway, or the zero Addr for an on-link route.
+//   - metric: uint32 - The route metric, added to the interface metric by Windows.
+//
+// Returns:
+//   - error: An error if the route couldn't be created.
+func AddRoute(prefix netip.Prefix, luid uint64, nexthop netip.Addr, metric uint32) error {
+	row := newForwardRow(prefix, luid, nexthop, metric)
+	if ret, _, _ := procCreateIpForwardEntry2.Call(uintptr(unsafe.Pointer(row))); ret != 0 {
+		return windows.Errno(ret)
+	}
+	return nil
+}
+
+// DeleteRoute removes a route previously added with AddRoute.
+func DeleteRoute(prefix netip.Prefix, luid uint64, nexthop netip.Addr) error {
+	row := newForwardRow(prefix, luid, nexthop, 0)
+	if ret, _, _ := procDeleteIpForwardEntry2.Call(uintptr(unsafe.Pointer(row))); ret != 0 {
+		return windows.Errno(ret)
+	}
+	return nil
+}
+
+// FindRoute looks up the route Windows currently uses to reach addr.
+//
+// Parameters:
+//   - addr: netip.Addr - The destination.
+//
+// Returns:
+//   - uint64: The LUID of the outgoing interface.
+//   - netip.Addr: The gateway, or the zero Addr if the destination is on-link.
+//   - error: An error if there is no route.
+func FindRoute(addr netip.Addr) (uint64, netip.Addr, error) {
+	var dst, bestSrc rawSockaddrInet
+	dst.setAddr(addr)
+
+	var row mibIPForwardRow2
+	ret, _, _ := procGetBestRoute2.Call(
+		0, 0, 0,
+		uintptr(unsafe.Pointer(&dst)),
+		0,
+		uintptr(unsafe.Pointer(&row)),
+		uintptr(unsafe.Pointer(&bestSrc)),
+	)
+	if ret != 0 {
+		return 0, netip.Addr{}, fmt.Errorf("no route to %s: %v", addr, windows.Errno(ret))
+	}
+
+	nexthop := row.NextHop.addr()
+	if nexthop.IsUnspecified() {
+		nexthop = netip.Addr{}
+	}
+
+	return row.InterfaceLUID, nexthop, nil
+}
@@ -0,0 +1,285 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSpeedTestServer is the server speed tests run against by default.
+const DefaultSpeedTestServer = "https://speed.cloudflare.com"
+
+// speedTestChunk is the size of a single download or upload request. Requests are
+// repeated until the test duration is over, so it only has to be large enough
+// for the request overhead not to matter.
+const speedTestChunk = 25_000_000
+
+// speedTestLoadedInterval is how often latency is measured while a transfer runs.
+const speedTestLoadedInterval = 250 * time.Millisecond
+
+// SpeedTest measures latency and throughput against a server speaking the protocol of
+// speed.cloudflare.com: GET /__down?bytes=N returns N bytes and POST /__up discards the body.
+type SpeedTest struct {
+	// Server is the base URL of the speed test server.
+	Server string
+
+	// NewClient returns a new HTTP client with its own connections. Transfers and
+	// latency measurements use separate clients, so latency probes don't queue behind transfers.
+	NewClient func() *http.Client
+
+	// Duration is how long each transfer direction runs.
+	Duration time.Duration
+
+	// Connections is the number of parallel connections used for transfers.
+	Connections int
+}
+
+// LatencyResult holds the result of a latency measurement.
+type LatencyResult struct {
+	Samples int           `json:"samples"`
+	Median  time.Duration `json:"median"`
+	Jitter  time.Duration `json:"jitter"` // Mean difference between consecutive samples
+}
+
+// TransferResult holds the result of a download or upload measurement.
+type TransferResult struct {
+	Bytes         uint64        `json:"bytes"`
+	Duration      time.Duration `json:"duration"`
+	BitsPerSecond float64       `json:"bits_per_second"`
+	LoadedLatency LatencyResult `json:"loaded_latency"` // Latency measured while the transfer ran
+}
+
+// Latency measures the round trip time of count empty requests. The processing time
+// reported by the server is subtracted, so the result is close to the network round trip.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the requests.
+//   - count: int - The number of requests.
+//
+// Returns:
+//   - LatencyResult: The measured latency.
+//   - error: An error if no request succeeded.
+func (s *SpeedTest) Latency(ctx context.Context, count int) (LatencyResult, error) {
+	client := s.NewClient()
+	defer client.CloseIdleConnections()
+
+	// the first request also opens the connection, it isn't counted
+	if _, err := s.probe(ctx, client); err != nil {
+		return LatencyResult{}, err
+	}
+
+	var samples []time.Duration
+	var lastErr error
+	for range count {
+		rtt, err := s.probe(ctx, client)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		samples = append(samples, rtt)
+	}
+	if len(samples) == 0 {
+		return LatencyResult{}, lastErr
+	}
+	return latencyResult(samples), nil
+}
+
+// Download measures the download throughput.
+func (s *SpeedTest) Download(ctx context.Context) (TransferResult, error) {
+	return s.transfer(ctx, func(ctx context.Context, client *http.Client, counter *atomic.Uint64) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/__down?bytes=%d", s.Server, speedTestChunk), nil)
+		if err != nil {
+			return err
+		}
+		rsp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status: %s", rsp.Status)
+		}
+		_, err = io.Copy(io.Discard, &countingReader{r: rsp.Body, n: counter})
+		return err
+	})
+}
+
+// Upload measures the upload throughput.
+func (s *SpeedTest) Upload(ctx context.Context) (TransferResult, error) {
+	return s.transfer(ctx, func(ctx context.Context, client *http.Client, counter *atomic.Uint64) error {
+		body := &countingReader{r: io.LimitReader(zeroReader{}, speedTestChunk), n: counter}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Server+"/__up", body)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = speedTestChunk
+		req.Header.Set("Content-Type", "application/octet-stream")
+		rsp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer rsp.Body.Close()
+		io.Copy(io.Discard, rsp.Body)
+		if rsp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status: %s", rsp.Status)
+		}
+		return nil
+	})
+}
+
+// transfer runs request on Connections parallel connections for Duration, measuring
+// latency on another connection at the same time.
+func (s *SpeedTest) transfer(ctx context.Context, request func(context.Context, *http.Client, *atomic.Uint64) error) (TransferResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.Duration)
+	defer cancel()
+
+	var counter atomic.Uint64
+	var wg sync.WaitGroup
+	errs := make(chan error, s.Connections)
+	start := time.Now()
+	for range s.Connections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := s.NewClient()
+			defer client.CloseIdleConnections()
+			for ctx.Err() == nil {
+				if err := request(ctx, client, &counter); err != nil && ctx.Err() == nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	var loaded []time.Duration
+	probeClient := s.NewClient()
+	ticker := time.NewTicker(speedTestLoadedInterval)
+	for ctx.Err() == nil {
+		if rtt, err := s.probe(ctx, probeClient); err == nil {
+			loaded = append(loaded, rtt)
+		}
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+	ticker.Stop()
+	probeClient.CloseIdleConnections()
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+
+	result := TransferResult{Bytes: counter.Load(), Duration: elapsed}
+	if result.Bytes == 0 {
+		if err := <-errs; err != nil {
+			return result, err
+		}
+		return result, errors.New("no data transferred")
+	}
+	result.BitsPerSecond = float64(result.Bytes) * 8 / elapsed.Seconds()
+	if len(loaded) > 0 {
+		result.LoadedLatency = latencyResult(loaded)
+	}
+	return result, nil
+}
+
+// probe sends an empty request and returns the time from sending it to the first byte
+// of the response, minus the processing time reported in the Server-Timing header.
+func (s *SpeedTest) probe(ctx context.Context, client *http.Client) (time.Duration, error) {
+	var sent, received time.Time
+	trace := &httptrace.ClientTrace{
+		WroteRequest:         func(httptrace.WroteRequestInfo) { sent = time.Now() },
+		GotFirstResponseByte: func() { received = time.Now() },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, s.Server+"/__down?bytes=0", nil)
+	if err != nil {
+		return 0, err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status: %s", rsp.Status)
+	}
+
+	rtt := received.Sub(sent)
+	if processing := serverTiming(rsp.Header.Get("Server-Timing")); processing < rtt {
+		rtt -= processing
+	}
+	return rtt, nil
+}
+
+// serverTiming returns the cfRequestDuration of a Server-Timing header, 0 if it isn't set.
+func serverTiming(header string) time.Duration {
+	for _, metric := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(metric), ";")
+		if name != "cfRequestDuration" {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "dur="); ok {
+				ms, err := strconv.ParseFloat(value, 64)
+				if err == nil {
+					return time.Duration(ms * float64(time.Millisecond))
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// latencyResult computes the median and jitter of samples, in the order they were taken.
+func latencyResult(samples []time.Duration) LatencyResult {
+	var jitter time.Duration
+	for i := 1; i < len(samples); i++ {
+		diff := samples[i] - samples[i-1]
+		if diff < 0 {
+			diff = -diff
+		}
+		jitter += diff
+	}
+	if len(samples) > 1 {
+		jitter /= time.Duration(len(samples) - 1)
+	}
+
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + median) / 2
+	}
+	return LatencyResult{Samples: len(samples), Median: median, Jitter: jitter}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(uint64(n))
+	return n, err
+}
+
+// zeroReader reads zeros forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
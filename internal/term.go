@@ -0,0 +1,6 @@
+package internal
+
+import "errors"
+
+// ErrNotTerminal is returned by ReadPassword if there is no terminal to read from.
+var ErrNotTerminal = errors.New("not a terminal")
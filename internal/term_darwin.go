@@ -0,0 +1,9 @@
+package internal
+
+import "golang.org/x/sys/unix"
+
+// Requests to get and set the terminal attributes.
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+)
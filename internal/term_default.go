@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package internal
+
+import "os"
+
+// ReadPassword is not supported on this platform.
+func ReadPassword(f *os.File) (string, error) {
+	return "", ErrNotTerminal
+}
@@ -0,0 +1,40 @@
+//go:build linux || darwin
+
+package internal
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReadPassword reads a line from a terminal without echoing it, for passphrases.
+//
+// Parameters:
+//   - f: *os.File - The terminal, usually os.Stdin.
+//
+// Returns:
+//   - string: The line without the line break.
+//   - error: An error if f isn't a terminal or reading fails.
+func ReadPassword(f *os.File) (string, error) {
+	fd := int(f.Fd())
+	state, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return "", ErrNotTerminal
+	}
+	silent := *state
+	silent.Lflag &^= unix.ECHO
+	silent.Lflag |= unix.ICANON | unix.ISIG
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &silent); err != nil {
+		return "", err
+	}
+	defer unix.IoctlSetTermios(fd, ioctlSetTermios, state)
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// ReadPassword reads a line from a console without echoing it, for passphrases.
+//
+// Parameters:
+//   - f: *os.File - The console, usually os.Stdin.
+//
+// Returns:
+//   - string: The line without the line break.
+//   - error: An error if f isn't a console or reading fails.
+func ReadPassword(f *os.File) (string, error) {
+	handle := windows.Handle(f.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(handle, &mode); err != nil {
+		return "", ErrNotTerminal
+	}
+	silent := mode&^windows.ENABLE_ECHO_INPUT | windows.ENABLE_LINE_INPUT | windows.ENABLE_PROCESSED_INPUT
+	if err := windows.SetConsoleMode(handle, silent); err != nil {
+		return "", err
+	}
+	defer windows.SetConsoleMode(handle, mode)
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -8,9 +9,13 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
 	"math/big"
 	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -92,6 +97,20 @@ func GenerateEcKeyPair() ([]byte, []byte, error) {
 	return marshalledPrivKey, marshalledPubKey, nil
 }
 
+// GenerateWgKeyPair generates a new curve25519 key pair for WireGuard.
+//
+// Returns:
+//   - []byte: The 32 byte private key.
+//   - []byte: The 32 byte public key.
+//   - error:  An error if key generation fails.
+func GenerateWgKeyPair() ([]byte, []byte, error) {
+	privKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return privKey.Bytes(), privKey.PublicKey().Bytes(), nil
+}
+
 // GenerateCert creates a self-signed certificate using the provided ECDSA private and public keys.
 //
 // The certificate is valid for 24 hours.
@@ -316,3 +335,129 @@ func CheckIfname(name string) error {
 
 	return nil
 }
+
+// SetClientVersion overrides the official client version we mimic in API requests.
+// The API path version is derived from the build number at the end of the client version.
+//
+// Parameters:
+//   - clientVersion: string - The client version in the official format. (e.g., "a-6.35-4471")
+//
+// Returns:
+//   - error: An error if the client version is malformed.
+func SetClientVersion(clientVersion string) error {
+	if err := ValidateClientVersion(clientVersion); err != nil {
+		return err
+	}
+	parts := strings.Split(clientVersion, "-")
+	Headers["CF-Client-Version"] = clientVersion
+	ApiVersion = "v0" + parts[0] + parts[2]
+	return nil
+}
+
+// ValidateClientVersion checks the format of an official client version without using it.
+//
+// Parameters:
+//   - clientVersion: string - The client version. (e.g., "a-6.35-4471")
+//
+// Returns:
+//   - error: An error if the client version is malformed.
+func ValidateClientVersion(clientVersion string) error {
+	parts := strings.Split(clientVersion, "-")
+	if len(parts) != 3 || parts[2] == "" {
+		return errors.New("invalid client version format (expected format: platform-version-build)")
+	}
+	if _, err := strconv.Atoi(parts[2]); err != nil {
+		return errors.New("invalid client version build number")
+	}
+	return nil
+}
+
+// PrefixToIPNet converts a netip.Prefix to a *net.IPNet.
+//
+// Parameters:
+//   - prefix: netip.Prefix - The prefix to convert.
+//
+// Returns:
+//   - *net.IPNet: The equivalent IPNet.
+func PrefixToIPNet(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   net.IP(prefix.Addr().AsSlice()),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
+
+// WriteFileAtomic replaces a file by writing a temporary file next to it and renaming it over
+// the file, so a crash or a concurrent reader never sees a half written file. The mode of an
+// existing file is kept and a symlink is followed, so the file it points to is replaced.
+//
+// Parameters:
+//   - path: string - The path of the file.
+//   - data: []byte - The new content of the file.
+//   - perm: os.FileMode - The permissions of the file if it doesn't exist yet.
+//
+// Returns:
+//   - error: An error if the file couldn't be written.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// InterfaceTo returns the name of the interface the routing table sends packets to addr through.
+//
+// Parameters:
+//   - addr: netip.Addr - The destination.
+//
+// Returns:
+//   - string: The name of the interface.
+//   - error: An error if there is no route to addr or no interface has the source address.
+func InterfaceTo(addr netip.Addr) (string, error) {
+	// connecting a UDP socket only looks up the route, nothing is sent
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, 443)))
+	if err != nil {
+		return "", err
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+	conn.Close()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if prefix, ok := a.(*net.IPNet); ok && prefix.IP.Equal(local.AsSlice()) {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no interface has the address %s", local)
+}
@@ -0,0 +1,81 @@
+//go:build darwin
+
+package internal
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// SetIPv4Address assigns a point-to-point IPv4 address to a utun interface.
+func SetIPv4Address(ifaceName, ipAddr string) error {
+	cmd := exec.Command("ifconfig", ifaceName, "inet", ipAddr, ipAddr, "netmask", "255.255.255.255", "up")
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s", output)
+	}
+
+	log.Println("IPv4 address set successfully:", ipAddr)
+	return nil
+}
+
+// SetIPv6Address assigns an IPv6 address to a utun interface.
+func SetIPv6Address(ifaceName, ipAddr string, prefixLen int) error {
+	cmd := exec.Command("ifconfig", ifaceName, "inet6", ipAddr, "prefixlen", fmt.Sprint(prefixLen), "up")
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s", output)
+	}
+
+	log.Println("IPv6 address set successfully:", ipAddr)
+	return nil
+}
+
+// dnsStateKey returns the dynamic store key holding the DNS configuration of a service.
+func dnsStateKey(serviceID string) string {
+	return "State:/Network/Service/" + serviceID + "/DNS"
+}
+
+// runScutil feeds commands to scutil.
+func runScutil(commands string) error {
+	cmd := exec.Command("scutil")
+	cmd.Stdin = strings.NewReader(commands)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	// scutil exits successfully even if a command fails
+	if len(strings.TrimSpace(string(output))) > 0 {
+		return fmt.Errorf("%s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// SetDNS publishes the DNS servers in the SystemConfiguration dynamic store under the given
+// service ID. An empty supplemental match domain makes them the resolvers for all domains.
+func SetDNS(serviceID string, servers []netip.Addr) error {
+	addrs := make([]string, len(servers))
+	for i, server := range servers {
+		addrs[i] = server.String()
+	}
+
+	err := runScutil(fmt.Sprintf("d.init\nd.add ServerAddresses * %s\nd.add SupplementalMatchDomains * \"\"\nset %s\nquit\n",
+		strings.Join(addrs, " "), dnsStateKey(serviceID)))
+	if err != nil {
+		return err
+	}
+
+	log.Println("DNS servers set successfully:", strings.Join(addrs, ", "))
+	return nil
+}
+
+// RemoveDNS removes the DNS configuration published by SetDNS.
+func RemoveDNS(serviceID string) error {
+	return runScutil(fmt.Sprintf("remove %s\nquit\n", dnsStateKey(serviceID)))
+}
@@ -3,11 +3,40 @@
 package internal
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"log"
+	"net/netip"
 	"os/exec"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
 )
 
+// AdapterGUID derives a stable Wintun adapter GUID from the profile and the interface name.
+// Each pair gets its own adapter, so several profiles can run side by side even with the same
+// interface name, while Windows recognizes the same network (and its firewall profile) across restarts.
+// Without a profile, the GUID only depends on the name.
+func AdapterGUID(profile, ifaceName string) *windows.GUID {
+	key := "usque adapter " + ifaceName
+	if profile != "" {
+		key = "usque adapter " + profile + "/" + ifaceName
+	}
+	sum := sha256.Sum256([]byte(key))
+	guid := &windows.GUID{
+		Data1: binary.BigEndian.Uint32(sum[0:4]),
+		Data2: binary.BigEndian.Uint16(sum[4:6]),
+		Data3: binary.BigEndian.Uint16(sum[6:8]),
+	}
+	copy(guid.Data4[:], sum[8:16])
+	// RFC 9562 version 8 (custom) with the RFC 4122 variant
+	guid.Data3 = guid.Data3&0x0fff | 0x8000
+	guid.Data4[0] = guid.Data4[0]&0x3f | 0x80
+	return guid
+}
+
 func SetIPv4Address(ifaceName, ipAddr, mask string) error {
 	cmd := exec.Command("netsh", "interface", "ipv4", "set", "address",
 		fmt.Sprintf("name=\"%s\"", ifaceName),
@@ -37,29 +66,149 @@ func SetIPv6Address(ifaceName, ipAddr, mask string) error {
 }
 
 func SetIPv4MTU(ifaceName string, mtu int) error {
-	cmd := exec.Command("netsh", "interface", "ipv4", "set", "subinterface",
-		fmt.Sprintf("\"%s\"", ifaceName),
-		fmt.Sprintf("mtu=%d", mtu))
+	if err := setInterfaceMTU(ifaceName, windows.AF_INET, mtu); err != nil {
+		return err
+	}
+
+	log.Println("IPv4 MTU set successfully:", mtu)
+	return nil
+}
+
+func SetIPv6MTU(ifaceName string, mtu int) error {
+	if err := setInterfaceMTU(ifaceName, windows.AF_INET6, mtu); err != nil {
+		return err
+	}
+
+	log.Println("IPv6 MTU set successfully:", mtu)
+	return nil
+}
+
+var (
+	procInitializeIpInterfaceEntry = modiphlpapi.NewProc("InitializeIpInterfaceEntry")
+	procGetIpInterfaceEntry        = modiphlpapi.NewProc("GetIpInterfaceEntry")
+	procSetIpInterfaceEntry        = modiphlpapi.NewProc("SetIpInterfaceEntry")
+)
+
+// mibIPInterfaceRow is the MIB_IPINTERFACE_ROW structure, the per family settings of an interface.
+type mibIPInterfaceRow struct {
+	Family                               uint16
+	InterfaceLUID                        uint64
+	InterfaceIndex                       uint32
+	MaxReassemblySize                    uint32
+	InterfaceIdentifier                  uint64
+	MinRouterAdvertisementInterval       uint32
+	MaxRouterAdvertisementInterval       uint32
+	AdvertisingEnabled                   bool
+	ForwardingEnabled                    bool
+	WeakHostSend                         bool
+	WeakHostReceive                      bool
+	UseAutomaticMetric                   bool
+	UseNeighborUnreachabilityDetection   bool
+	ManagedAddressConfigurationSupported bool
+	OtherStatefulConfigurationSupported  bool
+	AdvertiseDefaultRoute                bool
+	RouterDiscoveryBehavior              int32
+	DadTransmits                         uint32
+	BaseReachableTime                    uint32
+	RetransmitTime                       uint32
+	PathMTUDiscoveryTimeout              uint32
+	LinkLocalAddressBehavior             int32
+	LinkLocalAddressTimeout              uint32
+	ZoneIndices                          [16]uint32
+	SitePrefixLength                     uint32
+	Metric                               uint32
+	NLMTU                                uint32
+	Connected                            bool
+	SupportsWakeUpPatterns               bool
+	SupportsNeighborDiscovery            bool
+	SupportsRouterDiscovery              bool
+	ReachableTime                        uint32
+	TransmitOffload                      uint8
+	ReceiveOffload                       uint8
+	DisableDefaultRoutes                 bool
+}
+
+// setInterfaceMTU sets the MTU of one address family of the interface with SetIpInterfaceEntry,
+// without spawning netsh and parsing its localized output.
+//
+// Parameters:
+//   - ifaceName: string - The interface name.
+//   - family: uint16 - windows.AF_INET or windows.AF_INET6.
+//   - mtu: int - The MTU.
+//
+// Returns:
+//   - error: An error if the interface isn't found or the MTU can't be set.
+func setInterfaceMTU(ifaceName string, family uint16, mtu int) error {
+	luid, err := InterfaceLUID(ifaceName)
+	if err != nil {
+		return err
+	}
+
+	row := &mibIPInterfaceRow{}
+	procInitializeIpInterfaceEntry.Call(uintptr(unsafe.Pointer(row)))
+	row.Family = family
+	row.InterfaceLUID = luid
+	if ret, _, _ := procGetIpInterfaceEntry.Call(uintptr(unsafe.Pointer(row))); ret != 0 {
+		return fmt.Errorf("failed to get interface %s: %v", ifaceName, windows.Errno(ret))
+	}
+
+	row.NLMTU = uint32(mtu)
+	// SetIpInterfaceEntry rejects the site prefix length GetIpInterfaceEntry returns for IPv4
+	if family == windows.AF_INET {
+		row.SitePrefixLength = 0
+	}
+	if ret, _, _ := procSetIpInterfaceEntry.Call(uintptr(unsafe.Pointer(row))); ret != 0 {
+		return fmt.Errorf("failed to set MTU of %s: %v", ifaceName, windows.Errno(ret))
+	}
+	return nil
+}
+
+// DisableIPv6RouterDiscovery disables router discovery on the interface, so Windows
+// doesn't autoconfigure additional (public or temporary privacy) IPv6 addresses on it.
+// The server only accepts the address assigned to us.
+func DisableIPv6RouterDiscovery(ifaceName string) error {
+	cmd := exec.Command("netsh", "interface", "ipv6", "set", "interface",
+		fmt.Sprintf("interface=\"%s\"", ifaceName),
+		"routerdiscovery=disabled", "managedaddress=disabled", "otherstateful=disabled")
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("%s", output)
 	}
 
-	log.Println("IPv4 MTU set successfully:", mtu)
+	log.Println("IPv6 router discovery disabled successfully")
 	return nil
 }
 
-func SetIPv6MTU(ifaceName string, mtu int) error {
-	cmd := exec.Command("netsh", "interface", "ipv6", "set", "subinterface",
-		fmt.Sprintf("\"%s\"", ifaceName),
-		fmt.Sprintf("mtu=%d", mtu))
+// SetInterfaceMetric sets the interface metric for the given address family ("ipv4" or "ipv6").
+// A lower metric makes Windows prefer the interface's routes over equally specific routes of others.
+func SetInterfaceMetric(ifaceName, family string, metric int) error {
+	cmd := exec.Command("netsh", "interface", family, "set", "interface",
+		fmt.Sprintf("interface=\"%s\"", ifaceName),
+		fmt.Sprintf("metric=%d", metric))
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("%s", output)
 	}
 
-	log.Println("IPv6 MTU set successfully:", mtu)
+	log.Printf("%s interface metric set successfully: %d", family, metric)
+	return nil
+}
+
+// SetInterfaceDNS sets the DNS servers of an interface using netsh.
+func SetInterfaceDNS(ifaceName string, servers []netip.Addr) error {
+	for i, server := range servers {
+		family := "ipv4"
+		if server.Is6() {
+			family = "ipv6"
+		}
+
+		args := []string{"interface", family, "add", "dnsservers", fmt.Sprintf("name=\"%s\"", ifaceName), server.String(), fmt.Sprintf("index=%d", i+1), "validate=no"}
+		if output, err := exec.Command("netsh", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to add DNS server %s: %s", server, strings.TrimSpace(string(output)))
+		}
+	}
+
 	return nil
 }
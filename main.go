@@ -10,6 +10,6 @@ import (
 func main() {
 	if err := cmd.Execute(); err != nil {
 		fmt.Println("Error:", err)
-		os.Exit(1)
+		os.Exit(cmd.ExitUsage)
 	}
 }
@@ -0,0 +1,344 @@
+// Package mobile exposes a small API to run usque inside Android and iOS VPN apps.
+// It is meant to be built with gomobile:
+//
+//	gomobile bind -target=android ./mobile
+//	gomobile bind -target=ios ./mobile
+//
+// The app creates the TUN device through VpnService (Android) or NEPacketTunnelProvider (iOS)
+// and passes its file descriptor to Tunnel.Start. Only types supported by gomobile are used.
+package mobile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// States reported by Tunnel.State.
+const (
+	StateStopped    = "stopped"
+	StateConnecting = "connecting"
+	StateConnected  = "connected"
+)
+
+// SocketProtector excludes a socket from the VPN, so the tunnel's own traffic doesn't loop
+// through itself. On Android, implement it with VpnService.protect.
+type SocketProtector interface {
+	// Protect is called with the file descriptor of every socket opened to the MASQUE server.
+	// It returns false if the socket couldn't be protected.
+	Protect(fd int) bool
+}
+
+// SetSocketProtector sets the protector used for all sockets opened to the MASQUE server.
+//
+// Parameters:
+//   - protector: SocketProtector - The protector, or nil to remove it.
+func SetSocketProtector(protector SocketProtector) {
+	if protector == nil {
+		api.SocketProtector = nil
+		return
+	}
+	api.SocketProtector = func(fd uintptr) error {
+		if !protector.Protect(int(fd)) {
+			return errors.New("failed to protect socket")
+		}
+		return nil
+	}
+}
+
+// SetFeature switches an experimental feature on or off at runtime. It applies from the next
+// connection. Start applies the features section of the config, so call it after Start to override it.
+//
+// Parameters:
+//   - name: string - The feature name, see api.Features.
+//   - enabled: bool - Whether the feature is enabled.
+//
+// Returns:
+//   - error: An error if the feature is unknown.
+func SetFeature(name string, enabled bool) error {
+	return api.Features.Set(api.Feature(name), enabled)
+}
+
+// Features returns the feature switches and their counters as JSON, see api.FeatureStatus for the fields.
+func Features() string {
+	data, err := json.Marshal(api.Features.Status())
+	if err != nil {
+		return "[]"
+	}
+	return string(data)
+}
+
+// StateListener is notified of tunnel state changes, so the app can update its UI without polling State.
+type StateListener interface {
+	// OnStateChanged is called with StateConnected or StateConnecting and a human readable detail,
+	// the endpoint when connected, otherwise the error. It must not block.
+	OnStateChanged(state string, detail string)
+}
+
+// SetStateListener sets the listener notified of tunnel state changes.
+//
+// Parameters:
+//   - listener: StateListener - The listener, or nil to remove it.
+func SetStateListener(listener StateListener) {
+	if listener == nil {
+		api.Hooks = api.TunnelHooks{}
+		return
+	}
+	api.Hooks = api.TunnelHooks{
+		OnConnect: func(endpoint *net.UDPAddr) {
+			listener.OnStateChanged(StateConnected, endpoint.String())
+		},
+		OnDisconnect: func(endpoint *net.UDPAddr, err error) {
+			listener.OnStateChanged(StateConnecting, err.Error())
+		},
+		OnError: func(err error) {
+			listener.OnStateChanged(StateConnecting, err.Error())
+		},
+	}
+}
+
+// Options holds the tunnel settings. Create it with NewOptions to get the defaults.
+type Options struct {
+	MTU                  int    // MTU of the TUN device, must match the one given to the OS
+	SNI                  string // SNI address to use for the MASQUE connection, empty to send none
+	ConnectHost          string // Host of the Connect-IP request, empty for the default
+	PinSHA256            string // Comma-separated SHA-256 public key pins the server must present, empty for none
+	ConnectPort          int    // Port of the MASQUE server, used unless the config has an endpoint list
+	IPv6                 bool   // Connect to the IPv6 endpoint, used unless the config has an endpoint list
+	KeepaliveSeconds     int    // Keepalive period of the QUIC connection
+	InitialPacketSize    int    // Initial packet size of the QUIC connection
+	ReconnectDelayMillis int    // Delay between reconnect attempts after transient failures
+}
+
+// NewOptions returns the default options, the same as the defaults of the command line tool.
+func NewOptions() *Options {
+	return &Options{
+		MTU:                  1280,
+		SNI:                  internal.ConnectSNI,
+		ConnectPort:          443,
+		KeepaliveSeconds:     30,
+		InitialPacketSize:    1242,
+		ReconnectDelayMillis: 1000,
+	}
+}
+
+// Tunnel runs the MASQUE tunnel on a TUN file descriptor provided by the OS.
+// Each Tunnel has its own counters and state, but only one can run per process, as the api
+// package keeps its settings, such as the SNI and the pinned keys, in package variables.
+type Tunnel struct {
+	tunnel *api.Tunnel
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	closer func() error
+}
+
+// running is set while any Tunnel of this process runs.
+var running atomic.Bool
+
+// NewTunnel creates a stopped tunnel.
+func NewTunnel() *Tunnel {
+	return &Tunnel{tunnel: api.NewTunnel()}
+}
+
+// Start connects to the MASQUE server and forwards packets between it and the TUN device.
+// It returns immediately, the connection is maintained in the background until Stop is called.
+//
+// Parameters:
+//   - configJSON: string - The contents of a config file created by `usque register`.
+//   - fd: int - The TUN file descriptor. The tunnel takes ownership and closes it on Stop.
+//   - options: *Options - The tunnel settings, nil for the defaults.
+//
+// Returns:
+//   - error: An error if the tunnel is already running or couldn't be set up.
+func (t *Tunnel) Start(configJSON string, fd int, options *Options) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cancel != nil {
+		return errors.New("tunnel is already running")
+	}
+	if !running.CompareAndSwap(false, true) {
+		return errors.New("another tunnel is already running in this process")
+	}
+	started := false
+	defer func() {
+		if !started {
+			running.Store(false)
+		}
+	}()
+	if options == nil {
+		options = NewOptions()
+	}
+
+	cfg, err := config.ParseConfig([]byte(configJSON))
+	if err != nil {
+		return err
+	}
+	for name, enabled := range cfg.Features {
+		if err := api.Features.Set(api.Feature(name), enabled); err != nil {
+			return err
+		}
+	}
+
+	privKey, err := cfg.GetEcPrivateKey()
+	if err != nil {
+		return fmt.Errorf("failed to get private key: %v", err)
+	}
+	peerPubKey, err := cfg.GetEcEndpointPublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to get public key: %v", err)
+	}
+	cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to generate cert: %v", err)
+	}
+	tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, options.SNI)
+	if err != nil {
+		return fmt.Errorf("failed to prepare TLS config: %v", err)
+	}
+	if err := api.SetConnectHost(options.ConnectHost); err != nil {
+		return err
+	}
+	var pins []string
+	if options.PinSHA256 != "" {
+		pins = strings.Split(options.PinSHA256, ",")
+	}
+	if err := api.SetPinnedKeys(pins); err != nil {
+		return err
+	}
+
+	endpoints, err := endpointList(&cfg, options)
+	if err != nil {
+		return err
+	}
+
+	device, closer, err := openTun(t.tunnel, fd, options.MTU)
+	if err != nil {
+		return fmt.Errorf("failed to open TUN device: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		api.MaintainTunnel(
+			ctx,
+			t.tunnel,
+			tlsConfig,
+			time.Duration(options.KeepaliveSeconds)*time.Second,
+			uint16(options.InitialPacketSize),
+			endpoints,
+			device,
+			options.MTU,
+			time.Duration(options.ReconnectDelayMillis)*time.Millisecond,
+		)
+	}()
+
+	t.cancel, t.done, t.closer = cancel, done, closer
+	started = true
+	return nil
+}
+
+// Stop disconnects the tunnel, closes the TUN file descriptor and waits for the tunnel to stop.
+// Stopping a stopped tunnel does nothing.
+func (t *Tunnel) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cancel == nil {
+		return
+	}
+
+	t.cancel()
+	// unblocks the goroutine reading from the device
+	t.closer()
+	<-t.done
+
+	t.cancel, t.done, t.closer = nil, nil, nil
+	running.Store(false)
+}
+
+// State returns one of StateStopped, StateConnecting and StateConnected.
+func (t *Tunnel) State() string {
+	t.mu.Lock()
+	running := t.cancel != nil
+	t.mu.Unlock()
+
+	switch {
+	case !running:
+		return StateStopped
+	case t.tunnel.Metrics.Snapshot().ConnectedSince.IsZero():
+		return StateConnecting
+	default:
+		return StateConnected
+	}
+}
+
+// Stats returns the tunnel counters as JSON, see api.MetricsSnapshot for the fields.
+func (t *Tunnel) Stats() string {
+	data, err := json.Marshal(t.tunnel.Metrics.Snapshot())
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// ConnectionStats returns the counters of the current connection as JSON, see api.ConnectionStats
+// for the fields. It returns "{}" while disconnected.
+func (t *Tunnel) ConnectionStats() string {
+	stats, ok := t.tunnel.Metrics.Connection()
+	if !ok {
+		return "{}"
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// ReconnectHistory returns the last n reconnect decisions as JSON, oldest first, see
+// api.ReconnectDecision for the fields. n <= 0 returns all kept decisions.
+func (t *Tunnel) ReconnectHistory(n int) string {
+	data, err := json.Marshal(api.Reconnects.Recent(n))
+	if err != nil {
+		return "[]"
+	}
+	return string(data)
+}
+
+// endpointList builds the endpoints to connect to from the config and options.
+func endpointList(cfg *config.Config, options *Options) (*api.EndpointList, error) {
+	if len(cfg.Endpoints) > 0 {
+		var endpoints []*net.UDPAddr
+		for _, entry := range cfg.Endpoints {
+			endpoint, err := net.ResolveUDPAddr("udp", entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid endpoint %q: %v", entry, err)
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		return api.NewEndpointList(endpoints)
+	}
+
+	endpoint := cfg.EndpointV4
+	if options.IPv6 {
+		endpoint = cfg.EndpointV6
+	}
+	return api.NewEndpointList([]*net.UDPAddr{{
+		IP:   net.ParseIP(endpoint),
+		Port: options.ConnectPort,
+	}})
+}
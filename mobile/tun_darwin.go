@@ -0,0 +1,21 @@
+//go:build darwin
+
+package mobile
+
+import (
+	"os"
+
+	"github.com/Diniboy1123/usque/api"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// openTun wraps the utun file descriptor of a NEPacketTunnelProvider.
+func openTun(tunnel *api.Tunnel, fd int, mtu int) (api.TunnelDevice, func() error, error) {
+	dev, err := tun.CreateTUNFromFile(os.NewFile(uintptr(fd), "utun"), mtu)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the packets on the descriptor start with the 4 byte protocol family, as on any utun
+	return api.NewNetstackAdapterWithOffset(tunnel, dev, 4), dev.Close, nil
+}
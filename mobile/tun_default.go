@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package mobile
+
+import (
+	"errors"
+
+	"github.com/Diniboy1123/usque/api"
+)
+
+func openTun(tunnel *api.Tunnel, fd int, mtu int) (api.TunnelDevice, func() error, error) {
+	return nil, nil, errors.New("TUN file descriptors are only supported on Android and iOS")
+}
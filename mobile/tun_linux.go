@@ -0,0 +1,19 @@
+//go:build linux
+
+package mobile
+
+import (
+	"github.com/Diniboy1123/usque/api"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// openTun wraps the TUN file descriptor handed out by Android's VpnService.
+// The device isn't monitored, as apps aren't allowed to open netlink sockets.
+func openTun(tunnel *api.Tunnel, fd int, mtu int) (api.TunnelDevice, func() error, error) {
+	dev, _, err := tun.CreateUnmonitoredTUNFromFD(fd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return api.NewNetstackAdapter(tunnel, dev), dev.Close, nil
+}
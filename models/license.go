@@ -0,0 +1,5 @@
+package models
+
+type LicenseUpdate struct {
+	License string `json:"license"`
+}